@@ -1,14 +1,22 @@
 package blockchain
 
 import (
+	"context"
 	"fmt"
 
 	"encoding/binary"
+	"net/http"
+	"time"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
 	"github.com/ipfs/go-cid"
 	logging "github.com/ipfs/go-log/v2"
 	ens "github.com/wealdtech/go-ens/v3"
+
+	"github.com/allisterb/patr/devnet"
+	"github.com/allisterb/patr/util"
 )
 
 type ENSName struct {
@@ -17,31 +25,66 @@ type ENSName struct {
 	NostrPubKey string
 	ContentHash cid.Cid
 	Avatar      string
+	// AvatarNFT is set when the avatar references an NFT, with Verified set if the address of the name owns it.
+	AvatarNFT *NFT `json:",omitempty"`
 }
 
 var log = logging.Logger("patr/blockchain")
 
+// RPCTimeout is the maximum time a request to the Ethereum RPC API can take.
+var RPCTimeout = time.Minute
+
+// RPCEndpoint is the URL of the Infura Ethereum mainnet API the API key is appended to.
+var RPCEndpoint = "https://mainnet.infura.io/v3/"
+
+// dial creates an Infura Ethereum mainnet API client.
+func dial(apikey string) (*ethclient.Client, error) {
+	rpcclient, err := rpc.DialHTTPWithClient(RPCEndpoint+apikey, &http.Client{Timeout: RPCTimeout})
+	if err != nil {
+		log.Errorf("could not create Infura Ethereum API client: %v", err)
+		return nil, err
+	}
+	return ethclient.NewClient(rpcclient), nil
+}
+
 func ResolveENS(name string, apikey string) (ENSName, error) {
+	if devnet.Enabled {
+		return resolveDevnetENS(name)
+	}
 	if apikey == "" {
 		return ENSName{}, fmt.Errorf("The Infura API secret key was not specified")
 	}
 	log.Infof("resolving ENS name %v...", name)
-	client, err := ethclient.Dial(fmt.Sprintf("https://mainnet.infura.io/v3/%s", apikey))
+	client, err := dial(apikey)
 	if err != nil {
-		log.Errorf("could not create Infura Ethereum API client: %v", err)
 		return ENSName{}, err
 	}
-	r, err := ens.NewResolver(client, name)
+	var r *ens.Resolver
+	err = util.Retry(context.Background(), "blockchain", "creating ENS resolver", func(ctx context.Context) error {
+		r, err = ens.NewResolver(client, name)
+		if err != nil && (err.Error() == "unregistered name" || err.Error() == "no resolver") {
+			return util.Permanent(err)
+		}
+		return err
+	})
 	if err != nil {
 		log.Errorf("could not create resolver ENS name %s: %v", name, err)
 		return ENSName{}, err
 	}
-	address, err := r.Address()
+	var address common.Address
+	err = util.Retry(context.Background(), "blockchain", "resolving ENS address", func(ctx context.Context) error {
+		address, err = r.Address()
+		return err
+	})
 	if err != nil {
 		log.Errorf("could not resolve address for ENS name %s: %v", name, err)
 		return ENSName{}, err
 	}
-	chash, err := r.Contenthash()
+	var chash []byte
+	err = util.Retry(context.Background(), "blockchain", "resolving ENS content hash", func(ctx context.Context) error {
+		chash, err = r.Contenthash()
+		return err
+	})
 	if err != nil {
 		log.Errorf("could not resolve content hash record for ENS name %s: %v", name, err)
 		return ENSName{}, err
@@ -75,6 +118,16 @@ func ResolveENS(name string, apikey string) (ENSName, error) {
 		ContentHash: chashcid,
 		Avatar:      avatar,
 	}
+	if nft, ok := ParseNFTAvatar(avatar); ok {
+		nft.Verified, err = VerifyNFTOwnership(context.Background(), client, nft, address)
+		if err != nil {
+			log.Warnf("could not verify ownership of avatar NFT %s for ENS name %s: %v", avatar, name, err)
+			err = nil
+		} else if !nft.Verified {
+			log.Warnf("avatar NFT %s of ENS name %s is not owned by %s", avatar, name, address.Hex())
+		}
+		record.AvatarNFT = &nft
+	}
 
 	return record, err
 }
@@ -0,0 +1,53 @@
+package blockchain
+
+import (
+	"context"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/allisterb/patr/internal/testutil"
+)
+
+// hangingRPC points the Ethereum RPC client at an API which never responds until the request is aborted.
+func hangingRPC(t *testing.T) {
+	t.Helper()
+	endpoint := RPCEndpoint
+	RPCEndpoint = testutil.HangingServer(t) + "/"
+	t.Cleanup(func() { RPCEndpoint = endpoint })
+}
+
+const testTx = "0x5c504ed432cb51138bcf09aa5e8a410dd4a1e204ef84bfed1be16dfba1b22060"
+
+func TestVerifyPaymentAbortsWhenCancelled(t *testing.T) {
+	hangingRPC(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	testutil.Aborts(t, "VerifyPayment", func() error {
+		return VerifyPayment(ctx, "test", testTx, "0x0000000000000000000000000000000000000001", big.NewInt(1))
+	})
+}
+
+func TestVerifyPaymentAbortsWhenExpired(t *testing.T) {
+	hangingRPC(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	testutil.Aborts(t, "VerifyPayment", func() error {
+		return VerifyPayment(ctx, "test", testTx, "0x0000000000000000000000000000000000000001", big.NewInt(1))
+	})
+}
+
+func TestRPCTimeout(t *testing.T) {
+	hangingRPC(t)
+	timeout := RPCTimeout
+	RPCTimeout = 20 * time.Millisecond
+	defer func() { RPCTimeout = timeout }()
+	client, err := dial("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.Aborts(t, "BlockNumber", func() error {
+		_, err := client.BlockNumber(context.Background())
+		return err
+	})
+}
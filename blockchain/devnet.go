@@ -0,0 +1,63 @@
+package blockchain
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/allisterb/patr/devnet"
+	"github.com/allisterb/patr/util"
+)
+
+// On the devnet ENS names are resolved from a registry file shared by the devnet nodes instead of Ethereum mainnet.
+func devnetRegistryFile() string {
+	return filepath.Join(devnet.Dir, "ens.json")
+}
+
+func readDevnetRegistry() (map[string]ENSName, error) {
+	names := make(map[string]ENSName)
+	if !util.PathExists(devnetRegistryFile()) {
+		return names, nil
+	}
+	data, err := os.ReadFile(devnetRegistryFile())
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &names); err != nil {
+		log.Errorf("could not read JSON data from devnet ENS registry %s: %v", devnetRegistryFile(), err)
+		return nil, err
+	}
+	return names, nil
+}
+
+// RegisterDevnetName adds or updates an ENS name in the devnet registry.
+func RegisterDevnetName(name string, r ENSName) error {
+	names, err := readDevnetRegistry()
+	if err != nil {
+		return err
+	}
+	names[name] = r
+	data, _ := json.MarshalIndent(names, "", " ")
+	if err = os.MkdirAll(devnet.Dir, 0755); err != nil {
+		return err
+	}
+	f := devnetRegistryFile()
+	if err = os.WriteFile(f+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(f+".tmp", f)
+}
+
+func resolveDevnetENS(name string) (ENSName, error) {
+	names, err := readDevnetRegistry()
+	if err != nil {
+		return ENSName{}, err
+	}
+	r, ok := names[name]
+	if !ok {
+		return ENSName{}, fmt.Errorf("ENS name %s is not registered on the devnet", name)
+	}
+	log.Infof("resolved ENS name %v on devnet", name)
+	return r, nil
+}
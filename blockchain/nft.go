@@ -0,0 +1,89 @@
+package blockchain
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+
+	"github.com/allisterb/patr/util"
+)
+
+// NFT is an NFT referenced by an ENS avatar record e.g. eip155:1/erc721:0xb47e3cd837dDF8e4c57F05d70Ab865de6e193BBB/0
+type NFT struct {
+	ChainID  int64
+	Standard string
+	Contract string
+	TokenID  string
+	Verified bool
+}
+
+// Function selectors of ERC-721 ownerOf(uint256) and ERC-1155 balanceOf(address,uint256).
+var (
+	erc721OwnerOf    = common.Hex2Bytes("6352211e")
+	erc1155BalanceOf = common.Hex2Bytes("00fdd58e")
+)
+
+// ParseNFTAvatar parses an ENS avatar record which references an ERC-721 or ERC-1155 NFT.
+func ParseNFTAvatar(avatar string) (NFT, bool) {
+	parts := strings.Split(strings.TrimSpace(avatar), "/")
+	if len(parts) != 3 || !strings.HasPrefix(strings.ToLower(parts[0]), "eip155:") {
+		return NFT{}, false
+	}
+	chain, err := strconv.ParseInt(parts[0][len("eip155:"):], 10, 64)
+	if err != nil {
+		return NFT{}, false
+	}
+	asset := strings.SplitN(parts[1], ":", 2)
+	if len(asset) != 2 || !common.IsHexAddress(asset[1]) {
+		return NFT{}, false
+	}
+	standard := strings.ToLower(asset[0])
+	if standard != "erc721" && standard != "erc1155" {
+		return NFT{}, false
+	}
+	if _, ok := new(big.Int).SetString(parts[2], 10); !ok {
+		return NFT{}, false
+	}
+	return NFT{ChainID: chain, Standard: standard, Contract: common.HexToAddress(asset[1]).Hex(), TokenID: parts[2]}, true
+}
+
+// VerifyNFTOwnership checks on-chain that an address owns an NFT. Only NFTs on Ethereum mainnet can be verified.
+func VerifyNFTOwnership(ctx context.Context, client *ethclient.Client, nft NFT, owner common.Address) (bool, error) {
+	if nft.ChainID != 1 {
+		return false, fmt.Errorf("cannot verify NFT on chain %v", nft.ChainID)
+	}
+	id, _ := new(big.Int).SetString(nft.TokenID, 10)
+	contract := common.HexToAddress(nft.Contract)
+	var data []byte
+	switch nft.Standard {
+	case "erc721":
+		data = append(append([]byte{}, erc721OwnerOf...), common.LeftPadBytes(id.Bytes(), 32)...)
+	case "erc1155":
+		data = append(append([]byte{}, erc1155BalanceOf...), common.LeftPadBytes(owner.Bytes(), 32)...)
+		data = append(data, common.LeftPadBytes(id.Bytes(), 32)...)
+	default:
+		return false, fmt.Errorf("unsupported NFT standard %s", nft.Standard)
+	}
+	var out []byte
+	err := util.Retry(ctx, "blockchain", "verifying NFT ownership", func(ctx context.Context) error {
+		var err error
+		out, err = client.CallContract(ctx, ethereum.CallMsg{To: &contract, Data: data}, nil)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	if len(out) < 32 {
+		return false, fmt.Errorf("unexpected response from NFT contract %s", nft.Contract)
+	}
+	if nft.Standard == "erc721" {
+		return common.BytesToAddress(out[:32]) == owner, nil
+	}
+	return new(big.Int).SetBytes(out[:32]).Sign() > 0, nil
+}
@@ -0,0 +1,54 @@
+package blockchain
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"github.com/allisterb/patr/util"
+)
+
+// VerifyPayment checks that an Ethereum mainnet transaction succeeded and paid at least min wei to an address.
+func VerifyPayment(ctx context.Context, apikey string, txhash string, to string, min *big.Int) error {
+	if apikey == "" {
+		return fmt.Errorf("The Infura API secret key was not specified")
+	}
+	client, err := dial(apikey)
+	if err != nil {
+		return err
+	}
+	hash := common.HexToHash(txhash)
+	var tx *types.Transaction
+	var pending bool
+	err = util.Retry(ctx, "blockchain", "getting payment transaction", func(ctx context.Context) error {
+		tx, pending, err = client.TransactionByHash(ctx, hash)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("could not get transaction %s: %v", txhash, err)
+	}
+	if pending {
+		return fmt.Errorf("transaction %s is pending", txhash)
+	}
+	if tx.To() == nil || *tx.To() != common.HexToAddress(to) {
+		return fmt.Errorf("transaction %s is not a payment to %s", txhash, to)
+	}
+	if tx.Value().Cmp(min) < 0 {
+		return fmt.Errorf("transaction %s paid %v wei, less than %v wei", txhash, tx.Value(), min)
+	}
+	var receipt *types.Receipt
+	err = util.Retry(ctx, "blockchain", "getting payment transaction receipt", func(ctx context.Context) error {
+		receipt, err = client.TransactionReceipt(ctx, hash)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("could not get receipt of transaction %s: %v", txhash, err)
+	}
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		return fmt.Errorf("transaction %s failed", txhash)
+	}
+	return nil
+}
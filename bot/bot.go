@@ -0,0 +1,211 @@
+package bot
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	logging "github.com/ipfs/go-log/v2"
+	gonostr "github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/nostr"
+	"github.com/allisterb/patr/util"
+)
+
+type Bot struct {
+	Name         string
+	NostrPrivKey string
+	NostrPubKey  string
+	TokenHash    string
+	PostsPerHour int
+	Delegation   nostr.Delegation
+}
+
+type WebhookResponse struct {
+	ID      string `json:"id"`
+	Message string `json:"message,omitempty"`
+}
+
+type limiter struct {
+	lock  sync.Mutex
+	posts map[string][]time.Time
+}
+
+var log = logging.Logger("patr/bot")
+
+var rateLimiter = limiter{posts: make(map[string][]time.Time)}
+
+// Create generates a new bot identity with a NIP-26 delegation from the user's Nostr key limited to text notes.
+// The returned token is only shown once, the bot stores a hash of it.
+func Create(name string, userPrivKey string, postsPerHour int) (Bot, string, error) {
+	sk, pk, err := nostr.GenerateKeyPair()
+	if err != nil {
+		return Bot{}, "", err
+	}
+	d, err := nostr.CreateDelegation(userPrivKey, pk, []int{gonostr.KindTextNote}, time.Hour*24*365)
+	if err != nil {
+		log.Errorf("could not create delegation for bot %s: %v", name, err)
+		return Bot{}, "", err
+	}
+	token, err := GenerateToken()
+	if err != nil {
+		return Bot{}, "", err
+	}
+	log.Infof("created bot %s with Nostr public key %s", name, pk)
+	return Bot{
+		Name:         name,
+		NostrPrivKey: sk,
+		NostrPubKey:  pk,
+		TokenHash:    HashToken(token),
+		PostsPerHour: postsPerHour,
+		Delegation:   d,
+	}, token, nil
+}
+
+func GenerateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Errorf("could not generate random API token: %v", err)
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func HashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// PayloadToText converts a JSON webhook payload to the text of a post.
+// Payloads with a content or text field are posted as-is, RSS-style items with a title and link are
+// posted as the title followed by the link, and anything else is posted as compact JSON.
+func PayloadToText(payload map[string]any) string {
+	for _, k := range []string{"content", "text"} {
+		if v, ok := payload[k].(string); ok && v != "" {
+			return v
+		}
+	}
+	if title, ok := payload["title"].(string); ok && title != "" {
+		lines := []string{title}
+		if d, ok := payload["description"].(string); ok && d != "" {
+			lines = append(lines, d)
+		}
+		if l, ok := payload["link"].(string); ok && l != "" {
+			lines = append(lines, l)
+		} else if u, ok := payload["url"].(string); ok && u != "" {
+			lines = append(lines, u)
+		}
+		return strings.Join(lines, "\n")
+	}
+	b, _ := json.Marshal(payload)
+	return string(b)
+}
+
+func (b Bot) CreatePost(text string) (gonostr.Event, error) {
+	now, err := util.NormalizeTimestamp(util.Now())
+	if err != nil {
+		return gonostr.Event{}, err
+	}
+	evt := gonostr.Event{
+		CreatedAt: gonostr.Timestamp(now.Unix()),
+		Kind:      gonostr.KindTextNote,
+		Tags:      gonostr.Tags{},
+		Content:   text,
+	}
+	if err := nostr.SignDelegatedEvent(&evt, b.Delegation, b.NostrPrivKey); err != nil {
+		return gonostr.Event{}, err
+	}
+	return evt, nil
+}
+
+func (l *limiter) allow(name string, postsPerHour int) bool {
+	if postsPerHour <= 0 {
+		return true
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	recent := []time.Time{}
+	for _, t := range l.posts[name] {
+		if now.Sub(t) < time.Hour {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= postsPerHour {
+		l.posts[name] = recent
+		return false
+	}
+	l.posts[name] = append(recent, now)
+	return true
+}
+
+// SetWebhookHandlers registers the inbound webhook endpoint for each bot on the relay HTTP router.
+// Requests with dry_run=true in the query string return the ID of the event that would be posted without posting it.
+func SetWebhookHandlers(router *mux.Router, relay *nostr.Relay, bots []Bot) {
+	for i := range bots {
+		b := bots[i]
+		router.Path(fmt.Sprintf("/bot/%s/webhook", b.Name)).Methods("POST").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			webhookHandler(w, r, relay, b)
+		})
+		log.Infof("bot %s accepting webhooks at /bot/%s/webhook", b.Name, b.Name)
+	}
+}
+
+func webhookHandler(w http.ResponseWriter, r *http.Request, relay *nostr.Relay, b Bot) {
+	w.Header().Set("Content-Type", "application/json")
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" || HashToken(token) != b.TokenHash {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(WebhookResponse{Message: "invalid bot API token"})
+		return
+	}
+	if !rateLimiter.allow(b.Name, b.PostsPerHour) {
+		log.Warnf("bot %s exceeded rate limit of %v posts per hour", b.Name, b.PostsPerHour)
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(WebhookResponse{Message: "rate limit exceeded"})
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(WebhookResponse{Message: "could not read request body"})
+		return
+	}
+	payload := map[string]any{}
+	if err = json.Unmarshal(data, &payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(WebhookResponse{Message: "request body is not a JSON object"})
+		return
+	}
+	evt, err := b.CreatePost(PayloadToText(payload))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(WebhookResponse{Message: "could not create post"})
+		return
+	}
+	if r.URL.Query().Get("dry_run") == "true" {
+		msg := "dry run: event would be accepted by the relay"
+		if !relay.CheckEvent(&evt) {
+			msg = "dry run: event would be rejected by the relay"
+		}
+		json.NewEncoder(w).Encode(WebhookResponse{ID: evt.ID, Message: msg})
+		return
+	}
+	ok, msg := relay.AddEvent(evt, nostr.Provenance{Source: nostr.SourceLocal, Origin: "bot/" + b.Name})
+	if !ok {
+		log.Errorf("relay did not accept post %s from bot %s: %s", evt.ID, b.Name, msg)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(WebhookResponse{ID: evt.ID, Message: msg})
+		return
+	}
+	log.Infof("bot %s posted event %s", b.Name, evt.ID)
+	json.NewEncoder(w).Encode(WebhookResponse{ID: evt.ID})
+}
@@ -0,0 +1,110 @@
+package devnet
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+
+	"github.com/allisterb/patr/util"
+)
+
+// The devnet is a local network of patr nodes for development and CI. Nodes on the devnet use deterministic keys,
+// mocked Web3.Storage and ENS services, a fake clock and short IPNS lifetimes, and faults can be injected to test how
+// nodes recover from failures.
+var Enabled = false
+
+// Node is the index of this node on the devnet.
+var Node = 0
+
+// Nodes is the number of nodes on the devnet. Nodes bootstrap from each other on localhost.
+var Nodes = 3
+
+// Dir is the directory shared by all devnet nodes for their data and the mocked services.
+var Dir = filepath.Join(util.GetUserHomeDir(), ".patr", "devnet")
+
+// Epoch is the time the devnet fake clock starts at.
+var Epoch = time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var log = logging.Logger("patr/devnet")
+
+// Enable switches this process to the devnet as the node with index n.
+func Enable(n int) {
+	Enabled = true
+	Node = n
+	util.SetAppData(NodeDir(n))
+	util.SetClock(Clock)
+	log.Infof("running on devnet as node %v with data directory %s", n, util.AppData)
+}
+
+func NodeDir(n int) string {
+	return filepath.Join(Dir, strconv.Itoa(n))
+}
+
+// NodeDid returns the ENS DID of a devnet node.
+func NodeDid(n int) string {
+	return fmt.Sprintf("did:ens:node%v.devnet.eth", n)
+}
+
+func SwarmPort(n int) int {
+	return 4001 + 10*n
+}
+
+func RelayPort(n int) int {
+	return 4002 + 10*n
+}
+
+// Reader returns a deterministic stream of bytes for a seed which is used in place of a random source when
+// generating devnet keys.
+func Reader(seed string) io.Reader {
+	return &reader{seed: sha256.Sum256([]byte(seed))}
+}
+
+type reader struct {
+	seed    [32]byte
+	counter uint64
+	buf     []byte
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(r.buf) == 0 {
+			b := sha256.Sum256(append(r.seed[:], []byte(strconv.FormatUint(r.counter, 10))...))
+			r.buf = b[:]
+			r.counter++
+		}
+		c := copy(p[n:], r.buf)
+		r.buf = r.buf[c:]
+		n += c
+	}
+	return n, nil
+}
+
+// FakeClock is a clock that starts at the devnet epoch and advances one second each time it is read,
+// so timestamps on the devnet are reproducible.
+type FakeClock struct {
+	lock sync.Mutex
+	t    time.Time
+}
+
+var Clock = &FakeClock{t: Epoch}
+
+func (c *FakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.t = c.t.Add(time.Second)
+	return c.t
+}
+
+// Advance moves the clock forward e.g. to expire IPNS records or delegations in a test scenario.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.t = c.t.Add(d)
+}
@@ -0,0 +1,171 @@
+package devnet
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fault points where failures can be injected on the devnet to test the retry and repair of uploads, IPNS resolves and
+// block fetches.
+const (
+	// FaultW3SUpload fails uploads of CARs and IPNS records to the mocked Web3.Storage.
+	FaultW3SUpload = "w3s-upload"
+	// FaultIPNSResolve delays or fails resolving IPNS names.
+	FaultIPNSResolve = "ipns-resolve"
+	// FaultBlockFetch corrupts blocks fetched from IPFS as if they were corrupted in transit.
+	FaultBlockFetch = "block-fetch"
+)
+
+var faultPoints = []string{FaultW3SUpload, FaultIPNSResolve, FaultBlockFetch}
+
+// Fault is a failure injected at a fault point. Rate is the fraction of calls which fail or are corrupted and each call
+// is delayed by Delay.
+type Fault struct {
+	Rate  float64
+	Delay time.Duration
+}
+
+var faults = map[string]Fault{}
+var faultCounts = map[string]int{}
+var faultsLock = sync.Mutex{}
+
+// faultRand is seeded with the node index so the same calls fail each time a scenario is run.
+var faultRand *rand.Rand
+
+// ParseFaults parses a comma-separated list of faults in the form point:rate[:delay], e.g.
+// w3s-upload:0.3,ipns-resolve:0:5s,block-fetch:0.1.
+func ParseFaults(spec string) (map[string]Fault, error) {
+	parsed := map[string]Fault{}
+	for _, s := range strings.Split(spec, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		parts := strings.Split(s, ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("invalid fault %s, the format is point:rate[:delay]", s)
+		}
+		known := false
+		for _, p := range faultPoints {
+			known = known || p == parts[0]
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown fault point %s, can be one of: %s", parts[0], strings.Join(faultPoints, ", "))
+		}
+		rate, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("invalid rate %s of fault %s, must be between 0 and 1", parts[1], parts[0])
+		}
+		f := Fault{Rate: rate}
+		if len(parts) == 3 {
+			if f.Delay, err = time.ParseDuration(parts[2]); err != nil {
+				return nil, fmt.Errorf("invalid delay %s of fault %s: %v", parts[2], parts[0], err)
+			}
+		}
+		parsed[parts[0]] = f
+	}
+	return parsed, nil
+}
+
+// SetFaults replaces the injected faults with the faults in a spec parsed by ParseFaults. Faults are only injected on
+// the devnet.
+func SetFaults(spec string) error {
+	if spec != "" && !Enabled {
+		return fmt.Errorf("faults can only be injected on the devnet")
+	}
+	parsed, err := ParseFaults(spec)
+	if err != nil {
+		return err
+	}
+	faultsLock.Lock()
+	defer faultsLock.Unlock()
+	faults, faultCounts = parsed, map[string]int{}
+	faultRand = rand.New(rand.NewSource(int64(Node)))
+	for _, p := range faultPoints {
+		if f, ok := faults[p]; ok {
+			log.Warnf("injecting fault %s: %v of calls fail, delay %v", p, f.Rate, f.Delay)
+		}
+	}
+	return nil
+}
+
+// trigger returns the fault at a fault point and whether it fails this call.
+func trigger(point string) (Fault, bool) {
+	if !Enabled {
+		return Fault{}, false
+	}
+	faultsLock.Lock()
+	defer faultsLock.Unlock()
+	f, ok := faults[point]
+	if !ok {
+		return Fault{}, false
+	}
+	fail := f.Rate > 0 && faultRand.Float64() < f.Rate
+	if fail {
+		faultCounts[point]++
+	}
+	return f, fail
+}
+
+// Inject delays a call at a fault point and returns an error if the call fails.
+func Inject(ctx context.Context, point string) error {
+	f, fail := trigger(point)
+	if f.Delay > 0 {
+		select {
+		case <-time.After(f.Delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if fail {
+		log.Warnf("injected fault %s", point)
+		return fmt.Errorf("injected fault %s", point)
+	}
+	return nil
+}
+
+// Corrupt returns a copy of data with one byte flipped if the call at a fault point fails, or data unchanged.
+func Corrupt(point string, data []byte) []byte {
+	_, fail := trigger(point)
+	if !fail || len(data) == 0 {
+		return data
+	}
+	faultsLock.Lock()
+	i := faultRand.Intn(len(data))
+	faultsLock.Unlock()
+	corrupted := append([]byte{}, data...)
+	corrupted[i] ^= 0xff
+	log.Warnf("injected fault %s: corrupted byte %v of %v", point, i, len(data))
+	return corrupted
+}
+
+// FaultCounts returns how many faults were injected at each fault point, e.g. to check a scenario exercised the retries.
+func FaultCounts() map[string]int {
+	faultsLock.Lock()
+	defer faultsLock.Unlock()
+	counts := map[string]int{}
+	for p, n := range faultCounts {
+		counts[p] = n
+	}
+	return counts
+}
+
+// FaultSummary returns the injected fault counts as point=count pairs.
+func FaultSummary() string {
+	counts := FaultCounts()
+	points := []string{}
+	for p := range counts {
+		points = append(points, p)
+	}
+	sort.Strings(points)
+	s := []string{}
+	for _, p := range points {
+		s = append(s, fmt.Sprintf("%s=%v", p, counts[p]))
+	}
+	return strings.Join(s, ",")
+}
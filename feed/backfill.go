@@ -0,0 +1,188 @@
+package feed
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ipfs/go-cid"
+	gonostr "github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/node"
+	"github.com/allisterb/patr/nostr"
+	"github.com/allisterb/patr/util"
+)
+
+// BackfillProgress is the state of the backfill of a followed feed.
+type BackfillProgress struct {
+	Did      string    `json:"did"`
+	Head     string    `json:"head,omitempty"`
+	Fetched  int       `json:"fetched"`
+	Complete bool      `json:"complete"`
+	Error    string    `json:"error,omitempty"`
+	Updated  time.Time `json:"updated"`
+}
+
+var backfills = make(map[string]BackfillProgress)
+var backfillLock = sync.Mutex{}
+
+func reportBackfill(p BackfillProgress, progress func(BackfillProgress)) {
+	p.Updated = util.Now()
+	backfillLock.Lock()
+	backfills[p.Did] = p
+	backfillLock.Unlock()
+	if progress != nil {
+		progress(p)
+	}
+}
+
+// BackfillStatus returns the backfill progress of each followed feed and whether the timeline is complete.
+func BackfillStatus() ([]BackfillProgress, bool) {
+	backfillLock.Lock()
+	defer backfillLock.Unlock()
+	status := []BackfillProgress{}
+	complete := true
+	for _, f := range node.CurrentConfig.Follows {
+		p, ok := backfills[f.Did]
+		if !ok {
+			p = BackfillProgress{Did: f.Did, Complete: f.Gap == "" && f.LastSeen != ""}
+		}
+		complete = complete && p.Complete
+		status = append(status, p)
+	}
+	return status, complete
+}
+
+func parsePathCid(p string) (cid.Cid, error) {
+	return cid.Parse(strings.TrimPrefix(strings.TrimPrefix(p, "/ipfs/"), "/ipld/"))
+}
+
+func optionalCid(s string) cid.Cid {
+	c, err := cid.Parse(s)
+	if err != nil {
+		return cid.Undef
+	}
+	return c
+}
+
+// Backfill fetches the posts a followed feed published since it was last seen, walking back from the current head to
+// the last seen post. If the fetch budget runs out the point it stopped at is saved as a gap, and the next backfill
+// fills the gap before fetching newer posts. Posts of community feeds are replicated as they are fetched, and calendar
+// events, RSVPs and listings are added to the aggregated calendar and marketplace. If the followed account posted a
+// redirect record to a new DID the returned follow is switched to the new DID.
+func Backfill(ctx context.Context, ipfscore ipfs.IPFSCore, f node.Follow, progress func(BackfillProgress)) (node.Follow, error) {
+	fail := func(err error) (node.Follow, error) {
+		reportBackfill(BackfillProgress{Did: f.Did, Error: err.Error()}, progress)
+		return f, err
+	}
+	path, err := ipfs.ResolveIPNSName(ctx, ipfscore, f.FeedName)
+	if err != nil {
+		return fail(err)
+	}
+	head, err := parsePathCid(path)
+	if err != nil {
+		return fail(fmt.Errorf("feed name %s of %s does not resolve to a CID: %s", f.FeedName, f.Did, path))
+	}
+	return backfillFrom(ctx, ipfscore, f, head, progress)
+}
+
+// backfillFrom backfills a followed feed from a known head.
+func backfillFrom(ctx context.Context, ipfscore ipfs.IPFSCore, f node.Follow, head cid.Cid, progress func(BackfillProgress)) (node.Follow, error) {
+	p := BackfillProgress{Did: f.Did, Head: head.String()}
+	fail := func(err error) (node.Follow, error) {
+		p.Error = err.Error()
+		reportBackfill(p, progress)
+		return f, err
+	}
+	reportBackfill(p, progress)
+	var redirect *gonostr.Event
+	onPost := func(c cid.Cid, data []byte) {
+		if f.Community {
+			Replicate(ctx, ipfscore, f, c, data)
+		}
+		if evt, err := postEvent(c, data); err == nil {
+			nostr.Aggregate(&evt)
+			if isRedirect(&evt, f) && (redirect == nil || evt.CreatedAt > redirect.CreatedAt) {
+				redirect = &evt
+			}
+		}
+		p.Fetched++
+		if p.Fetched%50 == 0 {
+			reportBackfill(p, progress)
+		}
+	}
+	if f.Gap != "" {
+		_, next, err := fetchFeed(ctx, ipfscore, f.Did, f.NostrPubKey, optionalCid(f.Gap), optionalCid(f.GapUntil), onPost)
+		if err != nil {
+			return fail(err)
+		}
+		if next.Defined() {
+			f.Gap = next.String()
+			reportBackfill(p, progress)
+			return f, nil
+		}
+		f.Gap, f.GapUntil = "", ""
+	}
+	if f.LastSeen != head.String() {
+		_, next, err := fetchFeed(ctx, ipfscore, f.Did, f.NostrPubKey, head, optionalCid(f.LastSeen), onPost)
+		if err != nil {
+			return fail(err)
+		}
+		if next.Defined() {
+			f.Gap, f.GapUntil = next.String(), f.LastSeen
+		}
+		f.LastSeen = head.String()
+	}
+	if redirect != nil {
+		nf, err := followRedirect(f, *redirect)
+		if err != nil {
+			log.Warnf("could not follow redirect of %s: %v", f.Did, err)
+		} else {
+			f = nf
+		}
+	}
+	p.Complete = f.Gap == ""
+	reportBackfill(p, progress)
+	return f, nil
+}
+
+// BackfillAll backfills every followed feed and saves where each backfill got to.
+func BackfillAll(ctx context.Context, ipfscore ipfs.IPFSCore, progress func(BackfillProgress)) error {
+	failed := 0
+	for _, f := range node.CurrentConfig.Follows {
+		nf, err := Backfill(ctx, ipfscore, f, progress)
+		if err != nil {
+			log.Errorf("could not backfill feed of %s: %v", f.Did, err)
+			failed++
+		}
+		if (nf.Did != f.Did || nf.LastSeen != f.LastSeen || nf.Gap != f.Gap || nf.GapUntil != f.GapUntil) && !util.DryRun {
+			if err = node.SaveFollow(nf); err != nil {
+				return err
+			}
+		}
+	}
+	if _, complete := BackfillStatus(); complete {
+		log.Infof("timeline is complete")
+	}
+	if failed > 0 {
+		return fmt.Errorf("could not backfill %v feeds", failed)
+	}
+	return nil
+}
+
+// StartBackfill backfills followed feeds in the background when the node starts and serves the progress at
+// GET /follows/backfill.
+func StartBackfill(ctx context.Context, ipfscore ipfs.IPFSCore, router *mux.Router) {
+	router.Path("/follows/backfill").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, complete := BackfillStatus()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"complete": complete, "feeds": status})
+	})
+	go BackfillAll(ctx, ipfscore, nil)
+}
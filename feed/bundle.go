@@ -0,0 +1,379 @@
+package feed
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	carbs "github.com/ipld/go-car/v2/blockstore"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	gonostr "github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/node"
+	"github.com/allisterb/patr/util"
+)
+
+// KindFeedHead is the kind of the Nostr event an author signs to announce the head of their feed.
+const KindFeedHead = 30080
+
+// BundleHead is the head of a feed carried in an update bundle. Announcement is signed by the author of the feed if
+// they created the bundle or it was carried on from a bundle they created.
+type BundleHead struct {
+	Did          string
+	PubKey       string
+	FeedName     string
+	Head         string
+	Posted       int64
+	Announcement *gonostr.Event `json:",omitempty"`
+}
+
+// BundleImport is the result of importing an update bundle.
+type BundleImport struct {
+	Root     cid.Cid
+	Blocks   int
+	Heads    []BundleHead
+	Skipped  int
+	Followed int
+}
+
+var headsLock = sync.Mutex{}
+
+func headsFile() string {
+	return filepath.Join(util.AppData, "heads.json")
+}
+
+// readHeads returns the feed heads imported from update bundles keyed by Nostr public key.
+func readHeads() (map[string]BundleHead, error) {
+	heads := make(map[string]BundleHead)
+	if !util.PathExists(headsFile()) {
+		return heads, nil
+	}
+	data, err := util.ReadDataFile(headsFile())
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &heads); err != nil {
+		log.Errorf("could not read JSON data from bundle heads file %s: %v", headsFile(), err)
+		return nil, err
+	}
+	return heads, nil
+}
+
+func writeHeads(heads map[string]BundleHead) error {
+	data, _ := json.MarshalIndent(heads, "", " ")
+	return util.WriteDataFile(headsFile(), data)
+}
+
+// NewFeedHeadAnnouncement signs an announcement that a CID is the head of the feed published to an IPNS name.
+func NewFeedHeadAnnouncement(privkey string, did string, feedName string, head cid.Cid) (gonostr.Event, error) {
+	evt := gonostr.Event{
+		CreatedAt: gonostr.Timestamp(util.Now().Unix()),
+		Kind:      KindFeedHead,
+		Tags:      gonostr.Tags{gonostr.Tag{"d", "patr/feed"}, gonostr.Tag{"head", head.String()}, gonostr.Tag{"ipns", feedName}, gonostr.Tag{"did", did}},
+	}
+	if err := evt.Sign(privkey); err != nil {
+		log.Errorf("could not sign feed head announcement: %v", err)
+		return gonostr.Event{}, err
+	}
+	return evt, nil
+}
+
+// VerifyFeedHeadAnnouncement checks that an announcement of a feed head is validly signed by the author of the feed.
+func VerifyFeedHeadAnnouncement(evt gonostr.Event, h BundleHead) error {
+	if evt.Kind != KindFeedHead {
+		return fmt.Errorf("event %s is not a feed head announcement", evt.ID)
+	}
+	if evt.PubKey != h.PubKey {
+		return fmt.Errorf("feed head announcement %s is not signed by %s", evt.ID, h.PubKey)
+	}
+	if tagValue(&evt, "head") != h.Head {
+		return fmt.Errorf("feed head announcement %s is not for head %s", evt.ID, h.Head)
+	}
+	if tagValue(&evt, "ipns") != h.FeedName {
+		return fmt.Errorf("feed head announcement %s is not for feed %s", evt.ID, h.FeedName)
+	}
+	if evt.GetID() != evt.ID {
+		return fmt.Errorf("feed head announcement ID %s does not match its content", evt.ID)
+	}
+	if ok, err := evt.CheckSignature(); err != nil || !ok {
+		return fmt.Errorf("feed head announcement %s has an invalid signature", evt.ID)
+	}
+	if _, err := util.NormalizeTimestamp(time.Unix(int64(evt.CreatedAt), 0)); err != nil {
+		return fmt.Errorf("feed head announcement %s has an invalid timestamp: %v", evt.ID, err)
+	}
+	return nil
+}
+
+// posted returns the time the post at the head of a feed was created, or 0 if the post isn't available locally.
+func posted(ctx context.Context, ipfscore ipfs.IPFSCore, head cid.Cid) int64 {
+	data, err := ipfs.GetBlock(ctx, ipfscore, head)
+	if err != nil {
+		return 0
+	}
+	evt, err := postEvent(head, data)
+	if err != nil {
+		return 0
+	}
+	return int64(evt.CreatedAt)
+}
+
+// bundleHeads returns the feed heads the node knows: its own feed, the followed feeds it has fetched and the heads it
+// imported from other bundles, keeping the newest head of each author.
+func bundleHeads(ctx context.Context, ipfscore ipfs.IPFSCore) ([]BundleHead, error) {
+	config := node.CurrentConfig
+	heads, err := readHeads()
+	if err != nil {
+		return nil, err
+	}
+	add := func(h BundleHead) {
+		if h.PubKey == "" || h.Head == "" {
+			return
+		}
+		if c, ok := heads[h.PubKey]; ok && c.Posted >= h.Posted {
+			return
+		}
+		heads[h.PubKey] = h
+	}
+	if k, ok := config.IPNSKeys["feed"]; ok && config.FeedHead != "" {
+		head, err := parsePathCid(config.FeedHead)
+		if err != nil {
+			return nil, fmt.Errorf("feed head %s is not a CID", config.FeedHead)
+		}
+		h := BundleHead{Did: config.Did, PubKey: config.NostrPubKey, FeedName: k.Name(), Head: head.String(), Posted: posted(ctx, ipfscore, head)}
+		evt, err := NewFeedHeadAnnouncement(config.NostrPrivKey, config.Did, h.FeedName, head)
+		if err != nil {
+			return nil, err
+		}
+		h.Announcement = &evt
+		heads[h.PubKey] = h
+	}
+	for _, f := range config.Follows {
+		head := optionalCid(f.LastSeen)
+		if !head.Defined() {
+			continue
+		}
+		add(BundleHead{Did: f.Did, PubKey: f.NostrPubKey, FeedName: f.FeedName, Head: head.String(), Posted: posted(ctx, ipfscore, head)})
+	}
+	hs := []BundleHead{}
+	for _, h := range heads {
+		hs = append(hs, h)
+	}
+	return hs, nil
+}
+
+func bundleNode(did string, heads []BundleHead) (datamodel.Node, error) {
+	return qp.BuildMap(basicnode.Prototype.Any, 4, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "type", qp.String("bundle"))
+		qp.MapEntry(ma, "did", qp.String(did))
+		qp.MapEntry(ma, "created_at", qp.Int(util.Now().Unix()))
+		qp.MapEntry(ma, "heads", qp.List(int64(len(heads)), func(la datamodel.ListAssembler) {
+			for _, h := range heads {
+				qp.ListEntry(la, qp.Map(6, func(ma datamodel.MapAssembler) {
+					qp.MapEntry(ma, "did", qp.String(h.Did))
+					qp.MapEntry(ma, "pubkey", qp.String(h.PubKey))
+					qp.MapEntry(ma, "feed", qp.String(h.FeedName))
+					qp.MapEntry(ma, "head", qp.Link(cidlink.Link{Cid: optionalCid(h.Head)}))
+					qp.MapEntry(ma, "posted", qp.Int(h.Posted))
+					if h.Announcement != nil {
+						data, _ := json.Marshal(h.Announcement)
+						qp.MapEntry(ma, "announcement", qp.String(string(data)))
+					}
+				}))
+			}
+		}))
+	})
+}
+
+// ExportBundle writes an update bundle to a CAR archive which can be carried to nodes which can't reach this one. The
+// bundle has the head of the node's feed with an announcement signed by the user, and the newest heads of the followed
+// feeds and feeds imported from other bundles, with the posts of each feed.
+func ExportBundle(ctx context.Context, ipfscore ipfs.IPFSCore, path string) (cid.Cid, []BundleHead, error) {
+	heads, err := bundleHeads(ctx, ipfscore)
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+	if len(heads) == 0 {
+		return cid.Undef, nil, fmt.Errorf("the node does not have any feed heads to bundle")
+	}
+	n, err := bundleNode(node.CurrentConfig.Did, heads)
+	if err != nil {
+		return cid.Undef, nil, fmt.Errorf("could not create IPLD node for bundle: %v", err)
+	}
+	blk, err := ipfs.PutIPLDNode(ctx, ipfscore, n)
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+	if err = node.WriteArchive(ctx, ipfscore, blk.Cid(), path); err != nil {
+		return cid.Undef, nil, err
+	}
+	log.Infof("exported bundle %v of %v feed heads to %s", blk.Cid(), len(heads), path)
+	return blk.Cid(), heads, nil
+}
+
+func stringField(n datamodel.Node, key string) string {
+	v, err := n.LookupByString(key)
+	if err != nil {
+		return ""
+	}
+	s, _ := v.AsString()
+	return s
+}
+
+// readBundleHeads reads the feed heads in the manifest of a bundle.
+func readBundleHeads(c cid.Cid, data []byte) ([]BundleHead, error) {
+	n, err := ipfs.DecodeIPLDNode(c, data)
+	if err != nil {
+		return nil, err
+	}
+	if t := stringField(n, "type"); t != "bundle" {
+		return nil, fmt.Errorf("node type %s is not bundle", t)
+	}
+	hn, err := n.LookupByString("heads")
+	if err != nil {
+		return nil, err
+	}
+	heads := []BundleHead{}
+	it := hn.ListIterator()
+	for it != nil && !it.Done() {
+		_, v, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		h := BundleHead{Did: stringField(v, "did"), PubKey: stringField(v, "pubkey"), FeedName: stringField(v, "feed")}
+		if l, err := v.LookupByString("head"); err == nil {
+			if ln, err := l.AsLink(); err == nil {
+				h.Head = ln.(cidlink.Link).Cid.String()
+			}
+		}
+		if p, err := v.LookupByString("posted"); err == nil {
+			h.Posted, _ = p.AsInt()
+		}
+		if a := stringField(v, "announcement"); a != "" {
+			evt := gonostr.Event{}
+			if err = json.Unmarshal([]byte(a), &evt); err != nil {
+				return nil, fmt.Errorf("could not read feed head announcement of %s: %v", h.Did, err)
+			}
+			h.Announcement = &evt
+		}
+		heads = append(heads, h)
+	}
+	return heads, nil
+}
+
+// ImportBundle imports the feeds in an update bundle whose heads are newer than the heads the node has. The post at
+// each head must be signed by the author of the feed, and an announcement of the head must be signed by them too.
+// Followed feeds are backfilled from the imported posts and the other heads are kept so they can be carried on in the
+// bundles the node exports.
+func ImportBundle(ctx context.Context, ipfscore ipfs.IPFSCore, path string) (BundleImport, error) {
+	bs, f, err := node.OpenArchive(path)
+	if err != nil {
+		return BundleImport{}, err
+	}
+	defer f.Close()
+	roots, err := bs.Roots()
+	if err != nil {
+		return BundleImport{}, err
+	}
+	if len(roots) == 0 {
+		return BundleImport{}, fmt.Errorf("bundle %s does not have any roots", path)
+	}
+	result := BundleImport{Root: roots[0]}
+	blk, err := bs.Get(ctx, roots[0])
+	if err != nil {
+		return result, fmt.Errorf("bundle %s does not have its manifest %v", path, roots[0])
+	}
+	heads, err := readBundleHeads(roots[0], blk.RawData())
+	if err != nil {
+		log.Errorf("could not read manifest of bundle %s: %v", path, err)
+		return result, err
+	}
+	headsLock.Lock()
+	defer headsLock.Unlock()
+	stored, err := readHeads()
+	if err != nil {
+		return result, err
+	}
+	for _, h := range heads {
+		if err := importBundleHead(ctx, ipfscore, bs, stored, h, &result); err != nil {
+			log.Warnf("not importing feed head %s of %s from bundle: %v", h.Head, h.Did, err)
+			result.Skipped++
+		}
+	}
+	if err = writeHeads(stored); err != nil {
+		return result, err
+	}
+	log.Infof("imported %v feed heads and %v blocks from bundle %s", len(result.Heads), result.Blocks, path)
+	return result, nil
+}
+
+// importBundleHead validates a feed head in a bundle and imports its posts if it is newer than the head the node has.
+func importBundleHead(ctx context.Context, ipfscore ipfs.IPFSCore, bs *carbs.ReadOnly, stored map[string]BundleHead, h BundleHead, result *BundleImport) error {
+	config := node.CurrentConfig
+	if h.PubKey == config.NostrPubKey {
+		return fmt.Errorf("the feed is the node's own feed")
+	}
+	head, err := cid.Parse(h.Head)
+	if err != nil {
+		return fmt.Errorf("head %s is not a CID", h.Head)
+	}
+	if IsQuarantined(head) {
+		return fmt.Errorf("head %v is quarantined", head)
+	}
+	blk, err := bs.Get(ctx, head)
+	if err != nil {
+		return fmt.Errorf("head %v is not in the bundle", head)
+	}
+	if err = ValidatePost(head, blk.RawData(), h.PubKey); err != nil {
+		Quarantine(head, h.Did, err)
+		return err
+	}
+	if evt, err := postEvent(head, blk.RawData()); err == nil {
+		h.Posted = int64(evt.CreatedAt)
+	}
+	if h.Announcement != nil {
+		if err = VerifyFeedHeadAnnouncement(*h.Announcement, h); err != nil {
+			return err
+		}
+	}
+	f, followed := node.FindFollow(h.Did)
+	if followed && f.NostrPubKey != h.PubKey {
+		return fmt.Errorf("the feed is not signed by the followed key %s", f.NostrPubKey)
+	}
+	if c, ok := stored[h.PubKey]; ok && c.Posted >= h.Posted {
+		return fmt.Errorf("the node already has head %s posted at the same time or later", c.Head)
+	}
+	if followed {
+		if last := optionalCid(f.LastSeen); last.Defined() && posted(ctx, ipfscore, last) >= h.Posted {
+			return fmt.Errorf("the node already has head %v posted at the same time or later", last)
+		}
+	}
+	if util.DryRun {
+		log.Infof("dry run: would import feed head %v of %s", head, h.Did)
+		result.Heads = append(result.Heads, h)
+		return nil
+	}
+	n, err := node.ImportDAG(ctx, ipfscore, bs, []cid.Cid{head})
+	result.Blocks += n
+	if err != nil {
+		return err
+	}
+	stored[h.PubKey] = h
+	result.Heads = append(result.Heads, h)
+	if !followed {
+		return nil
+	}
+	nf, err := backfillFrom(ctx, ipfscore, f, head, nil)
+	if err != nil {
+		return err
+	}
+	result.Followed++
+	return node.SaveFollow(nf)
+}
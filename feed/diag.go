@@ -0,0 +1,165 @@
+package feed
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ipfs/boxo/coreiface/options"
+	"github.com/ipfs/go-cid"
+
+	"github.com/allisterb/patr/blockchain"
+	"github.com/allisterb/patr/did"
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/node"
+	"github.com/allisterb/patr/nostr"
+	"github.com/allisterb/patr/topics"
+	"github.com/allisterb/patr/util"
+)
+
+// SyncDiagnosis is why the timeline may be stale for a followed feed: how long resolving the feed's IPNS name took from
+// each source, which source had the newest head, how old the head is, what fetching the new posts cost and the steps
+// which failed.
+type SyncDiagnosis struct {
+	Did      string           `json:"did"`
+	FeedName string           `json:"feedName"`
+	Probes   []ipfs.IPNSProbe `json:"probes"`
+	// Source is the source of the newest head.
+	Source   string `json:"source,omitempty"`
+	Head     string `json:"head,omitempty"`
+	LastSeen string `json:"lastSeen,omitempty"`
+	// Behind is true if the newest head was not fetched yet.
+	Behind     bool          `json:"behind"`
+	HeadPosted time.Time     `json:"headPosted,omitempty"`
+	HeadAge    time.Duration `json:"headAge,omitempty"`
+	Posts      int           `json:"posts"`
+	Blocks     int           `json:"blocks"`
+	Bytes      int64         `json:"bytes"`
+	FetchTime  time.Duration `json:"fetchTime"`
+	Truncated  bool          `json:"truncated"`
+	// PubSubPeers is the number of peers subscribed to the feed's head announcements.
+	PubSubPeers int               `json:"pubsubPeers"`
+	Author      *ipfs.PeerLatency `json:"author,omitempty"`
+	Failures    []string          `json:"failures,omitempty"`
+}
+
+func (d *SyncDiagnosis) fail(step string, err error) {
+	d.Failures = append(d.Failures, fmt.Sprintf("%s: %v", step, err))
+}
+
+// DiagnoseSync runs each step of syncing a followed feed and records how it went. Fetched posts are not added to the
+// timeline and the follow is not updated.
+func DiagnoseSync(ctx context.Context, ipfscore ipfs.IPFSCore, f node.Follow) SyncDiagnosis {
+	d := SyncDiagnosis{Did: f.Did, FeedName: f.FeedName, LastSeen: f.LastSeen}
+	if f.Gap != "" {
+		d.fail("backfill", fmt.Errorf("there is a gap in the feed at %s", f.Gap))
+	}
+	if pd, err := did.Parse(f.Did); err != nil {
+		d.fail("did", err)
+	} else if r, err := blockchain.ResolveENS(pd.ID.ID, node.CurrentConfig.InfuraSecretKey); err != nil {
+		d.fail("ens", err)
+	} else if pid, err := ipfs.IPNSNamePeerID(r.IPFSPubKey); err != nil {
+		d.fail("ens", fmt.Errorf("invalid IPFS public key %s: %v", r.IPFSPubKey, err))
+	} else {
+		l := ipfs.PingPeer(ctx, ipfscore, pid)
+		d.Author = &l
+		if l.Error != "" {
+			d.fail("ping", fmt.Errorf("author's node %s is unreachable: %s", pid, l.Error))
+		}
+	}
+	for _, v := range nostr.TopicVersions() {
+		topic, err := topics.Feed(f.Did, v)
+		if err != nil {
+			continue
+		}
+		if peers, err := ipfscore.Api.PubSub().Peers(ctx, options.PubSub.Topic(topic)); err == nil {
+			d.PubSubPeers += len(peers)
+		}
+	}
+	if f.FeedName == "" {
+		d.fail("resolve", fmt.Errorf("no feed IPNS name"))
+		return d
+	}
+	probes, err := ipfs.ProbeIPNSName(ctx, ipfscore, f.FeedName)
+	if err != nil {
+		d.fail("resolve", err)
+		return d
+	}
+	d.Probes = probes
+	newest, ok := ipfs.NewestIPNSProbe(probes)
+	if !ok {
+		d.fail("resolve", fmt.Errorf("feed name %s could not be resolved from any source", f.FeedName))
+		return d
+	}
+	for _, p := range probes {
+		if p.Error == "" && p.Sequence < newest.Sequence {
+			d.fail("resolve", fmt.Errorf("%s has an old record %v, the newest is %v", p.Source, p.Sequence, newest.Sequence))
+		}
+	}
+	d.Source = newest.Source
+	head, err := parsePathCid(newest.Value)
+	if err != nil {
+		d.fail("resolve", fmt.Errorf("feed name %s does not resolve to a CID: %s", f.FeedName, newest.Value))
+		return d
+	}
+	d.Head, d.Behind = head.String(), head.String() != f.LastSeen
+	tracker := ipfs.NewFetchTracker(f.Did)
+	start := time.Now()
+	onPost := func(c cid.Cid, data []byte) {
+		if !c.Equals(head) {
+			return
+		}
+		if evt, err := postEvent(c, data); err == nil {
+			d.HeadPosted = evt.CreatedAt.Time()
+			d.HeadAge = util.Now().Sub(d.HeadPosted)
+		}
+	}
+	posts, _, err := fetchFeedTracked(ctx, ipfscore, tracker, f.NostrPubKey, head, optionalCid(f.LastSeen), onPost)
+	d.FetchTime, d.Posts, d.Blocks, d.Bytes, d.Truncated = time.Since(start), len(posts), tracker.Blocks, tracker.Bytes, tracker.Truncated
+	if err != nil {
+		d.fail("fetch", err)
+	} else if d.Truncated {
+		d.fail("fetch", fmt.Errorf("fetch budget ran out after %v posts", d.Posts))
+	}
+	return d
+}
+
+// DiagnoseSyncAll diagnoses the sync of every followed feed.
+func DiagnoseSyncAll(ctx context.Context, ipfscore ipfs.IPFSCore) []SyncDiagnosis {
+	diags := []SyncDiagnosis{}
+	for _, f := range node.CurrentConfig.Follows {
+		diags = append(diags, DiagnoseSync(ctx, ipfscore, f))
+	}
+	return diags
+}
+
+// SetDiagHandlers registers GET /diag/sync which diagnoses the sync of every followed feed or only the feed of ?did=,
+// GET /diag/peers which returns the latency of connected peers and GET /diag/retrieval which returns the blocks fetched
+// from each retrieval source.
+func SetDiagHandlers(ctx context.Context, ipfscore ipfs.IPFSCore, router *mux.Router) {
+	router.Path("/diag/sync").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if d := r.URL.Query().Get("did"); d != "" {
+			f, ok := node.FindFollow(d)
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(map[string]string{"message": "not following " + d})
+				return
+			}
+			json.NewEncoder(w).Encode([]SyncDiagnosis{DiagnoseSync(r.Context(), ipfscore, f)})
+			return
+		}
+		json.NewEncoder(w).Encode(DiagnoseSyncAll(r.Context(), ipfscore))
+	})
+	router.Path("/diag/peers").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ipfs.PeerLatencies(ipfscore))
+	})
+	router.Path("/diag/retrieval").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ipfs.RetrievalSourceStats())
+	})
+}
@@ -0,0 +1,111 @@
+package feed
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	gonostr "github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/blockchain"
+	"github.com/allisterb/patr/did"
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/node"
+	"github.com/allisterb/patr/nostr"
+	"github.com/allisterb/patr/util"
+)
+
+// dmRecipient returns the Nostr public key of the recipient of a DM given by DID, npub, nprofile or public key.
+func dmRecipient(to string) (string, error) {
+	if !did.IsValid(to) {
+		pk, _, err := nostr.DecodePubKey(to)
+		if err != nil {
+			return "", fmt.Errorf("%s is not a DID or Nostr public key", to)
+		}
+		return pk, nil
+	}
+	if f, ok := node.FindFollow(to); ok && f.NostrPubKey != "" {
+		return f.NostrPubKey, nil
+	}
+	d, err := did.Parse(to)
+	if err != nil {
+		return "", err
+	}
+	r, err := blockchain.ResolveENS(d.ID.ID, node.CurrentConfig.InfuraSecretKey)
+	if err != nil {
+		return "", err
+	}
+	if r.NostrPubKey == "" {
+		return "", fmt.Errorf("%s does not have a Nostr public key", to)
+	}
+	return r.NostrPubKey, nil
+}
+
+// archiveDM stores the encrypted event of a DM in IPFS and returns its CID.
+func archiveDM(ctx context.Context, ipfscore ipfs.IPFSCore, evt gonostr.Event) (cid.Cid, error) {
+	lnk, err := ipfs.PutNostrEventAsIPLDLink(ctx, ipfscore, evt, ipfs.DefaultCodec)
+	if err != nil {
+		log.Errorf("could not archive DM %s to IPFS: %v", evt.ID, err)
+		return cid.Undef, err
+	}
+	return lnk.(cidlink.Link).Cid, nil
+}
+
+// SendDM sends an encrypted direct message to the user of a DID or Nostr public key with the NIP-04 or NIP-44 scheme. The
+// event is archived to IPFS, so only the ciphertext is stored, and published to the node's relay and the profile relays.
+// NIP-44 DMs are gift wrapped for the sender too, so the sender can read their sent messages. It returns the event sent
+// to the recipient and the CID it was archived at.
+func SendDM(ctx context.Context, ipfscore ipfs.IPFSCore, to string, text string, scheme string) (gonostr.Event, cid.Cid, error) {
+	if scheme == "" {
+		scheme = nostr.DMSchemeNIP44
+	}
+	pubkey, err := dmRecipient(to)
+	if err != nil {
+		return gonostr.Event{}, cid.Undef, err
+	}
+	if err = util.CheckPublishLock(); err != nil {
+		return gonostr.Event{}, cid.Undef, err
+	}
+	privkey := node.CurrentConfig.NostrPrivKey
+	events := []gonostr.Event{}
+	if scheme == nostr.DMSchemeNIP44 {
+		rumor, err := nostr.NewPrivateDM(privkey, pubkey, text)
+		if err != nil {
+			return gonostr.Event{}, cid.Undef, err
+		}
+		if events, err = nostr.WrapPrivateDM(privkey, rumor); err != nil {
+			return gonostr.Event{}, cid.Undef, err
+		}
+	} else {
+		evt, err := nostr.NewDM(scheme, privkey, pubkey, text)
+		if err != nil {
+			return gonostr.Event{}, cid.Undef, err
+		}
+		events = append(events, evt)
+	}
+	if util.DryRun {
+		log.Infof("dry run: would send %s DM to %s", scheme, to)
+		return events[0], cid.Undef, nil
+	}
+	c := cid.Undef
+	for i, evt := range events {
+		ac, err := archiveDM(ctx, ipfscore, evt)
+		if err != nil {
+			return gonostr.Event{}, cid.Undef, err
+		}
+		if i == 0 {
+			c = ac
+		}
+		rctx, cancel := util.WithTimeout(ctx, nostr.RelayTimeout)
+		if err = nostr.PublishToRelay(rctx, fmt.Sprintf("ws://127.0.0.1:%v", node.RelayPort), evt); err != nil {
+			log.Warnf("could not publish DM %s to the node relay: %v", evt.ID, err)
+		}
+		cancel()
+		if err = node.PublishToProfileRelays(ctx, evt); err != nil {
+			log.Warnf("could not publish DM %s to the profile relays: %v", evt.ID, err)
+		}
+	}
+	log.Infof("sent %s DM %s to %s, archived at %v", scheme, events[0].ID, to, c)
+	return events[0], c, nil
+}
@@ -1,28 +1,24 @@
 package feed
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 
-	blocks "github.com/ipfs/go-block-format"
-	"github.com/ipfs/go-cid"
 	cbornode "github.com/ipfs/go-ipld-cbor"
 	ipldlegacy "github.com/ipfs/go-ipld-legacy"
 	logging "github.com/ipfs/go-log/v2"
-	"github.com/ipld/go-ipld-prime/codec/dagjson"
 	"github.com/ipld/go-ipld-prime/datamodel"
 	"github.com/ipld/go-ipld-prime/fluent/qp"
 
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	"github.com/ipld/go-ipld-prime/node/basicnode"
 
-	mh "github.com/multiformats/go-multihash"
-
 	"github.com/allisterb/patr/blockchain"
 	"github.com/allisterb/patr/did"
 	"github.com/allisterb/patr/ipfs"
 	"github.com/allisterb/patr/node"
+	"github.com/allisterb/patr/outbox"
+	"github.com/allisterb/patr/util"
 )
 
 type Feed struct {
@@ -36,7 +32,12 @@ func init() {
 	cbornode.RegisterCborType(Feed{})
 }
 
-func CreateFeed(ctx context.Context) error {
+// CreateFeed creates the profile node of the user's feed, encoded with a codec, and publishes it to the user's feed
+// IPNS name.
+func CreateFeed(ctx context.Context, codec string) error {
+	if _, err := ipfs.CodecPrefix(codec); err != nil {
+		return err
+	}
 	d, err := did.Parse(node.CurrentConfig.Did)
 	if err != nil {
 		log.Errorf("could not parse DID %s: %v", node.CurrentConfig.Did, err)
@@ -49,6 +50,10 @@ func CreateFeed(ctx context.Context) error {
 		log.Errorf("could not resolve ENS name %s", node.CurrentConfig.Did)
 		return err
 	}
+	feedKey, err := node.EnsureIPNSKey("feed")
+	if err != nil {
+		return err
+	}
 	ipfscore, err := ipfs.StartIPFSNode(ctx, node.CurrentConfig.IPFSPrivKey, node.CurrentConfig.IPFSPubKey)
 	if err != nil {
 		return err
@@ -66,48 +71,44 @@ func CreateFeed(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("error creating IPLD node from feed for %s: %v", feed.Did, err)
 	}
-	var buf bytes.Buffer
-	err = dagjson.Encode(dagnode, &buf)
+	blk, err := ipfs.EncodeIPLDNode(dagnode, codec)
 	if err != nil {
-		log.Errorf("error encoding DAG node for feed %v as DAG-JSON: %v", feed.Did, err)
-		ipfscore.Shutdown()
-		return err
-	}
-	cidprefix := cid.Prefix{
-		Version:  1, // Usually '1'.
-		Codec:    cid.DagJSON,
-		MhType:   mh.SHA3_384, // 0x15 means "sha3-384" -- See the multicodecs table: https://github.com/multiformats/multicodec/
-		MhLength: 48,          // sha3-384 hash has a 48-byte sum.
-	}
-	xcid, err := cidprefix.Sum(buf.Bytes())
-	if err != nil {
-		log.Errorf("error creating CID for DAG node for feed %v as DAG-JSON: %v", feed.Did, err)
-		ipfscore.Shutdown()
-		return err
-	}
-	blk, err := blocks.NewBlockWithCid(buf.Bytes(), xcid)
-	if err != nil {
-		log.Errorf("error creating IPFS block for DAG node for feed %v as DAG-JSON: %v", feed.Did, err)
+		log.Errorf("error creating IPFS block for DAG node for feed %v as %s: %v", feed.Did, codec, err)
 		ipfscore.Shutdown()
 		return err
 	}
 	log.Infof("IPFS block cid for DAG node for feed %s : %s", feed.Did, blk.Cid())
-	err = ipfscore.Api.Dag().Pinning().Add(ctx, &ipldlegacy.LegacyNode{blk, dagnode})
+	// pin and upload the feed block first and only publish the IPNS names once both succeed
+	tx := outbox.Begin("feed " + feed.Did)
+	err = tx.Prepare(ctx, fmt.Sprintf("pin block %v to the local IPFS node", blk.Cid()), func(ctx context.Context) error {
+		ctx, cancel := util.WithTimeout(ctx, ipfs.PinTimeout)
+		defer cancel()
+		return ipfscore.Api.Dag().Pinning().Add(ctx, &ipldlegacy.LegacyNode{Block: blk, Node: dagnode})
+	}, func(ctx context.Context) error {
+		return ipfs.UnpinBlock(ctx, *ipfscore, blk.Cid())
+	})
 	if err != nil {
-
 		log.Errorf("error pinning IPFS block %v for DAG node for feed %v: %v", blk.Cid(), feed.Did, err)
 		ipfscore.Shutdown()
 		return err
 	}
-
-	_, err = ipfs.PinIPLDBlockToW3S(ctx, ipfscore.Api, node.CurrentConfig.W3SSecretKey, blk)
+	err = tx.Prepare(ctx, fmt.Sprintf("pin block %v with the pinning services", blk.Cid()), func(ctx context.Context) error {
+		return ipfs.PinRemote(ctx, *ipfscore, blk.Cid())
+	}, nil)
 	if err != nil {
-		log.Errorf("could not pin IPFS block %v using Web3.Storage service")
+		log.Errorf("error pinning IPFS block %v for DAG node for feed %v with the pinning services: %v", blk.Cid(), feed.Did, err)
 		ipfscore.Shutdown()
 		return err
 	}
-	_ = ipfs.PublishIPNSRecordForDAGNodeToW3S(ctx, node.CurrentConfig.W3SSecretKey, blk.Cid(), node.CurrentConfig.IPFSPrivKey, node.CurrentConfig.IPFSPubKey)
-	err = ipfs.PublishIPNSRecordForDAGNode(ctx, *ipfscore, node.CurrentConfig.W3SSecretKey, blk.Cid(), "user", node.CurrentConfig.IPFSPrivKey, node.CurrentConfig.IPFSPubKey)
+	node.RegisterOutboxHandlers(*ipfscore)
+	c := blk.Cid().String()
+	p := "/ipfs/" + c
+	tx.Commit(outbox.KindW3SNamePublish, "feed:"+c, map[string]string{"cid": c, "key": "feed"})
+	tx.Commit(outbox.KindIPNSPublish, "feed:"+p, map[string]string{"key": "feed", "path": p})
+	err = tx.Apply(ctx)
+	if err == nil && node.CurrentConfig.WarmGateways && !util.DryRun {
+		ipfs.WarmGateways(ctx, node.CurrentConfig.Gateways, blk.Cid(), feedKey.Name())
+	}
 	ipfscore.Shutdown()
 	return err
 }
@@ -0,0 +1,112 @@
+package feed
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+
+	"github.com/allisterb/patr/devnet"
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/nostr"
+)
+
+// FetchFeed fetches the posts of a remote author's feed from IPFS by following prev links back from the head,
+// within the author's fetch budget. If the budget is exceeded the feed is truncated and the posts fetched so far
+// are returned, newest first. Posts which are not signed by the author's Nostr public key are quarantined and
+// fetching stops there. Posts rejected by the content filters are left out.
+func FetchFeed(ctx context.Context, ipfscore ipfs.IPFSCore, author string, pubkey string, head cid.Cid) ([]cid.Cid, bool, error) {
+	posts, next, err := fetchFeed(ctx, ipfscore, author, pubkey, head, cid.Undef, nil)
+	return posts, next.Defined(), err
+}
+
+// fetchFeed fetches posts back from head until it reaches the post until, the start of the feed or the end of the
+// budget. If the fetch was truncated it returns the next post to fetch.
+func fetchFeed(ctx context.Context, ipfscore ipfs.IPFSCore, author string, pubkey string, head cid.Cid, until cid.Cid, onPost func(cid.Cid, []byte)) ([]cid.Cid, cid.Cid, error) {
+	return fetchFeedTracked(ctx, ipfscore, ipfs.NewFetchTracker(author), pubkey, head, until, onPost)
+}
+
+// fetchFeedTracked is fetchFeed counting the fetched blocks with a tracker.
+func fetchFeedTracked(ctx context.Context, ipfscore ipfs.IPFSCore, tracker *ipfs.FetchTracker, pubkey string, head cid.Cid, until cid.Cid, onPost func(cid.Cid, []byte)) ([]cid.Cid, cid.Cid, error) {
+	author := tracker.Author
+	posts := []cid.Cid{}
+	c := head
+	for depth := 0; c.Defined() && !c.Equals(until); depth++ {
+		data, err := fetchBlock(ctx, ipfscore, c, tracker)
+		if err != nil {
+			return posts, cid.Undef, err
+		}
+		if !tracker.Allow(len(data), depth) {
+			break
+		}
+		if IsQuarantined(c) {
+			return posts, cid.Undef, fmt.Errorf("post %v in feed of %s is quarantined", c, author)
+		}
+		if err = ValidatePost(c, data, pubkey); err != nil {
+			Quarantine(c, author, err)
+			return posts, cid.Undef, fmt.Errorf("post %v in feed of %s is invalid: %v", c, author, err)
+		}
+		if evt, err := postEvent(c, data); err == nil && nostr.FilterEvent(ctx, &evt).Action == nostr.VerdictReject {
+			log.Infof("leaving out post %v in feed of %s rejected by the content filters", c, author)
+		} else {
+			posts = append(posts, c)
+			if onPost != nil {
+				onPost(c, data)
+			}
+		}
+		prev, err := prevLink(c, data)
+		if err != nil {
+			return posts, cid.Undef, fmt.Errorf("could not decode post %v in feed of %s: %v", c, author, err)
+		}
+		c = prev
+	}
+	if tracker.Truncated {
+		log.Warnf("feed of %s was truncated to %v posts", author, len(posts))
+		return posts, c, nil
+	}
+	log.Infof("fetched %v posts (%v bytes) from feed of %s", len(posts), tracker.Bytes, author)
+	return posts, cid.Undef, nil
+}
+
+// fetchBlock reads a block from IPFS, falling back to trustless gateways, and cuts it to the remaining bytes in the budget.
+func fetchBlock(ctx context.Context, ipfscore ipfs.IPFSCore, c cid.Cid, tracker *ipfs.FetchTracker) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, ipfs.DHTQueryTimeout)
+	defer cancel()
+	data, err := ipfs.RetrieveBlock(ctx, ipfscore, c)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch block %v: %v", c, err)
+	}
+	rem := tracker.Remaining()
+	if rem >= 0 && int64(len(data)) > rem+1 {
+		data = data[:rem+1]
+	}
+	data = devnet.Corrupt(devnet.FaultBlockFetch, data)
+	// Blocks cut short by the budget can't be verified and are rejected by the budget.
+	if rem < 0 || int64(len(data)) <= rem {
+		if h, err := c.Prefix().Sum(data); err != nil || !h.Equals(c) {
+			return nil, fmt.Errorf("block %v failed hash verification", c)
+		}
+	}
+	return data, nil
+}
+
+func prevLink(c cid.Cid, data []byte) (cid.Cid, error) {
+	n, err := ipfs.DecodeIPLDNode(c, data)
+	if err != nil {
+		return cid.Undef, err
+	}
+	prev, err := n.LookupByString("prev")
+	if err != nil {
+		return cid.Undef, nil
+	}
+	l, err := prev.AsLink()
+	if err != nil {
+		return cid.Undef, err
+	}
+	cl, ok := l.(cidlink.Link)
+	if !ok {
+		return cid.Undef, fmt.Errorf("prev is not a CID link")
+	}
+	return cl.Cid, nil
+}
@@ -0,0 +1,325 @@
+package feed
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	"github.com/ipld/go-ipld-prime/linking"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	gonostr "github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/blockchain"
+	"github.com/allisterb/patr/did"
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/node"
+	"github.com/allisterb/patr/nostr"
+	"github.com/allisterb/patr/util"
+)
+
+// Follow follows the feed of an author given by DID, npub, nprofile or patr:// identity and publishes the new contact
+// list. The feed IPNS name is read from the identity or the author's profile on the relays if it is not specified.
+func Follow(ctx context.Context, ipfscore ipfs.IPFSCore, target string, feedName string) (node.Follow, error) {
+	feedName, pubkey := strings.TrimPrefix(feedName, "/ipns/"), ""
+	if node.IsIdentity(target) {
+		i, err := node.ParseIdentity(target)
+		if err != nil {
+			return node.Follow{}, err
+		}
+		target, pubkey = i.Did, i.NostrPubKey
+		if feedName == "" {
+			feedName = i.FeedName
+		}
+		if feedName == "" && pubkey != "" {
+			rctx, cancel := util.WithTimeout(ctx, nostr.RelayTimeout)
+			defer cancel()
+			if _, name, err := node.ResolveProfileFeed(rctx, pubkey, i.Relays); err == nil {
+				feedName = name
+			}
+		}
+	} else if nostr.IsPubKeyEntity(target) {
+		pk, relays, err := nostr.DecodePubKey(target)
+		if err != nil {
+			return node.Follow{}, err
+		}
+		rctx, cancel := util.WithTimeout(ctx, nostr.RelayTimeout)
+		defer cancel()
+		d, name, err := node.ResolveProfileFeed(rctx, pk, relays)
+		if err != nil {
+			return node.Follow{}, err
+		}
+		target, pubkey = d, pk
+		if feedName == "" {
+			feedName = name
+		}
+	}
+	if target == "" || feedName == "" {
+		return node.Follow{}, fmt.Errorf("you must specify the DID and feed IPNS name or the npub of the author")
+	}
+	d, err := did.Parse(target)
+	if err != nil {
+		return node.Follow{}, fmt.Errorf("invalid DID %s: %v", target, err)
+	}
+	if _, ok := node.FindFollow(target); ok {
+		return node.Follow{}, fmt.Errorf("already following %s", target)
+	}
+	r, err := blockchain.ResolveENS(d.ID.ID, node.CurrentConfig.InfuraSecretKey)
+	if err != nil {
+		return node.Follow{}, err
+	}
+	if r.NostrPubKey == "" {
+		return node.Follow{}, fmt.Errorf("%s does not have a Nostr public key", target)
+	}
+	if pubkey != "" && r.NostrPubKey != pubkey {
+		return node.Follow{}, fmt.Errorf("the Nostr public key of %s is not %s", target, pubkey)
+	}
+	f := node.Follow{Did: target, NostrPubKey: r.NostrPubKey, FeedName: feedName, Added: util.Now()}
+	if err = node.SaveFollow(f); err != nil {
+		return node.Follow{}, err
+	}
+	log.Infof("following %s", target)
+	if err = PublishContactList(ctx, ipfscore); err != nil {
+		log.Warnf("could not publish contact list: %v", err)
+	}
+	return f, nil
+}
+
+// NewContactList signs the NIP-02 kind-3 contact list of the followed feeds. Each p tag has the DID of the author as
+// the petname.
+func NewContactList(privkey string, follows []node.Follow) (gonostr.Event, error) {
+	tags := gonostr.Tags{}
+	for _, f := range follows {
+		if f.NostrPubKey != "" {
+			tags = append(tags, gonostr.Tag{"p", f.NostrPubKey, "", f.Did})
+		}
+	}
+	evt := gonostr.Event{
+		CreatedAt: gonostr.Timestamp(util.Now().Unix()),
+		Kind:      gonostr.KindContactList,
+		Tags:      tags,
+	}
+	if err := util.CheckPublishLock(); err != nil {
+		return gonostr.Event{}, err
+	}
+	if err := evt.Sign(privkey); err != nil {
+		log.Errorf("could not sign contact list: %v", err)
+		return gonostr.Event{}, err
+	}
+	return evt, nil
+}
+
+// followEntry assembles the entry of a follow in the IPLD node of a contact list.
+func followEntry(f node.Follow) func(datamodel.MapAssembler) {
+	return func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "did", qp.String(f.Did))
+		qp.MapEntry(ma, "pubkey", qp.String(f.NostrPubKey))
+		qp.MapEntry(ma, "feed", qp.String(f.FeedName))
+	}
+}
+
+func followEntryNode(f node.Follow) (datamodel.Node, error) {
+	return qp.BuildMap(basicnode.Prototype.Any, 3, followEntry(f))
+}
+
+func stringEntry(n datamodel.Node, key string) (string, error) {
+	v, err := n.LookupByString(key)
+	if err != nil {
+		return "", err
+	}
+	return v.AsString()
+}
+
+// ContactListToIPLDNode creates the IPLD node of a contact list with the DID, Nostr public key and feed IPNS name of
+// each followed feed and the signed contact list event.
+func ContactListToIPLDNode(d string, follows []node.Follow, evt gonostr.Event) (datamodel.Node, error) {
+	evtnode, err := ipfs.NostrEventToIPLDNode(evt)
+	if err != nil {
+		return nil, err
+	}
+	n, err := qp.BuildMap(basicnode.Prototype.Any, 5, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "type", qp.String("contacts"))
+		qp.MapEntry(ma, "did", qp.String(d))
+		qp.MapEntry(ma, "created_at", qp.Int(int64(evt.CreatedAt)))
+		qp.MapEntry(ma, "follows", qp.List(int64(len(follows)), func(la datamodel.ListAssembler) {
+			for _, f := range follows {
+				qp.ListEntry(la, qp.Map(3, followEntry(f)))
+			}
+		}))
+		qp.MapEntry(ma, "event", qp.Node(evtnode))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create IPLD node for contact list %s: %v", evt.ID, err)
+	}
+	return n, nil
+}
+
+// contactListPatch returns the IPLD patch which updates the IPLD node of a published contact list to a new list of
+// follows and contact list event, so unchanged follows are not rewritten.
+func contactListPatch(ctx context.Context, ipfscore ipfs.IPFSCore, prev cid.Cid, follows []node.Follow, evt gonostr.Event) ([]ipfs.PatchOp, error) {
+	n, err := ipfscore.LS.Load(linking.LinkContext{Ctx: ctx}, cidlink.Link{Cid: prev}, basicnode.Prototype.Any)
+	if err != nil {
+		return nil, err
+	}
+	fl, err := n.LookupByString("follows")
+	if err != nil {
+		return nil, err
+	}
+	current := map[string]node.Follow{}
+	for _, f := range follows {
+		current[f.Did] = f
+	}
+	ops, published := []ipfs.PatchOp{}, map[string]bool{}
+	// entries are removed from the end of the list so the indexes of the remaining entries do not change
+	for i := fl.Length() - 1; i >= 0; i-- {
+		e, err := fl.LookupByIndex(i)
+		if err != nil {
+			return nil, err
+		}
+		d, _ := stringEntry(e, "did")
+		pubkey, _ := stringEntry(e, "pubkey")
+		feedName, _ := stringEntry(e, "feed")
+		path := datamodel.ParsePath("follows").AppendSegment(datamodel.PathSegmentOfInt(i))
+		f, ok := current[d]
+		if !ok || published[d] {
+			ops = append(ops, ipfs.PatchOp{Op: ipfs.PatchRemove, Path: path})
+			continue
+		}
+		published[d] = true
+		if f.NostrPubKey != pubkey || f.FeedName != feedName {
+			v, err := followEntryNode(f)
+			if err != nil {
+				return nil, err
+			}
+			ops = append(ops, ipfs.PatchOp{Op: ipfs.PatchReplace, Path: path, Value: v})
+		}
+	}
+	for _, f := range follows {
+		if published[f.Did] {
+			continue
+		}
+		v, err := followEntryNode(f)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, ipfs.PatchOp{Op: ipfs.PatchAdd, Path: datamodel.ParsePath("follows/-"), Value: v})
+	}
+	evtnode, err := ipfs.NostrEventToIPLDNode(evt)
+	if err != nil {
+		return nil, err
+	}
+	return append(ops,
+		ipfs.PatchOp{Op: ipfs.PatchReplace, Path: datamodel.ParsePath("did"), Value: basicnode.NewString(node.CurrentConfig.Did)},
+		ipfs.PatchOp{Op: ipfs.PatchReplace, Path: datamodel.ParsePath("created_at"), Value: basicnode.NewInt(int64(evt.CreatedAt))},
+		ipfs.PatchOp{Op: ipfs.PatchReplace, Path: datamodel.ParsePath("event"), Value: evtnode},
+	), nil
+}
+
+// PublishContactList publishes the followed feeds as a kind-3 contact list to the profile relays and as an IPLD node,
+// uploaded to Web3.Storage if configured, which the profile links to so the contact list can be read from gateways.
+// A previously published contact list node is patched with the changed follows.
+func PublishContactList(ctx context.Context, ipfscore ipfs.IPFSCore) error {
+	follows := node.CurrentConfig.Follows
+	evt, err := NewContactList(node.CurrentConfig.NostrPrivKey, follows)
+	if err != nil {
+		return err
+	}
+	if util.DryRun {
+		log.Infof("dry run: would publish contact list of %v follows", len(follows))
+		return nil
+	}
+	c := cid.Undef
+	if prev := optionalCid(node.CurrentConfig.ContactList); prev.Defined() {
+		// the patched nodes are uploaded to Web3.Storage by the IPFS link system
+		ipfscore.W3S.SetAuthToken(node.CurrentConfig.W3SSecretKey)
+		ops, err := contactListPatch(ctx, ipfscore, prev, follows, evt)
+		if err == nil {
+			c, err = ipfs.PatchBlock(ctx, ipfscore, prev, ops)
+		}
+		if err != nil {
+			log.Warnf("could not patch contact list %v, writing a new contact list: %v", prev, err)
+			c = cid.Undef
+		}
+	}
+	if !c.Defined() {
+		n, err := ContactListToIPLDNode(node.CurrentConfig.Did, follows, evt)
+		if err != nil {
+			return err
+		}
+		blk, err := ipfs.PutIPLDNode(ctx, ipfscore, n)
+		if err != nil {
+			log.Errorf("could not write contact list to IPFS: %v", err)
+			return err
+		}
+		if len(ipfs.RemotePinners(ipfscore)) > 0 {
+			if err = ipfs.PinRemote(ctx, ipfscore, blk.Cid()); err != nil {
+				log.Warnf("could not pin contact list %v with the pinning services: %v", blk.Cid(), err)
+			}
+		}
+		c = blk.Cid()
+	}
+	config := node.CurrentConfig
+	config.ContactList = c.String()
+	if !config.Profile.Updated.IsZero() {
+		// The profile links to the contact list so it is republished with a newer date relays will accept.
+		config.Profile.Updated = util.Now()
+	}
+	if err = node.SaveConfig(config); err != nil {
+		return err
+	}
+	log.Infof("published contact list of %v follows at %v", len(follows), c)
+	if err = node.PublishToProfileRelays(ctx, evt); err != nil {
+		return err
+	}
+	return node.PublishProfile(ctx)
+}
+
+// SetFollowHandlers registers the follow API. POST /follows follows the author in the request and DELETE /follows/{did}
+// unfollows a DID. GET /follows/contacts returns the CID of the IPLD node of the contact list.
+func SetFollowHandlers(ctx context.Context, ipfscore ipfs.IPFSCore, router *mux.Router) {
+	router.Path("/follows").Methods("POST").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		req := struct {
+			Target string `json:"target"`
+			Feed   string `json:"feed"`
+		}{}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil || req.Target == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"message": "the request must be JSON with the target to follow"})
+			return
+		}
+		f, err := Follow(ctx, ipfscore, req.Target, req.Feed)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"did": f.Did, "pubkey": f.NostrPubKey, "feed": f.FeedName})
+	})
+	router.Path("/follows/{did}").Methods("DELETE").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		d := mux.Vars(r)["did"]
+		if err := Unfollow(ctx, ipfscore, []string{d}); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"message": "unfollowed " + d})
+	})
+	router.Path("/follows/contacts").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		c := optionalCid(node.CurrentConfig.ContactList)
+		if !c.Defined() {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"message": "the contact list was not published"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"cid": c.String()})
+	})
+}
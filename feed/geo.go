@@ -0,0 +1,34 @@
+package feed
+
+import (
+	"fmt"
+
+	"github.com/allisterb/patr/node"
+	"github.com/allisterb/patr/util"
+)
+
+// MaxGeotagPrecision caps geotags at 5 geohash characters, an area of about 5km by 5km, so posts never reveal
+// a precise location.
+const MaxGeotagPrecision = 5
+
+const DefaultGeotagPrecision = 4
+
+// GeotagPrecision returns the geohash precision of geotags from the node configuration.
+func GeotagPrecision() int {
+	p := node.CurrentConfig.GeotagPrecision
+	if p <= 0 {
+		p = DefaultGeotagPrecision
+	}
+	if p > MaxGeotagPrecision {
+		p = MaxGeotagPrecision
+	}
+	return p
+}
+
+// Geotag returns the coarse geohash of a location for a post. Geotags are off unless enabled in the node configuration.
+func Geotag(lat float64, lon float64) (string, error) {
+	if !node.CurrentConfig.Geotags {
+		return "", fmt.Errorf("geotags are disabled in the node configuration")
+	}
+	return util.EncodeGeohash(lat, lon, GeotagPrecision())
+}
@@ -0,0 +1,169 @@
+package feed
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	gonostr "github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/ipfs"
+)
+
+// ImportedPost is a post read from an import file.
+type ImportedPost struct {
+	Timestamp   string   `json:"timestamp"`
+	Text        string   `json:"text"`
+	Attachments []string `json:"attachments"`
+	Latitude    *float64 `json:"lat,omitempty"`
+	Longitude   *float64 `json:"lon,omitempty"`
+	Voice       string   `json:"voice,omitempty"`
+}
+
+func ParseTimestamp(ts string) (time.Time, error) {
+	if ts == "" {
+		return time.Time{}, fmt.Errorf("missing timestamp")
+	}
+	if u, err := strconv.ParseInt(ts, 10, 64); err == nil {
+		return time.Unix(u, 0), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02", time.RubyDate} {
+		if t, err := time.Parse(layout, ts); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("could not parse timestamp %s", ts)
+}
+
+// ReadImportFile reads posts from a JSON array or a CSV file with timestamp, text and attachments columns and
+// optional lat, lon and voice columns. Attachments in CSV files are separated by spaces.
+func ReadImportFile(path string) ([]ImportedPost, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		posts := []ImportedPost{}
+		if err = json.NewDecoder(f).Decode(&posts); err != nil {
+			return nil, fmt.Errorf("could not read JSON posts from %s: %v", path, err)
+		}
+		return posts, nil
+	case ".csv":
+		return readCSV(f)
+	default:
+		return nil, fmt.Errorf("unsupported import file type: %s", filepath.Ext(path))
+	}
+}
+
+func readCSV(r io.Reader) ([]ImportedPost, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("could not read CSV posts: %v", err)
+	}
+	if len(records) == 0 {
+		return []ImportedPost{}, nil
+	}
+	cols := map[string]int{"timestamp": 0, "text": 1, "attachments": 2}
+	if _, err := ParseTimestamp(records[0][0]); err != nil {
+		for i, h := range records[0] {
+			cols[strings.ToLower(strings.TrimSpace(h))] = i
+		}
+		records = records[1:]
+	}
+	posts := []ImportedPost{}
+	for _, rec := range records {
+		p := ImportedPost{}
+		if i := cols["timestamp"]; i < len(rec) {
+			p.Timestamp = rec[i]
+		}
+		if i := cols["text"]; i < len(rec) {
+			p.Text = rec[i]
+		}
+		if i := cols["attachments"]; i < len(rec) {
+			p.Attachments = strings.Fields(rec[i])
+		}
+		p.Latitude, p.Longitude = csvFloat(cols, "lat", rec), csvFloat(cols, "lon", rec)
+		if i, ok := cols["voice"]; ok && i < len(rec) {
+			p.Voice = strings.TrimSpace(rec[i])
+		}
+		posts = append(posts, p)
+	}
+	return posts, nil
+}
+
+func csvFloat(cols map[string]int, name string, rec []string) *float64 {
+	i, ok := cols[name]
+	if !ok || i >= len(rec) {
+		return nil
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(rec[i]), 64)
+	if err != nil {
+		return nil
+	}
+	return &f
+}
+
+// ImportPosts appends posts to the feed in chronological order starting from the current head and returns the new head.
+func ImportPosts(ctx context.Context, ipfscore ipfs.IPFSCore, privkey string, posts []ImportedPost, head cid.Cid) (cid.Cid, int, error) {
+	type timedPost struct {
+		t time.Time
+		p ImportedPost
+	}
+	tps := []timedPost{}
+	for i, p := range posts {
+		t, err := ParseTimestamp(p.Timestamp)
+		if err != nil {
+			return head, 0, fmt.Errorf("invalid timestamp for post %v: %v", i+1, err)
+		}
+		tps = append(tps, timedPost{t, p})
+	}
+	sort.SliceStable(tps, func(i, j int) bool { return tps[i].t.Before(tps[j].t) })
+	n := 0
+	for _, tp := range tps {
+		if strings.TrimSpace(tp.p.Text) == "" && len(tp.p.Attachments) == 0 && tp.p.Voice == "" {
+			log.Warnf("skipping empty post at %v", tp.t)
+			continue
+		}
+		var tags gonostr.Tags
+		if tp.p.Latitude != nil && tp.p.Longitude != nil {
+			gh, err := Geotag(*tp.p.Latitude, *tp.p.Longitude)
+			if err != nil {
+				log.Warnf("not geotagging post at %v: %v", tp.t, err)
+			} else {
+				tags = gonostr.Tags{gonostr.Tag{"g", gh}}
+			}
+		}
+		attachments := tp.p.Attachments
+		if tp.p.Voice != "" {
+			var err error
+			if attachments, tags, err = attachVoiceNote(ctx, ipfscore, tp.p.Voice, attachments, tags); err != nil {
+				return head, n, fmt.Errorf("could not encode voice note of post at %v: %v", tp.t, err)
+			}
+		}
+		post, err := NewPost(privkey, tp.p.Text, attachments, tags, tp.t)
+		if err != nil {
+			return head, n, err
+		}
+		h, err := AppendPost(ctx, ipfscore, post, head)
+		if err != nil {
+			return head, n, err
+		}
+		head = h
+		n++
+	}
+	log.Infof("imported %v posts, feed head is now %v", n, head)
+	return head, n, nil
+}
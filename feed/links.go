@@ -0,0 +1,322 @@
+package feed
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ipfs/go-cid"
+
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/node"
+	"github.com/allisterb/patr/nostr"
+	"github.com/allisterb/patr/util"
+)
+
+// LinkCheckTimeout is the timeout of checking a single link.
+var LinkCheckTimeout = 20 * time.Second
+
+// DeadAfterFailures is the number of checks in a row a link must fail before it is flagged as dead, so links on sites
+// which are briefly down aren't flagged.
+const DeadAfterFailures = 3
+
+// Link is the state of a link in the user's own posts.
+type Link struct {
+	URL      string    `json:"url"`
+	Posts    []string  `json:"posts"`
+	Status   int       `json:"status,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Failures int       `json:"failures"`
+	Dead     bool      `json:"dead"`
+	Archive  string    `json:"archive,omitempty"`
+	Checked  time.Time `json:"checked"`
+}
+
+var linkPattern = regexp.MustCompile(`https?://[^\s<>"']+`)
+
+var linksLock = sync.Mutex{}
+
+// archivedLinks replaces the dead links which have an archived copy with the gateway URL of the copy.
+var archivedLinks = strings.NewReplacer()
+
+func linksFile() string {
+	return filepath.Join(util.AppData, "links.json")
+}
+
+func readLinks() (map[string]Link, error) {
+	links := make(map[string]Link)
+	if !util.PathExists(linksFile()) {
+		return links, nil
+	}
+	data, err := util.ReadDataFile(linksFile())
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &links); err != nil {
+		log.Errorf("could not read JSON data from links file %s: %v", linksFile(), err)
+		return nil, err
+	}
+	return links, nil
+}
+
+func writeLinks(links map[string]Link) error {
+	data, _ := json.MarshalIndent(links, "", " ")
+	if err := util.WriteDataFile(linksFile(), data); err != nil {
+		return err
+	}
+	setArchivedLinks(links)
+	return nil
+}
+
+// setArchivedLinks updates the replacements of dead links with their archived copies.
+func setArchivedLinks(links map[string]Link) {
+	replacements := []string{}
+	for _, l := range links {
+		if l.Dead && l.Archive != "" {
+			replacements = append(replacements, l.URL, ipfs.GatewayURL(l.Archive, false))
+		}
+	}
+	archivedLinks = strings.NewReplacer(replacements...)
+}
+
+// postLinks returns the http and https URLs in the text of a post, with trailing punctuation removed.
+func postLinks(text string) []string {
+	urls := []string{}
+	for _, u := range linkPattern.FindAllString(text, -1) {
+		u = strings.TrimRight(u, ".,;:!?)]}")
+		if !util.Contains(urls, u) {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// ownLinks walks the user's own feed from its head and returns the post event IDs each link appears in.
+func ownLinks(ctx context.Context, ipfscore ipfs.IPFSCore) (map[string][]string, error) {
+	links := make(map[string][]string)
+	if node.CurrentConfig.FeedHead == "" {
+		return links, nil
+	}
+	c, err := parsePathCid(node.CurrentConfig.FeedHead)
+	if err != nil {
+		return nil, fmt.Errorf("invalid feed head %s: %v", node.CurrentConfig.FeedHead, err)
+	}
+	for c.Defined() {
+		data, err := ipfs.GetBlock(ctx, ipfscore, c)
+		if err != nil {
+			return nil, fmt.Errorf("could not read post %v: %v", c, err)
+		}
+		if evt, err := postEvent(c, data); err == nil {
+			for _, u := range postLinks(evt.Content) {
+				links[u] = append(links[u], evt.ID)
+			}
+		}
+		prev, err := prevLink(c, data)
+		if err != nil {
+			return nil, fmt.Errorf("could not read previous post of %v: %v", c, err)
+		}
+		c = prev
+	}
+	return links, nil
+}
+
+// checkLink requests a link and returns the HTTP status. Servers which don't allow HEAD requests are sent a GET request.
+func checkLink(ctx context.Context, hc *http.Client, url string) (int, error) {
+	status := 0
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		ctx, cancel := util.WithTimeout(ctx, LinkCheckTimeout)
+		req, err := http.NewRequestWithContext(ctx, method, url, nil)
+		if err != nil {
+			cancel()
+			return 0, err
+		}
+		resp, err := hc.Do(req)
+		if err != nil {
+			cancel()
+			return 0, err
+		}
+		resp.Body.Close()
+		cancel()
+		status = resp.StatusCode
+		if status != http.StatusMethodNotAllowed && status != http.StatusNotImplemented {
+			break
+		}
+	}
+	return status, nil
+}
+
+// linkAlive returns true if a link check shows the link is still there. Sites which require a login or are rate limiting
+// the node are not dead.
+func linkAlive(status int, err error) bool {
+	if err != nil {
+		return false
+	}
+	return status < 400 || status == http.StatusUnauthorized || status == http.StatusForbidden || status == http.StatusTooManyRequests
+}
+
+// CheckLinks checks the links in the user's own posts and flags links which have failed DeadAfterFailures checks in a row
+// as dead.
+func CheckLinks(ctx context.Context, ipfscore ipfs.IPFSCore) ([]Link, error) {
+	found, err := ownLinks(ctx, ipfscore)
+	if err != nil {
+		log.Errorf("could not read links in feed: %v", err)
+		return nil, err
+	}
+	links, err := Links(false)
+	if err != nil {
+		return nil, err
+	}
+	previous := make(map[string]Link)
+	for _, l := range links {
+		previous[l.URL] = l
+	}
+	hc := &http.Client{}
+	checked := make(map[string]Link)
+	for u, posts := range found {
+		l := previous[u]
+		l.URL, l.Posts, l.Checked = u, posts, util.Now()
+		if util.DryRun {
+			log.Infof("dry run: would check link %s", u)
+			continue
+		}
+		status, err := checkLink(ctx, hc, u)
+		l.Status, l.Error = status, ""
+		if err != nil {
+			l.Error = err.Error()
+		}
+		if linkAlive(status, err) {
+			l.Failures, l.Dead = 0, false
+		} else {
+			l.Failures++
+			if l.Failures >= DeadAfterFailures && !l.Dead {
+				l.Dead = true
+				log.Warnf("link %s in %v posts is dead", u, len(posts))
+			}
+		}
+		checked[u] = l
+	}
+	if util.DryRun {
+		return nil, nil
+	}
+	linksLock.Lock()
+	defer linksLock.Unlock()
+	// Keep archived copies recorded while the links were being checked.
+	if current, err := readLinks(); err == nil {
+		for u, l := range current {
+			if c, ok := checked[u]; ok && c.Archive == "" {
+				c.Archive = l.Archive
+				checked[u] = c
+			}
+		}
+	}
+	if err = writeLinks(checked); err != nil {
+		log.Errorf("could not save link check results: %v", err)
+		return nil, err
+	}
+	return sortedLinks(checked, false), nil
+}
+
+func sortedLinks(links map[string]Link, deadOnly bool) []Link {
+	ls := []Link{}
+	for _, l := range links {
+		if !deadOnly || l.Dead {
+			ls = append(ls, l)
+		}
+	}
+	sort.Slice(ls, func(i, j int) bool { return ls[i].URL < ls[j].URL })
+	return ls
+}
+
+// Links returns the links in the user's own posts from the last check, or only the dead links.
+func Links(deadOnly bool) ([]Link, error) {
+	linksLock.Lock()
+	defer linksLock.Unlock()
+	links, err := readLinks()
+	if err != nil {
+		return nil, err
+	}
+	return sortedLinks(links, deadOnly), nil
+}
+
+// SetLinkArchive records the CID of an archived copy of a link, which replaces the link in rendered views once it is dead.
+func SetLinkArchive(url string, c cid.Cid) error {
+	linksLock.Lock()
+	defer linksLock.Unlock()
+	links, err := readLinks()
+	if err != nil {
+		return err
+	}
+	l, ok := links[url]
+	if !ok {
+		return fmt.Errorf("link %s is not in any checked post", url)
+	}
+	l.Archive = c.String()
+	links[url] = l
+	return writeLinks(links)
+}
+
+// RewriteDeadLinks replaces the dead links in post text which have an archived copy with the gateway URL of the copy.
+func RewriteDeadLinks(text string) string {
+	linksLock.Lock()
+	r := archivedLinks
+	linksLock.Unlock()
+	return r.Replace(text)
+}
+
+// StartLinkCheck registers GET /links, which returns the checked links in the user's own posts or only the dead links
+// with ?dead=true, and schedules the link checks.
+func StartLinkCheck(ctx context.Context, ipfscore ipfs.IPFSCore, router *mux.Router) {
+	router.Path("/links").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		links, err := Links(r.URL.Query().Get("dead") == "true")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"message": "could not read links"})
+			return
+		}
+		json.NewEncoder(w).Encode(links)
+	})
+	linksLock.Lock()
+	if links, err := readLinks(); err == nil {
+		setArchivedLinks(links)
+	}
+	linksLock.Unlock()
+	nostr.RewriteLinks = RewriteDeadLinks
+	ScheduleLinkCheck(ctx, ipfscore)
+}
+
+var cancelLinkCheck context.CancelFunc
+
+// ScheduleLinkCheck checks the links every LinkCheckIntervalHours if configured, stopping the checks scheduled before.
+func ScheduleLinkCheck(ctx context.Context, ipfscore ipfs.IPFSCore) {
+	if cancelLinkCheck != nil {
+		cancelLinkCheck()
+	}
+	ctx, cancelLinkCheck = context.WithCancel(ctx)
+	hours := node.CurrentConfig.LinkCheckIntervalHours
+	if hours <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(hours) * time.Hour)
+		defer ticker.Stop()
+		for {
+			if links, err := CheckLinks(ctx, ipfscore); err == nil {
+				log.Infof("checked %v links in feed", len(links))
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
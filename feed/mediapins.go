@@ -0,0 +1,235 @@
+package feed
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ipfs/go-cid"
+
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/node"
+	"github.com/allisterb/patr/util"
+)
+
+// DefaultMediaPinDays is how long the media of followed users is pinned for unless it is bookmarked.
+const DefaultMediaPinDays = 30
+
+// MediaPinExpiryInterval is how often expired media pins are removed.
+var MediaPinExpiryInterval = time.Hour
+
+// MediaPin is an attachment of a followed user's post pinned by the node for a limited time.
+type MediaPin struct {
+	Cid        string
+	Author     string
+	Post       string
+	Size       int64
+	Pinned     time.Time
+	Expires    time.Time
+	Bookmarked bool
+}
+
+var mediaPinsLock = sync.Mutex{}
+
+func mediaPinsFile() string {
+	return filepath.Join(util.AppData, "media-pins.json")
+}
+
+func readMediaPins() (map[string]MediaPin, error) {
+	pins := make(map[string]MediaPin)
+	if !util.PathExists(mediaPinsFile()) {
+		return pins, nil
+	}
+	data, err := util.ReadDataFile(mediaPinsFile())
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &pins); err != nil {
+		log.Errorf("could not read JSON data from media pins file %s: %v", mediaPinsFile(), err)
+		return nil, err
+	}
+	return pins, nil
+}
+
+func writeMediaPins(pins map[string]MediaPin) error {
+	data, _ := json.MarshalIndent(pins, "", " ")
+	return util.WriteDataFile(mediaPinsFile(), data)
+}
+
+// MediaPinDays returns how long followed users' media is pinned for from the node configuration.
+func MediaPinDays() int {
+	if d := node.CurrentConfig.MediaPinDays; d > 0 {
+		return d
+	}
+	return DefaultMediaPinDays
+}
+
+// MediaPinQuota returns the most bytes of followed users' media which is pinned from the node configuration, or 0 if
+// there is no quota.
+func MediaPinQuota() int64 {
+	return int64(node.CurrentConfig.MediaPinQuotaMB) * 1024 * 1024
+}
+
+// MediaPins returns the media pins of followed users' attachments, oldest first.
+func MediaPins() ([]MediaPin, error) {
+	mediaPinsLock.Lock()
+	defer mediaPinsLock.Unlock()
+	pins, err := readMediaPins()
+	if err != nil {
+		return nil, err
+	}
+	return sortedMediaPins(pins), nil
+}
+
+func sortedMediaPins(pins map[string]MediaPin) []MediaPin {
+	sorted := []MediaPin{}
+	for _, p := range pins {
+		sorted = append(sorted, p)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Pinned.Before(sorted[j].Pinned) })
+	return sorted
+}
+
+// mediaPinEvictions returns the pins to remove so the unbookmarked pins fit in a quota along with size more bytes, oldest
+// first, and whether they fit after removing them. Expired pins are always removed.
+func mediaPinEvictions(pins map[string]MediaPin, quota int64, size int64, now time.Time) ([]MediaPin, bool) {
+	evict := []MediaPin{}
+	var used int64
+	kept := []MediaPin{}
+	for _, p := range sortedMediaPins(pins) {
+		if p.Bookmarked {
+			continue
+		}
+		if !p.Expires.After(now) {
+			evict = append(evict, p)
+			continue
+		}
+		used += p.Size
+		kept = append(kept, p)
+	}
+	if quota <= 0 {
+		return evict, true
+	}
+	for _, p := range kept {
+		if used+size <= quota {
+			break
+		}
+		evict = append(evict, p)
+		used -= p.Size
+	}
+	return evict, used+size <= quota
+}
+
+func unpinMedia(ctx context.Context, ipfscore ipfs.IPFSCore, pins map[string]MediaPin, evict []MediaPin) {
+	for _, p := range evict {
+		if c, err := cid.Parse(p.Cid); err == nil && !util.DryRun {
+			if err := ipfs.UnpinDAG(ctx, ipfscore, c); err != nil {
+				continue
+			}
+		}
+		log.Debugf("unpinned media %s of %s pinned at %v", p.Cid, p.Author, p.Pinned)
+		delete(pins, p.Cid)
+	}
+}
+
+// pinMedia pins an attachment of a followed user's post until it expires, removing expired and old pins to keep the
+// media within the quota. Attachments which don't fit in the quota are not pinned.
+func pinMedia(ctx context.Context, ipfscore ipfs.IPFSCore, c cid.Cid, author string, post cid.Cid, size int64) error {
+	mediaPinsLock.Lock()
+	defer mediaPinsLock.Unlock()
+	pins, err := readMediaPins()
+	if err != nil {
+		return err
+	}
+	now := util.Now()
+	if p, ok := pins[c.String()]; ok {
+		if !p.Bookmarked {
+			p.Expires = now.AddDate(0, 0, MediaPinDays())
+			pins[c.String()] = p
+		}
+		return writeMediaPins(pins)
+	}
+	evict, fits := mediaPinEvictions(pins, MediaPinQuota(), size, now)
+	if !fits {
+		log.Debugf("not pinning media %v of %s, it does not fit in the media pin quota of %v bytes", c, author, MediaPinQuota())
+		return nil
+	}
+	unpinMedia(ctx, ipfscore, pins, evict)
+	if err = ipfs.PinDAG(ctx, ipfscore, c); err != nil {
+		writeMediaPins(pins)
+		return err
+	}
+	pins[c.String()] = MediaPin{Cid: c.String(), Author: author, Post: post.String(), Size: size, Pinned: now, Expires: now.AddDate(0, 0, MediaPinDays())}
+	return writeMediaPins(pins)
+}
+
+// ExpireMediaPins unpins the media of followed users which has expired and isn't bookmarked, and the oldest media over
+// the quota. It returns the number of pins removed.
+func ExpireMediaPins(ctx context.Context, ipfscore ipfs.IPFSCore) (int, error) {
+	mediaPinsLock.Lock()
+	defer mediaPinsLock.Unlock()
+	pins, err := readMediaPins()
+	if err != nil {
+		return 0, err
+	}
+	n := len(pins)
+	evict, _ := mediaPinEvictions(pins, MediaPinQuota(), 0, util.Now())
+	if len(evict) == 0 {
+		return 0, nil
+	}
+	unpinMedia(ctx, ipfscore, pins, evict)
+	if err = writeMediaPins(pins); err != nil {
+		return 0, err
+	}
+	log.Infof("unpinned %v expired media pins", n-len(pins))
+	return n - len(pins), nil
+}
+
+// BookmarkMedia keeps the media pins of an attachment or of every attachment of a post from expiring, or lets them
+// expire again. It returns the number of pins changed.
+func BookmarkMedia(c cid.Cid, bookmarked bool) (int, error) {
+	mediaPinsLock.Lock()
+	defer mediaPinsLock.Unlock()
+	pins, err := readMediaPins()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for k, p := range pins {
+		if (p.Cid != c.String() && p.Post != c.String()) || p.Bookmarked == bookmarked {
+			continue
+		}
+		p.Bookmarked = bookmarked
+		if !bookmarked {
+			p.Expires = util.Now().AddDate(0, 0, MediaPinDays())
+		}
+		pins[k] = p
+		n++
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, writeMediaPins(pins)
+}
+
+// StartMediaPinExpiry removes expired media pins periodically until the node stops.
+func StartMediaPinExpiry(ctx context.Context, ipfscore ipfs.IPFSCore, router *mux.Router) {
+	go func() {
+		ticker := time.NewTicker(MediaPinExpiryInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := ExpireMediaPins(ctx, ipfscore); err != nil {
+					log.Errorf("could not expire media pins: %v", err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,133 @@
+package feed
+
+import (
+	"context"
+	"fmt"
+
+	gonostr "github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/blockchain"
+	"github.com/allisterb/patr/did"
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/node"
+	"github.com/allisterb/patr/util"
+)
+
+// KindRedirect is the kind of the Nostr event an author posts to their feed to announce their account moved to a new DID.
+const KindRedirect = 30083
+
+// NewRedirect signs a redirect record announcing that the account of a DID moved to a new DID with a Nostr public key,
+// whose feed is published to an IPNS name.
+func NewRedirect(privkey string, from string, to string, pubkey string, feedName string) (Post, error) {
+	timestamp := util.Now()
+	evt := gonostr.Event{
+		CreatedAt: gonostr.Timestamp(timestamp.Unix()),
+		Kind:      KindRedirect,
+		Tags:      gonostr.Tags{gonostr.Tag{"d", "patr/redirect"}, gonostr.Tag{"did", from}, gonostr.Tag{"to", to}, gonostr.Tag{"p", pubkey}, gonostr.Tag{"ipns", feedName}},
+		Content:   fmt.Sprintf("%s moved to %s", from, to),
+	}
+	if err := util.CheckPublishLock(); err != nil {
+		return Post{}, err
+	}
+	if err := evt.Sign(privkey); err != nil {
+		log.Errorf("could not sign redirect record: %v", err)
+		return Post{}, err
+	}
+	return Post{Timestamp: timestamp, Text: evt.Content, Event: evt}, nil
+}
+
+// Migrate moves the user's account to a new DID. A redirect record is posted to the feed so followers switch to the new
+// DID, and the old DID is kept in the node configuration. The new DID must resolve to the Nostr public key of the node.
+func Migrate(ctx context.Context, ipfscore ipfs.IPFSCore, to string) error {
+	from := node.CurrentConfig.Did
+	if !did.IsValid(to) {
+		return fmt.Errorf("%s is not a valid Patr DID", to)
+	}
+	if to == from {
+		return fmt.Errorf("the account already uses %s", to)
+	}
+	pd, err := did.Parse(to)
+	if err != nil {
+		return fmt.Errorf("invalid DID %s: %v", to, err)
+	}
+	r, err := blockchain.ResolveENS(pd.ID.ID, node.CurrentConfig.InfuraSecretKey)
+	if err != nil {
+		return err
+	}
+	if r.NostrPubKey != node.CurrentConfig.NostrPubKey {
+		return fmt.Errorf("the Nostr public key of %s must be the public key of this node %s", to, node.CurrentConfig.NostrPubKey)
+	}
+	k, ok := node.CurrentConfig.IPNSKeys["feed"]
+	if !ok {
+		return fmt.Errorf("create your feed with patr feed create before migrating it")
+	}
+	post, err := NewRedirect(node.CurrentConfig.NostrPrivKey, from, to, r.NostrPubKey, k.Name())
+	if err != nil {
+		return err
+	}
+	if util.DryRun {
+		log.Infof("dry run: would post a redirect record from %s to %s", from, to)
+		return nil
+	}
+	head, pending, err := Publish(ctx, ipfscore, post)
+	if err != nil {
+		return err
+	}
+	config := node.CurrentConfig
+	config.PreviousDids = append(append([]string{}, config.PreviousDids...), from)
+	config.Did = to
+	if err = node.SaveConfig(config); err != nil {
+		return err
+	}
+	log.Infof("moved account from %s to %s with redirect record %v (pending: %v)", from, to, head, pending)
+	if err = node.PublishProfile(ctx); err != nil {
+		log.Warnf("could not publish profile with the new DID %s: %v", to, err)
+	}
+	return nil
+}
+
+// isRedirect returns true if a post event of a followed feed is a redirect record of the account of the follow.
+func isRedirect(evt *gonostr.Event, f node.Follow) bool {
+	return evt.Kind == KindRedirect && evt.PubKey == f.NostrPubKey && tagValue(evt, "did") == f.Did
+}
+
+// followRedirect switches a follow to the DID a redirect record of the followed account points to. The redirect is only
+// followed if the new DID resolves to the Nostr public key in the record. The previous identity is kept so its posts
+// stay in the timeline of the new DID.
+func followRedirect(f node.Follow, evt gonostr.Event) (node.Follow, error) {
+	to, pubkey, feedName := tagValue(&evt, "to"), tagValue(&evt, "p"), tagValue(&evt, "ipns")
+	if !did.IsValid(to) || pubkey == "" || feedName == "" {
+		return f, fmt.Errorf("redirect record %s of %s is invalid", evt.ID, f.Did)
+	}
+	if to == f.Did || f.MovedFrom(to) {
+		return f, fmt.Errorf("redirect record %s of %s points back to a previous DID %s", evt.ID, f.Did, to)
+	}
+	if _, ok := node.FindFollow(to); ok {
+		return f, fmt.Errorf("%s moved to %s which is already followed", f.Did, to)
+	}
+	pd, err := did.Parse(to)
+	if err != nil {
+		return f, err
+	}
+	r, err := blockchain.ResolveENS(pd.ID.ID, node.CurrentConfig.InfuraSecretKey)
+	if err != nil {
+		return f, err
+	}
+	if r.NostrPubKey != pubkey {
+		return f, fmt.Errorf("redirect record %s of %s is not confirmed by the Nostr public key of %s", evt.ID, f.Did, to)
+	}
+	nf := f
+	nf.Moved = append(append([]node.MovedIdentity{}, f.Moved...), node.MovedIdentity{
+		Did:         f.Did,
+		NostrPubKey: f.NostrPubKey,
+		FeedName:    f.FeedName,
+		Head:        f.LastSeen,
+		Moved:       evt.CreatedAt.Time(),
+	})
+	nf.Did, nf.NostrPubKey = to, pubkey
+	if feedName != f.FeedName {
+		nf.FeedName, nf.LastSeen, nf.Gap, nf.GapUntil = feedName, "", "", ""
+	}
+	log.Infof("%s moved to %s, following %s", f.Did, to, to)
+	return nf, nil
+}
@@ -0,0 +1,272 @@
+package feed
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	gonostr "github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip04"
+
+	"github.com/allisterb/patr/blockchain"
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/node"
+	"github.com/allisterb/patr/util"
+)
+
+// PaidKey is the key of the encrypted body of a paid post, kept on the author's node until a reader proves payment.
+type PaidKey struct {
+	EventID   string
+	Key       []byte
+	PriceMsat int64
+	PriceWei  string
+	Spent     []string
+	Created   time.Time
+}
+
+// PaymentProof is sent by a reader to get the key of a paid post. Auth is an event signed by the reader which tags the
+// post, and the key is encrypted to its public key. Either ZapReceipt or TxHash proves payment.
+type PaymentProof struct {
+	Auth       gonostr.Event  `json:"auth"`
+	ZapReceipt *gonostr.Event `json:"zap_receipt,omitempty"`
+	TxHash     string         `json:"tx_hash,omitempty"`
+}
+
+var paidLock = sync.Mutex{}
+
+func paidKeysFile() string {
+	return filepath.Join(util.AppData, "paidkeys.json")
+}
+
+func readPaidKeys() (map[string]PaidKey, error) {
+	keys := make(map[string]PaidKey)
+	if !util.PathExists(paidKeysFile()) {
+		return keys, nil
+	}
+	data, err := util.ReadDataFile(paidKeysFile())
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &keys); err != nil {
+		log.Errorf("could not read JSON data from paid post keys file %s: %v", paidKeysFile(), err)
+		return nil, err
+	}
+	return keys, nil
+}
+
+func writePaidKeys(keys map[string]PaidKey) error {
+	data, _ := json.MarshalIndent(keys, "", " ")
+	return util.WriteDataFile(paidKeysFile(), data)
+}
+
+// NewPaidPost creates a post whose body is encrypted with a new key. The teaser is the post text and the encrypted body
+// is in a paid tag with the price in millisats and wei. The key is saved on this node to be released on payment.
+func NewPaidPost(privkey string, teaser string, body string, priceMsat int64, priceWei *big.Int, timestamp time.Time) (Post, error) {
+	if priceMsat <= 0 && (priceWei == nil || priceWei.Sign() <= 0) {
+		return Post{}, fmt.Errorf("a paid post must have a price")
+	}
+	if priceWei == nil {
+		priceWei = big.NewInt(0)
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return Post{}, err
+	}
+	enc, err := sealBody(key, body)
+	if err != nil {
+		return Post{}, err
+	}
+	tags := gonostr.Tags{gonostr.Tag{"paid", enc, strconv.FormatInt(priceMsat, 10), priceWei.String()}}
+	post, err := NewPost(privkey, teaser, nil, tags, timestamp)
+	if err != nil {
+		return Post{}, err
+	}
+	paidLock.Lock()
+	defer paidLock.Unlock()
+	keys, err := readPaidKeys()
+	if err != nil {
+		return Post{}, err
+	}
+	keys[post.Event.ID] = PaidKey{EventID: post.Event.ID, Key: key, PriceMsat: priceMsat, PriceWei: priceWei.String(), Created: util.Now()}
+	if err = writePaidKeys(keys); err != nil {
+		log.Errorf("could not save key of paid post %s: %v", post.Event.ID, err)
+		return Post{}, err
+	}
+	return post, nil
+}
+
+// sealBody encrypts the body of a post with AES-GCM and returns it base64-encoded with the nonce.
+func sealBody(key []byte, body string) (string, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, _ := cipher.NewGCM(block)
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(body), nil)), nil
+}
+
+// openBody decrypts a post body encrypted by sealBody.
+func openBody(key []byte, enc string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(enc)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, _ := cipher.NewGCM(block)
+	if len(data) < gcm.NonceSize() {
+		return "", fmt.Errorf("encrypted body is too short")
+	}
+	body, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// DecryptPaidPost decrypts the body of a paid post with its released key.
+func DecryptPaidPost(evt gonostr.Event, key []byte) (string, error) {
+	t := evt.Tags.GetFirst([]string{"paid", ""})
+	if t == nil {
+		return "", fmt.Errorf("event %s is not a paid post", evt.ID)
+	}
+	body, err := openBody(key, t.Value())
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt paid post %s: %v", evt.ID, err)
+	}
+	return body, nil
+}
+
+func tagValue(evt *gonostr.Event, name string) string {
+	if t := evt.Tags.GetFirst([]string{name, ""}); t != nil {
+		return t.Value()
+	}
+	return ""
+}
+
+func validEvent(evt *gonostr.Event) bool {
+	ok, err := evt.CheckSignature()
+	return err == nil && ok && evt.GetID() == evt.ID
+}
+
+// verifyZap checks a NIP-57 zap receipt from one of the configured zapper services for the post, paid by the reader
+// for at least the price.
+func verifyZap(receipt *gonostr.Event, k PaidKey, reader string) error {
+	if receipt.Kind != 9735 || !validEvent(receipt) {
+		return fmt.Errorf("invalid zap receipt")
+	}
+	if !util.Contains(node.CurrentConfig.ZapperPubKeys, receipt.PubKey) {
+		return fmt.Errorf("zap receipt is not from a trusted zapper")
+	}
+	if tagValue(receipt, "e") != k.EventID || tagValue(receipt, "p") != node.CurrentConfig.NostrPubKey {
+		return fmt.Errorf("zap receipt is not for this post")
+	}
+	req := gonostr.Event{}
+	if err := json.Unmarshal([]byte(tagValue(receipt, "description")), &req); err != nil || req.Kind != 9734 || !validEvent(&req) {
+		return fmt.Errorf("zap receipt does not have a valid zap request")
+	}
+	if req.PubKey != reader {
+		return fmt.Errorf("zap was not sent by the reader")
+	}
+	amount, _ := strconv.ParseInt(tagValue(&req, "amount"), 10, 64)
+	if k.PriceMsat <= 0 || amount < k.PriceMsat {
+		return fmt.Errorf("zap of %v msat is less than the price of %v msat", amount, k.PriceMsat)
+	}
+	return nil
+}
+
+// ReleaseKey checks a payment proof for a paid post and returns the post key encrypted to the reader with NIP-04.
+// A zap receipt or transaction can only be used once.
+func ReleaseKey(ctx context.Context, eventID string, proof PaymentProof) (string, error) {
+	paidLock.Lock()
+	defer paidLock.Unlock()
+	keys, err := readPaidKeys()
+	if err != nil {
+		return "", err
+	}
+	k, ok := keys[eventID]
+	if !ok {
+		return "", fmt.Errorf("unknown paid post %s", eventID)
+	}
+	auth := proof.Auth
+	if !validEvent(&auth) || tagValue(&auth, "e") != eventID {
+		return "", fmt.Errorf("invalid auth event")
+	}
+	if d := util.Now().Sub(auth.CreatedAt.Time()); d > 5*time.Minute || d < -5*time.Minute {
+		return "", fmt.Errorf("auth event has expired")
+	}
+	spent := ""
+	switch {
+	case proof.ZapReceipt != nil:
+		if err = verifyZap(proof.ZapReceipt, k, auth.PubKey); err != nil {
+			return "", err
+		}
+		spent = proof.ZapReceipt.ID
+	case proof.TxHash != "":
+		min, ok := new(big.Int).SetString(k.PriceWei, 10)
+		if !ok || min.Sign() <= 0 || node.CurrentConfig.PaymentAddress == "" {
+			return "", fmt.Errorf("post %s cannot be paid on-chain", eventID)
+		}
+		if err = blockchain.VerifyPayment(ctx, node.CurrentConfig.InfuraSecretKey, proof.TxHash, node.CurrentConfig.PaymentAddress, min); err != nil {
+			return "", err
+		}
+		spent = proof.TxHash
+	default:
+		return "", fmt.Errorf("no proof of payment")
+	}
+	if util.Contains(k.Spent, spent) {
+		return "", fmt.Errorf("proof of payment has already been used")
+	}
+	secret, err := nip04.ComputeSharedSecret(auth.PubKey, node.CurrentConfig.NostrPrivKey)
+	if err != nil {
+		return "", err
+	}
+	enc, err := nip04.Encrypt(base64.StdEncoding.EncodeToString(k.Key), secret)
+	if err != nil {
+		return "", err
+	}
+	k.Spent = append(k.Spent, spent)
+	keys[eventID] = k
+	if err = writePaidKeys(keys); err != nil {
+		return "", err
+	}
+	log.Infof("released key of paid post %s to %s", eventID, auth.PubKey)
+	return enc, nil
+}
+
+// SetPaidHandlers registers the key release service for paid posts at POST /paid/{id}/key.
+func SetPaidHandlers(ctx context.Context, ipfscore ipfs.IPFSCore, router *mux.Router) {
+	router.Path("/paid/{id}/key").Methods("POST").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		proof := PaymentProof{}
+		if err := json.NewDecoder(r.Body).Decode(&proof); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"message": "invalid payment proof"})
+			return
+		}
+		key, err := ReleaseKey(r.Context(), mux.Vars(r)["id"], proof)
+		if err != nil {
+			w.WriteHeader(http.StatusPaymentRequired)
+			json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"key": key})
+	})
+}
@@ -0,0 +1,112 @@
+package feed
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	gonostr "github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/node"
+	"github.com/allisterb/patr/outbox"
+	"github.com/allisterb/patr/util"
+)
+
+// KeyRevocationTag is the hashtag of the post which revokes the user's keys.
+const KeyRevocationTag = "key-revocation"
+
+// PanicReport is what Panic did, and the signed revocation statement which can be republished from another device.
+type PanicReport struct {
+	Revocation gonostr.Event
+	Head       string
+	Pending    bool
+	Relays     int
+	Unpinned   int
+}
+
+// NewRevocation creates the post which revokes the user's Nostr and IPFS keys. It is tagged with the revoked keys so
+// clients can stop trusting events signed with them after the post.
+func NewRevocation(reason string) (Post, error) {
+	ipfsName, _ := ipfs.GetIPNSPublicKeyName(node.CurrentConfig.IPFSPubKey)
+	now := util.Now()
+	text := fmt.Sprintf("The keys of %s were revoked at %s because they may be compromised. Do not trust posts, messages or delegations signed with them after this post.",
+		node.CurrentConfig.Did, now.UTC().Format("2006-01-02 15:04 MST"))
+	if reason != "" {
+		text += "\n\n" + reason
+	}
+	tags := gonostr.Tags{
+		{"t", KeyRevocationTag},
+		{"did", node.CurrentConfig.Did},
+		{"revoked", "nostr", node.CurrentConfig.NostrPubKey},
+		{"revoked", "ipfs", ipfsName},
+	}
+	return NewPost(node.CurrentConfig.NostrPrivKey, text, nil, tags, now)
+}
+
+// unpinAllMedia unpins the media of followed users the node pinned, including bookmarked media, since it shows who the
+// user follows.
+func unpinAllMedia(ctx context.Context, ipfscore ipfs.IPFSCore) (int, error) {
+	mediaPinsLock.Lock()
+	defer mediaPinsLock.Unlock()
+	pins, err := readMediaPins()
+	if err != nil {
+		return 0, err
+	}
+	n := len(pins)
+	unpinMedia(ctx, ipfscore, pins, sortedMediaPins(pins))
+	if err = writeMediaPins(pins); err != nil {
+		return 0, err
+	}
+	return n - len(pins), nil
+}
+
+// Panic is for users whose device is about to be seized or is compromised. It publishes a revocation of the user's keys
+// to the feed and the external relays, unpins the media of followed users, and securely wipes the keys of paid posts
+// and the node keys. Failures to publish are logged and the data is wiped anyway. If the IPFS node could not be started
+// the revocation is only published to relays.
+func Panic(ctx context.Context, ipfscore ipfs.IPFSCore, reason string) (PanicReport, error) {
+	post, err := NewRevocation(reason)
+	if err != nil {
+		return PanicReport{}, err
+	}
+	report := PanicReport{Revocation: post.Event}
+	if util.DryRun {
+		log.Infof("dry run: would publish revocation %s to the feed and %v relays, unpin media and wipe keys", post.Event.ID, len(node.CurrentConfig.ProfileRelays))
+		return report, nil
+	}
+	if ipfscore.Api == nil {
+		log.Warnf("not publishing revocation to the feed, the IPFS node is not running")
+	} else if head, pending, err := Publish(ctx, ipfscore, post); err != nil {
+		log.Errorf("could not publish revocation to the feed: %v", err)
+	} else {
+		report.Head, report.Pending = head.String(), pending
+	}
+	data, _ := json.Marshal(post.Event)
+	for _, r := range node.CurrentConfig.ProfileRelays {
+		if err = outbox.Enqueue(outbox.KindRelayPublish, r+":"+post.Event.ID, map[string]string{"relay": r, "event": string(data)}); err != nil {
+			log.Errorf("could not queue revocation for relay %s: %v", r, err)
+			continue
+		}
+		report.Relays++
+	}
+	if err = outbox.Process(ctx); err != nil {
+		log.Errorf("could not publish revocation to relays: %v", err)
+	}
+	if ipfscore.Api != nil {
+		if report.Unpinned, err = unpinAllMedia(ctx, ipfscore); err != nil {
+			log.Errorf("could not unpin media of followed users: %v", err)
+		}
+	}
+	paidLock.Lock()
+	err = util.WipeFile(paidKeysFile())
+	paidLock.Unlock()
+	if err != nil {
+		log.Errorf("could not wipe the keys of paid posts: %v", err)
+	}
+	if err = node.WipeKeys(); err != nil {
+		return report, err
+	}
+	log.Infof("revoked and wiped the keys of %s", node.CurrentConfig.Did)
+	return report, nil
+}
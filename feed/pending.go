@@ -0,0 +1,169 @@
+package feed
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ipfs/go-cid"
+
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/node"
+	"github.com/allisterb/patr/nostr"
+	"github.com/allisterb/patr/outbox"
+	"github.com/allisterb/patr/util"
+)
+
+// PendingPublishInterval is how often the node checks whether it is back online to publish pending posts.
+var PendingPublishInterval = 30 * time.Second
+
+// MaxPendingPosts is the most posts walked back from the pending head to find the posts which are not published.
+const MaxPendingPosts = 10000
+
+// QueuePost appends a post to the chain of pending posts of the feed without publishing it. The post keeps the time it
+// was composed at since it is signed and written to IPFS immediately.
+func QueuePost(ctx context.Context, ipfscore ipfs.IPFSCore, p Post) (cid.Cid, error) {
+	prev := optionalCid(node.CurrentConfig.PendingHead)
+	if !prev.Defined() {
+		prev, _ = parsePathCid(node.CurrentConfig.FeedHead)
+	}
+	head, err := AppendPost(ctx, ipfscore, p, prev)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if util.DryRun {
+		return head, nil
+	}
+	config := node.CurrentConfig
+	config.PendingHead = head.String()
+	if err = node.SaveConfig(config); err != nil {
+		return cid.Undef, err
+	}
+	return head, nil
+}
+
+// PendingPosts returns the posts which have been queued but not published, newest first.
+func PendingPosts(ctx context.Context, ipfscore ipfs.IPFSCore) ([]cid.Cid, error) {
+	published, _ := parsePathCid(node.CurrentConfig.FeedHead)
+	posts := []cid.Cid{}
+	for c := optionalCid(node.CurrentConfig.PendingHead); c.Defined() && !c.Equals(published); {
+		if len(posts) >= MaxPendingPosts {
+			return nil, fmt.Errorf("more than %v pending posts before the feed head %v", MaxPendingPosts, published)
+		}
+		posts = append(posts, c)
+		data, err := ipfs.GetBlock(ctx, ipfscore, c)
+		if err != nil {
+			return nil, fmt.Errorf("could not get pending post %v: %v", c, err)
+		}
+		if c, err = prevLink(c, data); err != nil {
+			return nil, err
+		}
+	}
+	return posts, nil
+}
+
+// publishPending publishes the pending posts by uploading them and publishing the newest as the feed head. postLock must
+// be held.
+func publishPending(ctx context.Context, ipfscore ipfs.IPFSCore) (int, error) {
+	posts, err := PendingPosts(ctx, ipfscore)
+	if err != nil || len(posts) == 0 {
+		return 0, err
+	}
+	if node.PinningEnabled() {
+		for _, c := range posts[1:] {
+			if k := postKind(ctx, ipfscore, c); k >= 0 && node.StorageClassOf(k) == nostr.StorageHot {
+				continue
+			}
+			if err = outbox.Enqueue(outbox.KindW3SUpload, c.String(), map[string]string{"cid": c.String()}); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err = PublishFeedHead(ctx, ipfscore, posts[0]); err != nil {
+		return 0, err
+	}
+	if util.DryRun {
+		return len(posts), nil
+	}
+	config := node.CurrentConfig
+	config.PendingHead = ""
+	if err = node.SaveConfig(config); err != nil {
+		return 0, err
+	}
+	log.Infof("published %v pending posts", len(posts))
+	return len(posts), nil
+}
+
+// PublishPending publishes the posts queued while the node was offline.
+func PublishPending(ctx context.Context, ipfscore ipfs.IPFSCore) (int, error) {
+	postLock.Lock()
+	defer postLock.Unlock()
+	return publishPending(ctx, ipfscore)
+}
+
+// Publish queues a post and publishes it with any other pending posts if the node is online. It returns the new head
+// and whether the post is still pending.
+func Publish(ctx context.Context, ipfscore ipfs.IPFSCore, p Post) (cid.Cid, bool, error) {
+	postLock.Lock()
+	defer postLock.Unlock()
+	head, err := QueuePost(ctx, ipfscore, p)
+	if err != nil {
+		return cid.Undef, false, err
+	}
+	if !ipfs.Online(ipfscore) {
+		log.Infof("node is offline, post %s will be published when it reconnects", p.Event.ID)
+		return head, true, nil
+	}
+	if _, err = publishPending(ctx, ipfscore); err != nil {
+		log.Errorf("could not publish post %s, it will be published later: %v", p.Event.ID, err)
+		return head, true, nil
+	}
+	return head, false, nil
+}
+
+// StartPendingPublish publishes pending posts and retries the outbox when the node comes back online, and serves the
+// pending posts at GET /posts/pending.
+func StartPendingPublish(ctx context.Context, ipfscore ipfs.IPFSCore, router *mux.Router) {
+	router.Path("/posts/pending").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		posts, err := PendingPosts(r.Context(), ipfscore)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+			return
+		}
+		pending := []string{}
+		for _, c := range posts {
+			pending = append(pending, c.String())
+		}
+		json.NewEncoder(w).Encode(map[string]any{"online": ipfs.Online(ipfscore), "pending": pending})
+	})
+	go func() {
+		t := time.NewTicker(PendingPublishInterval)
+		defer t.Stop()
+		online := true
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+			wasOnline := online
+			if online = ipfs.Online(ipfscore); !online {
+				continue
+			}
+			if !wasOnline {
+				log.Infof("node is back online, publishing pending posts and outbox entries")
+				outbox.Process(ctx)
+			}
+			if node.CurrentConfig.PendingHead != "" {
+				if _, err := PublishPending(ctx, ipfscore); err != nil {
+					log.Errorf("could not publish pending posts: %v", err)
+				}
+			}
+		}
+	}()
+}
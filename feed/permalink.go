@@ -0,0 +1,275 @@
+package feed
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ipfs/go-cid"
+	gonostr "github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/blockchain"
+	"github.com/allisterb/patr/did"
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/node"
+	"github.com/allisterb/patr/nostr"
+)
+
+// PermalinkScheme is the URL scheme of patr permalinks.
+const PermalinkScheme = "patr://"
+
+// PermalinkTimeout is the time a permalink has to resolve from IPFS or Nostr.
+var PermalinkTimeout = 30 * time.Second
+
+// Permalink is a link to a post by its author's DID, the CID of the post in the feed and the ID of its Nostr event, so
+// it can be resolved from either IPFS or Nostr relays. Relays are hints of relays with the event.
+type Permalink struct {
+	Did     string
+	Cid     cid.Cid
+	EventID string
+	Relays  []string
+}
+
+// String returns the patr://<did>/<cid>?e=<event id> form of a permalink.
+func (l Permalink) String() string {
+	s := PermalinkScheme + l.Did + "/" + l.Cid.String()
+	if q := l.query(false).Encode(); q != "" {
+		s += "?" + q
+	}
+	return s
+}
+
+// HTTPS returns the gateway form of a permalink, which opens the post on any IPFS gateway and carries the DID and event
+// ID in the query.
+func (l Permalink) HTTPS() string {
+	return ipfs.GatewayURL(l.Cid.String(), false) + "?" + l.query(true).Encode()
+}
+
+func (l Permalink) query(withDid bool) url.Values {
+	q := url.Values{}
+	if withDid {
+		q.Set("did", l.Did)
+	}
+	if l.EventID != "" {
+		q.Set("e", l.EventID)
+	}
+	for _, r := range l.Relays {
+		q.Add("r", r)
+	}
+	return q
+}
+
+// NewPermalink returns the permalink of a post in a feed.
+func NewPermalink(did string, c cid.Cid, p Post, relays []string) Permalink {
+	return Permalink{Did: did, Cid: c, EventID: p.Event.ID, Relays: relays}
+}
+
+// PostPermalink returns the permalink of a post in the user's feed by its CID, with the profile relays as hints.
+func PostPermalink(ctx context.Context, ipfscore ipfs.IPFSCore, c cid.Cid) (Permalink, error) {
+	data, err := fetchBlock(ctx, ipfscore, c, ipfs.NewFetchTracker(node.CurrentConfig.Did))
+	if err != nil {
+		return Permalink{}, err
+	}
+	evt, err := postEvent(c, data)
+	if err != nil {
+		return Permalink{}, fmt.Errorf("%v is not a post: %v", c, err)
+	}
+	if evt.PubKey != node.CurrentConfig.NostrPubKey {
+		return Permalink{}, fmt.Errorf("post %v is not in your feed", c)
+	}
+	return Permalink{Did: node.CurrentConfig.Did, Cid: c, EventID: evt.ID, Relays: node.CurrentConfig.ProfileRelays}, nil
+}
+
+// ParsePermalink parses a permalink in the patr:// or gateway form.
+func ParsePermalink(s string) (Permalink, error) {
+	s = strings.TrimSpace(s)
+	l := Permalink{}
+	var q url.Values
+	var c string
+	if rest, ok := strings.CutPrefix(s, PermalinkScheme); ok {
+		// DIDs have colons so patr:// URLs can't be parsed as URLs with hosts.
+		p, query, _ := strings.Cut(rest, "?")
+		d, cs, ok := strings.Cut(p, "/")
+		if !ok {
+			return Permalink{}, fmt.Errorf("permalink %s has no CID", s)
+		}
+		l.Did, c = d, cs
+		q, _ = url.ParseQuery(query)
+	} else {
+		u, err := url.Parse(s)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+			return Permalink{}, fmt.Errorf("%s is not a patr permalink", s)
+		}
+		_, p, ok := strings.Cut(u.Path, "/ipfs/")
+		if !ok {
+			return Permalink{}, fmt.Errorf("permalink %s is not an IPFS gateway URL", s)
+		}
+		q = u.Query()
+		l.Did, c = q.Get("did"), strings.Trim(p, "/")
+	}
+	if !did.IsValid(l.Did) {
+		return Permalink{}, fmt.Errorf("permalink %s has an invalid DID %s", s, l.Did)
+	}
+	pc, err := cid.Parse(c)
+	if err != nil {
+		return Permalink{}, fmt.Errorf("permalink %s has an invalid CID %s: %v", s, c, err)
+	}
+	l.Cid = pc
+	if e := q.Get("e"); e != "" {
+		p, err := nostr.DecodeEvent(e)
+		if err != nil {
+			return Permalink{}, fmt.Errorf("permalink %s has an invalid event ID %s: %v", s, e, err)
+		}
+		l.EventID = p.ID
+		l.Relays = append(l.Relays, p.Relays...)
+	}
+	l.Relays = append(l.Relays, q["r"]...)
+	return l, nil
+}
+
+// ResolvedPost is a post resolved from a permalink. CidVerified is false if the post was only found on Nostr relays,
+// since its CID can't be computed from the event.
+type ResolvedPost struct {
+	Did         string        `json:"did"`
+	Cid         string        `json:"cid"`
+	Source      string        `json:"source"`
+	CidVerified bool          `json:"cid_verified"`
+	Text        string        `json:"text"`
+	Attachments []string      `json:"attachments"`
+	Event       gonostr.Event `json:"event"`
+}
+
+// authorPubKey returns the Nostr public key of a DID from the node's follows or else its ENS name.
+func authorPubKey(d string) (string, error) {
+	if d == node.CurrentConfig.Did {
+		return node.CurrentConfig.NostrPubKey, nil
+	}
+	if f, ok := node.FindFollow(d); ok && f.NostrPubKey != "" {
+		return f.NostrPubKey, nil
+	}
+	pd, err := did.Parse(d)
+	if err != nil {
+		return "", err
+	}
+	r, err := blockchain.ResolveENS(pd.ID.ID, node.CurrentConfig.InfuraSecretKey)
+	if err != nil {
+		return "", err
+	}
+	if r.NostrPubKey == "" {
+		return "", fmt.Errorf("%s does not have a Nostr public key", d)
+	}
+	return r.NostrPubKey, nil
+}
+
+// resolveFromIPFS fetches and validates the post at a permalink's CID.
+func resolveFromIPFS(ctx context.Context, ipfscore ipfs.IPFSCore, l Permalink, pubkey string) (ResolvedPost, error) {
+	tracker := ipfs.NewFetchTracker(l.Did)
+	data, err := fetchBlock(ctx, ipfscore, l.Cid, tracker)
+	if err != nil {
+		return ResolvedPost{}, err
+	}
+	if !tracker.Allow(len(data), 0) {
+		return ResolvedPost{}, fmt.Errorf("post %v is larger than the fetch budget of %s", l.Cid, l.Did)
+	}
+	if err = ValidatePost(l.Cid, data, pubkey); err != nil {
+		return ResolvedPost{}, err
+	}
+	evt, err := postEvent(l.Cid, data)
+	if err != nil {
+		return ResolvedPost{}, err
+	}
+	if l.EventID != "" && evt.ID != l.EventID {
+		return ResolvedPost{}, fmt.Errorf("post %v has event %s, not %s", l.Cid, evt.ID, l.EventID)
+	}
+	n, err := decodeTypedAs(l.Cid.Prefix().Codec, data, "Post")
+	if err != nil {
+		return ResolvedPost{}, err
+	}
+	return ResolvedPost{Did: l.Did, Cid: l.Cid.String(), Source: "ipfs", CidVerified: true, Text: lookupString(n, "text"),
+		Attachments: fieldValues(n, "attachments"), Event: evt}, nil
+}
+
+// resolveFromNostr fetches and verifies the event of a permalink from the node's relay, the relay hints and the profile
+// relays.
+func resolveFromNostr(ctx context.Context, l Permalink, pubkey string) (ResolvedPost, error) {
+	if l.EventID == "" {
+		return ResolvedPost{}, fmt.Errorf("permalink has no event ID")
+	}
+	relays := append([]string{fmt.Sprintf("ws://127.0.0.1:%v", node.RelayPort)}, l.Relays...)
+	relays = append(relays, node.CurrentConfig.ProfileRelays...)
+	evt, err := nostr.FetchLatest(ctx, relays, gonostr.Filter{IDs: []string{l.EventID}, Authors: []string{pubkey}})
+	if err != nil {
+		return ResolvedPost{}, err
+	}
+	if evt == nil || evt.ID != l.EventID || evt.PubKey != pubkey {
+		return ResolvedPost{}, fmt.Errorf("event %s of %s not found on relays", l.EventID, l.Did)
+	}
+	return ResolvedPost{Did: l.Did, Cid: l.Cid.String(), Source: "nostr", Text: evt.Content, Attachments: []string{}, Event: *evt}, nil
+}
+
+// ResolvePermalink fetches the post of a permalink from IPFS, or from Nostr relays if it can't be fetched from IPFS, and
+// verifies it was signed by the author of the DID.
+func ResolvePermalink(ctx context.Context, ipfscore ipfs.IPFSCore, l Permalink) (ResolvedPost, error) {
+	ctx, cancel := context.WithTimeout(ctx, PermalinkTimeout)
+	defer cancel()
+	pubkey, err := authorPubKey(l.Did)
+	if err != nil {
+		return ResolvedPost{}, fmt.Errorf("could not get the Nostr public key of %s: %v", l.Did, err)
+	}
+	p, err := resolveFromIPFS(ctx, ipfscore, l, pubkey)
+	if err == nil {
+		return p, nil
+	}
+	log.Debugf("could not resolve post %v of %s from IPFS: %v", l.Cid, l.Did, err)
+	p, nerr := resolveFromNostr(ctx, l, pubkey)
+	if nerr != nil {
+		return ResolvedPost{}, fmt.Errorf("could not resolve permalink from IPFS: %v or Nostr: %v", err, nerr)
+	}
+	return p, nil
+}
+
+// SetPermalinkHandlers registers GET /permalinks?url= which resolves a permalink in either form to its verified post, and
+// GET /permalinks/qr?cid= which returns a QR code of the gateway permalink of a post in the user's feed, or of the
+// patr:// permalink with form=patr.
+func SetPermalinkHandlers(ctx context.Context, ipfscore ipfs.IPFSCore, router *mux.Router) {
+	router.Path("/permalinks/qr").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := cid.Parse(r.URL.Query().Get("cid"))
+		if err != nil {
+			http.Error(w, "invalid post CID", http.StatusBadRequest)
+			return
+		}
+		l, err := PostPermalink(r.Context(), ipfscore, c)
+		if err != nil {
+			log.Warnf("could not get the permalink of post %v: %v", c, err)
+			http.Error(w, "could not get the permalink of the post", http.StatusNotFound)
+			return
+		}
+		if r.URL.Query().Get("form") == "patr" {
+			node.WriteQR(w, r, l.String())
+		} else {
+			node.WriteQR(w, r, l.HTTPS())
+		}
+	})
+	router.Path("/permalinks").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		l, err := ParsePermalink(r.URL.Query().Get("url"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+			return
+		}
+		p, err := ResolvePermalink(r.Context(), ipfscore, l)
+		if err != nil {
+			log.Warnf("could not resolve permalink %s: %v", l, err)
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"message": "could not resolve permalink"})
+			return
+		}
+		json.NewEncoder(w).Encode(p)
+	})
+}
@@ -0,0 +1,275 @@
+package feed
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	gonostr "github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/node"
+	"github.com/allisterb/patr/nostr"
+	"github.com/allisterb/patr/outbox"
+	"github.com/allisterb/patr/topics"
+	"github.com/allisterb/patr/util"
+)
+
+type Post struct {
+	Timestamp   time.Time
+	Text        string
+	Attachments []string
+	Source      string
+	Geohash     string
+	Voice       *VoiceNote
+	Event       gonostr.Event
+}
+
+// NewPost creates a post and the signed Nostr text note for it. Attachment URLs are appended to the note content
+// so Nostr clients can display them. A g tag in tags geotags the post, and an imeta tag with a waveform attaches a voice
+// note.
+func NewPost(privkey string, text string, attachments []string, tags gonostr.Tags, timestamp time.Time) (Post, error) {
+	timestamp, err := util.NormalizeTimestamp(timestamp)
+	if err != nil {
+		return Post{}, fmt.Errorf("invalid post timestamp: %v", err)
+	}
+	content := text
+	if len(attachments) > 0 {
+		content = strings.TrimSpace(text + "\n" + strings.Join(attachments, "\n"))
+	}
+	if tags == nil {
+		tags = gonostr.Tags{}
+	}
+	geohash := ""
+	if g := tags.GetFirst([]string{"g", ""}); g != nil {
+		geohash = g.Value()
+		if len(geohash) > MaxGeotagPrecision {
+			return Post{}, fmt.Errorf("geotag %s is more precise than %v characters", geohash, MaxGeotagPrecision)
+		}
+	}
+	voice, err := voiceNoteOfTags(tags)
+	if err != nil {
+		return Post{}, err
+	}
+	evt := gonostr.Event{
+		CreatedAt: gonostr.Timestamp(timestamp.Unix()),
+		Kind:      gonostr.KindTextNote,
+		Tags:      tags,
+		Content:   content,
+	}
+	if err := util.CheckPublishLock(); err != nil {
+		return Post{}, err
+	}
+	if err := evt.Sign(privkey); err != nil {
+		log.Errorf("could not sign Nostr event for post: %v", err)
+		return Post{}, err
+	}
+	return Post{
+		Timestamp:   timestamp,
+		Text:        text,
+		Attachments: attachments,
+		Geohash:     geohash,
+		Voice:       voice,
+		Event:       evt,
+	}, nil
+}
+
+func PostToIPLDNode(p Post, prev cid.Cid) (datamodel.Node, error) {
+	evtnode, err := ipfs.NostrEventToIPLDNode(p.Event)
+	if err != nil {
+		return nil, err
+	}
+	dagnode, err := qp.BuildMap(basicnode.Prototype.Any, 9, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "type", qp.String("post"))
+		qp.MapEntry(ma, "created_at", qp.Int(p.Timestamp.Unix()))
+		qp.MapEntry(ma, "text", qp.String(p.Text))
+		qp.MapEntry(ma, "attachments", qp.List(int64(len(p.Attachments)), func(la datamodel.ListAssembler) {
+			for _, a := range p.Attachments {
+				qp.ListEntry(la, qp.String(a))
+			}
+		}))
+		if p.Source != "" {
+			qp.MapEntry(ma, "source", qp.String(p.Source))
+		}
+		if p.Geohash != "" {
+			qp.MapEntry(ma, "geohash", qp.String(p.Geohash))
+		}
+		if p.Voice != nil {
+			qp.MapEntry(ma, "voice", qp.Map(3, func(va datamodel.MapAssembler) {
+				qp.MapEntry(va, "url", qp.String(p.Voice.URL))
+				qp.MapEntry(va, "duration", qp.Int(int64(p.Voice.Duration)))
+				qp.MapEntry(va, "waveform", qp.List(int64(len(p.Voice.Waveform)), func(la datamodel.ListAssembler) {
+					for _, w := range p.Voice.Waveform {
+						qp.ListEntry(la, qp.Int(int64(w)))
+					}
+				}))
+			}))
+		}
+		qp.MapEntry(ma, "event", qp.Node(evtnode))
+		if prev.Defined() {
+			qp.MapEntry(ma, "prev", qp.Link(cidlink.Link{Cid: prev}))
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create IPLD node for post %s: %v", p.Event.ID, err)
+	}
+	return dagnode, nil
+}
+
+// AppendPost writes a post to IPFS linked to the previous head of the feed and returns the new head. Posts of ephemeral
+// kinds are not written.
+func AppendPost(ctx context.Context, ipfscore ipfs.IPFSCore, p Post, prev cid.Cid) (cid.Cid, error) {
+	if node.StorageClassOf(p.Event.Kind) == nostr.StorageEphemeral {
+		return cid.Undef, fmt.Errorf("post %s has ephemeral kind %v and is not written to the feed", p.Event.ID, p.Event.Kind)
+	}
+	n, err := PostToIPLDNode(p, prev)
+	if err != nil {
+		return cid.Undef, err
+	}
+	blk, err := ipfs.PutIPLDNode(ctx, ipfscore, n)
+	if err != nil {
+		log.Errorf("could not write post %s to IPFS: %v", p.Event.ID, err)
+		return cid.Undef, err
+	}
+	log.Infof("appended post %s to feed at %v", p.Event.ID, blk.Cid())
+	return blk.Cid(), nil
+}
+
+// postKind returns the kind of the Nostr event of a post in the feed, or -1 if it can't be read.
+func postKind(ctx context.Context, ipfscore ipfs.IPFSCore, c cid.Cid) int {
+	data, err := ipfs.GetBlock(ctx, ipfscore, c)
+	if err != nil {
+		return -1
+	}
+	n, err := ipfs.DecodeIPLDNode(c, data)
+	if err != nil {
+		return -1
+	}
+	evt, err := n.LookupByString("event")
+	if err != nil {
+		return -1
+	}
+	kn, err := evt.LookupByString("kind")
+	if err != nil {
+		return -1
+	}
+	k, err := kn.AsInt()
+	if err != nil {
+		return -1
+	}
+	return int(k)
+}
+
+// PublishFeedHead pins the new head of the feed with the pinning services and saves it in the node configuration, then
+// publishes it to the user's feed IPNS name through the outbox. If pinning or saving fails the previous head is kept.
+// Heads which are posts of hot kinds are only stored locally.
+func PublishFeedHead(ctx context.Context, ipfscore ipfs.IPFSCore, head cid.Cid) error {
+	prev := node.CurrentConfig.FeedHead
+	tx := outbox.Begin("feed head " + head.String())
+	archival := true
+	if k := postKind(ctx, ipfscore, head); k >= 0 && node.StorageClassOf(k) == nostr.StorageHot {
+		log.Infof("feed head %v is a post of hot kind %v and will not be pinned with the pinning services", head, k)
+		archival = false
+	}
+	if node.PinningEnabled() && archival {
+		err := tx.Prepare(ctx, fmt.Sprintf("pin block %v with the pinning services", head), func(ctx context.Context) error {
+			return ipfs.PinRemote(ctx, ipfscore, head)
+		}, nil)
+		if err != nil {
+			log.Errorf("could not pin feed head %v with the pinning services: %v", head, err)
+			return err
+		}
+	}
+	err := tx.Prepare(ctx, fmt.Sprintf("save feed head %v in the node configuration", head), func(ctx context.Context) error {
+		config := node.CurrentConfig
+		config.FeedHead = head.String()
+		return node.SaveConfig(config)
+	}, func(ctx context.Context) error {
+		config := node.CurrentConfig
+		config.FeedHead = prev
+		return node.SaveConfig(config)
+	})
+	if err != nil {
+		return err
+	}
+	node.RegisterOutboxHandlers(ipfscore)
+	if _, ok := node.CurrentConfig.IPNSKeys["feed"]; ok {
+		p := "/ipfs/" + head.String()
+		tx.Commit(outbox.KindIPNSPublish, "feed:"+p, map[string]string{"key": "feed", "path": p})
+	} else {
+		log.Warnf("no feed IPNS key configured, feed head %v will not be published to IPNS", head)
+	}
+	for _, v := range nostr.TopicVersions() {
+		topic, err := topics.Feed(node.CurrentConfig.Did, v)
+		if err != nil {
+			topic = topics.Global(v)
+		}
+		tx.Commit(outbox.KindPubSubAnnounce, topic+":"+head.String(), map[string]string{"topic": topic, "data": head.String()})
+	}
+	return tx.Apply(ctx)
+}
+
+var postLock = sync.Mutex{}
+
+// SetPostHandlers registers POST /posts which API clients with the post scope use to publish a post to the user's feed.
+// Posts made while the node is offline are queued and published when it reconnects. The response has the nevent entity
+// of the post, with the profile relays as hints and the CID of the post, and its permalinks.
+func SetPostHandlers(ctx context.Context, ipfscore ipfs.IPFSCore, router *mux.Router) {
+	router.Path("/posts").Methods("POST").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		req := struct {
+			Text        string   `json:"text"`
+			Attachments []string `json:"attachments"`
+			Voice       string   `json:"voice"`
+		}{}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil || (strings.TrimSpace(req.Text) == "" && len(req.Attachments) == 0 && req.Voice == "") {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"message": "the request must be a JSON post with text, attachments or a voice note"})
+			return
+		}
+		if err := util.CheckPublishLock(); err != nil {
+			w.WriteHeader(http.StatusLocked)
+			json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+			return
+		}
+		attachments, tags := transcodeAttachments(ctx, ipfscore, req.Attachments)
+		if req.Voice != "" {
+			var err error
+			if attachments, tags, err = attachVoiceNote(ctx, ipfscore, req.Voice, attachments, tags); err != nil {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				json.NewEncoder(w).Encode(map[string]string{"message": "could not encode voice note: " + err.Error()})
+				return
+			}
+		}
+		post, err := NewPost(node.CurrentConfig.NostrPrivKey, req.Text, attachments, tags, util.Now())
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+			return
+		}
+		head, pending, err := Publish(ctx, ipfscore, post)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"message": "could not publish post"})
+			return
+		}
+		if pending {
+			w.WriteHeader(http.StatusAccepted)
+		}
+		nevent, _ := nostr.EventEntity(post.Event, node.CurrentConfig.ProfileRelays, head.String())
+		l := NewPermalink(node.CurrentConfig.Did, head, post, nil)
+		json.NewEncoder(w).Encode(map[string]any{"id": post.Event.ID, "nevent": nevent, "permalink": l.String(), "url": l.HTTPS(),
+			"head": head.String(), "pending": pending})
+	})
+}
@@ -0,0 +1,44 @@
+package feed
+
+import (
+	"fmt"
+	"time"
+
+	gonostr "github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/node"
+)
+
+// NewProtectedPost creates a non-public post of a protected account. The teaser is the post text and the body is
+// encrypted with the current post key in a protected tag with the key ID, so only approved followers can read it.
+func NewProtectedPost(privkey string, teaser string, body string, timestamp time.Time) (Post, error) {
+	if !node.CurrentConfig.Protected {
+		return Post{}, fmt.Errorf("only protected accounts can make non-public posts")
+	}
+	key, err := node.CurrentPostKey()
+	if err != nil {
+		return Post{}, err
+	}
+	enc, err := sealBody(key, body)
+	if err != nil {
+		return Post{}, err
+	}
+	return NewPost(privkey, teaser, nil, gonostr.Tags{gonostr.Tag{"protected", enc, node.PostKeyID(key)}}, timestamp)
+}
+
+// DecryptProtectedPost decrypts the body of a non-public post with the post keys of its author, keyed by key ID.
+func DecryptProtectedPost(evt gonostr.Event, keys map[string][]byte) (string, error) {
+	t := evt.Tags.GetFirst([]string{"protected", ""})
+	if t == nil || len(*t) < 3 {
+		return "", fmt.Errorf("event %s is not a non-public post", evt.ID)
+	}
+	key, ok := keys[(*t)[2]]
+	if !ok {
+		return "", fmt.Errorf("no post key %s for non-public post %s", (*t)[2], evt.ID)
+	}
+	body, err := openBody(key, t.Value())
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt non-public post %s: %v", evt.ID, err)
+	}
+	return body, nil
+}
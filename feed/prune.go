@@ -0,0 +1,87 @@
+package feed
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/node"
+	"github.com/allisterb/patr/util"
+)
+
+// InactiveFollow is a followed feed which can be pruned and why.
+type InactiveFollow struct {
+	Did      string
+	FeedName string
+	Reason   string
+	LastPost time.Time
+}
+
+// lastPost returns the time of the newest post of a followed feed.
+func lastPost(ctx context.Context, ipfscore ipfs.IPFSCore, f node.Follow) (time.Time, error) {
+	path, err := ipfs.ResolveIPNSName(ctx, ipfscore, f.FeedName)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("feed name %s does not resolve: %v", f.FeedName, err)
+	}
+	head, err := parsePathCid(path)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("feed name %s does not resolve to a CID: %s", f.FeedName, path)
+	}
+	data, err := ipfs.GetBlock(ctx, ipfscore, head)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not fetch feed head %v: %v", head, err)
+	}
+	evt, err := postEvent(head, data)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("feed head %v is not a post: %v", head, err)
+	}
+	return evt.CreatedAt.Time(), nil
+}
+
+// InactiveFollows returns the followed feeds whose IPNS name no longer resolves to a post, or whose newest post is older
+// than inactiveFor.
+func InactiveFollows(ctx context.Context, ipfscore ipfs.IPFSCore, inactiveFor time.Duration) []InactiveFollow {
+	inactive := []InactiveFollow{}
+	cutoff := util.Now().Add(-inactiveFor)
+	for _, f := range node.CurrentConfig.Follows {
+		t, err := lastPost(ctx, ipfscore, f)
+		switch {
+		case err != nil:
+			inactive = append(inactive, InactiveFollow{Did: f.Did, FeedName: f.FeedName, Reason: err.Error()})
+		case t.Before(cutoff):
+			inactive = append(inactive, InactiveFollow{Did: f.Did, FeedName: f.FeedName, Reason: "no posts since " + t.Format("2006-01-02"), LastPost: t})
+		}
+	}
+	return inactive
+}
+
+// Unfollow removes followed feeds in one batch with their fetch budgets and backfill progress and publishes the new
+// contact list.
+func Unfollow(ctx context.Context, ipfscore ipfs.IPFSCore, dids []string) error {
+	for _, d := range dids {
+		if _, ok := node.FindFollow(d); !ok {
+			return fmt.Errorf("not following %s", d)
+		}
+	}
+	if util.DryRun {
+		for _, d := range dids {
+			log.Infof("dry run: would unfollow %s", d)
+		}
+		return nil
+	}
+	if err := node.RemoveFollows(dids); err != nil {
+		return err
+	}
+	backfillLock.Lock()
+	for _, d := range dids {
+		delete(backfills, d)
+	}
+	backfillLock.Unlock()
+	log.Infof("unfollowed %s", strings.Join(dids, ", "))
+	if err := PublishContactList(ctx, ipfscore); err != nil {
+		log.Warnf("could not publish contact list: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package feed
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gorilla/mux"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/node"
+	"github.com/allisterb/patr/p2p"
+	"github.com/allisterb/patr/util"
+)
+
+// pushSource provides the node's feed and followed feeds to the feed push protocol.
+type pushSource struct {
+	ipfscore ipfs.IPFSCore
+}
+
+func (s pushSource) FeedHeads(ctx context.Context) map[string]p2p.FeedHead {
+	config := node.CurrentConfig
+	heads := make(map[string]p2p.FeedHead)
+	for _, f := range config.Follows {
+		if f.NostrPubKey == "" {
+			continue
+		}
+		h := p2p.FeedHead{}
+		if head := optionalCid(f.LastSeen); head.Defined() {
+			h = p2p.FeedHead{Head: head.String(), Posted: posted(ctx, s.ipfscore, head)}
+		}
+		heads[f.NostrPubKey] = h
+	}
+	if head, err := parsePathCid(config.FeedHead); err == nil {
+		heads[config.NostrPubKey] = p2p.FeedHead{Head: head.String(), Posted: posted(ctx, s.ipfscore, head)}
+	}
+	return heads
+}
+
+func (s pushSource) FeedPosts(ctx context.Context, head string, until string, max int) []p2p.PushedBlock {
+	blocks := []p2p.PushedBlock{}
+	stop := optionalCid(until)
+	for c := optionalCid(head); c.Defined() && !c.Equals(stop) && len(blocks) < max; {
+		data, err := ipfs.GetBlock(ctx, s.ipfscore, c)
+		if err != nil {
+			break
+		}
+		blocks = append(blocks, p2p.PushedBlock{Cid: c.String(), Data: data})
+		if c, err = prevLink(c, data); err != nil {
+			break
+		}
+	}
+	return blocks
+}
+
+// ReceiveFeed stores posts of a followed feed pushed by a peer if they are signed by the author and link to each other
+// from the head back, then backfills the feed from the new head.
+func (s pushSource) ReceiveFeed(ctx context.Context, pid peer.ID, pf p2p.PushedFeed) (int, error) {
+	var f node.Follow
+	found := false
+	for _, cf := range node.CurrentConfig.Follows {
+		if cf.NostrPubKey == pf.PubKey {
+			f, found = cf, true
+			break
+		}
+	}
+	if !found {
+		return 0, fmt.Errorf("the feed of %s is not followed", pf.PubKey)
+	}
+	head, err := cid.Parse(pf.Head)
+	if err != nil || len(pf.Blocks) == 0 {
+		return 0, fmt.Errorf("invalid head %s", pf.Head)
+	}
+	evt, err := postEvent(head, pf.Blocks[0].Data)
+	if err != nil {
+		return 0, err
+	}
+	if last := optionalCid(f.LastSeen); last.Defined() && posted(ctx, s.ipfscore, last) >= int64(evt.CreatedAt) {
+		return 0, nil
+	}
+	next := head
+	tracker := ipfs.NewFetchTracker(f.Did)
+	n := 0
+	for _, b := range pf.Blocks {
+		c, err := cid.Parse(b.Cid)
+		if err != nil || !c.Equals(next) {
+			return n, fmt.Errorf("post %s does not follow %v in the pushed feed", b.Cid, next)
+		}
+		if !tracker.Allow(len(b.Data), n) {
+			break
+		}
+		if err = ValidatePost(c, b.Data, f.NostrPubKey); err != nil {
+			Quarantine(c, f.Did, err)
+			return n, err
+		}
+		if next, err = prevLink(c, b.Data); err != nil {
+			return n, err
+		}
+		if util.DryRun {
+			log.Infof("dry run: would store post %v of %s pushed by peer %v", c, f.Did, pid)
+		} else if err = ipfs.PutBlock(ctx, s.ipfscore, c, b.Data); err != nil {
+			return n, err
+		}
+		p2p.Haves.Add(c)
+		n++
+	}
+	if n == 0 || util.DryRun {
+		return n, nil
+	}
+	nf, err := backfillFrom(ctx, s.ipfscore, f, head, nil)
+	if err != nil {
+		return n, err
+	}
+	log.Infof("stored %v posts of %s pushed by peer %v", n, f.Did, pid)
+	return n, node.SaveFollow(nf)
+}
+
+// StartFeedPush exchanges posts with the nodes of mutual follows when they connect.
+func StartFeedPush(ctx context.Context, ipfscore ipfs.IPFSCore, router *mux.Router) {
+	p2p.SetFeedPushStreamHandler(ipfscore, pushSource{ipfscore})
+}
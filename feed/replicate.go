@@ -0,0 +1,243 @@
+package feed
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/ipfs/boxo/coreiface/options"
+	ipfspath "github.com/ipfs/boxo/coreiface/path"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/schema"
+
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/node"
+	"github.com/allisterb/patr/util"
+)
+
+// DefaultThumbnailSize is the largest attachment the default replication rules replicate.
+const DefaultThumbnailSize = 512 * 1024
+
+// DefaultReplicationRules replicate every post with its small attachments like images and thumbnails but not
+// videos or other large attachments.
+var DefaultReplicationRules = []node.ReplicationRule{
+	{Field: "attachments", Match: "*.mp4", Replicate: false},
+	{Field: "attachments", Match: "*.webm", Replicate: false},
+	{Field: "attachments", Match: "*.mov", Replicate: false},
+	{Field: "attachments", Match: "*", MaxSize: DefaultThumbnailSize, Replicate: true},
+}
+
+// postField returns the schema field of the Post type with a name or representation key.
+func postField(name string) (*schema.StructField, error) {
+	st, ok := schemaTypes.TypeByName("Post").(*schema.TypeStruct)
+	if !ok {
+		return nil, fmt.Errorf("feed schema does not have a Post struct")
+	}
+	rep, _ := st.RepresentationStrategy().(schema.StructRepresentation_Map)
+	for _, f := range st.Fields() {
+		if f.Name() == name || rep.GetFieldKey(f) == name {
+			f := f
+			return &f, nil
+		}
+	}
+	return nil, fmt.Errorf("post schema does not have a field %s", name)
+}
+
+// ValidateReplicationRules checks that each rule matches a string or list field of the post schema and has a valid glob.
+func ValidateReplicationRules(rules []node.ReplicationRule) error {
+	for _, r := range rules {
+		f, err := postField(r.Field)
+		if err != nil {
+			return err
+		}
+		if k := f.Type().TypeKind(); k != schema.TypeKind_String && k != schema.TypeKind_List {
+			return fmt.Errorf("post field %s is not a string or list and can't be matched", r.Field)
+		}
+		if _, err := path.Match(r.Match, ""); err != nil {
+			return fmt.Errorf("invalid pattern %s for post field %s: %v", r.Match, r.Field, err)
+		}
+	}
+	return nil
+}
+
+// ParseReplicationRules parses a comma-separated list of rules of the form field=pattern[:maxsize], with a leading !
+// for fields which should not be replicated, e.g. "!attachments=*.mp4,attachments=*:524288".
+func ParseReplicationRules(s string) ([]node.ReplicationRule, error) {
+	rules := []node.ReplicationRule{}
+	for _, rs := range strings.Split(s, ",") {
+		rs = strings.TrimSpace(rs)
+		if rs == "" {
+			continue
+		}
+		r := node.ReplicationRule{Replicate: !strings.HasPrefix(rs, "!")}
+		field, match, ok := strings.Cut(strings.TrimPrefix(rs, "!"), "=")
+		if !ok {
+			return nil, fmt.Errorf("replication rule %s is not of the form field=pattern", rs)
+		}
+		if m, size, ok := strings.Cut(match, ":"); ok {
+			n, err := strconv.ParseInt(size, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid maximum size in replication rule %s: %v", rs, err)
+			}
+			match, r.MaxSize = m, n
+		}
+		r.Field, r.Match = field, match
+		rules = append(rules, r)
+	}
+	return rules, ValidateReplicationRules(rules)
+}
+
+func matchRule(r node.ReplicationRule, value string) bool {
+	if !strings.Contains(r.Match, "/") {
+		value = path.Base(value)
+	}
+	ok, _ := path.Match(r.Match, value)
+	return ok
+}
+
+// evaluateRules returns the first rule matching a value of a field, if any.
+func evaluateRules(rules []node.ReplicationRule, field string, value string) (node.ReplicationRule, bool) {
+	for _, r := range rules {
+		if r.Field == field && matchRule(r, value) {
+			return r, true
+		}
+	}
+	return node.ReplicationRule{}, false
+}
+
+func fieldValues(n datamodel.Node, field string) []string {
+	v, err := n.LookupByString(field)
+	if err != nil {
+		return nil
+	}
+	if v.Kind() == datamodel.Kind_String {
+		s, _ := v.AsString()
+		return []string{s}
+	}
+	values := []string{}
+	it := v.ListIterator()
+	for it != nil && !it.Done() {
+		_, e, err := it.Next()
+		if err != nil {
+			break
+		}
+		if s, err := e.AsString(); err == nil {
+			values = append(values, s)
+		}
+	}
+	return values
+}
+
+// attachmentCid returns the CID of an attachment stored on IPFS.
+func attachmentCid(url string) (cid.Cid, bool) {
+	s := strings.TrimPrefix(url, "ipfs://")
+	if i := strings.Index(s, "/ipfs/"); i >= 0 {
+		s = s[i+len("/ipfs/"):]
+	}
+	s, _, _ = strings.Cut(s, "/")
+	c, err := cid.Parse(s)
+	return c, err == nil
+}
+
+// attachmentPath returns the IPFS path of the file of an attachment stored on IPFS, which may be in a directory like the
+// playlist of a transcoded video.
+func attachmentPath(url string) string {
+	s := strings.TrimPrefix(url, "ipfs://")
+	if i := strings.Index(s, "/ipfs/"); i >= 0 {
+		s = s[i+len("/ipfs/"):]
+	}
+	s, _, _ = strings.Cut(s, "?")
+	return "/ipfs/" + s
+}
+
+// Replicate pins the parts of a post of a mirrored community feed selected by the feed's replication rules. A post is
+// replicated unless a rule matching one of its fields excludes it. Attachments stored on IPFS are only replicated if a
+// rule selects them and they are within the rule's maximum size, and not in text-only sync mode.
+func Replicate(ctx context.Context, ipfscore ipfs.IPFSCore, f node.Follow, c cid.Cid, data []byte) error {
+	rules := f.Replicate
+	if len(rules) == 0 {
+		rules = DefaultReplicationRules
+	}
+	n, err := decodeTypedAs(c.Prefix().Codec, data, "Post")
+	if err != nil {
+		return err
+	}
+	for _, r := range rules {
+		if r.Field == "attachments" || r.Replicate {
+			continue
+		}
+		for _, v := range fieldValues(n, r.Field) {
+			if matchRule(r, v) {
+				log.Debugf("not replicating post %v from %s, field %s matches %s", c, f.Did, r.Field, r.Match)
+				return nil
+			}
+		}
+	}
+	if util.DryRun {
+		log.Infof("dry run: would replicate post %v from %s", c, f.Did)
+		return nil
+	}
+	pctx, cancel := util.WithTimeout(ctx, ipfs.PinTimeout)
+	defer cancel()
+	if err = ipfscore.Api.Pin().Add(pctx, ipfspath.IpldPath(c), options.Pin.Recursive(false)); err != nil {
+		log.Errorf("could not pin post %v from %s: %v", c, f.Did, err)
+		return err
+	}
+	if ipfs.TextOnly() {
+		log.Debugf("not replicating attachments of post %v from %s in text-only sync mode", c, f.Did)
+		return nil
+	}
+	for _, a := range fieldValues(n, "attachments") {
+		r, ok := evaluateRules(rules, "attachments", a)
+		if !ok || !r.Replicate {
+			continue
+		}
+		ac, ok := attachmentCid(a)
+		if !ok {
+			continue
+		}
+		if err = replicateAttachment(ctx, ipfscore, f.Did, c, ac, attachmentPath(a), r.MaxSize, attachmentType(c, data, a)); err != nil {
+			log.Warnf("could not replicate attachment %s of post %v from %s: %v", a, c, f.Did, err)
+		}
+	}
+	return nil
+}
+
+// attachmentType returns the content type an attachment of a post claims to be, from the imeta tag of the post event
+// for the attachment or else the extension of its URL.
+func attachmentType(c cid.Cid, data []byte, url string) string {
+	if evt, err := postEvent(c, data); err == nil {
+		for _, t := range evt.Tags {
+			if len(t) < 2 || t[0] != "imeta" || !util.Contains(t[1:], "url "+url) {
+				continue
+			}
+			for _, f := range t[1:] {
+				if m, ok := strings.CutPrefix(f, "m "); ok {
+					return m
+				}
+			}
+		}
+	}
+	return ipfs.MediaTypeOfName(url)
+}
+
+// replicateAttachment checks the content type of an attachment of a followed user's post and pins it until it expires.
+func replicateAttachment(ctx context.Context, ipfscore ipfs.IPFSCore, author string, post cid.Cid, c cid.Cid, file string, maxSize int64, claimed string) error {
+	ctx, cancel := util.WithTimeout(ctx, ipfs.PinTimeout)
+	defer cancel()
+	if _, err := ipfs.CheckRemoteMedia(ctx, ipfscore, file, claimed); err != nil {
+		return err
+	}
+	st, err := ipfscore.Api.Object().Stat(ctx, ipfspath.IpfsPath(c))
+	if err != nil {
+		return err
+	}
+	if maxSize > 0 && int64(st.CumulativeSize) > maxSize {
+		log.Debugf("not replicating attachment %v, its size %v is larger than %v", c, st.CumulativeSize, maxSize)
+		return nil
+	}
+	return pinMedia(ctx, ipfscore, c, author, post, int64(st.CumulativeSize))
+}
@@ -0,0 +1,90 @@
+package feed
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	gonostr "github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/node"
+	"github.com/allisterb/patr/util"
+)
+
+// TimelinePost is a post of a feed read from the feed's post log. Body is the decrypted body of a non-public post if the
+// user has its post key.
+type TimelinePost struct {
+	Cid   string        `json:"cid"`
+	Event gonostr.Event `json:"event"`
+	Body  string        `json:"body,omitempty"`
+}
+
+// Timeline reconstructs the timeline of a feed by walking its post log back from the head, newest first, and returns
+// whether the walk was truncated by the fetch budget. The node's own feed, for an empty DID, starts at the newest
+// pending post and the head of a followed feed is resolved from its IPNS name. The posts of the previous identities of
+// an account which migrated to a new DID are merged into its timeline.
+func Timeline(ctx context.Context, ipfscore ipfs.IPFSCore, d string) ([]TimelinePost, bool, error) {
+	var head cid.Cid
+	pubkey, keys := node.CurrentConfig.NostrPubKey, node.PostKeys()
+	feedName, moved := "", []node.MovedIdentity{}
+	if d == "" || d == node.CurrentConfig.Did || util.Contains(node.CurrentConfig.PreviousDids, d) {
+		d = node.CurrentConfig.Did
+		if head = optionalCid(node.CurrentConfig.PendingHead); !head.Defined() {
+			head, _ = parsePathCid(node.CurrentConfig.FeedHead)
+		}
+	} else {
+		f, ok := findMovedFollow(d)
+		if !ok {
+			return nil, false, fmt.Errorf("you do not follow %s", d)
+		}
+		p, err := ipfs.ResolveIPNSName(ctx, ipfscore, f.FeedName)
+		if err != nil {
+			return nil, false, err
+		}
+		if head, err = parsePathCid(p); err != nil {
+			return nil, false, fmt.Errorf("feed name %s of %s does not resolve to a CID: %s", f.FeedName, f.Did, p)
+		}
+		d, pubkey, keys, feedName, moved = f.Did, f.NostrPubKey, f.PostKeys, f.FeedName, f.Moved
+	}
+	timeline := []TimelinePost{}
+	if !head.Defined() {
+		return timeline, false, nil
+	}
+	onPost := func(c cid.Cid, data []byte) {
+		if evt, err := postEvent(c, data); err == nil {
+			body, _ := DecryptProtectedPost(evt, keys)
+			timeline = append(timeline, TimelinePost{Cid: c.String(), Event: evt, Body: body})
+		}
+	}
+	_, next, err := fetchFeed(ctx, ipfscore, d, pubkey, head, cid.Undef, onPost)
+	if err != nil {
+		return nil, false, err
+	}
+	for i := len(moved) - 1; i >= 0 && !next.Defined(); i-- {
+		m := moved[i]
+		// A previous identity with the same feed name was already walked as the older part of the same post log.
+		if m.FeedName == feedName || !optionalCid(m.Head).Defined() {
+			feedName = m.FeedName
+			continue
+		}
+		if _, next, err = fetchFeed(ctx, ipfscore, m.Did, m.NostrPubKey, optionalCid(m.Head), cid.Undef, onPost); err != nil {
+			return nil, false, err
+		}
+		feedName = m.FeedName
+	}
+	return timeline, next.Defined(), nil
+}
+
+// findMovedFollow returns the follow of a DID or of the account which migrated away from it.
+func findMovedFollow(d string) (node.Follow, bool) {
+	if f, ok := node.FindFollow(d); ok {
+		return f, true
+	}
+	for _, f := range node.CurrentConfig.Follows {
+		if f.MovedFrom(d) {
+			return f, true
+		}
+	}
+	return node.Follow{}, false
+}
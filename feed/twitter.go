@@ -0,0 +1,222 @@
+package feed
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	gonostr "github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/ipfs"
+)
+
+type Tweet struct {
+	ID                string `json:"id_str"`
+	FullText          string `json:"full_text"`
+	CreatedAt         string `json:"created_at"`
+	InReplyToStatusID string `json:"in_reply_to_status_id_str"`
+	InReplyToUserID   string `json:"in_reply_to_user_id_str"`
+	Entities          tweetEntities
+	ExtendedEntities  tweetEntities `json:"extended_entities"`
+	timestamp         time.Time
+	mediaFiles        []string
+}
+
+type tweetEntities struct {
+	Urls []struct {
+		Url         string `json:"url"`
+		ExpandedUrl string `json:"expanded_url"`
+	} `json:"urls"`
+	Media []struct {
+		Url           string `json:"url"`
+		MediaUrlHttps string `json:"media_url_https"`
+	} `json:"media"`
+}
+
+type TwitterArchive struct {
+	Username  string
+	AccountID string
+	Tweets    []Tweet
+	files     map[string]*zip.File
+	reader    *zip.ReadCloser
+}
+
+const TwitterImportBatchSize = 100
+
+// ReadTwitterArchive reads the account and tweets from an official Twitter archive ZIP file, sorted oldest first.
+func ReadTwitterArchive(path string) (*TwitterArchive, error) {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open Twitter archive %s: %v", path, err)
+	}
+	a := TwitterArchive{files: make(map[string]*zip.File), reader: zr}
+	for _, f := range zr.File {
+		a.files[f.Name] = f
+	}
+	account := []struct {
+		Account struct {
+			Username  string `json:"username"`
+			AccountID string `json:"accountId"`
+		} `json:"account"`
+	}{}
+	if err = a.readJS("data/account.js", &account); err == nil && len(account) > 0 {
+		a.Username = account[0].Account.Username
+		a.AccountID = account[0].Account.AccountID
+	} else {
+		log.Warnf("could not read account data from Twitter archive: %v", err)
+	}
+	tweets := []struct {
+		Tweet Tweet `json:"tweet"`
+	}{}
+	if err = a.readJS("data/tweets.js", &tweets); err != nil {
+		if err = a.readJS("data/tweet.js", &tweets); err != nil {
+			zr.Close()
+			return nil, fmt.Errorf("could not read tweets from Twitter archive: %v", err)
+		}
+	}
+	for _, t := range tweets {
+		tw := t.Tweet
+		if tw.timestamp, err = time.Parse(time.RubyDate, tw.CreatedAt); err != nil {
+			log.Warnf("could not parse timestamp %s of tweet %s: %v", tw.CreatedAt, tw.ID, err)
+			continue
+		}
+		for name := range a.files {
+			if strings.HasPrefix(name, "data/tweets_media/"+tw.ID+"-") || strings.HasPrefix(name, "data/tweet_media/"+tw.ID+"-") {
+				tw.mediaFiles = append(tw.mediaFiles, name)
+			}
+		}
+		sort.Strings(tw.mediaFiles)
+		a.Tweets = append(a.Tweets, tw)
+	}
+	sort.SliceStable(a.Tweets, func(i, j int) bool { return a.Tweets[i].timestamp.Before(a.Tweets[j].timestamp) })
+	log.Infof("read %v tweets from Twitter archive for @%s", len(a.Tweets), a.Username)
+	return &a, nil
+}
+
+func (a *TwitterArchive) Close() error {
+	return a.reader.Close()
+}
+
+// readJS decodes a Twitter archive data file which is a JSON array assigned to a JavaScript variable.
+func (a *TwitterArchive) readJS(name string, v any) error {
+	data, err := a.readFile(name)
+	if err != nil {
+		return err
+	}
+	i := bytes.IndexByte(data, '[')
+	if i < 0 {
+		return fmt.Errorf("%s does not contain a JSON array", name)
+	}
+	return json.Unmarshal(data[i:], v)
+}
+
+func (a *TwitterArchive) readFile(name string) ([]byte, error) {
+	f, ok := a.files[name]
+	if !ok {
+		return nil, fmt.Errorf("%s not found in archive", name)
+	}
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func (a *TwitterArchive) tweetURL(t Tweet) string {
+	u := a.Username
+	if u == "" {
+		u = "i/web"
+	}
+	return fmt.Sprintf("https://twitter.com/%s/status/%s", u, t.ID)
+}
+
+// text returns the tweet text with t.co links expanded and media links removed.
+func (t Tweet) text() string {
+	text := t.FullText
+	for _, u := range t.Entities.Urls {
+		text = strings.ReplaceAll(text, u.Url, u.ExpandedUrl)
+	}
+	for _, m := range append(t.Entities.Media, t.ExtendedEntities.Media...) {
+		text = strings.ReplaceAll(text, m.Url, "")
+	}
+	return strings.TrimSpace(text)
+}
+
+// ImportTwitterArchive converts tweets to posts in chronological order, uploading media to IPFS and linking replies
+// within self-threads, and publishes the feed head after every batch.
+func ImportTwitterArchive(ctx context.Context, ipfscore ipfs.IPFSCore, privkey string, a *TwitterArchive, head cid.Cid, publish func(cid.Cid) error) (cid.Cid, int, error) {
+	events := make(map[string]string)
+	n := 0
+	for _, t := range a.Tweets {
+		if t.InReplyToUserID != "" && t.InReplyToUserID != a.AccountID {
+			// replies to other accounts can't be threaded without the parent so skip them
+			continue
+		}
+		attachments := []string{}
+		imeta := gonostr.Tags{}
+		for _, m := range t.mediaFiles {
+			data, err := a.readFile(m)
+			if err != nil {
+				log.Warnf("could not read media file %s for tweet %s: %v", m, t.ID, err)
+				continue
+			}
+			mt, err := ipfs.CheckMedia(data, ipfs.MediaTypeOfName(m))
+			if err != nil {
+				log.Warnf("not importing media file %s of tweet %s: %v", m, t.ID, err)
+				continue
+			}
+			c, err := ipfs.AddFile(ctx, ipfscore, data)
+			if err != nil {
+				return head, n, err
+			}
+			url := ipfs.GatewayURL(c.String(), false)
+			attachments = append(attachments, url)
+			if ipfs.TranscodeVideos && strings.HasPrefix(mt, "video/") {
+				if dir, err := ipfs.TranscodeHLSData(ctx, ipfscore, data); err == nil {
+					playlist, tag := hlsAttachment(dir, url)
+					attachments = append(attachments, playlist)
+					imeta = append(imeta, tag)
+				} else {
+					log.Warnf("could not transcode video %s of tweet %s to HLS: %v", m, t.ID, err)
+				}
+			}
+		}
+		tags := append(gonostr.Tags{gonostr.Tag{"proxy", a.tweetURL(t), "web"}}, imeta...)
+		if parent, ok := events[t.InReplyToStatusID]; ok {
+			tags = append(tags, gonostr.Tag{"e", parent, "", "reply"})
+		}
+		post, err := NewPost(privkey, t.text(), attachments, tags, t.timestamp)
+		if err != nil {
+			return head, n, err
+		}
+		post.Source = a.tweetURL(t)
+		h, err := AppendPost(ctx, ipfscore, post, head)
+		if err != nil {
+			return head, n, err
+		}
+		head = h
+		events[t.ID] = post.Event.ID
+		n++
+		if n%TwitterImportBatchSize == 0 && publish != nil {
+			log.Infof("imported %v of %v tweets", n, len(a.Tweets))
+			if err = publish(head); err != nil {
+				return head, n, err
+			}
+		}
+	}
+	if n%TwitterImportBatchSize != 0 && publish != nil {
+		if err := publish(head); err != nil {
+			return head, n, err
+		}
+	}
+	log.Infof("imported %v tweets, feed head is now %v", n, head)
+	return head, n, nil
+}
@@ -0,0 +1,207 @@
+package feed
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/multicodec"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/node/bindnode"
+	"github.com/ipld/go-ipld-prime/schema"
+	gonostr "github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/util"
+)
+
+// Schema is the IPLD schema of the feed and post nodes written by patr nodes.
+const Schema = `
+type Feed struct {
+	Did String
+	Events {String:Link}
+}
+
+type Event struct {
+	id String
+	pubkey String
+	created_at String
+	kind Int
+	tags [[String]]
+	content String
+	sig String
+}
+
+type Post struct {
+	typ String (rename "type")
+	created_at Int
+	text String
+	attachments [String]
+	source optional String
+	geohash optional String
+	voice optional Voice
+	event Event
+	prev optional Link
+}
+
+type Voice struct {
+	url String
+	duration Int
+	waveform [Int]
+}
+`
+
+var schemaTypes *schema.TypeSystem
+
+func init() {
+	ts, err := ipld.LoadSchemaBytes([]byte(Schema))
+	if err != nil {
+		panic(fmt.Sprintf("could not load feed IPLD schema: %v", err))
+	}
+	schemaTypes = ts
+}
+
+// decodeTypedAs checks that data encoded with a codec conforms to a schema type and decodes it.
+func decodeTypedAs(codec uint64, data []byte, typename string) (datamodel.Node, error) {
+	dec, err := multicodec.LookupDecoder(codec)
+	if err != nil {
+		return nil, err
+	}
+	tb := bindnode.Prototype(nil, schemaTypes.TypeByName(typename)).Representation().NewBuilder()
+	if err := dec(tb, bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("node does not match the %s schema: %v", typename, err)
+	}
+	nb := basicnode.Prototype.Any.NewBuilder()
+	if err := dec(nb, bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	return nb.Build(), nil
+}
+
+func lookupString(n datamodel.Node, key string) string {
+	v, err := n.LookupByString(key)
+	if err != nil {
+		return ""
+	}
+	s, _ := v.AsString()
+	return s
+}
+
+// ValidateFeed checks that a fetched feed node, encoded with the codec of its CID, conforms to the schema and belongs to
+// the expected DID.
+func ValidateFeed(c cid.Cid, data []byte, did string) error {
+	n, err := decodeTypedAs(c.Prefix().Codec, data, "Feed")
+	if err != nil {
+		return err
+	}
+	if d := lookupString(n, "Did"); d != did {
+		return fmt.Errorf("feed DID %s does not match expected author %s", d, did)
+	}
+	return nil
+}
+
+// postEvent returns the Nostr event embedded in a post node encoded with the codec of its CID.
+func postEvent(c cid.Cid, data []byte) (gonostr.Event, error) {
+	n, err := decodeTypedAs(c.Prefix().Codec, data, "Post")
+	if err != nil {
+		return gonostr.Event{}, err
+	}
+	en, err := n.LookupByString("event")
+	if err != nil {
+		return gonostr.Event{}, err
+	}
+	return ipfs.IPLDNodeToNostrEvent(en)
+}
+
+// ValidatePost checks that a fetched post node, encoded with the codec of its CID, conforms to the schema and that its
+// embedded Nostr event is signed by the expected author's Nostr public key.
+func ValidatePost(c cid.Cid, data []byte, pubkey string) error {
+	n, err := decodeTypedAs(c.Prefix().Codec, data, "Post")
+	if err != nil {
+		return err
+	}
+	if t := lookupString(n, "type"); t != "post" {
+		return fmt.Errorf("node type %s is not post", t)
+	}
+	en, err := n.LookupByString("event")
+	if err != nil {
+		return err
+	}
+	evt, err := ipfs.IPLDNodeToNostrEvent(en)
+	if err != nil {
+		return err
+	}
+	if evt.PubKey != pubkey {
+		return fmt.Errorf("post event public key %s does not match expected author %s", evt.PubKey, pubkey)
+	}
+	if evt.GetID() != evt.ID {
+		return fmt.Errorf("post event ID %s does not match its content", evt.ID)
+	}
+	if ok, err := evt.CheckSignature(); err != nil || !ok {
+		return fmt.Errorf("post event %s has an invalid signature", evt.ID)
+	}
+	if _, err := voiceNoteOfTags(evt.Tags); err != nil {
+		return fmt.Errorf("post event %s has an invalid voice note: %v", evt.ID, err)
+	}
+	return nil
+}
+
+// QuarantinedNode is a fetched node which failed validation.
+type QuarantinedNode struct {
+	Cid    string
+	Author string
+	Reason string
+	Time   time.Time
+}
+
+var quarantineLock = sync.Mutex{}
+
+func quarantineFile() string {
+	return filepath.Join(util.AppData, "quarantine.json")
+}
+
+// Quarantine records a node which failed validation so it is not trusted or fetched again.
+func Quarantine(c cid.Cid, author string, reason error) error {
+	log.Warnf("quarantined node %v from %s: %v", c, author, reason)
+	quarantineLock.Lock()
+	defer quarantineLock.Unlock()
+	nodes, err := readQuarantine()
+	if err != nil {
+		return err
+	}
+	nodes = append(nodes, QuarantinedNode{Cid: c.String(), Author: author, Reason: reason.Error(), Time: util.Now()})
+	data, _ := json.MarshalIndent(nodes, "", " ")
+	return util.WriteDataFile(quarantineFile(), data)
+}
+
+// IsQuarantined returns true if a node has previously failed validation.
+func IsQuarantined(c cid.Cid) bool {
+	quarantineLock.Lock()
+	defer quarantineLock.Unlock()
+	nodes, _ := readQuarantine()
+	for _, n := range nodes {
+		if n.Cid == c.String() {
+			return true
+		}
+	}
+	return false
+}
+
+func readQuarantine() ([]QuarantinedNode, error) {
+	nodes := []QuarantinedNode{}
+	if !util.PathExists(quarantineFile()) {
+		return nodes, nil
+	}
+	data, err := util.ReadDataFile(quarantineFile())
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &nodes)
+	return nodes, err
+}
@@ -0,0 +1,49 @@
+package feed
+
+import (
+	"context"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	gonostr "github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/ipfs"
+)
+
+// hlsAttachment returns the gateway URL of the playlist of a transcoded video and an imeta tag describing it which falls
+// back to the original video.
+func hlsAttachment(dir cid.Cid, original string) (string, gonostr.Tag) {
+	url := ipfs.GatewayURL(dir.String()+"/"+ipfs.HLSPlaylist, false)
+	return url, gonostr.Tag{"imeta", "url " + url, "m " + ipfs.HLSMediaType, "fallback " + original}
+}
+
+// transcodeAttachments transcodes the video attachments stored on IPFS to HLS if transcoding is enabled, and returns
+// the attachments with the playlist of each video after it and the imeta tags of the playlists. Videos which can't be
+// transcoded are left as they are.
+func transcodeAttachments(ctx context.Context, ipfscore ipfs.IPFSCore, attachments []string) ([]string, gonostr.Tags) {
+	if !ipfs.TranscodeVideos {
+		return attachments, nil
+	}
+	out := []string{}
+	tags := gonostr.Tags{}
+	for _, a := range attachments {
+		out = append(out, a)
+		if _, ok := attachmentCid(a); !ok {
+			continue
+		}
+		p := attachmentPath(a)
+		t, err := ipfs.CheckRemoteMedia(ctx, ipfscore, p, "")
+		if err != nil || !strings.HasPrefix(t, "video/") {
+			continue
+		}
+		dir, err := ipfs.TranscodeHLSFile(ctx, ipfscore, p)
+		if err != nil {
+			log.Warnf("could not transcode video attachment %s to HLS: %v", a, err)
+			continue
+		}
+		url, tag := hlsAttachment(dir, a)
+		out = append(out, url)
+		tags = append(tags, tag)
+	}
+	return out, tags
+}
@@ -0,0 +1,109 @@
+package feed
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	gonostr "github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/ipfs"
+)
+
+// VoiceNote is a short audio recording attached to a post with the peaks of its waveform for clients to draw.
+type VoiceNote struct {
+	URL      string
+	Duration int
+	Waveform []int
+}
+
+// voiceAttachment returns the gateway URL of an encoded voice note and an imeta tag with its duration and waveform.
+func voiceAttachment(v ipfs.VoiceNote) (string, gonostr.Tag) {
+	url := ipfs.GatewayURL(v.Cid.String(), false)
+	peaks := make([]string, len(v.Waveform))
+	for i, p := range v.Waveform {
+		peaks[i] = strconv.Itoa(p)
+	}
+	return url, gonostr.Tag{"imeta", "url " + url, "m " + ipfs.VoiceNoteMediaType, "duration " + strconv.Itoa(v.Duration),
+		"waveform " + strings.Join(peaks, " ")}
+}
+
+// voiceNoteOfTags returns the voice note described by an imeta tag with a waveform, or nil if there is none.
+func voiceNoteOfTags(tags gonostr.Tags) (*VoiceNote, error) {
+	for _, t := range tags {
+		if len(t) < 2 || t[0] != "imeta" {
+			continue
+		}
+		fields := map[string]string{}
+		for _, f := range t[1:] {
+			if k, v, ok := strings.Cut(f, " "); ok {
+				fields[k] = v
+			}
+		}
+		w, ok := fields["waveform"]
+		if !ok {
+			continue
+		}
+		v := VoiceNote{URL: fields["url"]}
+		d, err := strconv.Atoi(fields["duration"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid voice note duration %s", fields["duration"])
+		}
+		v.Duration = d
+		for _, p := range strings.Fields(w) {
+			n, err := strconv.Atoi(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid voice note waveform peak %s", p)
+			}
+			v.Waveform = append(v.Waveform, n)
+		}
+		if err := checkVoiceNote(v); err != nil {
+			return nil, err
+		}
+		return &v, nil
+	}
+	return nil, nil
+}
+
+// checkVoiceNote checks a voice note is within the duration limit and has a valid waveform.
+func checkVoiceNote(v VoiceNote) error {
+	if v.URL == "" {
+		return fmt.Errorf("voice note has no URL")
+	}
+	if v.Duration <= 0 || v.Duration > ipfs.MaxVoiceNoteSeconds {
+		return fmt.Errorf("voice note duration %vs is not between 1 and %v seconds", v.Duration, ipfs.MaxVoiceNoteSeconds)
+	}
+	if len(v.Waveform) > ipfs.WaveformPeaks {
+		return fmt.Errorf("voice note waveform has more than %v peaks", ipfs.WaveformPeaks)
+	}
+	for _, p := range v.Waveform {
+		if p < 0 || p > ipfs.MaxWaveformPeak {
+			return fmt.Errorf("voice note waveform peak %v is not between 0 and %v", p, ipfs.MaxWaveformPeak)
+		}
+	}
+	return nil
+}
+
+// attachVoiceNote encodes an audio attachment stored on IPFS as a voice note and returns the attachments and tags of a
+// post with the voice note added.
+func attachVoiceNote(ctx context.Context, ipfscore ipfs.IPFSCore, audio string, attachments []string, tags gonostr.Tags) ([]string, gonostr.Tags, error) {
+	if _, ok := attachmentCid(audio); !ok {
+		return attachments, tags, fmt.Errorf("voice note %s is not stored on IPFS", audio)
+	}
+	p := attachmentPath(audio)
+	t, err := ipfs.CheckRemoteMedia(ctx, ipfscore, p, "")
+	if err != nil {
+		return attachments, tags, err
+	}
+	if !strings.HasPrefix(t, "audio/") && !strings.HasPrefix(t, "video/") {
+		return attachments, tags, fmt.Errorf("voice note %s is %s, not audio", audio, t)
+	}
+	v, err := ipfs.EncodeVoiceNoteFile(ctx, ipfscore, p)
+	if err != nil {
+		log.Errorf("could not encode voice note %s: %v", audio, err)
+		return attachments, tags, err
+	}
+	url, tag := voiceAttachment(v)
+	return append(attachments, url), append(tags, tag), nil
+}
@@ -0,0 +1,38 @@
+// Package ipfstest has the IPFS node fixtures shared by the tests of the packages which use IPFS.
+package ipfstest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/util"
+)
+
+// StartOfflineNode starts an offline IPFS node with an in-memory repo and a data directory which are removed when the
+// test finishes.
+func StartOfflineNode(t testing.TB) *ipfs.IPFSCore {
+	t.Helper()
+	offline, repoPath, appData := ipfs.Offline, ipfs.RepoPath, util.AppData
+	ipfs.Offline, ipfs.RepoPath, util.AppData = true, "", t.TempDir()
+	t.Cleanup(func() { ipfs.Offline, ipfs.RepoPath, util.AppData = offline, repoPath, appData })
+	return StartNode(t)
+}
+
+// StartNode starts an IPFS node with new keys and the repo and data directory which are set, and shuts it down when
+// the test finishes.
+func StartNode(t testing.TB) *ipfs.IPFSCore {
+	t.Helper()
+	priv, pub, err := ipfs.GenerateIPFSNodeKeyPair()
+	if err != nil {
+		t.Fatalf("could not generate IPFS node keys: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	core, err := ipfs.StartIPFSNode(ctx, priv, pub)
+	if err != nil {
+		t.Fatalf("could not start IPFS node: %v", err)
+	}
+	t.Cleanup(core.Shutdown)
+	return core
+}
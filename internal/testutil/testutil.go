@@ -0,0 +1,41 @@
+// Package testutil has the fixtures shared by the tests of network operations which must be aborted.
+package testutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// HangingServer starts an HTTP server which never responds until the request is aborted, and returns its URL.
+func HangingServer(t testing.TB) string {
+	t.Helper()
+	stop := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-stop:
+		}
+	}))
+	t.Cleanup(func() {
+		close(stop)
+		srv.Close()
+	})
+	return srv.URL
+}
+
+// Aborts checks that a call returns an error within a few seconds.
+func Aborts(t testing.TB, name string, f func() error) {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- f() }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("%s succeeded against a server which never responds", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("%s was not aborted", name)
+	}
+}
@@ -0,0 +1,176 @@
+package ipfs
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/ipfs/boxo/coreiface/options"
+	files "github.com/ipfs/boxo/files"
+	"github.com/ipfs/go-cid"
+
+	"github.com/allisterb/patr/util"
+)
+
+// VoiceNoteMediaType is the content type of voice notes, which are Opus audio in an Ogg container.
+const VoiceNoteMediaType = "audio/ogg"
+
+// Limits of voice notes. Recordings longer than MaxVoiceNoteSeconds or larger than MaxVoiceNoteSourceBytes are rejected.
+const (
+	MaxVoiceNoteSeconds     = 300
+	MaxVoiceNoteSourceBytes = 50 * 1024 * 1024
+	WaveformPeaks           = 64
+	MaxWaveformPeak         = 100
+)
+
+// waveformSampleRate is the sample rate voice notes are decoded at to measure them.
+const waveformSampleRate = 8000
+
+// VoiceNoteBitrate is the bitrate of encoded voice notes.
+var VoiceNoteBitrate = "32k"
+
+// VoiceNote is a voice note encoded as Opus and added to IPFS.
+type VoiceNote struct {
+	Cid      cid.Cid
+	Duration int
+	Waveform []int
+}
+
+// waveform reduces the absolute sample values of a recording to n peaks between 0 and MaxWaveformPeak.
+func waveform(samples []uint16, n int) []int {
+	peaks := make([]int, n)
+	if len(samples) == 0 {
+		return peaks
+	}
+	max := uint16(1)
+	buckets := make([]uint16, n)
+	for i, s := range samples {
+		b := i * n / len(samples)
+		if s > buckets[b] {
+			buckets[b] = s
+		}
+		if s > max {
+			max = s
+		}
+	}
+	for i, b := range buckets {
+		peaks[i] = int(b) * MaxWaveformPeak / int(max)
+	}
+	return peaks
+}
+
+// AudioWaveform decodes an audio file with ffmpeg and returns its duration in seconds and WaveformPeaks peaks of its
+// waveform. Recordings longer than MaxVoiceNoteSeconds are rejected.
+func AudioWaveform(ctx context.Context, input string) (int, []int, error) {
+	tctx, cancel := util.WithTimeout(ctx, TranscodeTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(tctx, FFmpegPath, "-nostdin", "-loglevel", "error", "-i", input, "-vn", "-ac", "1",
+		"-ar", fmt.Sprint(waveformSampleRate), "-f", "s16le", "-")
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return 0, nil, err
+	}
+	// Keep the loudest sample of every 100 so long recordings don't use much memory.
+	const stride = 100
+	samples := []uint16{}
+	r := bufio.NewReader(out)
+	var s int16
+	var peak uint16
+	n := 0
+	for {
+		if err = binary.Read(r, binary.LittleEndian, &s); err != nil {
+			break
+		}
+		a := uint16(s)
+		if s < 0 {
+			a = uint16(-int32(s))
+		}
+		if a > peak {
+			peak = a
+		}
+		if n++; n%stride == 0 {
+			samples = append(samples, peak)
+			peak = 0
+		}
+		if n > (MaxVoiceNoteSeconds+1)*waveformSampleRate {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return 0, nil, fmt.Errorf("audio %s is longer than %v seconds", input, MaxVoiceNoteSeconds)
+		}
+	}
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return 0, nil, err
+	}
+	if err = cmd.Wait(); err != nil {
+		log.Errorf("could not decode audio %s: %v", input, err)
+		return 0, nil, err
+	}
+	if n == 0 {
+		return 0, nil, fmt.Errorf("audio %s has no samples", input)
+	}
+	duration := (n + waveformSampleRate - 1) / waveformSampleRate
+	if duration > MaxVoiceNoteSeconds {
+		return 0, nil, fmt.Errorf("audio %s is longer than %v seconds", input, MaxVoiceNoteSeconds)
+	}
+	return duration, waveform(samples, WaveformPeaks), nil
+}
+
+// EncodeVoiceNote measures an audio file with AudioWaveform, encodes it with ffmpeg as mono Opus and adds it to IPFS.
+func EncodeVoiceNote(ctx context.Context, ipfscore IPFSCore, input string) (VoiceNote, error) {
+	duration, peaks, err := AudioWaveform(ctx, input)
+	if err != nil {
+		return VoiceNote{}, err
+	}
+	f, err := os.CreateTemp("", "patr-voice-*.ogg")
+	if err != nil {
+		return VoiceNote{}, err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	tctx, cancel := util.WithTimeout(ctx, TranscodeTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(tctx, FFmpegPath, "-nostdin", "-loglevel", "error", "-y", "-i", input, "-vn", "-ac", "1",
+		"-c:a", "libopus", "-b:a", VoiceNoteBitrate, "-application", "voip", "-f", "ogg", f.Name())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Errorf("could not encode voice note %s as Opus: %v: %s", input, err, out)
+		return VoiceNote{}, err
+	}
+	st, err := os.Stat(f.Name())
+	if err != nil {
+		return VoiceNote{}, err
+	}
+	sf, err := files.NewSerialFile(f.Name(), false, st)
+	if err != nil {
+		return VoiceNote{}, err
+	}
+	defer sf.Close()
+	p, err := ipfscore.Api.Unixfs().Add(ctx, sf, options.Unixfs.HashOnly(util.DryRun))
+	if err != nil {
+		log.Errorf("could not add voice note %s to IPFS: %v", input, err)
+		return VoiceNote{}, err
+	}
+	log.Infof("encoded %vs voice note %s as %v", duration, input, p.Cid())
+	return VoiceNote{Cid: p.Cid(), Duration: duration, Waveform: peaks}, nil
+}
+
+// EncodeVoiceNoteFile encodes an audio file on IPFS as a voice note with EncodeVoiceNote.
+func EncodeVoiceNoteFile(ctx context.Context, ipfscore IPFSCore, p string) (VoiceNote, error) {
+	if !FFmpegAvailable() {
+		return VoiceNote{}, fmt.Errorf("ffmpeg was not found at %s", FFmpegPath)
+	}
+	name, err := fetchTemp(ctx, ipfscore, p, MaxVoiceNoteSourceBytes, "patr-audio-*")
+	if err != nil {
+		return VoiceNote{}, err
+	}
+	defer os.Remove(name)
+	return EncodeVoiceNote(ctx, ipfscore, name)
+}
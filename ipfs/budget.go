@@ -0,0 +1,66 @@
+package ipfs
+
+import "sync"
+
+// FetchBudget limits how much content is fetched from a single remote author during a sync so a malicious feed
+// linking an enormous DAG can't exhaust disk or bandwidth. Zero values mean no limit.
+type FetchBudget struct {
+	MaxBlocks int
+	MaxBytes  int64
+	MaxDepth  int
+}
+
+var DefaultFetchBudget = FetchBudget{MaxBlocks: 1000, MaxBytes: 64 * 1024 * 1024, MaxDepth: 1000}
+
+// FetchBudgets are the budgets for individual authors keyed by DID or peer ID.
+var FetchBudgets = map[string]FetchBudget{}
+
+func BudgetFor(author string) FetchBudget {
+	if b, ok := FetchBudgets[author]; ok {
+		return b
+	}
+	return DefaultFetchBudget
+}
+
+// FetchTracker tracks the content fetched from an author against their budget.
+type FetchTracker struct {
+	Author    string
+	Budget    FetchBudget
+	Blocks    int
+	Bytes     int64
+	Truncated bool
+	lock      sync.Mutex
+}
+
+func NewFetchTracker(author string) *FetchTracker {
+	return &FetchTracker{Author: author, Budget: BudgetFor(author)}
+}
+
+// Allow returns true and counts a block if fetching it at the given depth stays within the budget. Once the budget
+// is exceeded the fetch is truncated and a warning is logged.
+func (t *FetchTracker) Allow(size int, depth int) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.Truncated {
+		return false
+	}
+	b := t.Budget
+	if (b.MaxBlocks > 0 && t.Blocks+1 > b.MaxBlocks) || (b.MaxBytes > 0 && t.Bytes+int64(size) > b.MaxBytes) || (b.MaxDepth > 0 && depth > b.MaxDepth) {
+		t.Truncated = true
+		log.Warnf("fetch budget for %s exceeded after %v blocks and %v bytes at depth %v, truncating", t.Author, t.Blocks, t.Bytes, depth)
+		return false
+	}
+	t.Blocks++
+	t.Bytes += int64(size)
+	return true
+}
+
+// Remaining returns the number of bytes left in the budget or -1 if there is no byte limit.
+func (t *FetchTracker) Remaining() int64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.Budget.MaxBytes <= 0 {
+		return -1
+	}
+	return t.Budget.MaxBytes - t.Bytes
+}
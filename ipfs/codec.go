@@ -0,0 +1,86 @@
+package ipfs
+
+import (
+	"bytes"
+	"fmt"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/codec/dagjson"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/multicodec"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Codecs the IPLD nodes of profiles and Nostr events can be encoded with. DAG-CBOR is smaller and is the canonical IPLD
+// codec for structured data. DAG-JSON can be read by people and tools without IPLD support.
+const (
+	CodecDagCBOR = "dag-cbor"
+	CodecDagJSON = "dag-json"
+)
+
+// DefaultCodec is the codec of profiles and Nostr events if none is specified.
+var DefaultCodec = CodecDagCBOR
+
+// CodecPrefix returns the prefix of the CIDs of nodes encoded with a codec and hashed with SHA3-384.
+func CodecPrefix(codec string) (cid.Prefix, error) {
+	p := cid.Prefix{Version: 1, MhType: mh.SHA3_384, MhLength: 48}
+	switch codec {
+	case CodecDagCBOR:
+		p.Codec = cid.DagCBOR
+	case CodecDagJSON:
+		p.Codec = cid.DagJSON
+	default:
+		return cid.Prefix{}, fmt.Errorf("unknown IPLD codec %s, must be %s or %s", codec, CodecDagCBOR, CodecDagJSON)
+	}
+	return p, nil
+}
+
+// EncodeIPLDNode encodes an IPLD node with a codec as a block.
+func EncodeIPLDNode(dagnode datamodel.Node, codec string) (*blocks.BasicBlock, error) {
+	p, err := CodecPrefix(codec)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if codec == CodecDagCBOR {
+		err = dagcbor.Encode(dagnode, &buf)
+	} else {
+		err = dagjson.Encode(dagnode, &buf)
+	}
+	if err != nil {
+		log.Errorf("error encoding IPLD node as %s: %v", codec, err)
+		return nil, err
+	}
+	c, err := p.Sum(buf.Bytes())
+	if err != nil {
+		log.Errorf("error creating CID for IPLD node: %v", err)
+		return nil, err
+	}
+	return blocks.NewBlockWithCid(buf.Bytes(), c)
+}
+
+// DecodeIPLDNode decodes the data of a block with the codec of its CID.
+func DecodeIPLDNode(c cid.Cid, data []byte) (datamodel.Node, error) {
+	dec, err := multicodec.LookupDecoder(c.Prefix().Codec)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode block %v: %v", c, err)
+	}
+	nb := basicnode.Prototype.Any.NewBuilder()
+	if err = dec(nb, bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("could not decode block %v: %v", c, err)
+	}
+	return nb.Build(), nil
+}
+
+// DecodeNostrEvent decodes a Nostr event stored as an IPLD node in a block with either codec.
+func DecodeNostrEvent(c cid.Cid, data []byte) (nostr.Event, error) {
+	n, err := DecodeIPLDNode(c, data)
+	if err != nil {
+		return nostr.Event{}, err
+	}
+	return IPLDNodeToNostrEvent(n)
+}
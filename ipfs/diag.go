@@ -0,0 +1,177 @@
+package ipfs
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	ipns_pb "github.com/ipfs/boxo/ipns/pb"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+
+	"github.com/allisterb/patr/util"
+)
+
+// IPNS record sources probed by ProbeIPNSName.
+const (
+	IPNSSourceCache = "cache"
+	IPNSSourceDHT   = "dht"
+	IPNSSourcePeers = "peers"
+	IPNSSourceW3S   = "w3s"
+)
+
+// IPNSProbe is the result of resolving an IPNS name from one source.
+type IPNSProbe struct {
+	Source   string        `json:"source"`
+	Value    string        `json:"value,omitempty"`
+	Sequence uint64        `json:"sequence"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+func probeIPNSEntry(source string, start time.Time, entry *ipns_pb.IpnsEntry, err error) IPNSProbe {
+	p := IPNSProbe{Source: source, Duration: time.Since(start)}
+	if err == nil && entry == nil {
+		err = fmt.Errorf("no record found")
+	}
+	if err != nil {
+		p.Error = err.Error()
+		return p
+	}
+	p.Value, p.Sequence = string(entry.GetValue()), entry.GetSequence()
+	return p
+}
+
+// ProbeIPNSName resolves an IPNS name from the node's cache, the DHT, connected peers and Web3.Storage separately, timing
+// each, so it can be seen which sources have the newest record. Probes are returned in the order of the sources.
+func ProbeIPNSName(ctx context.Context, ipfscore IPFSCore, name string) ([]IPNSProbe, error) {
+	pid, err := IPNSNamePeerID(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid IPNS name %s: %v", name, err)
+	}
+	ctx, cancel := util.WithTimeout(ctx, IPNSResolveTimeout)
+	defer cancel()
+	probes := map[string]IPNSProbe{}
+	// The cache is probed first since the other probes cache the records they find.
+	start := time.Now()
+	if r, ok := cachedIPNSRecord(pid); ok {
+		probes[IPNSSourceCache] = probeIPNSEntry(IPNSSourceCache, start, r.entry, nil)
+	} else {
+		probes[IPNSSourceCache] = probeIPNSEntry(IPNSSourceCache, start, nil, fmt.Errorf("not cached"))
+	}
+	lock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	probe := func(source string, resolve func() (*ipns_pb.IpnsEntry, error)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			entry, err := resolve()
+			lock.Lock()
+			probes[source] = probeIPNSEntry(source, start, entry, err)
+			lock.Unlock()
+		}()
+	}
+	probe(IPNSSourceDHT, func() (*ipns_pb.IpnsEntry, error) {
+		r, err := lookupIPNSRecord(ctx, ipfscore, pid)
+		return r.entry, err
+	})
+	if PeerIPNSResolver != nil {
+		probe(IPNSSourcePeers, func() (*ipns_pb.IpnsEntry, error) {
+			r, err := peerIPNSRecord(ctx, pid)
+			return r.entry, err
+		})
+	}
+	probe(IPNSSourceW3S, func() (*ipns_pb.IpnsEntry, error) {
+		entry, err := ipfscore.W3S.GetName(ctx, strings.TrimPrefix(name, "/ipns/"))
+		if err != nil || entry == nil {
+			return entry, err
+		}
+		data, err := proto.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+		return ValidateIPNSRecord(pid, data)
+	})
+	wg.Wait()
+	result := []IPNSProbe{}
+	for _, s := range []string{IPNSSourceCache, IPNSSourceDHT, IPNSSourcePeers, IPNSSourceW3S} {
+		if p, ok := probes[s]; ok {
+			result = append(result, p)
+		}
+	}
+	return result, nil
+}
+
+// NewestIPNSProbe returns the successful probe with the newest record, preferring the fastest of equally new records.
+func NewestIPNSProbe(probes []IPNSProbe) (IPNSProbe, bool) {
+	var best *IPNSProbe
+	for i, p := range probes {
+		if p.Error != "" {
+			continue
+		}
+		if best == nil || p.Sequence > best.Sequence || (p.Sequence == best.Sequence && p.Duration < best.Duration) {
+			best = &probes[i]
+		}
+	}
+	if best == nil {
+		return IPNSProbe{}, false
+	}
+	return *best, true
+}
+
+// PeerLatency is the round trip time to a peer.
+type PeerLatency struct {
+	Peer      string        `json:"peer"`
+	Addr      string        `json:"addr,omitempty"`
+	Latency   time.Duration `json:"latency"`
+	Connected bool          `json:"connected"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// PingPeer measures the round trip time to a peer with the libp2p ping protocol, connecting to it if needed.
+func PingPeer(ctx context.Context, ipfscore IPFSCore, pid peer.ID) PeerLatency {
+	ctx, cancel := util.WithTimeout(ctx, DHTQueryTimeout)
+	defer cancel()
+	l := PeerLatency{Peer: pid.String()}
+	res, ok := <-ping.Ping(ctx, ipfscore.Node.PeerHost, pid)
+	if !ok {
+		l.Error = ctx.Err().Error()
+		return l
+	}
+	if res.Error != nil {
+		l.Error = res.Error.Error()
+		return l
+	}
+	l.Latency, l.Connected = res.RTT, true
+	if conns := ipfscore.Node.PeerHost.Network().ConnsToPeer(pid); len(conns) > 0 {
+		l.Addr = conns[0].RemoteMultiaddr().String()
+	}
+	return l
+}
+
+// PeerLatencies returns the latency of each connected peer measured by libp2p, fastest first. Peers without a latency
+// measurement are last.
+func PeerLatencies(ipfscore IPFSCore) []PeerLatency {
+	host := ipfscore.Node.PeerHost
+	latencies := []PeerLatency{}
+	for _, pid := range host.Network().Peers() {
+		l := PeerLatency{Peer: pid.String(), Latency: host.Peerstore().LatencyEWMA(pid), Connected: true}
+		if conns := host.Network().ConnsToPeer(pid); len(conns) > 0 {
+			l.Addr = conns[0].RemoteMultiaddr().String()
+		}
+		latencies = append(latencies, l)
+	}
+	sort.Slice(latencies, func(i, j int) bool {
+		a, b := latencies[i].Latency, latencies[j].Latency
+		if a == 0 || b == 0 {
+			return b == 0 && a != 0
+		}
+		return a < b
+	})
+	return latencies
+}
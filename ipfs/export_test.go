@@ -0,0 +1,4 @@
+package ipfs
+
+// PSAPin exports the pin status object of the Pinning Service API to the external tests.
+type PSAPin = psaPin
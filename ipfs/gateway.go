@@ -0,0 +1,261 @@
+package ipfs
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+
+	"github.com/allisterb/patr/util"
+)
+
+type GatewayWarmupResult struct {
+	Gateway  string
+	Path     string
+	Status   int
+	Duration time.Duration
+	Err      error
+}
+
+var DefaultGateways = []string{
+	"https://ipfs.io",
+	"https://dweb.link",
+	"https://w3s.link",
+	"https://cloudflare-ipfs.com",
+}
+
+// WarmGateways requests a CID and/or an IPNS name from each public gateway so their caches are primed.
+// Either c or name can be empty.
+func WarmGateways(ctx context.Context, gateways []string, c cid.Cid, name string) []GatewayWarmupResult {
+	if Offline {
+		return nil
+	}
+	if len(gateways) == 0 {
+		gateways = DefaultGateways
+	}
+	paths := []string{}
+	if c.Defined() {
+		paths = append(paths, "/ipfs/"+c.String())
+	}
+	if name != "" {
+		paths = append(paths, "/ipns/"+name)
+	}
+	hc := &http.Client{Timeout: 60 * time.Second}
+	results := make([]GatewayWarmupResult, len(gateways)*len(paths))
+	var wg sync.WaitGroup
+	for i, g := range gateways {
+		for j, p := range paths {
+			wg.Add(1)
+			go func(k int, g string, p string) {
+				defer wg.Done()
+				util.Retry(ctx, "gateway", "warming gateway", func(ctx context.Context) error {
+					results[k] = warmGateway(ctx, hc, strings.TrimSuffix(g, "/"), p)
+					return results[k].Err
+				})
+			}(i*len(paths)+j, g, p)
+		}
+	}
+	wg.Wait()
+	for _, r := range results {
+		if r.Err == nil {
+			log.Infof("gateway %s served %s in %v", r.Gateway, r.Path, r.Duration)
+		} else {
+			log.Warnf("gateway %s could not serve %s: %v", r.Gateway, r.Path, r.Err)
+		}
+	}
+	return results
+}
+
+func warmGateway(ctx context.Context, hc *http.Client, gateway string, path string) GatewayWarmupResult {
+	r := GatewayWarmupResult{Gateway: gateway, Path: path}
+	start := time.Now()
+	req, err := http.NewRequestWithContext(ctx, "HEAD", gateway+path, nil)
+	if err != nil {
+		r.Err = err
+		return r
+	}
+	res, err := hc.Do(req)
+	r.Duration = time.Since(start)
+	if err != nil {
+		r.Err = err
+		return r
+	}
+	res.Body.Close()
+	r.Status = res.StatusCode
+	if res.StatusCode != http.StatusOK {
+		r.Err = &util.HTTPStatusError{StatusCode: res.StatusCode, Status: res.Status}
+	}
+	return r
+}
+
+// ScheduleGatewayWarmup periodically primes gateway caches for an IPNS name until the context is cancelled.
+func ScheduleGatewayWarmup(ctx context.Context, gateways []string, name string, interval time.Duration) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				log.Infof("warming up gateway caches for IPNS name %s...", name)
+				WarmGateways(ctx, gateways, cid.Undef, name)
+			}
+		}
+	}()
+}
+
+// GatewayHealth is the result of the last probe of a gateway used for media URLs.
+type GatewayHealth struct {
+	Gateway   string
+	Available bool
+	Latency   time.Duration
+	Checked   time.Time
+}
+
+// probeCid is the CID of the empty UnixFS directory, which gateways can serve without fetching it from the network.
+const probeCid = "bafybeiczsscdsbs7ffqz55asqdf3smv6klcw3gofszvwlyarci47bgf354"
+
+// SlowGatewayLatency is the probe latency above which a gateway is only used for media URLs if no faster gateway in the
+// list is available.
+var SlowGatewayLatency = 2 * time.Second
+
+var gatewayLock = sync.Mutex{}
+var mediaGateways = DefaultGateways
+var localGateway = ""
+var gatewayHealth = map[string]GatewayHealth{}
+
+// SetMediaGateways sets the prioritized list of gateways used for media URLs and the local gateway used for API
+// consumers on the same machine. An empty list uses DefaultGateways.
+func SetMediaGateways(gateways []string, local string) {
+	gatewayLock.Lock()
+	defer gatewayLock.Unlock()
+	mediaGateways = DefaultGateways
+	if len(gateways) > 0 {
+		mediaGateways = []string{}
+		for _, g := range gateways {
+			mediaGateways = append(mediaGateways, strings.TrimSuffix(g, "/"))
+		}
+	}
+	localGateway = strings.TrimSuffix(local, "/")
+}
+
+// ProbeGateways measures the latency and availability of each media gateway.
+func ProbeGateways(ctx context.Context) []GatewayHealth {
+	if Offline {
+		return nil
+	}
+	gatewayLock.Lock()
+	gateways := mediaGateways
+	gatewayLock.Unlock()
+	hc := &http.Client{Timeout: 10 * time.Second}
+	health := make([]GatewayHealth, len(gateways))
+	var wg sync.WaitGroup
+	for i, g := range gateways {
+		wg.Add(1)
+		go func(i int, g string) {
+			defer wg.Done()
+			r := warmGateway(ctx, hc, g, "/ipfs/"+probeCid)
+			health[i] = GatewayHealth{Gateway: g, Available: r.Err == nil, Latency: r.Duration, Checked: util.Now()}
+			if r.Err != nil {
+				log.Debugf("gateway %s is unavailable: %v", g, r.Err)
+			}
+		}(i, g)
+	}
+	wg.Wait()
+	gatewayLock.Lock()
+	for _, h := range health {
+		gatewayHealth[h.Gateway] = h
+	}
+	gatewayLock.Unlock()
+	return health
+}
+
+// GatewayHealthStatus returns the last probe of each media gateway in priority order.
+func GatewayHealthStatus() []GatewayHealth {
+	gatewayLock.Lock()
+	defer gatewayLock.Unlock()
+	status := []GatewayHealth{}
+	for _, g := range mediaGateways {
+		h, ok := gatewayHealth[g]
+		if !ok {
+			h = GatewayHealth{Gateway: g, Available: true}
+		}
+		status = append(status, h)
+	}
+	return status
+}
+
+// selectGateway returns the gateway used for media URLs: the first gateway in priority order which is available and
+// not slow, else the fastest available gateway. Gateways which haven't been probed are assumed to be available, and if
+// no gateway is available the first one is used. Local API consumers get the local gateway if one is set.
+func selectGateway(local bool) string {
+	gatewayLock.Lock()
+	lg := localGateway
+	gatewayLock.Unlock()
+	if local && lg != "" {
+		return lg
+	}
+	status := GatewayHealthStatus()
+	available := []GatewayHealth{}
+	for _, h := range status {
+		if h.Available {
+			if h.Latency <= SlowGatewayLatency {
+				return h.Gateway
+			}
+			available = append(available, h)
+		}
+	}
+	if len(available) == 0 {
+		return status[0].Gateway
+	}
+	sort.SliceStable(available, func(i, j int) bool { return available[i].Latency < available[j].Latency })
+	return available[0].Gateway
+}
+
+// GatewayURL returns the URL of a CID or path on the selected media gateway, or on the local gateway if the API consumer
+// is local and one is configured.
+func GatewayURL(p string, local bool) string {
+	return selectGateway(local) + "/ipfs/" + strings.TrimPrefix(strings.TrimPrefix(p, "ipfs://"), "/ipfs/")
+}
+
+var gatewayURLPattern = regexp.MustCompile(`(ipfs://|https?://[^/\s"'<>]+/ipfs/)([A-Za-z0-9]+)`)
+
+// RewriteGatewayURLs replaces ipfs:// URLs and URLs on known gateways in text with URLs on the selected media gateway.
+// URLs on other hosts are left alone.
+func RewriteGatewayURLs(text string, local bool) string {
+	gatewayLock.Lock()
+	known := append(append([]string{}, DefaultGateways...), mediaGateways...)
+	gatewayLock.Unlock()
+	return gatewayURLPattern.ReplaceAllStringFunc(text, func(u string) string {
+		m := gatewayURLPattern.FindStringSubmatch(u)
+		if _, err := cid.Decode(m[2]); err != nil {
+			return u
+		}
+		if m[1] != "ipfs://" && !util.Contains(known, strings.TrimSuffix(m[1], "/ipfs/")) {
+			return u
+		}
+		return GatewayURL(m[2], local)
+	})
+}
+
+// ScheduleGatewayProbe probes the media gateways now and then periodically until the context is cancelled.
+func ScheduleGatewayProbe(ctx context.Context, interval time.Duration) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			ProbeGateways(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
@@ -0,0 +1,236 @@
+package ipfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	hamt "github.com/ipld/go-ipld-adl-hamt"
+	_ "github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/linking"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/bindnode"
+	"github.com/ipld/go-ipld-prime/schema"
+	mh "github.com/multiformats/go-multihash"
+
+	"github.com/allisterb/patr/util"
+)
+
+// ShardedMapThreshold is the number of entries above which collections are stored as sharded maps instead of a single map node.
+const ShardedMapThreshold = 500
+
+var shardLinkPrototype = cidlink.LinkPrototype{Prefix: cid.Prefix{
+	Version:  1,
+	Codec:    cid.DagCBOR,
+	MhType:   mh.SHA3_384,
+	MhLength: 48,
+}}
+
+// ShardedMap is an IPLD map sharded across blocks as a HAMT so it can grow beyond the size of a single block.
+// Entries are read and written through a link system backed by the local blockstore, so only the shards on the
+// path to a key are loaded or rewritten.
+type ShardedMap struct {
+	ipfscore IPFSCore
+	node     *hamt.Node
+	ma       datamodel.MapAssembler
+	lock     sync.Mutex
+	// written holds the blocks written in a dry run so the map can still be read back.
+	written map[cid.Cid][]byte
+}
+
+func (m *ShardedMap) linkSystem(ctx context.Context) linking.LinkSystem {
+	ls := cidlink.DefaultLinkSystem()
+	ls.StorageReadOpener = func(lctx linking.LinkContext, l datamodel.Link) (io.Reader, error) {
+		c := l.(cidlink.Link).Cid
+		if data, ok := m.written[c]; ok {
+			return bytes.NewReader(data), nil
+		}
+		data, err := GetBlock(ctx, m.ipfscore, c)
+		if err != nil {
+			log.Errorf("could not read sharded map block %v: %v", c, err)
+			return nil, err
+		}
+		return bytes.NewReader(data), nil
+	}
+	ls.StorageWriteOpener = func(lctx linking.LinkContext) (io.Writer, linking.BlockWriteCommitter, error) {
+		buf := bytes.Buffer{}
+		return &buf, func(l datamodel.Link) error {
+			c := l.(cidlink.Link).Cid
+			if util.DryRun {
+				m.written[c] = buf.Bytes()
+				return nil
+			}
+			return PutBlock(ctx, m.ipfscore, c, buf.Bytes())
+		}, nil
+	}
+	return ls
+}
+
+func newShardedMap(ctx context.Context, ipfscore IPFSCore, root *hamt.HashMapRoot) (*ShardedMap, error) {
+	m := &ShardedMap{ipfscore: ipfscore, written: make(map[cid.Cid][]byte)}
+	b := hamt.NewBuilder(hamt.Prototype{}).WithLinking(m.linkSystem(ctx), shardLinkPrototype)
+	ma, err := b.BeginMap(0)
+	if err != nil {
+		return nil, err
+	}
+	m.node, m.ma = hamt.Build(b), ma
+	if root != nil {
+		// the assembler inserts into the node the builder returned, so pointing it at an existing root lets
+		// entries be added without rebuilding the map
+		m.node.HashMapRoot = *root
+	}
+	return m, nil
+}
+
+// NewShardedMap creates an empty sharded map.
+func NewShardedMap(ctx context.Context, ipfscore IPFSCore) (*ShardedMap, error) {
+	return newShardedMap(ctx, ipfscore, nil)
+}
+
+// LoadShardedMap loads the root of a sharded map written by Save.
+func LoadShardedMap(ctx context.Context, ipfscore IPFSCore, root cid.Cid) (*ShardedMap, error) {
+	m := &ShardedMap{ipfscore: ipfscore, written: make(map[cid.Cid][]byte)}
+	ls := m.linkSystem(ctx)
+	n, err := ls.Load(linking.LinkContext{Ctx: ctx}, cidlink.Link{Cid: root}, hamt.HashMapRootPrototype.Representation())
+	if err != nil {
+		log.Errorf("could not load sharded map %v: %v", root, err)
+		return nil, err
+	}
+	r, ok := bindnode.Unwrap(n).(*hamt.HashMapRoot)
+	if !ok {
+		return nil, fmt.Errorf("%v is not the root of a sharded map", root)
+	}
+	return newShardedMap(ctx, ipfscore, r)
+}
+
+// IsShardedMap returns true if an IPLD node is the root of a sharded map rather than a flat map.
+func IsShardedMap(n datamodel.Node) bool {
+	if n.Kind() != datamodel.Kind_Map {
+		return false
+	}
+	for _, k := range []string{"hashAlg", "bucketSize", "hamt"} {
+		if _, err := n.LookupByString(k); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Set adds or replaces an entry.
+func (m *ShardedMap) Set(key string, value datamodel.Node) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err := m.ma.AssembleKey().AssignString(key); err != nil {
+		return err
+	}
+	if err := m.ma.AssembleValue().AssignNode(value); err != nil {
+		log.Errorf("could not add key %s to sharded map: %v", key, err)
+		return err
+	}
+	return nil
+}
+
+// Get returns the value of an entry or a datamodel.ErrNotExists error if the key is not in the map.
+func (m *ShardedMap) Get(key string) (datamodel.Node, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.node.LookupByString(key)
+}
+
+func (m *ShardedMap) Len() int64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.node.Length()
+}
+
+// Iterate calls f for each entry in the map in hash order.
+func (m *ShardedMap) Iterate(f func(key string, value datamodel.Node) error) error {
+	m.lock.Lock()
+	it := m.node.MapIterator()
+	m.lock.Unlock()
+	for !it.Done() {
+		k, v, err := it.Next()
+		if err != nil {
+			return err
+		}
+		key, err := k.AsString()
+		if err != nil {
+			b, err := k.AsBytes()
+			if err != nil {
+				return err
+			}
+			key = string(b)
+		}
+		if err = f(key, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Merge copies the entries of a flat map node into the sharded map, converting each value with convert if it is not nil.
+// It is used to migrate collections which were written as a single map node.
+func (m *ShardedMap) Merge(flat datamodel.Node, convert func(key string, value datamodel.Node) (datamodel.Node, error)) error {
+	if flat.Kind() != datamodel.Kind_Map {
+		return fmt.Errorf("cannot merge IPLD node of kind %v into sharded map", flat.Kind())
+	}
+	it := flat.MapIterator()
+	for !it.Done() {
+		k, v, err := it.Next()
+		if err != nil {
+			return err
+		}
+		key, err := k.AsString()
+		if err != nil {
+			return err
+		}
+		if convert != nil {
+			if v, err = convert(key, v); err != nil {
+				return err
+			}
+		}
+		if err = m.Set(key, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Save writes the root of the map and returns its CID. Shards are written as entries are added.
+func (m *ShardedMap) Save(ctx context.Context) (cid.Cid, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	root := m.node.Substrate().(schema.TypedNode).Representation()
+	ls := m.linkSystem(ctx)
+	l, err := ls.Store(linking.LinkContext{Ctx: ctx}, shardLinkPrototype, root)
+	if err != nil {
+		log.Errorf("could not write sharded map root: %v", err)
+		return cid.Undef, err
+	}
+	return l.(cidlink.Link).Cid, nil
+}
+
+// ReadMap returns a map stored inline as a flat map node or linked as a sharded map. Sharded maps are loaded
+// lazily so the result can be read like a flat map.
+func ReadMap(ctx context.Context, ipfscore IPFSCore, n datamodel.Node) (datamodel.Node, error) {
+	switch n.Kind() {
+	case datamodel.Kind_Map:
+		return n, nil
+	case datamodel.Kind_Link:
+		l, err := n.AsLink()
+		if err != nil {
+			return nil, err
+		}
+		m, err := LoadShardedMap(ctx, ipfscore, l.(cidlink.Link).Cid)
+		if err != nil {
+			return nil, err
+		}
+		return m.node, nil
+	default:
+		return nil, fmt.Errorf("IPLD node of kind %v is not a map", n.Kind())
+	}
+}
@@ -0,0 +1,132 @@
+package ipfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/ipfs/boxo/coreiface/options"
+	ipfspath "github.com/ipfs/boxo/coreiface/path"
+	files "github.com/ipfs/boxo/files"
+	"github.com/ipfs/go-cid"
+
+	"github.com/allisterb/patr/util"
+)
+
+// HLSPlaylist is the name of the playlist in the UnixFS directory of a transcoded video.
+const HLSPlaylist = "index.m3u8"
+
+// HLSMediaType is the content type of HLS playlists.
+const HLSMediaType = "application/vnd.apple.mpegurl"
+
+// MaxTranscodeSourceBytes is the size of the largest video which is transcoded.
+const MaxTranscodeSourceBytes = 2 * 1024 * 1024 * 1024
+
+// Video transcoding settings. TranscodeVideos and FFmpegPath can be changed in the node configuration.
+var (
+	TranscodeVideos   = false
+	FFmpegPath        = "ffmpeg"
+	TranscodeTimeout  = 30 * time.Minute
+	HLSSegmentSeconds = 6
+	HLSMaxHeight      = 720
+)
+
+// FFmpegAvailable returns true if the ffmpeg binary can be found.
+func FFmpegAvailable() bool {
+	_, err := exec.LookPath(FFmpegPath)
+	return err == nil
+}
+
+// TranscodeHLS transcodes a video file with ffmpeg to an HLS playlist and segments of at most HLSMaxHeight lines, and
+// adds them to IPFS as a UnixFS directory. It returns the CID of the directory, which has the playlist at HLSPlaylist.
+func TranscodeHLS(ctx context.Context, ipfscore IPFSCore, input string) (cid.Cid, error) {
+	dir, err := os.MkdirTemp("", "patr-hls-*")
+	if err != nil {
+		return cid.Undef, err
+	}
+	defer os.RemoveAll(dir)
+	tctx, cancel := util.WithTimeout(ctx, TranscodeTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(tctx, FFmpegPath, "-nostdin", "-loglevel", "error", "-i", input,
+		"-vf", fmt.Sprintf("scale=-2:'min(%v,ih)'", HLSMaxHeight),
+		"-c:v", "libx264", "-preset", "veryfast", "-crf", "23", "-c:a", "aac", "-b:a", "128k",
+		"-f", "hls", "-hls_time", strconv.Itoa(HLSSegmentSeconds), "-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(dir, "segment%05d.ts"), filepath.Join(dir, HLSPlaylist))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Errorf("could not transcode video %s to HLS: %v: %s", input, err, out)
+		return cid.Undef, err
+	}
+	st, err := os.Stat(dir)
+	if err != nil {
+		return cid.Undef, err
+	}
+	sf, err := files.NewSerialFile(dir, false, st)
+	if err != nil {
+		return cid.Undef, err
+	}
+	defer sf.Close()
+	p, err := ipfscore.Api.Unixfs().Add(ctx, sf, options.Unixfs.HashOnly(util.DryRun))
+	if err != nil {
+		log.Errorf("could not add HLS playlist of video %s to IPFS: %v", input, err)
+		return cid.Undef, err
+	}
+	log.Infof("transcoded video %s to HLS playlist %v/%s", input, p.Cid(), HLSPlaylist)
+	return p.Cid(), nil
+}
+
+// TranscodeHLSData transcodes video data to HLS with TranscodeHLS.
+func TranscodeHLSData(ctx context.Context, ipfscore IPFSCore, data []byte) (cid.Cid, error) {
+	f, err := os.CreateTemp("", "patr-video-*")
+	if err != nil {
+		return cid.Undef, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	f.Close()
+	if err != nil {
+		return cid.Undef, err
+	}
+	return TranscodeHLS(ctx, ipfscore, f.Name())
+}
+
+// fetchTemp copies a UnixFS file on IPFS no larger than max bytes to a temporary file and returns its name.
+func fetchTemp(ctx context.Context, ipfscore IPFSCore, p string, max int64, pattern string) (string, error) {
+	n, err := ipfscore.Api.Unixfs().Get(ctx, ipfspath.New(p))
+	if err != nil {
+		return "", err
+	}
+	defer n.Close()
+	r, ok := n.(files.File)
+	if !ok {
+		return "", fmt.Errorf("%s is not a file", p)
+	}
+	f, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return "", err
+	}
+	written, err := io.Copy(f, io.LimitReader(r, max+1))
+	f.Close()
+	if err == nil && written > max {
+		err = fmt.Errorf("%s is larger than %v bytes", p, max)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// TranscodeHLSFile transcodes a video file on IPFS to HLS with TranscodeHLS.
+func TranscodeHLSFile(ctx context.Context, ipfscore IPFSCore, p string) (cid.Cid, error) {
+	name, err := fetchTemp(ctx, ipfscore, p, MaxTranscodeSourceBytes, "patr-video-*")
+	if err != nil {
+		return cid.Undef, err
+	}
+	defer os.Remove(name)
+	return TranscodeHLS(ctx, ipfscore, name)
+}
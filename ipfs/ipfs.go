@@ -5,14 +5,22 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"sync"
 	"time"
 
 	iface "github.com/ipfs/boxo/coreiface"
+	"github.com/ipfs/boxo/coreiface/options"
+	files "github.com/ipfs/boxo/files"
 
 	ipfspath "github.com/ipfs/boxo/coreiface/path"
 	ipns "github.com/ipfs/boxo/ipns"
+	ipns_pb "github.com/ipfs/boxo/ipns/pb"
+	keystore "github.com/ipfs/boxo/keystore"
 	path "github.com/ipfs/boxo/path"
 	"github.com/multiformats/go-multibase"
 
@@ -25,7 +33,11 @@ import (
 	ipfsCore "github.com/ipfs/kubo/core"
 	coreapi "github.com/ipfs/kubo/core/coreapi"
 	"github.com/ipfs/kubo/core/node/libp2p"
+	"github.com/ipfs/kubo/plugin"
+	"github.com/ipfs/kubo/plugin/plugins/flatfs"
+	"github.com/ipfs/kubo/plugin/plugins/levelds"
 	repo "github.com/ipfs/kubo/repo"
+	"github.com/ipfs/kubo/repo/fsrepo"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/peer"
 
@@ -36,10 +48,12 @@ import (
 	"github.com/ipld/go-ipld-prime/linking"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	"github.com/ipld/go-ipld-prime/node/basicnode"
-	mh "github.com/multiformats/go-multihash"
 
 	"github.com/nbd-wtf/go-nostr"
 
+	"github.com/allisterb/patr/devnet"
+	"github.com/allisterb/patr/outbox"
+	"github.com/allisterb/patr/util"
 	"github.com/allisterb/patr/w3s"
 )
 
@@ -52,161 +66,129 @@ type IPFSCore struct {
 	W3S      w3s.Client
 }
 
+// IPFSLinkWriter buffers the data of a block written by an IPLD LinkSystem until the block is committed with its link.
 type IPFSLinkWriter struct {
-	ctx  context.Context
-	ipfs iface.CoreAPI
-	cid  cid.Cid
-	w3s  w3s.Client
-	log  *logging.ZapEventLogger
-	data bytes.Buffer
+	ctx   context.Context
+	store *IPFSCore
+	data  bytes.Buffer
 }
 
 var log = logging.Logger("patr/ipfs")
 
 func (w *IPFSLinkWriter) Write(d []byte) (int, error) {
-	return w.data.Read(d)
+	return w.data.Write(d)
 }
 
+// keyToCid parses a storage key, which is the binary form of a CID as used by ipld-prime storage.
+func keyToCid(key string) (cid.Cid, error) {
+	_, c, err := cid.CidFromBytes([]byte(key))
+	if err != nil {
+		log.Errorf("could not create CID from key string %x: %v", key, err)
+		return cid.Undef, err
+	}
+	return c, nil
+}
+
+// Has implements the ipld-prime storage.Storage interface and checks if the block of a key is in the local blockstore.
 func (store *IPFSCore) Has(ctx context.Context, key string) (bool, error) {
-	_, cid, err := cid.CidFromBytes([]byte(key))
+	c, err := keyToCid(key)
 	if err != nil {
-		log.Errorf("could not create CID from key string %s: %v", key, err)
 		return false, err
 	}
-	_, err = store.Api.Block().Stat(ctx, ipfspath.IpldPath(cid))
-	return err != nil, err
+	return store.Node.Blockstore.Has(ctx, c)
 }
 
+// Get implements the ipld-prime storage.ReadableStorage interface and returns the raw data of the block of a key. Blocks
+// not in the local blockstore are fetched from the network with RetrieveBlock.
 func (store *IPFSCore) Get(ctx context.Context, key string) ([]byte, error) {
-	_, k, err := cid.CidFromBytes([]byte(key))
+	c, err := keyToCid(key)
 	if err != nil {
-		log.Errorf("could not create CID from key string %s: %v", key, err)
-		return []byte{}, err
+		return nil, err
 	}
-	log.Infof("getting IPLD node %v from IPFS DAG: %v", k)
-	r, err := store.Api.Block().Get(ctx, ipfspath.IpldPath(k))
+	data, err := RetrieveBlock(ctx, *store, c)
 	if err != nil {
-		log.Errorf("could not get IPLD node %v from IPFS DAG: %v", key, err)
-		return []byte{}, err
+		log.Errorf("could not get IPLD block %v from IPFS: %v", c, err)
+		return nil, err
 	}
-	buf, _ := io.ReadAll(r)
-	b, _ := blocks.NewBlockWithCid(buf, k)
-	ul, err := ipldlegacy.DecodeNode(ctx, b)
-	log.Infof("got IPLD node %v from IPFS DAG", k, err)
-	return ul.RawData(), err
+	return data, nil
 }
 
+// Put implements the ipld-prime storage.WritableStorage interface. The block is verified against the CID of the key and
+// stored and pinned in the local blockstore, then pinned with the remote pinning services of the node, if it has any,
+// with PinRemote, which fails unless the quorum of the services pin it. When the node is offline the remote pin is
+// queued in the outbox instead.
 func (store *IPFSCore) Put(ctx context.Context, key string, data []byte) error {
-	_, k, err := cid.CidFromBytes([]byte(key))
+	c, err := keyToCid(key)
 	if err != nil {
-		log.Errorf("could not create CID from key string %s: %v", key, err)
 		return err
 	}
-	log.Infof("putting IPLD block %v to IPFS DAG...", k)
-	b, _ := blocks.NewBlockWithCid(data, k)
-	ul, err := ipldlegacy.DecodeNode(ctx, b)
-	if err != nil {
-		log.Errorf("could not decode ILPD node data as LegacyNode: %v", err)
-		return err
+	if util.DryRun {
+		log.Infof("dry run: would put IPLD block %v to the local IPFS node", c)
+		return nil
 	}
-	err = store.Api.Dag().Pinning().Add(ctx, ul)
-	if err == nil {
-		log.Infof("put IPLD block %v to local IPFS DAG", k)
-	} else {
-		log.Errorf("error putting IPLD block %v to local IPFS DAG: %v", k, err)
+	if err = PutBlock(ctx, *store, c, data); err != nil {
 		return err
 	}
-	_, err = PinIPLDBlockToW3S(ctx, store.Api, store.W3S.GetAuthToken(), b)
-	if err == nil {
-		log.Infof("put IPLD block %v to IPFS DAG", k)
-	} else {
-		log.Errorf("error putting IPLD block %v to IPFS DAG: %v", k, err)
+	log.Infof("put IPLD block %v to local IPFS node", c)
+	if len(RemotePinners(*store)) == 0 {
+		return nil
 	}
-	return err
+	if Offline {
+		log.Infof("the IPFS node is offline, queueing the remote pin of IPLD block %v in the outbox", c)
+		return outbox.Enqueue(outbox.KindW3SUpload, c.String(), map[string]string{"cid": c.String()})
+	}
+	return PinRemote(ctx, *store, c)
 }
 
+// OpenRead is the BlockReadOpener of the IPFS LinkSystem.
 func (store *IPFSCore) OpenRead(lnkCtx linking.LinkContext, lnk datamodel.Link) (io.Reader, error) {
-	_, k, err := cid.CidFromBytes([]byte(lnk.Binary()))
+	data, err := store.Get(lnkCtx.Ctx, lnk.Binary())
 	if err != nil {
-		log.Errorf("could not create CID from key string %s: %v", lnk.Binary(), err)
 		return nil, err
 	}
-	log.Infof("getting IPLD link %v from IPFS DAG: %v", k)
-	r, err := store.Api.Block().Get(lnkCtx.Ctx, ipfspath.IpldPath(k))
-	if err != nil {
-		log.Errorf("could not get IPLD node %v from IPFS DAG: %v", k, err)
-		return nil, err
-	}
-	buf, _ := io.ReadAll(r)
-	b, _ := blocks.NewBlockWithCid(buf, k)
-	ul, err := ipldlegacy.DecodeNode(lnkCtx.Ctx, b)
-	log.Infof("got IPLD link %v from IPFS DAG", k, err)
-	return bytes.NewReader(ul.RawData()), err
+	return bytes.NewReader(data), nil
 }
 
-func (store *IPFSCore) OpenWrite(lnkCtx linking.LinkContext, lnk datamodel.Link) (io.Writer, linking.BlockWriteCommitter, error) {
-	_, k, err := cid.CidFromBytes([]byte(lnk.Binary()))
-	if err != nil {
-		log.Errorf("could not create CID from key string %s: %v", lnk.Binary(), err)
-		return nil, nil, err
-	}
-	lw := IPFSLinkWriter{
-		ctx:  lnkCtx.Ctx,
-		ipfs: store.Api,
-		cid:  k,
-		w3s:  store.W3S,
-		log:  log,
-		data: bytes.Buffer{},
-	}
-	return &lw, lw.BlockWriteCommit, nil
+// OpenWrite is the BlockWriteOpener of the IPFS LinkSystem. The block is put when the LinkSystem commits it with its link.
+func (store *IPFSCore) OpenWrite(lnkCtx linking.LinkContext) (io.Writer, linking.BlockWriteCommitter, error) {
+	lw := &IPFSLinkWriter{ctx: lnkCtx.Ctx, store: store}
+	return lw, lw.BlockWriteCommit, nil
 }
 
+// BlockWriteCommit puts the written block to IPFS and the remote pinning services with Put.
 func (w *IPFSLinkWriter) BlockWriteCommit(lnk datamodel.Link) error {
-	/*
-		b, err := blocks.NewBlockWithCid(w.data.Bytes(), w.cid)
-		if err != nil {
-			return err
-		}
-		w.log.Infof("putting IPLD block %v to IPFS...", w.cid)
-		s, err := w.ipfs.Block().Put(w.ctx, bytes.NewReader(b.RawData()))
-		if err != nil {
-			w.log.Infof("put IPLD block %v to IPFS at path %s with size %v bytes", w.cid, s.Path(), s.Size())
-		} else {
-			w.log.Errorf("error putting IPLD block %v to IPFS: %v", w.cid, err)
-			return err
-		}
-		w.log.Infof("putting IPLD block %v to Web3.Storage...", w.cid)
-		var cardata bytes.Buffer
-		err = w3s.WriteCar(w.ctx, w.ipfs.Dag(), []cid.Cid{b.Cid()}, &cardata)
-		if err != nil {
-			w.log.Errorf("could not serialize block %v as CAR: %v", b.Cid(), err)
-			return err
-		}
-		pcid, err := w.w3s.PutCar(w.ctx, &cardata)
-		if err != nil {
-			w.log.Infof("put IPLD block %v to Web3.Storage at %v", w.cid, pcid)
-		} else {
-			w.log.Errorf("error putting IPLD block %v to Web3.Storage: %v", w.cid, err)
-		}
-		return err
-	*/
-	return nil
+	ctx := w.ctx
+	if ctx == nil {
+		ctx = w.store.Ctx
+	}
+	return w.store.Put(ctx, lnk.Binary(), w.data.Bytes())
 }
 
-func GenerateIPNSKeyPair() ([]byte, []byte, error) {
-	priv, pub, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, rand.Reader)
-	if err != nil {
-		log.Errorf("error generating RSA 2048-bit keypair: %v", err)
+// GenerateIPNSKeyPair generates a keypair of a key type for an IPNS name.
+func GenerateIPNSKeyPair(keytype string) ([]byte, []byte, error) {
+	var priv crypto.PrivKey
+	var pub crypto.PubKey
+	var err error
+	switch keytype {
+	case KeyTypeEd25519:
+		priv, pub, err = crypto.GenerateEd25519Key(rand.Reader)
+	case KeyTypeRSA:
+		priv, pub, err = crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, rand.Reader)
+	default:
+		return []byte{}, []byte{}, fmt.Errorf("unsupported IPNS key type %s, must be %s or %s", keytype, KeyTypeEd25519, KeyTypeRSA)
+	}
+	if err != nil {
+		log.Errorf("error generating %s keypair: %v", keytype, err)
 		return []byte{}, []byte{}, err
 	}
 	privkeyb, err := crypto.MarshalPrivateKey(priv)
 	if err != nil {
-		log.Errorf("error marshalling RSA 2048-bit private key: %v", err)
+		log.Errorf("error marshalling %s private key: %v", keytype, err)
 		return []byte{}, []byte{}, err
 	}
 	pubkeyb, err := crypto.MarshalPublicKey(pub)
 	if err != nil {
-		log.Errorf("error marshalling RSA 2048-bit public key: %v", err)
+		log.Errorf("error marshalling %s public key: %v", keytype, err)
 		return []byte{}, []byte{}, err
 	}
 	return privkeyb, pubkeyb, err
@@ -236,6 +218,32 @@ func GenerateIPFSNodeKeyPair() ([]byte, []byte, error) {
 	return privkeyb, pubkeyb, err
 }
 
+// GenerateDeterministicKeyPair generates an Ed25519 keypair from a deterministic source of bytes, used for devnet
+// node identities and IPNS keys.
+func GenerateDeterministicKeyPair(r io.Reader) ([]byte, []byte, error) {
+	priv, pub, err := crypto.GenerateEd25519Key(r)
+	if err != nil {
+		log.Errorf("error generating Ed25519 keypair: %v", err)
+		return []byte{}, []byte{}, err
+	}
+	privkeyb, err := crypto.MarshalPrivateKey(priv)
+	if err != nil {
+		log.Errorf("error marshalling Ed25519 private key: %v", err)
+		return []byte{}, []byte{}, err
+	}
+	pubkeyb, err := crypto.MarshalPublicKey(pub)
+	if err != nil {
+		log.Errorf("error marshalling Ed25519 public key: %v", err)
+		return []byte{}, []byte{}, err
+	}
+	return privkeyb, pubkeyb, err
+}
+
+// DevnetNodeKeyPair returns the deterministic identity keypair of a devnet node.
+func DevnetNodeKeyPair(n int) ([]byte, []byte, error) {
+	return GenerateDeterministicKeyPair(devnet.Reader(fmt.Sprintf("patr-devnet/%v/ipfs", n)))
+}
+
 func GetIPFSNodeIdentity(pubb []byte) peer.ID {
 	pub, err := crypto.UnmarshalPublicKey(pubb)
 	if err != nil {
@@ -278,7 +286,25 @@ func GetIPNSPublicKeyName(pubb []byte) (string, error) {
 	return peer.ToCid(pid).StringOfBase(multibase.Base36)
 }
 
-func initIPFSRepo(ctx context.Context, privkey []byte, pubkey []byte) repo.Repo {
+// SwarmAddrFilters are the CIDR ranges in multiaddr format the IPFS node will not connect to or accept connections from.
+var SwarmAddrFilters = []string{}
+
+// RepoPath is the directory of the on-disk IPFS repo which keeps blocks, pins and the node's IPNS records across
+// restarts. If it is empty or the repo is locked by another process the node uses an in-memory repo.
+var RepoPath = ""
+
+// Offline starts the IPFS node without networking, so content can be created and the local DAG inspected without
+// connecting to bootstrap peers, the DHT or gateways. Publishing IPNS names and remote pins fail with ErrOffline, so
+// they stay in the outbox until the node runs online. Blocks put offline are queued in the outbox to be remote pinned.
+var Offline = false
+
+// ErrOffline is returned by operations which need the network when the IPFS node is offline.
+var ErrOffline = errors.New("the IPFS node is offline")
+
+var registerDatastores = sync.Once{}
+
+// ipfsConfig creates the IPFS node configuration from the node keys.
+func ipfsConfig(privkey []byte, pubkey []byte) cfg.Config {
 	pid := GetIPFSNodeIdentity(pubkey)
 	c := cfg.Config{}
 	c.Pubsub.Enabled = cfg.True
@@ -290,32 +316,188 @@ func initIPFSRepo(ctx context.Context, privkey []byte, pubkey []byte) repo.Repo
 		"/dnsaddr/bootstrap.libp2p.io/p2p/QmcZf59bWwK5XFi76CZX8cbJ4BhTzzA3gU1ZjYZcYW3dwt",
 		"/ip4/149.56.89.144/tcp/4001/p2p/12D3KooWDiybBBYDvEEJQmNEp1yJeTgVr6mMgxqDrm9Gi8AKeNww",
 	}
-	c.Addresses.Swarm = []string{"/ip4/127.0.0.1/tcp/4001", "/ip4/192.168.8.190/tcp/4001", "/ip4/127.0.0.1/udp/4001/quic"}
+	if Offline {
+		c.Bootstrap = []string{}
+	} else if devnet.Enabled {
+		// devnet nodes only listen on localhost and bootstrap from each other
+		c.Bootstrap = []string{}
+		for i := 0; i < devnet.Nodes; i++ {
+			if i == devnet.Node {
+				continue
+			}
+			_, pub, err := DevnetNodeKeyPair(i)
+			if err != nil {
+				continue
+			}
+			c.Bootstrap = append(c.Bootstrap, fmt.Sprintf("/ip4/127.0.0.1/tcp/%v/p2p/%s", devnet.SwarmPort(i), GetIPFSNodeIdentity(pub)))
+		}
+		c.Addresses.Swarm = []string{fmt.Sprintf("/ip4/127.0.0.1/tcp/%v", devnet.SwarmPort(devnet.Node))}
+		c.Discovery.MDNS.Enabled = false
+	} else {
+		c.Addresses.Swarm = Swarm.ListenAddrs()
+		c.Addresses.Announce = Swarm.AnnounceAddrs
+	}
+	c.Swarm.AddrFilters = SwarmAddrFilters
+	if !Offline {
+		c.Peering.Peers = peeringAddrInfos(PeeringPeers)
+	}
 	c.Identity.PeerID = pid.Pretty()
 	c.Identity.PrivKey = base64.StdEncoding.EncodeToString(privkey)
+	c.Datastore = cfg.DefaultDatastoreConfig()
+	return c
+}
 
+func memIPFSRepo(c cfg.Config) repo.Repo {
 	return &repo.Mock{
 		D: dsync.MutexWrap(ds.NewMapDatastore()),
 		C: c,
+		K: keystore.NewMemKeystore(),
+	}
+}
+
+// secretIPFSRepo is an on-disk IPFS repo whose node identity and keystore are kept in memory, so private keys are not
+// written in plaintext to the repo when datastore encryption is enabled. The keys are read from the encrypted node.json.
+type secretIPFSRepo struct {
+	repo.Repo
+	c cfg.Config
+	k keystore.Keystore
+}
+
+func (r *secretIPFSRepo) Config() (*cfg.Config, error) {
+	c := r.c
+	return &c, nil
+}
+
+// SetConfig persists a configuration without the private key of the node identity.
+func (r *secretIPFSRepo) SetConfig(c *cfg.Config) error {
+	disk := *c
+	disk.Identity.PrivKey = ""
+	if err := r.Repo.SetConfig(&disk); err != nil {
+		return err
+	}
+	r.c = *c
+	return nil
+}
+
+func (r *secretIPFSRepo) Keystore() keystore.Keystore {
+	return r.k
+}
+
+// removePlaintextKeys removes the private keys written to the keystore of the repo before datastore encryption was
+// enabled.
+func removePlaintextKeys() {
+	dir := filepath.Join(RepoPath, "keystore")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+			log.Errorf("could not remove plaintext key %s from IPFS keystore: %v", e.Name(), err)
+			continue
+		}
+		log.Infof("removed plaintext key %s from IPFS keystore at %s", e.Name(), dir)
 	}
 }
 
+// openIPFSRepo opens the on-disk IPFS repo at RepoPath, creating it if needed. The configuration of the repo is
+// replaced with the current one, so the node keys in node.json are migrated into the repo when it is created or when
+// they change, but the datastore of an existing repo is kept. When datastore encryption is enabled the node identity
+// and keystore are only kept in memory.
+func openIPFSRepo(c cfg.Config) (repo.Repo, error) {
+	registerDatastores.Do(func() {
+		for _, p := range append(flatfs.Plugins, levelds.Plugins...) {
+			d := p.(plugin.PluginDatastore)
+			if err := fsrepo.AddDatastoreConfigHandler(d.DatastoreTypeName(), d.DatastoreConfigParser()); err != nil {
+				log.Errorf("could not register IPFS datastore %s: %v", d.DatastoreTypeName(), err)
+			}
+		}
+	})
+	if !fsrepo.IsInitialized(RepoPath) {
+		log.Infof("creating IPFS repo at %s...", RepoPath)
+		if err := os.MkdirAll(RepoPath, 0700); err != nil {
+			return nil, err
+		}
+		disk := c
+		if util.DatastoreEncrypted() {
+			disk.Identity.PrivKey = ""
+		}
+		if err := fsrepo.Init(RepoPath, &disk); err != nil {
+			return nil, fmt.Errorf("could not create IPFS repo at %s: %v", RepoPath, err)
+		}
+	}
+	r, err := fsrepo.Open(RepoPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not open IPFS repo at %s: %v", RepoPath, err)
+	}
+	old, err := r.Config()
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	if old.Identity.PeerID != c.Identity.PeerID {
+		log.Infof("migrating IPFS node identity %s into repo at %s", c.Identity.PeerID, RepoPath)
+	}
+	c.Datastore = old.Datastore
+	if util.DatastoreEncrypted() {
+		removePlaintextKeys()
+		r = &secretIPFSRepo{Repo: r, k: keystore.NewMemKeystore()}
+	}
+	if err = r.SetConfig(&c); err != nil {
+		r.Close()
+		return nil, fmt.Errorf("could not update the configuration of IPFS repo at %s: %v", RepoPath, err)
+	}
+	return r, nil
+}
+
+// initIPFSRepo opens the on-disk IPFS repo or creates an in-memory repo if there is no repo path or the repo is in use
+// by another process, like a running node when a command is run.
+func initIPFSRepo(ctx context.Context, privkey []byte, pubkey []byte) repo.Repo {
+	c := ipfsConfig(privkey, pubkey)
+	if RepoPath == "" {
+		return memIPFSRepo(c)
+	}
+	if locked, err := fsrepo.LockedByOtherProcess(RepoPath); err == nil && locked {
+		log.Warnf("IPFS repo at %s is in use by another process, using an in-memory repo", RepoPath)
+		return memIPFSRepo(c)
+	}
+	r, err := openIPFSRepo(c)
+	if err != nil {
+		log.Errorf("%v, using an in-memory repo", err)
+		return memIPFSRepo(c)
+	}
+	return r
+}
+
 func StartIPFSNode(ctx context.Context, privkey []byte, pubkey []byte) (*IPFSCore, error) {
 	log.Infof("starting IPFS node %s...", GetIPFSNodeIdentity(pubkey).Pretty())
-	node, err := ipfsCore.NewNode(ctx, &ipfsCore.BuildCfg{
+	r := initIPFSRepo(ctx, privkey, pubkey)
+	bcfg := &ipfsCore.BuildCfg{
 		Online:  true,
 		Routing: libp2p.DHTOption,
-		Repo:    initIPFSRepo(ctx, privkey, pubkey),
+		Repo:    r,
 		ExtraOpts: map[string]bool{
 			"pubsub": true,
 		},
-	})
+	}
+	if Offline {
+		bcfg = &ipfsCore.BuildCfg{Online: false, Repo: r}
+	}
+	node, err := ipfsCore.NewNode(ctx, bcfg)
 	if err != nil {
 		log.Errorf("error staring IPFS node %s: %v", GetIPFSNodeIdentity(pubkey).Pretty(), err)
+		r.Close()
 		return nil, err
 	}
 	pubk, _ := GetIPNSPublicKeyName(pubkey)
-	log.Infof("IPFS node %s (%v) started", node.Identity.Pretty(), pubk)
+	if Offline {
+		log.Infof("IPFS node %s (%v) started offline", node.Identity.Pretty(), pubk)
+	} else {
+		log.Infof("IPFS node %s (%v) started", node.Identity.Pretty(), pubk)
+	}
 	c, e := coreapi.NewCoreAPI(node)
 	if e != nil {
 		return nil, e
@@ -339,25 +521,37 @@ func StartIPFSNode(ctx context.Context, privkey []byte, pubkey []byte) (*IPFSCor
 		core.W3S = c
 
 		lsys := cidlink.DefaultLinkSystem()
-		lsys.SetReadStorage(&core)
-		lsys.SetWriteStorage(&core)
+		lsys.StorageReadOpener = core.OpenRead
+		lsys.StorageWriteOpener = core.OpenWrite
 		core.LS = lsys
 
-		_, err = core.Api.PubSub().Subscribe(ctx, "patr")
-		core.Api.PubSub().Publish(ctx, "patr", []byte{byte(1)})
+		if !Offline {
+			_, err = core.Api.PubSub().Subscribe(ctx, "patr")
+			core.Api.PubSub().Publish(ctx, "patr", []byte{byte(1)})
+		}
 		return &core, e
 	}
 }
 
+// PublishIPNSRecordForDAGNode publishes a DAG node to the IPNS name of a keypair. The keypair is imported into the IPFS
+// node keystore under the key name so the name does not depend on the node identity and is republished by the node. The
+// key name self publishes to the IPNS name of the node.
 func PublishIPNSRecordForDAGNode(ctx context.Context, ipfscore IPFSCore, authtoken string, cid cid.Cid, keyname string, privkey []byte, pubkey []byte) error {
+	if Offline {
+		return ErrOffline
+	}
+	if keyname != "" && keyname != "self" {
+		if err := ImportNamedKeys(ipfscore, map[string]NamedKey{keyname: {PrivKey: privkey, PubKey: pubkey}}); err != nil {
+			return err
+		}
+		return PublishNamedKey(ctx, ipfscore, keyname, ipfspath.IpfsPath(cid).String())
+	}
 	p := ipfspath.IpldPath(cid)
-	//_, err := ipfscore.Node.Repo.Keystore().
-	//if err != nil {
-	//	return fmt.Errorf("could not get key %s from IPFS node keystore: %v", keyname, err)
-	//}
-	r, err := ipfscore.Api.Name().Publish(ctx, p)
+	ctx, cancel := util.WithTimeout(ctx, IPNSPublishTimeout)
+	defer cancel()
+	r, err := ipfscore.Api.Name().Publish(ctx, p, options.Name.ValidTime(IPNSValidTime))
 	if err != nil {
-		return fmt.Errorf("error publishing IPNS record for %v using IPFS node key %s: %v", p, keyname, err)
+		return fmt.Errorf("error publishing IPNS record for %v using IPFS node key: %v", p, err)
 	} else {
 		log.Infof("created IPNS record on DHT for path %v", r.Value())
 		return err
@@ -379,7 +573,11 @@ func PinIPFSBlockToW3S(ctx context.Context, ipfs iface.CoreAPI, authToken string
 	for i := range l {
 		us[i] = w3s.WithPinOrigin(l[i].String())
 	}
-	r, err := c.Pin(ctx, block.Cid(), us[0])
+	var r *w3s.PinResponse
+	err = util.Retry(ctx, "w3s", "pinning block to Web3.Storage", func(ctx context.Context) error {
+		r, err = c.Pin(ctx, block.Cid(), us[0])
+		return err
+	})
 	if err != nil {
 		return err
 	} else {
@@ -389,6 +587,9 @@ func PinIPFSBlockToW3S(ctx context.Context, ipfs iface.CoreAPI, authToken string
 }
 
 func PinIPLDBlockToW3S(ctx context.Context, ipfsNode iface.CoreAPI, authToken string, block *blocks.BasicBlock) (cid.Cid, error) {
+	if Offline {
+		return cid.Undef, ErrOffline
+	}
 	log.Infof("pinning IPLD block %v using Web3.Storage pinning service...", block.Cid())
 	c, err := w3s.NewClient(w3s.WithToken(authToken))
 	if err != nil {
@@ -401,7 +602,11 @@ func PinIPLDBlockToW3S(ctx context.Context, ipfsNode iface.CoreAPI, authToken st
 		log.Errorf("could not serialize block %v as CAR: %v", block.Cid(), err)
 		return cid.Cid{}, err
 	}
-	pcid, err := c.PutCar(ctx, &buf)
+	var pcid cid.Cid
+	err = util.Retry(ctx, "w3s", "uploading CAR to Web3.Storage", func(ctx context.Context) error {
+		pcid, err = c.PutCar(ctx, bytes.NewReader(buf.Bytes()))
+		return err
+	})
 	if err != nil {
 		log.Errorf("could not put block %v as CAR to W3S: %v", block.Cid(), err)
 		return cid.Cid{}, err
@@ -417,7 +622,11 @@ func GetIPNSRecordFromW3S(ctx context.Context, authToken string, name string) (c
 		log.Errorf("could not create W3S client: %v", err)
 		return cid.Cid{}, err
 	}
-	r, err := c.GetName(ctx, name)
+	var r *ipns_pb.IpnsEntry
+	err = util.Retry(ctx, "w3s", "looking up name on Web3.Storage", func(ctx context.Context) error {
+		r, err = c.GetName(ctx, name)
+		return err
+	})
 	if err != nil {
 		log.Errorf("could not lookup name %s on Web3.Storage: %v", name, err)
 	}
@@ -432,6 +641,9 @@ func GetIPNSRecordFromW3S(ctx context.Context, authToken string, name string) (c
 }
 
 func PublishIPNSRecordForDAGNodeToW3S(ctx context.Context, authToken string, cid cid.Cid, privkey []byte, pubkey []byte) error {
+	if Offline {
+		return ErrOffline
+	}
 	name, err := GetIPNSPublicKeyName(pubkey)
 	if err != nil {
 		return err
@@ -455,7 +667,7 @@ func PublishIPNSRecordForDAGNodeToW3S(ctx context.Context, authToken string, cid
 		seq = r.GetSequence() + 1
 	}
 
-	nr, err := ipns.Create(sk, []byte(p), seq, time.Now().Add(time.Hour*48), 0)
+	nr, err := ipns.Create(sk, []byte(p), seq, time.Now().Add(IPNSValidTime), IPNSTTL)
 	if err != nil {
 		log.Errorf("could not create new IPNS record for path %v: %v", p, err)
 		return err
@@ -470,7 +682,9 @@ func PublishIPNSRecordForDAGNodeToW3S(ctx context.Context, authToken string, cid
 		return err
 	}
 
-	err = c.PutName(ctx, nr, name)
+	err = util.Retry(ctx, "w3s", "publishing name to Web3.Storage", func(ctx context.Context) error {
+		return c.PutName(ctx, nr, name)
+	})
 	if err == nil {
 		log.Infof("published DAG node %v at path %s to IPNS name %s using Web3.Storage", cid, p, name)
 	} else {
@@ -479,15 +693,19 @@ func PublishIPNSRecordForDAGNodeToW3S(ctx context.Context, authToken string, cid
 	return err
 }
 
-func PutNostrEventAsIPLDLink(ctx context.Context, ipfs IPFSCore, evt nostr.Event) (datamodel.Link, error) {
+func NostrEventToIPLDNode(evt nostr.Event) (datamodel.Node, error) {
 	dagnode, err := qp.BuildMap(basicnode.Prototype.Any, 4, func(ma datamodel.MapAssembler) {
 		qp.MapEntry(ma, "id", qp.String(evt.ID))
 		qp.MapEntry(ma, "pubkey", qp.String(evt.PubKey))
 		qp.MapEntry(ma, "created_at", qp.String(evt.CreatedAt.Time().String()))
 		qp.MapEntry(ma, "kind", qp.Int(int64(evt.Kind)))
-		qp.MapEntry(ma, "tags", qp.Map(int64(len(evt.Tags)), func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "tags", qp.List(int64(len(evt.Tags)), func(la datamodel.ListAssembler) {
 			for _, t := range evt.Tags {
-				qp.MapEntry(ma, t.Key(), qp.String(t.Value()))
+				qp.ListEntry(la, qp.List(int64(len(t)), func(la datamodel.ListAssembler) {
+					for _, v := range t {
+						qp.ListEntry(la, qp.String(v))
+					}
+				}))
 			}
 		}))
 		qp.MapEntry(ma, "content", qp.String(evt.Content))
@@ -496,13 +714,177 @@ func PutNostrEventAsIPLDLink(ctx context.Context, ipfs IPFSCore, evt nostr.Event
 	if err != nil {
 		return nil, fmt.Errorf("could not create IPLD node from Nostr event %s: %v", evt.ID, err)
 	}
+	return dagnode, nil
+}
+
+// IPLDNodeToNostrEvent converts an event node created by NostrEventToIPLDNode back to a Nostr event.
+func IPLDNodeToNostrEvent(n datamodel.Node) (nostr.Event, error) {
+	str := func(key string) string {
+		v, err := n.LookupByString(key)
+		if err != nil {
+			return ""
+		}
+		s, _ := v.AsString()
+		return s
+	}
+	evt := nostr.Event{
+		ID:      str("id"),
+		PubKey:  str("pubkey"),
+		Content: str("content"),
+		Sig:     str("sig"),
+		Tags:    nostr.Tags{},
+	}
+	created, err := time.Parse("2006-01-02 15:04:05 -0700 MST", str("created_at"))
+	if err != nil {
+		return nostr.Event{}, fmt.Errorf("invalid event timestamp: %v", err)
+	}
+	evt.CreatedAt = nostr.Timestamp(created.Unix())
+	kn, err := n.LookupByString("kind")
+	if err != nil {
+		return nostr.Event{}, fmt.Errorf("event %s does not have a kind", evt.ID)
+	}
+	kind, err := kn.AsInt()
+	if err != nil {
+		return nostr.Event{}, fmt.Errorf("invalid kind for event %s: %v", evt.ID, err)
+	}
+	evt.Kind = int(kind)
+	tn, err := n.LookupByString("tags")
+	if err != nil {
+		return evt, nil
+	}
+	for it := tn.ListIterator(); it != nil && !it.Done(); {
+		_, tv, err := it.Next()
+		if err != nil {
+			return nostr.Event{}, err
+		}
+		tag := nostr.Tag{}
+		for vit := tv.ListIterator(); vit != nil && !vit.Done(); {
+			_, v, err := vit.Next()
+			if err != nil {
+				return nostr.Event{}, err
+			}
+			s, _ := v.AsString()
+			tag = append(tag, s)
+		}
+		evt.Tags = append(evt.Tags, tag)
+	}
+	return evt, nil
+}
+
+// PutIPLDNode encodes an IPLD node with the default codec and pins the block to the local IPFS node.
+func PutIPLDNode(ctx context.Context, ipfscore IPFSCore, dagnode datamodel.Node) (*blocks.BasicBlock, error) {
+	blk, err := EncodeIPLDNode(dagnode, DefaultCodec)
+	if err != nil {
+		return nil, err
+	}
+	c := blk.Cid()
+	if util.DryRun {
+		log.Infof("dry run: would pin block %v to the local IPFS node", c)
+		return blk, nil
+	}
+	ctx, cancel := util.WithTimeout(ctx, PinTimeout)
+	defer cancel()
+	if err = ipfscore.Api.Dag().Pinning().Add(ctx, &ipldlegacy.LegacyNode{Block: blk, Node: dagnode}); err != nil {
+		log.Errorf("error pinning IPFS block %v: %v", c, err)
+		return nil, err
+	}
+	return blk, nil
+}
+
+// PutNostrEventAsIPLDLink stores a Nostr event as an IPLD node encoded with a codec and returns the link to it.
+func PutNostrEventAsIPLDLink(ctx context.Context, ipfs IPFSCore, evt nostr.Event, codec string) (datamodel.Link, error) {
+	dagnode, err := NostrEventToIPLDNode(evt)
+	if err != nil {
+		return nil, err
+	}
+	p, err := CodecPrefix(codec)
+	if err != nil {
+		return nil, err
+	}
+	return ipfs.LS.Store(linking.LinkContext{Ctx: ctx}, cidlink.LinkPrototype{Prefix: p}, dagnode)
+}
+
+// PutBlock verifies that data hashes to the given CID and stores it directly in the local blockstore, pinning it non-recursively.
+func PutBlock(ctx context.Context, ipfscore IPFSCore, c cid.Cid, data []byte) error {
+	vc, err := c.Prefix().Sum(data)
+	if err != nil {
+		return fmt.Errorf("could not hash block data for %v: %v", c, err)
+	}
+	if !vc.Equals(c) {
+		return fmt.Errorf("block data does not match CID %v", c)
+	}
+	blk, err := blocks.NewBlockWithCid(data, c)
+	if err != nil {
+		return err
+	}
+	if err = ipfscore.Node.Blockstore.Put(ctx, blk); err != nil {
+		log.Errorf("could not put block %v to local blockstore: %v", c, err)
+		return err
+	}
+	ctx, cancel := util.WithTimeout(ctx, PinTimeout)
+	defer cancel()
+	if err = ipfscore.Api.Pin().Add(ctx, ipfspath.IpldPath(c), options.Pin.Recursive(false)); err != nil {
+		log.Errorf("could not pin block %v: %v", c, err)
+		return err
+	}
+	return nil
+}
+
+// GetBlock returns the raw data of a block in the local blockstore.
+func GetBlock(ctx context.Context, ipfscore IPFSCore, c cid.Cid) ([]byte, error) {
+	blk, err := ipfscore.Node.Blockstore.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return blk.RawData(), nil
+}
+
+// AddFile adds file data to IPFS as UnixFS and returns its CID.
+func AddFile(ctx context.Context, ipfscore IPFSCore, data []byte) (cid.Cid, error) {
+	p, err := ipfscore.Api.Unixfs().Add(ctx, files.NewBytesFile(data), options.Unixfs.HashOnly(util.DryRun))
+	if err != nil {
+		log.Errorf("could not add file to IPFS: %v", err)
+		return cid.Undef, err
+	}
+	if util.DryRun {
+		log.Infof("dry run: would add file %v to the local IPFS node", p.Cid())
+	}
+	return p.Cid(), nil
+}
+
+// UnpinBlock removes the pin for a block from the local IPFS node so it can be garbage collected.
+func UnpinBlock(ctx context.Context, ipfscore IPFSCore, c cid.Cid) error {
+	if err := ipfscore.Api.Pin().Rm(ctx, ipfspath.IpldPath(c), options.Pin.RmRecursive(false)); err != nil {
+		log.Errorf("could not unpin block %v: %v", c, err)
+		return err
+	}
+	return nil
+}
+
+// PinDAG fetches the DAG with a root CID and pins it recursively on the local IPFS node. Fetching a large DAG can take
+// a long time so PinTimeout doesn't apply.
+func PinDAG(ctx context.Context, ipfscore IPFSCore, c cid.Cid) error {
+	if util.DryRun {
+		log.Infof("dry run: would pin DAG %v", c)
+		return nil
+	}
+	if err := ipfscore.Api.Pin().Add(ctx, ipfspath.IpldPath(c), options.Pin.Recursive(true)); err != nil {
+		log.Errorf("could not pin DAG %v: %v", c, err)
+		return err
+	}
+	return nil
+}
+
+// UnpinDAG removes the recursive pin of a DAG from the local IPFS node so it can be garbage collected.
+func UnpinDAG(ctx context.Context, ipfscore IPFSCore, c cid.Cid) error {
+	if err := ipfscore.Api.Pin().Rm(ctx, ipfspath.IpldPath(c), options.Pin.RmRecursive(true)); err != nil {
+		log.Errorf("could not unpin DAG %v: %v", c, err)
+		return err
+	}
+	return nil
+}
 
-	lp := cidlink.LinkPrototype{
-		Prefix: cid.Prefix{
-			Version:  1,           // Usually '1'.
-			Codec:    cid.DagJSON, // 0x71 means "dag-cbor" -- See the multicodecs table: https://github.com/multiformats/multicodec/
-			MhType:   mh.SHA3_384, // 0x20 means "sha2-512" -- See the multicodecs table: https://github.com/multiformats/multicodec/
-			MhLength: 48,          // sha2-512 hash has a 64-byte sum.
-		}}
-	return ipfs.LS.Store(linking.LinkContext{}, lp, dagnode)
+// Online returns true if the IPFS node is connected to any peers.
+func Online(ipfscore IPFSCore) bool {
+	return len(ipfscore.Node.PeerHost.Network().Peers()) > 0
 }
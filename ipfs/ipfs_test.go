@@ -0,0 +1,132 @@
+package ipfs_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	"github.com/ipld/go-ipld-prime/linking"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+
+	"github.com/allisterb/patr/internal/ipfstest"
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/outbox"
+	"github.com/allisterb/patr/util"
+)
+
+// testNode builds an IPLD node whose map keys are in the canonical order of both DAG-JSON and DAG-CBOR, so a loaded node
+// is deeply equal to it.
+func testNode(t *testing.T) datamodel.Node {
+	t.Helper()
+	n, err := qp.BuildMap(basicnode.Prototype.Any, 3, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "id", qp.Int(42))
+		qp.MapEntry(ma, "tag", qp.List(2, func(la datamodel.ListAssembler) {
+			qp.ListEntry(la, qp.String("a"))
+			qp.ListEntry(la, qp.String("b"))
+		}))
+		qp.MapEntry(ma, "type", qp.String("test"))
+	})
+	if err != nil {
+		t.Fatalf("could not build IPLD node: %v", err)
+	}
+	return n
+}
+
+func TestLinkSystemRoundTrip(t *testing.T) {
+	core := ipfstest.StartOfflineNode(t)
+	ctx := core.Ctx
+	for _, codec := range []string{ipfs.CodecDagJSON, ipfs.CodecDagCBOR} {
+		t.Run(codec, func(t *testing.T) {
+			p, err := ipfs.CodecPrefix(codec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n := testNode(t)
+			lnk, err := core.LS.Store(linking.LinkContext{Ctx: ctx}, cidlink.LinkPrototype{Prefix: p}, n)
+			if err != nil {
+				t.Fatalf("could not store %s node: %v", codec, err)
+			}
+			if c := lnk.(cidlink.Link).Cid; c.Prefix() != p {
+				t.Errorf("stored %s node has CID prefix %v, expected %v", codec, c.Prefix(), p)
+			}
+			if has, err := core.Has(ctx, lnk.Binary()); err != nil || !has {
+				t.Fatalf("block of stored %s node is not in the blockstore: %v", codec, err)
+			}
+			loaded, err := core.LS.Load(linking.LinkContext{Ctx: ctx}, lnk, basicnode.Prototype.Any)
+			if err != nil {
+				t.Fatalf("could not load %s node: %v", codec, err)
+			}
+			if !datamodel.DeepEqual(n, loaded) {
+				t.Errorf("loaded %s node differs from the stored node", codec)
+			}
+		})
+	}
+}
+
+func TestOfflinePutQueuesRemotePin(t *testing.T) {
+	core := ipfstest.StartOfflineNode(t)
+	service := ipfs.PinningService
+	ipfs.PinningService = ipfs.PinningServiceConfig{Provider: ipfs.PinningPSA, Endpoint: "http://127.0.0.1:1", Token: "test"}
+	t.Cleanup(func() { ipfs.PinningService = service })
+	p, err := ipfs.CodecPrefix(ipfs.DefaultCodec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lnk, err := core.LS.Store(linking.LinkContext{Ctx: core.Ctx}, cidlink.LinkPrototype{Prefix: p}, testNode(t))
+	if err != nil {
+		t.Fatalf("could not store node on offline IPFS node: %v", err)
+	}
+	c := lnk.(cidlink.Link).Cid
+	pending, err := outbox.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range pending {
+		if e.Kind == outbox.KindW3SUpload && e.Payload["cid"] == c.String() {
+			return
+		}
+	}
+	t.Errorf("remote pin of %v put offline is not queued in the outbox", c)
+}
+
+func TestEncryptedRepoKeepsKeysInMemory(t *testing.T) {
+	offline, repoPath, appData := ipfs.Offline, ipfs.RepoPath, util.AppData
+	ipfs.Offline, util.AppData = true, t.TempDir()
+	ipfs.RepoPath = filepath.Join(util.AppData, "ipfs")
+	t.Cleanup(func() { ipfs.Offline, ipfs.RepoPath, util.AppData = offline, repoPath, appData })
+	if err := util.EnableDatastoreEncryption("test"); err != nil {
+		t.Fatalf("could not enable datastore encryption: %v", err)
+	}
+	t.Cleanup(func() { util.DisableDatastoreEncryption() })
+	core := ipfstest.StartNode(t)
+	k, err := ipfs.GenerateNamedKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ipfs.ImportNamedKeys(*core, map[string]ipfs.NamedKey{"test": k}); err != nil {
+		t.Fatalf("could not import named key: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(ipfs.RepoPath, "config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := struct {
+		Identity struct{ PeerID, PrivKey string }
+	}{}
+	if err = json.Unmarshal(data, &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Identity.PeerID != core.Node.Identity.String() {
+		t.Errorf("the IPFS repo config has identity %s, expected %v", config.Identity.PeerID, core.Node.Identity)
+	}
+	if config.Identity.PrivKey != "" {
+		t.Error("the private key of the IPFS node is in plaintext in the repo config")
+	}
+	if entries, _ := os.ReadDir(filepath.Join(ipfs.RepoPath, "keystore")); len(entries) > 0 {
+		t.Errorf("the IPFS repo keystore has %v plaintext keys", len(entries))
+	}
+}
@@ -0,0 +1,173 @@
+package ipfs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	ipns "github.com/ipfs/boxo/ipns"
+	ipns_pb "github.com/ipfs/boxo/ipns/pb"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"github.com/allisterb/patr/util"
+)
+
+// IPNSRecordCacheTTL is how long a validated IPNS record resolves its name without looking it up again and is served to
+// peers.
+var IPNSRecordCacheTTL = 10 * time.Minute
+
+// MaxIPNSRecords is the number of validated IPNS records cached.
+const MaxIPNSRecords = 1024
+
+// PeerIPNSResolver asks connected peers for the signed IPNS records of a name they have validated. It is set by the p2p
+// package.
+var PeerIPNSResolver func(ctx context.Context, pid peer.ID) [][]byte
+
+type ipnsRecord struct {
+	entry     *ipns_pb.IpnsEntry
+	data      []byte
+	validated time.Time
+}
+
+var ipnsRecordsLock = sync.Mutex{}
+var ipnsRecords = map[peer.ID]ipnsRecord{}
+
+// IPNSNamePeerID returns the peer ID of the key of an IPNS name.
+func IPNSNamePeerID(name string) (peer.ID, error) {
+	return peer.Decode(strings.TrimPrefix(name, "/ipns/"))
+}
+
+// ValidateIPNSRecord checks that an IPNS record is signed by the key of a name and has not expired. Records of names of
+// any libp2p key type are accepted: Ed25519 keys are inlined in the name and RSA keys are embedded in the record.
+func ValidateIPNSRecord(pid peer.ID, data []byte) (*ipns_pb.IpnsEntry, error) {
+	if err := (ipns.Validator{}).Validate(ipns.RecordKey(pid), data); err != nil {
+		return nil, err
+	}
+	entry := new(ipns_pb.IpnsEntry)
+	if err := proto.Unmarshal(data, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// cacheIPNSRecord caches a validated record unless a newer record of the name is cached already, and returns the newest
+// record of the name.
+func cacheIPNSRecord(pid peer.ID, r ipnsRecord) ipnsRecord {
+	ipnsRecordsLock.Lock()
+	defer ipnsRecordsLock.Unlock()
+	if c, ok := ipnsRecords[pid]; ok {
+		if cmp, err := ipns.Compare(r.entry, c.entry); err != nil || cmp < 0 {
+			return c
+		}
+	} else if len(ipnsRecords) >= MaxIPNSRecords {
+		var oldest peer.ID
+		for p, c := range ipnsRecords {
+			if oldest == "" || c.validated.Before(ipnsRecords[oldest].validated) {
+				oldest = p
+			}
+		}
+		delete(ipnsRecords, oldest)
+	}
+	ipnsRecords[pid] = r
+	return r
+}
+
+// cachedIPNSRecord returns the cached record of a name if it was validated within IPNSRecordCacheTTL and has not expired.
+func cachedIPNSRecord(pid peer.ID) (ipnsRecord, bool) {
+	ipnsRecordsLock.Lock()
+	defer ipnsRecordsLock.Unlock()
+	r, ok := ipnsRecords[pid]
+	if !ok || util.Now().Sub(r.validated) > IPNSRecordCacheTTL {
+		return ipnsRecord{}, false
+	}
+	if eol, err := ipns.GetEOL(r.entry); err != nil || util.Now().After(eol) {
+		delete(ipnsRecords, pid)
+		return ipnsRecord{}, false
+	}
+	return r, true
+}
+
+// CachedIPNSRecord returns the signed record of a name recently validated by the node, which can be passed on to peers.
+func CachedIPNSRecord(pid peer.ID) ([]byte, bool) {
+	r, ok := cachedIPNSRecord(pid)
+	return r.data, ok
+}
+
+// lookupIPNSRecord gets the record of a name from the routing system and caches it.
+func lookupIPNSRecord(ctx context.Context, ipfscore IPFSCore, pid peer.ID) (ipnsRecord, error) {
+	data, err := ipfscore.Node.Routing.GetValue(ctx, ipns.RecordKey(pid))
+	if err != nil {
+		return ipnsRecord{}, err
+	}
+	entry, err := ValidateIPNSRecord(pid, data)
+	if err != nil {
+		return ipnsRecord{}, fmt.Errorf("invalid IPNS record for %v from routing: %v", pid, err)
+	}
+	return cacheIPNSRecord(pid, ipnsRecord{entry: entry, data: data, validated: util.Now()}), nil
+}
+
+// peerIPNSRecord returns the newest valid record of a name peers sent which is not older than the cached record.
+func peerIPNSRecord(ctx context.Context, pid peer.ID) (ipnsRecord, error) {
+	var best *ipnsRecord
+	for _, data := range PeerIPNSResolver(ctx, pid) {
+		entry, err := ValidateIPNSRecord(pid, data)
+		if err != nil {
+			log.Debugf("ignoring invalid IPNS record for %v from peer: %v", pid, err)
+			continue
+		}
+		if best != nil {
+			if cmp, err := ipns.Compare(entry, best.entry); err != nil || cmp <= 0 {
+				continue
+			}
+		}
+		best = &ipnsRecord{entry: entry, data: data, validated: util.Now()}
+	}
+	if best == nil {
+		return ipnsRecord{}, fmt.Errorf("no peer sent a valid IPNS record for %v", pid)
+	}
+	return cacheIPNSRecord(pid, *best), nil
+}
+
+// resolveIPNSRecord returns a validated record of a name from the cache, or from whichever of the routing system and
+// the connected peers answers first. The routing lookup continues after a peer answers so the cache doesn't keep an old
+// record a peer sent.
+func resolveIPNSRecord(ctx context.Context, ipfscore IPFSCore, pid peer.ID) (ipnsRecord, error) {
+	if r, ok := cachedIPNSRecord(pid); ok {
+		return r, nil
+	}
+	type result struct {
+		r   ipnsRecord
+		err error
+	}
+	results := make(chan result, 2)
+	pending := 1
+	go func() {
+		ctx, cancel := util.WithTimeout(ipfscore.Ctx, IPNSResolveTimeout)
+		defer cancel()
+		r, err := lookupIPNSRecord(ctx, ipfscore, pid)
+		results <- result{r, err}
+	}()
+	if PeerIPNSResolver != nil {
+		pending++
+		go func() {
+			r, err := peerIPNSRecord(ctx, pid)
+			results <- result{r, err}
+		}()
+	}
+	var err error
+	for ; pending > 0; pending-- {
+		select {
+		case <-ctx.Done():
+			return ipnsRecord{}, ctx.Err()
+		case res := <-results:
+			if res.err == nil {
+				return res.r, nil
+			}
+			err = res.err
+		}
+	}
+	return ipnsRecord{}, err
+}
@@ -0,0 +1,214 @@
+package ipfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ipfs/boxo/coreiface/options"
+	ipfspath "github.com/ipfs/boxo/coreiface/path"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	pb "github.com/libp2p/go-libp2p/core/crypto/pb"
+
+	"github.com/allisterb/patr/devnet"
+	"github.com/allisterb/patr/util"
+)
+
+// NamedKey is an IPNS keypair used for one of the user's IPNS names e.g. profile, feed, media or site. A key converted
+// from RSA keeps the RSA private key in PreviousKey and publishes to both names until DualPublishUntil.
+type NamedKey struct {
+	PrivKey          []byte
+	PubKey           []byte
+	Created          time.Time
+	Previous         []string
+	Value            string
+	PreviousKey      []byte    `json:",omitempty"`
+	DualPublishUntil time.Time `json:",omitempty"`
+}
+
+// Key types of IPNS names. Ed25519 public keys are inlined in the IPNS name so records don't need to embed them.
+const (
+	KeyTypeEd25519 = "ed25519"
+	KeyTypeRSA     = "rsa"
+)
+
+// IPNSKeyType is the type of the keys generated for new IPNS names.
+var IPNSKeyType = KeyTypeEd25519
+
+// IPNSDualPublishWindow is how long a name converted from RSA to Ed25519 is published to its RSA name as well, so
+// followers who only know the RSA name can find the new one.
+var IPNSDualPublishWindow = 30 * 24 * time.Hour
+
+var DefaultKeyNames = []string{"profile", "feed", "media", "site"}
+
+// IPNSValidTime and IPNSTTL are the lifetime and cache TTL of published IPNS records. They are much shorter on the devnet.
+var IPNSValidTime = 48 * time.Hour
+var IPNSTTL = time.Duration(0)
+
+// GenerateNamedKey generates a key of type IPNSKeyType for an IPNS name.
+func GenerateNamedKey() (NamedKey, error) {
+	return GenerateNamedKeyOfType(IPNSKeyType)
+}
+
+// GenerateNamedKeyOfType generates a key of a key type for an IPNS name.
+func GenerateNamedKeyOfType(keytype string) (NamedKey, error) {
+	priv, pub, err := GenerateIPNSKeyPair(keytype)
+	if err != nil {
+		return NamedKey{}, err
+	}
+	return NamedKey{PrivKey: priv, PubKey: pub, Created: util.Now()}, nil
+}
+
+// Name returns the IPNS name of the key.
+func (k NamedKey) Name() string {
+	n, _ := GetIPNSPublicKeyName(k.PubKey)
+	return n
+}
+
+// KeyType returns the type of the key, ed25519 or rsa, or the libp2p name of other key types.
+func (k NamedKey) KeyType() string {
+	pk, err := crypto.UnmarshalPublicKey(k.PubKey)
+	if err != nil {
+		return ""
+	}
+	switch pk.Type() {
+	case pb.KeyType_Ed25519:
+		return KeyTypeEd25519
+	case pb.KeyType_RSA:
+		return KeyTypeRSA
+	default:
+		return strings.ToLower(pk.Type().String())
+	}
+}
+
+// Transitioning returns true if the key was converted from RSA and is still published to its RSA name.
+func (k NamedKey) Transitioning() bool {
+	return len(k.PreviousKey) > 0 && util.Now().Before(k.DualPublishUntil)
+}
+
+// PreviousNamedKey returns the RSA key a converted key replaced.
+func (k NamedKey) PreviousNamedKey() (NamedKey, error) {
+	if len(k.PreviousKey) == 0 {
+		return NamedKey{}, fmt.Errorf("the key for IPNS name %s was not converted from another key", k.Name())
+	}
+	sk, err := crypto.UnmarshalPrivateKey(k.PreviousKey)
+	if err != nil {
+		log.Errorf("could not unmarshal previous private key of IPNS name %s: %v", k.Name(), err)
+		return NamedKey{}, err
+	}
+	pub, err := crypto.MarshalPublicKey(sk.GetPublic())
+	if err != nil {
+		return NamedKey{}, err
+	}
+	return NamedKey{PrivKey: k.PreviousKey, PubKey: pub, Value: k.Value}, nil
+}
+
+// ConvertNamedKey replaces an RSA key with an Ed25519 key. The old IPNS name is kept in the key history and the RSA key
+// is kept so the value of the name is published to both names for IPNSDualPublishWindow, after which the RSA name points
+// to the new name.
+func ConvertNamedKey(k NamedKey) (NamedKey, error) {
+	if t := k.KeyType(); t != KeyTypeRSA {
+		return NamedKey{}, fmt.Errorf("the key for IPNS name %s is not an RSA key but %s", k.Name(), t)
+	}
+	nk, err := GenerateNamedKeyOfType(KeyTypeEd25519)
+	if err != nil {
+		return NamedKey{}, err
+	}
+	nk.Previous = append(append([]string{}, k.Previous...), k.Name())
+	nk.Value = k.Value
+	nk.PreviousKey = k.PrivKey
+	nk.DualPublishUntil = util.Now().Add(IPNSDualPublishWindow)
+	return nk, nil
+}
+
+// RotateNamedKey generates a new keypair for a name, keeping the old IPNS name in the key history.
+func RotateNamedKey(k NamedKey) (NamedKey, error) {
+	nk, err := GenerateNamedKey()
+	if err != nil {
+		return NamedKey{}, err
+	}
+	nk.Previous = append(append([]string{}, k.Previous...), k.Name())
+	nk.Value = k.Value
+	return nk, nil
+}
+
+// ImportNamedKeys adds the user's named keys to the IPFS node keystore so they can be published and are republished by the node.
+func ImportNamedKeys(ipfscore IPFSCore, keys map[string]NamedKey) error {
+	ks := ipfscore.Node.Repo.Keystore()
+	if ks == nil {
+		return fmt.Errorf("the IPFS node does not have a keystore")
+	}
+	for name, k := range keys {
+		sk, err := crypto.UnmarshalPrivateKey(k.PrivKey)
+		if err != nil {
+			log.Errorf("could not unmarshal private key for IPNS name %s: %v", name, err)
+			return err
+		}
+		if k.PubKey != nil {
+			if pk, err := crypto.MarshalPublicKey(sk.GetPublic()); err != nil || !bytes.Equal(pk, k.PubKey) {
+				return fmt.Errorf("the private key for IPNS name %s does not match its public key", name)
+			}
+		}
+		if has, _ := ks.Has(name); has {
+			if existing, err := ks.Get(name); err == nil && existing.Equals(sk) {
+				continue
+			}
+			if err = ks.Delete(name); err != nil {
+				log.Errorf("could not delete existing key %s from IPFS keystore: %v", name, err)
+				return err
+			}
+		}
+		if err = ks.Put(name, sk); err != nil {
+			log.Errorf("could not import key %s into IPFS keystore: %v", name, err)
+			return err
+		}
+		log.Infof("imported key %s for IPNS name %s into IPFS keystore", name, k.Name())
+	}
+	return nil
+}
+
+// PublishNamedKey publishes an IPFS path to the IPNS name of a key in the IPFS node keystore.
+func PublishNamedKey(ctx context.Context, ipfscore IPFSCore, keyname string, p string) error {
+	if Offline {
+		return ErrOffline
+	}
+	log.Infof("publishing path %s to IPNS name %s...", p, keyname)
+	opts := []options.NamePublishOption{options.Name.Key(keyname), options.Name.ValidTime(IPNSValidTime)}
+	if IPNSTTL > 0 {
+		opts = append(opts, options.Name.TTL(IPNSTTL))
+	}
+	ctx, cancel := util.WithTimeout(ctx, IPNSPublishTimeout)
+	defer cancel()
+	r, err := ipfscore.Api.Name().Publish(ctx, ipfspath.New(p), opts...)
+	if err != nil {
+		log.Errorf("error publishing path %s to IPNS name %s: %v", p, keyname, err)
+		return err
+	}
+	log.Infof("published path %v to IPNS name %s (%s)", r.Value(), keyname, r.Name())
+	return nil
+}
+
+// ResolveIPNSName resolves an IPNS name to a path. Names of keys are resolved from validated records cached by the node
+// or sent by peers if possible.
+func ResolveIPNSName(ctx context.Context, ipfscore IPFSCore, name string) (string, error) {
+	ctx, cancel := util.WithTimeout(ctx, IPNSResolveTimeout)
+	defer cancel()
+	if err := devnet.Inject(ctx, devnet.FaultIPNSResolve); err != nil {
+		log.Errorf("could not resolve IPNS name %s: %v", name, err)
+		return "", err
+	}
+	if pid, err := IPNSNamePeerID(name); err == nil {
+		r, err := resolveIPNSRecord(ctx, ipfscore, pid)
+		if v := string(r.entry.GetValue()); err == nil && strings.HasPrefix(v, "/ipfs/") {
+			return v, nil
+		}
+	}
+	p, err := ipfscore.Api.Name().Resolve(ctx, name)
+	if err != nil {
+		log.Errorf("could not resolve IPNS name %s: %v", name, err)
+		return "", err
+	}
+	return p.String(), nil
+}
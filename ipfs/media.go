@@ -0,0 +1,118 @@
+package ipfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	ipfspath "github.com/ipfs/boxo/coreiface/path"
+	files "github.com/ipfs/boxo/files"
+)
+
+// SniffLength is the number of bytes read from the start of a file to sniff its content type.
+const SniffLength = 512
+
+// DefaultAllowedMediaTypes are the content types of media which can be imported and fetched. Types ending in /* match
+// every subtype.
+var DefaultAllowedMediaTypes = []string{
+	"image/jpeg", "image/png", "image/gif", "image/webp", "image/bmp",
+	"video/mp4", "video/webm", "audio/mpeg", "audio/ogg", "audio/wave", "audio/mp4",
+	"application/pdf", "text/plain", HLSMediaType,
+}
+
+// AllowedMediaTypes are the content types of media which can be imported and fetched. They can be changed in the node
+// configuration.
+var AllowedMediaTypes = DefaultAllowedMediaTypes
+
+// dangerousMediaTypes are never allowed since a browser can run scripts in them when they are opened from a gateway URL.
+var dangerousMediaTypes = []string{
+	"text/html", "image/svg+xml", "text/xml", "application/xml", "application/xhtml+xml",
+	"application/javascript", "text/javascript", "application/x-msdownload", "application/x-sh",
+}
+
+// mediaType returns a content type without parameters in lower case.
+func mediaType(t string) string {
+	if mt, _, err := mime.ParseMediaType(t); err == nil {
+		return mt
+	}
+	return strings.ToLower(strings.TrimSpace(t))
+}
+
+// SniffMediaType returns the content type of file data using the start of the data.
+func SniffMediaType(data []byte) string {
+	if len(data) > SniffLength {
+		data = data[:SniffLength]
+	}
+	if bytes.HasPrefix(data, []byte("#EXTM3U")) {
+		return HLSMediaType
+	}
+	t := mediaType(http.DetectContentType(data))
+	if t == "application/ogg" {
+		return VoiceNoteMediaType
+	}
+	if t == "text/xml" || t == "text/plain" {
+		if bytes.Contains(bytes.ToLower(data), []byte("<svg")) {
+			return "image/svg+xml"
+		}
+	}
+	return t
+}
+
+// MediaTypeOfName returns the content type of a file name or URL from its extension, or "" if it is not known.
+func MediaTypeOfName(name string) string {
+	name, _, _ = strings.Cut(name, "?")
+	ext := path.Ext(name)
+	if ext == "" {
+		return ""
+	}
+	return mediaType(mime.TypeByExtension(ext))
+}
+
+func matchMediaType(patterns []string, t string) bool {
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if p == t || (strings.HasSuffix(p, "/*") && strings.HasPrefix(t, strings.TrimSuffix(p, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckMedia sniffs the content type of file data and returns it if it is allowed. Dangerous types are rejected, as is
+// data whose type doesn't match the type it claims to be. claimed may be empty if the type isn't known.
+func CheckMedia(data []byte, claimed string) (string, error) {
+	t := SniffMediaType(data)
+	if matchMediaType(dangerousMediaTypes, t) {
+		return t, fmt.Errorf("content type %s is not allowed since it can run scripts", t)
+	}
+	if !matchMediaType(AllowedMediaTypes, t) {
+		return t, fmt.Errorf("content type %s is not in the allowed media types", t)
+	}
+	if c := mediaType(claimed); c != "" && c != "application/octet-stream" && c != t {
+		return t, fmt.Errorf("content claims to be %s but is %s", c, t)
+	}
+	return t, nil
+}
+
+// CheckRemoteMedia reads the start of a UnixFS file at an IPFS path and checks its content type with CheckMedia.
+func CheckRemoteMedia(ctx context.Context, ipfscore IPFSCore, p string, claimed string) (string, error) {
+	n, err := ipfscore.Api.Unixfs().Get(ctx, ipfspath.New(p))
+	if err != nil {
+		return "", err
+	}
+	defer n.Close()
+	f, ok := n.(files.File)
+	if !ok {
+		return "", fmt.Errorf("%s is not a file", p)
+	}
+	data, err := io.ReadAll(io.LimitReader(f, SniffLength))
+	if err != nil {
+		return "", err
+	}
+	return CheckMedia(data, claimed)
+}
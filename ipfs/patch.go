@@ -0,0 +1,247 @@
+package ipfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime/codec/dagjson"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/linking"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal"
+)
+
+// Operations of an IPLD patch. Like JSON Patch, add inserts into a list at an index or appends to it at -, and adds a
+// key which must not exist to a map. Replace and remove need the path to exist.
+const (
+	PatchAdd     = "add"
+	PatchReplace = "replace"
+	PatchRemove  = "remove"
+)
+
+// PatchOp is an operation of an IPLD patch at a path within a node. Paths can go through links, in which case the linked
+// nodes are patched and stored and the links are updated.
+type PatchOp struct {
+	Op    string
+	Path  datamodel.Path
+	Value datamodel.Node
+}
+
+// ParsePatch parses a DAG-JSON IPLD patch, which is a list of operations like {"op": "add", "path": "/a/b", "value": 1}.
+func ParsePatch(data []byte) ([]PatchOp, error) {
+	nb := basicnode.Prototype.Any.NewBuilder()
+	if err := dagjson.Decode(nb, bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("could not decode IPLD patch: %v", err)
+	}
+	n := nb.Build()
+	if n.Kind() != datamodel.Kind_List {
+		return nil, fmt.Errorf("an IPLD patch must be a list of operations")
+	}
+	ops := []PatchOp{}
+	for itr := n.ListIterator(); !itr.Done(); {
+		i, on, err := itr.Next()
+		if err != nil {
+			return nil, err
+		}
+		op, err := stringEntry(on, "op")
+		if err != nil {
+			return nil, fmt.Errorf("operation %v of IPLD patch has no op", i)
+		}
+		switch op {
+		case PatchAdd, PatchReplace, PatchRemove:
+		default:
+			return nil, fmt.Errorf("unknown IPLD patch operation %s, must be %s, %s or %s", op, PatchAdd, PatchReplace, PatchRemove)
+		}
+		p, err := stringEntry(on, "path")
+		if err != nil {
+			return nil, fmt.Errorf("operation %v of IPLD patch has no path", i)
+		}
+		v, err := on.LookupByString("value")
+		if err != nil && op != PatchRemove {
+			return nil, fmt.Errorf("%s operation %v of IPLD patch has no value", op, i)
+		}
+		ops = append(ops, PatchOp{Op: op, Path: datamodel.ParsePath(p), Value: v})
+	}
+	return ops, nil
+}
+
+func stringEntry(n datamodel.Node, key string) (string, error) {
+	v, err := n.LookupByString(key)
+	if err != nil {
+		return "", err
+	}
+	return v.AsString()
+}
+
+// PatchIPLDNode applies the operations of a patch to an IPLD node in order and returns the new node. Linked nodes on the
+// paths of the operations are loaded from and stored to IPFS.
+func PatchIPLDNode(ctx context.Context, ipfscore IPFSCore, n datamodel.Node, ops []PatchOp) (datamodel.Node, error) {
+	prog := traversal.Progress{Cfg: &traversal.Config{
+		Ctx:                            ctx,
+		LinkSystem:                     ipfscore.LS,
+		LinkTargetNodePrototypeChooser: basicnode.Chooser,
+	}}
+	var err error
+	for _, op := range ops {
+		if n, err = patchOne(ctx, ipfscore.LS, prog, n, op); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// PatchBlock applies a patch to the IPLD node of a block and stores the new node with the codec and hash function of the
+// block. It returns the CID of the new node.
+func PatchBlock(ctx context.Context, ipfscore IPFSCore, root cid.Cid, ops []PatchOp) (cid.Cid, error) {
+	lctx := linking.LinkContext{Ctx: ctx}
+	n, err := ipfscore.LS.Load(lctx, cidlink.Link{Cid: root}, basicnode.Prototype.Any)
+	if err != nil {
+		log.Errorf("could not load IPLD node %v to patch: %v", root, err)
+		return cid.Undef, err
+	}
+	if n, err = PatchIPLDNode(ctx, ipfscore, n, ops); err != nil {
+		log.Errorf("could not patch IPLD node %v: %v", root, err)
+		return cid.Undef, err
+	}
+	lnk, err := ipfscore.LS.Store(lctx, cidlink.LinkPrototype{Prefix: root.Prefix()}, n)
+	if err != nil {
+		log.Errorf("could not store patched IPLD node %v: %v", root, err)
+		return cid.Undef, err
+	}
+	c := lnk.(cidlink.Link).Cid
+	log.Infof("patched IPLD node %v with %v operations to %v", root, len(ops), c)
+	return c, nil
+}
+
+// patchOne transforms the parent of the path of an operation, since removing from and inserting into a list changes the
+// list itself.
+func patchOne(ctx context.Context, ls linking.LinkSystem, prog traversal.Progress, n datamodel.Node, op PatchOp) (datamodel.Node, error) {
+	if op.Path.Len() == 0 {
+		if op.Op != PatchReplace {
+			return nil, fmt.Errorf("only the %s operation can be applied to the root of a node", PatchReplace)
+		}
+		return op.Value, nil
+	}
+	seg := op.Path.Last()
+	return prog.FocusedTransform(n, op.Path.Pop(), func(_ traversal.Progress, parent datamodel.Node) (datamodel.Node, error) {
+		if parent == nil || parent.IsAbsent() {
+			return nil, fmt.Errorf("the parent of %s does not exist", op.Path)
+		}
+		if parent.Kind() == datamodel.Kind_Link {
+			// the traversal only loads links it goes through, so a link at the end of the parent path is patched here
+			lnk, _ := parent.AsLink()
+			lctx := linking.LinkContext{Ctx: ctx}
+			child, err := ls.Load(lctx, lnk, basicnode.Prototype.Any)
+			if err != nil {
+				return nil, fmt.Errorf("could not load %v at %s: %v", lnk, op.Path.Pop(), err)
+			}
+			if child, err = patchEntry(child, seg, op); err != nil {
+				return nil, err
+			}
+			if lnk, err = ls.Store(lctx, lnk.Prototype(), child); err != nil {
+				return nil, fmt.Errorf("could not store patched node at %s: %v", op.Path.Pop(), err)
+			}
+			return basicnode.NewLink(lnk), nil
+		}
+		return patchEntry(parent, seg, op)
+	}, false)
+}
+
+func patchEntry(parent datamodel.Node, seg datamodel.PathSegment, op PatchOp) (datamodel.Node, error) {
+	switch parent.Kind() {
+	case datamodel.Kind_Map:
+		return patchMap(parent, seg.String(), op)
+	case datamodel.Kind_List:
+		return patchList(parent, seg, op)
+	default:
+		return nil, fmt.Errorf("cannot %s %s in a %s", op.Op, op.Path, parent.Kind())
+	}
+}
+
+func patchMap(parent datamodel.Node, key string, op PatchOp) (datamodel.Node, error) {
+	v, err := parent.LookupByString(key)
+	exists := err == nil && v != nil && !v.IsAbsent()
+	if op.Op == PatchAdd && exists {
+		return nil, fmt.Errorf("cannot add %s because it already exists", op.Path)
+	} else if op.Op != PatchAdd && !exists {
+		return nil, fmt.Errorf("cannot %s %s because it does not exist", op.Op, op.Path)
+	}
+	nb := basicnode.Prototype.Map.NewBuilder()
+	ma, err := nb.BeginMap(parent.Length() + 1)
+	if err != nil {
+		return nil, err
+	}
+	for itr := parent.MapIterator(); !itr.Done(); {
+		k, v, err := itr.Next()
+		if err != nil {
+			return nil, err
+		}
+		if ks, _ := k.AsString(); ks == key {
+			if op.Op == PatchRemove {
+				continue
+			}
+			v = op.Value
+		}
+		if err = ma.AssembleKey().AssignNode(k); err != nil {
+			return nil, err
+		}
+		if err = ma.AssembleValue().AssignNode(v); err != nil {
+			return nil, err
+		}
+	}
+	if op.Op == PatchAdd {
+		if err = ma.AssembleKey().AssignString(key); err != nil {
+			return nil, err
+		}
+		if err = ma.AssembleValue().AssignNode(op.Value); err != nil {
+			return nil, err
+		}
+	}
+	if err = ma.Finish(); err != nil {
+		return nil, err
+	}
+	return nb.Build(), nil
+}
+
+func patchList(parent datamodel.Node, seg datamodel.PathSegment, op PatchOp) (datamodel.Node, error) {
+	l := parent.Length()
+	idx, err := seg.Index()
+	if err != nil {
+		if op.Op != PatchAdd || seg.String() != "-" {
+			return nil, fmt.Errorf("invalid list index in %s", op.Path)
+		}
+		idx = l
+	}
+	if idx < 0 || idx > l || (idx == l && op.Op != PatchAdd) {
+		return nil, fmt.Errorf("list index in %s is out of range", op.Path)
+	}
+	nb := basicnode.Prototype.List.NewBuilder()
+	la, err := nb.BeginList(l + 1)
+	if err != nil {
+		return nil, err
+	}
+	for i := int64(0); i <= l; i++ {
+		if i == idx && op.Op != PatchRemove {
+			if err = la.AssembleValue().AssignNode(op.Value); err != nil {
+				return nil, err
+			}
+		}
+		if i == l || (i == idx && op.Op != PatchAdd) {
+			continue
+		}
+		v, err := parent.LookupByIndex(i)
+		if err != nil {
+			return nil, err
+		}
+		if err = la.AssembleValue().AssignNode(v); err != nil {
+			return nil, err
+		}
+	}
+	if err = la.Finish(); err != nil {
+		return nil, err
+	}
+	return nb.Build(), nil
+}
@@ -0,0 +1,45 @@
+package ipfs
+
+import (
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// PeeringPeers are the nodes the IPFS node peers with, like the Peering.Peers of a Kubo node. The node connects to them
+// when it starts, reconnects when a connection drops and the connection manager never closes their connections.
+var PeeringPeers = []peer.ID{}
+
+func peeringAddrInfos(ids []peer.ID) []peer.AddrInfo {
+	infos := []peer.AddrInfo{}
+	for _, id := range ids {
+		// the addresses of the peers are found with the DHT
+		infos = append(infos, peer.AddrInfo{ID: id})
+	}
+	return infos
+}
+
+// SetPeeringPeers replaces the peers of the peering service of a running IPFS node, connecting to added peers and
+// unprotecting the connections to removed peers.
+func SetPeeringPeers(ipfscore IPFSCore, ids []peer.ID) {
+	PeeringPeers = ids
+	if Offline || ipfscore.Node.Peering == nil {
+		return
+	}
+	current := map[peer.ID]bool{}
+	for _, p := range ipfscore.Node.Peering.ListPeers() {
+		current[p.ID] = true
+	}
+	keep := map[peer.ID]bool{}
+	for _, info := range peeringAddrInfos(ids) {
+		keep[info.ID] = true
+		if !current[info.ID] {
+			log.Infof("peering with %v", info.ID)
+			ipfscore.Node.Peering.AddPeer(info)
+		}
+	}
+	for id := range current {
+		if !keep[id] {
+			log.Infof("no longer peering with %v", id)
+			ipfscore.Node.Peering.RemovePeer(id)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package ipfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+
+	"github.com/allisterb/patr/util"
+	"github.com/allisterb/patr/w3s"
+)
+
+// Providers of remote pinning services. Pinata, Filebase and 4EVERLAND implement the IPFS Pinning Service API at known
+// endpoints, and psa is any other service implementing the API at the endpoint in the configuration.
+const (
+	PinningW3S       = "w3s"
+	PinningPinata    = "pinata"
+	PinningFilebase  = "filebase"
+	Pinning4EVERLAND = "4everland"
+	PinningPSA       = "psa"
+)
+
+// PinningServiceEndpoints are the IPFS Pinning Service API endpoints of the known providers.
+var PinningServiceEndpoints = map[string]string{
+	PinningPinata:    "https://api.pinata.cloud/psa",
+	PinningFilebase:  "https://api.filebase.io/v1/ipfs",
+	Pinning4EVERLAND: "https://api.4everland.dev",
+}
+
+// PinningServiceConfig selects the remote pinning service blocks are pinned with. Token is the access token of the
+// service. Endpoint overrides the endpoint of the provider and is required for psa. The default provider is w3s, which
+// uses the Web3.Storage API keys of the node. Name tells apart services of the same provider and is the provider by
+// default.
+type PinningServiceConfig struct {
+	Provider string
+	Name     string `json:",omitempty"`
+	Endpoint string `json:",omitempty"`
+	Token    string `json:",omitempty"`
+}
+
+// PinningService is the remote pinning service of the node.
+var PinningService = PinningServiceConfig{}
+
+// PinningServices are the other remote pinning services of the node, which blocks are pinned with as well as
+// PinningService.
+var PinningServices = []PinningServiceConfig{}
+
+// Validate checks the provider of the pinning service is known and it has an endpoint and token.
+func (s PinningServiceConfig) Validate() error {
+	switch s.Provider {
+	case "", PinningW3S:
+		return nil
+	case PinningPinata, PinningFilebase, Pinning4EVERLAND, PinningPSA:
+		if s.endpoint() == "" {
+			return fmt.Errorf("the pinning service %s does not have an endpoint", s.Provider)
+		}
+		if s.Token == "" {
+			return fmt.Errorf("the pinning service %s does not have a token", s.Provider)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown pinning service provider %s", s.Provider)
+	}
+}
+
+func (s PinningServiceConfig) name() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	if s.Provider == "" {
+		return PinningW3S
+	}
+	return s.Provider
+}
+
+func (s PinningServiceConfig) endpoint() string {
+	if s.Endpoint != "" {
+		return strings.TrimSuffix(s.Endpoint, "/")
+	}
+	return PinningServiceEndpoints[s.Provider]
+}
+
+// PinStatus is the status of a pin on a remote pinning service. The statuses other than unpinned are those of the IPFS
+// Pinning Service API.
+type PinStatus string
+
+const (
+	PinQueued   PinStatus = "queued"
+	PinPinning  PinStatus = "pinning"
+	PinPinned   PinStatus = "pinned"
+	PinFailed   PinStatus = "failed"
+	PinUnpinned PinStatus = "unpinned"
+)
+
+// Pinner pins DAGs stored by the IPFS node with a remote pinning service.
+type Pinner interface {
+	Name() string
+	Pin(ctx context.Context, c cid.Cid) error
+	Status(ctx context.Context, c cid.Cid) (PinStatus, error)
+	Unpin(ctx context.Context, c cid.Cid) error
+}
+
+// NewPinner creates the pinner of a pinning service for the IPFS node.
+func NewPinner(ipfscore IPFSCore, s PinningServiceConfig) (Pinner, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	switch s.Provider {
+	case "", PinningW3S:
+		if ipfscore.W3S == nil || !w3s.Enabled(ipfscore.W3S.GetAuthToken()) {
+			return nil, fmt.Errorf("Web3.Storage is not configured")
+		}
+		return &w3sPinner{name: s.name(), ipfscore: ipfscore}, nil
+	default:
+		return &psaPinner{name: s.name(), endpoint: s.endpoint(), token: s.Token, ipfscore: ipfscore, hc: &http.Client{}}, nil
+	}
+}
+
+// w3sPinner pins DAGs by uploading them to Web3.Storage as CARs.
+type w3sPinner struct {
+	name     string
+	ipfscore IPFSCore
+}
+
+func (p *w3sPinner) Name() string {
+	return p.name
+}
+
+func (p *w3sPinner) Pin(ctx context.Context, c cid.Cid) error {
+	data, err := GetBlock(ctx, p.ipfscore, c)
+	if err != nil {
+		return fmt.Errorf("could not get block %v from local blockstore: %v", c, err)
+	}
+	blk, err := blocks.NewBlockWithCid(data, c)
+	if err != nil {
+		return err
+	}
+	_, err = PinIPLDBlockToW3S(ctx, p.ipfscore.Api, p.ipfscore.W3S.GetAuthToken(), blk)
+	return err
+}
+
+func (p *w3sPinner) Status(ctx context.Context, c cid.Cid) (PinStatus, error) {
+	s, err := p.ipfscore.W3S.Status(ctx, c)
+	if err != nil {
+		var herr *util.HTTPStatusError
+		if errors.As(err, &herr) && herr.StatusCode == http.StatusNotFound {
+			return PinUnpinned, nil
+		}
+		return "", err
+	}
+	status := PinQueued
+	for _, pin := range s.Pins {
+		switch pin.Status {
+		case w3s.PinStatusPinned:
+			return PinPinned, nil
+		case w3s.PinStatusPinning:
+			status = PinPinning
+		}
+	}
+	return status, nil
+}
+
+func (p *w3sPinner) Unpin(ctx context.Context, c cid.Cid) error {
+	return fmt.Errorf("Web3.Storage does not support unpinning %v", c)
+}
+
+// psaPinner pins DAGs with a service implementing the IPFS Pinning Service API, which fetches them from the node.
+type psaPinner struct {
+	name     string
+	endpoint string
+	token    string
+	ipfscore IPFSCore
+	hc       *http.Client
+}
+
+// psaPin is a pin status object of the IPFS Pinning Service API.
+type psaPin struct {
+	RequestID string    `json:"requestid"`
+	Status    PinStatus `json:"status"`
+	Pin       struct {
+		Cid  string `json:"cid"`
+		Name string `json:"name,omitempty"`
+	} `json:"pin"`
+}
+
+func (p *psaPinner) Name() string {
+	return p.name
+}
+
+func (p *psaPinner) do(ctx context.Context, method string, path string, body any, out any) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	ctx, cancel := util.WithTimeout(ctx, PinningServiceTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, p.endpoint+path, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := p.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		b, _ := io.ReadAll(res.Body)
+		return &util.HTTPStatusError{StatusCode: res.StatusCode, Status: res.Status, Body: string(b)}
+	}
+	if out != nil {
+		return json.NewDecoder(res.Body).Decode(out)
+	}
+	return nil
+}
+
+// origins returns the multiaddrs of the node the pinning service can fetch DAGs from.
+func (p *psaPinner) origins(ctx context.Context) []string {
+	addrs, err := p.ipfscore.Api.Swarm().LocalAddrs(ctx)
+	if err != nil {
+		return nil
+	}
+	origins := []string{}
+	for _, a := range addrs {
+		origins = append(origins, fmt.Sprintf("%s/p2p/%s", a, p.ipfscore.Node.Identity))
+	}
+	return origins
+}
+
+// lookup returns the pin of a CID on the service, or nil if it is not pinned, with a single request.
+func (p *psaPinner) lookup(ctx context.Context, c cid.Cid) (*psaPin, error) {
+	q := url.Values{"cid": {c.String()}, "status": {"queued,pinning,pinned,failed"}, "limit": {"1"}}
+	var res struct {
+		Count   int      `json:"count"`
+		Results []psaPin `json:"results"`
+	}
+	if err := p.do(ctx, "GET", "/pins?"+q.Encode(), nil, &res); err != nil {
+		return nil, err
+	}
+	if len(res.Results) == 0 {
+		return nil, nil
+	}
+	return &res.Results[0], nil
+}
+
+// find returns the pin of a CID on the service, or nil if it is not pinned.
+func (p *psaPinner) find(ctx context.Context, c cid.Cid) (*psaPin, error) {
+	var pin *psaPin
+	err := util.Retry(ctx, "pinning", "getting pin status from "+p.name, func(ctx context.Context) error {
+		var err error
+		pin, err = p.lookup(ctx, c)
+		return err
+	})
+	return pin, err
+}
+
+// Pin creates a pin request for a CID unless the service already has one which didn't fail. Creating a pin request is
+// not idempotent, so the service is asked for an existing request before each attempt in case an attempt which timed
+// out was accepted.
+func (p *psaPinner) Pin(ctx context.Context, c cid.Cid) error {
+	body := map[string]any{"cid": c.String(), "name": "patr/" + c.String(), "origins": p.origins(ctx)}
+	return util.Retry(ctx, "pinning", "pinning block with "+p.name, func(ctx context.Context) error {
+		pin, err := p.lookup(ctx, c)
+		if err != nil {
+			return err
+		}
+		if pin != nil && pin.Status != PinFailed {
+			return nil
+		}
+		return p.do(ctx, "POST", "/pins", body, &psaPin{})
+	})
+}
+
+func (p *psaPinner) Status(ctx context.Context, c cid.Cid) (PinStatus, error) {
+	pin, err := p.find(ctx, c)
+	if err != nil {
+		return "", err
+	}
+	if pin == nil {
+		return PinUnpinned, nil
+	}
+	return pin.Status, nil
+}
+
+func (p *psaPinner) Unpin(ctx context.Context, c cid.Cid) error {
+	pin, err := p.find(ctx, c)
+	if err != nil || pin == nil {
+		return err
+	}
+	return util.Retry(ctx, "pinning", "unpinning block from "+p.name, func(ctx context.Context) error {
+		return p.do(ctx, "DELETE", "/pins/"+url.PathEscape(pin.RequestID), nil, nil)
+	})
+}
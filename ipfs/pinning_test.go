@@ -0,0 +1,60 @@
+package ipfs_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+
+	"github.com/allisterb/patr/internal/ipfstest"
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/util"
+)
+
+func TestPSAPinDoesNotDuplicateAcceptedRequests(t *testing.T) {
+	core := ipfstest.StartOfflineNode(t)
+	h, err := mh.Sum([]byte("patr"), mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cid.NewCidV1(cid.Raw, h)
+	lock := sync.Mutex{}
+	posts, pins := 0, []ipfs.PSAPin{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		if r.Method == "GET" {
+			res := map[string]any{"count": len(pins), "results": pins}
+			lock.Unlock()
+			json.NewEncoder(w).Encode(res)
+			return
+		}
+		posts++
+		pin := ipfs.PSAPin{RequestID: "1", Status: ipfs.PinQueued}
+		pin.Pin.Cid = c.String()
+		pins = append(pins, pin)
+		lock.Unlock()
+		// the pin request is accepted but a proxy in front of the service times out
+		w.WriteHeader(http.StatusGatewayTimeout)
+	}))
+	t.Cleanup(srv.Close)
+	policy := util.GetRetryPolicy("pinning")
+	util.SetRetryPolicy("pinning", util.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, Multiplier: 1})
+	t.Cleanup(func() { util.SetRetryPolicy("pinning", policy) })
+	p, err := ipfs.NewPinner(*core, ipfs.PinningServiceConfig{Provider: ipfs.PinningPSA, Endpoint: srv.URL, Token: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Pin(core.Ctx, c); err != nil {
+		t.Fatalf("pin request which failed after it was accepted was not found on retry: %v", err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if posts != 1 {
+		t.Errorf("pinning a block made %v pin requests, expected 1", posts)
+	}
+}
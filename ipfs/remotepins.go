@@ -0,0 +1,388 @@
+package ipfs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+
+	"github.com/allisterb/patr/util"
+)
+
+// PinQuorum is how many of the remote pinning services must pin a block for it to be pinned. Services which fail are
+// retried in the background. If it is negative or larger than the number of services every service must pin the block.
+var PinQuorum = 1
+
+var remotePinsLock = sync.Mutex{}
+
+// ServicePin is the status of the pin of a block on a remote pinning service. Failed pins are retried at NextAttempt
+// until the remote-pins retry policy runs out of attempts.
+type ServicePin struct {
+	Status      PinStatus
+	Attempts    int
+	Error       string `json:",omitempty"`
+	Updated     time.Time
+	NextAttempt time.Time `json:",omitempty"`
+}
+
+// RemotePin is the status of the pins of a block on each remote pinning service, keyed by service name.
+type RemotePin struct {
+	Cid      string
+	Services map[string]ServicePin
+}
+
+// Pinned returns the number of services which pinned the block or accepted to pin it.
+func (p RemotePin) Pinned() int {
+	n := 0
+	for _, s := range p.Services {
+		if s.Status == PinPinned || s.Status == PinPinning || s.Status == PinQueued {
+			n++
+		}
+	}
+	return n
+}
+
+// ServiceNames returns the names of the services of a remote pin in order.
+func (p RemotePin) ServiceNames() []string {
+	names := []string{}
+	for n := range p.Services {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Quorum returns the number of services which must pin a block for it to be pinned with n services.
+func Quorum(n int) int {
+	if PinQuorum < 0 || PinQuorum > n {
+		return n
+	}
+	return PinQuorum
+}
+
+// RemotePinners returns the pinners of the remote pinning services of the node which are configured.
+func RemotePinners(ipfscore IPFSCore) []Pinner {
+	pinners := []Pinner{}
+	names := map[string]bool{}
+	for _, s := range append([]PinningServiceConfig{PinningService}, PinningServices...) {
+		p, err := NewPinner(ipfscore, s)
+		if err != nil {
+			log.Debugf("remote pinning with %s is disabled: %v", s.name(), err)
+			continue
+		}
+		if names[p.Name()] {
+			log.Warnf("the pinning service %s is configured more than once, give the services different names", p.Name())
+			continue
+		}
+		names[p.Name()] = true
+		pinners = append(pinners, p)
+	}
+	return pinners
+}
+
+func remotePinsDir() string {
+	return filepath.Join(util.AppData, "remote-pins")
+}
+
+func remotePinFile(c string) string {
+	return filepath.Join(remotePinsDir(), c+".json")
+}
+
+// migrateRemotePins moves the remote pins recorded in the single remote pins file of earlier versions to a record per
+// block.
+func migrateRemotePins() {
+	f := filepath.Join(util.AppData, "remote-pins.json")
+	if !util.PathExists(f) {
+		return
+	}
+	data, err := util.ReadDataFile(f)
+	if err != nil {
+		log.Errorf("could not read remote pins file %s: %v", f, err)
+		return
+	}
+	pins := map[string]RemotePin{}
+	if err = json.Unmarshal(data, &pins); err != nil {
+		log.Errorf("could not read JSON data from remote pins file %s: %v", f, err)
+		return
+	}
+	log.Infof("migrating %v remote pins in %s to %s", len(pins), f, remotePinsDir())
+	for _, p := range pins {
+		if err = writeRemotePin(p); err != nil {
+			log.Errorf("could not migrate remote pin of %s: %v", p.Cid, err)
+			return
+		}
+	}
+	os.Remove(f)
+}
+
+var migrateRemotePinsOnce = sync.Once{}
+
+// readRemotePin reads the recorded status of the remote pins of a block.
+func readRemotePin(c string) (RemotePin, error) {
+	migrateRemotePinsOnce.Do(migrateRemotePins)
+	p := RemotePin{Cid: c, Services: map[string]ServicePin{}}
+	f := remotePinFile(c)
+	if !util.PathExists(f) {
+		return p, nil
+	}
+	data, err := util.ReadDataFile(f)
+	if err != nil {
+		log.Errorf("could not read remote pin record %s: %v", f, err)
+		return p, err
+	}
+	if err = json.Unmarshal(data, &p); err != nil {
+		log.Errorf("could not read JSON data from remote pin record %s: %v", f, err)
+		return p, err
+	}
+	if p.Services == nil {
+		p.Services = map[string]ServicePin{}
+	}
+	return p, nil
+}
+
+// writeRemotePin records the status of the remote pins of a block. Services which unpinned the block are dropped and
+// the record is removed when no service pins the block.
+func writeRemotePin(p RemotePin) error {
+	for name, s := range p.Services {
+		if s.Status == PinUnpinned {
+			delete(p.Services, name)
+		}
+	}
+	f := remotePinFile(p.Cid)
+	if len(p.Services) == 0 {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(remotePinsDir(), 0700); err != nil {
+		return err
+	}
+	data, _ := json.MarshalIndent(p, "", " ")
+	return util.WriteDataFile(f, data)
+}
+
+// remotePinCids returns the CIDs of the blocks with recorded remote pins.
+func remotePinCids() ([]string, error) {
+	migrateRemotePinsOnce.Do(migrateRemotePins)
+	entries, err := os.ReadDir(remotePinsDir())
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	cids := []string{}
+	for _, e := range entries {
+		if !e.IsDir() && filepath.Ext(e.Name()) == ".json" {
+			cids = append(cids, strings.TrimSuffix(e.Name(), ".json"))
+		}
+	}
+	return cids, nil
+}
+
+// GetRemotePin returns the recorded status of the pins of a block on the remote pinning services.
+func GetRemotePin(c cid.Cid) (RemotePin, error) {
+	remotePinsLock.Lock()
+	defer remotePinsLock.Unlock()
+	return readRemotePin(c.String())
+}
+
+// updateServicePin records the status of the pin of a block on a service.
+func updateServicePin(c cid.Cid, service string, f func(s *ServicePin)) {
+	remotePinsLock.Lock()
+	defer remotePinsLock.Unlock()
+	p, err := readRemotePin(c.String())
+	if err != nil {
+		return
+	}
+	s := p.Services[service]
+	f(&s)
+	s.Updated = util.Now()
+	p.Services[service] = s
+	if err = writeRemotePin(p); err != nil {
+		log.Errorf("could not record remote pin status of %v with %s: %v", c, service, err)
+	}
+}
+
+// pinWith pins a block with a pinning service and records the status of the pin, scheduling a retry if it failed.
+func pinWith(ctx context.Context, p Pinner, c cid.Cid) error {
+	err := p.Pin(ctx, c)
+	status := PinQueued
+	if err == nil {
+		if s, serr := p.Status(ctx, c); serr == nil && s != PinUnpinned {
+			status = s
+		}
+	}
+	updateServicePin(c, p.Name(), func(s *ServicePin) {
+		s.Attempts++
+		if err != nil {
+			s.Status, s.Error = PinFailed, err.Error()
+			s.NextAttempt = nextPinAttempt(s.Attempts)
+		} else {
+			s.Status, s.Error, s.NextAttempt = status, "", time.Time{}
+		}
+	})
+	return err
+}
+
+// nextPinAttempt returns when a failed pin is retried, or the zero time if it isn't.
+func nextPinAttempt(attempts int) time.Time {
+	policy := util.GetRetryPolicy("remote-pins")
+	if attempts >= policy.MaxAttempts {
+		return time.Time{}
+	}
+	return util.Now().Add(policy.Backoff(attempts))
+}
+
+// PinRemote pins a DAG with the remote pinning services of the node concurrently. It succeeds when the quorum of the
+// services pinned the DAG. The status of each pin is recorded in the remote pin record of the DAG and failed pins are
+// retried by SchedulePinRetries.
+func PinRemote(ctx context.Context, ipfscore IPFSCore, c cid.Cid) error {
+	if Offline {
+		return ErrOffline
+	}
+	pinners := RemotePinners(ipfscore)
+	if len(pinners) == 0 {
+		return fmt.Errorf("the node does not have a remote pinning service")
+	}
+	quorum := Quorum(len(pinners))
+	log.Infof("pinning %v with %v pinning services...", c, len(pinners))
+	errs := make([]error, len(pinners))
+	wg := sync.WaitGroup{}
+	for i, p := range pinners {
+		wg.Add(1)
+		go func(i int, p Pinner) {
+			defer wg.Done()
+			if errs[i] = pinWith(ctx, p, c); errs[i] != nil {
+				log.Errorf("could not pin %v with %s: %v", c, p.Name(), errs[i])
+			}
+		}(i, p)
+	}
+	wg.Wait()
+	pinned := 0
+	for _, err := range errs {
+		if err == nil {
+			pinned++
+		}
+	}
+	if pinned < quorum {
+		return fmt.Errorf("%v was pinned with %v of %v pinning services, fewer than the quorum of %v", c, pinned, len(pinners), quorum)
+	}
+	log.Infof("pinned %v with %v of %v pinning services", c, pinned, len(pinners))
+	return nil
+}
+
+// UnpinRemote unpins a DAG from the remote pinning services of the node and records it is unpinned.
+func UnpinRemote(ctx context.Context, ipfscore IPFSCore, c cid.Cid) error {
+	var err error
+	for _, p := range RemotePinners(ipfscore) {
+		if uerr := p.Unpin(ctx, c); uerr != nil {
+			log.Warnf("could not unpin %v from %s: %v", c, p.Name(), uerr)
+			err = uerr
+			continue
+		}
+		updateServicePin(c, p.Name(), func(s *ServicePin) {
+			s.Status, s.Error, s.NextAttempt = PinUnpinned, "", time.Time{}
+		})
+	}
+	return err
+}
+
+// RefreshRemotePin updates the recorded status of the pins of a block which are queued or pinning with the status the
+// services report, and returns the status of the pins.
+func RefreshRemotePin(ctx context.Context, ipfscore IPFSCore, c cid.Cid) (RemotePin, error) {
+	rp, err := GetRemotePin(c)
+	if err != nil {
+		return rp, err
+	}
+	for _, p := range RemotePinners(ipfscore) {
+		s, ok := rp.Services[p.Name()]
+		if !ok || (s.Status != PinQueued && s.Status != PinPinning) {
+			continue
+		}
+		status, err := p.Status(ctx, c)
+		if err != nil {
+			log.Warnf("could not get the status of the pin of %v with %s: %v", c, p.Name(), err)
+			continue
+		}
+		updateServicePin(c, p.Name(), func(s *ServicePin) {
+			s.Status = status
+			if status == PinFailed {
+				s.Error = fmt.Sprintf("%s failed to pin %v", p.Name(), c)
+				s.NextAttempt = nextPinAttempt(s.Attempts)
+			}
+		})
+	}
+	return GetRemotePin(c)
+}
+
+// RetryRemotePins retries the failed pins which are due and refreshes the status of the pins which are queued or pinning.
+func RetryRemotePins(ctx context.Context, ipfscore IPFSCore) {
+	if Offline {
+		return
+	}
+	pinners := map[string]Pinner{}
+	for _, p := range RemotePinners(ipfscore) {
+		pinners[p.Name()] = p
+	}
+	remotePinsLock.Lock()
+	cids, err := remotePinCids()
+	remotePinsLock.Unlock()
+	if err != nil {
+		log.Errorf("could not list remote pin records in %s: %v", remotePinsDir(), err)
+		return
+	}
+	now := util.Now()
+	for _, s := range cids {
+		c, err := cid.Parse(s)
+		if err != nil {
+			continue
+		}
+		rp, err := GetRemotePin(c)
+		if err != nil {
+			continue
+		}
+		refresh := false
+		for name, s := range rp.Services {
+			p, ok := pinners[name]
+			if !ok {
+				continue
+			}
+			switch {
+			case s.Status == PinFailed && !s.NextAttempt.IsZero() && !now.Before(s.NextAttempt):
+				log.Infof("retrying pin of %v with %s (attempt %v)", c, name, s.Attempts+1)
+				if err := pinWith(ctx, p, c); err == nil {
+					log.Infof("pinned %v with %s", c, name)
+				}
+			case s.Status == PinQueued || s.Status == PinPinning:
+				refresh = true
+			}
+		}
+		if refresh {
+			RefreshRemotePin(ctx, ipfscore, c)
+		}
+	}
+}
+
+// SchedulePinRetries retries failed remote pins and refreshes the status of pending ones at an interval.
+func SchedulePinRetries(ctx context.Context, ipfscore IPFSCore, interval time.Duration) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				RetryRemotePins(ctx, ipfscore)
+			}
+		}
+	}()
+}
@@ -0,0 +1,100 @@
+package ipfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+
+	"github.com/allisterb/patr/util"
+)
+
+func testCid(t *testing.T, data string) cid.Cid {
+	t.Helper()
+	h, err := mh.Sum([]byte(data), mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cid.NewCidV1(cid.Raw, h)
+}
+
+func tempAppData(t *testing.T) {
+	t.Helper()
+	appData := util.AppData
+	util.AppData = t.TempDir()
+	migrateRemotePinsOnce = sync.Once{}
+	t.Cleanup(func() { util.AppData = appData })
+}
+
+func TestRemotePinRecords(t *testing.T) {
+	tempAppData(t)
+	a, b := testCid(t, "a"), testCid(t, "b")
+	for _, c := range []cid.Cid{a, b} {
+		updateServicePin(c, "one", func(s *ServicePin) { s.Status = PinPinned })
+		updateServicePin(c, "two", func(s *ServicePin) { s.Status = PinQueued })
+	}
+	p, err := GetRemotePin(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Pinned() != 2 {
+		t.Errorf("remote pin of %v has %v pinned services, expected 2", a, p.Pinned())
+	}
+	updateServicePin(a, "one", func(s *ServicePin) { s.Status = PinUnpinned })
+	if p, _ = GetRemotePin(a); len(p.Services) != 1 {
+		t.Errorf("remote pin of %v has %v services after one unpinned it, expected 1", a, len(p.Services))
+	}
+	updateServicePin(a, "two", func(s *ServicePin) { s.Status = PinUnpinned })
+	if util.PathExists(remotePinFile(a.String())) {
+		t.Errorf("remote pin record of %v was not removed when it was unpinned", a)
+	}
+	cids, err := remotePinCids()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cids) != 1 || cids[0] != b.String() {
+		t.Errorf("remote pin records are %v, expected %v", cids, b)
+	}
+}
+
+func TestRemotePinRecordsAreEncrypted(t *testing.T) {
+	tempAppData(t)
+	c := testCid(t, "a")
+	updateServicePin(c, "one", func(s *ServicePin) { s.Status = PinPinned })
+	if err := util.EnableDatastoreEncryption("test"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { util.DisableDatastoreEncryption() })
+	data, err := os.ReadFile(remotePinFile(c.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte(c.String())) {
+		t.Error("remote pin record was not encrypted when datastore encryption was enabled")
+	}
+	if p, err := GetRemotePin(c); err != nil || p.Pinned() != 1 {
+		t.Errorf("could not read encrypted remote pin record: %v", err)
+	}
+}
+
+func TestMigrateRemotePinsFile(t *testing.T) {
+	tempAppData(t)
+	c := testCid(t, "a")
+	pins := map[string]RemotePin{c.String(): {Cid: c.String(), Services: map[string]ServicePin{"one": {Status: PinPinned}}}}
+	data, _ := json.Marshal(pins)
+	f := filepath.Join(util.AppData, "remote-pins.json")
+	if err := os.WriteFile(f, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := GetRemotePin(c); err != nil || p.Pinned() != 1 {
+		t.Errorf("remote pin in the remote pins file was not migrated: %v", err)
+	}
+	if util.PathExists(f) {
+		t.Error("the remote pins file was not removed after it was migrated")
+	}
+}
@@ -0,0 +1,222 @@
+package ipfs
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	ipfspath "github.com/ipfs/boxo/coreiface/path"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	carv2 "github.com/ipld/go-car/v2"
+
+	"github.com/allisterb/patr/util"
+)
+
+// RetrievalSourceBitswap is the retrieval source of blocks fetched from peers. Blocks fetched from a trustless gateway
+// have the gateway URL as their source.
+const RetrievalSourceBitswap = "bitswap"
+
+// MaxBlockSize is the largest block fetched from a gateway, the same as the limit of bitswap.
+const MaxBlockSize = 2 << 20
+
+// RetrievalMetrics are the blocks, failures, bytes and milliseconds spent fetching blocks, keyed by retrieval source.
+var RetrievalMetrics = expvar.NewMap("retrieval")
+
+// RetrievalStats are the metrics of a retrieval source.
+type RetrievalStats struct {
+	Source   string        `json:"source"`
+	Blocks   int64         `json:"blocks"`
+	Failures int64         `json:"failures"`
+	Bytes    int64         `json:"bytes"`
+	Latency  time.Duration `json:"latency"`
+}
+
+func countRetrieval(source string, start time.Time, size int, err error) {
+	m, ok := RetrievalMetrics.Get(source).(*expvar.Map)
+	if !ok {
+		m = new(expvar.Map).Init()
+		RetrievalMetrics.Set(source, m)
+	}
+	if err != nil {
+		m.Add("failures", 1)
+		return
+	}
+	m.Add("blocks", 1)
+	m.Add("bytes", int64(size))
+	m.Add("ms", time.Since(start).Milliseconds())
+}
+
+func metricValue(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// RetrievalSourceStats returns the metrics of each retrieval source sorted by source. Latency is the average time to
+// fetch a block.
+func RetrievalSourceStats() []RetrievalStats {
+	stats := []RetrievalStats{}
+	RetrievalMetrics.Do(func(kv expvar.KeyValue) {
+		m, ok := kv.Value.(*expvar.Map)
+		if !ok {
+			return
+		}
+		s := RetrievalStats{Source: kv.Key, Blocks: metricValue(m, "blocks"), Failures: metricValue(m, "failures"), Bytes: metricValue(m, "bytes")}
+		if s.Blocks > 0 {
+			s.Latency = time.Duration(metricValue(m, "ms")/s.Blocks) * time.Millisecond
+		}
+		stats = append(stats, s)
+	})
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Source < stats[j].Source })
+	return stats
+}
+
+// WritePrometheusRetrievalMetrics writes the retrieval metrics in the Prometheus text format labelled by source.
+func WritePrometheusRetrievalMetrics(w io.Writer) {
+	stats := RetrievalSourceStats()
+	for _, metric := range []struct {
+		name  string
+		value func(RetrievalStats) int64
+	}{
+		{"patr_retrieval_blocks_total", func(s RetrievalStats) int64 { return s.Blocks }},
+		{"patr_retrieval_failures_total", func(s RetrievalStats) int64 { return s.Failures }},
+		{"patr_retrieval_bytes_total", func(s RetrievalStats) int64 { return s.Bytes }},
+	} {
+		fmt.Fprintf(w, "# TYPE %s counter\n", metric.name)
+		for _, s := range stats {
+			fmt.Fprintf(w, "%s{source=%q} %v\n", metric.name, s.Source, metric.value(s))
+		}
+	}
+}
+
+// retrievalGateways returns the gateways blocks are fetched from if bitswap can't find them, available gateways first.
+func retrievalGateways() []string {
+	available, unavailable := []string{}, []string{}
+	for _, h := range GatewayHealthStatus() {
+		if h.Available {
+			available = append(available, h.Gateway)
+		} else {
+			unavailable = append(unavailable, h.Gateway)
+		}
+	}
+	return append(available, unavailable...)
+}
+
+// RetrieveBlock returns the data of a block from the local blockstore, or fetches it from peers with bitswap. If bitswap
+// can't find the block within BitswapTimeout it is fetched from the trustless gateways, verified against its CID and
+// stored in the local blockstore.
+func RetrieveBlock(ctx context.Context, ipfscore IPFSCore, c cid.Cid) ([]byte, error) {
+	if has, _ := ipfscore.Node.Blockstore.Has(ctx, c); has {
+		return GetBlock(ctx, ipfscore, c)
+	}
+	if Offline {
+		return nil, fmt.Errorf("block %v is not stored on the node: %w", c, ErrOffline)
+	}
+	start := time.Now()
+	data, err := bitswapBlock(ctx, ipfscore, c)
+	countRetrieval(RetrievalSourceBitswap, start, len(data), err)
+	if err == nil {
+		return data, nil
+	}
+	if ctx.Err() != nil {
+		return nil, err
+	}
+	log.Warnf("could not fetch block %v with bitswap, trying gateways: %v", c, err)
+	for _, g := range retrievalGateways() {
+		start := time.Now()
+		data, gerr := gatewayBlock(ctx, g, c)
+		countRetrieval(g, start, len(data), gerr)
+		if gerr != nil {
+			log.Debugf("could not fetch block %v from gateway %s: %v", c, g, gerr)
+			continue
+		}
+		blk, _ := blocks.NewBlockWithCid(data, c)
+		if perr := ipfscore.Node.Blockstore.Put(ctx, blk); perr != nil {
+			log.Warnf("could not store block %v fetched from gateway %s: %v", c, g, perr)
+		}
+		log.Infof("fetched block %v from gateway %s", c, g)
+		return data, nil
+	}
+	return nil, fmt.Errorf("could not fetch block %v with bitswap or from gateways: %v", c, err)
+}
+
+func bitswapBlock(ctx context.Context, ipfscore IPFSCore, c cid.Cid) ([]byte, error) {
+	ctx, cancel := util.WithTimeout(ctx, BitswapTimeout)
+	defer cancel()
+	r, err := ipfscore.Api.Block().Get(ctx, ipfspath.IpldPath(c))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// gatewayBlock fetches a block from a trustless gateway as a raw block, or as a CAR of the block if the gateway does not
+// serve raw blocks, and verifies it against its CID.
+func gatewayBlock(ctx context.Context, gateway string, c cid.Cid) ([]byte, error) {
+	ctx, cancel := util.WithTimeout(ctx, DHTQueryTimeout)
+	defer cancel()
+	url := strings.TrimSuffix(gateway, "/") + "/ipfs/" + c.String()
+	data, err := gatewayGet(ctx, url+"?format=raw", "application/vnd.ipld.raw")
+	if err == nil {
+		return verifyBlock(c, data)
+	}
+	car, cerr := gatewayGet(ctx, url+"?format=car&dag-scope=block", "application/vnd.ipld.car")
+	if cerr != nil {
+		return nil, err
+	}
+	br, err := carv2.NewBlockReader(bytes.NewReader(car))
+	if err != nil {
+		return nil, fmt.Errorf("invalid CAR: %v", err)
+	}
+	for {
+		blk, err := br.Next()
+		if err != nil {
+			return nil, fmt.Errorf("the CAR does not contain the block: %v", err)
+		}
+		if blk.Cid().Equals(c) {
+			return verifyBlock(c, blk.RawData())
+		}
+	}
+}
+
+func gatewayGet(ctx context.Context, url string, accept string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", accept)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, &util.HTTPStatusError{StatusCode: res.StatusCode, Status: res.Status}
+	}
+	// a CAR has a header and the CID of the block as well as the block
+	data, err := io.ReadAll(io.LimitReader(res.Body, MaxBlockSize+4096))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxBlockSize+4095 {
+		return nil, fmt.Errorf("the response is larger than the maximum block size")
+	}
+	return data, nil
+}
+
+// verifyBlock checks that the data of a block hashes to its CID, since gateways are not trusted.
+func verifyBlock(c cid.Cid, data []byte) ([]byte, error) {
+	h, err := c.Prefix().Sum(data)
+	if err != nil || !h.Equals(c) {
+		return nil, fmt.Errorf("block %v failed hash verification", c)
+	}
+	return data, nil
+}
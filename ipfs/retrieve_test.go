@@ -0,0 +1,40 @@
+package ipfs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+
+	"github.com/allisterb/patr/internal/testutil"
+)
+
+func TestGatewayBlockAborts(t *testing.T) {
+	gateway := testutil.HangingServer(t)
+	h, err := mh.Sum([]byte("patr"), mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cid.NewCidV1(cid.Raw, h)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	testutil.Aborts(t, "gatewayBlock with a cancelled context", func() error {
+		_, err := gatewayBlock(ctx, gateway, c)
+		return err
+	})
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	testutil.Aborts(t, "gatewayBlock with an expired context", func() error {
+		_, err := gatewayBlock(ctx, gateway, c)
+		return err
+	})
+	timeout := DHTQueryTimeout
+	DHTQueryTimeout = 20 * time.Millisecond
+	defer func() { DHTQueryTimeout = timeout }()
+	testutil.Aborts(t, "gatewayBlock with DHTQueryTimeout", func() error {
+		_, err := gatewayBlock(context.Background(), gateway, c)
+		return err
+	})
+}
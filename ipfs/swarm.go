@@ -0,0 +1,85 @@
+package ipfs
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// DefaultSwarmPort is the port the IPFS node listens on for peers if no port is configured.
+const DefaultSwarmPort = 4001
+
+// SwarmConfig is where the IPFS node listens for connections from peers and the addresses it announces to them. The
+// node listens on TCP and QUIC on Port of Host, by default all IPv4 and IPv6 interfaces. Addrs replaces these listen
+// addresses with multiaddrs. AnnounceAddrs replaces the addresses announced to peers, e.g. with the public address of
+// a node behind NAT with a forwarded port.
+type SwarmConfig struct {
+	Host          string
+	Port          int
+	Addrs         []string
+	AnnounceAddrs []string
+}
+
+// Swarm is the swarm configuration of the IPFS node.
+var Swarm = SwarmConfig{}
+
+// Validate checks the host, port and multiaddrs of a swarm configuration.
+func (s SwarmConfig) Validate() error {
+	if s.Host != "" && net.ParseIP(s.Host) == nil {
+		return fmt.Errorf("invalid swarm host %s, must be an IPv4 or IPv6 address", s.Host)
+	}
+	if s.Port < 0 || s.Port > 65535 {
+		return fmt.Errorf("invalid swarm port %v", s.Port)
+	}
+	for _, a := range append(append([]string{}, s.Addrs...), s.AnnounceAddrs...) {
+		if _, err := ma.NewMultiaddr(a); err != nil {
+			return fmt.Errorf("invalid swarm address %s: %v", a, err)
+		}
+	}
+	return nil
+}
+
+// ListenAddrs returns the multiaddrs the IPFS node listens on. If the swarm port was not set and the default port is in
+// use, e.g. by a Kubo daemon or a running patr node when a command is run, the node listens on a random port.
+func (s SwarmConfig) ListenAddrs() []string {
+	if len(s.Addrs) > 0 {
+		return s.Addrs
+	}
+	port := s.Port
+	if port == 0 {
+		port = DefaultSwarmPort
+		if !portAvailable(s.Host, port) {
+			log.Warnf("swarm port %v is in use, listening on a random port", port)
+			port = 0
+		}
+	}
+	hosts := []string{"/ip4/0.0.0.0", "/ip6/::"}
+	if ip := net.ParseIP(s.Host); ip != nil && ip.To4() != nil {
+		hosts = []string{"/ip4/" + s.Host}
+	} else if ip != nil {
+		hosts = []string{"/ip6/" + s.Host}
+	}
+	addrs := []string{}
+	for _, h := range hosts {
+		addrs = append(addrs, fmt.Sprintf("%s/tcp/%v", h, port), fmt.Sprintf("%s/udp/%v/quic-v1", h, port))
+	}
+	return addrs
+}
+
+// portAvailable returns true if a TCP and UDP port can be bound on a host.
+func portAvailable(host string, port int) bool {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return false
+	}
+	l.Close()
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return false
+	}
+	pc.Close()
+	return true
+}
@@ -0,0 +1,122 @@
+package ipfs
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/allisterb/patr/util"
+)
+
+// Sync modes. Text-only sync fetches the text and metadata of posts but not their attachments, media or thumbnails.
+// Auto sync is text-only while the default route is over a metered interface.
+const (
+	SyncFull     = "full"
+	SyncTextOnly = "text-only"
+	SyncAuto     = "auto"
+)
+
+// DefaultMeteredInterfaces are the names of interfaces which are usually metered mobile, satellite or tethered links.
+var DefaultMeteredInterfaces = []string{"ppp*", "wwan*", "wwp*", "rmnet*", "usb*", "sat*"}
+
+// MeteredCheckInterval is how long the metered state of the default route is cached.
+var MeteredCheckInterval = time.Minute
+
+var syncLock = sync.Mutex{}
+var syncMode = SyncFull
+var interfaceSyncModes = map[string]string{}
+var meteredIface string
+var meteredChecked time.Time
+
+// ValidSyncMode returns an error if a sync mode is not full, text-only or auto.
+func ValidSyncMode(mode string) error {
+	switch mode {
+	case SyncFull, SyncTextOnly, SyncAuto:
+		return nil
+	default:
+		return fmt.Errorf("unknown sync mode %s, must be one of %s, %s or %s", mode, SyncFull, SyncTextOnly, SyncAuto)
+	}
+}
+
+// SetSyncMode sets the global sync mode and the modes of interfaces, keyed by interface name or glob like wwan*. An
+// interface mode overrides the global mode while the default route is over the interface.
+func SetSyncMode(mode string, interfaces map[string]string) {
+	syncLock.Lock()
+	defer syncLock.Unlock()
+	if mode == "" {
+		mode = SyncFull
+	}
+	syncMode = mode
+	interfaceSyncModes = map[string]string{}
+	for i, m := range interfaces {
+		interfaceSyncModes[i] = m
+	}
+	meteredChecked = time.Time{}
+}
+
+// defaultRouteInterface returns the name of the interface of the default IPv4 route, or "" if it can't be found.
+func defaultRouteInterface() string {
+	if runtime.GOOS != "linux" {
+		return ""
+	}
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) > 2 && fields[1] == "00000000" {
+			return fields[0]
+		}
+	}
+	return ""
+}
+
+func matchInterface(patterns []string, iface string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, iface); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// SyncStatus returns the sync mode in effect, the interface of the default route and whether the interface is metered.
+func SyncStatus() (string, string, bool) {
+	syncLock.Lock()
+	defer syncLock.Unlock()
+	if meteredChecked.IsZero() || util.Now().Sub(meteredChecked) > MeteredCheckInterval {
+		meteredIface = defaultRouteInterface()
+		meteredChecked = util.Now()
+	}
+	iface := meteredIface
+	metered := iface != "" && matchInterface(DefaultMeteredInterfaces, iface)
+	mode := syncMode
+	for p, m := range interfaceSyncModes {
+		if iface != "" && matchInterface([]string{p}, iface) {
+			mode = m
+			break
+		}
+	}
+	if mode == SyncAuto {
+		if metered {
+			mode = SyncTextOnly
+		} else {
+			mode = SyncFull
+		}
+	}
+	return mode, iface, metered
+}
+
+// TextOnly returns true if media blocks should not be fetched.
+func TextOnly() bool {
+	mode, _, _ := SyncStatus()
+	return mode == SyncTextOnly
+}
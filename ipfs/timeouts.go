@@ -0,0 +1,15 @@
+package ipfs
+
+import "time"
+
+// Timeouts for IPFS operations which can otherwise hang indefinitely. They can be changed in the node configuration.
+var (
+	PinTimeout         = 5 * time.Minute
+	IPNSPublishTimeout = 2 * time.Minute
+	IPNSResolveTimeout = time.Minute
+	DHTQueryTimeout    = time.Minute
+	// BitswapTimeout is how long a block is looked for with bitswap before it is fetched from trustless gateways.
+	BitswapTimeout = 20 * time.Second
+	// PinningServiceTimeout is the timeout of requests to remote pinning services.
+	PinningServiceTimeout = time.Minute
+)
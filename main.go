@@ -1,55 +1,296 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/alecthomas/kong"
+	"github.com/ipfs/go-cid"
 	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/mbndr/figlet4go"
+	gonostr "github.com/nbd-wtf/go-nostr"
 	nip19 "github.com/nbd-wtf/go-nostr/nip19"
 
 	"github.com/allisterb/patr/blockchain"
+	"github.com/allisterb/patr/bot"
+	"github.com/allisterb/patr/devnet"
 	"github.com/allisterb/patr/did"
 	"github.com/allisterb/patr/feed"
 	"github.com/allisterb/patr/ipfs"
 	"github.com/allisterb/patr/node"
 	"github.com/allisterb/patr/nostr"
 	"github.com/allisterb/patr/p2p"
+	"github.com/allisterb/patr/topics"
 	"github.com/allisterb/patr/util"
+	"github.com/allisterb/patr/w3s"
+	"github.com/allisterb/patr/wiki"
 )
 
 type NodeCmd struct {
-	Cmd string `arg:"" name:"cmd" help:"The command to run. Can be one of: init."`
+	Cmd string `arg:"" name:"cmd" help:"The command to run. Can be one of: init, run, encrypt, decrypt, features, sync, peering, w3up."`
 	Did string `arg:"" optional:"" name:"did" help:"Use the DID linked to this name."`
 }
 
 type DidCmd struct {
-	Cmd  string `arg:"" name:"cmd" help:"The command to run. Can be one of: resolve, dm"`
+	Cmd  string `arg:"" name:"cmd" help:"The command to run. Can be one of: resolve, dm, migrate"`
 	Name string `arg:"" name:"name" help:"Get the DID linked to this name."`
 	Arg  string `arg:"" optional:"" name:"did" help:"Argument for the DID command."`
 }
 
 type FeedCmd struct {
-	Cmd string `arg:"" name:"cmd" help:"The command to run. Can be one of: create."`
+	Cmd       string `arg:"" name:"cmd" help:"The command to run. Can be one of: create, post, timeline, resolve."`
+	Arg       string `arg:"" optional:"" name:"arg" help:"The text to post, the DID of a followed feed to show the timeline of or the patr:// or gateway permalink of the post to resolve."`
+	Protected string `optional:"" name:"protected" help:"The body of a non-public post only your approved followers can read. The text to post is shown to everyone."`
+	Codec     string `optional:"" name:"codec" help:"The IPLD codec of the feed profile, dag-cbor or dag-json. The default is the codec in the node configuration."`
 }
 
 type NostrCmd struct {
-	Cmd string `arg:"" name:"cmd" help:"The command to run. Can be one of: create-event."`
+	Cmd    string   `arg:"" name:"cmd" help:"The command to run. Can be one of: create-event, delegate, revoke-delegation, topics, encode, decode, dm."`
+	Args   []string `arg:"" optional:"" name:"args" help:"Arguments for the Nostr command."`
+	Scheme string   `optional:"" name:"scheme" default:"nip44" help:"The encryption scheme of DMs, nip44 or nip04 for clients which only support NIP-04."`
+	Tags   []string `optional:"" name:"tag" sep:"none" help:"A tag of the created event as comma-separated values, e.g. t,patr. Can be repeated."`
+}
+
+type BotCmd struct {
+	Cmd  string `arg:"" name:"cmd" help:"The command to run. Can be one of: create, list, delete."`
+	Name string `arg:"" optional:"" name:"name" help:"The name of the bot."`
+	Rate int    `optional:"" name:"rate" default:"60" help:"The maximum number of posts per hour the bot can make."`
+}
+
+type KeysCmd struct {
+	Cmd  string `arg:"" name:"cmd" help:"The command to run. Can be one of: create, list, rotate, convert, publish, resolve."`
+	Name string `arg:"" optional:"" name:"name" help:"The name of the IPNS key e.g. profile, feed, media, site."`
+	Path string `arg:"" optional:"" name:"path" help:"The IPFS path to publish."`
+	Type string `help:"The type of key to create, ed25519 or rsa. The default is the IPNSKeyType in the configuration file."`
+}
+
+type ImportCmd struct {
+	Cmd  string `arg:"" name:"cmd" help:"The command to run. Can be one of: file, twitter."`
+	Path string `arg:"" name:"path" help:"The path to the file or archive to import."`
+}
+
+type PeersCmd struct {
+	Cmd    string `arg:"" name:"cmd" help:"The command to run. Can be one of: block, unblock, list, report."`
+	Peer   string `arg:"" optional:"" name:"peer" help:"The peer ID or CIDR range."`
+	Reason string `arg:"" optional:"" name:"reason" help:"The reason for an abuse report."`
+}
+
+type BackupCmd struct {
+	Cmd  string `arg:"" name:"cmd" help:"The command to run. Can be one of: create, restore."`
+	Path string `arg:"" name:"path" help:"The path to the CAR archive."`
+}
+
+type BundleCmd struct {
+	Cmd  string `arg:"" name:"cmd" help:"The command to run. Can be one of: export, import."`
+	Path string `arg:"" name:"path" help:"The path to the CAR archive of the update bundle."`
+}
+
+type RelayCmd struct {
+	Cmd    string `arg:"" name:"cmd" help:"The command to run. Can be one of: export, import, events, delete, ban, unban, bans."`
+	Arg    string `arg:"" optional:"" name:"arg" help:"The path to the JSONL file of events to export or import, the ID of the event to delete or the pubkey to ban or unban."`
+	Filter string `optional:"" name:"filter" default:"{}" help:"A Nostr filter in JSON format selecting the events to export or list."`
+	Reason string `optional:"" name:"reason" help:"The reason an event is deleted or a pubkey is banned."`
+	Token  string `optional:"" name:"token" env:"PATR_API_TOKEN" help:"An API token with the admin scope for the relay admin commands, which are run by the running node."`
+}
+
+type FollowsCmd struct {
+	Cmd     string `arg:"" name:"cmd" help:"The command to run. Can be one of: add, request, remove, list, backfill, prune, tag, untag, mirror, unmirror."`
+	Target  string `arg:"" optional:"" name:"target" help:"The DID, npub, nprofile or scanned patr:// identity of the author or the hashtag."`
+	Feed    string `arg:"" optional:"" name:"feed" help:"The IPNS name the author publishes their feed to. It is read from the profile of authors followed by npub if not specified."`
+	Rules   string `optional:"" help:"The replication rules of a mirrored community feed e.g. '!attachments=*.mp4,attachments=*:524288'."`
+	Months  int    `optional:"" default:"6" help:"Prune followed feeds with no posts for this many months."`
+	Yes     bool   `optional:"" help:"Prune without asking for confirmation."`
+	Message string `optional:"" help:"A message to send with a follow request to a protected account."`
+}
+
+type RequestsCmd struct {
+	Cmd string `arg:"" name:"cmd" help:"The command to run. Can be one of: list, approve, deny."`
+	Did string `arg:"" optional:"" name:"did" help:"The DID of the user who asked to follow you."`
+}
+
+type TokensCmd struct {
+	Cmd    string `arg:"" name:"cmd" help:"The command to run. Can be one of: create, list, revoke."`
+	Name   string `arg:"" optional:"" name:"name" help:"The name of the API token."`
+	Scopes string `optional:"" name:"scopes" default:"read" help:"The comma-separated scopes of the API token. Can be read, post or admin."`
+}
+
+type LiveCmd struct {
+	Cmd     string `arg:"" name:"cmd" help:"The command to run. Can be one of: plan, start, end."`
+	ID      string `arg:"" name:"id" help:"The identifier of the live activity."`
+	Title   string `optional:"" name:"title" help:"The title of the live activity."`
+	URL     string `optional:"" name:"url" help:"The URL of the HLS or IPFS-hosted playlist of the stream."`
+	Summary string `optional:"" name:"summary" help:"A summary of the live activity."`
+	Image   string `optional:"" name:"image" help:"The URL of the preview image of the live activity."`
+}
+
+type CalendarCmd struct {
+	Cmd      string `arg:"" name:"cmd" help:"The command to run. Can be one of: create, rsvp."`
+	ID       string `arg:"" name:"id" help:"The identifier of the calendar event, or the coordinate of the calendar event to RSVP to."`
+	Title    string `optional:"" name:"title" help:"The title of the calendar event."`
+	Start    string `optional:"" name:"start" help:"The start of the calendar event as a date like 2006-01-02 or an RFC3339 time."`
+	End      string `optional:"" name:"end" help:"The end of the calendar event as a date like 2006-01-02 or an RFC3339 time."`
+	Location string `optional:"" name:"location" help:"The location of the calendar event."`
+	Summary  string `optional:"" name:"summary" help:"A summary of the calendar event."`
+	Status   string `optional:"" name:"status" default:"accepted" help:"The RSVP status. Can be accepted, declined or tentative."`
+}
+
+type ListingsCmd struct {
+	Cmd       string   `arg:"" name:"cmd" help:"The command to run. Can be one of: create, close."`
+	ID        string   `arg:"" name:"id" help:"The identifier of the listing."`
+	Title     string   `optional:"" name:"title" help:"The title of the listing."`
+	Summary   string   `optional:"" name:"summary" help:"A short summary of the listing."`
+	Text      string   `optional:"" name:"text" help:"The description of the listing."`
+	Price     float64  `optional:"" name:"price" help:"The price of the listing."`
+	Currency  string   `optional:"" name:"currency" help:"The currency of the price e.g. USD, EUR or SATS."`
+	Frequency string   `optional:"" name:"frequency" help:"The period the price is for e.g. month."`
+	Images    []string `optional:"" name:"images" help:"The URLs of the images of the listing."`
+	Location  string   `optional:"" name:"location" help:"The location of the listing."`
+	Geohash   string   `optional:"" name:"geohash" help:"The geohash of the location of the listing."`
+	Tags      []string `optional:"" name:"tags" help:"The hashtags of the listing."`
+}
+
+type DocsCmd struct {
+	Cmd  string `arg:"" name:"cmd" help:"The command to run. Can be one of: write, merge, show, history."`
+	Name string `arg:"" name:"name" help:"The name of the document."`
+	Arg  string `arg:"" optional:"" name:"arg" help:"The path of the file with the new text of the document, or the CID of the head to merge."`
+}
+
+type ProfileCmd struct {
+	Cmd         string `arg:"" name:"cmd" help:"The command to run. Can be one of: show, set, sync, protect, unprotect."`
+	Name        string `optional:"" name:"name" help:"Your user name."`
+	DisplayName string `optional:"" name:"display-name" help:"Your display name."`
+	About       string `optional:"" name:"about" help:"A description of yourself."`
+	Picture     string `optional:"" name:"picture" help:"The URL of your profile picture."`
+	Banner      string `optional:"" name:"banner" help:"The URL of your profile banner."`
+	Website     string `optional:"" name:"website" help:"The URL of your website."`
+	NIP05       string `optional:"" name:"nip05" help:"Your NIP-05 identifier."`
+	LUD16       string `optional:"" name:"lud16" help:"Your Lightning address."`
+}
+
+type PinsCmd struct {
+	Cmd    string   `arg:"" name:"cmd" help:"The command to run. Can be one of: quote, accept, list, audit, status, remote-pin, remote-unpin."`
+	Arg    string   `arg:"" optional:"" name:"arg" help:"The peer ID of the pinning provider to ask for a quote, the ID of the quote to accept or the CID to pin with the remote pinning services or show the status of."`
+	Cids   []string `optional:"" name:"cids" help:"The CIDs of the DAGs to pin."`
+	GiB    float64  `optional:"" name:"gib" help:"The total size of the DAGs to pin in GiB."`
+	Months int      `optional:"" name:"months" default:"12" help:"The number of months to pin the DAGs for."`
+	TxHash string   `optional:"" name:"tx" help:"The hash of the Ethereum transaction paying for the quote."`
+	Zap    string   `optional:"" name:"zap" help:"The path of a JSON file with the zap receipt paying for the quote."`
+}
+
+type MediaCmd struct {
+	Cmd string `arg:"" name:"cmd" help:"The command to run. Can be one of: pins, expire, bookmark, unbookmark."`
+	Cid string `arg:"" optional:"" name:"cid" help:"The CID of the attachment or post to bookmark."`
+}
+
+type QRCmd struct {
+	Cmd    string `arg:"" name:"cmd" help:"The command to run. Can be one of: identity, npub, post."`
+	Arg    string `arg:"" optional:"" name:"arg" help:"The CID of the post to share."`
+	Out    string `optional:"" name:"out" help:"Write the QR code to this PNG file instead of the terminal."`
+	Invert bool   `optional:"" name:"invert" help:"Invert the QR code for terminals with light backgrounds."`
+	Patr   bool   `optional:"" name:"patr" help:"Encode the patr:// permalink of the post instead of the gateway URL."`
+}
+
+type ContactsCmd struct {
+	Cmd string `arg:"" name:"cmd" help:"The command to run. Can be one of: verify, confirm, list, reset."`
+	Did string `arg:"" optional:"" name:"did" help:"The DID of the contact."`
+}
+
+type PanicCmd struct {
+	Reason string `optional:"" name:"reason" help:"A message to add to the revocation of your keys."`
+	Yes    bool   `optional:"" help:"Revoke and wipe your keys without asking for confirmation."`
+}
+
+type DiagCmd struct {
+	Cmd string `arg:"" name:"cmd" help:"The command to run. Can be one of: sync, peers."`
+	Did string `arg:"" optional:"" name:"did" help:"Only diagnose the sync of the feed of this DID."`
+}
+
+type LockCmd struct {
+	Cmd string `arg:"" name:"cmd" help:"The command to run. Can be one of: lock, unlock, status, passphrase."`
+}
+
+type LinksCmd struct {
+	Cmd string `arg:"" name:"cmd" help:"The command to run. Can be one of: check, list, dead, archive."`
+	URL string `arg:"" optional:"" name:"url" help:"The link to record an archived copy of."`
+	Cid string `arg:"" optional:"" name:"cid" help:"The CID of the archived copy of the link."`
+}
+
+type RootCmd struct {
+	Cmd     string            `arg:"" name:"cmd" help:"The command to run. Can be one of: publish, show."`
+	Name    string            `arg:"" optional:"" name:"name" help:"The IPNS name of the root to show. The default is your root."`
+	Objects map[string]string `name:"object" help:"The CID of a new version of an object e.g. --object feed=<cid> --object site=<cid>. Objects can be profile, feed, media, site or an app namespace."`
+}
+
+type AppsCmd struct {
+	Cmd       string `arg:"" name:"cmd" help:"The command to run. Can be one of: list, register, publish, patch."`
+	Namespace string `arg:"" optional:"" name:"namespace" help:"The app namespace e.g. patr.blog or example.com."`
+	Cid       string `arg:"" optional:"" name:"cid" help:"The CID of the new head of the app's data, or for patch the file of the DAG-JSON IPLD patch to apply to the head."`
+}
+
+type DevicesCmd struct {
+	Cmd string `arg:"" name:"cmd" help:"The command to run. Can be one of: list, revoke."`
+	ID  string `arg:"" optional:"" name:"id" help:"The ID of the device session."`
 }
 
 var log = logging.Logger("patr/main")
 
 // Command-line arguments
 var CLI struct {
-	Node  NodeCmd  `cmd:"" help:"Run Patr node commands."`
-	Did   DidCmd   `cmd:"" help:"Run commands on the DID linked to a name."`
-	Feed  FeedCmd  `cmd:"" help:"Run Patr feed commands."`
-	Nostr NostrCmd `cmd:"" help:"Run Nostr commands."`
+	Node         NodeCmd     `cmd:"" help:"Run Patr node commands."`
+	Did          DidCmd      `cmd:"" help:"Run commands on the DID linked to a name."`
+	Feed         FeedCmd     `cmd:"" help:"Run Patr feed commands."`
+	Nostr        NostrCmd    `cmd:"" help:"Run Nostr commands."`
+	Bot          BotCmd      `cmd:"" help:"Run bot commands."`
+	Keys         KeysCmd     `cmd:"" help:"Manage the IPNS names linked to your DID."`
+	Import       ImportCmd   `cmd:"" help:"Import posts into your feed."`
+	Peers        PeersCmd    `cmd:"" help:"Block and report abusive peers."`
+	Backup       BackupCmd   `cmd:"" help:"Back up and restore your public data as indexed CAR archives."`
+	Bundle       BundleCmd   `cmd:"" help:"Export and import update bundles of feeds to carry between nodes which can't reach each other."`
+	Relay        RelayCmd    `cmd:"" help:"Export and import relay events as newline-delimited JSON."`
+	Follows      FollowsCmd  `cmd:"" help:"Manage the feeds you follow."`
+	Requests     RequestsCmd `cmd:"" help:"Approve or deny follow requests to your protected account."`
+	Tokens       TokensCmd   `cmd:"" help:"Manage the API tokens clients use to access your node."`
+	Devices      DevicesCmd  `cmd:"" help:"List and revoke the devices and clients connected to your node API."`
+	Live         LiveCmd     `cmd:"" help:"Announce live streams to your followers."`
+	Calendar     CalendarCmd `cmd:"" help:"Publish calendar events and RSVPs."`
+	Listings     ListingsCmd `cmd:"" help:"Publish and close classified listings in the marketplace."`
+	Docs         DocsCmd     `cmd:"" help:"Edit and merge collaborative documents."`
+	Links        LinksCmd    `cmd:"" help:"Check the links in your posts for link rot."`
+	Profile      ProfileCmd  `cmd:"" help:"Manage your profile and sync it with your Nostr metadata on external relays."`
+	Pins         PinsCmd     `cmd:"" help:"Negotiate paid pinning of your content with other nodes and audit it."`
+	Media        MediaCmd    `cmd:"" help:"Manage the media of followed users pinned by your node."`
+	QR           QRCmd       `cmd:"" name:"qr" help:"Show QR codes of your identity and posts to share in person."`
+	Contacts     ContactsCmd `cmd:"" help:"Verify your contacts by comparing short authentication strings."`
+	Panic        PanicCmd    `cmd:"" help:"Revoke your keys and wipe them from this device if it is about to be seized or is compromised."`
+	Diag         DiagCmd     `cmd:"" help:"Diagnose why your timeline is stale and show the latency of connected peers."`
+	Lock         LockCmd     `cmd:"" help:"Lock publishing until you re-enter your passphrase."`
+	Apps         AppsCmd     `cmd:"" help:"Manage the namespaces other apps store data in under your identity."`
+	Root         RootCmd     `cmd:"" help:"Publish new versions of your profile, feed, site and app data together under your root IPNS name."`
+	DryRun       bool        `name:"dry-run" help:"Show the blocks that would be pinned, the names that would be published and the remote services that would be contacted without doing anything."`
+	Offline      bool        `name:"offline" help:"Start the IPFS node without connecting to peers or gateways, to create profiles and posts and inspect the local DAG. Names and uploads are published the next time the node runs online."`
+	Devnet       bool        `name:"devnet" help:"Run on the local devnet with deterministic keys and mocked Web3.Storage and ENS services."`
+	DevnetNode   int         `name:"devnet-node" default:"0" help:"The index of this node on the devnet."`
+	DevnetFaults string      `name:"devnet-faults" env:"PATR_DEVNET_FAULTS" help:"Inject faults on the devnet as point:rate[:delay] pairs, e.g. w3s-upload:0.3,ipns-resolve:0:5s,block-fetch:0.1."`
+	Passphrase   string      `name:"passphrase" env:"PATR_PASSPHRASE" help:"The passphrase the node data files are encrypted with."`
+	SwarmHost    string      `name:"swarm-host" env:"PATR_SWARM_HOST" help:"The IP address the IPFS node listens on for peers, e.g. 0.0.0.0 for a public node. By default all interfaces."`
+	SwarmPort    int         `name:"swarm-port" env:"PATR_SWARM_PORT" help:"The TCP and UDP port the IPFS node listens on for peers. By default 4001, or a random port if 4001 is in use."`
+	SwarmAddrs   []string    `name:"swarm-addr" env:"PATR_SWARM_ADDRS" help:"Multiaddrs the IPFS node listens on, replacing the swarm host and port."`
+	Announce     []string    `name:"announce-addr" env:"PATR_ANNOUNCE_ADDRS" help:"Multiaddrs the IPFS node announces to peers instead of its listen addresses, e.g. its public address behind NAT."`
+	LogSensitive bool        `name:"log-sensitive" help:"Log private keys, tokens and DM content without redacting them. Only for debugging."`
 }
 
 func init() {
@@ -79,12 +320,46 @@ func main() {
 	fmt.Print(renderStr)
 
 	ctx := kong.Parse(&CLI)
-	ctx.FatalIfErrorf(ctx.Run(&kong.Context{}))
+	util.DryRun = CLI.DryRun
+	ipfs.Offline = CLI.Offline
+	util.LogSensitive = CLI.LogSensitive
+	if err := util.RedactLogs(); err != nil {
+		ctx.FatalIfErrorf(err)
+	}
+	if util.LogSensitive {
+		log.Warnf("logging sensitive values without redaction")
+	}
+	util.AddSecrets(CLI.Passphrase)
+	if CLI.Devnet {
+		ctx.FatalIfErrorf(node.EnableDevnet(CLI.DevnetNode))
+	}
+	ctx.FatalIfErrorf(devnet.SetFaults(CLI.DevnetFaults))
+	node.SwarmFlags = ipfs.SwarmConfig{Host: CLI.SwarmHost, Port: CLI.SwarmPort, Addrs: CLI.SwarmAddrs, AnnounceAddrs: CLI.Announce}
+	ctx.FatalIfErrorf(node.SwarmFlags.Validate())
+	if util.DatastoreEncrypted() {
+		if CLI.Passphrase == "" {
+			ctx.Fatalf("the node data files are encrypted, specify the passphrase with --passphrase or PATR_PASSPHRASE")
+		}
+		ctx.FatalIfErrorf(util.UnlockDatastore(CLI.Passphrase))
+	}
+	err := ctx.Run(&kong.Context{})
+	if CLI.DevnetFaults != "" {
+		log.Infof("injected faults: %s", devnet.FaultSummary())
+	}
+	ctx.FatalIfErrorf(err)
 }
 
 func (c *NodeCmd) Run(clictx *kong.Context) error {
 	switch strings.ToLower(c.Cmd) {
 	case "init":
+		if devnet.Enabled {
+			config, err := node.InitDevnetConfig(devnet.Node)
+			if err != nil {
+				return err
+			}
+			log.Infof("devnet node %v initialized with DID %s and identity %s", devnet.Node, config.Did, ipfs.GetIPFSNodeIdentity(config.IPFSPubKey).Pretty())
+			return nil
+		}
 		if c.Did == "" {
 			return fmt.Errorf("you must specify a user DID to initialize the node")
 		}
@@ -120,6 +395,29 @@ func (c *NodeCmd) Run(clictx *kong.Context) error {
 			log.Infof("Nostr secp256k1 public key (nostrKey): %s\n", nppk)
 		}
 
+		keys := make(map[string]ipfs.NamedKey)
+		for _, n := range ipfs.DefaultKeyNames {
+			k, err := ipfs.GenerateNamedKey()
+			if err != nil {
+				log.Errorf("could not generate IPNS key %s: %v", n, err)
+				return err
+			}
+			keys[n] = k
+			log.Infof("IPNS name for %s is %s", n, k.Name())
+		}
+
+		seed, err := node.NewMasterSeed()
+		if err != nil {
+			log.Errorf("could not generate master seed: %v", err)
+			return err
+		}
+
+		agentkey, err := w3s.GenerateAgentKey()
+		if err != nil {
+			log.Errorf("could not generate w3up agent key: %v", err)
+			return err
+		}
+
 		//nssk, _ := nip19.EncodePrivateKey(nsk)
 		//nppk, _ := nip19.EncodePublicKey(npk)
 		config := node.Config{
@@ -128,6 +426,9 @@ func (c *NodeCmd) Run(clictx *kong.Context) error {
 			IPFSPrivKey:  priv,
 			NostrPrivKey: nsk,
 			NostrPubKey:  npk,
+			IPNSKeys:     keys,
+			MasterSeed:   seed,
+			W3UpAgentKey: agentkey,
 		}
 		data, _ := json.MarshalIndent(config, "", " ")
 		err = os.WriteFile(filepath.Join(d, "node.json"), data, 0644)
@@ -138,14 +439,110 @@ func (c *NodeCmd) Run(clictx *kong.Context) error {
 		log.Infof("user DID is %s", c.Did)
 		log.Infof("node identity is %s", ipfs.GetIPFSNodeIdentity(pub).Pretty())
 		log.Infof("patr node configuration initialized at %s", filepath.Join(d, "node.json"))
-		log.Info("add your Infura and Web3.Storage API secret keys to this file to complete the configuration")
+		log.Info("add your Infura API secret key to this file and run patr node w3up to set up Web3.Storage to complete the configuration")
 		return nil
 
 	case "run":
-		ctx, _ := context.WithCancel(context.Background())
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		node.OnStarted = append(node.OnStarted, feed.StartBackfill, feed.SetFollowHandlers, feed.SetPaidHandlers, feed.SetPostHandlers, feed.StartPendingPublish, feed.StartFeedPush, feed.StartLinkCheck, feed.StartMediaPinExpiry, feed.SetPermalinkHandlers, feed.SetDiagHandlers, wiki.SetDocumentHandlers)
+		node.OnReload = append(node.OnReload, feed.ScheduleLinkCheck)
 		err := node.Run(ctx)
 		return err
 
+	case "encrypt":
+		if err := util.EnableDatastoreEncryption(CLI.Passphrase); err != nil {
+			return err
+		}
+		log.Infof("encrypted node data files in %s, the passphrase is now required to run patr", util.AppData)
+		return nil
+
+	case "decrypt":
+		if err := util.DisableDatastoreEncryption(); err != nil {
+			return err
+		}
+		log.Infof("decrypted node data files in %s", util.AppData)
+		return nil
+
+	case "features":
+		if _, err := node.LoadConfig(); err != nil {
+			return err
+		}
+		flags := []string{}
+		for f := range util.KnownFeatures {
+			flags = append(flags, f)
+		}
+		sort.Strings(flags)
+		for _, f := range flags {
+			state := "disabled"
+			if util.FeatureEnabled(f) {
+				state = "enabled"
+			}
+			fmt.Printf("%s	%s	%s\n", f, state, util.KnownFeatures[f])
+		}
+		return nil
+
+	case "sync":
+		if _, err := node.LoadConfig(); err != nil {
+			return err
+		}
+		mode, iface, metered := ipfs.SyncStatus()
+		if iface == "" {
+			iface = "unknown"
+		}
+		fmt.Printf("Sync mode: %s\nInterface: %s\nMetered: %v\n", mode, iface, metered)
+		return nil
+
+	case "peering":
+		if _, err := node.LoadConfig(); err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+		defer cancel()
+		peers, err := node.UpdatePeering(ctx)
+		if err != nil {
+			return err
+		}
+		for _, p := range peers {
+			fmt.Printf("%s	%s	%s\n", p.Did, p.PeerID, p.Added.Format(time.RFC3339))
+		}
+		return nil
+
+	case "w3up":
+		config, err := node.LoadConfig()
+		if err != nil {
+			return err
+		}
+		if config.W3UpAgentKey == "" {
+			if config.W3UpAgentKey, err = w3s.GenerateAgentKey(); err != nil {
+				log.Errorf("could not generate w3up agent key: %v", err)
+				return err
+			}
+			if err = node.SaveConfig(config); err != nil {
+				return err
+			}
+		}
+		a, err := w3s.ParseAgent(config.W3UpAgentKey)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("agent\t%s\n", a.DID())
+		if config.W3UpProof == "" {
+			log.Infof("delegate your space to the agent with w3 delegation create %s --can store/add --can upload/add --base64 and set W3UpProof in the configuration file to the output", a.DID())
+			return nil
+		}
+		if err = w3s.ConfigureUp(config.W3UpAgentKey, config.W3UpSpace, config.W3UpProof); err != nil {
+			return err
+		}
+		d, _ := w3s.ParseDelegation(config.W3UpProof)
+		fmt.Printf("delegation\t%v\n", d.Root)
+		space := config.W3UpSpace
+		if space == "" {
+			space = strings.Join(d.Resources, ",")
+		}
+		fmt.Printf("space\t%s\n", space)
+		return nil
+
 	default:
 		return fmt.Errorf("Unknown node command: %s", c.Cmd)
 	}
@@ -171,7 +568,13 @@ func (c *DidCmd) Run(clictx *kong.Context) error {
 		}
 		r, err := blockchain.ResolveENS(d.ID.ID, config.InfuraSecretKey)
 		if err == nil {
-			fmt.Printf("ETH Address: %s\nNostr Public-Key: %v\nIPFS Public-Key: %s\nContent-Hash: %s\nAvatar: %s", r.Address, r.NostrPubKey, r.IPFSPubKey, r.ContentHash, r.Avatar)
+			avatar := r.Avatar
+			if r.AvatarNFT != nil && r.AvatarNFT.Verified {
+				avatar += " (verified NFT)"
+			} else if r.AvatarNFT != nil {
+				avatar += " (unverified NFT)"
+			}
+			fmt.Printf("ETH Address: %s\nNostr Public-Key: %v\nIPFS Public-Key: %s\nContent-Hash: %s\nAvatar: %s", r.Address, r.NostrPubKey, r.IPFSPubKey, r.ContentHash, avatar)
 			return nil
 		} else {
 			return err
@@ -190,15 +593,30 @@ func (c *DidCmd) Run(clictx *kong.Context) error {
 		if err != nil {
 			return fmt.Errorf("could not load patr node config")
 		}
-		ctx, _ := context.WithCancel(context.Background())
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
 		ipfscore, err := ipfs.StartIPFSNode(ctx, config.IPFSPrivKey, config.IPFSPubKey)
 		if err != nil {
 			return fmt.Errorf("could not start patr IPFS node")
 		}
-		err = p2p.SendDM(ctx, *ipfscore, config.InfuraSecretKey, d.ID.ID, c.Arg)
+		err = p2p.SendDM(ctx, *ipfscore, config.InfuraSecretKey, config.Did, d.ID.ID, c.Arg)
 		ipfscore.Shutdown()
 		return err
 
+	case "migrate":
+		config, err := node.LoadConfig()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ipfscore, err := ipfs.StartIPFSNode(ctx, config.IPFSPrivKey, config.IPFSPubKey)
+		if err != nil {
+			return err
+		}
+		defer ipfscore.Shutdown()
+		return feed.Migrate(ctx, *ipfscore, c.Name)
+
 	default:
 		return fmt.Errorf("Unknown did command: %s", c.Cmd)
 	}
@@ -211,8 +629,98 @@ func (c *FeedCmd) Run(clictx *kong.Context) error {
 		if err != nil {
 			return err
 		}
-		ctx, _ := context.WithCancel(context.Background())
-		feed.CreateFeed(ctx)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		codec := c.Codec
+		if codec == "" {
+			codec = ipfs.DefaultCodec
+		}
+		return feed.CreateFeed(ctx, codec)
+
+	case "post":
+		if strings.TrimSpace(c.Arg) == "" {
+			return fmt.Errorf("you must specify the text to post")
+		}
+		config, err := node.LoadConfig()
+		if err != nil {
+			return err
+		}
+		var post feed.Post
+		if c.Protected != "" {
+			post, err = feed.NewProtectedPost(config.NostrPrivKey, c.Arg, c.Protected, util.Now())
+		} else {
+			post, err = feed.NewPost(config.NostrPrivKey, c.Arg, nil, nil, util.Now())
+		}
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ipfscore, err := ipfs.StartIPFSNode(ctx, config.IPFSPrivKey, config.IPFSPubKey)
+		if err != nil {
+			return err
+		}
+		defer ipfscore.Shutdown()
+		head, pending, err := feed.Publish(ctx, *ipfscore, post)
+		if err != nil {
+			return err
+		}
+		if pending {
+			log.Infof("post %s is pending and will be published when the node is online", head)
+		} else {
+			log.Infof("published post %s, the feed head is now %s", post.Event.ID, head)
+		}
+		return nil
+
+	case "timeline":
+		config, err := node.LoadConfig()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ipfscore, err := ipfs.StartIPFSNode(ctx, config.IPFSPrivKey, config.IPFSPubKey)
+		if err != nil {
+			return err
+		}
+		defer ipfscore.Shutdown()
+		posts, truncated, err := feed.Timeline(ctx, *ipfscore, c.Arg)
+		if err != nil {
+			return err
+		}
+		for _, p := range posts {
+			fmt.Printf("%s\t%s\t%s\n", p.Event.CreatedAt.Time().Format(time.RFC3339), p.Cid, strings.ReplaceAll(p.Event.Content, "\n", " "))
+			if p.Body != "" {
+				fmt.Printf("\t\t%s\n", strings.ReplaceAll(p.Body, "\n", " "))
+			}
+		}
+		if truncated {
+			log.Warnf("the timeline was truncated by the fetch budget after %v posts", len(posts))
+		}
+		return nil
+
+	case "resolve":
+		l, err := feed.ParsePermalink(c.Arg)
+		if err != nil {
+			return err
+		}
+		config, err := node.LoadConfig()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ipfscore, err := ipfs.StartIPFSNode(ctx, config.IPFSPrivKey, config.IPFSPubKey)
+		if err != nil {
+			return err
+		}
+		defer ipfscore.Shutdown()
+		p, err := feed.ResolvePermalink(ctx, *ipfscore, l)
+		if err != nil {
+			return err
+		}
+		data, _ := json.MarshalIndent(p, "", " ")
+		fmt.Println(string(data))
 		return nil
 
 	default:
@@ -224,20 +732,1978 @@ func (c *FeedCmd) Run(clictx *kong.Context) error {
 func (c *NostrCmd) Run(clictx *kong.Context) error {
 	switch strings.ToLower(c.Cmd) {
 	case "create-event":
-		_, err := node.LoadConfig()
+		if len(c.Args) < 2 {
+			return fmt.Errorf("you must specify the kind and content of the event")
+		}
+		kind, err := strconv.Atoi(c.Args[0])
 		if err != nil {
+			return fmt.Errorf("invalid event kind: %s", c.Args[0])
+		}
+		tags := gonostr.Tags{}
+		for _, t := range c.Tags {
+			tags = append(tags, gonostr.Tag(strings.Split(t, ",")))
+		}
+		if _, err = node.LoadConfig(); err != nil {
 			return err
 		}
-		ctx, _ := context.WithCancel(context.Background())
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
 		ipfscore, err := ipfs.StartIPFSNode(ctx, node.CurrentConfig.IPFSPrivKey, node.CurrentConfig.IPFSPubKey)
+		if err != nil {
+			return err
+		}
 		ipfscore.W3S.SetAuthToken(node.CurrentConfig.W3SSecretKey)
+		evt, l, err := nostr.BuildEvent(kind, strings.Join(c.Args[1:], " "), tags, nostr.BuildOptions{PrivKey: node.CurrentConfig.NostrPrivKey, Ipfscore: ipfscore})
 		if err != nil {
 			return err
 		}
-		return nostr.CreateTestEvent(node.CurrentConfig.NostrPrivKey, "test event", *ipfscore)
-	default:
-		log.Errorf("Unknown nostr command: %s", c.Cmd)
-		return fmt.Errorf("UNKNOWN NOSTR COMMAND: %s", c.Cmd)
-	}
+		data, _ := json.MarshalIndent(evt, "", " ")
+		fmt.Printf("%s\nIPLD: %v\n", data, l)
+		return nil
+
+	case "delegate":
+		config, err := node.LoadConfig()
+		if err != nil {
+			return err
+		}
+		if len(c.Args) < 2 {
+			return fmt.Errorf("you must specify the delegatee public key and the number of hours the delegation is valid for")
+		}
+		pk, _, err := nostr.DecodePubKey(c.Args[0])
+		if err != nil {
+			return fmt.Errorf("could not decode %s as a Nostr public key: %v", c.Args[0], err)
+		}
+		hours, err := strconv.Atoi(c.Args[1])
+		if err != nil || hours <= 0 {
+			return fmt.Errorf("invalid number of hours: %s", c.Args[1])
+		}
+		kinds := []int{}
+		for _, a := range c.Args[2:] {
+			k, err := strconv.Atoi(a)
+			if err != nil {
+				return fmt.Errorf("invalid event kind: %s", a)
+			}
+			kinds = append(kinds, k)
+		}
+		d, err := nostr.CreateDelegation(config.NostrPrivKey, pk, kinds, time.Duration(hours)*time.Hour)
+		if err != nil {
+			return err
+		}
+		config.Delegations = append(config.Delegations, d)
+		if err = node.SaveConfig(config); err != nil {
+			return err
+		}
+		tag, _ := json.Marshal(d.Tag)
+		fmt.Printf("Delegation tag: %s\n", tag)
+		return nil
+
+	case "revoke-delegation":
+		config, err := node.LoadConfig()
+		if err != nil {
+			return err
+		}
+		if len(c.Args) < 1 {
+			return fmt.Errorf("you must specify the delegation token to revoke")
+		}
+		for _, d := range config.Delegations {
+			if d.Token() == c.Args[0] {
+				if util.Contains(config.RevokedDelegations, c.Args[0]) {
+					log.Infof("delegation to %s is already revoked", d.Delegatee)
+					return nil
+				}
+				log.Infof("revoking delegation to %s", d.Delegatee)
+				return node.RevokeDelegation(context.Background(), config, c.Args[0])
+			}
+		}
+		return fmt.Errorf("could not find delegation with token %s", c.Args[0])
+
+	case "topics":
+		if err := topics.Verify(); err != nil {
+			log.Errorf("topic derivation does not match the test vectors: %v", err)
+			return err
+		}
+		for _, v := range topics.Versions {
+			fmt.Printf("%v\t%s\t\t%s\n", v, topics.KindGlobal, topics.Global(v))
+		}
+		for _, a := range c.Args {
+			if nostr.IsPubKeyEntity(a) {
+				pk, _, err := nostr.DecodePubKey(a)
+				if err != nil {
+					return err
+				}
+				a = pk
+			}
+			kind := topics.KindHashtag
+			if strings.HasPrefix(a, "did:") {
+				kind = topics.KindFeed
+			} else if _, err := hex.DecodeString(a); err == nil && len(a) == 64 {
+				kind = topics.KindKey
+			}
+			for _, v := range topics.Versions {
+				if t, err := topics.Derive(kind, a, v); err == nil {
+					fmt.Printf("%v\t%s\t%s\t%s\n", v, kind, a, t)
+				}
+			}
+		}
+		return nil
+
+	case "encode":
+		if len(c.Args) < 2 {
+			return fmt.Errorf("you must specify the entity type and the public key, event ID or kind and identifier to encode")
+		}
+		var entity string
+		var err error
+		switch strings.ToLower(c.Args[0]) {
+		case "npub":
+			entity, err = nostr.EncodePubKey(c.Args[1])
+		case "nprofile":
+			entity, err = nostr.EncodeProfile(c.Args[1], c.Args[2:])
+		case "nevent":
+			entity, err = nostr.EncodeEvent(nostr.EventPointer{ID: c.Args[1], Relays: c.Args[2:]})
+		case "naddr":
+			if len(c.Args) < 3 {
+				return fmt.Errorf("you must specify the kind and identifier of the addressable event")
+			}
+			config, err := node.LoadConfig()
+			if err != nil {
+				return err
+			}
+			kind, err := strconv.Atoi(c.Args[1])
+			if err != nil {
+				return fmt.Errorf("invalid event kind: %s", c.Args[1])
+			}
+			entity, err = nostr.EncodeAddr(nostr.AddrPointer{PubKey: config.NostrPubKey, Kind: kind, Identifier: c.Args[2], Relays: c.Args[3:]})
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported NIP-19 entity type %s", c.Args[0])
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Println(entity)
+		return nil
+
+	case "decode":
+		if len(c.Args) < 1 {
+			return fmt.Errorf("you must specify the NIP-19 entity to decode")
+		}
+		prefix, v, err := nostr.DecodeEntity(c.Args[0])
+		if err != nil {
+			return err
+		}
+		data, _ := json.MarshalIndent(v, "", " ")
+		fmt.Printf("%s: %s\n", prefix, data)
+		return nil
 
+	case "dm":
+		if len(c.Args) < 2 {
+			return fmt.Errorf("you must specify the DID or Nostr public key of the recipient and the text of the DM")
+		}
+		if _, err := node.LoadConfig(); err != nil {
+			return err
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ipfscore, err := ipfs.StartIPFSNode(ctx, node.CurrentConfig.IPFSPrivKey, node.CurrentConfig.IPFSPubKey)
+		if err != nil {
+			return err
+		}
+		node.RegisterOutboxHandlers(*ipfscore)
+		evt, archived, err := feed.SendDM(ctx, *ipfscore, c.Args[0], strings.Join(c.Args[1:], " "), c.Scheme)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("DM: %s\nArchived: %v\n", evt.ID, archived)
+		return nil
+
+	default:
+		log.Errorf("Unknown nostr command: %s", c.Cmd)
+		return fmt.Errorf("UNKNOWN NOSTR COMMAND: %s", c.Cmd)
+	}
+
+}
+
+func (c *BotCmd) Run(clictx *kong.Context) error {
+	switch strings.ToLower(c.Cmd) {
+	case "create":
+		config, err := node.LoadConfig()
+		if err != nil {
+			return err
+		}
+		if c.Name == "" {
+			return fmt.Errorf("you must specify a name for the bot")
+		}
+		for _, b := range config.Bots {
+			if b.Name == c.Name {
+				return fmt.Errorf("the bot %s already exists", c.Name)
+			}
+		}
+		b, token, err := bot.Create(c.Name, config.NostrPrivKey, c.Rate)
+		if err != nil {
+			return err
+		}
+		config.Bots = append(config.Bots, b)
+		if err = node.SaveConfig(config); err != nil {
+			return err
+		}
+		fmt.Printf("Bot: %s\nNostr Public-Key: %s\nWebhook: /bot/%s/webhook\nAPI Token: %s\n", b.Name, b.NostrPubKey, b.Name, token)
+		log.Info("the API token will not be shown again")
+		return nil
+
+	case "list":
+		config, err := node.LoadConfig()
+		if err != nil {
+			return err
+		}
+		for _, b := range config.Bots {
+			fmt.Printf("%s\t%s\t%v posts/hour\n", b.Name, b.NostrPubKey, b.PostsPerHour)
+		}
+		return nil
+
+	case "delete":
+		config, err := node.LoadConfig()
+		if err != nil {
+			return err
+		}
+		for i, b := range config.Bots {
+			if b.Name == c.Name {
+				config.Bots = append(config.Bots[:i], config.Bots[i+1:]...)
+				log.Infof("deleting bot %s and revoking its delegation", c.Name)
+				return node.RevokeDelegation(context.Background(), config, b.Delegation.Token())
+			}
+		}
+		return fmt.Errorf("could not find bot %s", c.Name)
+
+	default:
+		log.Errorf("Unknown bot command: %s", c.Cmd)
+		return fmt.Errorf("UNKNOWN BOT COMMAND: %s", c.Cmd)
+	}
+}
+
+func (c *KeysCmd) Run(clictx *kong.Context) error {
+	config, err := node.LoadConfig()
+	if err != nil {
+		return err
+	}
+	if config.IPNSKeys == nil {
+		config.IPNSKeys = make(map[string]ipfs.NamedKey)
+	}
+	switch strings.ToLower(c.Cmd) {
+	case "create":
+		if c.Name == "" {
+			return fmt.Errorf("you must specify a name for the IPNS key")
+		}
+		if _, ok := config.IPNSKeys[c.Name]; ok {
+			return fmt.Errorf("the IPNS key %s already exists", c.Name)
+		}
+		keytype := c.Type
+		if keytype == "" {
+			keytype = ipfs.IPNSKeyType
+		}
+		k, err := ipfs.GenerateNamedKeyOfType(keytype)
+		if err != nil {
+			return err
+		}
+		config.IPNSKeys[c.Name] = k
+		if err = node.SaveConfig(config); err != nil {
+			return err
+		}
+		fmt.Printf("%s\t%s\t%s\n", c.Name, k.Name(), k.KeyType())
+		return nil
+
+	case "list":
+		for n, k := range config.IPNSKeys {
+			fmt.Printf("%s\t%s\t%s\t%s\n", n, k.Name(), k.KeyType(), k.Value)
+			if k.Transitioning() {
+				if prev, err := k.PreviousNamedKey(); err == nil {
+					fmt.Printf("\tdual publishing to %s until %s\n", prev.Name(), k.DualPublishUntil.Format(time.RFC3339))
+				}
+			}
+		}
+		return nil
+
+	case "convert":
+		k, ok := config.IPNSKeys[c.Name]
+		if !ok {
+			return fmt.Errorf("could not find IPNS key %s", c.Name)
+		}
+		nk, err := ipfs.ConvertNamedKey(k)
+		if err != nil {
+			return err
+		}
+		if util.DryRun {
+			log.Infof("dry run: would convert IPNS key %s from %s to Ed25519 name %s", c.Name, k.Name(), nk.Name())
+			return nil
+		}
+		if nk.Value != "" {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ipfscore, err := ipfs.StartIPFSNode(ctx, config.IPFSPrivKey, config.IPFSPubKey)
+			if err != nil {
+				return err
+			}
+			defer ipfscore.Shutdown()
+			prev := c.Name + "-previous"
+			if err = ipfs.ImportNamedKeys(*ipfscore, map[string]ipfs.NamedKey{prev: k, c.Name: nk}); err != nil {
+				return err
+			}
+			for _, name := range []string{c.Name, prev} {
+				if err = ipfs.PublishNamedKey(ctx, *ipfscore, name, nk.Value); err != nil {
+					return err
+				}
+			}
+		}
+		config.IPNSKeys[c.Name] = nk
+		if err = node.SaveConfig(config); err != nil {
+			return err
+		}
+		log.Infof("converted IPNS key %s from %s to %s, publishing to both names until %s", c.Name, k.Name(), nk.Name(), nk.DualPublishUntil.Format(time.RFC3339))
+		fmt.Printf("%s\t%s\t%s\n", c.Name, nk.Name(), nk.KeyType())
+		return nil
+
+	case "rotate":
+		k, ok := config.IPNSKeys[c.Name]
+		if !ok {
+			return fmt.Errorf("could not find IPNS key %s", c.Name)
+		}
+		nk, err := ipfs.RotateNamedKey(k)
+		if err != nil {
+			return err
+		}
+		if util.DryRun {
+			log.Infof("dry run: would publish /ipns/%s to IPNS name %s on the DHT", nk.Name(), k.Name())
+			if nk.Value != "" {
+				log.Infof("dry run: would publish %s to IPNS name %s on the DHT", nk.Value, nk.Name())
+			}
+			return nil
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ipfscore, err := ipfs.StartIPFSNode(ctx, config.IPFSPrivKey, config.IPFSPubKey)
+		if err != nil {
+			return err
+		}
+		defer ipfscore.Shutdown()
+		prev := c.Name + "-previous"
+		if err = ipfs.ImportNamedKeys(*ipfscore, map[string]ipfs.NamedKey{prev: k, c.Name: nk}); err != nil {
+			return err
+		}
+		if err = ipfs.PublishNamedKey(ctx, *ipfscore, prev, "/ipns/"+nk.Name()); err != nil {
+			return err
+		}
+		if nk.Value != "" {
+			if err = ipfs.PublishNamedKey(ctx, *ipfscore, c.Name, nk.Value); err != nil {
+				return err
+			}
+		}
+		config.IPNSKeys[c.Name] = nk
+		log.Infof("rotated IPNS key %s from %s to %s", c.Name, k.Name(), nk.Name())
+		return node.SaveConfig(config)
+
+	case "publish":
+		k, ok := config.IPNSKeys[c.Name]
+		if !ok {
+			return fmt.Errorf("could not find IPNS key %s", c.Name)
+		}
+		if c.Path == "" {
+			return fmt.Errorf("you must specify the IPFS path to publish")
+		}
+		if util.DryRun {
+			log.Infof("dry run: would publish %s to IPNS name %s (%s) on the DHT", c.Path, c.Name, k.Name())
+			return nil
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ipfscore, err := ipfs.StartIPFSNode(ctx, config.IPFSPrivKey, config.IPFSPubKey)
+		if err != nil {
+			return err
+		}
+		defer ipfscore.Shutdown()
+		if err = ipfs.ImportNamedKeys(*ipfscore, map[string]ipfs.NamedKey{c.Name: k}); err != nil {
+			return err
+		}
+		if err = ipfs.PublishNamedKey(ctx, *ipfscore, c.Name, c.Path); err != nil {
+			return err
+		}
+		k.Value = c.Path
+		config.IPNSKeys[c.Name] = k
+		return node.SaveConfig(config)
+
+	case "resolve":
+		name := c.Name
+		if k, ok := config.IPNSKeys[c.Name]; ok {
+			name = k.Name()
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ipfscore, err := ipfs.StartIPFSNode(ctx, config.IPFSPrivKey, config.IPFSPubKey)
+		if err != nil {
+			return err
+		}
+		defer ipfscore.Shutdown()
+		p, err := ipfs.ResolveIPNSName(ctx, *ipfscore, name)
+		if err != nil {
+			return err
+		}
+		fmt.Println(p)
+		return nil
+
+	default:
+		log.Errorf("Unknown keys command: %s", c.Cmd)
+		return fmt.Errorf("UNKNOWN KEYS COMMAND: %s", c.Cmd)
+	}
+}
+
+func (c *ImportCmd) Run(clictx *kong.Context) error {
+	switch strings.ToLower(c.Cmd) {
+	case "file":
+		config, err := node.LoadConfig()
+		if err != nil {
+			return err
+		}
+		posts, err := feed.ReadImportFile(c.Path)
+		if err != nil {
+			return err
+		}
+		head := cid.Undef
+		if config.FeedHead != "" {
+			if head, err = cid.Parse(config.FeedHead); err != nil {
+				return fmt.Errorf("could not parse feed head %s: %v", config.FeedHead, err)
+			}
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ipfscore, err := ipfs.StartIPFSNode(ctx, config.IPFSPrivKey, config.IPFSPubKey)
+		if err != nil {
+			return err
+		}
+		defer ipfscore.Shutdown()
+		head, n, err := feed.ImportPosts(ctx, *ipfscore, config.NostrPrivKey, posts, head)
+		if n > 0 {
+			if perr := feed.PublishFeedHead(ctx, *ipfscore, head); perr != nil {
+				log.Errorf("could not publish feed head %v: %v", head, perr)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Imported %v posts from %s\nFeed head: %v\n", n, c.Path, head)
+		return nil
+
+	case "twitter":
+		config, err := node.LoadConfig()
+		if err != nil {
+			return err
+		}
+		a, err := feed.ReadTwitterArchive(c.Path)
+		if err != nil {
+			return err
+		}
+		defer a.Close()
+		head := cid.Undef
+		if config.FeedHead != "" {
+			if head, err = cid.Parse(config.FeedHead); err != nil {
+				return fmt.Errorf("could not parse feed head %s: %v", config.FeedHead, err)
+			}
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ipfscore, err := ipfs.StartIPFSNode(ctx, config.IPFSPrivKey, config.IPFSPubKey)
+		if err != nil {
+			return err
+		}
+		defer ipfscore.Shutdown()
+		head, n, err := feed.ImportTwitterArchive(ctx, *ipfscore, config.NostrPrivKey, a, head, func(h cid.Cid) error {
+			return feed.PublishFeedHead(ctx, *ipfscore, h)
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Imported %v tweets from %s\nFeed head: %v\n", n, c.Path, head)
+		return nil
+
+	default:
+		log.Errorf("Unknown import command: %s", c.Cmd)
+		return fmt.Errorf("UNKNOWN IMPORT COMMAND: %s", c.Cmd)
+	}
+}
+
+func (c *PeersCmd) Run(clictx *kong.Context) error {
+	if _, err := node.LoadConfig(); err != nil {
+		return err
+	}
+	if err := p2p.LoadBlocklist(); err != nil {
+		return err
+	}
+	switch strings.ToLower(c.Cmd) {
+	case "block":
+		if c.Peer == "" {
+			return fmt.Errorf("you must specify the peer ID or CIDR range to block")
+		}
+		if err := p2p.Blocked.Block(c.Peer); err != nil {
+			return err
+		}
+		log.Info("restart the node for the blocklist change to take effect")
+		return nil
+
+	case "unblock":
+		if c.Peer == "" {
+			return fmt.Errorf("you must specify the peer ID or CIDR range to unblock")
+		}
+		if err := p2p.Blocked.Unblock(c.Peer); err != nil {
+			return err
+		}
+		log.Info("restart the node for the blocklist change to take effect")
+		return nil
+
+	case "list":
+		for _, p := range p2p.Blocked.Peers {
+			fmt.Printf("peer\t%s\n", p)
+		}
+		for _, r := range p2p.Blocked.CIDRs {
+			fmt.Printf("cidr\t%s\n", r)
+		}
+		for _, r := range p2p.Blocked.Reports {
+			fmt.Printf("report\t%s\t%s\t%s\n", r.Peer, r.Time.Format(time.RFC3339), r.Reason)
+		}
+		return nil
+
+	case "report":
+		if c.Peer == "" || c.Reason == "" {
+			return fmt.Errorf("you must specify the peer ID and the reason for the report")
+		}
+		return p2p.Blocked.Report(c.Peer, c.Reason)
+
+	default:
+		log.Errorf("Unknown peers command: %s", c.Cmd)
+		return fmt.Errorf("UNKNOWN PEERS COMMAND: %s", c.Cmd)
+	}
+}
+
+func (c *BackupCmd) Run(clictx *kong.Context) error {
+	config, err := node.LoadConfig()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	switch strings.ToLower(c.Cmd) {
+	case "create":
+		ipfscore, err := ipfs.StartIPFSNode(ctx, config.IPFSPrivKey, config.IPFSPubKey)
+		if err != nil {
+			return err
+		}
+		defer ipfscore.Shutdown()
+		root, err := node.Backup(ctx, *ipfscore, c.Path)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Snapshot: %v\nArchive: %s\nIndex: %s\n", root, c.Path, node.IndexFile(c.Path))
+		return nil
+
+	case "restore":
+		if util.DryRun {
+			log.Infof("dry run: would import blocks from %s into the local IPFS node", c.Path)
+			return nil
+		}
+		ipfscore, err := ipfs.StartIPFSNode(ctx, config.IPFSPrivKey, config.IPFSPubKey)
+		if err != nil {
+			return err
+		}
+		defer ipfscore.Shutdown()
+		root, n, err := node.Restore(ctx, *ipfscore, c.Path)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Snapshot: %v\nBlocks: %v\n", root, n)
+		return nil
+
+	default:
+		log.Errorf("Unknown backup command: %s", c.Cmd)
+		return fmt.Errorf("UNKNOWN BACKUP COMMAND: %s", c.Cmd)
+	}
+}
+
+func (c *BundleCmd) Run(clictx *kong.Context) error {
+	config, err := node.LoadConfig()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	switch strings.ToLower(c.Cmd) {
+	case "export":
+		ipfscore, err := ipfs.StartIPFSNode(ctx, config.IPFSPrivKey, config.IPFSPubKey)
+		if err != nil {
+			return err
+		}
+		defer ipfscore.Shutdown()
+		root, heads, err := feed.ExportBundle(ctx, *ipfscore, c.Path)
+		if err != nil {
+			return err
+		}
+		for _, h := range heads {
+			fmt.Printf("%s\t%s\t%s\n", h.Did, h.Head, time.Unix(h.Posted, 0).Format(time.RFC3339))
+		}
+		fmt.Printf("Bundle: %v\nArchive: %s\nIndex: %s\n", root, c.Path, node.IndexFile(c.Path))
+		return nil
+
+	case "import":
+		ipfscore, err := ipfs.StartIPFSNode(ctx, config.IPFSPrivKey, config.IPFSPubKey)
+		if err != nil {
+			return err
+		}
+		defer ipfscore.Shutdown()
+		result, err := feed.ImportBundle(ctx, *ipfscore, c.Path)
+		if err != nil {
+			return err
+		}
+		for _, h := range result.Heads {
+			fmt.Printf("%s\t%s\t%s\n", h.Did, h.Head, time.Unix(h.Posted, 0).Format(time.RFC3339))
+		}
+		fmt.Printf("Bundle: %v\nBlocks: %v\nFollowed feeds updated: %v\nSkipped: %v\n", result.Root, result.Blocks, result.Followed, result.Skipped)
+		return nil
+
+	default:
+		log.Errorf("Unknown bundle command: %s", c.Cmd)
+		return fmt.Errorf("UNKNOWN BUNDLE COMMAND: %s", c.Cmd)
+	}
+}
+
+func (c *RelayCmd) Run(clictx *kong.Context) error {
+	config, err := node.LoadConfig()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	switch strings.ToLower(c.Cmd) {
+	case "export", "import":
+		if c.Arg == "" {
+			return fmt.Errorf("you must specify the path to the JSONL file of events")
+		}
+	case "delete", "ban", "unban":
+		if c.Arg == "" {
+			return fmt.Errorf("you must specify the event ID or pubkey")
+		}
+	}
+	switch strings.ToLower(c.Cmd) {
+	case "export":
+		filter := gonostr.Filter{}
+		if err := json.Unmarshal([]byte(c.Filter), &filter); err != nil {
+			return fmt.Errorf("could not parse filter %s: %v", c.Filter, err)
+		}
+		head, err := cid.Parse(config.BatchHead)
+		if err != nil {
+			return fmt.Errorf("the relay has not stored any events")
+		}
+		ipfscore, err := ipfs.StartIPFSNode(ctx, config.IPFSPrivKey, config.IPFSPubKey)
+		if err != nil {
+			return err
+		}
+		defer ipfscore.Shutdown()
+		f, err := os.Create(c.Arg)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		n, err := nostr.ExportEvents(ctx, *ipfscore, head, filter, f)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Exported %v events to %s\n", n, c.Arg)
+		return nil
+
+	case "import":
+		f, err := os.Open(c.Arg)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		ipfscore, err := ipfs.StartIPFSNode(ctx, config.IPFSPrivKey, config.IPFSPubKey)
+		if err != nil {
+			return err
+		}
+		defer ipfscore.Shutdown()
+		ipfscore.W3S.SetAuthToken(config.W3SSecretKey)
+		b := nostr.NewBatcher(*ipfscore, config.BatchSize, 0)
+		if head, err := cid.Parse(config.BatchHead); err == nil {
+			b.SetHead(head)
+		}
+		b.OnFlush = func(c cid.Cid) { node.SaveBatchHead(c) }
+		b.Start()
+		defer b.Stop()
+		n, skipped, err := nostr.ImportEvents(f, func(evt gonostr.Event) error {
+			if node.StorageClassOf(evt.Kind) == nostr.StorageEphemeral {
+				log.Debugf("not importing event %s of ephemeral kind %v", evt.ID, evt.Kind)
+				return nil
+			}
+			b.Add(evt, nostr.Provenance{Source: nostr.SourceImport, Origin: c.Arg})
+			return nil
+		})
+		if ferr := b.Flush(); err == nil {
+			err = ferr
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Imported %v events from %s, skipped %v\n", n, c.Arg, skipped)
+		return nil
+
+	case "events":
+		events := []gonostr.Event{}
+		if err := relayAdminRequest(ctx, "GET", "/admin/events?filter="+url.QueryEscape(c.Filter), c.Token, nil, &events); err != nil {
+			return err
+		}
+		for _, evt := range events {
+			fmt.Printf("%s\t%s\tkind %v\t%v\n", evt.ID, evt.PubKey, evt.Kind, evt.CreatedAt.Time().UTC().Format(time.RFC3339))
+		}
+		return nil
+
+	case "delete":
+		d := nostr.Deletion{}
+		if err := relayAdminRequest(ctx, "DELETE", "/admin/events/"+url.PathEscape(c.Arg)+"?reason="+url.QueryEscape(c.Reason), c.Token, nil, &d); err != nil {
+			return err
+		}
+		fmt.Printf("Deleted event %s by %s\n", d.ID, d.PubKey)
+		return nil
+
+	case "ban":
+		return relayAdminRequest(ctx, "PUT", "/admin/bans/"+url.PathEscape(c.Arg), c.Token, map[string]string{"reason": c.Reason}, nil)
+
+	case "unban":
+		return relayAdminRequest(ctx, "DELETE", "/admin/bans/"+url.PathEscape(c.Arg), c.Token, nil, nil)
+
+	case "bans":
+		m := nostr.ModerationState{}
+		if err := relayAdminRequest(ctx, "GET", "/admin/bans", c.Token, nil, &m); err != nil {
+			return err
+		}
+		for _, b := range m.Bans {
+			fmt.Printf("banned\t%s\t%v\t%s\n", b.PubKey, b.Time.Format(time.RFC3339), b.Reason)
+		}
+		for _, d := range m.Deletions {
+			fmt.Printf("deleted\t%s\tby %s\t%v\t%s\n", d.ID, d.PubKey, d.Time.Format(time.RFC3339), d.Reason)
+		}
+		return nil
+
+	default:
+		log.Errorf("Unknown relay command: %s", c.Cmd)
+		return fmt.Errorf("UNKNOWN RELAY COMMAND: %s", c.Cmd)
+	}
+}
+
+// relayAdminRequest calls the relay admin API of the running node with an API token and decodes the JSON response.
+func relayAdminRequest(ctx context.Context, method string, path string, token string, body any, out any) error {
+	if token == "" {
+		return fmt.Errorf("you must specify an API token with the admin scope")
+	}
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("http://127.0.0.1:%v%s", node.RelayPort, path), r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not connect to the node, is it running? %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		msg := struct {
+			Message string `json:"message"`
+		}{}
+		json.NewDecoder(res.Body).Decode(&msg)
+		return fmt.Errorf("%s %s failed: %s %s", method, path, res.Status, msg.Message)
+	}
+	if out != nil && res.StatusCode != http.StatusNoContent {
+		return json.NewDecoder(res.Body).Decode(out)
+	}
+	return nil
+}
+
+func (c *FollowsCmd) Run(clictx *kong.Context) error {
+	config, err := node.LoadConfig()
+	if err != nil {
+		return err
+	}
+	cmd := strings.ToLower(c.Cmd)
+	if cmd != "add" && node.IsIdentity(c.Target) {
+		i, err := node.ParseIdentity(c.Target)
+		if err != nil {
+			return err
+		}
+		c.Target = i.Did
+	}
+	if cmd != "add" && nostr.IsPubKeyEntity(c.Target) {
+		pk, _, err := nostr.DecodePubKey(c.Target)
+		if err != nil {
+			return err
+		}
+		f, ok := node.FindFollowByPubKey(pk)
+		if !ok {
+			return fmt.Errorf("not following %s", c.Target)
+		}
+		c.Target = f.Did
+	}
+	switch cmd {
+	case "add", "remove":
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ipfscore, err := ipfs.StartIPFSNode(ctx, config.IPFSPrivKey, config.IPFSPubKey)
+		if err != nil {
+			return err
+		}
+		defer ipfscore.Shutdown()
+		if cmd == "remove" {
+			return feed.Unfollow(ctx, *ipfscore, []string{c.Target})
+		}
+		_, err = feed.Follow(ctx, *ipfscore, c.Target, c.Feed)
+		return err
+
+	case "request":
+		if c.Target == "" {
+			return fmt.Errorf("you must specify the DID of the protected account to follow")
+		}
+		if _, ok := node.FindFollow(c.Target); !ok {
+			return fmt.Errorf("follow %s with patr follows add first", c.Target)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ipfscore, err := ipfs.StartIPFSNode(ctx, config.IPFSPrivKey, config.IPFSPubKey)
+		if err != nil {
+			return err
+		}
+		defer ipfscore.Shutdown()
+		if err = node.RequestFollow(ctx, *ipfscore, c.Target, c.Message); err != nil {
+			return err
+		}
+		log.Infof("sent follow request to %s", c.Target)
+		return nil
+
+	case "mirror":
+		f, ok := node.FindFollow(c.Target)
+		if !ok {
+			return fmt.Errorf("not following %s", c.Target)
+		}
+		rules, err := feed.ParseReplicationRules(c.Rules)
+		if err != nil {
+			return err
+		}
+		f.Community, f.Replicate = true, rules
+		log.Infof("mirroring community feed %s", c.Target)
+		return node.SaveFollow(f)
+
+	case "unmirror":
+		f, ok := node.FindFollow(c.Target)
+		if !ok {
+			return fmt.Errorf("not following %s", c.Target)
+		}
+		f.Community, f.Replicate = false, nil
+		return node.SaveFollow(f)
+
+	case "list":
+		for _, f := range config.Follows {
+			npub, _ := nostr.EncodePubKey(f.NostrPubKey)
+			status := "unverified"
+			if ct, ok := node.FindContact(f.Did); ok {
+				status = ct.Status()
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\n", f.Did, npub, f.FeedName, f.LastSeen, status)
+		}
+		for _, t := range config.Hashtags {
+			fmt.Printf("#%s\n", t)
+		}
+		return nil
+
+	case "tag":
+		t := nostr.NormalizeHashtag(c.Target)
+		if t == "" {
+			return fmt.Errorf("you must specify the hashtag to follow")
+		}
+		if util.Contains(config.Hashtags, t) {
+			return fmt.Errorf("already following #%s", t)
+		}
+		config.Hashtags = append(config.Hashtags, t)
+		log.Infof("following #%s, restart the node for the change to take effect", t)
+		return node.SaveConfig(config)
+
+	case "untag":
+		t := nostr.NormalizeHashtag(c.Target)
+		tags := []string{}
+		for _, ht := range config.Hashtags {
+			if ht != t {
+				tags = append(tags, ht)
+			}
+		}
+		if len(tags) == len(config.Hashtags) {
+			return fmt.Errorf("not following #%s", t)
+		}
+		config.Hashtags = tags
+		return node.SaveConfig(config)
+
+	case "backfill":
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ipfscore, err := ipfs.StartIPFSNode(ctx, config.IPFSPrivKey, config.IPFSPubKey)
+		if err != nil {
+			return err
+		}
+		defer ipfscore.Shutdown()
+		err = feed.BackfillAll(ctx, *ipfscore, func(p feed.BackfillProgress) {
+			switch {
+			case p.Error != "":
+				fmt.Printf("%s\tfailed after %v posts: %s\n", p.Did, p.Fetched, p.Error)
+			case p.Complete:
+				fmt.Printf("%s\tcomplete, fetched %v posts\n", p.Did, p.Fetched)
+			default:
+				fmt.Printf("%s\tfetched %v posts\n", p.Did, p.Fetched)
+			}
+		})
+		if _, complete := feed.BackfillStatus(); complete {
+			fmt.Println("Timeline is complete")
+		} else {
+			fmt.Println("Timeline is incomplete, run backfill again to continue")
+		}
+		return err
+
+	case "prune":
+		if c.Months <= 0 {
+			return fmt.Errorf("the number of months must be positive")
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ipfscore, err := ipfs.StartIPFSNode(ctx, config.IPFSPrivKey, config.IPFSPubKey)
+		if err != nil {
+			return err
+		}
+		defer ipfscore.Shutdown()
+		inactive := feed.InactiveFollows(ctx, *ipfscore, time.Duration(c.Months)*30*24*time.Hour)
+		if len(inactive) == 0 {
+			fmt.Println("No inactive feeds to prune")
+			return nil
+		}
+		dids := []string{}
+		for _, f := range inactive {
+			fmt.Printf("%s\t%s\t%s\n", f.Did, f.FeedName, f.Reason)
+			dids = append(dids, f.Did)
+		}
+		if !c.Yes {
+			fmt.Printf("Unfollow %v feeds? [y/N] ", len(dids))
+			answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+			if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+				return nil
+			}
+		}
+		if err = feed.Unfollow(ctx, *ipfscore, dids); err != nil {
+			return err
+		}
+		log.Infof("unfollowed %v inactive feeds", len(dids))
+		return nil
+
+	default:
+		log.Errorf("Unknown follows command: %s", c.Cmd)
+		return fmt.Errorf("UNKNOWN FOLLOWS COMMAND: %s", c.Cmd)
+	}
+}
+
+func (c *TokensCmd) Run(clictx *kong.Context) error {
+	config, err := node.LoadConfig()
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(c.Cmd) {
+	case "create":
+		scopes := []string{}
+		for _, s := range strings.Split(c.Scopes, ",") {
+			if s = strings.ToLower(strings.TrimSpace(s)); s != "" {
+				scopes = append(scopes, s)
+			}
+		}
+		t, token, err := node.CreateAPIToken(c.Name, scopes)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("API Token: %s\nScopes: %s\nToken: %s\n", t.Name, strings.Join(t.Scopes, ","), token)
+		log.Info("the API token will not be shown again")
+		return nil
+
+	case "list":
+		for _, t := range config.APITokens {
+			fmt.Printf("%s\t%s\t%s\n", t.Name, strings.Join(t.Scopes, ","), t.Created.Format(time.RFC3339))
+		}
+		return nil
+
+	case "revoke":
+		if err = node.RevokeAPIToken(c.Name); err != nil {
+			return err
+		}
+		log.Infof("revoked API token %s", c.Name)
+		return nil
+
+	default:
+		log.Errorf("Unknown tokens command: %s", c.Cmd)
+		return fmt.Errorf("UNKNOWN TOKENS COMMAND: %s", c.Cmd)
+	}
+}
+
+func (c *DevicesCmd) Run(clictx *kong.Context) error {
+	if _, err := node.LoadConfig(); err != nil {
+		return err
+	}
+	switch strings.ToLower(c.Cmd) {
+	case "list":
+		sessions, err := node.Sessions()
+		if err != nil {
+			return err
+		}
+		for _, s := range sessions {
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\t%s\n", s.ID, s.Device, s.APIToken, strings.Join(s.Scopes, ","), s.Address, s.LastSeen.Format(time.RFC3339))
+		}
+		return nil
+
+	case "revoke":
+		if err := node.RevokeSession(c.ID); err != nil {
+			return err
+		}
+		log.Infof("revoked device session %s", c.ID)
+		return nil
+
+	default:
+		log.Errorf("Unknown devices command: %s", c.Cmd)
+		return fmt.Errorf("UNKNOWN DEVICES COMMAND: %s", c.Cmd)
+	}
+}
+
+func (c *LiveCmd) Run(clictx *kong.Context) error {
+	config, err := node.LoadConfig()
+	if err != nil {
+		return err
+	}
+	a := nostr.LiveActivity{ID: c.ID, Title: c.Title, Streaming: c.URL, Summary: c.Summary, Image: c.Image}
+	switch strings.ToLower(c.Cmd) {
+	case "plan":
+		a.Status = nostr.LiveStatusPlanned
+	case "start":
+		a.Status, a.Starts = nostr.LiveStatusLive, util.Now()
+	case "end":
+		a.Status = nostr.LiveStatusEnded
+	default:
+		log.Errorf("Unknown live command: %s", c.Cmd)
+		return fmt.Errorf("UNKNOWN LIVE COMMAND: %s", c.Cmd)
+	}
+	evt, err := nostr.NewLiveActivity(config.NostrPrivKey, a)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := util.WithTimeout(context.Background(), nostr.RelayTimeout)
+	defer cancel()
+	if err = nostr.PublishToRelay(ctx, fmt.Sprintf("ws://127.0.0.1:%v", node.RelayPort), evt); err != nil {
+		return err
+	}
+	naddr, _ := nostr.AddrEntity(evt, config.ProfileRelays)
+	log.Infof("live activity %s is %s at %s", c.ID, a.Status, nostr.NostrURI(naddr))
+	return nil
+}
+
+func parseCalendarTime(s string) (time.Time, bool, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, true, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	return t, false, err
+}
+
+func (c *CalendarCmd) Run(clictx *kong.Context) error {
+	config, err := node.LoadConfig()
+	if err != nil {
+		return err
+	}
+	var evt gonostr.Event
+	switch strings.ToLower(c.Cmd) {
+	case "create":
+		e := nostr.CalendarEvent{Title: c.Title, Location: c.Location, Summary: c.Summary}
+		if e.Start, e.AllDay, err = parseCalendarTime(c.Start); err != nil {
+			return fmt.Errorf("invalid start %s: %v", c.Start, err)
+		}
+		if c.End != "" {
+			allDay := false
+			if e.End, allDay, err = parseCalendarTime(c.End); err != nil {
+				return fmt.Errorf("invalid end %s: %v", c.End, err)
+			}
+			if allDay != e.AllDay {
+				return fmt.Errorf("the start and end must both be dates or both be times")
+			}
+		}
+		if evt, err = nostr.NewCalendarEvent(config.NostrPrivKey, c.ID, e); err != nil {
+			return err
+		}
+		fmt.Printf("Calendar event: %v:%s:%s\n", evt.Kind, evt.PubKey, c.ID)
+		if naddr, err := nostr.AddrEntity(evt, config.ProfileRelays); err == nil {
+			fmt.Printf("Share: %s\n", nostr.NostrURI(naddr))
+		}
+
+	case "rsvp":
+		if evt, err = nostr.NewRSVP(config.NostrPrivKey, c.ID, strings.ToLower(c.Status)); err != nil {
+			return err
+		}
+
+	default:
+		log.Errorf("Unknown calendar command: %s", c.Cmd)
+		return fmt.Errorf("UNKNOWN CALENDAR COMMAND: %s", c.Cmd)
+	}
+	ctx, cancel := util.WithTimeout(context.Background(), nostr.RelayTimeout)
+	defer cancel()
+	return nostr.PublishToRelay(ctx, fmt.Sprintf("ws://127.0.0.1:%v", node.RelayPort), evt)
+}
+
+func (c *ListingsCmd) Run(clictx *kong.Context) error {
+	config, err := node.LoadConfig()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := util.WithTimeout(context.Background(), nostr.RelayTimeout)
+	defer cancel()
+	url := fmt.Sprintf("ws://127.0.0.1:%v", node.RelayPort)
+	switch strings.ToLower(c.Cmd) {
+	case "create":
+		evt, err := nostr.NewListing(config.NostrPrivKey, c.ID, nostr.Listing{
+			Title:    c.Title,
+			Summary:  c.Summary,
+			Content:  c.Text,
+			Price:    nostr.Price{Amount: c.Price, Currency: c.Currency, Frequency: c.Frequency},
+			Images:   c.Images,
+			Location: c.Location,
+			Geohash:  c.Geohash,
+			Tags:     c.Tags,
+		})
+		if err != nil {
+			return err
+		}
+		if err = nostr.PublishToRelay(ctx, url, evt); err != nil {
+			return err
+		}
+		if naddr, err := nostr.AddrEntity(evt, config.ProfileRelays); err == nil {
+			fmt.Printf("Listing: %s\n", nostr.NostrURI(naddr))
+		}
+		return nil
+
+	case "close":
+		if err = nostr.CloseListing(ctx, url, config.NostrPrivKey, c.ID); err != nil {
+			return err
+		}
+		log.Infof("closed listing %s", c.ID)
+		return nil
+
+	default:
+		log.Errorf("Unknown listings command: %s", c.Cmd)
+		return fmt.Errorf("UNKNOWN LISTINGS COMMAND: %s", c.Cmd)
+	}
+}
+
+func (c *DocsCmd) Run(clictx *kong.Context) error {
+	config, err := node.LoadConfig()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ipfscore, err := ipfs.StartIPFSNode(ctx, config.IPFSPrivKey, config.IPFSPubKey)
+	if err != nil {
+		return err
+	}
+	defer ipfscore.Shutdown()
+	switch strings.ToLower(c.Cmd) {
+	case "write":
+		text, err := os.ReadFile(c.Arg)
+		if err != nil {
+			return err
+		}
+		head, err := wiki.Write(ctx, *ipfscore, config.NostrPrivKey, c.Name, string(text))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Head: %v\n", head)
+		return nil
+
+	case "merge":
+		head, err := cid.Parse(c.Arg)
+		if err != nil {
+			return fmt.Errorf("invalid CID %s: %v", c.Arg, err)
+		}
+		return wiki.Merge(ctx, *ipfscore, c.Name, head)
+
+	case "show":
+		d, err := wiki.Open(ctx, *ipfscore, c.Name)
+		if err != nil {
+			return err
+		}
+		fmt.Println(d.Text())
+		return nil
+
+	case "history":
+		d, err := wiki.Open(ctx, *ipfscore, c.Name)
+		if err != nil {
+			return err
+		}
+		for _, e := range d.History() {
+			fmt.Printf("%s\t%s\t%s\t%v ops\n", e.Cid, e.Author, e.Created.Format(time.RFC3339), e.Ops)
+		}
+		return nil
+
+	default:
+		log.Errorf("Unknown docs command: %s", c.Cmd)
+		return fmt.Errorf("UNKNOWN DOCS COMMAND: %s", c.Cmd)
+	}
+}
+
+func (c *ProfileCmd) Run(clictx *kong.Context) error {
+	config, err := node.LoadConfig()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	switch strings.ToLower(c.Cmd) {
+	case "show":
+		data, _ := json.MarshalIndent(config.Profile, "", " ")
+		fmt.Println(string(data))
+		return nil
+
+	case "set":
+		m := config.Profile.ProfileMetadata
+		for _, f := range []struct {
+			value string
+			field *string
+		}{{c.Name, &m.Name}, {c.DisplayName, &m.DisplayName}, {c.About, &m.About}, {c.Picture, &m.Picture},
+			{c.Banner, &m.Banner}, {c.Website, &m.Website}, {c.NIP05, &m.NIP05}, {c.LUD16, &m.LUD16}} {
+			if f.value != "" {
+				*f.field = f.value
+			}
+		}
+		return node.SetProfile(ctx, m)
+
+	case "sync":
+		return node.SyncProfile(ctx)
+
+	case "protect", "unprotect":
+		config.Protected = strings.ToLower(c.Cmd) == "protect"
+		if err = node.SaveConfig(config); err != nil {
+			return err
+		}
+		if config.Protected {
+			log.Info("your account is protected, follow requests must be approved with patr requests approve")
+		} else {
+			log.Info("your account is no longer protected")
+		}
+		return nil
+
+	default:
+		log.Errorf("Unknown profile command: %s", c.Cmd)
+		return fmt.Errorf("UNKNOWN PROFILE COMMAND: %s", c.Cmd)
+	}
+}
+
+func (c *PinsCmd) Run(clictx *kong.Context) error {
+	config, err := node.LoadConfig()
+	if err != nil {
+		return err
+	}
+	cmd := strings.ToLower(c.Cmd)
+	if cmd == "list" {
+		pins, err := p2p.PinAgreements()
+		if err != nil {
+			return err
+		}
+		for _, a := range pins {
+			status := "quoted"
+			if !a.Accepted.IsZero() {
+				status = "until " + a.Until.Format(time.RFC3339)
+			}
+			fmt.Printf("%s\t%s\t%s\t%v DAGs\t%s\t%v/%v audits failed\n", a.Quote.ID, a.Role, a.Peer, len(a.Quote.Cids), status, a.FailedAudits, a.Audits)
+		}
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ipfscore, err := ipfs.StartIPFSNode(ctx, config.IPFSPrivKey, config.IPFSPubKey)
+	if err != nil {
+		return err
+	}
+	defer ipfscore.Shutdown()
+	switch cmd {
+	case "quote":
+		pid, err := peer.Decode(c.Arg)
+		if err != nil {
+			return fmt.Errorf("invalid peer ID %s: %v", c.Arg, err)
+		}
+		cids := []cid.Cid{}
+		for _, s := range c.Cids {
+			pc, err := cid.Parse(s)
+			if err != nil {
+				return fmt.Errorf("invalid CID %s: %v", s, err)
+			}
+			cids = append(cids, pc)
+		}
+		q, err := p2p.RequestPinQuote(ctx, *ipfscore, pid, cids, p2p.GiB(c.GiB), c.Months)
+		if err != nil {
+			return err
+		}
+		data, _ := json.MarshalIndent(q, "", " ")
+		fmt.Println(string(data))
+		return nil
+
+	case "accept":
+		var receipt *gonostr.Event
+		if c.Zap != "" {
+			data, err := os.ReadFile(c.Zap)
+			if err != nil {
+				return err
+			}
+			receipt = &gonostr.Event{}
+			if err = json.Unmarshal(data, receipt); err != nil {
+				return fmt.Errorf("could not read zap receipt %s: %v", c.Zap, err)
+			}
+		}
+		if receipt == nil && c.TxHash == "" {
+			return fmt.Errorf("you must specify the zap receipt or the transaction paying for the quote")
+		}
+		return p2p.AcceptPinQuote(ctx, *ipfscore, c.Arg, receipt, c.TxHash)
+
+	case "audit":
+		audited, err := p2p.AuditPins(ctx, *ipfscore)
+		if err != nil {
+			return err
+		}
+		for _, a := range audited {
+			fmt.Printf("%s\t%s\t%s\n", a.Quote.ID, a.Peer, a.LastAuditError)
+		}
+		return nil
+
+	case "status", "remote-pin", "remote-unpin":
+		pc, err := cid.Parse(c.Arg)
+		if err != nil {
+			return fmt.Errorf("invalid CID %s: %v", c.Arg, err)
+		}
+		ipfscore.W3S.SetAuthToken(config.W3SSecretKey)
+		pinners := ipfs.RemotePinners(*ipfscore)
+		if len(pinners) == 0 {
+			return fmt.Errorf("the node does not have a remote pinning service")
+		}
+		var perr error
+		switch cmd {
+		case "remote-pin":
+			perr = ipfs.PinRemote(ctx, *ipfscore, pc)
+		case "remote-unpin":
+			perr = ipfs.UnpinRemote(ctx, *ipfscore, pc)
+		}
+		rp, err := ipfs.RefreshRemotePin(ctx, *ipfscore, pc)
+		if err != nil {
+			return err
+		}
+		for _, name := range rp.ServiceNames() {
+			s := rp.Services[name]
+			fmt.Printf("%s\t%s\t%v attempts\t%v", name, s.Status, s.Attempts, s.Updated.Format(time.RFC3339))
+			if s.Error != "" {
+				fmt.Printf("\t%s", s.Error)
+			}
+			if !s.NextAttempt.IsZero() {
+				fmt.Printf("\tretry at %v", s.NextAttempt.Format(time.RFC3339))
+			}
+			fmt.Println()
+		}
+		quorum := ipfs.Quorum(len(pinners))
+		fmt.Printf("%v pinned with %v of %v pinning services, quorum %v: %v\n", pc, rp.Pinned(), len(pinners), quorum, rp.Pinned() >= quorum)
+		return perr
+
+	default:
+		log.Errorf("Unknown pins command: %s", c.Cmd)
+		return fmt.Errorf("UNKNOWN PINS COMMAND: %s", c.Cmd)
+	}
+}
+
+func (c *LinksCmd) Run(clictx *kong.Context) error {
+	config, err := node.LoadConfig()
+	if err != nil {
+		return err
+	}
+	show := func(links []feed.Link) {
+		for _, l := range links {
+			fmt.Printf("%s\t%v\t%v\t%s\t%s\n", l.URL, l.Status, l.Dead, l.Archive, l.Checked.Format(time.RFC3339))
+		}
+	}
+	switch strings.ToLower(c.Cmd) {
+	case "check":
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ipfscore, err := ipfs.StartIPFSNode(ctx, config.IPFSPrivKey, config.IPFSPubKey)
+		if err != nil {
+			return err
+		}
+		defer ipfscore.Shutdown()
+		links, err := feed.CheckLinks(ctx, *ipfscore)
+		if err != nil {
+			return err
+		}
+		show(links)
+		return nil
+
+	case "list", "dead":
+		links, err := feed.Links(strings.ToLower(c.Cmd) == "dead")
+		if err != nil {
+			return err
+		}
+		show(links)
+		return nil
+
+	case "archive":
+		archive, err := cid.Parse(c.Cid)
+		if err != nil {
+			return fmt.Errorf("invalid CID %s: %v", c.Cid, err)
+		}
+		return feed.SetLinkArchive(c.URL, archive)
+
+	default:
+		log.Errorf("Unknown links command: %s", c.Cmd)
+		return fmt.Errorf("UNKNOWN LINKS COMMAND: %s", c.Cmd)
+	}
+}
+
+func (c *MediaCmd) Run(clictx *kong.Context) error {
+	config, err := node.LoadConfig()
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(c.Cmd) {
+	case "pins":
+		pins, err := feed.MediaPins()
+		if err != nil {
+			return err
+		}
+		for _, p := range pins {
+			expires := p.Expires.Format(time.RFC3339)
+			if p.Bookmarked {
+				expires = "bookmarked"
+			}
+			fmt.Printf("%s\t%s\t%s\t%v bytes\t%s\n", p.Cid, p.Author, p.Post, p.Size, expires)
+		}
+		return nil
+
+	case "expire":
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ipfscore, err := ipfs.StartIPFSNode(ctx, config.IPFSPrivKey, config.IPFSPubKey)
+		if err != nil {
+			return err
+		}
+		defer ipfscore.Shutdown()
+		n, err := feed.ExpireMediaPins(ctx, *ipfscore)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("unpinned %v media pins\n", n)
+		return nil
+
+	case "bookmark", "unbookmark":
+		mc, err := cid.Parse(c.Cid)
+		if err != nil {
+			return fmt.Errorf("invalid CID %s: %v", c.Cid, err)
+		}
+		n, err := feed.BookmarkMedia(mc, strings.ToLower(c.Cmd) == "bookmark")
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("no media of followed users pinned for %s", c.Cid)
+		}
+		return nil
+
+	default:
+		log.Errorf("Unknown media command: %s", c.Cmd)
+		return fmt.Errorf("UNKNOWN MEDIA COMMAND: %s", c.Cmd)
+	}
+}
+
+func (c *QRCmd) Run(clictx *kong.Context) error {
+	config, err := node.LoadConfig()
+	if err != nil {
+		return err
+	}
+	data := ""
+	switch strings.ToLower(c.Cmd) {
+	case "identity":
+		data = node.CurrentIdentity().String()
+
+	case "npub":
+		if data, err = nostr.EncodePubKey(config.NostrPubKey); err != nil {
+			return err
+		}
+		data = nostr.NostrURI(data)
+
+	case "post":
+		pc, err := cid.Parse(c.Arg)
+		if err != nil {
+			return fmt.Errorf("invalid post CID %s: %v", c.Arg, err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ipfscore, err := ipfs.StartIPFSNode(ctx, config.IPFSPrivKey, config.IPFSPubKey)
+		if err != nil {
+			return err
+		}
+		defer ipfscore.Shutdown()
+		l, err := feed.PostPermalink(ctx, *ipfscore, pc)
+		if err != nil {
+			return err
+		}
+		data = l.HTTPS()
+		if c.Patr {
+			data = l.String()
+		}
+
+	default:
+		log.Errorf("Unknown QR command: %s", c.Cmd)
+		return fmt.Errorf("UNKNOWN QR COMMAND: %s", c.Cmd)
+	}
+	if c.Out != "" {
+		png, err := util.QRPNG(data, 0)
+		if err != nil {
+			return err
+		}
+		if err = os.WriteFile(c.Out, png, 0644); err != nil {
+			log.Errorf("could not write QR code to %s: %v", c.Out, err)
+			return err
+		}
+		log.Infof("wrote QR code of %s to %s", data, c.Out)
+		return nil
+	}
+	s, err := util.QRText(data, c.Invert)
+	if err != nil {
+		return err
+	}
+	fmt.Print(s)
+	fmt.Println(data)
+	return nil
+}
+
+func (c *ContactsCmd) Run(clictx *kong.Context) error {
+	config, err := node.LoadConfig()
+	if err != nil {
+		return err
+	}
+	cmd := strings.ToLower(c.Cmd)
+	if cmd != "list" && !did.IsValid(c.Did) {
+		return fmt.Errorf("you must specify the DID of the contact")
+	}
+	switch cmd {
+	case "verify":
+		ct, err := node.StartVerification(c.Did)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Short authentication string: %s\n", ct.SAS())
+		fmt.Printf("Compare it with the one %s sees over a call or in person, then run: patr contacts confirm %s\n", c.Did, c.Did)
+		return nil
+
+	case "confirm":
+		ct, err := node.ConfirmVerification(c.Did)
+		if err != nil {
+			return err
+		}
+		d, _ := did.Parse(c.Did)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ipfscore, err := ipfs.StartIPFSNode(ctx, config.IPFSPrivKey, config.IPFSPubKey)
+		if err != nil {
+			return err
+		}
+		defer ipfscore.Shutdown()
+		if err = p2p.SendVerification(ctx, *ipfscore, config.InfuraSecretKey, config.Did, d.ID.ID, ct.Commitment()); err != nil {
+			log.Warnf("could not send the confirmation to %s, run confirm again when their node is online: %v", c.Did, err)
+			return err
+		}
+		log.Infof("sent the confirmation of %s %s", c.Did, ct.SAS())
+		return nil
+
+	case "list":
+		contacts, err := node.Contacts()
+		if err != nil {
+			return err
+		}
+		for _, ct := range contacts {
+			fmt.Printf("%s\t%s\t%s\n", ct.Did, ct.SAS(), ct.Status())
+		}
+		return nil
+
+	case "reset":
+		return node.ResetVerification(c.Did)
+
+	default:
+		log.Errorf("Unknown contacts command: %s", c.Cmd)
+		return fmt.Errorf("UNKNOWN CONTACTS COMMAND: %s", c.Cmd)
+	}
+}
+
+func (c *PanicCmd) Run(clictx *kong.Context) error {
+	config, err := node.LoadConfig()
+	if err != nil {
+		return err
+	}
+	if !c.Yes && !util.DryRun {
+		fmt.Printf("Revoke the keys of %s and wipe them from this device? This cannot be undone. [y/N] ", config.Did)
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			return nil
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	ipfscore, err := ipfs.StartIPFSNode(ctx, config.IPFSPrivKey, config.IPFSPubKey)
+	if err != nil {
+		log.Errorf("could not start IPFS node, the revocation will only be published to relays: %v", err)
+	} else {
+		defer ipfscore.Shutdown()
+	}
+	var core ipfs.IPFSCore
+	if ipfscore != nil {
+		core = *ipfscore
+	}
+	report, err := feed.Panic(ctx, core, c.Reason)
+	if err != nil && report.Revocation.ID == "" {
+		return err
+	}
+	revocation, _ := json.Marshal(report.Revocation)
+	fmt.Printf("Revocation %s published to %v relays", report.Revocation.ID, report.Relays)
+	if report.Head != "" {
+		fmt.Printf(" and feed head %s", report.Head)
+	}
+	fmt.Printf(", unpinned %v media pins.\n\n", report.Unpinned)
+	fmt.Println("To recover your identity from a safe device:")
+	fmt.Printf("  1. Initialize a new node with new keys: patr node init %s\n", config.Did)
+	fmt.Println("  2. Replace the Nostr and IPFS public keys in the text records of your ENS name with the new keys.")
+	fmt.Println("  3. Restore your public data from a backup: patr backup restore <path>")
+	fmt.Println("  4. Follow your contacts again and ask them to verify you: patr contacts verify <did>")
+	fmt.Println("  5. If the revocation could not reach your relays, publish this signed event with any Nostr client:")
+	fmt.Printf("\n%s\n", revocation)
+	return err
+}
+
+func (c *DiagCmd) Run(clictx *kong.Context) error {
+	config, err := node.LoadConfig()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	switch strings.ToLower(c.Cmd) {
+	case "sync":
+		follows := config.Follows
+		if c.Did != "" {
+			f, ok := node.FindFollow(c.Did)
+			if !ok {
+				return fmt.Errorf("you do not follow %s", c.Did)
+			}
+			follows = []node.Follow{f}
+		}
+		ipfscore, err := ipfs.StartIPFSNode(ctx, config.IPFSPrivKey, config.IPFSPubKey)
+		if err != nil {
+			return err
+		}
+		defer ipfscore.Shutdown()
+		for _, f := range follows {
+			d := feed.DiagnoseSync(ctx, *ipfscore, f)
+			fmt.Printf("%s\n", d.Did)
+			for _, p := range d.Probes {
+				if p.Error != "" {
+					fmt.Printf("  resolve %-5s\t%v\tfailed: %s\n", p.Source, p.Duration.Round(time.Millisecond), p.Error)
+				} else {
+					fmt.Printf("  resolve %-5s\t%v\tsequence %v\n", p.Source, p.Duration.Round(time.Millisecond), p.Sequence)
+				}
+			}
+			if d.Head != "" {
+				fmt.Printf("  head\t%s from %s, behind: %v", d.Head, d.Source, d.Behind)
+				if !d.HeadPosted.IsZero() {
+					fmt.Printf(", posted %v ago", d.HeadAge.Round(time.Second))
+				}
+				fmt.Println()
+				fmt.Printf("  fetch\t%v posts, %v blocks, %v bytes in %v\n", d.Posts, d.Blocks, d.Bytes, d.FetchTime.Round(time.Millisecond))
+			}
+			if d.Author != nil && d.Author.Error == "" {
+				fmt.Printf("  author\t%s %v\n", d.Author.Peer, d.Author.Latency.Round(time.Millisecond))
+			}
+			fmt.Printf("  pubsub\t%v peers\n", d.PubSubPeers)
+			for _, failure := range d.Failures {
+				fmt.Printf("  FAILED\t%s\n", failure)
+			}
+		}
+		for _, s := range ipfs.RetrievalSourceStats() {
+			fmt.Printf("retrieval %s\t%v blocks, %v failures, %v bytes, %v per block\n", s.Source, s.Blocks, s.Failures, s.Bytes, s.Latency)
+		}
+		return nil
+
+	case "peers":
+		ipfscore, err := ipfs.StartIPFSNode(ctx, config.IPFSPrivKey, config.IPFSPubKey)
+		if err != nil {
+			return err
+		}
+		defer ipfscore.Shutdown()
+		for _, l := range ipfs.PeerLatencies(*ipfscore) {
+			latency := "unknown"
+			if l.Latency > 0 {
+				latency = l.Latency.Round(time.Millisecond).String()
+			}
+			fmt.Printf("%s\t%s\t%s\n", l.Peer, latency, l.Addr)
+		}
+		return nil
+
+	default:
+		log.Errorf("Unknown diag command: %s", c.Cmd)
+		return fmt.Errorf("UNKNOWN DIAG COMMAND: %s", c.Cmd)
+	}
+}
+
+// readPassphrase prompts for a passphrase on stdin.
+func readPassphrase(prompt string) string {
+	fmt.Print(prompt)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.TrimRight(answer, "\r\n")
+}
+
+func (c *LockCmd) Run(clictx *kong.Context) error {
+	if _, err := node.LoadConfig(); err != nil {
+		return err
+	}
+	switch strings.ToLower(c.Cmd) {
+	case "lock":
+		if err := util.LockPublishing(); err != nil {
+			return err
+		}
+		log.Info("publishing is locked, unlock it with patr lock unlock")
+		return nil
+
+	case "unlock":
+		if err := util.UnlockPublishing(readPassphrase("Passphrase: ")); err != nil {
+			return err
+		}
+		if util.LockIdle > 0 {
+			log.Infof("publishing is unlocked and will lock again after %v without publishing", util.LockIdle)
+		} else {
+			log.Info("publishing is unlocked")
+		}
+		return nil
+
+	case "status":
+		s, err := util.PublishLockStatus()
+		if err != nil {
+			return err
+		}
+		state := "unlocked"
+		if s.Locked {
+			state = "locked"
+		}
+		fmt.Printf("Publishing is %s", state)
+		if !s.LastActivity.IsZero() {
+			fmt.Printf(", last published %v", s.LastActivity.Format(time.RFC3339))
+		}
+		if util.LockIdle > 0 {
+			fmt.Printf(", locks after %v idle", util.LockIdle)
+		}
+		fmt.Println()
+		return nil
+
+	case "passphrase":
+		if util.LockPassphraseHash != "" {
+			if err := util.UnlockPublishing(readPassphrase("Current passphrase: ")); err != nil {
+				return err
+			}
+		}
+		p := readPassphrase("New passphrase (empty to use the datastore passphrase): ")
+		if p != "" && readPassphrase("Repeat new passphrase: ") != p {
+			return fmt.Errorf("the passphrases do not match")
+		}
+		if err := node.SetLockPassphrase(p); err != nil {
+			return err
+		}
+		log.Info("lock passphrase updated")
+		return nil
+
+	default:
+		log.Errorf("Unknown lock command: %s", c.Cmd)
+		return fmt.Errorf("UNKNOWN LOCK COMMAND: %s", c.Cmd)
+	}
+}
+
+func (c *RequestsCmd) Run(clictx *kong.Context) error {
+	config, err := node.LoadConfig()
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(c.Cmd) {
+	case "list":
+		followers, err := node.Followers()
+		if err != nil {
+			return err
+		}
+		for _, f := range followers {
+			fmt.Printf("%s\t%s\t%s\t%s\n", f.Did, f.Status, f.Requested.Format(time.RFC3339), f.Message)
+		}
+		return nil
+
+	case "approve", "deny":
+		if c.Did == "" {
+			return fmt.Errorf("you must specify the DID of the user who asked to follow you")
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ipfscore, err := ipfs.StartIPFSNode(ctx, config.IPFSPrivKey, config.IPFSPubKey)
+		if err != nil {
+			return err
+		}
+		defer ipfscore.Shutdown()
+		if strings.ToLower(c.Cmd) == "approve" {
+			return node.ApproveFollower(ctx, *ipfscore, c.Did)
+		}
+		return node.DenyFollower(ctx, *ipfscore, c.Did)
+
+	default:
+		log.Errorf("Unknown requests command: %s", c.Cmd)
+		return fmt.Errorf("UNKNOWN REQUESTS COMMAND: %s", c.Cmd)
+	}
+}
+
+func (c *AppsCmd) Run(clictx *kong.Context) error {
+	if _, err := node.LoadConfig(); err != nil {
+		return err
+	}
+	switch strings.ToLower(c.Cmd) {
+	case "list":
+		for _, a := range node.AppInfos() {
+			fmt.Printf("%s\t%s\t%s\n", a.Namespace, a.IPNS, a.Head)
+		}
+		return nil
+
+	case "register":
+		k, err := node.RegisterApp(c.Namespace)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\t%s\n", c.Namespace, k.Name())
+		return nil
+
+	case "publish":
+		head, err := cid.Parse(c.Cid)
+		if err != nil {
+			return fmt.Errorf("invalid CID %s: %v", c.Cid, err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ipfscore, err := ipfs.StartIPFSNode(ctx, node.CurrentConfig.IPFSPrivKey, node.CurrentConfig.IPFSPubKey)
+		if err != nil {
+			return err
+		}
+		defer ipfscore.Shutdown()
+		return node.PublishAppHead(ctx, *ipfscore, c.Namespace, head)
+
+	case "patch":
+		data, err := os.ReadFile(c.Cid)
+		if err != nil {
+			return fmt.Errorf("could not read patch file %s: %v", c.Cid, err)
+		}
+		ops, err := ipfs.ParsePatch(data)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ipfscore, err := ipfs.StartIPFSNode(ctx, node.CurrentConfig.IPFSPrivKey, node.CurrentConfig.IPFSPubKey)
+		if err != nil {
+			return err
+		}
+		defer ipfscore.Shutdown()
+		head, err := node.PatchAppHead(ctx, *ipfscore, c.Namespace, ops)
+		if err != nil {
+			return err
+		}
+		fmt.Println(head)
+		return nil
+
+	default:
+		log.Errorf("Unknown apps command: %s", c.Cmd)
+		return fmt.Errorf("UNKNOWN APPS COMMAND: %s", c.Cmd)
+	}
+}
+
+func (c *RootCmd) Run(clictx *kong.Context) error {
+	if _, err := node.LoadConfig(); err != nil {
+		return err
+	}
+	switch strings.ToLower(c.Cmd) {
+	case "publish":
+		objects := map[string]cid.Cid{}
+		for name, v := range c.Objects {
+			oc, err := cid.Parse(strings.TrimPrefix(v, "/ipfs/"))
+			if err != nil {
+				return fmt.Errorf("invalid CID %s for object %s: %v", v, name, err)
+			}
+			objects[name] = oc
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ipfscore, err := ipfs.StartIPFSNode(ctx, node.CurrentConfig.IPFSPrivKey, node.CurrentConfig.IPFSPubKey)
+		if err != nil {
+			return err
+		}
+		defer ipfscore.Shutdown()
+		ipfscore.W3S.SetAuthToken(node.CurrentConfig.W3SSecretKey)
+		root, err := node.PublishRoot(ctx, *ipfscore, objects)
+		if err != nil {
+			return err
+		}
+		fmt.Println(root)
+		return nil
+
+	case "show":
+		name := c.Name
+		if name == "" {
+			k, ok := node.CurrentConfig.IPNSKeys[node.RootKeyName]
+			if !ok {
+				return fmt.Errorf("you have not published a root")
+			}
+			name = k.Name()
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ipfscore, err := ipfs.StartIPFSNode(ctx, node.CurrentConfig.IPFSPrivKey, node.CurrentConfig.IPFSPubKey)
+		if err != nil {
+			return err
+		}
+		defer ipfscore.Shutdown()
+		root, objects, err := node.ResolveRoot(ctx, *ipfscore, name)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Root: %v\n", root)
+		names := []string{}
+		for n := range objects {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			fmt.Printf("%s\t%v\n", n, objects[n])
+		}
+		return nil
+
+	default:
+		log.Errorf("Unknown root command: %s", c.Cmd)
+		return fmt.Errorf("UNKNOWN ROOT COMMAND: %s", c.Cmd)
+	}
 }
@@ -0,0 +1,32 @@
+package node
+
+import (
+	"strings"
+
+	"github.com/allisterb/patr/blockchain"
+	"github.com/allisterb/patr/did"
+)
+
+// RelayAllowedPubKeys returns the pubkeys the relay accepts events from in allowlist mode: the user, their follows and
+// the pubkeys and DIDs in the AllowedPubKeys configuration. DIDs which can't be resolved are skipped.
+func RelayAllowedPubKeys() []string {
+	keys := append([]string{CurrentConfig.NostrPubKey}, FollowPubKeys()...)
+	for _, k := range CurrentConfig.AllowedPubKeys {
+		if !strings.HasPrefix(k, "did:") {
+			keys = append(keys, k)
+			continue
+		}
+		d, err := did.Parse(k)
+		if err != nil {
+			log.Warnf("invalid DID %s in relay allowlist: %v", k, err)
+			continue
+		}
+		name, err := blockchain.ResolveENS(d.ID.ID, CurrentConfig.InfuraSecretKey)
+		if err != nil || name.NostrPubKey == "" {
+			log.Warnf("could not resolve the Nostr public key of %s in relay allowlist: %v", k, err)
+			continue
+		}
+		keys = append(keys, name.NostrPubKey)
+	}
+	return keys
+}
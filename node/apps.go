@@ -0,0 +1,285 @@
+package node
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/outbox"
+	"github.com/allisterb/patr/util"
+)
+
+// Well-known app namespaces. The patr.social namespace is the social feed, which has its own feed head and feed key.
+const (
+	AppSocial = "patr.social"
+	AppBlog   = "patr.blog"
+)
+
+// App is the data an application stores under the user's identity. Head is the root of the app's data, which is published
+// to the IPNS name of the app's key.
+type App struct {
+	Head    string
+	Updated time.Time
+}
+
+var appNamespaceRegex = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)+$`)
+
+// ValidAppNamespace checks an app namespace is a domain name like patr.blog or example.com.
+func ValidAppNamespace(ns string) error {
+	if len(ns) > 64 || !appNamespaceRegex.MatchString(ns) {
+		return fmt.Errorf("invalid app namespace %s, must be a lowercase domain name like example.com", ns)
+	}
+	return nil
+}
+
+// AppKeyName returns the name of the IPNS key of an app namespace.
+func AppKeyName(ns string) string {
+	if ns == AppSocial {
+		return "feed"
+	}
+	return "app:" + ns
+}
+
+// NewMasterSeed generates the master seed the IPNS keys of app namespaces are derived from.
+func NewMasterSeed() ([]byte, error) {
+	seed := make([]byte, 32)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, err
+	}
+	return seed, nil
+}
+
+// DeriveAppKey derives the IPNS key of an app namespace from the master seed, so the key can be recreated from the seed.
+func DeriveAppKey(seed []byte, ns string) (ipfs.NamedKey, error) {
+	if len(seed) == 0 {
+		return ipfs.NamedKey{}, fmt.Errorf("the node does not have a master seed")
+	}
+	priv, pub, err := ipfs.GenerateDeterministicKeyPair(hkdf.New(sha256.New, seed, nil, []byte("patr/app/"+ns)))
+	if err != nil {
+		return ipfs.NamedKey{}, err
+	}
+	return ipfs.NamedKey{PrivKey: priv, PubKey: pub, Created: util.Now()}, nil
+}
+
+// Apps returns the registered app namespaces keyed by namespace with their IPNS keys, including the social feed.
+func Apps() map[string]ipfs.NamedKey {
+	apps := map[string]ipfs.NamedKey{}
+	for name, k := range CurrentConfig.IPNSKeys {
+		if strings.HasPrefix(name, "app:") {
+			apps[strings.TrimPrefix(name, "app:")] = k
+		}
+	}
+	if k, ok := CurrentConfig.IPNSKeys["feed"]; ok {
+		apps[AppSocial] = k
+	}
+	return apps
+}
+
+// RegisterApp registers an app namespace under the user's identity with an IPNS key derived from the master seed. Nodes
+// created before app namespaces get a master seed when the first app is registered.
+func RegisterApp(ns string) (ipfs.NamedKey, error) {
+	if err := ValidAppNamespace(ns); err != nil {
+		return ipfs.NamedKey{}, err
+	}
+	if k, ok := Apps()[ns]; ok {
+		return k, nil
+	}
+	config := CurrentConfig
+	if len(config.MasterSeed) == 0 {
+		seed, err := NewMasterSeed()
+		if err != nil {
+			return ipfs.NamedKey{}, err
+		}
+		config.MasterSeed = seed
+	}
+	k, err := DeriveAppKey(config.MasterSeed, ns)
+	if err != nil {
+		return ipfs.NamedKey{}, err
+	}
+	keys := map[string]ipfs.NamedKey{}
+	for n, nk := range config.IPNSKeys {
+		keys[n] = nk
+	}
+	keys[AppKeyName(ns)] = k
+	config.IPNSKeys = keys
+	if err = SaveConfig(config); err != nil {
+		return ipfs.NamedKey{}, err
+	}
+	log.Infof("registered app %s with IPNS name %s", ns, k.Name())
+	return k, nil
+}
+
+// PublishAppHead saves the new head of the data of an app and publishes it to the app's IPNS name through the outbox.
+// The head is uploaded to Web3.Storage if it is configured.
+func PublishAppHead(ctx context.Context, ipfscore ipfs.IPFSCore, ns string, head cid.Cid) error {
+	if ns == AppSocial {
+		return fmt.Errorf("the %s namespace is the social feed, publish posts to it instead", AppSocial)
+	}
+	if _, ok := Apps()[ns]; !ok {
+		return fmt.Errorf("the app %s is not registered", ns)
+	}
+	if err := util.CheckPublishLock(); err != nil {
+		return err
+	}
+	if util.DryRun {
+		log.Infof("dry run: would publish head %v of app %s", head, ns)
+		return nil
+	}
+	config := CurrentConfig
+	apps := map[string]App{}
+	for n, a := range config.Apps {
+		apps[n] = a
+	}
+	apps[ns] = App{Head: head.String(), Updated: util.Now()}
+	config.Apps = apps
+	if err := SaveConfig(config); err != nil {
+		return err
+	}
+	RegisterOutboxHandlers(ipfscore)
+	if PinningEnabled() {
+		if err := outbox.Enqueue(outbox.KindW3SUpload, head.String(), map[string]string{"cid": head.String()}); err != nil {
+			return err
+		}
+	}
+	p := "/ipfs/" + head.String()
+	if err := outbox.Enqueue(outbox.KindIPNSPublish, AppKeyName(ns)+":"+p, map[string]string{"key": AppKeyName(ns), "path": p}); err != nil {
+		return err
+	}
+	log.Infof("published head %v of app %s", head, ns)
+	return outbox.Process(ctx)
+}
+
+// PatchAppHead applies an IPLD patch to the head of the data of an app and publishes the patched node as the new head.
+func PatchAppHead(ctx context.Context, ipfscore ipfs.IPFSCore, ns string, ops []ipfs.PatchOp) (cid.Cid, error) {
+	head, err := cid.Parse(CurrentConfig.Apps[ns].Head)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("the app %s does not have a head to patch", ns)
+	}
+	if err = util.CheckPublishLock(); err != nil {
+		return cid.Undef, err
+	}
+	ipfscore.W3S.SetAuthToken(CurrentConfig.W3SSecretKey)
+	c, err := ipfs.PatchBlock(ctx, ipfscore, head, ops)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return c, PublishAppHead(ctx, ipfscore, ns, c)
+}
+
+// AppInfo is an app namespace as returned by the API.
+type AppInfo struct {
+	Namespace string    `json:"namespace"`
+	IPNS      string    `json:"ipns"`
+	Head      string    `json:"head,omitempty"`
+	Updated   time.Time `json:"updated,omitempty"`
+}
+
+// AppInfos returns the registered app namespaces sorted by namespace. The head of the social feed is the feed head.
+func AppInfos() []AppInfo {
+	infos := []AppInfo{}
+	for ns, k := range Apps() {
+		a := CurrentConfig.Apps[ns]
+		if ns == AppSocial {
+			a.Head = strings.TrimPrefix(CurrentConfig.FeedHead, "/ipfs/")
+		}
+		infos = append(infos, AppInfo{Namespace: ns, IPNS: k.Name(), Head: a.Head, Updated: a.Updated})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Namespace < infos[j].Namespace })
+	return infos
+}
+
+// SetAppHandlers registers the app namespace API. GET /apps returns the app namespaces, POST /apps registers the
+// namespace in the request and PUT /apps/{app}/head publishes the CID in the request as the head of an app's data.
+// PATCH /apps/{app}/head applies the DAG-JSON IPLD patch in the request to the head.
+func SetAppHandlers(ctx context.Context, router *mux.Router, ipfscore ipfs.IPFSCore) {
+	router.Path("/apps").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(AppInfos())
+	})
+	router.Path("/apps").Methods("POST").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		req := struct {
+			Namespace string `json:"namespace"`
+		}{}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"message": "the request must be JSON with the app namespace"})
+			return
+		}
+		k, err := RegisterApp(req.Namespace)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(AppInfo{Namespace: req.Namespace, IPNS: k.Name()})
+	})
+	router.Path("/apps/{app}/head").Methods("PUT").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := util.CheckPublishLock(); err != nil {
+			w.WriteHeader(http.StatusLocked)
+			json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+			return
+		}
+		req := struct {
+			Cid string `json:"cid"`
+		}{}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"message": "the request must be JSON with the CID of the head"})
+			return
+		}
+		c, err := cid.Parse(req.Cid)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"message": "invalid CID " + req.Cid})
+			return
+		}
+		if err = PublishAppHead(ctx, ipfscore, mux.Vars(r)["app"], c); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"message": "published head " + c.String()})
+	})
+	router.Path("/apps/{app}/head").Methods("PATCH").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := util.CheckPublishLock(); err != nil {
+			w.WriteHeader(http.StatusLocked)
+			json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+			return
+		}
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"message": "could not read the patch"})
+			return
+		}
+		ops, err := ipfs.ParsePatch(data)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+			return
+		}
+		c, err := PatchAppHead(ctx, ipfscore, mux.Vars(r)["app"], ops)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"message": "published head " + c.String(), "cid": c.String()})
+	})
+}
@@ -0,0 +1,180 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/allisterb/patr/bot"
+	"github.com/allisterb/patr/util"
+)
+
+const (
+	ScopeRead  = "read"
+	ScopePost  = "post"
+	ScopeAdmin = "admin"
+)
+
+var Scopes = []string{ScopeRead, ScopePost, ScopeAdmin}
+
+// APIToken is a token a client uses to access the node HTTP API with a set of scopes. Only the hash of the token is stored.
+type APIToken struct {
+	Name      string
+	TokenHash string
+	Scopes    []string
+	Created   time.Time
+}
+
+// RouteScopes are the scopes required to call each method of the API routes, keyed by route path template.
+// Routes which are not listed are public.
+var RouteScopes = map[string]map[string]string{
+	"/admin/bans":                 {"GET": ScopeAdmin},
+	"/admin/bans/{pubkey}":        {"PUT": ScopeAdmin, "DELETE": ScopeAdmin},
+	"/admin/events":               {"GET": ScopeAdmin},
+	"/admin/events/{id}":          {"DELETE": ScopeAdmin},
+	"/apps":                       {"GET": ScopeRead, "POST": ScopeAdmin},
+	"/apps/{app}/head":            {"PUT": ScopePost, "PATCH": ScopePost},
+	"/config/reload":              {"POST": ScopeAdmin},
+	"/contacts":                   {"GET": ScopeRead},
+	"/diag/peers":                 {"GET": ScopeRead},
+	"/diag/retrieval":             {"GET": ScopeRead},
+	"/diag/sync":                  {"GET": ScopeRead},
+	"/export":                     {"GET": ScopeRead},
+	"/followers":                  {"GET": ScopeRead},
+	"/followers/{did}/approve":    {"POST": ScopeAdmin},
+	"/followers/{did}/deny":       {"POST": ScopeAdmin},
+	"/follows":                    {"POST": ScopeAdmin},
+	"/follows/backfill":           {"GET": ScopeRead},
+	"/follows/contacts":           {"GET": ScopeRead},
+	"/follows/{did}":              {"DELETE": ScopeAdmin},
+	"/links":                      {"GET": ScopeRead},
+	"/lock":                       {"GET": ScopeRead, "POST": ScopeAdmin},
+	"/lock/unlock":                {"POST": ScopeAdmin},
+	"/media/{cid}/thumbnail":      {"GET": ScopeRead},
+	"/metrics":                    {"GET": ScopeRead},
+	"/moderation":                 {"GET": ScopeRead},
+	"/peers/blocklist":            {"GET": ScopeRead},
+	"/permalinks":                 {"GET": ScopeRead},
+	"/permalinks/qr":              {"GET": ScopeRead},
+	"/peers/blocklist/{entry:.+}": {"PUT": ScopeAdmin, "DELETE": ScopeAdmin},
+	"/peers/{peer}/report":        {"POST": ScopeAdmin},
+	"/posts":                      {"POST": ScopePost},
+	"/posts/pending":              {"GET": ScopePost},
+	"/profile":                    {"PUT": ScopeAdmin},
+	"/sessions":                   {"GET": ScopeAdmin},
+	"/sessions/{id}":              {"DELETE": ScopeAdmin},
+}
+
+func hasScope(scopes []string, scope string) bool {
+	return util.Contains(scopes, scope) || util.Contains(scopes, ScopeAdmin)
+}
+
+// HasScope returns true if a token grants a scope. The admin scope grants every scope.
+func (t APIToken) HasScope(scope string) bool {
+	return hasScope(t.Scopes, scope)
+}
+
+// CreateAPIToken creates an API token with scopes and returns it with the token, which is not stored.
+func CreateAPIToken(name string, scopes []string) (APIToken, string, error) {
+	if name == "" {
+		return APIToken{}, "", fmt.Errorf("you must specify a name for the API token")
+	}
+	if len(scopes) == 0 {
+		return APIToken{}, "", fmt.Errorf("you must specify at least one scope for the API token")
+	}
+	for _, s := range scopes {
+		if !util.Contains(Scopes, s) {
+			return APIToken{}, "", fmt.Errorf("unknown scope %s, scopes are %s", s, strings.Join(Scopes, ", "))
+		}
+	}
+	for _, t := range CurrentConfig.APITokens {
+		if t.Name == name {
+			return APIToken{}, "", fmt.Errorf("the API token %s already exists", name)
+		}
+	}
+	token, err := bot.GenerateToken()
+	if err != nil {
+		return APIToken{}, "", err
+	}
+	t := APIToken{Name: name, TokenHash: bot.HashToken(token), Scopes: scopes, Created: util.Now()}
+	config := CurrentConfig
+	config.APITokens = append(append([]APIToken{}, config.APITokens...), t)
+	if err = SaveConfig(config); err != nil {
+		return APIToken{}, "", err
+	}
+	return t, token, nil
+}
+
+// RevokeAPIToken removes an API token so it can no longer be used.
+func RevokeAPIToken(name string) error {
+	config := CurrentConfig
+	tokens := []APIToken{}
+	for _, t := range config.APITokens {
+		if t.Name != name {
+			tokens = append(tokens, t)
+		}
+	}
+	if len(tokens) == len(config.APITokens) {
+		return fmt.Errorf("could not find API token %s", name)
+	}
+	config.APITokens = tokens
+	if err := SaveConfig(config); err != nil {
+		return err
+	}
+	return revokeTokenSessions(name)
+}
+
+// FindAPIToken returns the API token a bearer token matches.
+func FindAPIToken(token string) (APIToken, bool) {
+	if token == "" {
+		return APIToken{}, false
+	}
+	h := bot.HashToken(token)
+	for _, t := range CurrentConfig.APITokens {
+		if t.TokenHash == h {
+			return t, true
+		}
+	}
+	return APIToken{}, false
+}
+
+// AuthorizeAPI is the router middleware which checks that requests to routes in RouteScopes have a bearer API or
+// session token with the required scope.
+func AuthorizeAPI(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scope := ""
+		if route := mux.CurrentRoute(r); route != nil {
+			if tmpl, err := route.GetPathTemplate(); err == nil {
+				scope = RouteScopes[tmpl][r.Method]
+			}
+		}
+		if scope == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		name, scopes := "", []string{}
+		if t, ok := FindAPIToken(token); ok {
+			name, scopes = t.Name, t.Scopes
+		} else if s, ok := FindSession(token); ok {
+			name, scopes = s.Device, s.Scopes
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"message": "invalid API token"})
+			return
+		}
+		if !hasScope(scopes, scope) {
+			log.Warnf("API client %s does not have the %s scope for %s %s", name, scope, r.Method, r.URL.Path)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"message": fmt.Sprintf("the API token does not have the %s scope", scope)})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,276 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	carv2 "github.com/ipld/go-car/v2"
+	carbs "github.com/ipld/go-car/v2/blockstore"
+	"github.com/ipld/go-car/v2/index"
+	_ "github.com/ipld/go-codec-dagpb"
+	_ "github.com/ipld/go-ipld-prime/codec/raw"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/multicodec"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal"
+
+	"github.com/allisterb/patr/ipfs"
+)
+
+// IndexFile returns the path of the index stored alongside a backup archive.
+func IndexFile(path string) string {
+	return path + ".idx"
+}
+
+// Backup writes a snapshot of the node's public data to an indexed CARv2 file and stores a copy of the index alongside
+// it so the archive can be read randomly even by tools that don't understand CARv2.
+func Backup(ctx context.Context, ipfscore ipfs.IPFSCore, path string) (cid.Cid, error) {
+	root, err := CreateSnapshot(ctx, ipfscore)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if err = WriteArchive(ctx, ipfscore, root, path); err != nil {
+		return cid.Undef, err
+	}
+	log.Infof("backed up snapshot %v to %s", root, path)
+	return root, nil
+}
+
+// WriteArchive writes the DAG under a root to an indexed CARv2 file with a copy of the index alongside it.
+func WriteArchive(ctx context.Context, ipfscore ipfs.IPFSCore, root cid.Cid, path string) error {
+	f, err := writeSnapshotCar(ctx, ipfscore, root)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	if err = carv2.WrapV1File(f.Name(), path); err != nil {
+		log.Errorf("could not write archive %s as CARv2: %v", path, err)
+		return err
+	}
+	return writeIndex(path)
+}
+
+func writeIndex(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	idx, err := carv2.ReadOrGenerateIndex(f)
+	if err != nil {
+		log.Errorf("could not read index of backup %s: %v", path, err)
+		return err
+	}
+	tmp := IndexFile(path) + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = index.WriteTo(idx, out); err != nil {
+		out.Close()
+		log.Errorf("could not write index file %s: %v", tmp, err)
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, IndexFile(path))
+}
+
+// OpenArchive opens a CARv1 or CARv2 archive as a read-only blockstore using the stored index if there is one. Blocks
+// are read from the archive on demand so it is never loaded into memory. The caller must close the file.
+func OpenArchive(path string) (*carbs.ReadOnly, *os.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var idx index.Index
+	if i, err := os.Open(IndexFile(path)); err == nil {
+		idx, err = index.ReadFrom(i)
+		i.Close()
+		if err != nil {
+			log.Warnf("could not read index file %s, the archive index will be used: %v", IndexFile(path), err)
+			idx = nil
+		}
+	}
+	bs, err := carbs.NewReadOnly(f, idx)
+	if err != nil {
+		f.Close()
+		log.Errorf("could not open archive %s: %v", path, err)
+		return nil, nil, err
+	}
+	return bs, f, nil
+}
+
+// links returns the CIDs a block links to.
+func links(c cid.Cid, data []byte) ([]cid.Cid, error) {
+	dec, err := multicodec.LookupDecoder(c.Prefix().Codec)
+	if err != nil {
+		return nil, err
+	}
+	nb := basicnode.Prototype.Any.NewBuilder()
+	if err = dec(nb, bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	ls, err := traversal.SelectLinks(nb.Build())
+	if err != nil {
+		return nil, err
+	}
+	cids := []cid.Cid{}
+	for _, l := range ls {
+		if cl, ok := l.(cidlink.Link); ok {
+			cids = append(cids, cl.Cid)
+		}
+	}
+	return cids, nil
+}
+
+// Restore imports the DAG under each root of a backup archive into the IPFS node, reading blocks from the archive by
+// CID. Blocks missing from the archive are skipped. If the node has no feed head the feed head of the snapshot is restored,
+// and follows in the snapshot the node doesn't have are added.
+func Restore(ctx context.Context, ipfscore ipfs.IPFSCore, path string) (cid.Cid, int, error) {
+	bs, f, err := OpenArchive(path)
+	if err != nil {
+		return cid.Undef, 0, err
+	}
+	defer f.Close()
+	roots, err := bs.Roots()
+	if err != nil {
+		return cid.Undef, 0, err
+	}
+	if len(roots) == 0 {
+		return cid.Undef, 0, fmt.Errorf("backup %s does not have any roots", path)
+	}
+	n, err := ImportDAG(ctx, ipfscore, bs, roots)
+	if err != nil {
+		return roots[0], n, err
+	}
+	log.Infof("restored %v blocks from backup %s", n, path)
+	if err = restoreFeedHead(ctx, ipfscore, roots[0]); err != nil {
+		return roots[0], n, err
+	}
+	return roots[0], n, nil
+}
+
+// ImportDAG imports the DAG under each root from an archive into the IPFS node and returns the number of blocks
+// imported. Blocks missing from the archive are skipped.
+func ImportDAG(ctx context.Context, ipfscore ipfs.IPFSCore, bs *carbs.ReadOnly, roots []cid.Cid) (int, error) {
+	seen := cid.NewSet()
+	queue := append([]cid.Cid{}, roots...)
+	n := 0
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+		if !seen.Visit(c) {
+			continue
+		}
+		blk, err := bs.Get(ctx, c)
+		if err != nil {
+			log.Warnf("block %v is not in archive", c)
+			continue
+		}
+		if err = ipfs.PutBlock(ctx, ipfscore, c, blk.RawData()); err != nil {
+			return n, err
+		}
+		n++
+		ls, err := links(c, blk.RawData())
+		if err != nil {
+			log.Warnf("could not decode links of block %v: %v", c, err)
+			continue
+		}
+		queue = append(queue, ls...)
+	}
+	return n, nil
+}
+
+func restoreFeedHead(ctx context.Context, ipfscore ipfs.IPFSCore, root cid.Cid) error {
+	if codec := root.Prefix().Codec; codec != cid.DagJSON && codec != cid.DagCBOR {
+		return nil
+	}
+	data, err := ipfs.GetBlock(ctx, ipfscore, root)
+	if err != nil {
+		return err
+	}
+	n, err := ipfs.DecodeIPLDNode(root, data)
+	if err != nil {
+		return err
+	}
+	if t, err := n.LookupByString("type"); err != nil {
+		return nil
+	} else if s, _ := t.AsString(); s != "snapshot" {
+		return nil
+	}
+	if fn, err := n.LookupByString("follows"); err == nil {
+		if err = restoreFollows(ctx, ipfscore, fn); err != nil {
+			log.Warnf("could not restore follows from backup: %v", err)
+		}
+	}
+	fn, err := n.LookupByString("feed")
+	if err != nil {
+		return nil
+	}
+	l, err := fn.AsLink()
+	if err != nil {
+		return nil
+	}
+	head := l.(cidlink.Link).Cid
+	config := CurrentConfig
+	if config.FeedHead != "" {
+		if config.FeedHead != head.String() {
+			log.Warnf("node already has feed head %s, not restoring feed head %v from backup", config.FeedHead, head)
+		}
+		return nil
+	}
+	config.FeedHead = head.String()
+	log.Infof("restored feed head %v", head)
+	return SaveConfig(config)
+}
+
+// restoreFollows adds the follows in a snapshot which the node doesn't already have.
+func restoreFollows(ctx context.Context, ipfscore ipfs.IPFSCore, n datamodel.Node) error {
+	follows, err := ipfs.ReadMap(ctx, ipfscore, n)
+	if err != nil {
+		return err
+	}
+	config := CurrentConfig
+	restored := 0
+	it := follows.MapIterator()
+	for !it.Done() {
+		k, v, err := it.Next()
+		if err != nil {
+			return err
+		}
+		did, err := k.AsString()
+		if err != nil {
+			b, _ := k.AsBytes()
+			did = string(b)
+		}
+		if _, ok := FindFollow(did); ok {
+			continue
+		}
+		f := Follow{Did: did}
+		if pn, err := v.LookupByString("pubkey"); err == nil {
+			f.NostrPubKey, _ = pn.AsString()
+		}
+		if fn, err := v.LookupByString("feed"); err == nil {
+			f.FeedName, _ = fn.AsString()
+		}
+		if an, err := v.LookupByString("added"); err == nil {
+			a, _ := an.AsInt()
+			f.Added = time.Unix(a, 0)
+		}
+		config.Follows = append(config.Follows, f)
+		restored++
+	}
+	if restored == 0 {
+		return nil
+	}
+	log.Infof("restored %v follows", restored)
+	return SaveConfig(config)
+}
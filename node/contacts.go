@@ -0,0 +1,259 @@
+package node
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/allisterb/patr/blockchain"
+	"github.com/allisterb/patr/did"
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/util"
+)
+
+// Contact is a user the node's user has verified or is verifying. Both users compare a short authentication string
+// derived from both users' keys over a channel they already trust, like a call or in person, and confirm it matches.
+// The contact is verified when both have confirmed the same keys.
+type Contact struct {
+	Did         string
+	NostrPubKey string
+	IPFSPubKey  string
+	// Confirmed is when the user confirmed the short authentication string and RemoteConfirmed when the contact did.
+	Confirmed       time.Time
+	RemoteConfirmed time.Time
+}
+
+// Verified returns true if both users confirmed the short authentication string of the contact's keys.
+func (c Contact) Verified() bool {
+	return !c.Confirmed.IsZero() && !c.RemoteConfirmed.IsZero()
+}
+
+// Status returns whether the contact is verified or which side has confirmed the verification.
+func (c Contact) Status() string {
+	switch {
+	case c.Verified():
+		return "verified"
+	case !c.Confirmed.IsZero():
+		return "confirmed by you"
+	case !c.RemoteConfirmed.IsZero():
+		return "confirmed by contact"
+	default:
+		return "unverified"
+	}
+}
+
+// Commitment returns the hash of the DIDs and keys of the user and the contact which the short authentication string
+// is derived from. It is the same on both sides if both have the same keys for each other.
+func (c Contact) Commitment() string {
+	ipfsName, _ := ipfs.GetIPNSPublicKeyName(CurrentConfig.IPFSPubKey)
+	parties := []string{
+		strings.Join([]string{CurrentConfig.Did, CurrentConfig.NostrPubKey, ipfsName}, " "),
+		strings.Join([]string{c.Did, c.NostrPubKey, c.IPFSPubKey}, " "),
+	}
+	sort.Strings(parties)
+	h := sha256.Sum256([]byte("patr-sas-v1\n" + strings.Join(parties, "\n")))
+	return hex.EncodeToString(h[:])
+}
+
+// SAS returns the short authentication string of the contact, nine digits in groups of three.
+func (c Contact) SAS() string {
+	h, _ := hex.DecodeString(c.Commitment())
+	n := binary.BigEndian.Uint64(h[:8]) % 1000000000
+	return fmt.Sprintf("%03d-%03d-%03d", n/1000000, n/1000%1000, n%1000)
+}
+
+var contactsLock = sync.Mutex{}
+
+func contactsFile() string {
+	return filepath.Join(util.AppData, "contacts.json")
+}
+
+func readContacts() (map[string]Contact, error) {
+	contacts := make(map[string]Contact)
+	if !util.PathExists(contactsFile()) {
+		return contacts, nil
+	}
+	data, err := util.ReadDataFile(contactsFile())
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &contacts); err != nil {
+		log.Errorf("could not read JSON data from contacts file %s: %v", contactsFile(), err)
+		return nil, err
+	}
+	return contacts, nil
+}
+
+func writeContacts(contacts map[string]Contact) error {
+	data, _ := json.MarshalIndent(contacts, "", " ")
+	return util.WriteDataFile(contactsFile(), data)
+}
+
+// Contacts returns the contacts in the contact store.
+func Contacts() ([]Contact, error) {
+	contactsLock.Lock()
+	defer contactsLock.Unlock()
+	contacts, err := readContacts()
+	if err != nil {
+		return nil, err
+	}
+	sorted := []Contact{}
+	for _, c := range contacts {
+		sorted = append(sorted, c)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Did < sorted[j].Did })
+	return sorted, nil
+}
+
+// FindContact returns the contact of a DID.
+func FindContact(d string) (Contact, bool) {
+	contactsLock.Lock()
+	defer contactsLock.Unlock()
+	contacts, err := readContacts()
+	if err != nil {
+		return Contact{}, false
+	}
+	c, ok := contacts[d]
+	return c, ok
+}
+
+// updateContactKeys sets the keys of a contact, starting the verification again if they changed.
+func updateContactKeys(c Contact, nostrPubKey string, ipfsPubKey string) Contact {
+	if c.NostrPubKey != nostrPubKey || c.IPFSPubKey != ipfsPubKey {
+		if c.NostrPubKey != "" {
+			log.Warnf("the keys of contact %s changed, the contact must be verified again", c.Did)
+		}
+		c.NostrPubKey, c.IPFSPubKey = nostrPubKey, ipfsPubKey
+		c.Confirmed, c.RemoteConfirmed = time.Time{}, time.Time{}
+	}
+	return c
+}
+
+// StartVerification resolves the keys of the user of a DID from ENS and adds them to the contact store, returning the
+// contact whose short authentication string both users compare.
+func StartVerification(d string) (Contact, error) {
+	pd, err := did.Parse(d)
+	if err != nil {
+		return Contact{}, fmt.Errorf("invalid DID %s: %v", d, err)
+	}
+	if d == CurrentConfig.Did {
+		return Contact{}, fmt.Errorf("you cannot verify yourself")
+	}
+	r, err := blockchain.ResolveENS(pd.ID.ID, CurrentConfig.InfuraSecretKey)
+	if err != nil {
+		return Contact{}, err
+	}
+	if r.NostrPubKey == "" || r.IPFSPubKey == "" {
+		return Contact{}, fmt.Errorf("%s does not have a Nostr and IPFS public key", d)
+	}
+	contactsLock.Lock()
+	defer contactsLock.Unlock()
+	contacts, err := readContacts()
+	if err != nil {
+		return Contact{}, err
+	}
+	c, ok := contacts[d]
+	if !ok {
+		c = Contact{Did: d}
+	}
+	c = updateContactKeys(c, r.NostrPubKey, r.IPFSPubKey)
+	contacts[d] = c
+	return c, writeContacts(contacts)
+}
+
+// ConfirmVerification records that the user confirmed the short authentication string of a contact matches the one the
+// contact sees, and returns the commitment to send to the contact.
+func ConfirmVerification(d string) (Contact, error) {
+	contactsLock.Lock()
+	defer contactsLock.Unlock()
+	contacts, err := readContacts()
+	if err != nil {
+		return Contact{}, err
+	}
+	c, ok := contacts[d]
+	if !ok || c.NostrPubKey == "" {
+		return Contact{}, fmt.Errorf("start the verification of %s first", d)
+	}
+	c.Confirmed = util.Now()
+	contacts[d] = c
+	return c, writeContacts(contacts)
+}
+
+// ResetVerification removes the verification of a contact.
+func ResetVerification(d string) error {
+	contactsLock.Lock()
+	defer contactsLock.Unlock()
+	contacts, err := readContacts()
+	if err != nil {
+		return err
+	}
+	if _, ok := contacts[d]; !ok {
+		return fmt.Errorf("%s is not a contact", d)
+	}
+	delete(contacts, d)
+	return writeContacts(contacts)
+}
+
+// contactStore is the contact store the p2p DM handler records verifications in.
+type contactStore struct{}
+
+func (contactStore) Verified(d string) bool {
+	c, ok := FindContact(d)
+	return ok && c.Verified()
+}
+
+// ReceiveVerification records the confirmation of a contact if its commitment matches the commitment to the keys the
+// contact has in ENS. A contact which confirms first is added to the contact store.
+func (contactStore) ReceiveVerification(d string, nostrPubKey string, ipfsPubKey string, commitment string) error {
+	contactsLock.Lock()
+	defer contactsLock.Unlock()
+	contacts, err := readContacts()
+	if err != nil {
+		return err
+	}
+	c, ok := contacts[d]
+	if !ok {
+		c = Contact{Did: d}
+	}
+	c = updateContactKeys(c, nostrPubKey, ipfsPubKey)
+	if c.Commitment() != commitment {
+		return fmt.Errorf("the verification of %s is for different keys", d)
+	}
+	c.RemoteConfirmed = util.Now()
+	contacts[d] = c
+	return writeContacts(contacts)
+}
+
+// SetContactHandlers registers GET /contacts which returns the contacts with their verification status.
+func SetContactHandlers(router *mux.Router) {
+	router.Path("/contacts").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		contacts, err := Contacts()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"message": "could not read contacts"})
+			return
+		}
+		type contact struct {
+			Contact
+			SAS      string `json:"sas"`
+			Status   string `json:"status"`
+			Verified bool   `json:"verified"`
+		}
+		resp := []contact{}
+		for _, c := range contacts {
+			resp = append(resp, contact{c, c.SAS(), c.Status(), c.Verified()})
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+}
@@ -0,0 +1,76 @@
+package node
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/allisterb/patr/blockchain"
+	"github.com/allisterb/patr/devnet"
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/nostr"
+	"github.com/allisterb/patr/util"
+)
+
+// EnableDevnet runs this process as the devnet node with index n with short IPNS lifetimes and its own relay port.
+func EnableDevnet(n int) error {
+	if n < 0 || n >= devnet.Nodes {
+		return fmt.Errorf("devnet node must be between 0 and %v", devnet.Nodes-1)
+	}
+	devnet.Enable(n)
+	ipfs.IPNSValidTime = 5 * time.Minute
+	ipfs.IPNSTTL = time.Second
+	RelayPort = devnet.RelayPort(n)
+	return nil
+}
+
+// InitDevnetConfig creates the configuration of a devnet node from deterministic keys and registers its DID in the
+// devnet ENS registry so other devnet nodes can resolve it.
+func InitDevnetConfig(n int) (Config, error) {
+	priv, pub, err := ipfs.DevnetNodeKeyPair(n)
+	if err != nil {
+		return Config{}, err
+	}
+	nsk, npk, err := nostr.GenerateDeterministicKeyPair(devnet.Reader(fmt.Sprintf("patr-devnet/%v/nostr", n)))
+	if err != nil {
+		return Config{}, err
+	}
+	keys := make(map[string]ipfs.NamedKey)
+	for _, name := range ipfs.DefaultKeyNames {
+		kpriv, kpub, err := ipfs.GenerateDeterministicKeyPair(devnet.Reader(fmt.Sprintf("patr-devnet/%v/ipns/%s", n, name)))
+		if err != nil {
+			return Config{}, err
+		}
+		keys[name] = ipfs.NamedKey{PrivKey: kpriv, PubKey: kpub, Created: devnet.Epoch}
+	}
+	seed := make([]byte, 32)
+	if _, err = io.ReadFull(devnet.Reader(fmt.Sprintf("patr-devnet/%v/seed", n)), seed); err != nil {
+		return Config{}, err
+	}
+	config := Config{
+		Did:             devnet.NodeDid(n),
+		IPFSPubKey:      pub,
+		IPFSPrivKey:     priv,
+		NostrPrivKey:    nsk,
+		NostrPubKey:     npk,
+		InfuraSecretKey: "devnet",
+		W3SSecretKey:    "devnet",
+		IPNSKeys:        keys,
+		MasterSeed:      seed,
+	}
+	ipfsname, _ := ipfs.GetIPNSPublicKeyName(pub)
+	err = blockchain.RegisterDevnetName(fmt.Sprintf("node%v.devnet.eth", n), blockchain.ENSName{
+		Address:     fmt.Sprintf("0x%040x", n),
+		IPFSPubKey:  ipfsname,
+		NostrPubKey: npk,
+	})
+	if err != nil {
+		log.Errorf("could not register devnet node %v in devnet ENS registry: %v", n, err)
+		return Config{}, err
+	}
+	if err = os.MkdirAll(util.AppData, 0755); err != nil {
+		return Config{}, err
+	}
+	return config, SaveConfig(config)
+}
@@ -0,0 +1,173 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/ipfs/go-cid"
+	carv2 "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/util"
+	"github.com/allisterb/patr/w3s"
+)
+
+// exportLock serializes exports so each one captures the public roots at a single point in time.
+var exportLock = sync.Mutex{}
+
+func pathCid(p string) cid.Cid {
+	c, err := cid.Parse(strings.TrimPrefix(strings.TrimPrefix(p, "/ipfs/"), "/ipld/"))
+	if err != nil {
+		return cid.Undef
+	}
+	return c
+}
+
+// CreateSnapshot writes a snapshot node linking the feed head, profile and app heads of the node and returns its CID.
+// Since IPFS content is immutable the DAG under the snapshot is consistent even if the feed changes later.
+func CreateSnapshot(ctx context.Context, ipfscore ipfs.IPFSCore) (cid.Cid, error) {
+	exportLock.Lock()
+	config := CurrentConfig
+	exportLock.Unlock()
+	feed := pathCid(config.FeedHead)
+	profile := cid.Undef
+	if k, ok := config.IPNSKeys["profile"]; ok {
+		profile = pathCid(k.Value)
+	}
+	follows, err := followsNode(ctx, ipfscore, config.Follows)
+	if err != nil {
+		return cid.Undef, err
+	}
+	apps := map[string]cid.Cid{}
+	for ns, a := range config.Apps {
+		if c := pathCid(a.Head); c.Defined() {
+			apps[ns] = c
+		}
+	}
+	dagnode, err := qp.BuildMap(basicnode.Prototype.Any, 7, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "type", qp.String("snapshot"))
+		qp.MapEntry(ma, "did", qp.String(config.Did))
+		qp.MapEntry(ma, "created_at", qp.Int(util.Now().Unix()))
+		if feed.Defined() {
+			qp.MapEntry(ma, "feed", qp.Link(cidlink.Link{Cid: feed}))
+		}
+		if profile.Defined() {
+			qp.MapEntry(ma, "profile", qp.Link(cidlink.Link{Cid: profile}))
+		}
+		qp.MapEntry(ma, "follows", qp.Node(follows))
+		if len(apps) > 0 {
+			qp.MapEntry(ma, "apps", qp.Map(int64(len(apps)), func(aa datamodel.MapAssembler) {
+				for ns, c := range apps {
+					qp.MapEntry(aa, ns, qp.Link(cidlink.Link{Cid: c}))
+				}
+			}))
+		}
+	})
+	if err != nil {
+		return cid.Undef, fmt.Errorf("could not create IPLD node for snapshot: %v", err)
+	}
+	blk, err := ipfs.PutIPLDNode(ctx, ipfscore, dagnode)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return blk.Cid(), nil
+}
+
+// followsNode returns the follow list of a snapshot keyed by DID, as a flat map or a link to a sharded map
+// if there are more than ipfs.ShardedMapThreshold follows.
+func followsNode(ctx context.Context, ipfscore ipfs.IPFSCore, follows []Follow) (datamodel.Node, error) {
+	nodes := make(map[string]datamodel.Node)
+	for _, f := range follows {
+		n, err := qp.BuildMap(basicnode.Prototype.Any, 3, func(ma datamodel.MapAssembler) {
+			qp.MapEntry(ma, "pubkey", qp.String(f.NostrPubKey))
+			qp.MapEntry(ma, "feed", qp.String(f.FeedName))
+			qp.MapEntry(ma, "added", qp.Int(f.Added.Unix()))
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not create IPLD node for follow %s: %v", f.Did, err)
+		}
+		nodes[f.Did] = n
+	}
+	if len(nodes) <= ipfs.ShardedMapThreshold {
+		return qp.BuildMap(basicnode.Prototype.Any, int64(len(nodes)), func(ma datamodel.MapAssembler) {
+			for did, n := range nodes {
+				qp.MapEntry(ma, did, qp.Node(n))
+			}
+		})
+	}
+	m, err := ipfs.NewShardedMap(ctx, ipfscore)
+	if err != nil {
+		return nil, err
+	}
+	for did, n := range nodes {
+		if err = m.Set(did, n); err != nil {
+			return nil, err
+		}
+	}
+	root, err := m.Save(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return basicnode.NewLink(cidlink.Link{Cid: root}), nil
+}
+
+// writeSnapshotCar writes the DAG under a snapshot as a CARv1 to a temporary file since the CARv2 header needs the
+// size of the CARv1 payload. The caller must close and remove the file.
+func writeSnapshotCar(ctx context.Context, ipfscore ipfs.IPFSCore, root cid.Cid) (*os.File, error) {
+	f, err := os.CreateTemp("", "patr-export-*.car")
+	if err != nil {
+		return nil, err
+	}
+	if err = w3s.WriteCar(ctx, ipfscore.Api.Dag(), []cid.Cid{root}, f); err != nil {
+		log.Errorf("could not write snapshot %v as CAR: %v", root, err)
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	if _, err = f.Seek(0, 0); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// ExportSnapshot writes a snapshot of the node's public data as an indexed CARv2 to w.
+func ExportSnapshot(ctx context.Context, ipfscore ipfs.IPFSCore, w http.ResponseWriter) error {
+	root, err := CreateSnapshot(ctx, ipfscore)
+	if err != nil {
+		return err
+	}
+	f, err := writeSnapshotCar(ctx, ipfscore, root)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/vnd.ipld.car; version=2")
+	w.Header().Set("X-Patr-Snapshot", root.String())
+	if err = carv2.WrapV1(f, w); err != nil {
+		log.Errorf("could not write snapshot %v as CARv2: %v", root, err)
+		return err
+	}
+	log.Infof("exported snapshot %v", root)
+	return nil
+}
+
+// SetExportHandlers registers the snapshot export API on the relay HTTP router.
+func SetExportHandlers(router *mux.Router, ipfscore ipfs.IPFSCore) {
+	router.Path("/export").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := ExportSnapshot(r.Context(), ipfscore, w); err != nil {
+			http.Error(w, "could not export snapshot", http.StatusInternalServerError)
+		}
+	})
+}
@@ -0,0 +1,312 @@
+package node
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	gonostr "github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/blockchain"
+	"github.com/allisterb/patr/did"
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/p2p"
+	"github.com/allisterb/patr/util"
+)
+
+// Follower statuses. Follow requests to a protected account are pending until the user approves or denies them.
+const (
+	FollowerPending  = "pending"
+	FollowerApproved = "approved"
+	FollowerDenied   = "denied"
+)
+
+// Follower is a user who asked to follow the user's protected account. Approved followers are sent the keys of the
+// user's non-public posts.
+type Follower struct {
+	Did         string
+	NostrPubKey string
+	Message     string
+	Status      string
+	Requested   time.Time
+	Decided     time.Time
+}
+
+var followersLock = sync.Mutex{}
+
+func followersFile() string {
+	return filepath.Join(util.AppData, "followers.json")
+}
+
+func readFollowers() (map[string]Follower, error) {
+	followers := make(map[string]Follower)
+	if !util.PathExists(followersFile()) {
+		return followers, nil
+	}
+	data, err := util.ReadDataFile(followersFile())
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &followers); err != nil {
+		log.Errorf("could not read JSON data from followers file %s: %v", followersFile(), err)
+		return nil, err
+	}
+	return followers, nil
+}
+
+func writeFollowers(followers map[string]Follower) error {
+	data, _ := json.MarshalIndent(followers, "", " ")
+	return util.WriteDataFile(followersFile(), data)
+}
+
+// Followers returns the users who asked to follow the user's protected account, pending requests first.
+func Followers() ([]Follower, error) {
+	followersLock.Lock()
+	defer followersLock.Unlock()
+	followers, err := readFollowers()
+	if err != nil {
+		return nil, err
+	}
+	sorted := []Follower{}
+	for _, f := range followers {
+		sorted = append(sorted, f)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if (sorted[i].Status == FollowerPending) != (sorted[j].Status == FollowerPending) {
+			return sorted[i].Status == FollowerPending
+		}
+		return sorted[i].Did < sorted[j].Did
+	})
+	return sorted, nil
+}
+
+// PostKeyID returns the ID of a key of non-public posts, which tags the posts encrypted with it.
+func PostKeyID(key []byte) string {
+	h := sha256.Sum256(key)
+	return hex.EncodeToString(h[:8])
+}
+
+// PostKeys returns the keys of the user's non-public posts keyed by key ID.
+func PostKeys() map[string][]byte {
+	keys := map[string][]byte{}
+	for _, k := range CurrentConfig.ProtectedKeys {
+		keys[PostKeyID(k)] = k
+	}
+	return keys
+}
+
+// CurrentPostKey returns the key new non-public posts are encrypted with, creating it if the account has none.
+func CurrentPostKey() ([]byte, error) {
+	if n := len(CurrentConfig.ProtectedKeys); n > 0 {
+		return CurrentConfig.ProtectedKeys[n-1], nil
+	}
+	return rotatePostKey()
+}
+
+// rotatePostKey adds a new key for non-public posts so followers who are no longer approved can't read new posts.
+func rotatePostKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	config := CurrentConfig
+	config.ProtectedKeys = append(append([][]byte{}, config.ProtectedKeys...), key)
+	if err := SaveConfig(config); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// RequestFollow sends a follow request with a message to the node of the user of a DID with a protected account.
+func RequestFollow(ctx context.Context, ipfscore ipfs.IPFSCore, d string, message string) error {
+	pd, err := did.Parse(d)
+	if err != nil {
+		return fmt.Errorf("invalid DID %s: %v", d, err)
+	}
+	r, err := blockchain.ResolveENS(pd.ID.ID, CurrentConfig.InfuraSecretKey)
+	if err != nil {
+		return err
+	}
+	if r.NostrPubKey == "" {
+		return fmt.Errorf("%s does not have a Nostr public key", d)
+	}
+	evt, err := p2p.NewFollowRequest(CurrentConfig.NostrPrivKey, r.NostrPubKey, message)
+	if err != nil {
+		return err
+	}
+	return p2p.SendFollowRequest(ctx, ipfscore, CurrentConfig.InfuraSecretKey, CurrentConfig.Did, pd.ID.ID, evt)
+}
+
+// sendPostKeys sends the keys of the user's non-public posts to an approved follower.
+func sendPostKeys(ctx context.Context, ipfscore ipfs.IPFSCore, f Follower) error {
+	pd, err := did.Parse(f.Did)
+	if err != nil {
+		return err
+	}
+	evt, err := p2p.NewFollowKey(CurrentConfig.NostrPrivKey, f.NostrPubKey, PostKeys())
+	if err != nil {
+		return err
+	}
+	return p2p.SendFollowKey(ctx, ipfscore, CurrentConfig.InfuraSecretKey, CurrentConfig.Did, pd.ID.ID, evt)
+}
+
+// decideFollower sets the status of a follower.
+func decideFollower(d string, status string) (Follower, string, error) {
+	followersLock.Lock()
+	defer followersLock.Unlock()
+	followers, err := readFollowers()
+	if err != nil {
+		return Follower{}, "", err
+	}
+	f, ok := followers[d]
+	if !ok {
+		return Follower{}, "", fmt.Errorf("%s has not asked to follow you", d)
+	}
+	old := f.Status
+	f.Status, f.Decided = status, util.Now()
+	followers[d] = f
+	return f, old, writeFollowers(followers)
+}
+
+// ApproveFollower approves the follow request of a DID and sends the follower the keys of the user's non-public posts.
+// If the keys can't be delivered the follower stays approved and approving them again resends the keys.
+func ApproveFollower(ctx context.Context, ipfscore ipfs.IPFSCore, d string) error {
+	if _, err := CurrentPostKey(); err != nil {
+		return err
+	}
+	f, _, err := decideFollower(d, FollowerApproved)
+	if err != nil {
+		return err
+	}
+	log.Infof("approved follow request of %s", d)
+	if err = sendPostKeys(ctx, ipfscore, f); err != nil {
+		return fmt.Errorf("could not send post keys to %s, approve them again to retry: %v", d, err)
+	}
+	return nil
+}
+
+// DenyFollower denies the follow request of a DID. If the follower was approved a new post key is created, so they
+// can't read new non-public posts, and sent to the other approved followers.
+func DenyFollower(ctx context.Context, ipfscore ipfs.IPFSCore, d string) error {
+	_, old, err := decideFollower(d, FollowerDenied)
+	if err != nil {
+		return err
+	}
+	log.Infof("denied follow request of %s", d)
+	if old != FollowerApproved {
+		return nil
+	}
+	if _, err = rotatePostKey(); err != nil {
+		return err
+	}
+	followers, err := Followers()
+	if err != nil {
+		return err
+	}
+	for _, f := range followers {
+		if f.Status != FollowerApproved {
+			continue
+		}
+		if err := sendPostKeys(ctx, ipfscore, f); err != nil {
+			log.Warnf("could not send the new post key to %s, approve them again to retry: %v", f.Did, err)
+		}
+	}
+	return nil
+}
+
+// followerStore is the follower store the p2p DM handler records follow requests and post keys in.
+type followerStore struct{}
+
+// ReceiveFollowRequest records a follow request to the user's protected account as pending. Requests from approved or
+// denied followers don't change their status.
+func (followerStore) ReceiveFollowRequest(d string, nostrPubKey string, evt gonostr.Event) error {
+	if !CurrentConfig.Protected {
+		return fmt.Errorf("the account is not protected")
+	}
+	message, err := p2p.OpenFollowEvent(evt, p2p.KindFollowRequest, nostrPubKey, CurrentConfig.NostrPrivKey)
+	if err != nil {
+		return err
+	}
+	followersLock.Lock()
+	defer followersLock.Unlock()
+	followers, err := readFollowers()
+	if err != nil {
+		return err
+	}
+	f, ok := followers[d]
+	if !ok || f.NostrPubKey != nostrPubKey {
+		f = Follower{Did: d, NostrPubKey: nostrPubKey, Status: FollowerPending}
+	}
+	f.Message, f.Requested = message, util.Now()
+	followers[d] = f
+	if err = writeFollowers(followers); err != nil {
+		return err
+	}
+	log.Infof("follow request from %s is %s: %s", d, f.Status, util.Sensitive(message))
+	return nil
+}
+
+// ReceiveFollowKey adds the post keys sent by a followed protected account to its follow.
+func (followerStore) ReceiveFollowKey(d string, nostrPubKey string, evt gonostr.Event) error {
+	follow, ok := FindFollow(d)
+	if !ok || follow.NostrPubKey != nostrPubKey {
+		return fmt.Errorf("you do not follow %s", d)
+	}
+	content, err := p2p.OpenFollowEvent(evt, p2p.KindFollowKey, nostrPubKey, CurrentConfig.NostrPrivKey)
+	if err != nil {
+		return err
+	}
+	keys, err := p2p.ParseFollowKey(content)
+	if err != nil {
+		return err
+	}
+	if follow.PostKeys == nil {
+		follow.PostKeys = map[string][]byte{}
+	}
+	for id, k := range keys {
+		follow.PostKeys[id] = k
+	}
+	if err = SaveFollow(follow); err != nil {
+		return err
+	}
+	log.Infof("%s approved your follow request and sent %v post keys", d, len(keys))
+	return nil
+}
+
+// SetFollowerHandlers registers GET /followers which returns the follow requests to the user's protected account and
+// POST /followers/{did}/approve and POST /followers/{did}/deny which decide them.
+func SetFollowerHandlers(ctx context.Context, router *mux.Router, ipfscore ipfs.IPFSCore) {
+	router.Path("/followers").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		followers, err := Followers()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"message": "could not read followers"})
+			return
+		}
+		json.NewEncoder(w).Encode(followers)
+	})
+	decide := func(decision string, decided string, f func(context.Context, ipfs.IPFSCore, string) error) {
+		router.Path("/followers/{did}/" + decision).Methods("POST").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			d := mux.Vars(r)["did"]
+			if err := f(ctx, ipfscore, d); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"message": fmt.Sprintf("follow request of %s %s", d, decided)})
+		})
+	}
+	decide("approve", "approved", ApproveFollower)
+	decide("deny", "denied", DenyFollower)
+}
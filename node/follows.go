@@ -0,0 +1,166 @@
+package node
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/util"
+)
+
+// Follow is an author whose feed the node follows.
+type Follow struct {
+	Did         string
+	NostrPubKey string
+	// FeedName is the IPNS name the author publishes their feed head to.
+	FeedName string
+	// LastSeen is the newest feed head fetched. Posts older than it have been fetched unless there is a gap.
+	LastSeen string
+	// Gap and GapUntil record where a truncated fetch stopped and the post it was fetching back to.
+	Gap      string
+	GapUntil string
+	Added    time.Time
+	// Community feeds are mirrored by the node, replicating the parts of each post selected by Replicate.
+	Community bool
+	Replicate []ReplicationRule
+	// PostKeys are the keys of the non-public posts of a protected account sent when it approved the follow request,
+	// keyed by key ID.
+	PostKeys map[string][]byte `json:",omitempty"`
+	// Moved are the previous identities of an account which migrated to a new DID, oldest first.
+	Moved []MovedIdentity `json:",omitempty"`
+}
+
+// MovedIdentity is an identity a followed account migrated away from. Head is the last post fetched from its feed.
+type MovedIdentity struct {
+	Did         string
+	NostrPubKey string
+	FeedName    string
+	Head        string
+	Moved       time.Time
+}
+
+// MovedFrom returns true if a follow migrated away from a DID.
+func (f Follow) MovedFrom(did string) bool {
+	for _, m := range f.Moved {
+		if m.Did == did {
+			return true
+		}
+	}
+	return false
+}
+
+// ReplicationRule selects whether a field of the posts of a mirrored community feed is replicated. Field is a field of
+// the Post type in the feed schema and Match is a glob matched against its value, or against each value of a list field.
+// Patterns without a / are matched against the last element of the value so they can match file names in URLs.
+// Attachments are only replicated if their total size is at most MaxSize, if it is set.
+type ReplicationRule struct {
+	Field     string
+	Match     string
+	MaxSize   int64
+	Replicate bool
+}
+
+// FindFollow returns the follow for a DID.
+func FindFollow(did string) (Follow, bool) {
+	for _, f := range CurrentConfig.Follows {
+		if f.Did == did {
+			return f, true
+		}
+	}
+	return Follow{}, false
+}
+
+// FindFollowByPubKey returns the follow of an author with a Nostr public key.
+func FindFollowByPubKey(pubkey string) (Follow, bool) {
+	for _, f := range CurrentConfig.Follows {
+		if f.NostrPubKey == pubkey {
+			return f, true
+		}
+	}
+	return Follow{}, false
+}
+
+// FollowPubKeys returns the Nostr public keys of the followed authors.
+func FollowPubKeys() []string {
+	keys := []string{}
+	for _, f := range CurrentConfig.Follows {
+		if f.NostrPubKey != "" {
+			keys = append(keys, f.NostrPubKey)
+		}
+	}
+	return keys
+}
+
+// OnFollowsChanged functions are run when the public keys of the followed authors change, e.g. to update the relay
+// allowlist of a running node.
+var OnFollowsChanged = []func(){}
+
+// saveFollows saves a node configuration with changed follows and runs the OnFollowsChanged functions if the public
+// keys of the followed authors changed.
+func saveFollows(config Config) error {
+	before := strings.Join(FollowPubKeys(), ",")
+	if err := SaveConfig(config); err != nil {
+		return err
+	}
+	if strings.Join(FollowPubKeys(), ",") != before {
+		for _, f := range OnFollowsChanged {
+			f()
+		}
+	}
+	return nil
+}
+
+// SaveFollow adds or updates a follow in the node configuration. A follow which migrated to a new DID replaces the
+// follow of its previous DID.
+func SaveFollow(f Follow) error {
+	config := CurrentConfig
+	follows := []Follow{}
+	found := false
+	for _, cf := range config.Follows {
+		if cf.Did == f.Did || f.MovedFrom(cf.Did) {
+			if !found {
+				follows = append(follows, f)
+			}
+			found = true
+			continue
+		}
+		follows = append(follows, cf)
+	}
+	if !found {
+		follows = append(follows, f)
+	}
+	config.Follows = follows
+	return saveFollows(config)
+}
+
+// RemoveFollow removes a follow from the node configuration.
+func RemoveFollow(did string) error {
+	return RemoveFollows([]string{did})
+}
+
+// RemoveFollows removes follows and their fetch budgets from the node configuration.
+func RemoveFollows(dids []string) error {
+	config := CurrentConfig
+	follows := []Follow{}
+	for _, f := range config.Follows {
+		if !util.Contains(dids, f.Did) {
+			follows = append(follows, f)
+		}
+	}
+	if len(follows) == len(config.Follows) {
+		return fmt.Errorf("not following %s", strings.Join(dids, ", "))
+	}
+	config.Follows = follows
+	if config.FetchBudgets != nil {
+		budgets := make(map[string]ipfs.FetchBudget)
+		for k, b := range config.FetchBudgets {
+			if !util.Contains(dids, k) {
+				budgets[k] = b
+			}
+		}
+		config.FetchBudgets = budgets
+		ipfs.FetchBudgets = budgets
+	}
+	return saveFollows(config)
+}
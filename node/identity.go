@@ -0,0 +1,113 @@
+package node
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/allisterb/patr/did"
+	"github.com/allisterb/patr/nostr"
+	"github.com/allisterb/patr/util"
+)
+
+// IdentityScheme is the URL scheme of patr identities.
+const IdentityScheme = "patr://"
+
+// Identity is what a user shares so others can follow them: their DID, Nostr public key, feed IPNS name and relays.
+type Identity struct {
+	Did         string
+	NostrPubKey string
+	FeedName    string
+	Relays      []string
+}
+
+// String returns the patr://<did>?npub=<npub>&ipns=<name>&r=<relay> form of an identity, which is encoded in identity
+// QR codes.
+func (i Identity) String() string {
+	q := url.Values{}
+	if npub, err := nostr.EncodePubKey(i.NostrPubKey); err == nil {
+		q.Set("npub", npub)
+	}
+	if i.FeedName != "" {
+		q.Set("ipns", i.FeedName)
+	}
+	for _, r := range i.Relays {
+		q.Add("r", r)
+	}
+	s := IdentityScheme + i.Did
+	if len(q) > 0 {
+		s += "?" + q.Encode()
+	}
+	return s
+}
+
+// CurrentIdentity returns the identity of the node's user.
+func CurrentIdentity() Identity {
+	i := Identity{Did: CurrentConfig.Did, NostrPubKey: CurrentConfig.NostrPubKey, Relays: CurrentConfig.ProfileRelays}
+	if k, ok := CurrentConfig.IPNSKeys["feed"]; ok {
+		i.FeedName = k.Name()
+	}
+	return i
+}
+
+// IsIdentity returns true if s is a patr identity and not a permalink to a post.
+func IsIdentity(s string) bool {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(s), IdentityScheme)
+	p, _, _ := strings.Cut(rest, "?")
+	return ok && !strings.Contains(p, "/")
+}
+
+// ParseIdentity parses an identity scanned from a QR code.
+func ParseIdentity(s string) (Identity, error) {
+	s = strings.TrimSpace(s)
+	if !IsIdentity(s) {
+		return Identity{}, fmt.Errorf("%s is not a patr identity", s)
+	}
+	d, query, _ := strings.Cut(strings.TrimPrefix(s, IdentityScheme), "?")
+	if !did.IsValid(d) {
+		return Identity{}, fmt.Errorf("identity %s has an invalid DID %s", s, d)
+	}
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return Identity{}, fmt.Errorf("identity %s has an invalid query: %v", s, err)
+	}
+	i := Identity{Did: d, FeedName: strings.TrimPrefix(q.Get("ipns"), "/ipns/"), Relays: q["r"]}
+	if npub := q.Get("npub"); npub != "" {
+		pk, relays, err := nostr.DecodePubKey(npub)
+		if err != nil {
+			return Identity{}, fmt.Errorf("identity %s has an invalid Nostr public key: %v", s, err)
+		}
+		i.NostrPubKey = pk
+		i.Relays = append(i.Relays, relays...)
+	}
+	return i, nil
+}
+
+// WriteQR writes a QR code encoding data to an HTTP response, as a PNG image unless the request has format=text, in which
+// case it is drawn with text. The size of PNG modules is set with scale and text codes are inverted with invert=true.
+func WriteQR(w http.ResponseWriter, r *http.Request, data string) {
+	q := r.URL.Query()
+	if q.Get("format") == "text" {
+		s, err := util.QRText(data, q.Get("invert") == "true")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(s))
+		return
+	}
+	scale, _ := strconv.Atoi(q.Get("scale"))
+	if scale > 32 {
+		scale = 32
+	}
+	png, err := util.QRPNG(data, scale)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(png)
+}
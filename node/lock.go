@@ -0,0 +1,74 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/allisterb/patr/util"
+)
+
+// SetLockPassphrase sets the passphrase which unlocks publishing. An empty passphrase removes the lock passphrase so the
+// datastore passphrase unlocks publishing.
+func SetLockPassphrase(passphrase string) error {
+	if passphrase == "" && !util.DatastoreEncrypted() {
+		return fmt.Errorf("the datastore is not encrypted, so publishing could not be unlocked without a lock passphrase")
+	}
+	config := CurrentConfig
+	config.LockPassphrase = ""
+	if passphrase != "" {
+		h, err := util.HashLockPassphrase(passphrase)
+		if err != nil {
+			return err
+		}
+		config.LockPassphrase = h
+	}
+	if err := SaveConfig(config); err != nil {
+		return err
+	}
+	util.LockPassphraseHash = config.LockPassphrase
+	return nil
+}
+
+// SetLockHandlers registers the publishing lock API. GET /lock returns the state of the lock, POST /lock engages it and
+// POST /lock/unlock releases it with the passphrase in the request.
+func SetLockHandlers(router *mux.Router) {
+	router.Path("/lock").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		s, err := util.PublishLockStatus()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(s)
+	})
+	router.Path("/lock").Methods("POST").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := util.LockPublishing(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"message": "publishing locked"})
+	})
+	router.Path("/lock/unlock").Methods("POST").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		req := struct {
+			Passphrase string `json:"passphrase"`
+		}{}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil || req.Passphrase == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"message": "the request must be JSON with the passphrase"})
+			return
+		}
+		if err := util.UnlockPublishing(req.Passphrase); err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"message": "publishing unlocked"})
+	})
+}
@@ -2,31 +2,140 @@ package node
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/fiatjaf/relayer"
+	"github.com/gorilla/mux"
+	"github.com/ipfs/go-cid"
 
 	logging "github.com/ipfs/go-log/v2"
+	"github.com/nbd-wtf/go-nostr/nip19"
 
+	"github.com/allisterb/patr/blockchain"
+	"github.com/allisterb/patr/bot"
 	"github.com/allisterb/patr/ipfs"
 	"github.com/allisterb/patr/nostr"
+	"github.com/allisterb/patr/outbox"
 	"github.com/allisterb/patr/p2p"
 	"github.com/allisterb/patr/util"
+	"github.com/allisterb/patr/w3s"
 )
 
 type Config struct {
-	Did             string
-	NostrPrivKey    string
-	NostrPubKey     string
-	IPFSPubKey      []byte
-	IPFSPrivKey     []byte
-	InfuraSecretKey string
-	W3SSecretKey    string
-	IPNSKeys        map[byte]byte
+	Did                    string
+	NostrPrivKey           string
+	NostrPubKey            string
+	IPFSPubKey             []byte
+	IPFSPrivKey            []byte
+	InfuraSecretKey        string
+	W3SSecretKey           string
+	IPNSKeys               map[string]ipfs.NamedKey
+	Delegations            []nostr.Delegation
+	RevokedDelegations     []string
+	Bots                   []bot.Bot
+	Gateways               []string
+	LocalGateway           string
+	GatewayProbeMinutes    int
+	WarmGateways           bool
+	WarmupIntervalHours    int
+	LinkCheckIntervalHours int
+	UserAgent              string
+	BatchSize              int
+	BatchIntervalSeconds   int
+	FeedHead               string
+	PendingHead            string
+	BatchHead              string
+	StorageDriver          string
+	DatabaseURL            string
+	MirrorKinds            []int
+	StorageClasses         map[string]string
+	NTPServers             []string
+	PublicTimeline         bool
+	TimelineSize           int
+	SendQueueKB            int
+	SlowClientPolicy       string
+	Hashtags               []string
+	RelayAllowlist         bool
+	AllowedPubKeys         []string
+	MaxSpamScore           float64
+	Geotags                bool
+	GeotagPrecision        int
+	PaymentAddress         string
+	ZapperPubKeys          []string
+	PinOffer               *p2p.PinOffer
+	Follows                []Follow
+	Profile                Profile
+	ProfileRelays          []string
+	ProfileConflict        string
+	APITokens              []APIToken
+	Documents              map[string][]string
+	MaxClockSkewSeconds    int
+	TimeoutSeconds         map[string]int
+	LogLevels              map[string]string
+	Features               map[string]bool
+	RetryPolicies          map[string]RetryPolicyConfig
+	FetchBudgets           map[string]ipfs.FetchBudget
+	SyncMode               string
+	AllowedMediaTypes      []string
+	TranscodeVideos        bool
+	FFmpegPath             string
+	InterfaceSyncModes     map[string]string
+	MediaPinDays           int
+	MediaPinQuotaMB        int
+	// IPFSRepoPath is the directory of the on-disk IPFS repo, by default ipfs in the node data directory. If it is
+	// memory the node keeps blocks and pins in memory and loses them when it stops.
+	IPFSRepoPath   string
+	ContentFilters []nostr.ContentFilter
+	// LockIdleMinutes locks publishing once nothing was published for this many minutes. LockPassphrase is the hash of
+	// the passphrase which unlocks publishing, set with patr lock passphrase. If it is empty the datastore passphrase is
+	// used.
+	LockIdleMinutes int
+	LockPassphrase  string
+	Swarm           ipfs.SwarmConfig
+	// Protected accounts approve who can follow them. ProtectedKeys are the keys of the non-public posts sent to approved
+	// followers, newest last.
+	Protected     bool
+	ProtectedKeys [][]byte
+	// PreviousDids are the DIDs the account migrated away from, oldest first.
+	PreviousDids []string
+	// ContactList is the CID of the IPLD node of the contact list of followed feeds, which the profile links to.
+	ContactList string
+	// MasterSeed is the seed the IPNS keys of app namespaces are derived from. Apps are the heads of the data of the app
+	// namespaces other than the social feed, keyed by namespace.
+	MasterSeed []byte
+	Apps       map[string]App
+	// Codec is the IPLD codec profiles and Nostr events are encoded with, dag-cbor or dag-json. The default is dag-cbor.
+	Codec string
+	// Root is the CID of the root linking the versions of the user's objects last published together to the root IPNS name.
+	Root string
+	// Peering are the nodes of mutual follows the IPFS node keeps connected to.
+	Peering []PeeringPeer
+	// RelayInfo is the name, description and operator of the relay in its NIP-11 relay information document.
+	RelayInfo nostr.RelayInfo
+	// W3UpAgentKey is the key the node signs invocations of the w3up API of web3.storage with, W3UpSpace the DID of the
+	// space uploads are stored in and W3UpProof the base64 delegation of store/add and upload/add on the space to the
+	// agent. The w3up API is used instead of the token API in W3SSecretKey when the agent key is set.
+	W3UpAgentKey string
+	W3UpSpace    string
+	W3UpProof    string
+	// PinningService is the remote pinning service blocks are pinned with, Web3.Storage by default. PinningServices are
+	// other services blocks are pinned with concurrently, and PinQuorum is how many of the services must pin a block for
+	// it to be pinned, 1 by default or -1 for all of them.
+	PinningService  ipfs.PinningServiceConfig
+	PinningServices []ipfs.PinningServiceConfig `json:",omitempty"`
+	PinQuorum       int                         `json:",omitempty"`
+	// IPNSKeyType is the type of the keys generated for new IPNS names, ed25519 or rsa. The default is ed25519.
+	IPNSKeyType string
+	// AcceptRelayTerms are the URLs of the relays whose terms of service the node acknowledges with the user's Nostr key
+	// before publishing to them, or * for every relay.
+	AcceptRelayTerms []string
 }
 
 type NodeRun struct {
@@ -37,6 +146,26 @@ type NodeRun struct {
 
 var log = logging.Logger("patr/node")
 
+// RetryPolicyConfig is the retry policy of a network client in the node configuration file.
+type RetryPolicyConfig struct {
+	MaxAttempts      int
+	InitialBackoffMs int
+	MaxBackoffMs     int
+	Multiplier       float64
+	Jitter           float64
+}
+
+// OnStarted functions are run once the node and relay HTTP API are started, e.g. to start background tasks of packages
+// which depend on the node package.
+var OnStarted = []func(ctx context.Context, ipfscore ipfs.IPFSCore, router *mux.Router){}
+
+// SwarmFlags are the swarm host, port and addresses given on the command line, which override the ones in the node
+// configuration.
+var SwarmFlags = ipfs.SwarmConfig{}
+
+// RelayPort is the port the Nostr relay and HTTP API listen on.
+var RelayPort = 4002
+
 var CurrentConfig = Config{}
 var CurrentConfigInitialized = false
 
@@ -46,12 +175,24 @@ func PanicIfNotInitialized() {
 	}
 }
 func LoadConfig() (Config, error) {
-	f := filepath.Join(filepath.Join(util.GetUserHomeDir(), ".patr"), "node.json")
+	config, err := readConfig()
+	if err != nil {
+		return Config{}, err
+	}
+	applyConfig(config)
+	CurrentConfig = config
+	CurrentConfigInitialized = true
+	return config, nil
+}
+
+// readConfig reads and checks the node configuration file.
+func readConfig() (Config, error) {
+	f := util.ServerConfigFile
 	if _, err := os.Stat(f); err != nil {
 		log.Errorf("could not find node configuration file %s", f)
 		return Config{}, err
 	}
-	c, err := os.ReadFile(f)
+	c, err := util.ReadDataFile(f)
 	if err != nil {
 		log.Errorf("could not read data from node configuration file: %v", err)
 		return Config{}, err
@@ -73,22 +214,293 @@ func LoadConfig() (Config, error) {
 		log.Warnf("Infura API secret key not set in configuration file")
 		return Config{}, fmt.Errorf("INFURA API SECRET KEY NOT SET IN CONFIGURATION FILE")
 	}
-	if config.W3SSecretKey == "" {
-		log.Warnf("Web3.Storage API secret key not set in configuration file")
-		return Config{}, fmt.Errorf("WEB3.STORAGE API SECRET KEY NOT SET IN CONFIGURATION FILE")
+	if config.W3SSecretKey == "" && config.W3UpAgentKey == "" {
+		log.Warnf("Web3.Storage API secret key or w3up agent key not set in configuration file")
+		return Config{}, fmt.Errorf("WEB3.STORAGE API SECRET KEY OR W3UP AGENT KEY NOT SET IN CONFIGURATION FILE")
 	}
-	CurrentConfig = config
-	CurrentConfigInitialized = true
 	return config, nil
 }
 
+// applyConfig sets the log levels, timeouts, limits and retry policies of the node packages from the node configuration.
+func applyConfig(config Config) {
+	applyLogLevels(config.LogLevels)
+	addConfigSecrets(config)
+	for _, f := range util.SetFeatures(config.Features) {
+		log.Warnf("unknown feature flag %s in configuration file", f)
+	}
+	applyTimeouts(config.TimeoutSeconds)
+	if config.MaxSpamScore > 0 {
+		nostr.MaxSpamScore = config.MaxSpamScore
+	}
+	if config.MaxClockSkewSeconds > 0 {
+		util.MaxClockSkew = time.Duration(config.MaxClockSkewSeconds) * time.Second
+	}
+	if config.FetchBudgets != nil {
+		ipfs.FetchBudgets = config.FetchBudgets
+	}
+	applySyncModes(config.SyncMode, config.InterfaceSyncModes)
+	if err := nostr.SetContentFilters(config.ContentFilters); err != nil {
+		log.Errorf("invalid content filters in configuration file: %v", err)
+	}
+	applySwarm(config.Swarm)
+	ipfs.PeeringPeers = peeringPeerIDs(config.Peering)
+	if config.W3UpAgentKey != "" && config.W3UpProof == "" {
+		log.Warnf("the w3up agent does not have a delegation from a space in configuration file, run patr node w3up")
+		w3s.ConfigureUp("", "", "")
+	} else if err := w3s.ConfigureUp(config.W3UpAgentKey, config.W3UpSpace, config.W3UpProof); err != nil {
+		log.Errorf("invalid w3up configuration in configuration file, using the token API: %v", err)
+		w3s.ConfigureUp("", "", "")
+	}
+	ipfs.PinningService = config.PinningService
+	if err := config.PinningService.Validate(); err != nil {
+		log.Errorf("invalid pinning service in configuration file, using Web3.Storage: %v", err)
+		ipfs.PinningService = ipfs.PinningServiceConfig{}
+	}
+	ipfs.PinningServices = []ipfs.PinningServiceConfig{}
+	for _, s := range config.PinningServices {
+		if err := s.Validate(); err != nil {
+			log.Errorf("invalid pinning service in configuration file: %v", err)
+			continue
+		}
+		ipfs.PinningServices = append(ipfs.PinningServices, s)
+	}
+	ipfs.PinQuorum = 1
+	if config.PinQuorum != 0 {
+		ipfs.PinQuorum = config.PinQuorum
+	}
+	nostr.AcceptTermsRelays = config.AcceptRelayTerms
+	nostr.SetTermsKeys(config.NostrPrivKey)
+	ipfs.IPNSKeyType = ipfs.KeyTypeEd25519
+	switch config.IPNSKeyType {
+	case "", ipfs.KeyTypeEd25519:
+	case ipfs.KeyTypeRSA:
+		ipfs.IPNSKeyType = ipfs.KeyTypeRSA
+	default:
+		log.Warnf("unknown IPNS key type %s in configuration file, using %s", config.IPNSKeyType, ipfs.KeyTypeEd25519)
+	}
+	ipfs.DefaultCodec = ipfs.CodecDagCBOR
+	if config.Codec != "" {
+		if _, err := ipfs.CodecPrefix(config.Codec); err != nil {
+			log.Warnf("%v in configuration file, using %s", err, ipfs.CodecDagCBOR)
+		} else {
+			ipfs.DefaultCodec = config.Codec
+		}
+	}
+	switch config.IPFSRepoPath {
+	case "":
+		ipfs.RepoPath = util.IPFSRepoDir
+	case "memory":
+		ipfs.RepoPath = ""
+	default:
+		ipfs.RepoPath = config.IPFSRepoPath
+	}
+	util.LockIdle = time.Duration(config.LockIdleMinutes) * time.Minute
+	if util.LockIdle > 0 && config.LockPassphrase == "" && !util.DatastoreEncrypted() {
+		log.Warnf("the idle lock is disabled because no lock passphrase is set and the datastore is not encrypted")
+		util.LockIdle = 0
+	}
+	util.LockPassphraseHash = config.LockPassphrase
+	ipfs.TranscodeVideos = config.TranscodeVideos
+	if config.FFmpegPath != "" {
+		ipfs.FFmpegPath = config.FFmpegPath
+	}
+	if ipfs.TranscodeVideos && !ipfs.FFmpegAvailable() {
+		log.Warnf("video transcoding is enabled but ffmpeg was not found at %s, videos will not be transcoded", ipfs.FFmpegPath)
+		ipfs.TranscodeVideos = false
+	}
+	if len(config.AllowedMediaTypes) > 0 {
+		ipfs.AllowedMediaTypes = config.AllowedMediaTypes
+	} else {
+		ipfs.AllowedMediaTypes = ipfs.DefaultAllowedMediaTypes
+	}
+	for client, p := range config.RetryPolicies {
+		util.SetRetryPolicy(client, util.RetryPolicy{
+			MaxAttempts:    p.MaxAttempts,
+			InitialBackoff: time.Duration(p.InitialBackoffMs) * time.Millisecond,
+			MaxBackoff:     time.Duration(p.MaxBackoffMs) * time.Millisecond,
+			Multiplier:     p.Multiplier,
+			Jitter:         p.Jitter,
+		})
+	}
+}
+
+// applySwarm sets the swarm configuration of the IPFS node from the node configuration and the command line flags.
+func applySwarm(s ipfs.SwarmConfig) {
+	if SwarmFlags.Host != "" {
+		s.Host = SwarmFlags.Host
+	}
+	if SwarmFlags.Port != 0 {
+		s.Port = SwarmFlags.Port
+	}
+	if len(SwarmFlags.Addrs) > 0 {
+		s.Addrs = SwarmFlags.Addrs
+	}
+	if len(SwarmFlags.AnnounceAddrs) > 0 {
+		s.AnnounceAddrs = SwarmFlags.AnnounceAddrs
+	}
+	if err := s.Validate(); err != nil {
+		log.Errorf("invalid swarm configuration, using the default: %v", err)
+		s = ipfs.SwarmConfig{}
+	}
+	ipfs.Swarm = s
+}
+
+// PinningEnabled returns true if the node pins data with a remote pinning service: one configured in the node
+// configuration, or web3.storage with the w3up API or the token API.
+func PinningEnabled() bool {
+	if len(ipfs.PinningServices) > 0 {
+		return true
+	}
+	switch ipfs.PinningService.Provider {
+	case "", ipfs.PinningW3S:
+		return w3s.Enabled(CurrentConfig.W3SSecretKey)
+	default:
+		return ipfs.PinningService.Validate() == nil
+	}
+}
+
+// addConfigSecrets registers the private keys and API keys in the configuration so they are redacted from logs.
+func addConfigSecrets(config Config) {
+	util.AddSecrets(config.NostrPrivKey, config.InfuraSecretKey, config.W3SSecretKey, config.W3UpAgentKey, config.PinningService.Token)
+	for _, s := range config.PinningServices {
+		util.AddSecrets(s.Token)
+	}
+	if nsec, err := nip19.EncodePrivateKey(config.NostrPrivKey); err == nil {
+		util.AddSecrets(nsec)
+	}
+	privkeys := append([][]byte{config.IPFSPrivKey, config.MasterSeed}, config.ProtectedKeys...)
+	for _, k := range config.IPNSKeys {
+		privkeys = append(privkeys, k.PrivKey, k.PreviousKey)
+	}
+	for _, k := range privkeys {
+		if len(k) > 0 {
+			util.AddSecrets(base64.StdEncoding.EncodeToString(k), hex.EncodeToString(k))
+		}
+	}
+}
+
+// applyLogLevels sets the levels of loggers from the node configuration, keyed by logger name like patr/nostr or bitswap.
+func applyLogLevels(levels map[string]string) {
+	for name, level := range levels {
+		if err := logging.SetLogLevel(name, level); err != nil {
+			log.Warnf("could not set level of logger %s to %s: %v", name, level, err)
+		}
+	}
+}
+
+// applySyncModes sets the global sync mode and the sync modes of network interfaces from the node configuration. Unknown
+// modes are ignored.
+func applySyncModes(mode string, interfaces map[string]string) {
+	if mode != "" {
+		if err := ipfs.ValidSyncMode(mode); err != nil {
+			log.Warnf("%v in configuration file, using %s", err, ipfs.SyncFull)
+			mode = ipfs.SyncFull
+		}
+	}
+	valid := map[string]string{}
+	for i, m := range interfaces {
+		if err := ipfs.ValidSyncMode(m); err != nil {
+			log.Warnf("%v for interface %s in configuration file", err, i)
+			continue
+		}
+		valid[i] = m
+	}
+	ipfs.SetSyncMode(mode, valid)
+}
+
+// applyTimeouts sets the timeouts of network operations from the node configuration. Keys are pin, ipns-publish,
+// ipns-resolve, dht, bitswap, w3s, pinning-service, blockchain, content-filter and relay.
+func applyTimeouts(timeouts map[string]int) {
+	for k, v := range timeouts {
+		d := time.Duration(v) * time.Second
+		switch k {
+		case "pin":
+			ipfs.PinTimeout = d
+		case "ipns-publish":
+			ipfs.IPNSPublishTimeout = d
+		case "ipns-resolve":
+			ipfs.IPNSResolveTimeout = d
+		case "dht":
+			ipfs.DHTQueryTimeout = d
+		case "bitswap":
+			ipfs.BitswapTimeout = d
+		case "w3s":
+			w3s.RequestTimeout = d
+		case "pinning-service":
+			ipfs.PinningServiceTimeout = d
+		case "blockchain":
+			blockchain.RPCTimeout = d
+		case "content-filter":
+			nostr.ContentFilterTimeout = d
+		case "relay":
+			nostr.RelayTimeout = d
+		default:
+			log.Warnf("unknown timeout %s in configuration file", k)
+		}
+	}
+}
+
+func SaveConfig(config Config) error {
+	f := util.ServerConfigFile
+	data, _ := json.MarshalIndent(config, "", " ")
+	if err := util.WriteDataFile(f, data); err != nil {
+		log.Errorf("error writing node configuration file %s: %v", f, err)
+		return err
+	}
+	CurrentConfig = config
+	return nil
+}
+
+// SaveBatchHead saves the CID of the last relay event batch so the chain of batches can be continued and exported.
+func SaveBatchHead(head cid.Cid) error {
+	if util.DryRun {
+		return nil
+	}
+	config := CurrentConfig
+	config.BatchHead = head.String()
+	return SaveConfig(config)
+}
+
+// StorageClassOf returns the storage class of the events of a kind in the node configuration. Kinds without a
+// configured class are archival.
+func StorageClassOf(kind int) nostr.StorageClass {
+	classes, err := nostr.ParseStorageClasses(CurrentConfig.StorageClasses)
+	if err != nil {
+		log.Warnf("invalid storage classes in node configuration: %v", err)
+	}
+	if c, ok := classes.Class(kind); ok {
+		return c
+	}
+	return nostr.StorageArchival
+}
+
 func Run(ctx context.Context) error {
 	_, err := LoadConfig()
 	if err != nil {
 		return err
 	}
+	classes, err := nostr.ParseStorageClasses(CurrentConfig.StorageClasses)
+	if err != nil {
+		log.Errorf("invalid storage classes in node configuration: %v", err)
+		return err
+	}
 	log.Info("starting patr node...")
-	ipfs, err := ipfs.StartIPFSNode(ctx, CurrentConfig.IPFSPrivKey, CurrentConfig.IPFSPubKey)
+	if enabled := util.EnabledFeatures(); len(enabled) > 0 {
+		log.Warnf("experimental features enabled: %v", enabled)
+	}
+	if mode, iface, _ := ipfs.SyncStatus(); mode != ipfs.SyncFull {
+		log.Infof("%s sync mode on interface %s, media will not be fetched", mode, iface)
+	}
+	if err = p2p.LoadBlocklist(); err != nil {
+		return err
+	}
+	if err = nostr.LoadModeration(); err != nil {
+		return err
+	}
+	if err = nostr.LoadTermsAcceptances(); err != nil {
+		return err
+	}
+	ipfscore, err := ipfs.StartIPFSNode(ctx, CurrentConfig.IPFSPrivKey, CurrentConfig.IPFSPubKey)
 	if err != nil {
 		log.Errorf("error starting IPFS node: %v", err)
 		return err
@@ -98,24 +510,102 @@ func Run(ctx context.Context) error {
 	//if err := ipfs.Node.DHTClient.Provide(tctx, c, true); err != nil {
 	//	log.Errorf("could not provide patr topic: %v", err)
 	//}
-	p2p.SetDMStreamHandler(*ipfs, CurrentConfig.InfuraSecretKey)
+	ipfscore.W3S.SetAuthToken(CurrentConfig.W3SSecretKey)
+	p2p.SetDMStreamHandler(*ipfscore, CurrentConfig.InfuraSecretKey, contactStore{}, followerStore{})
+	if CurrentConfig.Did != "" && CurrentConfig.NostrPrivKey != "" {
+		if a, err := p2p.NewAttestation(CurrentConfig.NostrPrivKey, CurrentConfig.Did, ipfscore.Node.Identity); err == nil {
+			p2p.SetAttestation(a)
+		}
+	}
+	p2p.SetTrustedPubKeys(FollowPubKeys())
+	p2p.SetPinStreamHandler(*ipfscore, CurrentConfig.PinOffer, p2p.PinPayee{
+		NostrPubKey:     CurrentConfig.NostrPubKey,
+		ZapperPubKeys:   CurrentConfig.ZapperPubKeys,
+		PaymentAddress:  CurrentConfig.PaymentAddress,
+		InfuraSecretKey: CurrentConfig.InfuraSecretKey,
+	})
+	p2p.SchedulePinAudits(ctx, *ipfscore, 6*time.Hour)
+	ipfs.SchedulePinRetries(ctx, *ipfscore, 10*time.Minute)
+	p2p.SetIdentifyStreamHandler(*ipfscore, CurrentConfig.UserAgent)
+	nostr.TopicVersions = p2p.TopicVersionsInUse
+	p2p.SetHaveStreamHandler(*ipfscore)
+	p2p.SetIPNSStreamHandler(*ipfscore)
+	p2p.EnforceBlocklist(*ipfscore)
+	if err = ipfs.ImportNamedKeys(*ipfscore, CurrentConfig.IPNSKeys); err != nil {
+		log.Errorf("could not import IPNS keys into IPFS node keystore: %v", err)
+	}
+	RegisterOutboxHandlers(*ipfscore)
+	if err = outbox.Process(ctx); err != nil {
+		log.Warnf("could not replay outbox: %v", err)
+	}
+	outbox.Schedule(ctx, 5*time.Minute)
+	ipfs.SetMediaGateways(CurrentConfig.Gateways, CurrentConfig.LocalGateway)
+	startSchedules(ctx)
+	SchedulePeering(ctx, *ipfscore)
 
+	policy := relayPolicy()
 	r := nostr.Relay{
-		Ipfscore: *ipfs,
+		Ipfscore:           *ipfscore,
+		RevokedDelegations: policy.RevokedDelegations,
+		BatchSize:          CurrentConfig.BatchSize,
+		BatchInterval:      time.Duration(CurrentConfig.BatchIntervalSeconds) * time.Second,
+		BatchHead:          pathCid(CurrentConfig.BatchHead),
+		StorageDriver:      CurrentConfig.StorageDriver,
+		DatabaseURL:        CurrentConfig.DatabaseURL,
+		MirrorKinds:        CurrentConfig.MirrorKinds,
+		StorageClasses:     classes,
+		PublicTimeline:     CurrentConfig.PublicTimeline,
+		TimelineSize:       CurrentConfig.TimelineSize,
+		Hashtags:           CurrentConfig.Hashtags,
+		Allowlist:          policy.Allowlist,
+		AllowedPubKeys:     policy.AllowedPubKeys,
+		FollowedPubKeys:    policy.FollowedPubKeys,
+		SendQueueBytes:     policy.SendQueueBytes,
+		SlowClientPolicy:   policy.SlowClientPolicy,
+		Info:               relayInfo(),
+		OnBatch: func(c cid.Cid) {
+			p2p.Haves.Add(c)
+			SaveBatchHead(c)
+		},
 	}
 
-	server := relayer.NewServer("0.0.0.0:4002", &r)
-	if err != nil {
-		log.Fatalf("failed to create server: %v", err)
-	}
-	if err := server.Start(); err != nil {
-		log.Fatalf("server terminated: %v", err)
+	server := relayer.NewServer(fmt.Sprintf("0.0.0.0:%v", RelayPort), &r)
+	server.Router().Use(AuthorizeAPI)
+	bot.SetWebhookHandlers(server.Router(), &r, CurrentConfig.Bots)
+	p2p.SetBlocklistHandlers(server.Router(), *ipfscore)
+	SetExportHandlers(server.Router(), *ipfscore)
+	SetThumbnailHandlers(server.Router(), *ipfscore)
+	SetProfileHandlers(ctx, server.Router())
+	SetContactHandlers(server.Router())
+	SetFollowerHandlers(ctx, server.Router(), *ipfscore)
+	SetAppHandlers(ctx, server.Router(), *ipfscore)
+	SetSessionHandlers(server.Router())
+	SetLockHandlers(server.Router())
+	SetReloadHandlers(ctx, server.Router(), *ipfscore, &r)
+	OnFollowsChanged = append(OnFollowsChanged, func() { r.SetPolicy(relayPolicy()) })
+	for _, f := range OnStarted {
+		f(ctx, *ipfscore, server.Router())
 	}
+	go func() {
+		if err := server.Start(); err != nil {
+			log.Fatalf("server terminated: %v", err)
+		}
+	}()
 
-	log.Info("patr node started, press Ctrl-C to stop...")
+	log.Info("patr node started, press Ctrl-C to stop or send SIGHUP to reload the configuration...")
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt)
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			ReloadConfig(ctx, *ipfscore, &r)
+		}
+	}()
 	<-quit
-	ipfs.Shutdown()
+	sctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	err = server.Shutdown(sctx)
+	ipfscore.Shutdown()
 	return err
 }
@@ -0,0 +1,123 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	gonostr "github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/nostr"
+	"github.com/allisterb/patr/outbox"
+	"github.com/allisterb/patr/util"
+)
+
+// The relay publish handler doesn't need the IPFS node, so commands like profile set can publish without starting it.
+func init() {
+	outbox.RegisterHandler(outbox.KindRelayPublish, func(ctx context.Context, e outbox.Entry) error {
+		evt := gonostr.Event{}
+		if err := json.Unmarshal([]byte(e.Payload["event"]), &evt); err != nil {
+			return err
+		}
+		ctx, cancel := util.WithTimeout(ctx, nostr.RelayTimeout)
+		defer cancel()
+		return nostr.PublishToRelay(ctx, e.Payload["relay"], evt)
+	})
+}
+
+// RegisterOutboxHandlers registers the handlers which perform outbound side effects using the IPFS node.
+func RegisterOutboxHandlers(ipfscore ipfs.IPFSCore) {
+	outbox.RegisterHandler(outbox.KindIPNSPublish, func(ctx context.Context, e outbox.Entry) error {
+		name, p := e.Payload["key"], e.Payload["path"]
+		if name == "self" {
+			c, err := cid.Parse(e.Payload["cid"])
+			if err != nil {
+				return err
+			}
+			return ipfs.PublishIPNSRecordForDAGNode(ctx, ipfscore, CurrentConfig.W3SSecretKey, c, name, CurrentConfig.IPFSPrivKey, CurrentConfig.IPFSPubKey)
+		}
+		k, ok := CurrentConfig.IPNSKeys[name]
+		if !ok {
+			return fmt.Errorf("could not find IPNS key %s", name)
+		}
+		if err := ipfs.ImportNamedKeys(ipfscore, map[string]ipfs.NamedKey{name: k}); err != nil {
+			return err
+		}
+		if err := ipfs.PublishNamedKey(ctx, ipfscore, name, p); err != nil {
+			return err
+		}
+		k, err := publishConvertedKey(ctx, ipfscore, name, k, p)
+		if err != nil {
+			return err
+		}
+		config := CurrentConfig
+		k.Value = p
+		config.IPNSKeys[name] = k
+		return SaveConfig(config)
+	})
+	outbox.RegisterHandler(outbox.KindW3SUpload, func(ctx context.Context, e outbox.Entry) error {
+		c, err := cid.Parse(e.Payload["cid"])
+		if err != nil {
+			return err
+		}
+		return ipfs.PinRemote(ctx, ipfscore, c)
+	})
+	outbox.RegisterHandler(outbox.KindW3SNamePublish, func(ctx context.Context, e outbox.Entry) error {
+		c, err := cid.Parse(e.Payload["cid"])
+		if err != nil {
+			return err
+		}
+		if name := e.Payload["key"]; name != "" {
+			k, ok := CurrentConfig.IPNSKeys[name]
+			if !ok {
+				return fmt.Errorf("could not find IPNS key %s", name)
+			}
+			if k.Transitioning() {
+				prev, err := k.PreviousNamedKey()
+				if err != nil {
+					return err
+				}
+				if err = ipfs.PublishIPNSRecordForDAGNodeToW3S(ctx, CurrentConfig.W3SSecretKey, c, prev.PrivKey, prev.PubKey); err != nil {
+					return err
+				}
+			}
+			return ipfs.PublishIPNSRecordForDAGNodeToW3S(ctx, CurrentConfig.W3SSecretKey, c, k.PrivKey, k.PubKey)
+		}
+		return ipfs.PublishIPNSRecordForDAGNodeToW3S(ctx, CurrentConfig.W3SSecretKey, c, CurrentConfig.IPFSPrivKey, CurrentConfig.IPFSPubKey)
+	})
+	outbox.RegisterHandler(outbox.KindPubSubAnnounce, func(ctx context.Context, e outbox.Entry) error {
+		if ipfs.Offline {
+			return ipfs.ErrOffline
+		}
+		return ipfscore.Api.PubSub().Publish(ctx, e.Payload["topic"], []byte(e.Payload["data"]))
+	})
+}
+
+// publishConvertedKey publishes a path to the RSA name of a key converted to Ed25519 during the dual publish window. When
+// the window has ended the RSA name is pointed to the new name and the RSA key is dropped.
+func publishConvertedKey(ctx context.Context, ipfscore ipfs.IPFSCore, name string, k ipfs.NamedKey, p string) (ipfs.NamedKey, error) {
+	if len(k.PreviousKey) == 0 {
+		return k, nil
+	}
+	prev, err := k.PreviousNamedKey()
+	if err != nil {
+		return k, err
+	}
+	prevname := name + "-previous"
+	if err = ipfs.ImportNamedKeys(ipfscore, map[string]ipfs.NamedKey{prevname: prev}); err != nil {
+		return k, err
+	}
+	if k.Transitioning() {
+		return k, ipfs.PublishNamedKey(ctx, ipfscore, prevname, p)
+	}
+	if err = ipfs.PublishNamedKey(ctx, ipfscore, prevname, "/ipns/"+k.Name()); err != nil {
+		return k, err
+	}
+	log.Infof("dual publish window of IPNS key %s ended, %s now points to %s", name, prev.Name(), k.Name())
+	k.PreviousKey = nil
+	k.DualPublishUntil = time.Time{}
+	return k, nil
+}
@@ -0,0 +1,152 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	gonostr "github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/blockchain"
+	"github.com/allisterb/patr/did"
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/nostr"
+	"github.com/allisterb/patr/util"
+)
+
+// PeeringInterval is how often the contact lists of follows are checked for mutual follows to peer with.
+var PeeringInterval = 6 * time.Hour
+
+// PeeringPeer is the node of a mutual follow the IPFS node peers with, so their content and DMs reach each other without
+// waiting for the DHT.
+type PeeringPeer struct {
+	Did    string
+	PeerID string
+	Added  time.Time
+}
+
+// peeringPeerIDs returns the peer IDs of the peering list, skipping invalid ones.
+func peeringPeerIDs(peers []PeeringPeer) []peer.ID {
+	ids := []peer.ID{}
+	for _, p := range peers {
+		id, err := peer.Decode(p.PeerID)
+		if err != nil {
+			log.Warnf("invalid peer ID %s of %s in peering list: %v", p.PeerID, p.Did, err)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// followsBack returns true if the newest contact list of a follow on the profile relays follows the user.
+func followsBack(ctx context.Context, f Follow) (bool, error) {
+	evt, err := nostr.FetchLatest(ctx, CurrentConfig.ProfileRelays, gonostr.Filter{Kinds: []int{gonostr.KindContactList}, Authors: []string{f.NostrPubKey}})
+	if err != nil {
+		return false, err
+	}
+	return evt != nil && evt.Tags.ContainsAny("p", []string{CurrentConfig.NostrPubKey}), nil
+}
+
+// followPeerID returns the peer ID of the IPFS node of a follow from the IPFS public key of its ENS name.
+func followPeerID(f Follow) (peer.ID, error) {
+	d, err := did.Parse(f.Did)
+	if err != nil {
+		return "", fmt.Errorf("invalid DID %s: %v", f.Did, err)
+	}
+	r, err := blockchain.ResolveENS(d.ID.ID, CurrentConfig.InfuraSecretKey)
+	if err != nil {
+		return "", err
+	}
+	if r.IPFSPubKey == "" {
+		return "", fmt.Errorf("%s does not have an IPFS public key", f.Did)
+	}
+	return ipfs.GetIPFSNodeIdentityFromPublicKeyName(r.IPFSPubKey)
+}
+
+// UpdatePeering adds the nodes of follows whose contact lists on the profile relays follow the user back to the peering
+// list and removes the nodes of follows which no longer do. Follows whose contact list can't be fetched stay in the list.
+func UpdatePeering(ctx context.Context) ([]PeeringPeer, error) {
+	if len(CurrentConfig.ProfileRelays) == 0 {
+		return CurrentConfig.Peering, fmt.Errorf("no profile relays to fetch the contact lists of follows from")
+	}
+	current := map[string]PeeringPeer{}
+	for _, p := range CurrentConfig.Peering {
+		current[p.Did] = p
+	}
+	peers := []PeeringPeer{}
+	for _, f := range CurrentConfig.Follows {
+		if f.NostrPubKey == "" {
+			continue
+		}
+		p, peering := current[f.Did]
+		mutual, err := followsBack(ctx, f)
+		if err != nil {
+			log.Warnf("could not fetch the contact list of %s: %v", f.Did, err)
+			if peering {
+				peers = append(peers, p)
+			}
+			continue
+		} else if !mutual {
+			continue
+		}
+		pid, err := followPeerID(f)
+		if err != nil {
+			log.Warnf("could not get the IPFS node of %s: %v", f.Did, err)
+			if peering {
+				peers = append(peers, p)
+			}
+			continue
+		}
+		if !peering || p.PeerID != pid.String() {
+			p = PeeringPeer{Did: f.Did, PeerID: pid.String(), Added: util.Now()}
+			log.Infof("%s follows you back, peering with node %v", f.Did, pid)
+		}
+		peers = append(peers, p)
+	}
+	if reflect.DeepEqual(peers, CurrentConfig.Peering) || (len(peers) == 0 && len(CurrentConfig.Peering) == 0) {
+		return peers, nil
+	}
+	if util.DryRun {
+		log.Infof("dry run: would peer with the nodes of %v mutual follows", len(peers))
+		return peers, nil
+	}
+	config := CurrentConfig
+	config.Peering = peers
+	if err := SaveConfig(config); err != nil {
+		return nil, err
+	}
+	return peers, nil
+}
+
+var cancelPeering context.CancelFunc
+
+// SchedulePeering updates the peering list and the peers of the IPFS node every PeeringInterval, stopping the updates
+// scheduled before.
+func SchedulePeering(ctx context.Context, ipfscore ipfs.IPFSCore) {
+	if cancelPeering != nil {
+		cancelPeering()
+	}
+	if ipfs.Offline || len(CurrentConfig.ProfileRelays) == 0 {
+		return
+	}
+	ctx, cancelPeering = context.WithCancel(ctx)
+	go func() {
+		ticker := time.NewTicker(PeeringInterval)
+		defer ticker.Stop()
+		for {
+			if peers, err := UpdatePeering(ctx); err != nil {
+				log.Warnf("could not update peering with mutual follows: %v", err)
+			} else {
+				ipfs.SetPeeringPeers(ipfscore, peeringPeerIDs(peers))
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
@@ -0,0 +1,274 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	gonostr "github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/blockchain"
+	"github.com/allisterb/patr/did"
+	"github.com/allisterb/patr/nostr"
+	"github.com/allisterb/patr/outbox"
+	"github.com/allisterb/patr/util"
+)
+
+// Rules for resolving a profile changed both on the node and on the external relays since the last sync.
+const (
+	ProfileNewestWins = "newest"
+	ProfilePatrWins   = "patr"
+	ProfileNostrWins  = "nostr"
+)
+
+// ProfileSyncInterval is how often the profile is synced with the external relays while the node is running.
+var ProfileSyncInterval = time.Hour
+
+// Profile is the user's patr profile, which is kept in sync with their kind-0 metadata on the configured ProfileRelays.
+type Profile struct {
+	gonostr.ProfileMetadata
+	Updated time.Time
+}
+
+// profileEvent signs the kind-0 metadata event of a profile, dated when the profile was updated. It is tagged with the
+// user's DID and feed IPNS name so Nostr users can follow the feed by public key, with the CID of the contact list and
+// with the tokens of the revoked delegations.
+func profileEvent(p Profile) (gonostr.Event, error) {
+	content, _ := json.Marshal(p.ProfileMetadata)
+	tags := gonostr.Tags{}
+	if CurrentConfig.Did != "" {
+		tags = append(tags, gonostr.Tag{"did", CurrentConfig.Did})
+	}
+	if k, ok := CurrentConfig.IPNSKeys["feed"]; ok {
+		tags = append(tags, gonostr.Tag{"ipns", k.Name()})
+	}
+	if CurrentConfig.ContactList != "" {
+		tags = append(tags, gonostr.Tag{"contacts", CurrentConfig.ContactList})
+	}
+	if k, ok := CurrentConfig.IPNSKeys[RootKeyName]; ok {
+		tags = append(tags, gonostr.Tag{"root", k.Name()})
+	}
+	tags = append(tags, nostr.RevocationTags(CurrentConfig.RevokedDelegations)...)
+	evt := gonostr.Event{
+		CreatedAt: gonostr.Timestamp(p.Updated.Unix()),
+		Kind:      gonostr.KindSetMetadata,
+		Tags:      tags,
+		Content:   string(content),
+	}
+	if err := evt.Sign(CurrentConfig.NostrPrivKey); err != nil {
+		log.Errorf("could not sign profile metadata: %v", err)
+		return gonostr.Event{}, err
+	}
+	return evt, nil
+}
+
+// PublishProfile publishes the profile as kind-0 metadata to the external relays through the outbox.
+func PublishProfile(ctx context.Context) error {
+	if len(CurrentConfig.ProfileRelays) == 0 || CurrentConfig.Profile.Updated.IsZero() {
+		return nil
+	}
+	evt, err := profileEvent(CurrentConfig.Profile)
+	if err != nil {
+		return err
+	}
+	return PublishToProfileRelays(ctx, evt)
+}
+
+// PublishToProfileRelays publishes an event to the external relays through the outbox.
+func PublishToProfileRelays(ctx context.Context, evt gonostr.Event) error {
+	if len(CurrentConfig.ProfileRelays) == 0 {
+		return nil
+	}
+	data, _ := json.Marshal(evt)
+	for _, r := range CurrentConfig.ProfileRelays {
+		if err := outbox.Enqueue(outbox.KindRelayPublish, r+":"+evt.ID, map[string]string{"relay": r, "event": string(data)}); err != nil {
+			return err
+		}
+	}
+	return outbox.Process(ctx)
+}
+
+// SetProfile updates the profile and publishes it to the external relays.
+func SetProfile(ctx context.Context, m gonostr.ProfileMetadata) error {
+	if err := util.CheckPublishLock(); err != nil {
+		return err
+	}
+	config := CurrentConfig
+	config.Profile = Profile{ProfileMetadata: m, Updated: util.Now()}
+	if util.DryRun {
+		log.Infof("dry run: would update profile and publish it to %v relays", len(config.ProfileRelays))
+		return nil
+	}
+	if err := SaveConfig(config); err != nil {
+		return err
+	}
+	return PublishProfile(ctx)
+}
+
+// RevokeDelegation revokes a delegation token and publishes the revocation in the profile metadata, so relays and
+// clients that don't share the node configuration stop accepting the delegated events.
+func RevokeDelegation(ctx context.Context, config Config, token string) error {
+	if !util.Contains(config.RevokedDelegations, token) {
+		config.RevokedDelegations = append(config.RevokedDelegations, token)
+	}
+	config.Profile.Updated = util.Now()
+	if err := SaveConfig(config); err != nil {
+		return err
+	}
+	return PublishProfile(ctx)
+}
+
+// SyncProfile compares the profile with the newest kind-0 metadata on the external relays. If they differ the profile
+// is imported from the relays or published to them, following the ProfileConflict rule: newest, the default, keeps the
+// most recently updated profile, patr always keeps the node profile and nostr always keeps the relay metadata.
+func SyncProfile(ctx context.Context) error {
+	if len(CurrentConfig.ProfileRelays) == 0 {
+		return nil
+	}
+	evt, err := nostr.FetchLatest(ctx, CurrentConfig.ProfileRelays, gonostr.Filter{Kinds: []int{gonostr.KindSetMetadata}, Authors: []string{CurrentConfig.NostrPubKey}})
+	if err != nil {
+		log.Errorf("could not fetch profile metadata from relays: %v", err)
+		return err
+	}
+	local := CurrentConfig.Profile
+	if evt == nil {
+		return PublishProfile(ctx)
+	}
+	m, err := gonostr.ParseMetadata(*evt)
+	if err != nil {
+		return err
+	}
+	if *m == local.ProfileMetadata {
+		return nil
+	}
+	rule := CurrentConfig.ProfileConflict
+	if rule == "" {
+		rule = ProfileNewestWins
+	}
+	remote := Profile{ProfileMetadata: *m, Updated: evt.CreatedAt.Time()}
+	importRemote := false
+	switch rule {
+	case ProfileNewestWins:
+		importRemote = remote.Updated.After(local.Updated)
+	case ProfilePatrWins:
+		importRemote = local.Updated.IsZero()
+	case ProfileNostrWins:
+		importRemote = true
+	default:
+		return fmt.Errorf("unknown profile conflict rule %s", rule)
+	}
+	if !importRemote {
+		log.Infof("profile metadata on relays is out of date, publishing profile")
+		return PublishProfile(ctx)
+	}
+	log.Infof("importing profile metadata %s updated at %v from relays", evt.ID, remote.Updated)
+	if util.DryRun {
+		return nil
+	}
+	config := CurrentConfig
+	config.Profile = remote
+	return SaveConfig(config)
+}
+
+// ResolveProfileFeed returns the DID and feed IPNS name a Nostr user tags their newest kind-0 metadata with on the relays
+// and the configured ProfileRelays.
+func ResolveProfileFeed(ctx context.Context, pubkey string, relays []string) (string, string, error) {
+	for _, r := range CurrentConfig.ProfileRelays {
+		if !util.Contains(relays, r) {
+			relays = append(relays, r)
+		}
+	}
+	if len(relays) == 0 {
+		return "", "", fmt.Errorf("no relays to fetch the profile of %s from", pubkey)
+	}
+	evt, err := nostr.FetchLatest(ctx, relays, gonostr.Filter{Kinds: []int{gonostr.KindSetMetadata}, Authors: []string{pubkey}})
+	if err != nil {
+		return "", "", err
+	}
+	if evt == nil {
+		return "", "", fmt.Errorf("no profile metadata of %s found on relays %v", pubkey, relays)
+	}
+	did, feed := "", ""
+	if t := evt.Tags.GetFirst([]string{"did", ""}); t != nil {
+		did = t.Value()
+	}
+	if t := evt.Tags.GetFirst([]string{"ipns", ""}); t != nil {
+		feed = t.Value()
+	}
+	if did == "" {
+		return "", "", fmt.Errorf("the profile of %s does not have a patr DID", pubkey)
+	}
+	return did, feed, nil
+}
+
+// ScheduleProfileSync syncs the profile with the external relays every ProfileSyncInterval.
+func ScheduleProfileSync(ctx context.Context) {
+	if len(CurrentConfig.ProfileRelays) == 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(ProfileSyncInterval)
+		defer ticker.Stop()
+		for {
+			if err := SyncProfile(ctx); err != nil {
+				log.Warnf("could not sync profile with relays: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// SetProfileHandlers registers the API clients use to get the ENS profile of a DID at GET /did/{did}. If the avatar
+// references an NFT the profile says whether the owner of the name owns it. The user's own profile is at GET /profile
+// and is updated with PUT /profile. GET /profile/qr returns a QR code of the user's identity to share in person.
+func SetProfileHandlers(ctx context.Context, router *mux.Router) {
+	router.Path("/profile/qr").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteQR(w, r, CurrentIdentity().String())
+	})
+	router.Path("/profile").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(CurrentConfig.Profile)
+	})
+	router.Path("/profile").Methods("PUT").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := util.CheckPublishLock(); err != nil {
+			w.WriteHeader(http.StatusLocked)
+			json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+			return
+		}
+		m := gonostr.ProfileMetadata{}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&m); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"message": "the request must be JSON profile metadata"})
+			return
+		}
+		if err := SetProfile(ctx, m); err != nil {
+			log.Warnf("could not publish profile: %v", err)
+		}
+		json.NewEncoder(w).Encode(CurrentConfig.Profile)
+	})
+	router.Path("/did/{did}").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		d, err := did.Parse(mux.Vars(r)["did"])
+		if err != nil || d.ID.Method != "ens" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"message": "only ENS DIDs are supported"})
+			return
+		}
+		name, err := blockchain.ResolveENS(d.ID.ID, CurrentConfig.InfuraSecretKey)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"message": "could not resolve DID"})
+			return
+		}
+		json.NewEncoder(w).Encode(name)
+	})
+}
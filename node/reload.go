@@ -0,0 +1,159 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/allisterb/patr/devnet"
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/nostr"
+	"github.com/allisterb/patr/p2p"
+	"github.com/allisterb/patr/util"
+)
+
+// OnReload functions are run after the node configuration is reloaded, e.g. to restart background tasks of packages
+// which depend on the node package with new intervals.
+var OnReload = []func(ctx context.Context, ipfscore ipfs.IPFSCore){}
+
+var reloadLock = sync.Mutex{}
+var cancelSchedules context.CancelFunc
+
+// startSchedules starts the background tasks whose intervals and targets are in the node configuration, stopping the
+// ones started before.
+func startSchedules(ctx context.Context) {
+	if cancelSchedules != nil {
+		cancelSchedules()
+	}
+	ctx, cancelSchedules = context.WithCancel(ctx)
+	if !devnet.Enabled {
+		util.ScheduleClockSkewCheck(ctx, CurrentConfig.NTPServers, time.Hour)
+	}
+	ScheduleProfileSync(ctx)
+	probe := 15 * time.Minute
+	if CurrentConfig.GatewayProbeMinutes > 0 {
+		probe = time.Duration(CurrentConfig.GatewayProbeMinutes) * time.Minute
+	}
+	ipfs.ScheduleGatewayProbe(ctx, probe)
+	if CurrentConfig.WarmGateways && CurrentConfig.WarmupIntervalHours > 0 {
+		name, _ := ipfs.GetIPNSPublicKeyName(CurrentConfig.IPFSPubKey)
+		if k, ok := CurrentConfig.IPNSKeys["feed"]; ok {
+			name = k.Name()
+		}
+		ipfs.ScheduleGatewayWarmup(ctx, CurrentConfig.Gateways, name, time.Duration(CurrentConfig.WarmupIntervalHours)*time.Hour)
+	}
+}
+
+// relayPolicy returns the relay policy in the node configuration.
+func relayPolicy() nostr.RelayPolicy {
+	p := nostr.RelayPolicy{
+		Allowlist:          CurrentConfig.RelayAllowlist,
+		FollowedPubKeys:    append(FollowPubKeys(), CurrentConfig.NostrPubKey),
+		RevokedDelegations: CurrentConfig.RevokedDelegations,
+		SendQueueBytes:     CurrentConfig.SendQueueKB * 1024,
+		SlowClientPolicy:   CurrentConfig.SlowClientPolicy,
+	}
+	if p.Allowlist {
+		p.AllowedPubKeys = RelayAllowedPubKeys()
+	}
+	return p
+}
+
+// relayInfo returns the relay information in the node configuration. The operator of the relay is the node's user if
+// no other public key is set.
+func relayInfo() nostr.RelayInfo {
+	i := CurrentConfig.RelayInfo
+	if i.PubKey == "" {
+		i.PubKey = CurrentConfig.NostrPubKey
+	}
+	return i
+}
+
+// restartRequired returns the settings which differ between two configurations and only take effect when the node is
+// restarted.
+func restartRequired(old Config, config Config) []string {
+	settings := map[string][2]any{
+		"Did":                  {old.Did, config.Did},
+		"NostrPrivKey":         {old.NostrPrivKey, config.NostrPrivKey},
+		"IPFSPrivKey":          {old.IPFSPrivKey, config.IPFSPrivKey},
+		"InfuraSecretKey":      {old.InfuraSecretKey, config.InfuraSecretKey},
+		"W3SSecretKey":         {old.W3SSecretKey, config.W3SSecretKey},
+		"W3UpAgentKey":         {old.W3UpAgentKey, config.W3UpAgentKey},
+		"W3UpSpace":            {old.W3UpSpace, config.W3UpSpace},
+		"W3UpProof":            {old.W3UpProof, config.W3UpProof},
+		"IPNSKeys":             {old.IPNSKeys, config.IPNSKeys},
+		"Bots":                 {old.Bots, config.Bots},
+		"UserAgent":            {old.UserAgent, config.UserAgent},
+		"BatchSize":            {old.BatchSize, config.BatchSize},
+		"BatchIntervalSeconds": {old.BatchIntervalSeconds, config.BatchIntervalSeconds},
+		"StorageDriver":        {old.StorageDriver, config.StorageDriver},
+		"DatabaseURL":          {old.DatabaseURL, config.DatabaseURL},
+		"MirrorKinds":          {old.MirrorKinds, config.MirrorKinds},
+		"StorageClasses":       {old.StorageClasses, config.StorageClasses},
+		"PublicTimeline":       {old.PublicTimeline, config.PublicTimeline},
+		"TimelineSize":         {old.TimelineSize, config.TimelineSize},
+		"Hashtags":             {old.Hashtags, config.Hashtags},
+		"PinOffer":             {old.PinOffer, config.PinOffer},
+		"IPFSRepoPath":         {old.IPFSRepoPath, config.IPFSRepoPath},
+		"Swarm":                {old.Swarm, config.Swarm},
+	}
+	changed := []string{}
+	for name, v := range settings {
+		if !reflect.DeepEqual(v[0], v[1]) {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// ReloadConfig reads the node configuration file again and applies the log levels, relay policy and information, fetch
+// budgets, retry policies, timeouts, media gateways and sync schedules without restarting the IPFS node or dropping
+// relay connections. It returns the changed settings which need a restart.
+func ReloadConfig(ctx context.Context, ipfscore ipfs.IPFSCore, r *nostr.Relay) ([]string, error) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	config, err := readConfig()
+	if err != nil {
+		log.Errorf("could not reload node configuration: %v", err)
+		return nil, err
+	}
+	restart := restartRequired(CurrentConfig, config)
+	applyConfig(config)
+	CurrentConfig = config
+	p2p.SetTrustedPubKeys(FollowPubKeys())
+	r.SetPolicy(relayPolicy())
+	r.SetInfo(relayInfo())
+	ipfs.SetMediaGateways(CurrentConfig.Gateways, CurrentConfig.LocalGateway)
+	startSchedules(ctx)
+	SchedulePeering(ctx, ipfscore)
+	for _, f := range OnReload {
+		f(ctx, ipfscore)
+	}
+	if len(restart) > 0 {
+		log.Warnf("node configuration reloaded, restart the node to apply changes to %v", restart)
+	} else {
+		log.Info("node configuration reloaded")
+	}
+	return restart, nil
+}
+
+// SetReloadHandlers registers POST /config/reload, which reloads the node configuration file.
+func SetReloadHandlers(ctx context.Context, router *mux.Router, ipfscore ipfs.IPFSCore, r *nostr.Relay) {
+	router.Path("/config/reload").Methods("POST").HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		restart, err := ReloadConfig(ctx, ipfscore, r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string][]string{"restartRequired": restart})
+	})
+}
@@ -0,0 +1,260 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	"github.com/ipld/go-ipld-prime/linking"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/outbox"
+	"github.com/allisterb/patr/util"
+)
+
+// RootKeyName is the name of the IPNS key of the user's root. The root links the current versions of the profile, feed,
+// site and app data, so objects which change together are published with one IPNS record and readers of the root never
+// see some of them changed and others not.
+const RootKeyName = "root"
+
+// EnsureIPNSKey returns a named IPNS key of the user, generating and saving it if the node does not have it yet.
+func EnsureIPNSKey(name string) (ipfs.NamedKey, error) {
+	if k, ok := CurrentConfig.IPNSKeys[name]; ok {
+		return k, nil
+	}
+	k, err := ipfs.GenerateNamedKey()
+	if err != nil {
+		return ipfs.NamedKey{}, err
+	}
+	config := CurrentConfig
+	keys := map[string]ipfs.NamedKey{}
+	for n, nk := range config.IPNSKeys {
+		keys[n] = nk
+	}
+	keys[name] = k
+	config.IPNSKeys = keys
+	if err = SaveConfig(config); err != nil {
+		return ipfs.NamedKey{}, err
+	}
+	log.Infof("generated IPNS key %s with IPNS name %s", name, k.Name())
+	return k, nil
+}
+
+// validRootObject checks the name of an object linked from the root is one of the user's named keys or an app namespace.
+func validRootObject(name string) error {
+	for _, n := range ipfs.DefaultKeyNames {
+		if name == n {
+			return nil
+		}
+	}
+	if _, ok := Apps()[name]; ok && name != AppSocial {
+		return nil
+	}
+	names := strings.Join(ipfs.DefaultKeyNames, ", ")
+	return fmt.Errorf("unknown root object %s, must be one of %s or a registered app namespace", name, names)
+}
+
+// rootObjects returns the current versions of the objects of the user known to the node configuration.
+func rootObjects(config Config) map[string]cid.Cid {
+	objects := map[string]cid.Cid{}
+	if c := pathCid(config.FeedHead); c.Defined() {
+		objects["feed"] = c
+	}
+	for _, name := range ipfs.DefaultKeyNames {
+		if k, ok := config.IPNSKeys[name]; ok && name != "feed" {
+			if c := pathCid(k.Value); c.Defined() {
+				objects[name] = c
+			}
+		}
+	}
+	for ns, a := range config.Apps {
+		if c := pathCid(a.Head); c.Defined() {
+			objects[ns] = c
+		}
+	}
+	return objects
+}
+
+// newRoot writes the first root of the user, linking the current versions of the objects in the node configuration
+// updated with the new versions of objects.
+func newRoot(ctx context.Context, ipfscore ipfs.IPFSCore, config Config, objects map[string]cid.Cid) (cid.Cid, error) {
+	all := rootObjects(config)
+	for name, c := range objects {
+		all[name] = c
+	}
+	names := []string{}
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	n, err := qp.BuildMap(basicnode.Prototype.Any, 4, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "type", qp.String("root"))
+		qp.MapEntry(ma, "did", qp.String(config.Did))
+		qp.MapEntry(ma, "created_at", qp.Int(util.Now().Unix()))
+		qp.MapEntry(ma, "objects", qp.Map(int64(len(names)), func(oa datamodel.MapAssembler) {
+			for _, name := range names {
+				qp.MapEntry(oa, name, qp.Link(cidlink.Link{Cid: all[name]}))
+			}
+		}))
+	})
+	if err != nil {
+		return cid.Undef, fmt.Errorf("could not create IPLD node for root: %v", err)
+	}
+	p, err := ipfs.CodecPrefix(ipfs.DefaultCodec)
+	if err != nil {
+		return cid.Undef, err
+	}
+	lnk, err := ipfscore.LS.Store(linking.LinkContext{Ctx: ctx}, cidlink.LinkPrototype{Prefix: p}, n)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return lnk.(cidlink.Link).Cid, nil
+}
+
+// patchRoot writes the next version of the root, patching the links of the changed objects in the previous root and
+// linking the previous root.
+func patchRoot(ctx context.Context, ipfscore ipfs.IPFSCore, prev cid.Cid, objects map[string]cid.Cid) (cid.Cid, error) {
+	n, err := ipfscore.LS.Load(linking.LinkContext{Ctx: ctx}, cidlink.Link{Cid: prev}, basicnode.Prototype.Any)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("could not load root %v: %v", prev, err)
+	}
+	current, err := n.LookupByString("objects")
+	if err != nil {
+		return cid.Undef, fmt.Errorf("root %v does not have objects: %v", prev, err)
+	}
+	ops := []ipfs.PatchOp{
+		{Op: ipfs.PatchReplace, Path: datamodel.ParsePath("did"), Value: basicnode.NewString(CurrentConfig.Did)},
+		{Op: ipfs.PatchReplace, Path: datamodel.ParsePath("created_at"), Value: basicnode.NewInt(util.Now().Unix())},
+	}
+	op := ipfs.PatchAdd
+	if _, err := n.LookupByString("previous"); err == nil {
+		op = ipfs.PatchReplace
+	}
+	ops = append(ops, ipfs.PatchOp{Op: op, Path: datamodel.ParsePath("previous"), Value: basicnode.NewLink(cidlink.Link{Cid: prev})})
+	for name, c := range objects {
+		op := ipfs.PatchAdd
+		if v, err := current.LookupByString(name); err == nil && v != nil {
+			op = ipfs.PatchReplace
+		}
+		path := datamodel.ParsePath("objects").AppendSegment(datamodel.PathSegmentOfString(name))
+		ops = append(ops, ipfs.PatchOp{Op: op, Path: path, Value: basicnode.NewLink(cidlink.Link{Cid: c})})
+	}
+	return ipfs.PatchBlock(ctx, ipfscore, prev, ops)
+}
+
+// PublishRoot publishes new versions of several of the user's objects, keyed by feed, profile, media, site or app
+// namespace, together. The new root linking them is written first and then published to the root IPNS name with one
+// IPNS record. The feed head and app heads in the node configuration are updated to the new versions.
+func PublishRoot(ctx context.Context, ipfscore ipfs.IPFSCore, objects map[string]cid.Cid) (cid.Cid, error) {
+	if len(objects) == 0 {
+		return cid.Undef, fmt.Errorf("you must specify the objects to publish")
+	}
+	for name, c := range objects {
+		if err := validRootObject(name); err != nil {
+			return cid.Undef, err
+		}
+		// the root must not link to objects readers cannot fetch from the node
+		if has, _ := ipfscore.Node.Blockstore.Has(ctx, c); !has && !util.DryRun {
+			return cid.Undef, fmt.Errorf("the %s object %v is not stored on the IPFS node", name, c)
+		}
+	}
+	if err := util.CheckPublishLock(); err != nil {
+		return cid.Undef, err
+	}
+	if util.DryRun {
+		log.Infof("dry run: would publish a new root linking %v objects", len(objects))
+		return cid.Undef, nil
+	}
+	if _, err := EnsureIPNSKey(RootKeyName); err != nil {
+		return cid.Undef, err
+	}
+	prevConfig := CurrentConfig
+	root := cid.Undef
+	tx := outbox.Begin("root " + prevConfig.Did)
+	err := tx.Prepare(ctx, "write the new root", func(ctx context.Context) error {
+		var err error
+		if prev := pathCid(prevConfig.Root); prev.Defined() {
+			root, err = patchRoot(ctx, ipfscore, prev, objects)
+		} else {
+			root, err = newRoot(ctx, ipfscore, prevConfig, objects)
+		}
+		return err
+	}, func(ctx context.Context) error {
+		return ipfs.UnpinBlock(ctx, ipfscore, root)
+	})
+	if err != nil {
+		log.Errorf("could not write the new root: %v", err)
+		return cid.Undef, err
+	}
+	err = tx.Prepare(ctx, "save the new root", func(ctx context.Context) error {
+		config := CurrentConfig
+		config.Root = root.String()
+		apps := map[string]App{}
+		for ns, a := range config.Apps {
+			apps[ns] = a
+		}
+		for name, c := range objects {
+			if name == "feed" {
+				config.FeedHead = "/ipfs/" + c.String()
+			} else if ValidAppNamespace(name) == nil {
+				apps[name] = App{Head: c.String(), Updated: util.Now()}
+			}
+		}
+		config.Apps = apps
+		return SaveConfig(config)
+	}, func(ctx context.Context) error {
+		return SaveConfig(prevConfig)
+	})
+	if err != nil {
+		return cid.Undef, err
+	}
+	RegisterOutboxHandlers(ipfscore)
+	if PinningEnabled() {
+		tx.Commit(outbox.KindW3SUpload, root.String(), map[string]string{"cid": root.String()})
+	}
+	p := "/ipfs/" + root.String()
+	tx.Commit(outbox.KindIPNSPublish, RootKeyName+":"+p, map[string]string{"key": RootKeyName, "path": p})
+	if err = tx.Apply(ctx); err != nil {
+		return root, err
+	}
+	log.Infof("published root %v with new versions of %v objects", root, len(objects))
+	return root, nil
+}
+
+// ResolveRoot resolves the IPNS name of a root and returns the objects it links to.
+func ResolveRoot(ctx context.Context, ipfscore ipfs.IPFSCore, name string) (cid.Cid, map[string]cid.Cid, error) {
+	p, err := ipfs.ResolveIPNSName(ctx, ipfscore, name)
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+	root := pathCid(p)
+	if !root.Defined() {
+		return cid.Undef, nil, fmt.Errorf("the IPNS name %s does not point to a root", name)
+	}
+	n, err := ipfscore.LS.Load(linking.LinkContext{Ctx: ctx}, cidlink.Link{Cid: root}, basicnode.Prototype.Any)
+	if err != nil {
+		return cid.Undef, nil, fmt.Errorf("could not load root %v: %v", root, err)
+	}
+	on, err := n.LookupByString("objects")
+	if err != nil {
+		return cid.Undef, nil, fmt.Errorf("root %v does not have objects: %v", root, err)
+	}
+	objects := map[string]cid.Cid{}
+	for itr := on.MapIterator(); !itr.Done(); {
+		k, v, err := itr.Next()
+		if err != nil {
+			return cid.Undef, nil, err
+		}
+		name, _ := k.AsString()
+		if lnk, err := v.AsLink(); err == nil {
+			objects[name] = lnk.(cidlink.Link).Cid
+		}
+	}
+	return root, objects, nil
+}
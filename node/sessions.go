@@ -0,0 +1,240 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/allisterb/patr/bot"
+	"github.com/allisterb/patr/util"
+)
+
+// Session is a device an API client uses the node from. Clients exchange an API token for a session token per device so
+// each device can be listed and revoked on its own. Only the hash of the session token is stored.
+type Session struct {
+	ID        string
+	TokenHash string
+	APIToken  string
+	Device    string
+	Scopes    []string
+	Address   string
+	Created   time.Time
+	LastSeen  time.Time
+}
+
+// SessionSaveInterval is how often the last seen time of a session is saved.
+const SessionSaveInterval = time.Minute
+
+var sessions = []Session{}
+var sessionsModTime time.Time
+var sessionsLock = sync.Mutex{}
+
+func sessionsFile() string {
+	return filepath.Join(util.AppData, "sessions.json")
+}
+
+// loadSessions reads the sessions file if it changed since it was last read, so sessions revoked by another patr
+// process are seen by the node.
+func loadSessions() error {
+	f := sessionsFile()
+	st, err := os.Stat(f)
+	if err != nil {
+		if os.IsNotExist(err) {
+			sessions, sessionsModTime = []Session{}, time.Time{}
+			return nil
+		}
+		return err
+	}
+	if st.ModTime().Equal(sessionsModTime) {
+		return nil
+	}
+	data, err := util.ReadDataFile(f)
+	if err != nil {
+		log.Errorf("could not read sessions file %s: %v", f, err)
+		return err
+	}
+	s := []Session{}
+	if err = json.Unmarshal(data, &s); err != nil {
+		log.Errorf("could not read JSON data from sessions file %s: %v", f, err)
+		return err
+	}
+	sessions, sessionsModTime = s, st.ModTime()
+	return nil
+}
+
+func saveSessions() error {
+	data, _ := json.MarshalIndent(sessions, "", " ")
+	if err := util.WriteDataFile(sessionsFile(), data); err != nil {
+		log.Errorf("could not write sessions file %s: %v", sessionsFile(), err)
+		return err
+	}
+	if st, err := os.Stat(sessionsFile()); err == nil {
+		sessionsModTime = st.ModTime()
+	}
+	return nil
+}
+
+// CreateSession starts a session for a device with the scopes of an API token and returns it with the session token.
+func CreateSession(t APIToken, device string, address string) (Session, string, error) {
+	if device == "" {
+		return Session{}, "", fmt.Errorf("you must specify the name of the device")
+	}
+	token, err := bot.GenerateToken()
+	if err != nil {
+		return Session{}, "", err
+	}
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	if err = loadSessions(); err != nil {
+		return Session{}, "", err
+	}
+	now := util.Now()
+	s := Session{
+		ID:        bot.HashToken(token)[:12],
+		TokenHash: bot.HashToken(token),
+		APIToken:  t.Name,
+		Device:    device,
+		Scopes:    t.Scopes,
+		Address:   address,
+		Created:   now,
+		LastSeen:  now,
+	}
+	sessions = append(sessions, s)
+	if err = saveSessions(); err != nil {
+		return Session{}, "", err
+	}
+	log.Infof("started session %s for device %s with API token %s", s.ID, device, t.Name)
+	return s, token, nil
+}
+
+// FindSession returns the session a bearer token matches and updates its last seen time.
+func FindSession(token string) (Session, bool) {
+	if token == "" {
+		return Session{}, false
+	}
+	h := bot.HashToken(token)
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	if err := loadSessions(); err != nil {
+		return Session{}, false
+	}
+	for i := range sessions {
+		if sessions[i].TokenHash == h {
+			now := util.Now()
+			if now.Sub(sessions[i].LastSeen) > SessionSaveInterval {
+				sessions[i].LastSeen = now
+				saveSessions()
+			}
+			return sessions[i], true
+		}
+	}
+	return Session{}, false
+}
+
+// Sessions returns the sessions of the devices using the node.
+func Sessions() ([]Session, error) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	if err := loadSessions(); err != nil {
+		return nil, err
+	}
+	return append([]Session{}, sessions...), nil
+}
+
+// RevokeSession ends a session so its token can no longer be used.
+func RevokeSession(id string) error {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	if err := loadSessions(); err != nil {
+		return err
+	}
+	s := []Session{}
+	for _, ss := range sessions {
+		if ss.ID != id {
+			s = append(s, ss)
+		}
+	}
+	if len(s) == len(sessions) {
+		return fmt.Errorf("could not find session %s", id)
+	}
+	sessions = s
+	return saveSessions()
+}
+
+// revokeTokenSessions ends the sessions started with an API token.
+func revokeTokenSessions(name string) error {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	if err := loadSessions(); err != nil {
+		return err
+	}
+	s := []Session{}
+	for _, ss := range sessions {
+		if ss.APIToken != name {
+			s = append(s, ss)
+		}
+	}
+	if len(s) == len(sessions) {
+		return nil
+	}
+	sessions = s
+	return saveSessions()
+}
+
+// SetSessionHandlers registers the session API. POST /sessions exchanges an API token for a session token for the device
+// in the request, and admin clients can list sessions at GET /sessions and revoke them at DELETE /sessions/{id}.
+func SetSessionHandlers(router *mux.Router) {
+	router.Path("/sessions").Methods("POST").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		t, ok := FindAPIToken(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"message": "invalid API token"})
+			return
+		}
+		req := struct {
+			Device string `json:"device"`
+		}{}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil || req.Device == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"message": "the request must be JSON with the name of the device"})
+			return
+		}
+		s, token, err := CreateSession(t, req.Device, r.RemoteAddr)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"message": "could not create session"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"id": s.ID, "token": token, "scopes": s.Scopes})
+	})
+	router.Path("/sessions").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		s, err := Sessions()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"message": "could not read sessions"})
+			return
+		}
+		for i := range s {
+			s[i].TokenHash = ""
+		}
+		json.NewEncoder(w).Encode(s)
+	})
+	router.Path("/sessions/{id}").Methods("DELETE").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := RevokeSession(mux.Vars(r)["id"]); err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"message": "session revoked"})
+	})
+}
@@ -0,0 +1,254 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	ipfspath "github.com/ipfs/boxo/coreiface/path"
+	files "github.com/ipfs/boxo/files"
+	"github.com/ipfs/go-cid"
+
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/util"
+)
+
+// Limits of thumbnails. Sources larger than MaxThumbnailSourceBytes or MaxThumbnailSourcePixels are not resized, and
+// thumbnails are at most MaxThumbnailDimension pixels wide and high and MaxThumbnailBytes long.
+const (
+	MaxThumbnailSourceBytes  = 20 * 1024 * 1024
+	MaxThumbnailSourcePixels = 40 * 1000 * 1000
+	MaxThumbnailDimension    = 1024
+	MaxThumbnailBytes        = 256 * 1024
+	DefaultThumbnailWidth    = 320
+)
+
+// ThumbnailCacheBytes is the total size of the thumbnails kept in memory.
+var ThumbnailCacheBytes = 32 * 1024 * 1024
+
+type thumbnail struct {
+	key         string
+	contentType string
+	data        []byte
+}
+
+var thumbnailsLock = sync.Mutex{}
+var thumbnails = make(map[string]thumbnail)
+var thumbnailOrder = []string{}
+var thumbnailBytes = 0
+
+func cachedThumbnail(key string) (thumbnail, bool) {
+	thumbnailsLock.Lock()
+	defer thumbnailsLock.Unlock()
+	t, ok := thumbnails[key]
+	return t, ok
+}
+
+func cacheThumbnail(t thumbnail) {
+	thumbnailsLock.Lock()
+	defer thumbnailsLock.Unlock()
+	if _, ok := thumbnails[t.key]; ok || len(t.data) > ThumbnailCacheBytes {
+		return
+	}
+	for thumbnailBytes+len(t.data) > ThumbnailCacheBytes && len(thumbnailOrder) > 0 {
+		oldest := thumbnailOrder[0]
+		thumbnailOrder = thumbnailOrder[1:]
+		thumbnailBytes -= len(thumbnails[oldest].data)
+		delete(thumbnails, oldest)
+	}
+	thumbnails[t.key] = t
+	thumbnailOrder = append(thumbnailOrder, t.key)
+	thumbnailBytes += len(t.data)
+}
+
+// thumbnailSize returns the size of a thumbnail of an image which fits in the requested width and height, keeping the
+// aspect ratio of the image. Images are never enlarged.
+func thumbnailSize(sw int, sh int, w int, h int) (int, int) {
+	if w <= 0 && h <= 0 {
+		w = DefaultThumbnailWidth
+	}
+	if w <= 0 || w > MaxThumbnailDimension {
+		w = MaxThumbnailDimension
+	}
+	if h <= 0 || h > MaxThumbnailDimension {
+		h = MaxThumbnailDimension
+	}
+	scale := float64(w) / float64(sw)
+	if s := float64(h) / float64(sh); s < scale {
+		scale = s
+	}
+	if scale >= 1 {
+		return sw, sh
+	}
+	tw, th := int(float64(sw)*scale+0.5), int(float64(sh)*scale+0.5)
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+	return tw, th
+}
+
+// resizeImage scales an image down to a width and height by averaging the source pixels covering each pixel.
+func resizeImage(src image.Image, w int, h int) *image.RGBA {
+	b := src.Bounds()
+	rgba, ok := src.(*image.RGBA)
+	if !ok {
+		rgba = image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+	}
+	sw, sh := rgba.Bounds().Dx(), rgba.Bounds().Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, (y+1)*sh/h
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, (x+1)*sw/w
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				i := rgba.PixOffset(rgba.Bounds().Min.X+x0, rgba.Bounds().Min.Y+sy)
+				for sx := x0; sx < x1; sx++ {
+					r += uint64(rgba.Pix[i])
+					g += uint64(rgba.Pix[i+1])
+					bl += uint64(rgba.Pix[i+2])
+					a += uint64(rgba.Pix[i+3])
+					n++
+					i += 4
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{uint8(r / n), uint8(g / n), uint8(bl / n), uint8(a / n)})
+		}
+	}
+	return dst
+}
+
+// encodeThumbnail encodes a thumbnail as PNG if the source format may have transparency, or else as JPEG at the highest
+// quality which fits in MaxThumbnailBytes.
+func encodeThumbnail(img image.Image, format string) ([]byte, string, error) {
+	var buf bytes.Buffer
+	if format == "png" || format == "gif" {
+		if err := png.Encode(&buf, img); err == nil && buf.Len() <= MaxThumbnailBytes {
+			return buf.Bytes(), "image/png", nil
+		}
+	}
+	for q := 85; q >= 40; q -= 15 {
+		buf.Reset()
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: q}); err != nil {
+			return nil, "", err
+		}
+		if buf.Len() <= MaxThumbnailBytes {
+			return buf.Bytes(), "image/jpeg", nil
+		}
+	}
+	return nil, "", fmt.Errorf("thumbnail is larger than %v bytes", MaxThumbnailBytes)
+}
+
+// readMedia reads a UnixFS file from IPFS if it is no larger than MaxThumbnailSourceBytes.
+func readMedia(ctx context.Context, ipfscore ipfs.IPFSCore, c cid.Cid) ([]byte, error) {
+	n, err := ipfscore.Api.Unixfs().Get(ctx, ipfspath.IpfsPath(c))
+	if err != nil {
+		return nil, err
+	}
+	defer n.Close()
+	f, ok := n.(files.File)
+	if !ok {
+		return nil, fmt.Errorf("%v is not a file", c)
+	}
+	data, err := io.ReadAll(io.LimitReader(f, MaxThumbnailSourceBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxThumbnailSourceBytes {
+		return nil, fmt.Errorf("%v is larger than %v bytes", c, MaxThumbnailSourceBytes)
+	}
+	return data, nil
+}
+
+// Thumbnail returns a resized variant of an image on IPFS which fits in a width and height.
+func Thumbnail(ctx context.Context, ipfscore ipfs.IPFSCore, c cid.Cid, w int, h int) ([]byte, string, error) {
+	key := fmt.Sprintf("%v/%v/%v", c, w, h)
+	if t, ok := cachedThumbnail(key); ok {
+		return t.data, t.contentType, nil
+	}
+	ctx, cancel := util.WithTimeout(ctx, ipfs.DHTQueryTimeout)
+	defer cancel()
+	data, err := readMedia(ctx, ipfscore, c)
+	if err != nil {
+		return nil, "", err
+	}
+	if t, err := ipfs.CheckMedia(data, ""); err != nil {
+		return nil, "", err
+	} else if !strings.HasPrefix(t, "image/") {
+		return nil, "", fmt.Errorf("%v is %s, not an image", c, t)
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("could not read image %v: %v", c, err)
+	}
+	if cfg.Width*cfg.Height > MaxThumbnailSourcePixels {
+		return nil, "", fmt.Errorf("image %v is larger than %v pixels", c, MaxThumbnailSourcePixels)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("could not decode image %v: %v", c, err)
+	}
+	tw, th := thumbnailSize(cfg.Width, cfg.Height, w, h)
+	out, contentType, err := encodeThumbnail(resizeImage(img, tw, th), format)
+	if err != nil {
+		return nil, "", err
+	}
+	cacheThumbnail(thumbnail{key: key, contentType: contentType, data: out})
+	return out, contentType, nil
+}
+
+// SetThumbnailHandlers registers GET /media/{cid}/thumbnail which serves a resized variant of an image fitting in the
+// w and h query parameters.
+func SetThumbnailHandlers(router *mux.Router, ipfscore ipfs.IPFSCore) {
+	router.Path("/media/{cid}/thumbnail").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := cid.Parse(mux.Vars(r)["cid"])
+		if err != nil {
+			http.Error(w, "invalid CID", http.StatusBadRequest)
+			return
+		}
+		width, _ := strconv.Atoi(r.URL.Query().Get("w"))
+		height, _ := strconv.Atoi(r.URL.Query().Get("h"))
+		if width < 0 || height < 0 {
+			http.Error(w, "invalid thumbnail size", http.StatusBadRequest)
+			return
+		}
+		etag := fmt.Sprintf("\"%v-%v-%v\"", c, width, height)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		data, contentType, err := Thumbnail(r.Context(), ipfscore, c, width, height)
+		if err != nil {
+			log.Warnf("could not create thumbnail of %v: %v", c, err)
+			http.Error(w, "could not create thumbnail", http.StatusUnprocessableEntity)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		w.Header().Set("ETag", etag)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Write(data)
+	})
+}
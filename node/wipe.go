@@ -0,0 +1,48 @@
+package node
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/util"
+)
+
+// WipeKeys securely wipes the node configuration with the user's private keys, the device sessions, the IPFS repo
+// configuration and keystore and the datastore key, and forgets the keys in memory. The node can't sign or decrypt
+// anything afterwards.
+func WipeKeys() error {
+	sessionsLock.Lock()
+	sessions = []Session{}
+	sessionsLock.Unlock()
+	files := []string{util.ServerConfigFile, sessionsFile()}
+	if ipfs.RepoPath != "" {
+		// The IPFS repo configuration has a copy of the node's private key.
+		files = append(files, filepath.Join(ipfs.RepoPath, "config"))
+		// The IPFS keystore has the IPNS private keys of the feed, app namespaces and previous RSA names.
+		keystore := filepath.Join(ipfs.RepoPath, "keystore")
+		err := filepath.WalkDir(keystore, func(path string, d os.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				files = append(files, path)
+			}
+			return err
+		})
+		if err != nil && !os.IsNotExist(err) {
+			log.Errorf("could not list the IPFS keystore %s: %v", keystore, err)
+			return err
+		}
+	}
+	for _, f := range files {
+		if err := util.WipeFile(f); err != nil {
+			log.Errorf("could not wipe %s: %v", f, err)
+			return err
+		}
+	}
+	if err := util.WipeDatastoreKey(); err != nil {
+		log.Errorf("could not wipe the datastore key: %v", err)
+		return err
+	}
+	CurrentConfig.NostrPrivKey, CurrentConfig.IPFSPrivKey, CurrentConfig.IPNSKeys = "", nil, nil
+	CurrentConfig.InfuraSecretKey, CurrentConfig.W3SSecretKey, CurrentConfig.APITokens = "", "", nil
+	return nil
+}
@@ -0,0 +1,260 @@
+package nostr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/util"
+)
+
+// Ban is a pubkey banned from the relay by an admin.
+type Ban struct {
+	PubKey string
+	Reason string
+	Time   time.Time
+}
+
+// Deletion is an event deleted from the relay by an admin.
+type Deletion struct {
+	ID     string
+	PubKey string
+	Reason string
+	Time   time.Time
+}
+
+// ModerationState is the moderation of the relay by its admins: the pubkeys whose events are rejected and hidden from
+// queries, and the events which were deleted and are not accepted again.
+type ModerationState struct {
+	Bans      []Ban
+	Deletions []Deletion
+	lock      sync.Mutex
+}
+
+var Moderation = &ModerationState{Bans: []Ban{}, Deletions: []Deletion{}}
+
+func moderationFile() string {
+	return filepath.Join(util.AppData, "relay-moderation.json")
+}
+
+// LoadModeration reads the persisted moderation state of the relay.
+func LoadModeration() error {
+	m := Moderation
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !util.PathExists(moderationFile()) {
+		return nil
+	}
+	data, err := util.ReadDataFile(moderationFile())
+	if err != nil {
+		log.Errorf("could not read relay moderation file %s: %v", moderationFile(), err)
+		return err
+	}
+	if err = json.Unmarshal(data, m); err != nil {
+		log.Errorf("could not read JSON data from relay moderation file %s: %v", moderationFile(), err)
+		return err
+	}
+	return nil
+}
+
+func (m *ModerationState) save() error {
+	data, _ := json.MarshalIndent(m, "", " ")
+	if err := util.WriteDataFile(moderationFile(), data); err != nil {
+		log.Errorf("could not write relay moderation file %s: %v", moderationFile(), err)
+		return err
+	}
+	return nil
+}
+
+// Ban bans a pubkey from the relay with a reason, or changes the reason it is banned for.
+func (m *ModerationState) Ban(pubkey string, reason string) error {
+	pk, _, err := DecodePubKey(pubkey)
+	if err != nil {
+		return fmt.Errorf("%s is not a valid Nostr public key", pubkey)
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for i, b := range m.Bans {
+		if b.PubKey == pk {
+			m.Bans[i].Reason = reason
+			return m.save()
+		}
+	}
+	m.Bans = append(m.Bans, Ban{PubKey: pk, Reason: reason, Time: util.Now()})
+	log.Infof("banned pubkey %s from the relay: %s", pk, reason)
+	return m.save()
+}
+
+// Unban removes the ban of a pubkey.
+func (m *ModerationState) Unban(pubkey string) error {
+	pk, _, err := DecodePubKey(pubkey)
+	if err != nil {
+		return fmt.Errorf("%s is not a valid Nostr public key", pubkey)
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for i, b := range m.Bans {
+		if b.PubKey == pk {
+			m.Bans = append(m.Bans[:i], m.Bans[i+1:]...)
+			log.Infof("unbanned pubkey %s from the relay", pk)
+			return m.save()
+		}
+	}
+	return fmt.Errorf("pubkey %s is not banned", pk)
+}
+
+// IsBanned returns true if a pubkey is banned from the relay.
+func (m *ModerationState) IsBanned(pubkey string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, b := range m.Bans {
+		if b.PubKey == pubkey {
+			return true
+		}
+	}
+	return false
+}
+
+// IsDeleted returns true if an event was deleted from the relay by an admin.
+func (m *ModerationState) IsDeleted(id string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, d := range m.Deletions {
+		if d.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *ModerationState) recordDeletion(d Deletion) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.Deletions = append(m.Deletions, d)
+	return m.save()
+}
+
+// QueryStoredEvents returns the stored events matching a filter, including those of banned pubkeys or pubkeys not in
+// the allowlist which are hidden from clients.
+func (r *Relay) QueryStoredEvents(filter nostr.Filter) ([]nostr.Event, error) {
+	if r.storage == nil {
+		return nil, fmt.Errorf("the relay is not initialized")
+	}
+	return r.storage.queryStored(&filter)
+}
+
+// DeleteStoredEvent deletes an event from the relay whatever its author and records the deletion so the event is not
+// accepted again. An event stored in its own block is unpinned from the local node and the pinning services. An event
+// in a batch stays pinned with the other events of the batch but is no longer returned by queries.
+func (r *Relay) DeleteStoredEvent(ctx context.Context, id string, reason string) (Deletion, error) {
+	events, err := r.QueryStoredEvents(nostr.Filter{IDs: []string{id}})
+	if err != nil {
+		return Deletion{}, err
+	}
+	if len(events) == 0 {
+		return Deletion{}, fmt.Errorf("event %s is not stored in the relay", id)
+	}
+	evt := events[0]
+	d := Deletion{ID: evt.ID, PubKey: evt.PubKey, Reason: reason, Time: util.Now()}
+	if err = Moderation.recordDeletion(d); err != nil {
+		return Deletion{}, err
+	}
+	var block *indexEntry
+	if r.storage.index != nil {
+		if e, ok := r.storage.index.lookup(evt.ID); ok && e.Pos < 0 {
+			block = &e
+		}
+	}
+	if err = r.storage.DeleteEvent(evt.ID, evt.PubKey); err != nil {
+		log.Errorf("could not delete event %s from relay storage: %v", evt.ID, err)
+		return Deletion{}, err
+	}
+	if r.storage.timeline != nil {
+		r.storage.timeline.Remove(evt.ID)
+	}
+	for _, t := range r.hashtagTimelines {
+		t.Remove(evt.ID)
+	}
+	if block != nil {
+		if err := ipfs.UnpinBlock(ctx, r.Ipfscore, block.Cid); err == nil {
+			log.Infof("unpinned block %v of deleted event %s", block.Cid, evt.ID)
+		}
+		if err := ipfs.UnpinRemote(ctx, r.Ipfscore, block.Cid); err != nil {
+			log.Warnf("could not unpin block %v of deleted event %s from the pinning services: %v", block.Cid, evt.ID, err)
+		}
+	} else if c, ok := r.storage.batcher.Lookup(evt.ID); ok {
+		log.Infof("deleted event %s stays pinned in batch %v with the other events of the batch", evt.ID, c)
+	}
+	log.Infof("deleted event %s by %s from the relay: %s", evt.ID, evt.PubKey, reason)
+	return d, nil
+}
+
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+}
+
+// setAdminHandlers registers the relay admin API on the relay HTTP router.
+func (r *Relay) setAdminHandlers(router *mux.Router) {
+	router.Path("/admin/events").Methods("GET").HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+		filter := nostr.Filter{}
+		if f := rq.URL.Query().Get("filter"); f != "" {
+			if err := json.Unmarshal([]byte(f), &filter); err != nil {
+				writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid filter: %v", err))
+				return
+			}
+		}
+		events, err := r.QueryStoredEvents(filter)
+		if err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(events)
+	})
+	router.Path("/admin/events/{id}").Methods("DELETE").HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+		id := mux.Vars(rq)["id"]
+		if p, err := DecodeEvent(id); err == nil {
+			id = p.ID
+		}
+		d, err := r.DeleteStoredEvent(rq.Context(), id, rq.URL.Query().Get("reason"))
+		if err != nil {
+			writeAdminError(w, http.StatusNotFound, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(d)
+	})
+	router.Path("/admin/bans").Methods("GET").HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+		Moderation.lock.Lock()
+		defer Moderation.lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Moderation)
+	})
+	router.Path("/admin/bans/{pubkey}").Methods("PUT", "DELETE").HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+		var err error
+		if rq.Method == "PUT" {
+			data := struct {
+				Reason string `json:"reason"`
+			}{}
+			json.NewDecoder(http.MaxBytesReader(w, rq.Body, 4096)).Decode(&data)
+			err = Moderation.Ban(mux.Vars(rq)["pubkey"], data.Reason)
+		} else {
+			err = Moderation.Unban(mux.Vars(rq)["pubkey"])
+		}
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
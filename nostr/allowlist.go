@@ -0,0 +1,84 @@
+package nostr
+
+import (
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// RelayPolicy is the part of the relay configuration which can be changed while the relay is running.
+type RelayPolicy struct {
+	Allowlist          bool
+	AllowedPubKeys     []string
+	FollowedPubKeys    []string
+	RevokedDelegations []string
+	SendQueueBytes     int
+	SlowClientPolicy   string
+}
+
+// SetPolicy changes the relay policy without dropping client connections. Connected websocket clients keep the send
+// queue they were given.
+func (r *Relay) SetPolicy(p RelayPolicy) {
+	r.policyLock.Lock()
+	defer r.policyLock.Unlock()
+	r.Allowlist, r.AllowedPubKeys, r.FollowedPubKeys = p.Allowlist, p.AllowedPubKeys, p.FollowedPubKeys
+	r.RevokedDelegations = p.RevokedDelegations
+	r.SendQueueBytes, r.SlowClientPolicy = p.SendQueueBytes, p.SlowClientPolicy
+	r.indexPolicy()
+}
+
+// indexPolicy builds the pubkey sets of the relay policy. The policy lock must be held.
+func (r *Relay) indexPolicy() {
+	r.allowedPubKeys = make(map[string]bool)
+	for _, k := range r.AllowedPubKeys {
+		r.allowedPubKeys[k] = true
+	}
+	if r.Allowlist {
+		log.Infof("relay allowlist mode enabled for %v pubkeys", len(r.allowedPubKeys))
+	}
+	r.followedPubKeys = make(map[string]bool)
+	for _, k := range r.FollowedPubKeys {
+		r.followedPubKeys[k] = true
+	}
+}
+
+// followed returns true if the user or one of their follows has a pubkey.
+func (r *Relay) followed(pubkey string) bool {
+	r.policyLock.RLock()
+	defer r.policyLock.RUnlock()
+	return r.followedPubKeys[pubkey]
+}
+
+// allowed returns true if the relay is not in allowlist mode, which only accepts and serves events from AllowedPubKeys,
+// or an event was published or delegated by an allowed pubkey.
+func (r *Relay) allowed(evt *nostr.Event) bool {
+	r.policyLock.RLock()
+	defer r.policyLock.RUnlock()
+	return r.isAllowed(evt)
+}
+
+// isAllowed is allowed with the policy lock held.
+func (r *Relay) isAllowed(evt *nostr.Event) bool {
+	if !r.Allowlist {
+		return true
+	}
+	if r.allowedPubKeys[evt.PubKey] {
+		return true
+	}
+	if delegator, err := VerifyDelegation(evt, r.RevokedDelegations); err == nil && delegator != "" {
+		return r.allowedPubKeys[delegator]
+	}
+	return false
+}
+
+// filterAllowed removes events by pubkeys which are not allowed or are banned from query results, so events stored
+// before allowlist mode was enabled or before a pubkey was banned are not served.
+func (r *Relay) filterAllowed(events []nostr.Event) []nostr.Event {
+	r.policyLock.RLock()
+	defer r.policyLock.RUnlock()
+	allowed := []nostr.Event{}
+	for i := range events {
+		if r.isAllowed(&events[i]) && !Moderation.IsBanned(events[i].PubKey) {
+			allowed = append(allowed, events[i])
+		}
+	}
+	return allowed
+}
@@ -0,0 +1,348 @@
+package nostr
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/util"
+)
+
+const DefaultBatchSize = 100
+
+const DefaultBatchInterval = 30 * time.Second
+
+// MaxBatchBytes is the largest encoded size of the events of a batch, with room left for the index and provenance of
+// the events so the batch fits in an IPFS block of at most 1 MiB.
+const MaxBatchBytes = 768 * 1024
+
+// Batcher groups relay events into IPLD batch nodes which are written to IPFS and Web3.Storage
+// when the batch is full or the flush interval elapses, instead of writing each event individually.
+// Batches are written in the background so adding an event never waits for IPFS or the pinning services.
+type Batcher struct {
+	ipfscore  ipfs.IPFSCore
+	size      int
+	interval  time.Duration
+	lock      sync.Mutex
+	flushLock sync.Mutex
+	pending   []nostr.Event
+	sources   []Provenance
+	sizes     []int
+	bytes     int
+	head      cid.Cid
+	index     *ipfs.ShardedMap
+	full      chan struct{}
+	done      chan struct{}
+	stop      sync.Once
+	OnFlush   func(cid.Cid)
+	// OnWritten is called with the events of each batch written and the batch's CID.
+	OnWritten func([]nostr.Event, cid.Cid)
+}
+
+func NewBatcher(ipfscore ipfs.IPFSCore, size int, interval time.Duration) *Batcher {
+	if size <= 0 {
+		size = DefaultBatchSize
+	}
+	if interval <= 0 {
+		interval = DefaultBatchInterval
+	}
+	return &Batcher{
+		ipfscore: ipfscore,
+		size:     size,
+		interval: interval,
+		pending:  []nostr.Event{},
+		sources:  []Provenance{},
+		sizes:    []int{},
+		head:     cid.Undef,
+		full:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+func (b *Batcher) Start() {
+	go func() {
+		t := time.NewTicker(b.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-b.done:
+				return
+			case <-b.ipfscore.Ctx.Done():
+				return
+			case <-t.C:
+				b.Flush()
+			case <-b.full:
+				b.Flush()
+			}
+		}
+	}()
+}
+
+// Stop stops flushing batches in the background and writes the pending events. It can be called more than once.
+func (b *Batcher) Stop() {
+	b.stop.Do(func() { close(b.done) })
+	b.Flush()
+}
+
+// entrySize returns the encoded size of an event in a batch with its index and provenance entries.
+func entrySize(evt nostr.Event, prov Provenance) int {
+	size := len(evt.ID) + len(prov.Source) + len(prov.Origin) + 64
+	n, err := ipfs.NostrEventToIPLDNode(evt)
+	if err != nil {
+		return size
+	}
+	if blk, err := ipfs.EncodeIPLDNode(n, ipfs.DefaultCodec); err == nil {
+		size += len(blk.RawData())
+	}
+	return size
+}
+
+// Add adds an event to the pending batch. When the batch is full the background flush is signalled.
+func (b *Batcher) Add(evt nostr.Event, prov Provenance) {
+	size := entrySize(evt, prov)
+	b.lock.Lock()
+	b.pending = append(b.pending, evt)
+	b.sources = append(b.sources, prov)
+	b.sizes = append(b.sizes, size)
+	b.bytes += size
+	full := len(b.pending) >= b.size || b.bytes >= MaxBatchBytes
+	b.lock.Unlock()
+	if full {
+		select {
+		case b.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// take removes the events of the next batch from the pending events: at most the batch size, and at most MaxBatchBytes
+// unless a single event is larger.
+func (b *Batcher) take() ([]nostr.Event, []Provenance, []int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	n, bytes := 0, 0
+	for n < len(b.pending) && n < b.size && (n == 0 || bytes+b.sizes[n] <= MaxBatchBytes) {
+		bytes += b.sizes[n]
+		n++
+	}
+	events, sources, sizes := b.pending[:n:n], b.sources[:n:n], b.sizes[:n:n]
+	b.pending, b.sources, b.sizes = b.pending[n:], b.sources[n:], b.sizes[n:]
+	b.bytes -= bytes
+	return events, sources, sizes
+}
+
+// putBack returns the events of a batch which could not be written to the front of the pending events.
+func (b *Batcher) putBack(events []nostr.Event, sources []Provenance, sizes []int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, size := range sizes {
+		b.bytes += size
+	}
+	b.pending = append(events, b.pending...)
+	b.sources = append(sources, b.sources...)
+	b.sizes = append(sizes, b.sizes...)
+}
+
+// SetHead sets the batch new batches are linked to, used to continue the chain of batches written before a restart,
+// and loads the event index of the chain.
+func (b *Batcher) SetHead(head cid.Cid) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.head = head
+	index, err := loadEventIndex(b.ipfscore.Ctx, b.ipfscore, head)
+	if err != nil {
+		log.Errorf("could not load event index of batch %v, events in earlier batches can't be looked up: %v", head, err)
+		index, _ = ipfs.NewShardedMap(b.ipfscore.Ctx, b.ipfscore)
+	}
+	b.index = index
+}
+
+// loadEventIndex returns the index of the events in the chain of batches ending at head. Batches link the sharded index
+// of the events in earlier batches and have a flat index of their own events. Chains written before batches linked an
+// index are migrated by merging the flat index of every batch.
+func loadEventIndex(ctx context.Context, ipfscore ipfs.IPFSCore, head cid.Cid) (*ipfs.ShardedMap, error) {
+	var index *ipfs.ShardedMap
+	batches := []cid.Cid{}
+	flat := []datamodel.Node{}
+	for c := head; c.Defined() && index == nil; {
+		batch, err := readBatch(ctx, ipfscore, c)
+		if err != nil {
+			return nil, err
+		}
+		if in, err := batch.LookupByString("index"); err == nil {
+			batches, flat = append(batches, c), append(flat, in)
+		}
+		if en, err := batch.LookupByString("event_index"); err == nil {
+			l, err := en.AsLink()
+			if err != nil {
+				return nil, err
+			}
+			if index, err = ipfs.LoadShardedMap(ctx, ipfscore, l.(cidlink.Link).Cid); err != nil {
+				return nil, err
+			}
+			break
+		}
+		c = cid.Undef
+		if pn, err := batch.LookupByString("prev"); err == nil {
+			if l, err := pn.AsLink(); err == nil {
+				c = l.(cidlink.Link).Cid
+			}
+		}
+	}
+	if index == nil {
+		var err error
+		if index, err = ipfs.NewShardedMap(ctx, ipfscore); err != nil {
+			return nil, err
+		}
+		if len(batches) > 1 {
+			log.Infof("migrating flat event indexes of %v batches to a sharded event index", len(batches))
+		}
+	}
+	for i := len(batches) - 1; i >= 0; i-- {
+		link := basicnode.NewLink(cidlink.Link{Cid: batches[i]})
+		if err := index.Merge(flat[i], func(string, datamodel.Node) (datamodel.Node, error) { return link, nil }); err != nil {
+			return nil, err
+		}
+	}
+	return index, nil
+}
+
+// Head returns the CID of the last batch written.
+func (b *Batcher) Head() cid.Cid {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.head
+}
+
+// Lookup returns the CID of the batch an event was written to.
+func (b *Batcher) Lookup(id string) (cid.Cid, bool) {
+	b.lock.Lock()
+	index := b.index
+	b.lock.Unlock()
+	if index == nil {
+		return cid.Undef, false
+	}
+	n, err := index.Get(id)
+	if err != nil {
+		return cid.Undef, false
+	}
+	l, err := n.AsLink()
+	if err != nil {
+		return cid.Undef, false
+	}
+	return l.(cidlink.Link).Cid, true
+}
+
+// Flush writes the pending events in batches. Events of a batch which can't be written stay pending.
+func (b *Batcher) Flush() error {
+	b.flushLock.Lock()
+	defer b.flushLock.Unlock()
+	for {
+		pending, sources, sizes := b.take()
+		if len(pending) == 0 {
+			return nil
+		}
+		if err := b.write(pending, sources); err != nil {
+			b.putBack(pending, sources, sizes)
+			return err
+		}
+	}
+}
+
+// write writes a batch of events linked to the head batch and makes it the head. Only one batch is written at a time.
+func (b *Batcher) write(pending []nostr.Event, sources []Provenance) error {
+	events := make([]datamodel.Node, len(pending))
+	for i, e := range pending {
+		n, err := ipfs.NostrEventToIPLDNode(e)
+		if err != nil {
+			log.Errorf("could not add event %s to batch: %v", e.ID, err)
+			return err
+		}
+		events[i] = n
+	}
+	ctx, cancel := context.WithTimeout(b.ipfscore.Ctx, 5*time.Minute)
+	defer cancel()
+	b.lock.Lock()
+	if b.index == nil {
+		index, err := ipfs.NewShardedMap(b.ipfscore.Ctx, b.ipfscore)
+		if err != nil {
+			b.lock.Unlock()
+			return err
+		}
+		b.index = index
+	}
+	head, eventIndex := b.head, b.index
+	b.lock.Unlock()
+	index := cid.Undef
+	if head.Defined() {
+		var err error
+		if index, err = eventIndex.Save(ctx); err != nil {
+			return err
+		}
+	}
+	dagnode, err := qp.BuildMap(basicnode.Prototype.Any, 6, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "created_at", qp.Int(util.Now().Unix()))
+		if head.Defined() {
+			qp.MapEntry(ma, "prev", qp.Link(cidlink.Link{Cid: head}))
+			qp.MapEntry(ma, "event_index", qp.Link(cidlink.Link{Cid: index}))
+		}
+		qp.MapEntry(ma, "index", qp.Map(int64(len(pending)), func(ma datamodel.MapAssembler) {
+			for i, e := range pending {
+				qp.MapEntry(ma, e.ID, qp.Int(int64(i)))
+			}
+		}))
+		qp.MapEntry(ma, "events", qp.List(int64(len(events)), func(la datamodel.ListAssembler) {
+			for _, n := range events {
+				qp.ListEntry(la, qp.Node(n))
+			}
+		}))
+		qp.MapEntry(ma, "provenance", qp.List(int64(len(sources)), func(la datamodel.ListAssembler) {
+			for _, p := range sources {
+				qp.ListEntry(la, qp.Map(3, func(ma datamodel.MapAssembler) {
+					qp.MapEntry(ma, "source", qp.String(p.Source))
+					qp.MapEntry(ma, "origin", qp.String(p.Origin))
+					qp.MapEntry(ma, "received", qp.Int(p.Received.Unix()))
+				}))
+			}
+		}))
+	})
+	if err != nil {
+		log.Errorf("could not create IPLD node for event batch: %v", err)
+		return err
+	}
+	blk, err := ipfs.PutIPLDNode(ctx, b.ipfscore, dagnode)
+	if err != nil {
+		log.Errorf("could not write batch of %v events to IPFS: %v", len(pending), err)
+		return err
+	}
+	log.Infof("wrote batch of %v events to IPFS block %v", len(pending), blk.Cid())
+	if len(ipfs.RemotePinners(b.ipfscore)) > 0 {
+		if err = ipfs.PinRemote(ctx, b.ipfscore, blk.Cid()); err != nil {
+			log.Errorf("could not pin event batch %v with the pinning services: %v", blk.Cid(), err)
+		}
+	}
+	link := basicnode.NewLink(cidlink.Link{Cid: blk.Cid()})
+	for _, e := range pending {
+		if err = eventIndex.Set(e.ID, link); err != nil {
+			log.Errorf("could not add event %s to event index: %v", e.ID, err)
+		}
+	}
+	if b.OnWritten != nil {
+		b.OnWritten(pending, blk.Cid())
+	}
+	b.lock.Lock()
+	b.head = blk.Cid()
+	b.lock.Unlock()
+	if b.OnFlush != nil {
+		b.OnFlush(blk.Cid())
+	}
+	return nil
+}
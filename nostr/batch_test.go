@@ -0,0 +1,86 @@
+package nostr
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/internal/ipfstest"
+	"github.com/allisterb/patr/ipfs"
+)
+
+func largeEvent(t *testing.T, size int) nostr.Event {
+	t.Helper()
+	evt := nostr.Event{Kind: nostr.KindTextNote, Content: strings.Repeat("a", size), CreatedAt: nostr.Now(), Tags: nostr.Tags{}}
+	if err := evt.Sign(nostr.GeneratePrivateKey()); err != nil {
+		t.Fatal(err)
+	}
+	return evt
+}
+
+func TestAddDoesNotWriteBatches(t *testing.T) {
+	core := ipfstest.StartOfflineNode(t)
+	b := NewBatcher(*core, 1, time.Hour)
+	b.Add(testEvent(t, nostr.KindTextNote), Provenance{Source: SourceImport})
+	if b.Head().Defined() {
+		t.Fatal("adding an event to a full batch wrote the batch")
+	}
+	b.Start()
+	defer b.Stop()
+	for i := 0; i < 100 && !b.Head().Defined(); i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !b.Head().Defined() {
+		t.Error("the full batch was not written in the background")
+	}
+}
+
+func TestBatchesAreCappedBySize(t *testing.T) {
+	core := ipfstest.StartOfflineNode(t)
+	b := NewBatcher(*core, DefaultBatchSize, time.Hour)
+	for i := 0; i < 5; i++ {
+		b.Add(largeEvent(t, 300*1024), Provenance{Source: SourceImport})
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatalf("could not flush batches: %v", err)
+	}
+	batches, events := 0, int64(0)
+	for c := b.Head(); c.Defined(); batches++ {
+		data, err := ipfs.GetBlock(core.Ctx, *core, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) > 1024*1024 {
+			t.Errorf("batch %v is %v bytes, larger than an IPFS block", c, len(data))
+		}
+		batch, err := readBatch(core.Ctx, *core, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		en, err := batch.LookupByString("events")
+		if err != nil {
+			t.Fatal(err)
+		}
+		events += en.Length()
+		c = cid.Undef
+		if pn, err := batch.LookupByString("prev"); err == nil {
+			l, _ := pn.AsLink()
+			c = l.(cidlink.Link).Cid
+		}
+	}
+	if events != 5 || batches < 2 {
+		t.Errorf("wrote %v events in %v batches, expected 5 events in several batches", events, batches)
+	}
+}
+
+func TestStopTwice(t *testing.T) {
+	core := ipfstest.StartOfflineNode(t)
+	b := NewBatcher(*core, DefaultBatchSize, time.Hour)
+	b.Start()
+	b.Stop()
+	b.Stop()
+}
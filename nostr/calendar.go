@@ -0,0 +1,306 @@
+package nostr
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/util"
+)
+
+// NIP-52 calendar kinds.
+const (
+	KindDateEvent = 31922
+	KindTimeEvent = 31923
+	KindRSVP      = 31925
+)
+
+const (
+	RSVPAccepted  = "accepted"
+	RSVPDeclined  = "declined"
+	RSVPTentative = "tentative"
+)
+
+const dateFormat = "2006-01-02"
+
+// CalendarEvent is a date or time based calendar event with the number of RSVPs of each status it has received.
+type CalendarEvent struct {
+	Coordinate string         `json:"coordinate"`
+	PubKey     string         `json:"pubkey"`
+	Title      string         `json:"title"`
+	Summary    string         `json:"summary,omitempty"`
+	Location   string         `json:"location,omitempty"`
+	AllDay     bool           `json:"all_day"`
+	Start      time.Time      `json:"start"`
+	End        time.Time      `json:"end,omitempty"`
+	RSVPs      map[string]int `json:"rsvps"`
+	Updated    time.Time      `json:"updated"`
+}
+
+// NewCalendarEvent signs a calendar event with an identifier. All day events are date based and others are time based.
+func NewCalendarEvent(privkey string, id string, e CalendarEvent) (nostr.Event, error) {
+	if id == "" || e.Title == "" {
+		return nostr.Event{}, fmt.Errorf("a calendar event must have an identifier and a title")
+	}
+	if e.Start.IsZero() {
+		return nostr.Event{}, fmt.Errorf("a calendar event must have a start time")
+	}
+	if !e.End.IsZero() && e.End.Before(e.Start) {
+		return nostr.Event{}, fmt.Errorf("a calendar event can't end before it starts")
+	}
+	evt := nostr.Event{
+		CreatedAt: nostr.Timestamp(util.Now().Unix()),
+		Kind:      KindTimeEvent,
+		Tags:      nostr.Tags{nostr.Tag{"d", id}, nostr.Tag{"title", e.Title}},
+		Content:   e.Summary,
+	}
+	if e.AllDay {
+		evt.Kind = KindDateEvent
+		evt.Tags = append(evt.Tags, nostr.Tag{"start", e.Start.UTC().Format(dateFormat)})
+		if !e.End.IsZero() {
+			evt.Tags = append(evt.Tags, nostr.Tag{"end", e.End.UTC().Format(dateFormat)})
+		}
+	} else {
+		evt.Tags = append(evt.Tags, nostr.Tag{"start", strconv.FormatInt(e.Start.Unix(), 10)})
+		if !e.End.IsZero() {
+			evt.Tags = append(evt.Tags, nostr.Tag{"end", strconv.FormatInt(e.End.Unix(), 10)})
+		}
+	}
+	if e.Location != "" {
+		evt.Tags = append(evt.Tags, nostr.Tag{"location", e.Location})
+	}
+	if err := util.CheckPublishLock(); err != nil {
+		return nostr.Event{}, err
+	}
+	if err := evt.Sign(privkey); err != nil {
+		log.Errorf("could not sign calendar event: %v", err)
+		return nostr.Event{}, err
+	}
+	return evt, nil
+}
+
+// NewRSVP signs an RSVP to the calendar event with a coordinate like 31923:<pubkey>:<id>.
+func NewRSVP(privkey string, coordinate string, status string) (nostr.Event, error) {
+	if status != RSVPAccepted && status != RSVPDeclined && status != RSVPTentative {
+		return nostr.Event{}, fmt.Errorf("unknown RSVP status %s", status)
+	}
+	if k, _, _ := strings.Cut(coordinate, ":"); k != strconv.Itoa(KindDateEvent) && k != strconv.Itoa(KindTimeEvent) {
+		return nostr.Event{}, fmt.Errorf("%s is not the coordinate of a calendar event", coordinate)
+	}
+	evt := nostr.Event{
+		CreatedAt: nostr.Timestamp(util.Now().Unix()),
+		Kind:      KindRSVP,
+		Tags:      nostr.Tags{nostr.Tag{"d", coordinate}, nostr.Tag{"a", coordinate}, nostr.Tag{"status", status}},
+	}
+	if err := util.CheckPublishLock(); err != nil {
+		return nostr.Event{}, err
+	}
+	if err := evt.Sign(privkey); err != nil {
+		log.Errorf("could not sign RSVP: %v", err)
+		return nostr.Event{}, err
+	}
+	return evt, nil
+}
+
+func parseCalendarTime(s string, allDay bool) (time.Time, error) {
+	if allDay {
+		return time.Parse(dateFormat, s)
+	}
+	t, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(t, 0).UTC(), nil
+}
+
+// ParseCalendarEvent reads a calendar event from a NIP-52 date or time based event.
+func ParseCalendarEvent(evt *nostr.Event) (CalendarEvent, error) {
+	if evt.Kind != KindDateEvent && evt.Kind != KindTimeEvent {
+		return CalendarEvent{}, fmt.Errorf("event %s is not a calendar event", evt.ID)
+	}
+	id := tagValue(evt, "d")
+	if id == "" {
+		return CalendarEvent{}, fmt.Errorf("calendar event %s does not have an identifier", evt.ID)
+	}
+	e := CalendarEvent{
+		Coordinate: fmt.Sprintf("%v:%s:%s", evt.Kind, evt.PubKey, id),
+		PubKey:     evt.PubKey,
+		Title:      tagValue(evt, "title"),
+		Summary:    evt.Content,
+		Location:   tagValue(evt, "location"),
+		AllDay:     evt.Kind == KindDateEvent,
+		RSVPs:      make(map[string]int),
+		Updated:    evt.CreatedAt.Time(),
+	}
+	if e.Title == "" {
+		e.Title = tagValue(evt, "name")
+	}
+	var err error
+	if e.Start, err = parseCalendarTime(tagValue(evt, "start"), e.AllDay); err != nil {
+		return CalendarEvent{}, fmt.Errorf("calendar event %s has an invalid start: %v", evt.ID, err)
+	}
+	if end := tagValue(evt, "end"); end != "" {
+		if e.End, err = parseCalendarTime(end, e.AllDay); err != nil {
+			return CalendarEvent{}, fmt.Errorf("calendar event %s has an invalid end: %v", evt.ID, err)
+		}
+	}
+	return e, nil
+}
+
+type rsvp struct {
+	status  string
+	created nostr.Timestamp
+}
+
+// calendar aggregates the calendar events and RSVPs received by the relay or fetched from followed feeds.
+type calendar struct {
+	lock   sync.Mutex
+	events map[string]CalendarEvent
+	rsvps  map[string]map[string]rsvp
+}
+
+var aggregatedCalendar = &calendar{events: make(map[string]CalendarEvent), rsvps: make(map[string]map[string]rsvp)}
+
+// Aggregate adds the calendar events, RSVPs and listings received by the relay or fetched from followed feeds to the
+// aggregated calendar and marketplace.
+func Aggregate(evt *nostr.Event) {
+	AddCalendarEvent(evt)
+	AddListing(evt)
+}
+
+// AddCalendarEvent adds a calendar event or RSVP to the aggregated calendar. Other events are ignored.
+func AddCalendarEvent(evt *nostr.Event) {
+	c := aggregatedCalendar
+	switch evt.Kind {
+	case KindDateEvent, KindTimeEvent:
+		e, err := ParseCalendarEvent(evt)
+		if err != nil {
+			log.Debugf("ignoring invalid calendar event: %v", err)
+			return
+		}
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if prev, ok := c.events[e.Coordinate]; !ok || !prev.Updated.After(e.Updated) {
+			c.events[e.Coordinate] = e
+		}
+	case KindRSVP:
+		a, status := tagValue(evt, "a"), tagValue(evt, "status")
+		if status == "" {
+			if l := evt.Tags.GetFirst([]string{"l", ""}); l != nil && len(*l) > 2 && (*l)[2] == "status" {
+				status = l.Value()
+			}
+		}
+		if a == "" || (status != RSVPAccepted && status != RSVPDeclined && status != RSVPTentative) {
+			log.Debugf("ignoring invalid RSVP %s", evt.ID)
+			return
+		}
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if c.rsvps[a] == nil {
+			c.rsvps[a] = make(map[string]rsvp)
+		}
+		if prev, ok := c.rsvps[a][evt.PubKey]; !ok || prev.created <= evt.CreatedAt {
+			c.rsvps[a][evt.PubKey] = rsvp{status, evt.CreatedAt}
+		}
+	}
+}
+
+// CalendarEvents returns the calendar events by users matching a filter which end after a time, in start order, with
+// their RSVP counts.
+func CalendarEvents(after time.Time, match func(string) bool) []CalendarEvent {
+	c := aggregatedCalendar
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	events := []CalendarEvent{}
+	for _, e := range c.events {
+		end := e.End
+		if end.IsZero() {
+			end = e.Start
+		}
+		if end.Before(after) || (match != nil && !match(e.PubKey)) {
+			continue
+		}
+		e.RSVPs = make(map[string]int)
+		for _, r := range c.rsvps[e.Coordinate] {
+			e.RSVPs[r.status]++
+		}
+		events = append(events, e)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Start.Before(events[j].Start) })
+	return events
+}
+
+func escapeICal(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`).Replace(s)
+}
+
+func icalTime(t time.Time, allDay bool) string {
+	if allDay {
+		return ";VALUE=DATE:" + t.UTC().Format("20060102")
+	}
+	return ":" + t.UTC().Format("20060102T150405Z")
+}
+
+// ICal returns calendar events in iCalendar format. RSVP counts are added to the description of each event.
+func ICal(name string, events []CalendarEvent) string {
+	lines := []string{"BEGIN:VCALENDAR", "VERSION:2.0", "PRODID:-//patr//" + escapeICal(name) + "//EN"}
+	for _, e := range events {
+		description := e.Summary
+		if len(e.RSVPs) > 0 {
+			description = strings.TrimSpace(fmt.Sprintf("%s\n\nAccepted: %v, tentative: %v, declined: %v", description,
+				e.RSVPs[RSVPAccepted], e.RSVPs[RSVPTentative], e.RSVPs[RSVPDeclined]))
+		}
+		lines = append(lines, "BEGIN:VEVENT",
+			"UID:"+escapeICal(e.Coordinate),
+			"DTSTAMP"+icalTime(e.Updated, false),
+			"DTSTART"+icalTime(e.Start, e.AllDay))
+		if !e.End.IsZero() {
+			lines = append(lines, "DTEND"+icalTime(e.End, e.AllDay))
+		}
+		lines = append(lines, "SUMMARY:"+escapeICal(e.Title))
+		if description != "" {
+			lines = append(lines, "DESCRIPTION:"+escapeICal(description))
+		}
+		if e.Location != "" {
+			lines = append(lines, "LOCATION:"+escapeICal(e.Location))
+		}
+		lines = append(lines, "END:VEVENT")
+	}
+	lines = append(lines, "END:VCALENDAR")
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// handleCalendar serves the upcoming calendar events of the users the relay follows with their RSVP counts, as JSON or
+// as an iCalendar file at /calendar.ics.
+func (r *Relay) handleCalendar(w http.ResponseWriter, rq *http.Request) {
+	events := CalendarEvents(util.Now(), r.followed)
+	if strings.HasSuffix(rq.URL.Path, ".ics") {
+		w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+		w.Write([]byte(ICal(r.Name(), events)))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// loadCalendar fills the aggregated calendar from the database when the relay starts.
+func (s *Storage) loadCalendar() {
+	if s.db == nil {
+		return
+	}
+	events, err := s.db.QueryEvents(&nostr.Filter{Kinds: []int{KindDateEvent, KindTimeEvent, KindRSVP}})
+	if err != nil {
+		log.Warnf("could not load calendar events from relay storage: %v", err)
+		return
+	}
+	for i := range events {
+		AddCalendarEvent(&events[i])
+	}
+}
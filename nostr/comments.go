@@ -0,0 +1,179 @@
+package nostr
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+	"github.com/ipfs/go-cid"
+	"github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/ipfs"
+)
+
+// MaxComments is the most replies served in the comment thread of a post.
+const MaxComments = 500
+
+// Comment is a reply in the comment thread of a post with the result of verifying its signature.
+type Comment struct {
+	ID        string          `json:"id"`
+	PubKey    string          `json:"pubkey"`
+	Content   string          `json:"content"`
+	CreatedAt nostr.Timestamp `json:"created_at"`
+	Parent    string          `json:"parent"`
+	Verified  bool            `json:"verified"`
+}
+
+// verified returns true if an event ID matches its content and its signature is valid.
+func verified(evt *nostr.Event) bool {
+	ok, err := evt.CheckSignature()
+	return err == nil && ok && evt.GetID() == evt.ID
+}
+
+// replyTo returns the ID of the event a reply replies to, using the NIP-10 reply marker or else the last e tag.
+func replyTo(evt *nostr.Event) string {
+	parent := ""
+	for _, t := range evt.Tags {
+		if len(t) < 2 || t[0] != "e" {
+			continue
+		}
+		if len(t) > 3 && t[3] == "reply" {
+			return t[1]
+		}
+		parent = t[1]
+	}
+	return parent
+}
+
+// postEvent reads the Nostr event of a post in a patr feed.
+func (r *Relay) postEvent(c cid.Cid) (nostr.Event, error) {
+	data, err := ipfs.GetBlock(r.Ipfscore.Ctx, r.Ipfscore, c)
+	if err != nil {
+		return nostr.Event{}, fmt.Errorf("could not read post %v: %v", c, err)
+	}
+	n, err := ipfs.DecodeIPLDNode(c, data)
+	if err != nil {
+		return nostr.Event{}, fmt.Errorf("could not decode post %v: %v", c, err)
+	}
+	en, err := n.LookupByString("event")
+	if err != nil {
+		return nostr.Event{}, fmt.Errorf("node %v is not a post", c)
+	}
+	return ipfs.IPLDNodeToNostrEvent(en)
+}
+
+// replies returns the text notes replying to any of a set of events, from the relay storage or the local timeline.
+func (r *Relay) replies(ids []string) []nostr.Event {
+	events, err := r.storage.QueryEvents(&nostr.Filter{Kinds: []int{nostr.KindTextNote}, Tags: nostr.TagMap{"e": ids}, Limit: MaxComments})
+	if err != nil {
+		log.Warnf("could not query replies: %v", err)
+	}
+	if r.storage.timeline != nil {
+		events = append(events, r.storage.timeline.Events(0, 0, func(evt *nostr.Event) bool {
+			for _, t := range evt.Tags {
+				for _, id := range ids {
+					if len(t) >= 2 && t[0] == "e" && t[1] == id {
+						return true
+					}
+				}
+			}
+			return false
+		})...)
+	}
+	return events
+}
+
+// CommentThread returns the replies to the post with a CID and its replies, oldest first, and whether the post itself
+// is validly signed.
+func (r *Relay) CommentThread(c cid.Cid) (nostr.Event, bool, []Comment, error) {
+	post, err := r.postEvent(c)
+	if err != nil {
+		return nostr.Event{}, false, nil, err
+	}
+	comments := []Comment{}
+	seen := map[string]bool{post.ID: true}
+	for ids := []string{post.ID}; len(ids) > 0 && len(comments) < MaxComments; {
+		next := []string{}
+		for _, evt := range r.replies(ids) {
+			evt := evt
+			if seen[evt.ID] {
+				continue
+			}
+			seen[evt.ID] = true
+			comments = append(comments, Comment{
+				ID:        evt.ID,
+				PubKey:    evt.PubKey,
+				Content:   evt.Content,
+				CreatedAt: evt.CreatedAt,
+				Parent:    replyTo(&evt),
+				Verified:  verified(&evt),
+			})
+			next = append(next, evt.ID)
+		}
+		ids = next
+	}
+	sort.Slice(comments, func(i, j int) bool { return comments[i].CreatedAt < comments[j].CreatedAt })
+	if len(comments) > MaxComments {
+		comments = comments[:MaxComments]
+	}
+	return post, verified(&post), comments, nil
+}
+
+func (r *Relay) handleComments(w http.ResponseWriter, rq *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	c, err := cid.Parse(mux.Vars(rq)["cid"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"message": "invalid post CID"})
+		return
+	}
+	post, ok, comments, err := r.CommentThread(c)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]any{"post": c.String(), "event": post.ID, "pubkey": post.PubKey, "verified": ok, "comments": comments})
+}
+
+// commentsEmbed is the script a blog page includes to show the comment thread of a post, e.g.
+// <script src="https://node/comments/embed.js" data-patr-post="<post CID>"></script>
+const commentsEmbed = `(function () {
+  var script = document.currentScript;
+  var post = script.getAttribute("data-patr-post");
+  var node = new URL(script.src).origin;
+  var container = document.createElement("section");
+  container.className = "patr-comments";
+  script.parentNode.insertBefore(container, script.nextSibling);
+  fetch(node + "/comments/" + encodeURIComponent(post)).then(function (r) { return r.json(); }).then(function (thread) {
+    if (!thread.comments) { container.textContent = thread.message || "Could not load comments."; return; }
+    var byParent = {};
+    thread.comments.forEach(function (c) { (byParent[c.parent] = byParent[c.parent] || []).push(c); });
+    function render(parent, el) {
+      (byParent[parent] || []).forEach(function (c) {
+        var item = document.createElement("article");
+        var meta = document.createElement("small");
+        meta.textContent = c.pubkey.slice(0, 12) + " · " + new Date(c.created_at * 1000).toLocaleString() + " · " + (c.verified ? "✓ verified" : "✗ invalid signature");
+        var text = document.createElement("p");
+        text.textContent = c.content;
+        item.appendChild(meta);
+        item.appendChild(text);
+        var replies = document.createElement("div");
+        replies.style.marginLeft = "1.5em";
+        item.appendChild(replies);
+        el.appendChild(item);
+        render(c.id, replies);
+      });
+    }
+    render(thread.event, container);
+    if (!thread.comments.length) { container.textContent = "No comments yet."; }
+  });
+})();
+`
+
+func (r *Relay) handleCommentsEmbed(w http.ResponseWriter, rq *http.Request) {
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Write([]byte(commentsEmbed))
+}
@@ -0,0 +1,79 @@
+package nostr
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/util"
+)
+
+// MaxKind is the largest Nostr event kind.
+const MaxKind = 65535
+
+// BuildOptions are the options of composing an event with BuildEvent.
+type BuildOptions struct {
+	// PrivKey is the Nostr private key the event is signed with.
+	PrivKey string
+	// CreatedAt is the time of the event, by default now.
+	CreatedAt time.Time
+	// Ipfscore is the IPFS node the event is stored in as an IPLD node encoded with Codec, by default the default codec
+	// of the ipfs package. If it is nil the event is not stored.
+	Ipfscore *ipfs.IPFSCore
+	Codec    string
+}
+
+// BuildEvent composes an event of a kind with content and tags, signs it and verifies its ID and signature. The event
+// is stored in IPFS if the options have an IPFS node, and the link to its IPLD node is returned with it.
+func BuildEvent(kind int, content string, tags nostr.Tags, opts BuildOptions) (nostr.Event, datamodel.Link, error) {
+	if kind < 0 || kind > MaxKind {
+		return nostr.Event{}, nil, fmt.Errorf("invalid event kind %v, must be 0 to %v", kind, MaxKind)
+	}
+	if opts.CreatedAt.IsZero() {
+		opts.CreatedAt = util.Now()
+	}
+	t, err := util.NormalizeTimestamp(opts.CreatedAt)
+	if err != nil {
+		return nostr.Event{}, nil, err
+	}
+	if tags == nil {
+		tags = nostr.Tags{}
+	}
+	for i, tag := range tags {
+		if len(tag) == 0 || tag[0] == "" {
+			return nostr.Event{}, nil, fmt.Errorf("tag %v of the event has no name", i)
+		}
+	}
+	evt := nostr.Event{
+		CreatedAt: nostr.Timestamp(t.Unix()),
+		Kind:      kind,
+		Tags:      tags,
+		Content:   content,
+	}
+	if err = evt.Sign(opts.PrivKey); err != nil {
+		log.Errorf("could not sign event of kind %v: %v", kind, err)
+		return nostr.Event{}, nil, err
+	}
+	if evt.ID != evt.GetID() {
+		return nostr.Event{}, nil, fmt.Errorf("the ID of event %s does not match its content", evt.ID)
+	}
+	if ok, err := evt.CheckSignature(); !ok {
+		return nostr.Event{}, nil, fmt.Errorf("could not verify the signature of event %s: %v", evt.ID, err)
+	}
+	if opts.Ipfscore == nil {
+		return evt, nil, nil
+	}
+	codec := opts.Codec
+	if codec == "" {
+		codec = ipfs.DefaultCodec
+	}
+	l, err := ipfs.PutNostrEventAsIPLDLink(opts.Ipfscore.Ctx, *opts.Ipfscore, evt, codec)
+	if err != nil {
+		log.Errorf("could not store event %s in IPFS: %v", evt.ID, err)
+		return nostr.Event{}, nil, err
+	}
+	return evt, l, nil
+}
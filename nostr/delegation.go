@@ -0,0 +1,138 @@
+package nostr
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip26"
+
+	"github.com/allisterb/patr/util"
+)
+
+// RevokedDelegationTag tags the kind-0 profile metadata of a delegator with the tokens of the delegations they revoked,
+// so the consumers of delegated events learn of revocations from the profile of the delegator.
+const RevokedDelegationTag = "revoked-delegation"
+
+var revocationsLock = sync.RWMutex{}
+
+// revocations are the delegation tokens revoked in the profile metadata of delegators, keyed by delegator pubkey.
+// Revocations are permanent so the tokens of every profile seen are kept, even if a newer profile doesn't list them.
+var revocations = map[string]map[string]bool{}
+
+// RevocationTags returns the tags of profile metadata revoking delegation tokens.
+func RevocationTags(tokens []string) nostr.Tags {
+	tags := nostr.Tags{}
+	for _, t := range tokens {
+		tags = append(tags, nostr.Tag{RevokedDelegationTag, t})
+	}
+	return tags
+}
+
+// LearnRevocations records the delegation tokens revoked in the kind-0 profile metadata of a delegator.
+func LearnRevocations(evt *nostr.Event) {
+	if evt.Kind != nostr.KindSetMetadata {
+		return
+	}
+	tags := evt.Tags.GetAll([]string{RevokedDelegationTag, ""})
+	if len(tags) == 0 {
+		return
+	}
+	if ok, err := evt.CheckSignature(); err != nil || !ok {
+		return
+	}
+	revocationsLock.Lock()
+	defer revocationsLock.Unlock()
+	if revocations[evt.PubKey] == nil {
+		revocations[evt.PubKey] = map[string]bool{}
+	}
+	for _, t := range tags {
+		revocations[evt.PubKey][t.Value()] = true
+	}
+}
+
+// IsRevoked returns true if a delegator revoked a delegation token in their profile metadata.
+func IsRevoked(delegator string, token string) bool {
+	revocationsLock.RLock()
+	defer revocationsLock.RUnlock()
+	return revocations[delegator][token]
+}
+
+type Delegation struct {
+	Delegatee string
+	Kinds     []int
+	Since     time.Time
+	Until     time.Time
+	Tag       nostr.Tag
+}
+
+// Token returns the delegation token signature which identifies this delegation for revocation.
+func (d Delegation) Token() string {
+	if len(d.Tag) != 4 {
+		return ""
+	}
+	return d.Tag[3]
+}
+
+func CreateDelegation(privkey string, delegatee string, kinds []int, validFor time.Duration) (Delegation, error) {
+	if !nostr.IsValidPublicKeyHex(delegatee) {
+		return Delegation{}, fmt.Errorf("%s is not a valid Nostr public key", delegatee)
+	}
+	since := util.Now()
+	until := since.Add(validFor)
+	t, err := nip26.CreateToken(privkey, delegatee, kinds, &since, &until)
+	if err != nil {
+		log.Errorf("could not create NIP-26 delegation token for %s: %v", delegatee, err)
+		return Delegation{}, err
+	}
+	log.Infof("created NIP-26 delegation for %s with conditions %s", delegatee, t.Conditions())
+	return Delegation{
+		Delegatee: delegatee,
+		Kinds:     kinds,
+		Since:     since,
+		Until:     until,
+		Tag:       t.Tag(),
+	}, nil
+}
+
+func SignDelegatedEvent(evt *nostr.Event, d Delegation, delegateePrivKey string) error {
+	t, err := nip26.Import(d.Tag, d.Delegatee)
+	if err != nil {
+		log.Errorf("could not import NIP-26 delegation token for %s: %v", d.Delegatee, err)
+		return err
+	}
+	if err = nip26.DelegatedSign(evt, t, delegateePrivKey); err != nil {
+		log.Errorf("could not sign event using NIP-26 delegation for %s: %v", d.Delegatee, err)
+		return err
+	}
+	return nil
+}
+
+// VerifyDelegation checks the delegation tag of an event, if any, and returns the delegator public key. The delegation
+// must not be in the revoked tokens or revoked in the profile metadata of the delegator. Events without a delegation tag
+// are valid and return an empty delegator.
+func VerifyDelegation(evt *nostr.Event, revoked []string) (string, error) {
+	t := evt.Tags.GetFirst([]string{"delegation"})
+	if t == nil {
+		return "", nil
+	}
+	if len(*t) != 4 {
+		return "", fmt.Errorf("invalid delegation tag in event %s", evt.ID)
+	}
+	for _, r := range revoked {
+		if r == (*t)[3] {
+			return "", fmt.Errorf("the delegation from %s used by event %s has been revoked", (*t)[1], evt.ID)
+		}
+	}
+	if IsRevoked((*t)[1], (*t)[3]) {
+		return "", fmt.Errorf("the delegation from %s used by event %s has been revoked in their profile", (*t)[1], evt.ID)
+	}
+	ok, err := nip26.CheckDelegation(evt)
+	if err != nil {
+		return "", fmt.Errorf("could not verify delegation in event %s: %v", evt.ID, err)
+	} else if !ok {
+		return "", fmt.Errorf("the delegation token in event %s is not valid", evt.ID)
+	}
+	return (*t)[1], nil
+}
@@ -0,0 +1,244 @@
+package nostr
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip04"
+
+	"github.com/allisterb/patr/util"
+)
+
+// Encryption schemes of direct messages. NIP-04 DMs are kind-4 events which reveal the sender, the recipient and the
+// time. NIP-44 DMs are NIP-17 private messages sealed and gift wrapped with NIP-59 so only the recipient can see them.
+const (
+	DMSchemeNIP04 = "nip04"
+	DMSchemeNIP44 = "nip44"
+)
+
+// Kinds of the events of NIP-17 private messages.
+const (
+	KindSeal        = 13
+	KindPrivateDM   = 14
+	KindGiftWrap    = 1059
+	giftWrapMaxSkew = 2 * 24 * time.Hour
+)
+
+// DirectMessage is a decrypted direct message. Sender and Recipient are Nostr public keys.
+type DirectMessage struct {
+	ID        string
+	Sender    string
+	Recipient string
+	Text      string
+	CreatedAt time.Time
+	Scheme    string
+}
+
+// EncryptDM encrypts the text of a direct message from a private key to a public key with a scheme.
+func EncryptDM(scheme string, privkey string, pubkey string, text string) (string, error) {
+	switch scheme {
+	case DMSchemeNIP04:
+		secret, err := nip04.ComputeSharedSecret(pubkey, privkey)
+		if err != nil {
+			return "", err
+		}
+		return nip04.Encrypt(text, secret)
+	case DMSchemeNIP44:
+		key, err := NIP44ConversationKey(privkey, pubkey)
+		if err != nil {
+			return "", err
+		}
+		return NIP44Encrypt(key, text)
+	default:
+		return "", fmt.Errorf("unknown DM encryption scheme %s, must be %s or %s", scheme, DMSchemeNIP04, DMSchemeNIP44)
+	}
+}
+
+// DecryptDM decrypts the content of a direct message between a private key and the public key of the other party. The
+// scheme is detected from the content, since NIP-04 content has an ?iv= suffix.
+func DecryptDM(privkey string, pubkey string, content string) (string, error) {
+	if strings.Contains(content, "?iv=") {
+		secret, err := nip04.ComputeSharedSecret(pubkey, privkey)
+		if err != nil {
+			return "", err
+		}
+		return nip04.Decrypt(content, secret)
+	}
+	key, err := NIP44ConversationKey(privkey, pubkey)
+	if err != nil {
+		return "", err
+	}
+	return NIP44Decrypt(key, content)
+}
+
+// NewDM creates the event of a direct message from a private key to a public key. NIP-04 DMs are signed kind-4 events
+// and NIP-44 DMs are kind-1059 gift wraps for the recipient signed with a random key. WrapPrivateDM also wraps a
+// NIP-44 DM for its sender.
+func NewDM(scheme string, privkey string, pubkey string, text string) (nostr.Event, error) {
+	if scheme == DMSchemeNIP44 {
+		rumor, err := NewPrivateDM(privkey, pubkey, text)
+		if err != nil {
+			return nostr.Event{}, err
+		}
+		return GiftWrap(privkey, pubkey, rumor)
+	}
+	content, err := EncryptDM(scheme, privkey, pubkey, text)
+	if err != nil {
+		return nostr.Event{}, err
+	}
+	evt := nostr.Event{
+		CreatedAt: nostr.Timestamp(util.Now().Unix()),
+		Kind:      nostr.KindEncryptedDirectMessage,
+		Tags:      nostr.Tags{nostr.Tag{"p", pubkey}},
+		Content:   content,
+	}
+	if err = evt.Sign(privkey); err != nil {
+		log.Errorf("could not sign DM: %v", err)
+		return nostr.Event{}, err
+	}
+	return evt, nil
+}
+
+// NewPrivateDM creates the unsigned kind-14 event of a NIP-17 private message from a private key to a public key, which
+// is gift wrapped for the recipient and the sender with WrapPrivateDM.
+func NewPrivateDM(privkey string, pubkey string, text string) (nostr.Event, error) {
+	sender, err := nostr.GetPublicKey(privkey)
+	if err != nil {
+		return nostr.Event{}, err
+	}
+	rumor := nostr.Event{
+		PubKey:    sender,
+		CreatedAt: nostr.Timestamp(util.Now().Unix()),
+		Kind:      KindPrivateDM,
+		Tags:      nostr.Tags{nostr.Tag{"p", pubkey}},
+		Content:   text,
+	}
+	rumor.ID = rumor.GetID()
+	return rumor, nil
+}
+
+// randomPast returns a time up to two days before now, so the times of seals and gift wraps don't reveal when a DM was
+// sent.
+func randomPast() nostr.Timestamp {
+	n, _ := rand.Int(rand.Reader, big.NewInt(int64(giftWrapMaxSkew/time.Second)))
+	return nostr.Timestamp(util.Now().Unix() - n.Int64())
+}
+
+// GiftWrap seals an unsigned event with the private key of its author and wraps the seal for a recipient with a random
+// key, as NIP-59 describes.
+func GiftWrap(privkey string, pubkey string, rumor nostr.Event) (nostr.Event, error) {
+	data, _ := json.Marshal(rumor)
+	content, err := EncryptDM(DMSchemeNIP44, privkey, pubkey, string(data))
+	if err != nil {
+		return nostr.Event{}, err
+	}
+	seal := nostr.Event{CreatedAt: randomPast(), Kind: KindSeal, Tags: nostr.Tags{}, Content: content}
+	if err = seal.Sign(privkey); err != nil {
+		log.Errorf("could not sign seal: %v", err)
+		return nostr.Event{}, err
+	}
+	data, _ = json.Marshal(seal)
+	wrapkey := nostr.GeneratePrivateKey()
+	if content, err = EncryptDM(DMSchemeNIP44, wrapkey, pubkey, string(data)); err != nil {
+		return nostr.Event{}, err
+	}
+	wrap := nostr.Event{CreatedAt: randomPast(), Kind: KindGiftWrap, Tags: nostr.Tags{nostr.Tag{"p", pubkey}}, Content: content}
+	if err = wrap.Sign(wrapkey); err != nil {
+		log.Errorf("could not sign gift wrap: %v", err)
+		return nostr.Event{}, err
+	}
+	return wrap, nil
+}
+
+// WrapPrivateDM gift wraps a NIP-17 private message for its recipient and for its sender, as NIP-17 expects so the
+// sender can read the messages they sent. The wrap for the recipient is first.
+func WrapPrivateDM(privkey string, rumor nostr.Event) ([]nostr.Event, error) {
+	t := rumor.Tags.GetFirst([]string{"p", ""})
+	if t == nil {
+		return nil, fmt.Errorf("private message %s does not have a recipient", rumor.ID)
+	}
+	wraps := []nostr.Event{}
+	for _, pk := range []string{t.Value(), rumor.PubKey} {
+		wrap, err := GiftWrap(privkey, pk, rumor)
+		if err != nil {
+			return nil, err
+		}
+		wraps = append(wraps, wrap)
+	}
+	return wraps, nil
+}
+
+// unwrapGift opens a gift wrap for a private key and returns the sealed event, checking it was sealed by its author.
+func unwrapGift(privkey string, wrap nostr.Event) (nostr.Event, error) {
+	data, err := DecryptDM(privkey, wrap.PubKey, wrap.Content)
+	if err != nil {
+		return nostr.Event{}, fmt.Errorf("could not open gift wrap %s: %v", wrap.ID, err)
+	}
+	seal := nostr.Event{}
+	if err = json.Unmarshal([]byte(data), &seal); err != nil || seal.Kind != KindSeal {
+		return nostr.Event{}, fmt.Errorf("gift wrap %s does not contain a seal", wrap.ID)
+	}
+	if ok, err := seal.CheckSignature(); !ok {
+		return nostr.Event{}, fmt.Errorf("invalid signature of the seal in gift wrap %s: %v", wrap.ID, err)
+	}
+	if data, err = DecryptDM(privkey, seal.PubKey, seal.Content); err != nil {
+		return nostr.Event{}, fmt.Errorf("could not open the seal in gift wrap %s: %v", wrap.ID, err)
+	}
+	rumor := nostr.Event{}
+	if err = json.Unmarshal([]byte(data), &rumor); err != nil {
+		return nostr.Event{}, fmt.Errorf("the seal in gift wrap %s does not contain an event", wrap.ID)
+	}
+	if rumor.PubKey != seal.PubKey {
+		return nostr.Event{}, fmt.Errorf("the event in gift wrap %s was not sealed by its author", wrap.ID)
+	}
+	if rumor.ID != rumor.GetID() {
+		return nostr.Event{}, fmt.Errorf("the event in gift wrap %s has an invalid ID", wrap.ID)
+	}
+	return rumor, nil
+}
+
+// OpenDM decrypts a kind-4 DM or a gift wrapped private message sent to or by a private key.
+func OpenDM(privkey string, evt nostr.Event) (DirectMessage, error) {
+	me, err := nostr.GetPublicKey(privkey)
+	if err != nil {
+		return DirectMessage{}, err
+	}
+	switch evt.Kind {
+	case nostr.KindEncryptedDirectMessage:
+		recipient := ""
+		if t := evt.Tags.GetFirst([]string{"p", ""}); t != nil {
+			recipient = t.Value()
+		}
+		other := evt.PubKey
+		if other == me {
+			other = recipient
+		} else if recipient != me {
+			return DirectMessage{}, fmt.Errorf("DM %s was not sent to or by %s", evt.ID, me)
+		}
+		text, err := DecryptDM(privkey, other, evt.Content)
+		if err != nil {
+			return DirectMessage{}, fmt.Errorf("could not decrypt DM %s: %v", evt.ID, err)
+		}
+		return DirectMessage{ID: evt.ID, Sender: evt.PubKey, Recipient: recipient, Text: text, CreatedAt: evt.CreatedAt.Time(), Scheme: DMSchemeNIP04}, nil
+	case KindGiftWrap:
+		rumor, err := unwrapGift(privkey, evt)
+		if err != nil {
+			return DirectMessage{}, err
+		}
+		if rumor.Kind != KindPrivateDM {
+			return DirectMessage{}, fmt.Errorf("gift wrap %s does not contain a private message", evt.ID)
+		}
+		recipient := ""
+		if t := rumor.Tags.GetFirst([]string{"p", ""}); t != nil {
+			recipient = t.Value()
+		}
+		return DirectMessage{ID: rumor.ID, Sender: rumor.PubKey, Recipient: recipient, Text: rumor.Content, CreatedAt: rumor.CreatedAt.Time(), Scheme: DMSchemeNIP44}, nil
+	default:
+		return DirectMessage{}, fmt.Errorf("event %s of kind %v is not a DM", evt.ID, evt.Kind)
+	}
+}
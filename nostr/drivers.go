@@ -0,0 +1,54 @@
+package nostr
+
+import (
+	"fmt"
+	"strings"
+
+	"path/filepath"
+
+	"github.com/fiatjaf/relayer"
+	"github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/util"
+)
+
+// Relay storage drivers. With the ipfs driver events are only stored in IPFS. The sqlite and postgres drivers also store
+// events in a database which answers queries, and only write the configured kinds in IPFS batches.
+const (
+	DriverIPFS     = "ipfs"
+	DriverSQLite   = "sqlite"
+	DriverPostgres = "postgres"
+)
+
+// openDriver returns the database storage for a driver, or nil for the ipfs driver.
+func openDriver(driver string, url string) (relayer.Storage, error) {
+	switch strings.ToLower(driver) {
+	case "", DriverIPFS:
+		return nil, nil
+	case DriverSQLite:
+		if url == "" {
+			url = filepath.Join(util.AppData, "relay.sqlite")
+		}
+		return &sqlStorage{driver: "sqlite3", url: url}, nil
+	case DriverPostgres:
+		if url == "" {
+			return nil, fmt.Errorf("the postgres storage driver needs a database URL")
+		}
+		return &sqlStorage{driver: "postgres", url: url}, nil
+	default:
+		return nil, fmt.Errorf("unknown relay storage driver: %s", driver)
+	}
+}
+
+// mirrored returns true if an event should be written in IPFS batches.
+func (s *Storage) mirrored(evt *nostr.Event) bool {
+	if s.db == nil {
+		return true
+	}
+	for _, k := range s.mirrorKinds {
+		if k == evt.Kind {
+			return true
+		}
+	}
+	return false
+}
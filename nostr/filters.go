@@ -0,0 +1,273 @@
+package nostr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/util"
+)
+
+// Content filter types.
+const (
+	FilterKeyword = "keyword"
+	FilterRegex   = "regex"
+	FilterExec    = "exec"
+	FilterHTTP    = "http"
+)
+
+// Verdict actions. Rejected events are not accepted by the relay and rejected posts are left out of fetched feeds.
+// Flagged events are accepted and recorded in the moderation log. Any verdict can add to the spam score of an event.
+const (
+	VerdictAllow  = "allow"
+	VerdictFlag   = "flag"
+	VerdictReject = "reject"
+)
+
+// ContentFilterTimeout is the maximum time an external content filter can take to classify an event.
+var ContentFilterTimeout = 5 * time.Second
+
+// ContentFilter is a filter in the content filter pipeline. Keyword filters match any of the patterns as whole words
+// ignoring case and regex filters match any of the patterns as regular expressions. A match gives the filter's action
+// and score. Exec filters run a command with the event JSON on stdin and HTTP filters POST the event JSON to a URL, and
+// both return a verdict as JSON, so custom or ML classifiers can be plugged in. Kinds limits a filter to events of
+// those kinds.
+type ContentFilter struct {
+	Name     string
+	Type     string
+	Patterns []string
+	Command  []string
+	URL      string
+	Action   string
+	Score    float64
+	Kinds    []int
+	patterns []*regexp.Regexp
+}
+
+// Verdict is the result of filtering an event.
+type Verdict struct {
+	Action  string   `json:"action"`
+	Score   float64  `json:"score,omitempty"`
+	Reason  string   `json:"reason,omitempty"`
+	Filters []string `json:"filters,omitempty"`
+}
+
+// ModerationEntry is an event which was flagged or rejected by the content filters.
+type ModerationEntry struct {
+	EventID string    `json:"eventId"`
+	PubKey  string    `json:"pubkey"`
+	Kind    int       `json:"kind"`
+	Verdict Verdict   `json:"verdict"`
+	Time    time.Time `json:"time"`
+}
+
+// moderationLogSize is the number of entries kept in the moderation log.
+const moderationLogSize = 500
+
+// verdictCacheSize is the number of verdicts remembered so events seen again are not classified again.
+const verdictCacheSize = 10000
+
+var contentFilters = []ContentFilter{}
+var verdicts = map[string]Verdict{}
+var moderationLog = []ModerationEntry{}
+var filtersLock = sync.RWMutex{}
+
+// SetContentFilters replaces the content filter pipeline, compiling the patterns of keyword and regex filters.
+func SetContentFilters(filters []ContentFilter) error {
+	compiled := []ContentFilter{}
+	for i, f := range filters {
+		if f.Name == "" {
+			f.Name = fmt.Sprintf("%s-%v", f.Type, i)
+		}
+		switch f.Action {
+		case "":
+			f.Action = VerdictFlag
+		case VerdictAllow, VerdictFlag, VerdictReject:
+		default:
+			return fmt.Errorf("content filter %s has an unknown action %s", f.Name, f.Action)
+		}
+		f.patterns = nil
+		switch f.Type {
+		case FilterKeyword:
+			for _, p := range f.Patterns {
+				f.patterns = append(f.patterns, regexp.MustCompile(`(?i)(?:^|[^\p{L}\p{N}_])`+regexp.QuoteMeta(p)+`(?:$|[^\p{L}\p{N}_])`))
+			}
+		case FilterRegex:
+			for _, p := range f.Patterns {
+				re, err := regexp.Compile(p)
+				if err != nil {
+					return fmt.Errorf("content filter %s has an invalid pattern %s: %v", f.Name, p, err)
+				}
+				f.patterns = append(f.patterns, re)
+			}
+		case FilterExec:
+			if len(f.Command) == 0 {
+				return fmt.Errorf("content filter %s has no command", f.Name)
+			}
+		case FilterHTTP:
+			if !strings.HasPrefix(f.URL, "http://") && !strings.HasPrefix(f.URL, "https://") {
+				return fmt.Errorf("content filter %s has an invalid URL %s", f.Name, f.URL)
+			}
+		default:
+			return fmt.Errorf("content filter %s has an unknown type %s", f.Name, f.Type)
+		}
+		compiled = append(compiled, f)
+	}
+	filtersLock.Lock()
+	defer filtersLock.Unlock()
+	contentFilters, verdicts = compiled, map[string]Verdict{}
+	return nil
+}
+
+// classify runs an external classifier and parses its verdict.
+func (f ContentFilter) classify(ctx context.Context, evt *nostr.Event) (Verdict, error) {
+	ctx, cancel := util.WithTimeout(ctx, ContentFilterTimeout)
+	defer cancel()
+	data, _ := json.Marshal(evt)
+	var out []byte
+	if f.Type == FilterExec {
+		cmd := exec.CommandContext(ctx, f.Command[0], f.Command[1:]...)
+		cmd.Stdin = bytes.NewReader(data)
+		o, err := cmd.Output()
+		if err != nil {
+			return Verdict{}, err
+		}
+		out = o
+	} else {
+		req, err := http.NewRequestWithContext(ctx, "POST", f.URL, bytes.NewReader(data))
+		if err != nil {
+			return Verdict{}, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return Verdict{}, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return Verdict{}, fmt.Errorf("HTTP response status: %s", resp.Status)
+		}
+		buf := bytes.Buffer{}
+		if _, err = buf.ReadFrom(resp.Body); err != nil {
+			return Verdict{}, err
+		}
+		out = buf.Bytes()
+	}
+	v := Verdict{}
+	if err := json.Unmarshal(out, &v); err != nil {
+		return Verdict{}, fmt.Errorf("invalid verdict %s: %v", out, err)
+	}
+	if v.Action != VerdictAllow && v.Action != VerdictFlag && v.Action != VerdictReject {
+		return Verdict{}, fmt.Errorf("unknown verdict action %s", v.Action)
+	}
+	return v, nil
+}
+
+// apply returns the verdict of a filter on an event and whether the filter matched.
+func (f ContentFilter) apply(ctx context.Context, evt *nostr.Event) (Verdict, bool) {
+	if len(f.Kinds) > 0 {
+		matched := false
+		for _, k := range f.Kinds {
+			matched = matched || k == evt.Kind
+		}
+		if !matched {
+			return Verdict{}, false
+		}
+	}
+	switch f.Type {
+	case FilterExec, FilterHTTP:
+		v, err := f.classify(ctx, evt)
+		if err != nil {
+			// Events are allowed if a classifier fails so an outage doesn't block all events.
+			log.Warnf("content filter %s could not classify event %s: %v", f.Name, evt.ID, err)
+			return Verdict{}, false
+		}
+		return v, v.Action != VerdictAllow || v.Score != 0
+	default:
+		for i, p := range f.patterns {
+			if p.MatchString(evt.Content) {
+				return Verdict{Action: f.Action, Score: f.Score, Reason: fmt.Sprintf("matched %q", f.Patterns[i])}, true
+			}
+		}
+		return Verdict{}, false
+	}
+}
+
+// FilterEvent runs an event through the content filter pipeline. The event is rejected if any filter rejects it and
+// flagged if any filter flags it, and the scores of the filters are added. Flagged and rejected events are recorded in
+// the moderation log.
+func FilterEvent(ctx context.Context, evt *nostr.Event) Verdict {
+	filtersLock.RLock()
+	filters := contentFilters
+	v, ok := verdicts[evt.ID]
+	filtersLock.RUnlock()
+	if ok || len(filters) == 0 {
+		return verdictOrAllow(v)
+	}
+	v = Verdict{Action: VerdictAllow}
+	reasons := []string{}
+	for _, f := range filters {
+		fv, matched := f.apply(ctx, evt)
+		if !matched {
+			continue
+		}
+		v.Filters = append(v.Filters, f.Name)
+		v.Score += fv.Score
+		if fv.Reason != "" {
+			reasons = append(reasons, f.Name+": "+fv.Reason)
+		}
+		if fv.Action == VerdictReject || (fv.Action == VerdictFlag && v.Action == VerdictAllow) {
+			v.Action = fv.Action
+		}
+		if v.Action == VerdictReject {
+			break
+		}
+	}
+	v.Reason = strings.Join(reasons, "; ")
+	filtersLock.Lock()
+	defer filtersLock.Unlock()
+	if len(verdicts) >= verdictCacheSize {
+		verdicts = map[string]Verdict{}
+	}
+	verdicts[evt.ID] = v
+	if v.Action != VerdictAllow {
+		log.Infof("content filters %s event %s from %s: %s", v.Action, evt.ID, evt.PubKey, v.Reason)
+		moderationLog = append(moderationLog, ModerationEntry{EventID: evt.ID, PubKey: evt.PubKey, Kind: evt.Kind, Verdict: v, Time: util.Now()})
+		if len(moderationLog) > moderationLogSize {
+			moderationLog = moderationLog[len(moderationLog)-moderationLogSize:]
+		}
+	}
+	return v
+}
+
+func verdictOrAllow(v Verdict) Verdict {
+	if v.Action == "" {
+		v.Action = VerdictAllow
+	}
+	return v
+}
+
+// ModerationLog returns the events flagged or rejected by the content filters, newest first.
+func ModerationLog() []ModerationEntry {
+	filtersLock.RLock()
+	defer filtersLock.RUnlock()
+	entries := make([]ModerationEntry, len(moderationLog))
+	for i, e := range moderationLog {
+		entries[len(moderationLog)-1-i] = e
+	}
+	return entries
+}
+
+func handleModerationLog(w http.ResponseWriter, rq *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ModerationLog())
+}
@@ -0,0 +1,206 @@
+package nostr
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/outbox"
+	"github.com/allisterb/patr/topics"
+	"github.com/allisterb/patr/util"
+)
+
+// MaxSpamScore is the spam score above which events are left out of hashtag timelines and not relayed to hashtag topics.
+var MaxSpamScore = 1.0
+
+var hashtagPattern = regexp.MustCompile(`(?:^|\s)#([\p{L}\p{N}_]+)`)
+var linkPattern = regexp.MustCompile(`https?://`)
+
+// TopicVersions returns the pubsub topic versions events are announced on. The node sets it to the versions in use by
+// its peers.
+var TopicVersions = func() []int { return topics.Versions }
+
+// NormalizeHashtag returns a hashtag in lower case without the leading #.
+func NormalizeHashtag(tag string) string {
+	return topics.NormalizeHashtag(tag)
+}
+
+// HashtagTopics returns the pubsub topics events with a hashtag are announced on in each topic version.
+func HashtagTopics(tag string, versions []int) []string {
+	ts := []string{}
+	for _, v := range versions {
+		if t, err := topics.Hashtag(tag, v); err == nil {
+			ts = append(ts, t)
+		}
+	}
+	return ts
+}
+
+// Hashtags returns the hashtags of an event from its t tags and its content.
+func Hashtags(evt *nostr.Event) []string {
+	tags := []string{}
+	add := func(t string) {
+		t = NormalizeHashtag(t)
+		if t != "" && !util.Contains(tags, t) {
+			tags = append(tags, t)
+		}
+	}
+	for _, t := range evt.Tags {
+		if len(t) >= 2 && t[0] == "t" {
+			add(t[1])
+		}
+	}
+	for _, m := range hashtagPattern.FindAllStringSubmatch(evt.Content, -1) {
+		add(m[1])
+	}
+	return tags
+}
+
+// SpamFilter scores events using simple heuristics: lots of hashtags or links, the same content posted by several
+// authors and authors posting in bursts, adding the scores of the content filters.
+type SpamFilter struct {
+	lock    sync.Mutex
+	content map[[32]byte]map[string]bool
+	posts   map[string][]time.Time
+	reset   time.Time
+}
+
+func NewSpamFilter() *SpamFilter {
+	return &SpamFilter{content: make(map[[32]byte]map[string]bool), posts: make(map[string][]time.Time), reset: time.Now()}
+}
+
+// Score returns the spam score of an event, where 0 is not spam. Each event scored is remembered for an hour.
+func (f *SpamFilter) Score(evt *nostr.Event) float64 {
+	score := 0.0
+	if n := len(Hashtags(evt)); n > 5 {
+		score += 0.2 * float64(n-5)
+	}
+	if n := len(linkPattern.FindAllString(evt.Content, -1)); n > 3 {
+		score += 0.2 * float64(n-3)
+	}
+	score += FilterEvent(context.Background(), evt).Score
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	now := time.Now()
+	if now.Sub(f.reset) > time.Hour {
+		f.content = make(map[[32]byte]map[string]bool)
+		f.posts = make(map[string][]time.Time)
+		f.reset = now
+	}
+	h := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(evt.Content))))
+	if f.content[h] == nil {
+		f.content[h] = make(map[string]bool)
+	}
+	f.content[h][evt.PubKey] = true
+	if n := len(f.content[h]); n > 2 {
+		score += 0.5 * float64(n-2)
+	}
+	recent := []time.Time{}
+	for _, t := range f.posts[evt.PubKey] {
+		if now.Sub(t) < time.Minute {
+			recent = append(recent, t)
+		}
+	}
+	f.posts[evt.PubKey] = append(recent, now)
+	if n := len(recent); n > 10 {
+		score += 0.1 * float64(n-10)
+	}
+	return score
+}
+
+// followedHashtags returns the followed hashtags of an event.
+func (r *Relay) followedHashtags(evt *nostr.Event) []string {
+	tags := []string{}
+	for _, t := range Hashtags(evt) {
+		for _, ft := range r.Hashtags {
+			if NormalizeHashtag(ft) == t {
+				tags = append(tags, t)
+			}
+		}
+	}
+	return tags
+}
+
+// addToHashtagTimelines adds an event from the relay firehose to the timelines of the followed hashtags it has, unless
+// it looks like spam. Local events with hashtags are announced on the hashtag pubsub topics.
+func (r *Relay) addToHashtagTimelines(evt *nostr.Event, prov Provenance) {
+	hashtags := Hashtags(evt)
+	if len(hashtags) == 0 {
+		return
+	}
+	if score := r.spam.Score(evt); score > MaxSpamScore {
+		log.Debugf("not adding event %s to hashtag timelines, spam score is %.2f", evt.ID, score)
+		return
+	}
+	for _, t := range r.followedHashtags(evt) {
+		r.hashtagTimelines[t].Add(*evt)
+	}
+	if prov.Source == SourceLocal && evt.Kind == nostr.KindTextNote {
+		data, _ := json.Marshal(evt)
+		versions := TopicVersions()
+		for _, t := range hashtags {
+			for _, topic := range HashtagTopics(t, versions) {
+				outbox.Enqueue(outbox.KindPubSubAnnounce, topic+":"+evt.ID, map[string]string{"topic": topic, "data": string(data)})
+			}
+		}
+	}
+}
+
+// SubscribeHashtags adds events announced on the pubsub topics of followed hashtags in every topic version to the relay.
+func (r *Relay) SubscribeHashtags(ctx context.Context) {
+	for _, t := range r.Hashtags {
+		for _, topic := range HashtagTopics(t, topics.Versions) {
+			r.subscribeHashtagTopic(ctx, topic)
+		}
+		log.Infof("following hashtag #%s", NormalizeHashtag(t))
+	}
+}
+
+func (r *Relay) subscribeHashtagTopic(ctx context.Context, topic string) {
+	sub, err := r.Ipfscore.Api.PubSub().Subscribe(ctx, topic)
+	if err != nil {
+		log.Errorf("could not subscribe to hashtag topic %s: %v", topic, err)
+		return
+	}
+	go func() {
+		defer sub.Close()
+		for {
+			msg, err := sub.Next(ctx)
+			if err != nil {
+				return
+			}
+			evt := nostr.Event{}
+			if err = json.Unmarshal(msg.Data(), &evt); err != nil {
+				continue
+			}
+			if ok, err := evt.CheckSignature(); err != nil || !ok || evt.GetID() != evt.ID {
+				log.Debugf("ignoring invalid event from hashtag topic %s", topic)
+				continue
+			}
+			// The event may have been received on the topic of another version already.
+			if _, ok := r.Provenance(evt.ID); ok {
+				continue
+			}
+			r.AddEvent(evt, Provenance{Source: SourcePubSub, Origin: topic})
+		}
+	}()
+}
+
+func (r *Relay) handleHashtagTimeline(w http.ResponseWriter, rq *http.Request) {
+	tl, ok := r.hashtagTimelines[NormalizeHashtag(mux.Vars(rq)["tag"])]
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"message": "hashtag is not followed"})
+		return
+	}
+	json.NewEncoder(w).Encode(tl.Events(100, 0, nil))
+}
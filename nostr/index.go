@@ -0,0 +1,497 @@
+package nostr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/util"
+)
+
+// indexEntry is where an event stored in IPFS is, with the fields it can be queried by. Events in a batch are at Pos in
+// the batch's events and events written on their own have Pos -1.
+type indexEntry struct {
+	ID        string
+	PubKey    string
+	Kind      int
+	CreatedAt int64
+	Tags      []string
+	Cid       cid.Cid
+	Pos       int64
+}
+
+// queryIndex indexes the events stored in IPFS by kind, author, single-letter tag and creation time so the relay can
+// answer NIP-01 filters without a database. The entries are kept in a sharded IPLD map keyed by event ID whose root is
+// saved in the data directory, and the lookup tables are built in memory when the index is loaded. Events waiting to
+// be batched are answered from memory.
+type queryIndex struct {
+	ipfscore ipfs.IPFSCore
+	lock     sync.RWMutex
+	entries  map[string]indexEntry
+	pending  map[string]nostr.Event
+	byKind   map[int]map[string]bool
+	byAuthor map[string]map[string]bool
+	byTag    map[string]map[string]bool
+	store    *ipfs.ShardedMap
+	dirty    bool
+}
+
+func queryIndexFile() string {
+	return filepath.Join(util.AppData, "relay-index.json")
+}
+
+func newQueryIndex(ipfscore ipfs.IPFSCore) *queryIndex {
+	return &queryIndex{
+		ipfscore: ipfscore,
+		entries:  make(map[string]indexEntry),
+		pending:  make(map[string]nostr.Event),
+		byKind:   make(map[int]map[string]bool),
+		byAuthor: make(map[string]map[string]bool),
+		byTag:    make(map[string]map[string]bool),
+	}
+}
+
+// indexedTags returns the single-letter tags of an event as letter:value terms.
+func indexedTags(evt *nostr.Event) []string {
+	terms := []string{}
+	for _, t := range evt.Tags {
+		if len(t) >= 2 && len(t[0]) == 1 && !util.Contains(terms, t[0]+":"+t[1]) {
+			terms = append(terms, t[0]+":"+t[1])
+		}
+	}
+	return terms
+}
+
+func addTerm[K comparable](m map[K]map[string]bool, k K, id string) {
+	if m[k] == nil {
+		m[k] = make(map[string]bool)
+	}
+	m[k][id] = true
+}
+
+func removeTerm[K comparable](m map[K]map[string]bool, k K, id string) {
+	delete(m[k], id)
+	if len(m[k]) == 0 {
+		delete(m, k)
+	}
+}
+
+func (x *queryIndex) addTerms(id string, pubkey string, kind int, tags []string) {
+	addTerm(x.byKind, kind, id)
+	addTerm(x.byAuthor, pubkey, id)
+	for _, t := range tags {
+		addTerm(x.byTag, t, id)
+	}
+}
+
+func (x *queryIndex) removeTerms(id string, pubkey string, kind int, tags []string) {
+	removeTerm(x.byKind, kind, id)
+	removeTerm(x.byAuthor, pubkey, id)
+	for _, t := range tags {
+		removeTerm(x.byTag, t, id)
+	}
+}
+
+func entryNode(e indexEntry) (datamodel.Node, error) {
+	return qp.BuildMap(basicnode.Prototype.Any, 6, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "pubkey", qp.String(e.PubKey))
+		qp.MapEntry(ma, "kind", qp.Int(int64(e.Kind)))
+		qp.MapEntry(ma, "created_at", qp.Int(e.CreatedAt))
+		qp.MapEntry(ma, "tags", qp.List(int64(len(e.Tags)), func(la datamodel.ListAssembler) {
+			for _, t := range e.Tags {
+				qp.ListEntry(la, qp.String(t))
+			}
+		}))
+		qp.MapEntry(ma, "cid", qp.Link(cidlink.Link{Cid: e.Cid}))
+		qp.MapEntry(ma, "pos", qp.Int(e.Pos))
+	})
+}
+
+// parseEntry reads an index entry, returning false for the entries of deleted events.
+func parseEntry(id string, n datamodel.Node) (indexEntry, bool, error) {
+	if d, err := n.LookupByString("deleted"); err == nil {
+		if deleted, _ := d.AsBool(); deleted {
+			return indexEntry{}, false, nil
+		}
+	}
+	e := indexEntry{ID: id, Tags: []string{}}
+	field := func(key string) datamodel.Node {
+		v, err := n.LookupByString(key)
+		if err != nil {
+			return basicnode.NewString("")
+		}
+		return v
+	}
+	e.PubKey, _ = field("pubkey").AsString()
+	kind, err := field("kind").AsInt()
+	if err != nil {
+		return e, false, fmt.Errorf("index entry of event %s does not have a kind", id)
+	}
+	e.Kind = int(kind)
+	e.CreatedAt, _ = field("created_at").AsInt()
+	e.Pos, _ = field("pos").AsInt()
+	l, err := field("cid").AsLink()
+	if err != nil {
+		return e, false, fmt.Errorf("index entry of event %s does not link the event", id)
+	}
+	e.Cid = l.(cidlink.Link).Cid
+	for it := field("tags").ListIterator(); it != nil && !it.Done(); {
+		_, tv, err := it.Next()
+		if err != nil {
+			return e, false, err
+		}
+		t, _ := tv.AsString()
+		e.Tags = append(e.Tags, t)
+	}
+	return e, true, nil
+}
+
+// load reads the index saved in the data directory. If there is no saved index, the events in the chain of batches
+// ending at head are indexed.
+func (x *queryIndex) load(ctx context.Context, head cid.Cid) error {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	if util.PathExists(queryIndexFile()) {
+		data, err := util.ReadDataFile(queryIndexFile())
+		if err != nil {
+			return err
+		}
+		saved := struct{ Root string }{}
+		if err = json.Unmarshal(data, &saved); err != nil {
+			log.Errorf("could not read JSON data from relay index file %s: %v", queryIndexFile(), err)
+			return err
+		}
+		root, err := cid.Parse(saved.Root)
+		if err != nil {
+			return fmt.Errorf("invalid relay index root %s: %v", saved.Root, err)
+		}
+		if x.store, err = ipfs.LoadShardedMap(ctx, x.ipfscore, root); err != nil {
+			return err
+		}
+		err = x.store.Iterate(func(id string, n datamodel.Node) error {
+			e, ok, err := parseEntry(id, n)
+			if err != nil || !ok {
+				return err
+			}
+			x.entries[id] = e
+			x.addTerms(id, e.PubKey, e.Kind, e.Tags)
+			return nil
+		})
+		log.Infof("loaded relay index of %v events", len(x.entries))
+		return err
+	}
+	var err error
+	if x.store, err = ipfs.NewShardedMap(ctx, x.ipfscore); err != nil {
+		return err
+	}
+	if !head.Defined() {
+		return nil
+	}
+	log.Infof("indexing the events in the chain of batches ending at %v...", head)
+	for c := head; c.Defined(); {
+		batch, err := readBatch(ctx, x.ipfscore, c)
+		if err != nil {
+			return err
+		}
+		if en, err := batch.LookupByString("events"); err == nil {
+			for i := int64(0); i < en.Length(); i++ {
+				evn, err := en.LookupByIndex(i)
+				if err != nil {
+					return err
+				}
+				evt, err := ipfs.IPLDNodeToNostrEvent(evn)
+				if err != nil {
+					log.Warnf("not indexing event %v in batch %v: %v", i, c, err)
+					continue
+				}
+				// An event written in several batches is indexed at the newest batch it is in.
+				if _, ok := x.entries[evt.ID]; !ok {
+					x.addLocked(&evt, c, i)
+				}
+			}
+		}
+		c = cid.Undef
+		if pn, err := batch.LookupByString("prev"); err == nil {
+			if l, err := pn.AsLink(); err == nil {
+				c = l.(cidlink.Link).Cid
+			}
+		}
+	}
+	log.Infof("indexed %v events", len(x.entries))
+	return x.saveLocked(ctx)
+}
+
+// addPending indexes an event waiting to be written in a batch.
+func (x *queryIndex) addPending(evt *nostr.Event) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	x.pending[evt.ID] = *evt
+	x.addTerms(evt.ID, evt.PubKey, evt.Kind, indexedTags(evt))
+}
+
+// add indexes an event written to IPFS in the node c, at pos in the events of a batch or -1 if c is the event.
+func (x *queryIndex) add(evt *nostr.Event, c cid.Cid, pos int64) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	x.addLocked(evt, c, pos)
+}
+
+func (x *queryIndex) addLocked(evt *nostr.Event, c cid.Cid, pos int64) {
+	e := indexEntry{ID: evt.ID, PubKey: evt.PubKey, Kind: evt.Kind, CreatedAt: int64(evt.CreatedAt), Tags: indexedTags(evt), Cid: c, Pos: pos}
+	delete(x.pending, evt.ID)
+	x.entries[e.ID] = e
+	x.addTerms(e.ID, e.PubKey, e.Kind, e.Tags)
+	n, err := entryNode(e)
+	if err == nil {
+		err = x.store.Set(e.ID, n)
+	}
+	if err != nil {
+		log.Errorf("could not add event %s to relay index: %v", e.ID, err)
+		return
+	}
+	x.dirty = true
+}
+
+// lookup returns the index entry of an event written to IPFS.
+func (x *queryIndex) lookup(id string) (indexEntry, bool) {
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+	e, ok := x.entries[id]
+	return e, ok
+}
+
+// remove removes an event of an author from the index. The event stays in IPFS but is no longer returned by queries.
+func (x *queryIndex) remove(id string, pubkey string) error {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	if evt, ok := x.pending[id]; ok && evt.PubKey == pubkey {
+		delete(x.pending, id)
+		x.removeTerms(id, evt.PubKey, evt.Kind, indexedTags(&evt))
+	}
+	e, ok := x.entries[id]
+	if !ok || e.PubKey != pubkey {
+		return nil
+	}
+	delete(x.entries, id)
+	x.removeTerms(id, e.PubKey, e.Kind, e.Tags)
+	tombstone, _ := qp.BuildMap(basicnode.Prototype.Any, 1, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "deleted", qp.Bool(true))
+	})
+	if err := x.store.Set(id, tombstone); err != nil {
+		return err
+	}
+	x.dirty = true
+	return nil
+}
+
+// save writes the root of the index and saves its CID in the data directory if events were added since the last save.
+func (x *queryIndex) save(ctx context.Context) error {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	if !x.dirty {
+		return nil
+	}
+	return x.saveLocked(ctx)
+}
+
+func (x *queryIndex) saveLocked(ctx context.Context) error {
+	root, err := x.store.Save(ctx)
+	if err != nil {
+		return err
+	}
+	x.dirty = false
+	if util.DryRun {
+		return nil
+	}
+	data, _ := json.Marshal(struct{ Root string }{root.String()})
+	return util.WriteDataFile(queryIndexFile(), data)
+}
+
+// start saves the index periodically until the context is cancelled.
+func (x *queryIndex) start(ctx context.Context, interval time.Duration) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				if err := x.save(ctx); err != nil {
+					log.Errorf("could not save relay index: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// union returns the IDs in any of the lookup table entries of keys.
+func union[K comparable](m map[K]map[string]bool, keys []K) map[string]bool {
+	ids := make(map[string]bool)
+	for _, k := range keys {
+		for id := range m[k] {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+func intersect(a map[string]bool, b map[string]bool) map[string]bool {
+	if a == nil {
+		return b
+	}
+	ids := make(map[string]bool)
+	for id := range a {
+		if b[id] {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+// candidates returns the IDs of the events which can match a filter using the lookup tables. Author and ID prefixes
+// can't be looked up and are matched against the events.
+func (x *queryIndex) candidates(filter *nostr.Filter) map[string]bool {
+	var ids map[string]bool
+	if len(filter.IDs) > 0 {
+		exact := make(map[string]bool)
+		for _, id := range filter.IDs {
+			if len(id) < 64 {
+				exact = nil
+				break
+			}
+			if _, ok := x.entries[id]; ok {
+				exact[id] = true
+			} else if _, ok := x.pending[id]; ok {
+				exact[id] = true
+			}
+		}
+		ids = intersect(ids, exact)
+	}
+	if len(filter.Kinds) > 0 {
+		ids = intersect(ids, union(x.byKind, filter.Kinds))
+	}
+	if len(filter.Authors) > 0 {
+		exact := true
+		for _, a := range filter.Authors {
+			exact = exact && len(a) == 64
+		}
+		if exact {
+			ids = intersect(ids, union(x.byAuthor, filter.Authors))
+		}
+	}
+	for letter, values := range filter.Tags {
+		if len(values) == 0 {
+			continue
+		}
+		terms := []string{}
+		for _, v := range values {
+			terms = append(terms, letter+":"+v)
+		}
+		ids = intersect(ids, union(x.byTag, terms))
+	}
+	if ids == nil {
+		ids = make(map[string]bool)
+		for id := range x.entries {
+			ids[id] = true
+		}
+		for id := range x.pending {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+// query returns the events matching a filter, newest first, up to the filter limit or MaxQueryEvents.
+func (x *queryIndex) query(ctx context.Context, filter *nostr.Filter) ([]nostr.Event, error) {
+	x.lock.RLock()
+	type candidate struct {
+		entry   indexEntry
+		pending *nostr.Event
+	}
+	matches := []candidate{}
+	for id := range x.candidates(filter) {
+		if evt, ok := x.pending[id]; ok {
+			if filter.Matches(&evt) {
+				matches = append(matches, candidate{entry: indexEntry{ID: id, CreatedAt: int64(evt.CreatedAt)}, pending: &evt})
+			}
+			continue
+		}
+		e, ok := x.entries[id]
+		if !ok || (filter.Since != nil && e.CreatedAt < int64(*filter.Since)) || (filter.Until != nil && e.CreatedAt > int64(*filter.Until)) {
+			continue
+		}
+		matches = append(matches, candidate{entry: e})
+	}
+	x.lock.RUnlock()
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].entry.CreatedAt != matches[j].entry.CreatedAt {
+			return matches[i].entry.CreatedAt > matches[j].entry.CreatedAt
+		}
+		return matches[i].entry.ID < matches[j].entry.ID
+	})
+	limit := filter.Limit
+	if limit <= 0 || limit > MaxQueryEvents {
+		limit = MaxQueryEvents
+	}
+	events := []nostr.Event{}
+	batches := map[cid.Cid]datamodel.Node{}
+	for _, m := range matches {
+		if len(events) >= limit {
+			break
+		}
+		if m.pending != nil {
+			events = append(events, *m.pending)
+			continue
+		}
+		evt, err := x.readEvent(ctx, m.entry, batches)
+		if err != nil {
+			log.Warnf("could not read indexed event %s: %v", m.entry.ID, err)
+			continue
+		}
+		if filter.Matches(&evt) {
+			events = append(events, evt)
+		}
+	}
+	return events, nil
+}
+
+// readEvent reads an indexed event from IPFS, caching the batches read.
+func (x *queryIndex) readEvent(ctx context.Context, e indexEntry, batches map[cid.Cid]datamodel.Node) (nostr.Event, error) {
+	if e.Pos < 0 {
+		data, err := ipfs.GetBlock(ctx, x.ipfscore, e.Cid)
+		if err != nil {
+			return nostr.Event{}, err
+		}
+		return ipfs.DecodeNostrEvent(e.Cid, data)
+	}
+	batch, ok := batches[e.Cid]
+	if !ok {
+		var err error
+		if batch, err = readBatch(ctx, x.ipfscore, e.Cid); err != nil {
+			return nostr.Event{}, err
+		}
+		batches[e.Cid] = batch
+	}
+	en, err := batch.LookupByString("events")
+	if err != nil {
+		return nostr.Event{}, fmt.Errorf("event batch %v does not have any events", e.Cid)
+	}
+	evn, err := en.LookupByIndex(e.Pos)
+	if err != nil {
+		return nostr.Event{}, err
+	}
+	return ipfs.IPLDNodeToNostrEvent(evn)
+}
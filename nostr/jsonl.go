@@ -0,0 +1,124 @@
+package nostr
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/ipfs"
+)
+
+// MaxEventLineSize is the longest line ImportEvents will read.
+const MaxEventLineSize = 16 * 1024 * 1024
+
+func readBatch(ctx context.Context, ipfscore ipfs.IPFSCore, c cid.Cid) (datamodel.Node, error) {
+	data, err := ipfs.GetBlock(ctx, ipfscore, c)
+	if err != nil {
+		return nil, fmt.Errorf("could not read event batch %v: %v", c, err)
+	}
+	n, err := ipfs.DecodeIPLDNode(c, data)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode event batch %v: %v", c, err)
+	}
+	return n, nil
+}
+
+// ExportEvents writes the stored events matching a filter to w as newline-delimited JSON in the standard Nostr event
+// format, walking the chain of event batches back from head. Events are written newest batch first, and the filter
+// limit, if any, is applied to the number of events written.
+func ExportEvents(ctx context.Context, ipfscore ipfs.IPFSCore, head cid.Cid, filter nostr.Filter, w io.Writer) (int, error) {
+	enc := json.NewEncoder(w)
+	n := 0
+	for c := head; c.Defined(); {
+		batch, err := readBatch(ctx, ipfscore, c)
+		if err != nil {
+			return n, err
+		}
+		en, err := batch.LookupByString("events")
+		if err != nil {
+			return n, fmt.Errorf("event batch %v does not have any events", c)
+		}
+		for i := en.Length() - 1; i >= 0; i-- {
+			evn, err := en.LookupByIndex(i)
+			if err != nil {
+				return n, err
+			}
+			evt, err := ipfs.IPLDNodeToNostrEvent(evn)
+			if err != nil {
+				log.Warnf("skipping event %v in batch %v: %v", i, c, err)
+				continue
+			}
+			if !filter.Matches(&evt) {
+				continue
+			}
+			if err = enc.Encode(evt); err != nil {
+				return n, err
+			}
+			n++
+			if filter.Limit > 0 && n >= filter.Limit {
+				return n, nil
+			}
+		}
+		c = cid.Undef
+		if pn, err := batch.LookupByString("prev"); err == nil {
+			if l, err := pn.AsLink(); err == nil {
+				if c, err = cid.Parse(l.String()); err != nil {
+					return n, err
+				}
+			}
+		}
+	}
+	log.Infof("exported %v events", n)
+	return n, nil
+}
+
+// ImportEvents reads newline-delimited Nostr events from r and passes each one with a valid ID and signature to add.
+// Invalid events and events of ephemeral kinds are skipped. It returns the number of events imported and skipped.
+func ImportEvents(r io.Reader, add func(nostr.Event) error) (int, int, error) {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), MaxEventLineSize)
+	n, skipped, line := 0, 0, 0
+	for s.Scan() {
+		line++
+		if len(bytes.TrimSpace(s.Bytes())) == 0 {
+			continue
+		}
+		evt := nostr.Event{}
+		if err := json.Unmarshal(s.Bytes(), &evt); err != nil {
+			log.Warnf("skipping invalid JSON on line %v: %v", line, err)
+			skipped++
+			continue
+		}
+		if evt.GetID() != evt.ID {
+			log.Warnf("skipping event %s on line %v: ID does not match its content", evt.ID, line)
+			skipped++
+			continue
+		}
+		if ok, err := evt.CheckSignature(); err != nil || !ok {
+			log.Warnf("skipping event %s on line %v: invalid signature", evt.ID, line)
+			skipped++
+			continue
+		}
+		if IsEphemeral(evt.Kind) {
+			log.Warnf("skipping event %s on line %v: ephemeral events are not stored", evt.ID, line)
+			skipped++
+			continue
+		}
+		if err := add(evt); err != nil {
+			return n, skipped, err
+		}
+		n++
+	}
+	if err := s.Err(); err != nil {
+		return n, skipped, err
+	}
+	log.Infof("imported %v events, skipped %v", n, skipped)
+	return n, skipped, nil
+}
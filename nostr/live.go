@@ -0,0 +1,205 @@
+package nostr
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/util"
+)
+
+// KindLiveActivity is the NIP-53 kind of the replaceable event announcing a live stream.
+const KindLiveActivity = 30311
+
+const (
+	LiveStatusPlanned = "planned"
+	LiveStatusLive    = "live"
+	LiveStatusEnded   = "ended"
+)
+
+// LiveStaleAfter is how long a live activity is shown without being updated before it is considered ended, as
+// recommended by NIP-53.
+const LiveStaleAfter = time.Hour
+
+// LiveActivity is a live stream announced by a user. Streaming is the URL of an HLS playlist or an IPFS-hosted playlist.
+type LiveActivity struct {
+	ID        string    `json:"id"`
+	PubKey    string    `json:"pubkey"`
+	Title     string    `json:"title"`
+	Summary   string    `json:"summary,omitempty"`
+	Image     string    `json:"image,omitempty"`
+	Streaming string    `json:"streaming"`
+	Status    string    `json:"status"`
+	Starts    time.Time `json:"starts,omitempty"`
+	Updated   time.Time `json:"updated"`
+}
+
+// ValidStreamingURL returns true if a URL is an HLS playlist or is hosted on IPFS.
+func ValidStreamingURL(s string) bool {
+	if strings.HasPrefix(s, "ipfs://") || strings.HasPrefix(s, "/ipfs/") {
+		return true
+	}
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	return strings.HasSuffix(strings.ToLower(u.Path), ".m3u8") || strings.Contains(u.Path, "/ipfs/")
+}
+
+// NewLiveActivity signs the event announcing or updating a live activity.
+func NewLiveActivity(privkey string, a LiveActivity) (nostr.Event, error) {
+	if a.ID == "" {
+		return nostr.Event{}, fmt.Errorf("a live activity must have an identifier")
+	}
+	if a.Status != LiveStatusPlanned && a.Status != LiveStatusLive && a.Status != LiveStatusEnded {
+		return nostr.Event{}, fmt.Errorf("unknown live activity status %s", a.Status)
+	}
+	if a.Streaming != "" && !ValidStreamingURL(a.Streaming) {
+		return nostr.Event{}, fmt.Errorf("%s is not an HLS or IPFS playlist URL", a.Streaming)
+	}
+	if a.Status == LiveStatusLive && a.Streaming == "" {
+		return nostr.Event{}, fmt.Errorf("a live activity must have a streaming URL")
+	}
+	tags := nostr.Tags{nostr.Tag{"d", a.ID}, nostr.Tag{"status", a.Status}}
+	for _, t := range [][2]string{{"title", a.Title}, {"summary", a.Summary}, {"image", a.Image}, {"streaming", a.Streaming}} {
+		if t[1] != "" {
+			tags = append(tags, nostr.Tag{t[0], t[1]})
+		}
+	}
+	if !a.Starts.IsZero() {
+		tags = append(tags, nostr.Tag{"starts", strconv.FormatInt(a.Starts.Unix(), 10)})
+	}
+	evt := nostr.Event{
+		CreatedAt: nostr.Timestamp(util.Now().Unix()),
+		Kind:      KindLiveActivity,
+		Tags:      tags,
+	}
+	if err := util.CheckPublishLock(); err != nil {
+		return nostr.Event{}, err
+	}
+	if err := evt.Sign(privkey); err != nil {
+		log.Errorf("could not sign live activity event: %v", err)
+		return nostr.Event{}, err
+	}
+	return evt, nil
+}
+
+func tagValue(evt *nostr.Event, name string) string {
+	if t := evt.Tags.GetFirst([]string{name, ""}); t != nil {
+		return t.Value()
+	}
+	return ""
+}
+
+// ParseLiveActivity reads a live activity from a NIP-53 event.
+func ParseLiveActivity(evt *nostr.Event) (LiveActivity, error) {
+	if evt.Kind != KindLiveActivity {
+		return LiveActivity{}, fmt.Errorf("event %s is not a live activity", evt.ID)
+	}
+	a := LiveActivity{
+		ID:        tagValue(evt, "d"),
+		PubKey:    evt.PubKey,
+		Title:     tagValue(evt, "title"),
+		Summary:   tagValue(evt, "summary"),
+		Image:     tagValue(evt, "image"),
+		Streaming: tagValue(evt, "streaming"),
+		Status:    tagValue(evt, "status"),
+		Updated:   evt.CreatedAt.Time(),
+	}
+	if a.ID == "" {
+		return LiveActivity{}, fmt.Errorf("live activity %s does not have an identifier", evt.ID)
+	}
+	if s, err := strconv.ParseInt(tagValue(evt, "starts"), 10, 64); err == nil {
+		a.Starts = time.Unix(s, 0)
+	}
+	return a, nil
+}
+
+// liveActivities holds the latest state of the live activities seen by the relay.
+type liveActivities struct {
+	lock       sync.Mutex
+	activities map[string]LiveActivity
+}
+
+func newLiveActivities() *liveActivities {
+	return &liveActivities{activities: make(map[string]LiveActivity)}
+}
+
+// update records a live activity event, removing the activity once it has ended.
+func (l *liveActivities) update(evt *nostr.Event) {
+	if l == nil {
+		return
+	}
+	a, err := ParseLiveActivity(evt)
+	if err != nil {
+		log.Debugf("ignoring invalid live activity: %v", err)
+		return
+	}
+	key := a.PubKey + ":" + a.ID
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if prev, ok := l.activities[key]; ok && prev.Updated.After(a.Updated) {
+		return
+	}
+	if a.Status == LiveStatusEnded {
+		delete(l.activities, key)
+		return
+	}
+	l.activities[key] = a
+}
+
+// Live returns the activities which are live now by users matching a filter, most recently updated first. Activities
+// which have not been updated for LiveStaleAfter are removed.
+func (l *liveActivities) Live(match func(string) bool) []LiveActivity {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	live := []LiveActivity{}
+	for k, a := range l.activities {
+		if util.Now().Sub(a.Updated) > LiveStaleAfter {
+			delete(l.activities, k)
+			continue
+		}
+		if a.Status == LiveStatusLive && (match == nil || match(a.PubKey)) {
+			live = append(live, a)
+		}
+	}
+	sort.Slice(live, func(i, j int) bool { return live[i].Updated.After(live[j].Updated) })
+	return live
+}
+
+// LiveNow returns the live activities of the users the relay follows.
+func (r *Relay) LiveNow() []LiveActivity {
+	if r.live == nil {
+		return []LiveActivity{}
+	}
+	return r.live.Live(r.followed)
+}
+
+func (r *Relay) handleLive(w http.ResponseWriter, rq *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.LiveNow())
+}
+
+// loadLiveActivities fills the live activities from the database when the relay starts.
+func (s *Storage) loadLiveActivities() {
+	if s.db == nil || s.relay == nil || s.relay.live == nil {
+		return
+	}
+	since := nostr.Timestamp(util.Now().Add(-LiveStaleAfter).Unix())
+	events, err := s.db.QueryEvents(&nostr.Filter{Kinds: []int{KindLiveActivity}, Since: &since})
+	if err != nil {
+		log.Warnf("could not load live activities from relay storage: %v", err)
+		return
+	}
+	for i := range events {
+		s.relay.live.update(&events[i])
+	}
+}
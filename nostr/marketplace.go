@@ -0,0 +1,309 @@
+package nostr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/util"
+)
+
+// NIP-99 classified listing kinds. Draft listings are not shown in the marketplace.
+const (
+	KindListing      = 30402
+	KindDraftListing = 30403
+)
+
+const (
+	ListingActive = "active"
+	ListingSold   = "sold"
+)
+
+// Price is the price of a listing in a currency, optionally per a period like month for rentals.
+type Price struct {
+	Amount    float64 `json:"amount"`
+	Currency  string  `json:"currency"`
+	Frequency string  `json:"frequency,omitempty"`
+}
+
+// Listing is a classified listing. A listing is closed by publishing it again with the sold status.
+type Listing struct {
+	Coordinate string    `json:"coordinate"`
+	PubKey     string    `json:"pubkey"`
+	Title      string    `json:"title"`
+	Summary    string    `json:"summary,omitempty"`
+	Content    string    `json:"content"`
+	Price      Price     `json:"price"`
+	Images     []string  `json:"images,omitempty"`
+	Location   string    `json:"location,omitempty"`
+	Geohash    string    `json:"geohash,omitempty"`
+	Tags       []string  `json:"tags,omitempty"`
+	Status     string    `json:"status"`
+	Draft      bool      `json:"draft,omitempty"`
+	Published  time.Time `json:"published"`
+	Updated    time.Time `json:"updated"`
+}
+
+// NewListing signs a classified listing with an identifier.
+func NewListing(privkey string, id string, l Listing) (nostr.Event, error) {
+	if id == "" || l.Title == "" {
+		return nostr.Event{}, fmt.Errorf("a listing must have an identifier and a title")
+	}
+	if l.Price.Amount < 0 || (l.Price.Amount > 0 && l.Price.Currency == "") {
+		return nostr.Event{}, fmt.Errorf("a listing price must be positive and have a currency")
+	}
+	if l.Status == "" {
+		l.Status = ListingActive
+	}
+	if l.Status != ListingActive && l.Status != ListingSold {
+		return nostr.Event{}, fmt.Errorf("unknown listing status %s", l.Status)
+	}
+	if l.Published.IsZero() {
+		l.Published = util.Now()
+	}
+	evt := nostr.Event{
+		CreatedAt: nostr.Timestamp(util.Now().Unix()),
+		Kind:      KindListing,
+		Content:   l.Content,
+		Tags: nostr.Tags{
+			nostr.Tag{"d", id},
+			nostr.Tag{"title", l.Title},
+			nostr.Tag{"published_at", strconv.FormatInt(l.Published.Unix(), 10)},
+			nostr.Tag{"status", l.Status},
+		},
+	}
+	if l.Draft {
+		evt.Kind = KindDraftListing
+	}
+	price := nostr.Tag{"price", strconv.FormatFloat(l.Price.Amount, 'f', -1, 64), strings.ToUpper(l.Price.Currency)}
+	if l.Price.Frequency != "" {
+		price = append(price, l.Price.Frequency)
+	}
+	evt.Tags = append(evt.Tags, price)
+	for _, t := range [][2]string{{"summary", l.Summary}, {"location", l.Location}, {"g", l.Geohash}} {
+		if t[1] != "" {
+			evt.Tags = append(evt.Tags, nostr.Tag{t[0], t[1]})
+		}
+	}
+	for _, i := range l.Images {
+		evt.Tags = append(evt.Tags, nostr.Tag{"image", i})
+	}
+	for _, t := range l.Tags {
+		evt.Tags = append(evt.Tags, nostr.Tag{"t", NormalizeHashtag(t)})
+	}
+	if err := util.CheckPublishLock(); err != nil {
+		return nostr.Event{}, err
+	}
+	if err := evt.Sign(privkey); err != nil {
+		log.Errorf("could not sign listing: %v", err)
+		return nostr.Event{}, err
+	}
+	return evt, nil
+}
+
+// ParseListing reads a classified listing from a NIP-99 event.
+func ParseListing(evt *nostr.Event) (Listing, error) {
+	if evt.Kind != KindListing && evt.Kind != KindDraftListing {
+		return Listing{}, fmt.Errorf("event %s is not a listing", evt.ID)
+	}
+	id := tagValue(evt, "d")
+	if id == "" {
+		return Listing{}, fmt.Errorf("listing %s does not have an identifier", evt.ID)
+	}
+	l := Listing{
+		Coordinate: fmt.Sprintf("%v:%s:%s", KindListing, evt.PubKey, id),
+		PubKey:     evt.PubKey,
+		Title:      tagValue(evt, "title"),
+		Summary:    tagValue(evt, "summary"),
+		Content:    evt.Content,
+		Location:   tagValue(evt, "location"),
+		Geohash:    tagValue(evt, "g"),
+		Status:     strings.ToLower(tagValue(evt, "status")),
+		Draft:      evt.Kind == KindDraftListing,
+		Images:     []string{},
+		Tags:       []string{},
+		Published:  evt.CreatedAt.Time(),
+		Updated:    evt.CreatedAt.Time(),
+	}
+	if l.Status == "" {
+		l.Status = ListingActive
+	}
+	if p, err := strconv.ParseInt(tagValue(evt, "published_at"), 10, 64); err == nil {
+		l.Published = time.Unix(p, 0)
+	}
+	if p := evt.Tags.GetFirst([]string{"price", ""}); p != nil {
+		amount, err := strconv.ParseFloat((*p)[1], 64)
+		if err != nil {
+			return Listing{}, fmt.Errorf("listing %s has an invalid price: %v", evt.ID, err)
+		}
+		l.Price.Amount = amount
+		if len(*p) > 2 {
+			l.Price.Currency = strings.ToUpper((*p)[2])
+		}
+		if len(*p) > 3 {
+			l.Price.Frequency = (*p)[3]
+		}
+	}
+	for _, t := range evt.Tags {
+		if len(t) < 2 {
+			continue
+		}
+		switch t[0] {
+		case "image":
+			l.Images = append(l.Images, t[1])
+		case "t":
+			l.Tags = append(l.Tags, NormalizeHashtag(t[1]))
+		}
+	}
+	return l, nil
+}
+
+// ListingFilter selects the listings shown in the marketplace. Empty fields match every listing.
+type ListingFilter struct {
+	Query    string
+	Tag      string
+	Currency string
+	MaxPrice float64
+	Geohash  string
+	Sold     bool
+}
+
+func (f ListingFilter) matches(l Listing) bool {
+	if l.Draft || (l.Status == ListingSold && !f.Sold) {
+		return false
+	}
+	if f.Query != "" && !strings.Contains(strings.ToLower(l.Title+" "+l.Summary+" "+l.Content), strings.ToLower(f.Query)) {
+		return false
+	}
+	if f.Tag != "" && !util.Contains(l.Tags, NormalizeHashtag(f.Tag)) {
+		return false
+	}
+	if f.Currency != "" && !strings.EqualFold(f.Currency, l.Price.Currency) {
+		return false
+	}
+	if f.MaxPrice > 0 && l.Price.Amount > f.MaxPrice {
+		return false
+	}
+	if f.Geohash != "" && !strings.HasPrefix(l.Geohash, f.Geohash) {
+		return false
+	}
+	return true
+}
+
+type marketplace struct {
+	lock     sync.Mutex
+	listings map[string]Listing
+}
+
+var aggregatedMarketplace = &marketplace{listings: make(map[string]Listing)}
+
+// AddListing adds a classified listing to the marketplace, replacing earlier versions of it. Other events are ignored.
+func AddListing(evt *nostr.Event) {
+	if evt.Kind != KindListing && evt.Kind != KindDraftListing {
+		return
+	}
+	l, err := ParseListing(evt)
+	if err != nil {
+		log.Debugf("ignoring invalid listing: %v", err)
+		return
+	}
+	m := aggregatedMarketplace
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if prev, ok := m.listings[l.Coordinate]; ok && prev.Updated.After(l.Updated) {
+		return
+	}
+	m.listings[l.Coordinate] = l
+}
+
+// Listings returns the listings by users matching a filter which match a listing filter, newest first.
+func Listings(f ListingFilter, match func(string) bool) []Listing {
+	m := aggregatedMarketplace
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	listings := []Listing{}
+	for _, l := range m.listings {
+		if (match == nil || match(l.PubKey)) && f.matches(l) {
+			listings = append(listings, l)
+		}
+	}
+	sort.Slice(listings, func(i, j int) bool { return listings[i].Published.After(listings[j].Published) })
+	return listings
+}
+
+// handleMarketplace serves the listings of the users and communities the relay follows, filtered by the q, tag,
+// currency, max_price, geohash and sold query parameters.
+func (r *Relay) handleMarketplace(w http.ResponseWriter, rq *http.Request) {
+	q := rq.URL.Query()
+	f := ListingFilter{Query: q.Get("q"), Tag: q.Get("tag"), Currency: q.Get("currency"), Geohash: q.Get("geohash"), Sold: q.Get("sold") == "true"}
+	if mp := q.Get("max_price"); mp != "" {
+		var err error
+		if f.MaxPrice, err = strconv.ParseFloat(mp, 64); err != nil {
+			http.Error(w, fmt.Sprintf("invalid max_price %s", mp), http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Listings(f, r.followed))
+}
+
+// loadMarketplace fills the marketplace from the database when the relay starts.
+func (s *Storage) loadMarketplace() {
+	if s.db == nil {
+		return
+	}
+	events, err := s.db.QueryEvents(&nostr.Filter{Kinds: []int{KindListing, KindDraftListing}})
+	if err != nil {
+		log.Warnf("could not load listings from relay storage: %v", err)
+		return
+	}
+	for i := range events {
+		AddListing(&events[i])
+	}
+}
+
+// CloseListing marks a listing as sold by publishing it again with the sold status to the relay at url, which must have
+// the listing.
+func CloseListing(ctx context.Context, url string, privkey string, id string) error {
+	pubkey, err := nostr.GetPublicKey(privkey)
+	if err != nil {
+		return err
+	}
+	r, err := nostr.RelayConnect(ctx, url)
+	if err != nil {
+		log.Errorf("could not connect to relay %s: %v", url, err)
+		return err
+	}
+	events, err := r.QuerySync(ctx, nostr.Filter{Kinds: []int{KindListing}, Authors: []string{pubkey}, Tags: nostr.TagMap{"d": []string{id}}})
+	r.Close()
+	if err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		return fmt.Errorf("could not find listing %s on relay %s", id, url)
+	}
+	latest := events[0]
+	for _, e := range events {
+		if e.CreatedAt > latest.CreatedAt {
+			latest = e
+		}
+	}
+	l, err := ParseListing(latest)
+	if err != nil {
+		return err
+	}
+	l.Status = ListingSold
+	evt, err := NewListing(privkey, id, l)
+	if err != nil {
+		return err
+	}
+	return PublishToRelay(ctx, url, evt)
+}
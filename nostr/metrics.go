@@ -0,0 +1,253 @@
+package nostr
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/util"
+)
+
+// Metrics are the relay counters, published with expvar and served by the relay at /metrics.
+var Metrics = expvar.NewMap("relay")
+
+const (
+	MetricAccepted      = "events_accepted"
+	MetricRejected      = "events_rejected"
+	MetricStored        = "events_stored"
+	MetricEphemeral     = "events_ephemeral"
+	MetricSubscriptions = "subscriptions_active"
+	MetricEventRate     = "events_per_second"
+)
+
+// Labelled relay metrics: the messages received from clients and sent to them by verb, and the events accepted by kind.
+var (
+	ClientMessageMetrics = new(expvar.Map).Init()
+	RelayMessageMetrics  = new(expvar.Map).Init()
+	KindMetrics          = new(expvar.Map).Init()
+)
+
+// metricLabels are the Prometheus labels of the labelled relay metrics keyed by their name in Metrics.
+var metricLabels = map[string]string{"client_messages": "verb", "relay_messages": "verb", "kinds": "kind"}
+
+// gaugeMetrics are the relay metrics which go down as well as up.
+var gaugeMetrics = []string{MetricConnections, MetricQueuedBytes, MetricSubscriptions, MetricEventRate}
+
+// eventRateWindow is the number of seconds the event rate is averaged over.
+const eventRateWindow = 60
+
+// eventRate counts accepted events in one second buckets.
+type eventRate struct {
+	lock    sync.Mutex
+	buckets [eventRateWindow]int64
+	seconds [eventRateWindow]int64
+}
+
+var acceptedRate = &eventRate{}
+
+func (r *eventRate) add(now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	s := now.Unix()
+	i := s % eventRateWindow
+	if r.seconds[i] != s {
+		r.seconds[i], r.buckets[i] = s, 0
+	}
+	r.buckets[i]++
+}
+
+// rate returns the average events per second over the last eventRateWindow seconds.
+func (r *eventRate) rate(now time.Time) float64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var n int64
+	for i, s := range r.seconds {
+		if now.Unix()-s < eventRateWindow {
+			n += r.buckets[i]
+		}
+	}
+	return float64(n) / eventRateWindow
+}
+
+func init() {
+	for _, m := range []string{MetricAccepted, MetricRejected, MetricStored, MetricEphemeral, MetricSubscriptions} {
+		Metrics.Add(m, 0)
+	}
+	Metrics.Set(MetricEventRate, expvar.Func(func() any { return acceptedRate.rate(time.Now()) }))
+	Metrics.Set("client_messages", ClientMessageMetrics)
+	Metrics.Set("relay_messages", RelayMessageMetrics)
+	Metrics.Set("kinds", KindMetrics)
+}
+
+// messageVerb returns the verb of a Nostr message like REQ or EVENT and its second element if it is a string, like the
+// subscription ID of a REQ or CLOSE. Only the start of the message is read.
+func messageVerb(msg []byte) (string, string) {
+	dec := json.NewDecoder(bytes.NewReader(msg))
+	if t, err := dec.Token(); err != nil || t != json.Delim('[') {
+		return "", ""
+	}
+	t, err := dec.Token()
+	verb, ok := t.(string)
+	if err != nil || !ok {
+		return "", ""
+	}
+	t, _ = dec.Token()
+	arg, _ := t.(string)
+	return verb, arg
+}
+
+// countVerb counts a message by verb. Unknown verbs are counted together so clients can't create unlimited series.
+func countVerb(m *expvar.Map, verb string) {
+	switch verb {
+	case "EVENT", "REQ", "CLOSE", "AUTH", "COUNT", "EOSE", "OK", "NOTICE", "CLOSED":
+	default:
+		verb = "OTHER"
+	}
+	m.Add(verb, 1)
+}
+
+// clientMessages parses the websocket frames a client sends to count its messages by verb and track its subscriptions.
+type clientMessages struct {
+	partial  []byte
+	subs     map[string]bool
+	disabled bool
+}
+
+// maxClientFrame is the largest client frame parsed. The relay rejects larger messages.
+const maxClientFrame = 1 << 20
+
+// observe parses the frames in data read from the client.
+func (c *clientMessages) observe(data []byte) {
+	if c.disabled {
+		return
+	}
+	c.partial = append(c.partial, data...)
+	for {
+		n := frameLength(c.partial)
+		if n == 0 {
+			break
+		}
+		frame := c.partial[:n]
+		// Only unfragmented text frames are counted.
+		if frame[0]&0x80 != 0 && frame[0]&0x0f == 1 {
+			c.message(maskedPayload(frame))
+		}
+		c.partial = c.partial[n:]
+	}
+	if len(c.partial) > maxClientFrame {
+		c.disabled, c.partial = true, nil
+	}
+	if len(c.partial) == 0 {
+		c.partial = nil
+	}
+}
+
+func (c *clientMessages) message(msg []byte) {
+	verb, id := messageVerb(msg)
+	if verb == "" {
+		return
+	}
+	countVerb(ClientMessageMetrics, verb)
+	switch verb {
+	case "REQ":
+		if c.subs == nil {
+			c.subs = make(map[string]bool)
+		}
+		if id != "" && !c.subs[id] {
+			c.subs[id] = true
+			Metrics.Add(MetricSubscriptions, 1)
+		}
+	case "CLOSE":
+		if c.subs[id] {
+			delete(c.subs, id)
+			Metrics.Add(MetricSubscriptions, -1)
+		}
+	}
+}
+
+// close removes the subscriptions of a client which disconnected.
+func (c *clientMessages) close() {
+	Metrics.Add(MetricSubscriptions, -int64(len(c.subs)))
+	c.subs = nil
+}
+
+// maskedPayload returns the unmasked payload of a complete frame sent by a client.
+func maskedPayload(frame []byte) []byte {
+	if frame[1]&0x80 == 0 {
+		return payload(frame)
+	}
+	header := 2
+	switch frame[1] & 0x7f {
+	case 126:
+		header = 4
+	case 127:
+		header = 10
+	}
+	key := frame[header : header+4]
+	p := append([]byte{}, frame[header+4:]...)
+	for i := range p {
+		p[i] ^= key[i%4]
+	}
+	return p
+}
+
+// countEvent counts an accepted event in the event rate and the events of its kind.
+func countEvent(kind int) {
+	acceptedRate.add(time.Now())
+	KindMetrics.Add(strconv.Itoa(kind), 1)
+}
+
+// writePrometheusMetrics writes the relay metrics in the Prometheus text format, named like the metrics of strfry and
+// other relays so their dashboards can be reused. Labelled metrics are nostr_client_messages_total{verb},
+// nostr_relay_messages_total{verb} and nostr_events_total{kind}.
+func writePrometheusMetrics(w *bytes.Buffer) {
+	names := map[string]string{"client_messages": "nostr_client_messages_total", "relay_messages": "nostr_relay_messages_total", "kinds": "nostr_events_total"}
+	Metrics.Do(func(kv expvar.KeyValue) {
+		if m, ok := kv.Value.(*expvar.Map); ok {
+			name := names[kv.Key]
+			fmt.Fprintf(w, "# TYPE %s counter\n", name)
+			lines := []string{}
+			m.Do(func(l expvar.KeyValue) {
+				lines = append(lines, fmt.Sprintf("%s{%s=%q} %s\n", name, metricLabels[kv.Key], l.Key, l.Value.String()))
+			})
+			sort.Strings(lines)
+			w.WriteString(strings.Join(lines, ""))
+			return
+		}
+		name, typ := "nostr_"+kv.Key, "gauge"
+		if !util.Contains(gaugeMetrics, kv.Key) {
+			name, typ = name+"_total", "counter"
+		}
+		fmt.Fprintf(w, "# TYPE %s %s\n%s %s\n", name, typ, name, kv.Value.String())
+	})
+	ipfs.WritePrometheusRetrievalMetrics(w)
+}
+
+// wantsPrometheus returns true if a metrics request is from a Prometheus scraper, which asks for the text format.
+func wantsPrometheus(rq *http.Request) bool {
+	if f := rq.URL.Query().Get("format"); f != "" {
+		return f == "prometheus"
+	}
+	accept := rq.Header.Get("Accept")
+	return strings.Contains(accept, "text/plain") || strings.Contains(accept, "application/openmetrics-text")
+}
+
+func (r *Relay) handleMetrics(w http.ResponseWriter, rq *http.Request) {
+	if wantsPrometheus(rq) {
+		var buf bytes.Buffer
+		writePrometheusMetrics(&buf)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(buf.Bytes())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(Metrics.String()))
+}
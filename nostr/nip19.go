@@ -0,0 +1,327 @@
+package nostr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcutil/bech32"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// NIP-19 TLV types. TLVCid is the patr IPFS CID of the post of an event, which other clients ignore.
+const (
+	TLVSpecial uint8 = 0
+	TLVRelay   uint8 = 1
+	TLVAuthor  uint8 = 2
+	TLVKind    uint8 = 3
+	TLVCid     uint8 = 112
+)
+
+// EventPointer is a reference to an event shared as a nevent entity.
+type EventPointer struct {
+	ID     string
+	Relays []string
+	Author string
+	Kind   int
+	Cid    string
+}
+
+// AddrPointer is a reference to an addressable event shared as a naddr entity.
+type AddrPointer struct {
+	PubKey     string
+	Kind       int
+	Identifier string
+	Relays     []string
+}
+
+// NostrURI returns the NIP-21 URI of a NIP-19 entity.
+func NostrURI(entity string) string {
+	return "nostr:" + entity
+}
+
+func writeTLV(buf *bytes.Buffer, typ uint8, v []byte) error {
+	if len(v) > 255 {
+		return fmt.Errorf("NIP-19 TLV value of type %v is longer than 255 bytes", typ)
+	}
+	buf.WriteByte(typ)
+	buf.WriteByte(uint8(len(v)))
+	buf.Write(v)
+	return nil
+}
+
+// readTLVs reads NIP-19 TLV entries, failing on truncated entries.
+func readTLVs(data []byte) (map[uint8][][]byte, error) {
+	tlvs := make(map[uint8][][]byte)
+	for len(data) > 0 {
+		if len(data) < 2 || len(data) < 2+int(data[1]) {
+			return nil, fmt.Errorf("truncated NIP-19 TLV entry")
+		}
+		tlvs[data[0]] = append(tlvs[data[0]], data[2:2+int(data[1])])
+		data = data[2+int(data[1]):]
+	}
+	return tlvs, nil
+}
+
+func encodeBech32(prefix string, data []byte) (string, error) {
+	bits5, err := bech32.ConvertBits(data, 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+	return bech32.Encode(prefix, bits5)
+}
+
+func decodeBech32(s string) (string, []byte, error) {
+	prefix, bits5, err := bech32.DecodeNoLimit(strings.TrimPrefix(strings.TrimSpace(s), "nostr:"))
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid NIP-19 entity %s: %v", s, err)
+	}
+	data, err := bech32.ConvertBits(bits5, 5, 8, false)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid NIP-19 entity %s: %v", s, err)
+	}
+	return prefix, data, nil
+}
+
+func hex32(b []byte) (string, error) {
+	if len(b) != 32 {
+		return "", fmt.Errorf("NIP-19 key or ID is %v bytes, not 32", len(b))
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func isHex32(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == 32
+}
+
+func kindBytes(kind int) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(kind))
+	return b
+}
+
+// EncodePubKey returns the npub entity of a public key.
+func EncodePubKey(pubkey string) (string, error) {
+	b, err := hex.DecodeString(pubkey)
+	if err != nil || len(b) != 32 {
+		return "", fmt.Errorf("invalid Nostr public key %s", pubkey)
+	}
+	return encodeBech32("npub", b)
+}
+
+// EncodeProfile returns the nprofile entity of a public key with relay hints.
+func EncodeProfile(pubkey string, relays []string) (string, error) {
+	b, err := hex.DecodeString(pubkey)
+	if err != nil || len(b) != 32 {
+		return "", fmt.Errorf("invalid Nostr public key %s", pubkey)
+	}
+	buf := &bytes.Buffer{}
+	writeTLV(buf, TLVSpecial, b)
+	for _, r := range relays {
+		if err = writeTLV(buf, TLVRelay, []byte(r)); err != nil {
+			return "", err
+		}
+	}
+	return encodeBech32("nprofile", buf.Bytes())
+}
+
+// DecodePubKey returns the public key and relay hints of a hex public key or an npub or nprofile entity.
+func DecodePubKey(s string) (string, []string, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "nostr:")
+	if isHex32(s) {
+		return strings.ToLower(s), nil, nil
+	}
+	prefix, data, err := decodeBech32(s)
+	if err != nil {
+		return "", nil, err
+	}
+	switch prefix {
+	case "npub":
+		pk, err := hex32(data)
+		return pk, nil, err
+	case "nprofile":
+		tlvs, err := readTLVs(data)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(tlvs[TLVSpecial]) == 0 {
+			return "", nil, fmt.Errorf("nprofile %s has no public key", s)
+		}
+		pk, err := hex32(tlvs[TLVSpecial][0])
+		relays := []string{}
+		for _, r := range tlvs[TLVRelay] {
+			relays = append(relays, string(r))
+		}
+		return pk, relays, err
+	default:
+		return "", nil, fmt.Errorf("%s is a %s, not a Nostr public key", s, prefix)
+	}
+}
+
+// IsPubKeyEntity returns true if s is an npub or nprofile entity or URI.
+func IsPubKeyEntity(s string) bool {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "nostr:")
+	return strings.HasPrefix(s, "npub1") || strings.HasPrefix(s, "nprofile1")
+}
+
+// EncodeEvent returns the nevent entity of an event pointer.
+func EncodeEvent(p EventPointer) (string, error) {
+	id, err := hex.DecodeString(p.ID)
+	if err != nil || len(id) != 32 {
+		return "", fmt.Errorf("invalid Nostr event ID %s", p.ID)
+	}
+	buf := &bytes.Buffer{}
+	writeTLV(buf, TLVSpecial, id)
+	for _, r := range p.Relays {
+		if err = writeTLV(buf, TLVRelay, []byte(r)); err != nil {
+			return "", err
+		}
+	}
+	if author, err := hex.DecodeString(p.Author); err == nil && len(author) == 32 {
+		writeTLV(buf, TLVAuthor, author)
+	}
+	if p.Kind > 0 {
+		writeTLV(buf, TLVKind, kindBytes(p.Kind))
+	}
+	if p.Cid != "" {
+		if err = writeTLV(buf, TLVCid, []byte(p.Cid)); err != nil {
+			return "", err
+		}
+	}
+	return encodeBech32("nevent", buf.Bytes())
+}
+
+// EventEntity returns the nevent entity of an event with relay hints and the CID of its patr post, which may be empty.
+func EventEntity(evt nostr.Event, relays []string, cid string) (string, error) {
+	return EncodeEvent(EventPointer{ID: evt.ID, Relays: relays, Author: evt.PubKey, Kind: evt.Kind, Cid: cid})
+}
+
+// DecodeEvent returns the event pointer of a hex event ID or a note or nevent entity.
+func DecodeEvent(s string) (EventPointer, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "nostr:")
+	if isHex32(s) {
+		return EventPointer{ID: strings.ToLower(s)}, nil
+	}
+	prefix, data, err := decodeBech32(s)
+	if err != nil {
+		return EventPointer{}, err
+	}
+	switch prefix {
+	case "note":
+		id, err := hex32(data)
+		return EventPointer{ID: id}, err
+	case "nevent":
+		tlvs, err := readTLVs(data)
+		if err != nil {
+			return EventPointer{}, err
+		}
+		if len(tlvs[TLVSpecial]) == 0 {
+			return EventPointer{}, fmt.Errorf("nevent %s has no event ID", s)
+		}
+		p := EventPointer{}
+		if p.ID, err = hex32(tlvs[TLVSpecial][0]); err != nil {
+			return EventPointer{}, err
+		}
+		for _, r := range tlvs[TLVRelay] {
+			p.Relays = append(p.Relays, string(r))
+		}
+		if a := tlvs[TLVAuthor]; len(a) > 0 {
+			if p.Author, err = hex32(a[0]); err != nil {
+				return EventPointer{}, err
+			}
+		}
+		if k := tlvs[TLVKind]; len(k) > 0 && len(k[0]) == 4 {
+			p.Kind = int(binary.BigEndian.Uint32(k[0]))
+		}
+		if c := tlvs[TLVCid]; len(c) > 0 {
+			p.Cid = string(c[0])
+		}
+		return p, nil
+	default:
+		return EventPointer{}, fmt.Errorf("%s is a %s, not a Nostr event", s, prefix)
+	}
+}
+
+// EncodeAddr returns the naddr entity of an addressable event pointer.
+func EncodeAddr(p AddrPointer) (string, error) {
+	pk, err := hex.DecodeString(p.PubKey)
+	if err != nil || len(pk) != 32 {
+		return "", fmt.Errorf("invalid Nostr public key %s", p.PubKey)
+	}
+	buf := &bytes.Buffer{}
+	if err = writeTLV(buf, TLVSpecial, []byte(p.Identifier)); err != nil {
+		return "", err
+	}
+	for _, r := range p.Relays {
+		if err = writeTLV(buf, TLVRelay, []byte(r)); err != nil {
+			return "", err
+		}
+	}
+	writeTLV(buf, TLVAuthor, pk)
+	writeTLV(buf, TLVKind, kindBytes(p.Kind))
+	return encodeBech32("naddr", buf.Bytes())
+}
+
+// AddrEntity returns the naddr entity of an addressable event with relay hints.
+func AddrEntity(evt nostr.Event, relays []string) (string, error) {
+	d := evt.Tags.GetFirst([]string{"d", ""})
+	if d == nil {
+		return "", fmt.Errorf("event %s has no d tag", evt.ID)
+	}
+	return EncodeAddr(AddrPointer{PubKey: evt.PubKey, Kind: evt.Kind, Identifier: d.Value(), Relays: relays})
+}
+
+// DecodeAddr returns the pointer of a naddr entity.
+func DecodeAddr(s string) (AddrPointer, error) {
+	prefix, data, err := decodeBech32(s)
+	if err != nil {
+		return AddrPointer{}, err
+	}
+	if prefix != "naddr" {
+		return AddrPointer{}, fmt.Errorf("%s is a %s, not a Nostr address", s, prefix)
+	}
+	tlvs, err := readTLVs(data)
+	if err != nil {
+		return AddrPointer{}, err
+	}
+	if len(tlvs[TLVSpecial]) == 0 || len(tlvs[TLVAuthor]) == 0 || len(tlvs[TLVKind]) == 0 || len(tlvs[TLVKind][0]) != 4 {
+		return AddrPointer{}, fmt.Errorf("naddr %s is incomplete", s)
+	}
+	p := AddrPointer{Identifier: string(tlvs[TLVSpecial][0]), Kind: int(binary.BigEndian.Uint32(tlvs[TLVKind][0]))}
+	if p.PubKey, err = hex32(tlvs[TLVAuthor][0]); err != nil {
+		return AddrPointer{}, err
+	}
+	for _, r := range tlvs[TLVRelay] {
+		p.Relays = append(p.Relays, string(r))
+	}
+	return p, nil
+}
+
+// DecodeEntity decodes any NIP-19 entity except nsec, returning its prefix and the public key, event pointer or address
+// pointer it refers to.
+func DecodeEntity(s string) (string, any, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "nostr:")
+	prefix, _, err := decodeBech32(s)
+	if err != nil {
+		return "", nil, err
+	}
+	switch prefix {
+	case "npub", "nprofile":
+		pk, relays, err := DecodePubKey(s)
+		return prefix, struct {
+			PubKey string
+			Relays []string `json:",omitempty"`
+		}{pk, relays}, err
+	case "note", "nevent":
+		p, err := DecodeEvent(s)
+		return prefix, p, err
+	case "naddr":
+		p, err := DecodeAddr(s)
+		return prefix, p, err
+	default:
+		return prefix, nil, fmt.Errorf("unsupported NIP-19 entity type %s", prefix)
+	}
+}
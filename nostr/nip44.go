@@ -0,0 +1,139 @@
+package nostr
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+
+	"github.com/nbd-wtf/go-nostr/nip04"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/hkdf"
+)
+
+// NIP44Version is the version of NIP-44 encryption of encrypted payloads.
+const NIP44Version = 2
+
+// Limits of the plaintext of a NIP-44 payload.
+const (
+	NIP44MinPlaintext = 1
+	NIP44MaxPlaintext = 65535
+)
+
+// NIP44ConversationKey returns the NIP-44 conversation key of a private key and the public key of the other party, which
+// is the same for both parties.
+func NIP44ConversationKey(privkey string, pubkey string) ([]byte, error) {
+	shared, err := nip04.ComputeSharedSecret(pubkey, privkey)
+	if err != nil {
+		return nil, err
+	}
+	return hkdf.Extract(sha256.New, shared, []byte("nip44-v2")), nil
+}
+
+// nip44MessageKeys returns the ChaCha20 key and nonce and the HMAC key of a message from the conversation key and nonce.
+func nip44MessageKeys(key []byte, nonce []byte) ([]byte, []byte, []byte, error) {
+	if len(key) != 32 {
+		return nil, nil, nil, fmt.Errorf("invalid NIP-44 conversation key length %v", len(key))
+	}
+	keys := make([]byte, 76)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, key, nonce), keys); err != nil {
+		return nil, nil, nil, err
+	}
+	return keys[:32], keys[32:44], keys[44:], nil
+}
+
+// nip44PaddedLen returns the length a plaintext is padded to, so the length of messages is only partly revealed.
+func nip44PaddedLen(n int) int {
+	if n <= 32 {
+		return 32
+	}
+	next := 1 << bits.Len(uint(n-1))
+	chunk := 32
+	if next > 256 {
+		chunk = next / 8
+	}
+	return chunk * ((n-1)/chunk + 1)
+}
+
+func nip44MAC(key []byte, nonce []byte, ciphertext []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(nonce)
+	h.Write(ciphertext)
+	return h.Sum(nil)
+}
+
+// NIP44Encrypt encrypts a plaintext with a conversation key as a base64 NIP-44 version 2 payload.
+func NIP44Encrypt(key []byte, plaintext string) (string, error) {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return nip44EncryptWithNonce(key, plaintext, nonce)
+}
+
+func nip44EncryptWithNonce(key []byte, plaintext string, nonce []byte) (string, error) {
+	n := len(plaintext)
+	if n < NIP44MinPlaintext || n > NIP44MaxPlaintext {
+		return "", fmt.Errorf("the plaintext must be %v to %v bytes long", NIP44MinPlaintext, NIP44MaxPlaintext)
+	}
+	ckey, cnonce, hkey, err := nip44MessageKeys(key, nonce)
+	if err != nil {
+		return "", err
+	}
+	padded := make([]byte, 2+nip44PaddedLen(n))
+	binary.BigEndian.PutUint16(padded, uint16(n))
+	copy(padded[2:], plaintext)
+	c, err := chacha20.NewUnauthenticatedCipher(ckey, cnonce)
+	if err != nil {
+		return "", err
+	}
+	c.XORKeyStream(padded, padded)
+	payload := append([]byte{NIP44Version}, nonce...)
+	payload = append(payload, padded...)
+	payload = append(payload, nip44MAC(hkey, nonce, padded)...)
+	return base64.StdEncoding.EncodeToString(payload), nil
+}
+
+// NIP44Decrypt decrypts a base64 NIP-44 version 2 payload with a conversation key, checking its MAC and padding.
+func NIP44Decrypt(key []byte, payload string) (string, error) {
+	if payload == "" || payload[0] == '#' {
+		return "", fmt.Errorf("unknown NIP-44 payload version")
+	}
+	if len(payload) < 132 || len(payload) > 87472 {
+		return "", fmt.Errorf("invalid NIP-44 payload length %v", len(payload))
+	}
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return "", fmt.Errorf("invalid NIP-44 payload: %v", err)
+	}
+	if len(data) < 99 || len(data) > 65603 {
+		return "", fmt.Errorf("invalid NIP-44 payload length %v", len(data))
+	}
+	if data[0] != NIP44Version {
+		return "", fmt.Errorf("unknown NIP-44 payload version %v", data[0])
+	}
+	nonce, ciphertext, mac := data[1:33], data[33:len(data)-32], data[len(data)-32:]
+	ckey, cnonce, hkey, err := nip44MessageKeys(key, nonce)
+	if err != nil {
+		return "", err
+	}
+	if !hmac.Equal(mac, nip44MAC(hkey, nonce, ciphertext)) {
+		return "", fmt.Errorf("invalid NIP-44 payload MAC")
+	}
+	c, err := chacha20.NewUnauthenticatedCipher(ckey, cnonce)
+	if err != nil {
+		return "", err
+	}
+	padded := make([]byte, len(ciphertext))
+	c.XORKeyStream(padded, ciphertext)
+	n := int(binary.BigEndian.Uint16(padded))
+	if n < NIP44MinPlaintext || len(padded) != 2+nip44PaddedLen(n) || !bytes.Equal(padded[2+n:], make([]byte, len(padded)-2-n)) {
+		return "", fmt.Errorf("invalid NIP-44 padding")
+	}
+	return string(padded[2 : 2+n]), nil
+}
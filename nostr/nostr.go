@@ -1,13 +1,21 @@
 package nostr
 
 import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
+	"sync"
 	"time"
 
 	"net/http"
 
 	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/util"
 	"github.com/fiatjaf/relayer"
+	"github.com/gorilla/mux"
+	"github.com/ipfs/go-cid"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/nbd-wtf/go-nostr"
 
@@ -16,6 +24,9 @@ import (
 
 var log = logging.Logger("patr/nostr")
 
+// RelayTimeout bounds publishing events to and querying other relays.
+var RelayTimeout = 30 * time.Second
+
 func GenerateKeyPair() (string, string, error) {
 	sk := nostr.GeneratePrivateKey()
 	pk, err := nostr.GetPublicKey(sk)
@@ -26,17 +37,70 @@ func GenerateKeyPair() (string, string, error) {
 	return sk, pk, err
 }
 
+// GenerateDeterministicKeyPair generates a secp256k1 keypair from a deterministic source of bytes, used for devnet users.
+func GenerateDeterministicKeyPair(r io.Reader) (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", "", err
+	}
+	sk := hex.EncodeToString(b)
+	pk, err := nostr.GetPublicKey(sk)
+	if err != nil {
+		log.Errorf("Error generating secp256k1 keypair: %v", err)
+		return "", "", err
+	}
+	return sk, pk, err
+}
+
 type Logger struct {
 }
 
 type Relay struct {
-	Ipfs ipfs.IPFSCore
+	Ipfscore           ipfs.IPFSCore
+	RevokedDelegations []string
+	BatchSize          int
+	BatchInterval      time.Duration
+	OnBatch            func(cid.Cid)
+	BatchHead          cid.Cid
+	StorageDriver      string
+	DatabaseURL        string
+	MirrorKinds        []int
+	StorageClasses     StorageClasses
+	PublicTimeline     bool
+	TimelineSize       int
+	Hashtags           []string
+	Allowlist          bool
+	AllowedPubKeys     []string
+	FollowedPubKeys    []string
+	SendQueueBytes     int
+	SlowClientPolicy   string
+	Info               RelayInfo
+	policyLock         sync.RWMutex
+	allowedPubKeys     map[string]bool
+	followedPubKeys    map[string]bool
+	live               *liveActivities
+	hashtagTimelines   map[string]*Timeline
+	spam               *SpamFilter
+	storage            *Storage
 }
 
 type Storage struct {
-	ipfs iface.CoreAPI
+	ipfs        iface.CoreAPI
+	db          relayer.Storage
+	mirrorKinds []int
+	classes     StorageClasses
+	batcher     *Batcher
+	index       *queryIndex
+	provenance  *provenanceIndex
+	timeline    *Timeline
+	relay       *Relay
+	local       chan nostr.Event
 }
 
+// LocalQueueSize is how many events of hot kinds can wait to be written to the local IPFS node before saving events
+// waits for the writes.
+const LocalQueueSize = 1024
+
 func (l *Logger) Infof(format string, v ...any) {
 	log.Infof(format, v)
 }
@@ -49,50 +113,394 @@ func (l *Logger) Errorf(format string, v ...any) {
 	log.Errorf(format, v)
 }
 
+func (s *Storage) Init() error {
+	if s.db != nil {
+		if err := s.db.Init(); err != nil {
+			return err
+		}
+		s.loadTimeline()
+		s.loadLiveActivities()
+		s.loadCalendar()
+		s.loadMarketplace()
+	}
+	s.loadRevocations()
+	return nil
+}
+
+// loadRevocations learns the delegation revocations in the stored profile metadata.
+func (s *Storage) loadRevocations() {
+	events, err := s.queryStored(&nostr.Filter{Kinds: []int{nostr.KindSetMetadata}})
+	if err != nil {
+		log.Warnf("could not load delegation revocations from stored profile metadata: %v", err)
+		return
+	}
+	for i := range events {
+		LearnRevocations(&events[i])
+	}
+}
+
+// SaveEvent stores an event according to its storage class. Ephemeral events are not stored. Events are saved in the
+// relay database if there is one, archival events are written in batches and events of hot kinds are written to the
+// local IPFS node in the background when there is no relay database. Events written to IPFS are indexed by event ID
+// and author, and answered from memory until they are written.
 func (s *Storage) SaveEvent(evt *nostr.Event) error {
-	//evt.Kind == nostr.
+	LearnRevocations(evt)
+	class := s.class(evt)
+	if class == StorageEphemeral {
+		return nil
+	}
+	if s.db != nil {
+		if err := s.db.SaveEvent(evt); err != nil {
+			return err
+		}
+	}
+	Metrics.Add(MetricStored, 1)
+	prov := s.provenance.record(evt.ID)
+	if s.batcher != nil && class == StorageArchival {
+		if s.index != nil {
+			s.index.addPending(evt)
+		}
+		s.batcher.Add(*evt, prov)
+	} else if s.db == nil && s.local != nil {
+		if s.index != nil {
+			s.index.addPending(evt)
+		}
+		s.local <- *evt
+	}
+	if s.timeline != nil {
+		s.timeline.Add(*evt)
+	}
+	if s.relay != nil {
+		s.relay.addToHashtagTimelines(evt, prov)
+		if evt.Kind == KindLiveActivity {
+			s.relay.live.update(evt)
+		}
+	}
+	Aggregate(evt)
 	return nil
 }
+
+// saveLocal writes an event of a hot kind in its own block to the local IPFS node, where it is pinned but not pinned
+// with the remote pinning services, and indexes it.
+func (s *Storage) saveLocal(evt *nostr.Event) {
+	n, err := ipfs.NostrEventToIPLDNode(*evt)
+	if err != nil {
+		log.Errorf("could not create IPLD node for event %s: %v", evt.ID, err)
+		return
+	}
+	blk, err := ipfs.PutIPLDNode(s.relay.Ipfscore.Ctx, s.relay.Ipfscore, n)
+	if err != nil {
+		log.Errorf("could not write event %s to IPFS: %v", evt.ID, err)
+		return
+	}
+	if s.index != nil && !Moderation.IsDeleted(evt.ID) {
+		s.index.add(evt, blk.Cid(), -1)
+	}
+}
+
+// startLocal writes the events of hot kinds queued by SaveEvent until the context is cancelled.
+func (s *Storage) startLocal(ctx context.Context) {
+	s.local = make(chan nostr.Event, LocalQueueSize)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case evt := <-s.local:
+				s.saveLocal(&evt)
+			}
+		}
+	}()
+}
+
+// flushLocal writes the events of hot kinds which are still queued.
+func (s *Storage) flushLocal() {
+	for {
+		select {
+		case evt := <-s.local:
+			s.saveLocal(&evt)
+		default:
+			return
+		}
+	}
+}
+
+func (s *Storage) QueryEvents(filter *nostr.Filter) ([]nostr.Event, error) {
+	events, err := s.queryStored(filter)
+	if err != nil || s.relay == nil {
+		return events, err
+	}
+	return s.relay.filterAllowed(events), nil
+}
+
+// queryStored returns all the stored events matching a filter, including those hidden from clients.
+func (s *Storage) queryStored(filter *nostr.Filter) ([]nostr.Event, error) {
+	if s.db != nil {
+		return s.db.QueryEvents(filter)
+	}
+	if s.index != nil {
+		return s.index.query(s.relay.Ipfscore.Ctx, filter)
+	}
+	return []nostr.Event{}, nil
+}
+
+func (s *Storage) DeleteEvent(id string, pubkey string) error {
+	if s.db != nil {
+		if err := s.db.DeleteEvent(id, pubkey); err != nil {
+			return err
+		}
+	}
+	if s.index != nil {
+		return s.index.remove(id, pubkey)
+	}
+	return nil
+}
+
 func (r *Relay) Name() string {
 	return "PatrRelay"
 }
 
 func (r *Relay) Init() error {
 	log.Infof("patr relay initializing...")
+	db, err := openDriver(r.StorageDriver, r.DatabaseURL)
+	if err != nil {
+		log.Errorf("could not open relay storage: %v", err)
+		return err
+	}
+	if db != nil {
+		log.Infof("using %s relay storage, writing kinds %v in IPFS batches", r.StorageDriver, r.MirrorKinds)
+	}
+	r.storage = &Storage{
+		ipfs:        r.Ipfscore.Api,
+		db:          db,
+		mirrorKinds: r.MirrorKinds,
+		classes:     r.StorageClasses,
+		batcher:     NewBatcher(r.Ipfscore, r.BatchSize, r.BatchInterval),
+		provenance:  newProvenanceIndex(),
+	}
+	if r.PublicTimeline {
+		r.storage.timeline = NewTimeline(r.TimelineSize)
+	}
+	r.storage.relay = r
+	r.policyLock.Lock()
+	r.indexPolicy()
+	r.policyLock.Unlock()
+	r.live = newLiveActivities()
+	r.spam = NewSpamFilter()
+	r.hashtagTimelines = make(map[string]*Timeline)
+	for _, t := range r.Hashtags {
+		r.hashtagTimelines[NormalizeHashtag(t)] = NewTimeline(r.TimelineSize)
+	}
+	r.SubscribeHashtags(r.Ipfscore.Ctx)
+	r.storage.batcher.SetHead(r.BatchHead)
+	r.storage.batcher.OnFlush = r.OnBatch
+	index := newQueryIndex(r.Ipfscore)
+	if err = index.load(r.Ipfscore.Ctx, r.BatchHead); err != nil {
+		log.Errorf("could not load relay index, events in IPFS are not indexed: %v", err)
+	} else {
+		r.storage.index = index
+		r.storage.batcher.OnWritten = func(events []nostr.Event, batch cid.Cid) {
+			for i := range events {
+				if Moderation.IsDeleted(events[i].ID) {
+					continue
+				}
+				index.add(&events[i], batch, int64(i))
+			}
+			if err := index.save(r.Ipfscore.Ctx); err != nil {
+				log.Errorf("could not save relay index: %v", err)
+			}
+		}
+		index.start(r.Ipfscore.Ctx, r.storage.batcher.interval)
+	}
+	r.storage.batcher.Start()
+	if db == nil {
+		r.storage.startLocal(r.Ipfscore.Ctx)
+	}
 	return nil
 }
 
+func (r *Relay) OnShutdown(ctx context.Context) {
+	log.Infof("patr relay shutting down...")
+	if r.storage != nil && r.storage.batcher != nil {
+		r.storage.batcher.Stop()
+	}
+	if r.storage != nil && r.storage.local != nil {
+		r.storage.flushLocal()
+	}
+	if r.storage != nil && r.storage.index != nil {
+		if err := r.storage.index.save(ctx); err != nil {
+			log.Errorf("could not save relay index: %v", err)
+		}
+	}
+}
+
+func (r *Relay) Storage() relayer.Storage {
+	return r.storage
+}
+
+// AcceptEvent checks events received from clients and counts them in the relay metrics. Accepted events of ephemeral
+// kinds are broadcast to subscribers but never stored.
+func (r *Relay) AcceptEvent(evt *nostr.Event) bool {
+	if !r.checkEvent(evt, true) {
+		Metrics.Add(MetricRejected, 1)
+		return false
+	}
+	Metrics.Add(MetricAccepted, 1)
+	countEvent(evt.Kind)
+	if r.storage != nil && r.storage.class(evt) == StorageEphemeral {
+		log.Debugf("passing through event %s of ephemeral kind %v", evt.ID, evt.Kind)
+		Metrics.Add(MetricEphemeral, 1)
+	}
+	return true
+}
+
+// CheckEvent returns true if the relay would accept an event, without counting it in the relay metrics or recording an
+// acknowledgment of the relay terms of service, so events can be checked in dry runs.
+func (r *Relay) CheckEvent(evt *nostr.Event) bool {
+	return r.checkEvent(evt, false)
+}
+
+func (r *Relay) checkEvent(evt *nostr.Event, record bool) bool {
+	r.policyLock.RLock()
+	revoked := r.RevokedDelegations
+	r.policyLock.RUnlock()
+	if _, err := VerifyDelegation(evt, revoked); err != nil {
+		log.Warnf("rejecting event %s from %s: %v", evt.ID, evt.PubKey, err)
+		return false
+	}
+	if !r.allowed(evt) {
+		log.Debugf("rejecting event %s from %s which is not in the relay allowlist", evt.ID, evt.PubKey)
+		return false
+	}
+	if Moderation.IsBanned(evt.PubKey) {
+		log.Debugf("rejecting event %s from banned pubkey %s", evt.ID, evt.PubKey)
+		return false
+	}
+	if Moderation.IsDeleted(evt.ID) {
+		log.Debugf("rejecting event %s from %s which was deleted from the relay", evt.ID, evt.PubKey)
+		return false
+	}
+	if !r.termsAccepted(evt, record) {
+		log.Debugf("rejecting event %s from %s which has not acknowledged the relay terms of service", evt.ID, evt.PubKey)
+		return false
+	}
+	if v := FilterEvent(context.Background(), evt); v.Action == VerdictReject {
+		log.Debugf("rejecting event %s from %s: %s", evt.ID, evt.PubKey, v.Reason)
+		return false
+	}
+	return true
+}
+
 func (r *Relay) OnInitialized(s *relayer.Server) {
+	s.Router().Use(r.queueSends)
+	s.Router().Use(r.relayInfoCORS)
+	s.Router().Path("/").HeadersRegexp("Accept", `application/nostr\+json`).Methods("GET").HandlerFunc(r.handleRelayInfo)
 	// special handlers
 	//s.Router().Path("/").HandlerFunc(handleWebpage)
 	s.Router().Path("/dm").HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
 
 	})
+	s.Router().Path("/moderation").Methods("GET").HandlerFunc(handleModerationLog)
+	r.setAdminHandlers(s.Router())
+	s.Router().Path("/events/{id}/provenance").Methods("GET").HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+		id := mux.Vars(rq)["id"]
+		if p, err := DecodeEvent(id); err == nil {
+			id = p.ID
+		}
+		prov, ok := r.Provenance(id)
+		w.Header().Set("Content-Type", "application/json")
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"message": "event not found"})
+			return
+		}
+		resp := struct {
+			ID string `json:"id"`
+			Provenance
+			Batch string `json:"batch,omitempty"`
+		}{ID: id, Provenance: prov}
+		if c, ok := r.storage.batcher.Lookup(id); ok {
+			resp.Batch = c.String()
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+	s.Router().Path("/live").Methods("GET").HandlerFunc(r.handleLive)
+	s.Router().Path("/calendar").Methods("GET").HandlerFunc(r.handleCalendar)
+	s.Router().Path("/calendar.ics").Methods("GET").HandlerFunc(r.handleCalendar)
+	s.Router().Path("/marketplace").Methods("GET").HandlerFunc(r.handleMarketplace)
+	s.Router().Path("/comments/embed.js").Methods("GET").HandlerFunc(r.handleCommentsEmbed)
+	s.Router().Path("/comments/{cid}").Methods("GET").HandlerFunc(r.handleComments)
+	s.Router().Path("/metrics").Methods("GET").HandlerFunc(r.handleMetrics)
+	s.Router().Path("/timeline/tags/{tag}").Methods("GET").HandlerFunc(r.handleHashtagTimeline)
+	if r.PublicTimeline {
+		s.Router().Path("/timeline").Methods("GET").HandlerFunc(r.handleTimeline)
+		s.Router().Path("/").Methods("GET").HandlerFunc(r.handleLandingPage)
+		log.Info("public timeline enabled")
+	}
 	log.Info("patr relay initialized")
 }
 
-func CreateTestEvent(privkey string, text string, ipfscore ipfs.IPFSCore) error {
-	e := nostr.Event{
-		ID:        "0",
-		Content:   text,
-		CreatedAt: nostr.Timestamp(time.Now().UnixMicro()),
-		Kind:      nostr.KindApplicationSpecificData,
+func PublishToRelay(ctx context.Context, url string, evt nostr.Event) error {
+	return util.Retry(ctx, "relay", "publishing event to relay", func(ctx context.Context) error {
+		return publishToRelay(ctx, url, evt)
+	})
+}
+
+func publishToRelay(ctx context.Context, url string, evt nostr.Event) error {
+	r, err := nostr.RelayConnect(ctx, url)
+	if err != nil {
+		log.Errorf("could not connect to relay %s: %v", url, err)
+		return err
 	}
-	err := e.Sign(privkey)
+	defer r.Close()
+	if err = acceptTerms(ctx, r, evt); err != nil {
+		log.Warnf("could not acknowledge the terms of service of relay %s: %v", url, err)
+	}
+	s, err := r.Publish(ctx, evt)
 	if err != nil {
-		log.Errorf("could not sign test event: %v", err)
+		log.Errorf("could not publish event %s to relay %s: %v", evt.ID, url, err)
 		return err
 	}
-	sc, err := e.CheckSignature()
-	if (!sc) || err != nil {
-		return fmt.Errorf("signing test event failed")
+	if s == nostr.PublishStatusFailed {
+		return util.Permanent(fmt.Errorf("relay %s did not accept event %s: %v", url, evt.ID, s))
+	}
+	if s != nostr.PublishStatusSucceeded {
+		return fmt.Errorf("relay %s did not accept event %s: %v", url, evt.ID, s)
 	}
+	log.Infof("published event %s to relay %s", evt.ID, url)
+	return nil
+}
 
-	l, err := ipfs.PutNostrEventAsIPLDLink(ipfscore.Ctx, ipfscore, e)
-	if err != nil {
-		return fmt.Errorf("could not create test event %v with text %s: %v", e.ID, e.Content, err)
-	} else {
-		log.Infof("created event %v with text %s at https://ipfs.io/ipfs/%v", e.ID, e.Content, l.String())
-		return nil
+// FetchLatest returns the newest validly signed event matching a filter on any of the relays at urls, or nil if none of
+// them have one.
+func FetchLatest(ctx context.Context, urls []string, filter nostr.Filter) (*nostr.Event, error) {
+	var latest *nostr.Event
+	failed := 0
+	for _, url := range urls {
+		r, err := nostr.RelayConnect(ctx, url)
+		if err != nil {
+			log.Warnf("could not connect to relay %s: %v", url, err)
+			failed++
+			continue
+		}
+		events, err := r.QuerySync(ctx, filter)
+		r.Close()
+		if err != nil {
+			log.Warnf("could not query relay %s: %v", url, err)
+			failed++
+			continue
+		}
+		for _, e := range events {
+			if verified(e) && (latest == nil || e.CreatedAt > latest.CreatedAt) {
+				latest = e
+			}
+		}
+	}
+	if len(urls) > 0 && failed == len(urls) {
+		return nil, fmt.Errorf("could not query any of the relays %v", urls)
+	}
+	if latest != nil {
+		LearnRevocations(latest)
 	}
+	return latest, nil
 }
@@ -0,0 +1,145 @@
+package nostr
+
+import (
+	"testing"
+	"time"
+
+	ipfspath "github.com/ipfs/boxo/coreiface/path"
+	"github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/internal/ipfstest"
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/outbox"
+)
+
+// startRelay initializes a relay with IPFS storage and storage classes on an offline IPFS node.
+func startRelay(t *testing.T, classes map[string]string) *Relay {
+	t.Helper()
+	core := ipfstest.StartOfflineNode(t)
+	sc, err := ParseStorageClasses(classes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Relay{Ipfscore: *core, StorageClasses: sc, BatchInterval: time.Hour}
+	if err := r.Init(); err != nil {
+		t.Fatalf("could not initialize relay: %v", err)
+	}
+	if err := r.storage.Init(); err != nil {
+		t.Fatalf("could not initialize relay storage: %v", err)
+	}
+	return r
+}
+
+func testEvent(t *testing.T, kind int) nostr.Event {
+	t.Helper()
+	sk, _, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	evt, _, err := BuildEvent(kind, "test", nostr.Tags{}, BuildOptions{PrivKey: sk})
+	if err != nil {
+		t.Fatalf("could not build event: %v", err)
+	}
+	return evt
+}
+
+// queried checks that an event is returned by queries by its ID and author.
+func queried(t *testing.T, r *Relay, evt nostr.Event) {
+	t.Helper()
+	for _, filter := range []nostr.Filter{{IDs: []string{evt.ID}}, {Authors: []string{evt.PubKey}}} {
+		events, err := r.QueryStoredEvents(filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 1 || events[0].ID != evt.ID {
+			t.Errorf("query %v returned %v events", filter, len(events))
+		}
+	}
+}
+
+func TestSaveEventWritesHotEventsLocally(t *testing.T) {
+	r := startRelay(t, map[string]string{"0": "hot"})
+	ctx := r.Ipfscore.Ctx
+	service := ipfs.PinningService
+	ipfs.PinningService = ipfs.PinningServiceConfig{Provider: ipfs.PinningPSA, Endpoint: "http://127.0.0.1:1", Token: "test"}
+	t.Cleanup(func() { ipfs.PinningService = service })
+	evt := testEvent(t, nostr.KindSetMetadata)
+	if err := r.storage.SaveEvent(&evt); err != nil {
+		t.Fatalf("could not save event: %v", err)
+	}
+	queried(t, r, evt)
+	e, ok := r.storage.index.lookup(evt.ID)
+	for i := 0; i < 100 && !ok; i++ {
+		time.Sleep(50 * time.Millisecond)
+		e, ok = r.storage.index.lookup(evt.ID)
+	}
+	if !ok || e.Pos != -1 {
+		t.Fatal("event of a hot kind is not indexed at its own block")
+	}
+	if _, pinned, err := r.Ipfscore.Api.Pin().IsPinned(ctx, ipfspath.IpldPath(e.Cid)); err != nil || !pinned {
+		t.Errorf("block %v of event is not pinned: %v", e.Cid, err)
+	}
+	queried(t, r, evt)
+	pending, err := outbox.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) > 0 {
+		t.Errorf("event of a hot kind queued %v remote pins", len(pending))
+	}
+}
+
+func TestSaveEventBatchesArchivalEvents(t *testing.T) {
+	r := startRelay(t, map[string]string{"1": "archival"})
+	evt := testEvent(t, nostr.KindTextNote)
+	if err := r.storage.SaveEvent(&evt); err != nil {
+		t.Fatalf("could not save event: %v", err)
+	}
+	queried(t, r, evt)
+	if err := r.storage.batcher.Flush(); err != nil {
+		t.Fatalf("could not flush batch: %v", err)
+	}
+	e, ok := r.storage.index.lookup(evt.ID)
+	if !ok || e.Pos != 0 || e.Cid != r.storage.batcher.Head() {
+		t.Fatal("archival event is not indexed in its batch")
+	}
+	queried(t, r, evt)
+}
+
+func TestSaveEventDoesNotStoreEphemeralEvents(t *testing.T) {
+	r := startRelay(t, nil)
+	evt := testEvent(t, MinEphemeralKind)
+	if err := r.storage.SaveEvent(&evt); err != nil {
+		t.Fatalf("could not save ephemeral event: %v", err)
+	}
+	if _, ok := r.storage.index.lookup(evt.ID); ok {
+		t.Error("ephemeral event is indexed")
+	}
+}
+
+func TestSavedProfileRevokesDelegation(t *testing.T) {
+	r := startRelay(t, nil)
+	delegator, delegatorPub, _ := GenerateKeyPair()
+	delegatee, delegateePub, _ := GenerateKeyPair()
+	d, err := CreateDelegation(delegator, delegateePub, []int{nostr.KindTextNote}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	evt := nostr.Event{Kind: nostr.KindTextNote, Content: "test", CreatedAt: nostr.Now(), Tags: nostr.Tags{}}
+	if err := SignDelegatedEvent(&evt, d, delegatee); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := VerifyDelegation(&evt, nil); err != nil || p != delegatorPub {
+		t.Fatalf("could not verify delegated event: %v", err)
+	}
+	profile, _, err := BuildEvent(nostr.KindSetMetadata, "{}", RevocationTags([]string{d.Token()}), BuildOptions{PrivKey: delegator})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.storage.SaveEvent(&profile); err != nil {
+		t.Fatalf("could not save profile: %v", err)
+	}
+	if _, err := VerifyDelegation(&evt, nil); err == nil {
+		t.Error("delegated event was verified after the delegation was revoked in the profile of the delegator")
+	}
+}
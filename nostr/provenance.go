@@ -0,0 +1,85 @@
+package nostr
+
+import (
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/relayer"
+	"github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/util"
+)
+
+// Event sources recorded in provenance metadata.
+const (
+	SourceLocal       = "local"
+	SourceRelayClient = "relay-client"
+	SourcePubSub      = "pubsub"
+	SourceSync        = "sync"
+	SourceImport      = "import"
+)
+
+// Provenance records where and when the relay received an event.
+type Provenance struct {
+	Source   string    `json:"source"`
+	Origin   string    `json:"origin,omitempty"`
+	Received time.Time `json:"received"`
+}
+
+// provenanceIndex holds the provenance of stored events and of events which are about to be stored.
+type provenanceIndex struct {
+	lock     sync.Mutex
+	expected map[string]Provenance
+	stored   map[string]Provenance
+}
+
+func newProvenanceIndex() *provenanceIndex {
+	return &provenanceIndex{expected: make(map[string]Provenance), stored: make(map[string]Provenance)}
+}
+
+func (p *provenanceIndex) expect(id string, prov Provenance) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.expected[id] = prov
+}
+
+// record returns the provenance of an event being stored. Events which were not added through Relay.AddEvent were
+// sent by a relay client over a websocket.
+func (p *provenanceIndex) record(id string) Provenance {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	prov, ok := p.expected[id]
+	if ok {
+		delete(p.expected, id)
+	} else {
+		prov = Provenance{Source: SourceRelayClient}
+	}
+	if prov.Received.IsZero() {
+		prov.Received = util.Now()
+	}
+	p.stored[id] = prov
+	return prov
+}
+
+func (p *provenanceIndex) get(id string) (Provenance, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	prov, ok := p.stored[id]
+	return prov, ok
+}
+
+// AddEvent adds an event to the relay, recording its provenance.
+func (r *Relay) AddEvent(evt nostr.Event, prov Provenance) (bool, string) {
+	if r.storage != nil {
+		r.storage.provenance.expect(evt.ID, prov)
+	}
+	return relayer.AddEvent(r, evt)
+}
+
+// Provenance returns the provenance of an event stored by the relay.
+func (r *Relay) Provenance(id string) (Provenance, bool) {
+	if r.storage == nil {
+		return Provenance{}, false
+	}
+	return r.storage.provenance.get(id)
+}
@@ -0,0 +1,126 @@
+package nostr
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr/nip11"
+
+	"github.com/allisterb/patr/util"
+)
+
+// SupportedNIPs are the NIPs the relay supports, announced in its NIP-11 relay information document.
+var SupportedNIPs = []int{1, 9, 11, 12, 15, 16, 20, 26, 33}
+
+// RelaySoftware is the URL of the relay software in the NIP-11 relay information document.
+const RelaySoftware = "https://github.com/allisterb/patr"
+
+// maxMessageLength is the largest websocket message the relay server reads from clients.
+const maxMessageLength = 512000
+
+// RelayInfo is the information about the relay and its operator in the NIP-11 relay information document. PubKey is the
+// Nostr public key of the operator and Contact another way to reach them, like a mailto: URL. TermsOfService is the URL
+// of the terms of service of the relay at TermsVersion, and if RequireTerms is set the relay only accepts events from
+// pubkeys which acknowledged that version.
+type RelayInfo struct {
+	Name           string
+	Description    string
+	PubKey         string
+	Contact        string
+	PostingPolicy  string   `json:",omitempty"`
+	PaymentsURL    string   `json:",omitempty"`
+	RelayCountries []string `json:",omitempty"`
+	LanguageTags   []string `json:",omitempty"`
+	TermsOfService string   `json:",omitempty"`
+	TermsVersion   string   `json:",omitempty"`
+	RequireTerms   bool     `json:",omitempty"`
+}
+
+// RelayInformationDocument is the NIP-11 relay information document with the terms of service of the relay.
+type RelayInformationDocument struct {
+	nip11.RelayInformationDocument
+	TermsOfService *TermsOfService `json:"terms_of_service,omitempty"`
+}
+
+// TermsOfService are the terms of service of a relay in its relay information document. If Required is set the relay
+// rejects events from pubkeys which haven't acknowledged the version of the terms.
+type TermsOfService struct {
+	URL      string `json:"url"`
+	Version  string `json:"version"`
+	Required bool   `json:"required"`
+}
+
+// SetInfo changes the relay information served in the NIP-11 relay information document.
+func (r *Relay) SetInfo(i RelayInfo) {
+	r.policyLock.Lock()
+	defer r.policyLock.Unlock()
+	r.Info = i
+}
+
+// GetNIP11InformationDocument returns the NIP-11 relay information document with the relay information and the supported
+// NIPs, software, version and limits of the relay.
+func (r *Relay) GetNIP11InformationDocument() nip11.RelayInformationDocument {
+	r.policyLock.RLock()
+	defer r.policyLock.RUnlock()
+	name, desc := r.Info.Name, r.Info.Description
+	if name == "" {
+		name = r.Name()
+	}
+	if desc == "" {
+		desc = "Patr relay storing Nostr events on IPFS"
+	}
+	return nip11.RelayInformationDocument{
+		Name:          name,
+		Description:   desc,
+		PubKey:        r.Info.PubKey,
+		Contact:       r.Info.Contact,
+		SupportedNIPs: SupportedNIPs,
+		Software:      RelaySoftware,
+		Version:       util.Version,
+		Limitation: &nip11.RelayLimitationDocument{
+			MaxMessageLength: maxMessageLength,
+			MaxLimit:         MaxQueryEvents,
+		},
+		RelayCountries: r.Info.RelayCountries,
+		LanguageTags:   r.Info.LanguageTags,
+		PostingPolicy:  r.Info.PostingPolicy,
+		PaymentsURL:    r.Info.PaymentsURL,
+	}
+}
+
+// RelayInformationDocument returns the NIP-11 relay information document with the terms of service of the relay.
+func (r *Relay) RelayInformationDocument() RelayInformationDocument {
+	doc := RelayInformationDocument{RelayInformationDocument: r.GetNIP11InformationDocument()}
+	if t, ok := r.terms(); ok {
+		doc.TermsOfService = &t
+	}
+	return doc
+}
+
+// isRelayInfoRequest returns true if a request asks for the NIP-11 relay information document.
+func isRelayInfoRequest(rq *http.Request) bool {
+	return rq.URL.Path == "/" && rq.Header.Get("Upgrade") == "" && strings.Contains(rq.Header.Get("Accept"), "application/nostr+json")
+}
+
+// relayInfoCORS allows web clients on any origin to read the relay information document, as NIP-11 requires. It serves
+// the document itself, since the document the relayer server serves doesn't have the terms of service.
+func (r *Relay) relayInfoCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+		if isRelayInfoRequest(rq) {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("Access-Control-Allow-Headers", "*")
+			w.Header().Set("Access-Control-Allow-Methods", "GET")
+			r.handleRelayInfo(w, rq)
+			return
+		}
+		next.ServeHTTP(w, rq)
+	})
+}
+
+// handleRelayInfo serves the NIP-11 relay information document to clients which accept other media types as well as
+// application/nostr+json.
+func (r *Relay) handleRelayInfo(w http.ResponseWriter, rq *http.Request) {
+	w.Header().Set("Content-Type", "application/nostr+json")
+	json.NewEncoder(w).Encode(r.RelayInformationDocument())
+}
@@ -0,0 +1,280 @@
+package nostr
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Policies for a websocket client whose send queue is full.
+const (
+	// SlowClientDrop drops the events the client has subscribed to until its queue has room, and disconnects it if
+	// other messages don't fit.
+	SlowClientDrop = "drop"
+	// SlowClientDisconnect disconnects the client.
+	SlowClientDisconnect = "disconnect"
+)
+
+// DefaultSendQueueBytes is the default limit of the messages queued for a websocket client.
+const DefaultSendQueueBytes = 1 << 20
+
+// SendTimeout is the time a websocket client has to receive each queued frame before it is disconnected.
+var SendTimeout = 10 * time.Second
+
+const (
+	MetricConnections      = "ws_connections"
+	MetricQueuedBytes      = "ws_queued_bytes"
+	MetricDropped          = "ws_events_dropped"
+	MetricSlowDisconnected = "ws_slow_clients_disconnected"
+)
+
+func init() {
+	for _, m := range []string{MetricConnections, MetricQueuedBytes, MetricDropped, MetricSlowDisconnected} {
+		Metrics.Add(m, 0)
+	}
+}
+
+var eventMessagePrefix = []byte(`["EVENT"`)
+
+// sendQueue is a websocket connection whose writes are queued and sent by its own goroutine, so the relay fanning out
+// an event to its subscribers never waits for a slow client. The websocket frames written to it are parsed so whole
+// event messages can be dropped when the queue is full.
+type sendQueue struct {
+	net.Conn
+	limit     int
+	policy    string
+	lock      sync.Mutex
+	ready     *sync.Cond
+	handshake bool
+	partial   []byte
+	frames    [][]byte
+	queued    int
+	dropping  bool
+	closed    bool
+	err       error
+	received  clientMessages
+}
+
+func newSendQueue(c net.Conn, limit int, policy string) *sendQueue {
+	q := &sendQueue{Conn: c, limit: limit, policy: policy}
+	q.ready = sync.NewCond(&q.lock)
+	Metrics.Add(MetricConnections, 1)
+	go q.send()
+	return q
+}
+
+// frameLength returns the length of the websocket frame at the start of b, or 0 if b doesn't have the whole frame.
+func frameLength(b []byte) int {
+	if len(b) < 2 {
+		return 0
+	}
+	n, header := uint64(b[1]&0x7f), 2
+	switch n {
+	case 126:
+		if len(b) < 4 {
+			return 0
+		}
+		n, header = uint64(binary.BigEndian.Uint16(b[2:4])), 4
+	case 127:
+		if len(b) < 10 {
+			return 0
+		}
+		n, header = binary.BigEndian.Uint64(b[2:10]), 10
+	}
+	if b[1]&0x80 != 0 {
+		header += 4
+	}
+	if len(b) < header || uint64(len(b)-header) < n {
+		return 0
+	}
+	return header + int(n)
+}
+
+// payload returns the payload of a complete unmasked frame.
+func payload(frame []byte) []byte {
+	switch frame[1] & 0x7f {
+	case 126:
+		return frame[4:]
+	case 127:
+		return frame[10:]
+	default:
+		return frame[2:]
+	}
+}
+
+// Write queues the complete websocket frames in b. The first write is the handshake response, which is sent directly.
+func (q *sendQueue) Write(b []byte) (int, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.err != nil {
+		return 0, q.err
+	}
+	if !q.handshake {
+		q.handshake = true
+		return q.Conn.Write(b)
+	}
+	q.partial = append(q.partial, b...)
+	for {
+		n := frameLength(q.partial)
+		if n == 0 {
+			break
+		}
+		frame := append([]byte{}, q.partial[:n]...)
+		q.partial = q.partial[n:]
+		if err := q.queue(frame); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// queue adds a frame to the queue, or drops it or disconnects the client if the queue is full.
+func (q *sendQueue) queue(frame []byte) error {
+	fin, opcode := frame[0]&0x80 != 0, frame[0]&0x0f
+	control := opcode >= 8
+	if !control && opcode != 0 {
+		q.dropping = false
+	}
+	if q.dropping && !control {
+		q.dropping = !fin
+		return nil
+	}
+	if !control && opcode != 0 {
+		if verb, _ := messageVerb(payload(frame)); verb != "" {
+			countVerb(RelayMessageMetrics, verb)
+		}
+	}
+	if control || q.queued+len(frame) <= q.limit {
+		q.frames = append(q.frames, frame)
+		q.queued += len(frame)
+		Metrics.Add(MetricQueuedBytes, int64(len(frame)))
+		q.ready.Signal()
+		return nil
+	}
+	if q.policy != SlowClientDisconnect && opcode != 0 && bytes.HasPrefix(payload(frame), eventMessagePrefix) {
+		Metrics.Add(MetricDropped, 1)
+		q.dropping = !fin
+		return nil
+	}
+	Metrics.Add(MetricSlowDisconnected, 1)
+	log.Warnf("disconnecting websocket client %v with %v bytes of messages queued", q.RemoteAddr(), q.queued)
+	q.fail(fmt.Errorf("send queue of websocket client %v is full", q.RemoteAddr()))
+	return q.err
+}
+
+// fail stops sending and closes the connection. The lock must be held.
+func (q *sendQueue) fail(err error) {
+	if q.err == nil {
+		q.err = err
+	}
+	Metrics.Add(MetricQueuedBytes, -int64(q.queued))
+	q.frames, q.queued, q.closed = nil, 0, true
+	q.Conn.Close()
+	q.ready.Signal()
+}
+
+func (q *sendQueue) send() {
+	defer Metrics.Add(MetricConnections, -1)
+	for {
+		q.lock.Lock()
+		for len(q.frames) == 0 && !q.closed {
+			q.ready.Wait()
+		}
+		if len(q.frames) == 0 {
+			if q.err == nil {
+				q.err = net.ErrClosed
+				q.Conn.Close()
+			}
+			q.lock.Unlock()
+			return
+		}
+		frame, closing := q.frames[0], q.closed
+		q.frames = q.frames[1:]
+		q.queued -= len(frame)
+		Metrics.Add(MetricQueuedBytes, -int64(len(frame)))
+		q.lock.Unlock()
+		if !closing {
+			q.Conn.SetWriteDeadline(time.Now().Add(SendTimeout))
+		}
+		if _, err := q.Conn.Write(frame); err != nil {
+			q.lock.Lock()
+			q.fail(err)
+			q.lock.Unlock()
+		}
+	}
+}
+
+// Read reads from the connection and parses the frames the client sends for the relay metrics. The relay only reads
+// from one goroutine.
+func (q *sendQueue) Read(b []byte) (int, error) {
+	n, err := q.Conn.Read(b)
+	if n > 0 {
+		q.received.observe(b[:n])
+	}
+	if err != nil {
+		q.received.close()
+	}
+	return n, err
+}
+
+// SetWriteDeadline is ignored since writes are queued. Each queued frame is sent with the SendTimeout deadline.
+func (q *sendQueue) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// Close sends the frames already queued, like a close frame, within SendTimeout and then closes the connection.
+func (q *sendQueue) Close() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	q.Conn.SetWriteDeadline(time.Now().Add(SendTimeout))
+	q.ready.Signal()
+	return nil
+}
+
+type queuedResponseWriter struct {
+	http.ResponseWriter
+	limit  int
+	policy string
+}
+
+func (w queuedResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response does not implement http.Hijacker")
+	}
+	c, brw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return newSendQueue(c, w.limit, w.policy), brw, nil
+}
+
+// queueSends is the router middleware which gives each websocket client of the relay its own send queue. Clients get the
+// queue limit and slow client policy in effect when they connect.
+func (r *Relay) queueSends(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+		if strings.EqualFold(rq.Header.Get("Upgrade"), "websocket") {
+			r.policyLock.RLock()
+			limit, policy := r.SendQueueBytes, r.SlowClientPolicy
+			r.policyLock.RUnlock()
+			if limit <= 0 {
+				limit = DefaultSendQueueBytes
+			}
+			if policy == "" {
+				policy = SlowClientDrop
+			}
+			w = queuedResponseWriter{w, limit, policy}
+		}
+		next.ServeHTTP(w, rq)
+	})
+}
@@ -0,0 +1,220 @@
+package nostr
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// MaxQueryEvents is the most events a database query returns.
+const MaxQueryEvents = 500
+
+// sqlStorage stores relay events in a SQLite or Postgres database. Both databases accept the same SQL here so a single
+// implementation is used with a different database/sql driver.
+type sqlStorage struct {
+	driver string
+	url    string
+	db     *sql.DB
+}
+
+func (s *sqlStorage) Init() error {
+	db, err := sql.Open(s.driver, s.url)
+	if err != nil {
+		return err
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return fmt.Errorf("could not connect to %s database: %v", s.driver, err)
+	}
+	if s.driver == "sqlite3" {
+		// SQLite only allows one writer at a time
+		db.SetMaxOpenConns(1)
+	}
+	_, err = db.Exec(`
+CREATE TABLE IF NOT EXISTS event (
+  id text PRIMARY KEY,
+  pubkey text NOT NULL,
+  created_at integer NOT NULL,
+  kind integer NOT NULL,
+  tags text NOT NULL,
+  content text NOT NULL,
+  sig text NOT NULL
+);
+CREATE INDEX IF NOT EXISTS event_pubkey_kind ON event (pubkey, kind);
+CREATE INDEX IF NOT EXISTS event_created_at ON event (created_at);
+`)
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("could not create %s database tables: %v", s.driver, err)
+	}
+	s.db = db
+	return nil
+}
+
+func replaceable(kind int) bool {
+	return kind == nostr.KindSetMetadata || kind == nostr.KindContactList || (kind >= 10000 && kind < 20000)
+}
+
+func (s *sqlStorage) SaveEvent(evt *nostr.Event) error {
+	tags, err := json.Marshal(evt.Tags)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if replaceable(evt.Kind) {
+		_, err = tx.Exec(`DELETE FROM event WHERE pubkey = $1 AND kind = $2 AND created_at <= $3`, evt.PubKey, evt.Kind, int64(evt.CreatedAt))
+	} else if evt.Kind >= 30000 && evt.Kind < 40000 {
+		d := ""
+		if t := evt.Tags.GetFirst([]string{"d", ""}); t != nil {
+			d = t.Value()
+		}
+		_, err = deleteParameterized(tx, evt, d)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO event (id, pubkey, created_at, kind, tags, content, sig) VALUES ($1, $2, $3, $4, $5, $6, $7)
+ON CONFLICT (id) DO NOTHING`, evt.ID, evt.PubKey, int64(evt.CreatedAt), evt.Kind, string(tags), evt.Content, evt.Sig)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// deleteParameterized deletes older versions of a parameterized replaceable event with the same d tag.
+func deleteParameterized(tx *sql.Tx, evt *nostr.Event, d string) (int, error) {
+	rows, err := tx.Query(`SELECT id, tags FROM event WHERE pubkey = $1 AND kind = $2 AND created_at <= $3`, evt.PubKey, evt.Kind, int64(evt.CreatedAt))
+	if err != nil {
+		return 0, err
+	}
+	ids := []string{}
+	for rows.Next() {
+		var id, tagsj string
+		if err = rows.Scan(&id, &tagsj); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		tags := nostr.Tags{}
+		json.Unmarshal([]byte(tagsj), &tags)
+		od := ""
+		if t := tags.GetFirst([]string{"d", ""}); t != nil {
+			od = t.Value()
+		}
+		if od == d {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+	for _, id := range ids {
+		if _, err = tx.Exec(`DELETE FROM event WHERE id = $1`, id); err != nil {
+			return 0, err
+		}
+	}
+	return len(ids), nil
+}
+
+// QueryEvents selects events by ID, author, kind and time in the database and matches tags in the relay since the
+// tags are stored as JSON.
+func (s *sqlStorage) QueryEvents(filter *nostr.Filter) ([]nostr.Event, error) {
+	conditions := []string{}
+	params := []any{}
+	in := func(column string, values []string, prefix bool) {
+		c := []string{}
+		for _, v := range values {
+			if prefix {
+				params = append(params, v+"%")
+				c = append(c, fmt.Sprintf("%s LIKE $%v", column, len(params)))
+			} else {
+				params = append(params, v)
+				c = append(c, fmt.Sprintf("%s = $%v", column, len(params)))
+			}
+		}
+		conditions = append(conditions, "("+strings.Join(c, " OR ")+")")
+	}
+	if filter.IDs != nil {
+		if len(filter.IDs) == 0 {
+			return []nostr.Event{}, nil
+		}
+		in("id", filter.IDs, true)
+	}
+	if filter.Authors != nil {
+		if len(filter.Authors) == 0 {
+			return []nostr.Event{}, nil
+		}
+		in("pubkey", filter.Authors, true)
+	}
+	if filter.Kinds != nil {
+		if len(filter.Kinds) == 0 {
+			return []nostr.Event{}, nil
+		}
+		c := []string{}
+		for _, k := range filter.Kinds {
+			params = append(params, k)
+			c = append(c, fmt.Sprintf("kind = $%v", len(params)))
+		}
+		conditions = append(conditions, "("+strings.Join(c, " OR ")+")")
+	}
+	if filter.Since != nil {
+		params = append(params, int64(*filter.Since))
+		conditions = append(conditions, fmt.Sprintf("created_at >= $%v", len(params)))
+	}
+	if filter.Until != nil {
+		params = append(params, int64(*filter.Until))
+		conditions = append(conditions, fmt.Sprintf("created_at <= $%v", len(params)))
+	}
+	if filter.Search != "" {
+		params = append(params, "%"+filter.Search+"%")
+		conditions = append(conditions, fmt.Sprintf("content LIKE $%v", len(params)))
+	}
+	q := `SELECT id, pubkey, created_at, kind, tags, content, sig FROM event`
+	if len(conditions) > 0 {
+		q += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	q += " ORDER BY created_at DESC"
+	limit := filter.Limit
+	if limit <= 0 || limit > MaxQueryEvents {
+		limit = MaxQueryEvents
+	}
+	if len(filter.Tags) == 0 {
+		q += fmt.Sprintf(" LIMIT %v", limit)
+	}
+	rows, err := s.db.Query(q, params...)
+	if err != nil {
+		log.Errorf("could not query %s database: %v", s.driver, err)
+		return nil, err
+	}
+	defer rows.Close()
+	events := []nostr.Event{}
+	for rows.Next() && len(events) < limit {
+		var evt nostr.Event
+		var created int64
+		var tags string
+		if err = rows.Scan(&evt.ID, &evt.PubKey, &created, &evt.Kind, &tags, &evt.Content, &evt.Sig); err != nil {
+			return nil, err
+		}
+		evt.CreatedAt = nostr.Timestamp(created)
+		if err = json.Unmarshal([]byte(tags), &evt.Tags); err != nil {
+			log.Warnf("could not read tags of event %s: %v", evt.ID, err)
+			continue
+		}
+		if filter.Tags != nil && !filter.Matches(&evt) {
+			continue
+		}
+		events = append(events, evt)
+	}
+	return events, rows.Err()
+}
+
+func (s *sqlStorage) DeleteEvent(id string, pubkey string) error {
+	_, err := s.db.Exec(`DELETE FROM event WHERE id = $1 AND pubkey = $2`, id, pubkey)
+	return err
+}
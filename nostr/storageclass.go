@@ -0,0 +1,99 @@
+package nostr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// StorageClass is how the events of a kind are stored. Ephemeral events are never persisted, hot events are only stored
+// locally in the relay database or IPFS node, and archival events are also uploaded to Web3.Storage and Filecoin.
+type StorageClass string
+
+const (
+	StorageEphemeral StorageClass = "ephemeral"
+	StorageHot       StorageClass = "hot"
+	StorageArchival  StorageClass = "archival"
+)
+
+// Ephemeral kinds are never stored by relays according to NIP-16.
+const (
+	MinEphemeralKind = 20000
+	MaxEphemeralKind = 29999
+)
+
+type kindClass struct {
+	min   int
+	max   int
+	class StorageClass
+}
+
+// StorageClasses maps ranges of event kinds to storage classes.
+type StorageClasses []kindClass
+
+// IsEphemeral returns true if a kind is in the NIP-16 ephemeral range.
+func IsEphemeral(kind int) bool {
+	return kind >= MinEphemeralKind && kind <= MaxEphemeralKind
+}
+
+// ParseStorageClasses parses a map of kinds or kind ranges like "20000-29999" to storage classes. The NIP-16 ephemeral
+// range is always ephemeral.
+func ParseStorageClasses(m map[string]string) (StorageClasses, error) {
+	classes := StorageClasses{}
+	for k, v := range m {
+		kc := kindClass{class: StorageClass(strings.ToLower(v))}
+		if kc.class != StorageEphemeral && kc.class != StorageHot && kc.class != StorageArchival {
+			return nil, fmt.Errorf("unknown storage class %s for kinds %s", v, k)
+		}
+		min, max, ok := strings.Cut(k, "-")
+		var err error
+		if kc.min, err = strconv.Atoi(strings.TrimSpace(min)); err != nil {
+			return nil, fmt.Errorf("invalid kind %s: %v", k, err)
+		}
+		kc.max = kc.min
+		if ok {
+			if kc.max, err = strconv.Atoi(strings.TrimSpace(max)); err != nil {
+				return nil, fmt.Errorf("invalid kind range %s: %v", k, err)
+			}
+		}
+		if kc.min > kc.max {
+			return nil, fmt.Errorf("invalid kind range %s", k)
+		}
+		if kc.class != StorageEphemeral && kc.max >= MinEphemeralKind && kc.min <= MaxEphemeralKind {
+			return nil, fmt.Errorf("kinds %s are in the ephemeral range %v-%v and can't be stored", k, MinEphemeralKind, MaxEphemeralKind)
+		}
+		classes = append(classes, kc)
+	}
+	return append(classes, kindClass{MinEphemeralKind, MaxEphemeralKind, StorageEphemeral}), nil
+}
+
+// Class returns the storage class of a kind. When several ranges contain the kind the narrowest is used.
+func (s StorageClasses) Class(kind int) (StorageClass, bool) {
+	var match *kindClass
+	for i, kc := range s {
+		if kind >= kc.min && kind <= kc.max && (match == nil || kc.max-kc.min < match.max-match.min) {
+			match = &s[i]
+		}
+	}
+	if match == nil {
+		if IsEphemeral(kind) {
+			return StorageEphemeral, true
+		}
+		return "", false
+	}
+	return match.class, true
+}
+
+// class returns the storage class of an event. Kinds without a configured class are archival if they are mirrored to
+// IPFS and hot otherwise.
+func (s *Storage) class(evt *nostr.Event) StorageClass {
+	if c, ok := s.classes.Class(evt.Kind); ok {
+		return c
+	}
+	if s.mirrored(evt) {
+		return StorageArchival
+	}
+	return StorageHot
+}
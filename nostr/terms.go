@@ -0,0 +1,243 @@
+package nostr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/util"
+)
+
+// KindTermsAcceptance is the kind of the events pubkeys acknowledge the terms of service of a relay with. The event has
+// the URL of the relay in its d tag and the URL and version of the terms in its r and version tags.
+const KindTermsAcceptance = 30889
+
+// TermsAcceptance is the acknowledgment of a version of the terms of service of the relay by a pubkey.
+type TermsAcceptance struct {
+	Version string
+	EventID string
+	Time    time.Time
+}
+
+// TermsAcceptances are the latest acknowledgments of the terms of service of the relay, keyed by pubkey.
+type TermsAcceptances struct {
+	PubKeys map[string]TermsAcceptance
+	lock    sync.Mutex
+}
+
+var Acceptances = &TermsAcceptances{PubKeys: map[string]TermsAcceptance{}}
+
+func termsFile() string {
+	return filepath.Join(util.AppData, "relay-terms.json")
+}
+
+// LoadTermsAcceptances reads the persisted acknowledgments of the terms of service of the relay.
+func LoadTermsAcceptances() error {
+	a := Acceptances
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if !util.PathExists(termsFile()) {
+		return nil
+	}
+	data, err := util.ReadDataFile(termsFile())
+	if err != nil {
+		log.Errorf("could not read relay terms file %s: %v", termsFile(), err)
+		return err
+	}
+	if err = json.Unmarshal(data, a); err != nil {
+		log.Errorf("could not read JSON data from relay terms file %s: %v", termsFile(), err)
+		return err
+	}
+	if a.PubKeys == nil {
+		a.PubKeys = map[string]TermsAcceptance{}
+	}
+	return nil
+}
+
+// Accepted returns true if a pubkey acknowledged a version of the terms of service of the relay.
+func (a *TermsAcceptances) Accepted(pubkey string, version string) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	t, ok := a.PubKeys[pubkey]
+	return ok && t.Version == version
+}
+
+func (a *TermsAcceptances) record(evt *nostr.Event, version string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.PubKeys[evt.PubKey] = TermsAcceptance{Version: version, EventID: evt.ID, Time: evt.CreatedAt.Time()}
+	data, _ := json.MarshalIndent(a, "", " ")
+	if err := util.WriteDataFile(termsFile(), data); err != nil {
+		log.Errorf("could not write relay terms file %s: %v", termsFile(), err)
+		return err
+	}
+	return nil
+}
+
+// TermsAcceptanceTags returns the tags of an acknowledgment of the terms of service of a relay.
+func TermsAcceptanceTags(url string, t TermsOfService) nostr.Tags {
+	return nostr.Tags{{"d", url}, {"r", t.URL}, {"version", t.Version}}
+}
+
+// terms returns the terms of service of the relay, if it has any.
+func (r *Relay) terms() (TermsOfService, bool) {
+	r.policyLock.RLock()
+	defer r.policyLock.RUnlock()
+	if r.Info.TermsOfService == "" {
+		return TermsOfService{}, false
+	}
+	return TermsOfService{URL: r.Info.TermsOfService, Version: r.Info.TermsVersion, Required: r.Info.RequireTerms}, true
+}
+
+// termsAccepted returns true if the relay doesn't require acknowledging its terms of service, an event is from the
+// operator of the relay or a pubkey which acknowledged the current version of the terms, or it is the acknowledgment,
+// which is recorded if record is true.
+func (r *Relay) termsAccepted(evt *nostr.Event, record bool) bool {
+	t, ok := r.terms()
+	if !ok || !t.Required {
+		return true
+	}
+	r.policyLock.RLock()
+	operator := r.Info.PubKey
+	r.policyLock.RUnlock()
+	if evt.PubKey == operator {
+		return true
+	}
+	if evt.Kind == KindTermsAcceptance {
+		if v := evt.Tags.GetFirst([]string{"version", ""}); v == nil || v.Value() != t.Version {
+			return false
+		}
+		if !record {
+			return true
+		}
+		if err := Acceptances.record(evt, t.Version); err != nil {
+			return false
+		}
+		log.Infof("%s acknowledged version %s of the relay terms of service", evt.PubKey, t.Version)
+		return true
+	}
+	return Acceptances.Accepted(evt.PubKey, t.Version)
+}
+
+// AcceptTermsRelays are the URLs of the relays whose terms of service the client acknowledges before publishing events
+// to them, or * for every relay.
+var AcceptTermsRelays = []string{}
+
+var termsLock = sync.Mutex{}
+
+// termsKeys are the private keys acknowledgments are signed with, keyed by public key.
+var termsKeys = map[string]string{}
+
+// acknowledged are the versions of the terms of service of relays acknowledged by the client, keyed by relay URL and
+// pubkey. The version is empty if the relay doesn't require acknowledging its terms.
+var acknowledged = map[string]string{}
+
+// SetTermsKeys sets the private keys the client signs acknowledgments of the terms of service of relays with. The terms
+// are only acknowledged before publishing events signed by one of the keys.
+func SetTermsKeys(privkeys ...string) {
+	termsLock.Lock()
+	defer termsLock.Unlock()
+	termsKeys = map[string]string{}
+	for _, k := range privkeys {
+		if pk, err := nostr.GetPublicKey(k); err == nil {
+			termsKeys[pk] = k
+		}
+	}
+}
+
+func acceptsTerms(url string) bool {
+	for _, u := range AcceptTermsRelays {
+		if u == "*" || nostr.NormalizeURL(u) == nostr.NormalizeURL(url) {
+			return true
+		}
+	}
+	return false
+}
+
+// FetchRelayInfo fetches the NIP-11 relay information document of a relay.
+func FetchRelayInfo(ctx context.Context, url string) (RelayInformationDocument, error) {
+	doc := RelayInformationDocument{}
+	u := nostr.NormalizeURL(url)
+	u = strings.Replace(strings.Replace(u, "wss://", "https://", 1), "ws://", "http://", 1)
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return doc, err
+	}
+	req.Header.Set("Accept", "application/nostr+json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return doc, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return doc, &util.HTTPStatusError{StatusCode: res.StatusCode, Status: res.Status}
+	}
+	if err = json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		return doc, fmt.Errorf("invalid relay information document from %s: %v", url, err)
+	}
+	return doc, nil
+}
+
+// acceptTerms acknowledges the terms of service of a relay an event is published to if the relay requires it, the
+// client is configured to acknowledge the terms of the relay and it has the key of the author of the event. The relay is
+// first queried for an acknowledgment of the current version of the terms.
+func acceptTerms(ctx context.Context, r *nostr.Relay, evt nostr.Event) error {
+	if evt.Kind == KindTermsAcceptance || !acceptsTerms(r.URL) {
+		return nil
+	}
+	key := r.URL + " " + evt.PubKey
+	termsLock.Lock()
+	privkey, ok := termsKeys[evt.PubKey]
+	_, done := acknowledged[key]
+	termsLock.Unlock()
+	if !ok || done {
+		return nil
+	}
+	info, err := FetchRelayInfo(ctx, r.URL)
+	if err != nil {
+		return err
+	}
+	t := info.TermsOfService
+	if t == nil || !t.Required {
+		termsLock.Lock()
+		acknowledged[key] = ""
+		termsLock.Unlock()
+		return nil
+	}
+	filter := nostr.Filter{Kinds: []int{KindTermsAcceptance}, Authors: []string{evt.PubKey}}
+	events, err := r.QuerySync(ctx, filter)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, e := range events {
+		if v := e.Tags.GetFirst([]string{"version", ""}); v != nil && v.Value() == t.Version {
+			found = true
+		}
+	}
+	if !found {
+		ack, _, err := BuildEvent(KindTermsAcceptance, "", TermsAcceptanceTags(r.URL, *t), BuildOptions{PrivKey: privkey})
+		if err != nil {
+			return err
+		}
+		s, err := r.Publish(ctx, ack)
+		if err != nil {
+			return err
+		}
+		if s != nostr.PublishStatusSucceeded {
+			return fmt.Errorf("relay %s did not accept the acknowledgment of its terms of service: %v", r.URL, s)
+		}
+		log.Infof("acknowledged version %s of the terms of service %s of relay %s", t.Version, t.URL, r.URL)
+	}
+	termsLock.Lock()
+	acknowledged[key] = t.Version
+	termsLock.Unlock()
+	return nil
+}
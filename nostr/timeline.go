@@ -0,0 +1,204 @@
+package nostr
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/util"
+)
+
+const DefaultTimelineSize = 500
+
+// TimelineKinds are the kinds of public events shown on the local timeline.
+var TimelineKinds = []int{nostr.KindTextNote, nostr.KindRepost}
+
+// Timeline holds the most recent public events stored by the relay, newest first, like the local timeline of a
+// Mastodon server.
+type Timeline struct {
+	lock   sync.Mutex
+	size   int
+	events []nostr.Event
+}
+
+func NewTimeline(size int) *Timeline {
+	if size <= 0 {
+		size = DefaultTimelineSize
+	}
+	return &Timeline{size: size, events: []nostr.Event{}}
+}
+
+func public(evt *nostr.Event) bool {
+	for _, k := range TimelineKinds {
+		if evt.Kind == k {
+			return true
+		}
+	}
+	return false
+}
+
+// Add adds a public event to the timeline in created_at order, dropping the oldest event when the timeline is full.
+func (t *Timeline) Add(evt nostr.Event) {
+	if !public(&evt) {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	i := 0
+	for i < len(t.events) && t.events[i].CreatedAt > evt.CreatedAt {
+		i++
+	}
+	if i < len(t.events) && t.events[i].ID == evt.ID {
+		return
+	}
+	if i >= t.size {
+		return
+	}
+	t.events = append(t.events, nostr.Event{})
+	copy(t.events[i+1:], t.events[i:])
+	t.events[i] = evt
+	if len(t.events) > t.size {
+		t.events = t.events[:t.size]
+	}
+}
+
+// Remove removes an event from the timeline.
+func (t *Timeline) Remove(id string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for i, e := range t.events {
+		if e.ID == id {
+			t.events = append(t.events[:i], t.events[i+1:]...)
+			return
+		}
+	}
+}
+
+// Events returns up to limit events created before until, or all events if until is zero, which match if match is set.
+func (t *Timeline) Events(limit int, until nostr.Timestamp, match func(*nostr.Event) bool) []nostr.Event {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	events := []nostr.Event{}
+	for _, e := range t.events {
+		if until > 0 && e.CreatedAt >= until {
+			continue
+		}
+		if match != nil && !match(&e) {
+			continue
+		}
+		if limit > 0 && len(events) >= limit {
+			break
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+var landingPage = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Name}}</title></head>
+<body>
+<h1>{{.Name}}</h1>
+<p>Local timeline of the public posts on this relay. Connect a Nostr client to this address to join in.</p>
+{{range .Live}}<aside><strong>Live now:</strong> <a href="{{.Streaming}}">{{.Title}}</a> <small>{{.PubKey}}</small></aside>
+{{end}}{{range .Events}}<article>
+<p><small>{{.PubKey}} &middot; {{.CreatedAt.Time.UTC.Format "2006-01-02 15:04"}}</small></p>
+<p>{{.Content}}</p>
+</article>
+<hr>
+{{else}}<p>No posts yet.</p>
+{{end}}
+</body>
+</html>
+`))
+
+// InBounds returns a filter matching events geotagged with a g tag inside the map bounds.
+func InBounds(minLat, minLon, maxLat, maxLon float64) func(*nostr.Event) bool {
+	return func(evt *nostr.Event) bool {
+		g := evt.Tags.GetFirst([]string{"g", ""})
+		if g == nil {
+			return false
+		}
+		lat, lon, err := util.DecodeGeohash(g.Value())
+		if err != nil {
+			return false
+		}
+		return lat >= minLat && lat <= maxLat && lon >= minLon && lon <= maxLon
+	}
+}
+
+// parseBounds parses map bounds given as min latitude, min longitude, max latitude and max longitude.
+func parseBounds(bbox string) (func(*nostr.Event) bool, error) {
+	parts := strings.Split(bbox, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("bounds must be minLat,minLon,maxLat,maxLon")
+	}
+	b := [4]float64{}
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bounds %s: %v", bbox, err)
+		}
+		b[i] = f
+	}
+	return InBounds(b[0], b[1], b[2], b[3]), nil
+}
+
+func (r *Relay) handleTimeline(w http.ResponseWriter, rq *http.Request) {
+	limit, _ := strconv.Atoi(rq.URL.Query().Get("limit"))
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+	until, _ := strconv.ParseInt(rq.URL.Query().Get("until"), 10, 64)
+	var match func(*nostr.Event) bool
+	if bbox := rq.URL.Query().Get("bbox"); bbox != "" {
+		var err error
+		if match, err = parseBounds(bbox); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.storage.timeline.Events(limit, nostr.Timestamp(until), match))
+}
+
+// RewriteLinks rewrites the links in the content of the posts on the landing page if set, e.g. to replace dead links.
+var RewriteLinks func(string) string
+
+func (r *Relay) handleLandingPage(w http.ResponseWriter, rq *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	events := r.storage.timeline.Events(50, 0, nil)
+	for i := range events {
+		if RewriteLinks != nil {
+			events[i].Content = RewriteLinks(events[i].Content)
+		}
+		events[i].Content = ipfs.RewriteGatewayURLs(events[i].Content, util.IsLocalRequest(rq))
+	}
+	landingPage.Execute(w, struct {
+		Name   string
+		Live   []LiveActivity
+		Events []nostr.Event
+	}{r.Name(), r.LiveNow(), events})
+}
+
+// loadTimeline fills the timeline from the database when the relay starts.
+func (s *Storage) loadTimeline() {
+	if s.db == nil || s.timeline == nil {
+		return
+	}
+	events, err := s.QueryEvents(&nostr.Filter{Kinds: TimelineKinds, Limit: s.timeline.size})
+	if err != nil {
+		log.Warnf("could not load local timeline from relay storage: %v", err)
+		return
+	}
+	for _, e := range events {
+		s.timeline.Add(e)
+	}
+}
@@ -0,0 +1,220 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+
+	"github.com/allisterb/patr/util"
+)
+
+const (
+	KindIPNSPublish    = "ipns-publish"
+	KindW3SUpload      = "w3s-upload"
+	KindW3SNamePublish = "w3s-name-publish"
+	KindRelayPublish   = "relay-publish"
+	KindPubSubAnnounce = "pubsub-announce"
+)
+
+// Entry is an outbound side effect which is persisted before it is performed so it can be replayed after a crash.
+type Entry struct {
+	Key       string
+	Kind      string
+	Payload   map[string]string
+	Created   time.Time
+	Attempts  int
+	LastError string
+	Done      bool
+}
+
+type Handler func(ctx context.Context, e Entry) error
+
+var log = logging.Logger("patr/outbox")
+
+func outboxFile() string {
+	return filepath.Join(util.AppData, "outbox.json")
+}
+
+var entries = []Entry{}
+var handlers = make(map[string]Handler)
+var lock = sync.Mutex{}
+var loaded = false
+
+func RegisterHandler(kind string, h Handler) {
+	lock.Lock()
+	defer lock.Unlock()
+	handlers[kind] = h
+}
+
+func load() error {
+	if loaded {
+		return nil
+	}
+	f := outboxFile()
+	if !util.PathExists(f) {
+		loaded = true
+		return nil
+	}
+	data, err := util.ReadDataFile(f)
+	if err != nil {
+		log.Errorf("could not read outbox file %s: %v", f, err)
+		return err
+	}
+	if err = json.Unmarshal(data, &entries); err != nil {
+		log.Errorf("could not read JSON data from outbox file %s: %v", f, err)
+		return err
+	}
+	loaded = true
+	return nil
+}
+
+// save writes the outbox to a temporary file first so a crash never leaves a truncated outbox.
+func save() error {
+	pending := []Entry{}
+	for _, e := range entries {
+		if !e.Done || time.Since(e.Created) < 7*24*time.Hour {
+			pending = append(pending, e)
+		}
+	}
+	entries = pending
+	data, _ := json.MarshalIndent(entries, "", " ")
+	if err := util.WriteDataFile(outboxFile(), data); err != nil {
+		log.Errorf("could not write outbox file %s: %v", outboxFile(), err)
+		return err
+	}
+	return nil
+}
+
+// Enqueue persists a new outbox entry. Entries with a key that is already in the outbox are ignored.
+func Enqueue(kind string, key string, payload map[string]string) error {
+	if util.DryRun {
+		log.Infof("dry run: would %s", Describe(Entry{Kind: kind, Payload: payload}))
+		return nil
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if err := load(); err != nil {
+		return err
+	}
+	k := kind + ":" + key
+	for _, e := range entries {
+		if e.Key == k {
+			log.Debugf("outbox entry %s already exists", k)
+			return nil
+		}
+	}
+	entries = append(entries, Entry{Key: k, Kind: kind, Payload: payload, Created: util.Now()})
+	return save()
+}
+
+func Pending() ([]Entry, error) {
+	lock.Lock()
+	defer lock.Unlock()
+	if err := load(); err != nil {
+		return nil, err
+	}
+	p := []Entry{}
+	for _, e := range entries {
+		if !e.Done {
+			p = append(p, e)
+		}
+	}
+	return p, nil
+}
+
+// Process performs all pending outbox entries in order, marking each done once its handler succeeds.
+// Entries without a registered handler are left in the outbox.
+func Process(ctx context.Context) error {
+	pending, err := Pending()
+	if err != nil {
+		return err
+	}
+	if util.DryRun {
+		for _, e := range pending {
+			log.Infof("dry run: would retry pending outbox entry to %s", Describe(e))
+		}
+		return nil
+	}
+	failed := 0
+	for _, e := range pending {
+		lock.Lock()
+		h, ok := handlers[e.Kind]
+		lock.Unlock()
+		if !ok {
+			continue
+		}
+		err := h(ctx, e)
+		lock.Lock()
+		for i := range entries {
+			if entries[i].Key == e.Key {
+				entries[i].Attempts++
+				if err == nil {
+					entries[i].Done = true
+					entries[i].LastError = ""
+				} else {
+					entries[i].LastError = err.Error()
+				}
+			}
+		}
+		serr := save()
+		lock.Unlock()
+		if err != nil {
+			log.Errorf("outbox entry %s failed: %v", e.Key, err)
+			failed++
+		} else {
+			log.Infof("outbox entry %s completed", e.Key)
+		}
+		if serr != nil {
+			return serr
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%v outbox entries failed and will be retried", failed)
+	}
+	return nil
+}
+
+// Describe returns a description of the side effect an outbox entry performs.
+func Describe(e Entry) string {
+	switch e.Kind {
+	case KindIPNSPublish:
+		if e.Payload["key"] == "self" {
+			return fmt.Sprintf("publish /ipld/%s to the node IPNS name on the DHT", e.Payload["cid"])
+		}
+		return fmt.Sprintf("publish %s to IPNS name %s on the DHT", e.Payload["path"], e.Payload["key"])
+	case KindW3SUpload:
+		return fmt.Sprintf("pin block %s with the pinning services", e.Payload["cid"])
+	case KindW3SNamePublish:
+		if e.Payload["key"] != "" {
+			return fmt.Sprintf("publish IPNS record for %s to IPNS name %s on name.web3.storage", e.Payload["cid"], e.Payload["key"])
+		}
+		return fmt.Sprintf("publish IPNS record for %s to name.web3.storage", e.Payload["cid"])
+	case KindRelayPublish:
+		return fmt.Sprintf("publish event to Nostr relay %s", e.Payload["relay"])
+	case KindPubSubAnnounce:
+		return fmt.Sprintf("announce %s on pubsub topic %s", e.Payload["data"], e.Payload["topic"])
+	default:
+		return fmt.Sprintf("perform %s %v", e.Kind, e.Payload)
+	}
+}
+
+// Schedule replays pending outbox entries periodically until the context is cancelled.
+func Schedule(ctx context.Context, interval time.Duration) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				Process(ctx)
+			}
+		}
+	}()
+}
@@ -0,0 +1,93 @@
+package outbox
+
+import (
+	"context"
+
+	"github.com/allisterb/patr/util"
+)
+
+// Tx is a two-phase publish. Prepare steps are performed immediately and undone in reverse order if any of them
+// fails. Commit entries, which should flip the public pointers like IPNS names, are only written to the outbox
+// once every prepare step has succeeded.
+type Tx struct {
+	Name    string
+	undo    []func(ctx context.Context) error
+	commits []Entry
+}
+
+func Begin(name string) *Tx {
+	return &Tx{Name: name}
+}
+
+// Prepare performs a step of the transaction described by desc. If the step fails the transaction is rolled back and the
+// error is returned. undo may be nil if the step has no local state to clean up.
+func (tx *Tx) Prepare(ctx context.Context, desc string, do func(ctx context.Context) error, undo func(ctx context.Context) error) error {
+	if util.DryRun {
+		log.Infof("dry run: would %s", desc)
+		return nil
+	}
+	if err := do(ctx); err != nil {
+		log.Errorf("prepare step %v of %s failed, rolling back: %v", len(tx.undo)+1, tx.Name, err)
+		tx.Rollback(ctx)
+		return err
+	}
+	tx.undo = append(tx.undo, undo)
+	return nil
+}
+
+// Commit adds an outbox entry which is performed when the transaction is applied.
+func (tx *Tx) Commit(kind string, key string, payload map[string]string) {
+	tx.commits = append(tx.commits, Entry{Key: kind + ":" + key, Kind: kind, Payload: payload})
+}
+
+// Rollback undoes all prepared steps in reverse order.
+func (tx *Tx) Rollback(ctx context.Context) {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		if tx.undo[i] == nil {
+			continue
+		}
+		if err := tx.undo[i](ctx); err != nil {
+			log.Warnf("could not undo step %v of %s: %v", i+1, tx.Name, err)
+		}
+	}
+	tx.undo = nil
+	tx.commits = nil
+}
+
+// Apply writes all commit entries to the outbox in a single write and processes the outbox. Once the entries are
+// persisted the transaction is committed and failed entries are retried later instead of rolled back.
+func (tx *Tx) Apply(ctx context.Context) error {
+	if util.DryRun {
+		for _, c := range tx.commits {
+			log.Infof("dry run: would %s", Describe(c))
+		}
+		return nil
+	}
+	lock.Lock()
+	if err := load(); err != nil {
+		lock.Unlock()
+		tx.Rollback(ctx)
+		return err
+	}
+	for _, c := range tx.commits {
+		exists := false
+		for _, e := range entries {
+			if e.Key == c.Key {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			c.Created = util.Now()
+			entries = append(entries, c)
+		}
+	}
+	err := save()
+	lock.Unlock()
+	if err != nil {
+		tx.Rollback(ctx)
+		return err
+	}
+	log.Infof("committed %s with %v outbox entries", tx.Name, len(tx.commits))
+	return Process(ctx)
+}
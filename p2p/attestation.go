@@ -0,0 +1,106 @@
+package p2p
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/util"
+)
+
+// KindNodeAttestation is the kind of the Nostr event a user signs to attest that they operate the node with a peer ID.
+const KindNodeAttestation = 30079
+
+// FollowTag is the connection manager tag of peers attested by followed users.
+const FollowTag = "patr-follow"
+
+var localAttestation *nostr.Event
+var trustedPubKeys = make(map[string]bool)
+var attestationLock = sync.RWMutex{}
+
+// NewAttestation signs an attestation that the user with a DID and Nostr private key operates the node with a peer ID.
+func NewAttestation(privkey string, did string, pid peer.ID) (nostr.Event, error) {
+	evt := nostr.Event{
+		CreatedAt: nostr.Timestamp(util.Now().Unix()),
+		Kind:      KindNodeAttestation,
+		Tags:      nostr.Tags{nostr.Tag{"d", pid.String()}, nostr.Tag{"did", did}},
+	}
+	if err := evt.Sign(privkey); err != nil {
+		log.Errorf("could not sign node attestation: %v", err)
+		return nostr.Event{}, err
+	}
+	return evt, nil
+}
+
+// VerifyAttestation checks that an attestation is validly signed for a peer ID and returns the DID it attests.
+func VerifyAttestation(evt nostr.Event, pid peer.ID) (string, error) {
+	if evt.Kind != KindNodeAttestation {
+		return "", fmt.Errorf("event %s is not a node attestation", evt.ID)
+	}
+	if d := evt.Tags.GetFirst([]string{"d", ""}); d == nil || d.Value() != pid.String() {
+		return "", fmt.Errorf("node attestation %s is not for peer %v", evt.ID, pid)
+	}
+	did := evt.Tags.GetFirst([]string{"did", ""})
+	if did == nil || did.Value() == "" {
+		return "", fmt.Errorf("node attestation %s does not have a DID", evt.ID)
+	}
+	if evt.GetID() != evt.ID {
+		return "", fmt.Errorf("node attestation ID %s does not match its content", evt.ID)
+	}
+	if ok, err := evt.CheckSignature(); err != nil || !ok {
+		return "", fmt.Errorf("node attestation %s has an invalid signature", evt.ID)
+	}
+	if _, err := util.NormalizeTimestamp(time.Unix(int64(evt.CreatedAt), 0)); err != nil {
+		return "", fmt.Errorf("node attestation %s has an invalid timestamp: %v", evt.ID, err)
+	}
+	return did.Value(), nil
+}
+
+// SetAttestation sets the attestation sent to peers during identity exchange.
+func SetAttestation(evt nostr.Event) {
+	attestationLock.Lock()
+	defer attestationLock.Unlock()
+	localAttestation = &evt
+}
+
+// SetTrustedPubKeys sets the Nostr public keys of the users whose nodes are trusted, usually the user's follows.
+func SetTrustedPubKeys(pubkeys []string) {
+	attestationLock.Lock()
+	defer attestationLock.Unlock()
+	trustedPubKeys = make(map[string]bool)
+	for _, k := range pubkeys {
+		trustedPubKeys[k] = true
+	}
+}
+
+func isTrusted(pubkey string) bool {
+	attestationLock.RLock()
+	defer attestationLock.RUnlock()
+	return trustedPubKeys[pubkey]
+}
+
+// checkAttestation verifies the attestation of a remote identity. Connections to peers operated by trusted users are
+// protected from being trimmed by the connection manager and tagged so they are preferred.
+func checkAttestation(ipfscore ipfs.IPFSCore, pid peer.ID, i *Identity) {
+	if i.Attestation == nil {
+		return
+	}
+	did, err := VerifyAttestation(*i.Attestation, pid)
+	if err != nil {
+		log.Warnf("peer %v sent an invalid node attestation: %v", pid, err)
+		return
+	}
+	i.Did, i.Trusted = did, isTrusted(i.Attestation.PubKey)
+	if !i.Trusted {
+		log.Infof("peer %v is operated by %s", pid, did)
+		return
+	}
+	cm := ipfscore.Node.PeerHost.ConnManager()
+	cm.TagPeer(pid, FollowTag, 100)
+	cm.Protect(pid, FollowTag)
+	log.Infof("peer %v is operated by followed user %s", pid, did)
+}
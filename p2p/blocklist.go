@@ -0,0 +1,225 @@
+package p2p
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/util"
+)
+
+// AbuseReport is a report of an abusive or misbehaving peer.
+type AbuseReport struct {
+	Peer   string
+	Reason string
+	Time   time.Time
+}
+
+// Blocklist is the list of peer IDs and CIDR ranges which are not allowed to connect to the node.
+type Blocklist struct {
+	Peers   []string
+	CIDRs   []string
+	Reports []AbuseReport
+	lock    sync.Mutex
+	filters *ma.Filters
+}
+
+var Blocked = &Blocklist{Peers: []string{}, CIDRs: []string{}, Reports: []AbuseReport{}, filters: ma.NewFilters()}
+
+func blocklistFile() string {
+	return filepath.Join(util.AppData, "blocklist.json")
+}
+
+// LoadBlocklist reads the persisted blocklist and sets the CIDR ranges as swarm address filters of the IPFS node.
+// It must be called before the IPFS node is started.
+func LoadBlocklist() error {
+	b := Blocked
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if util.PathExists(blocklistFile()) {
+		data, err := util.ReadDataFile(blocklistFile())
+		if err != nil {
+			log.Errorf("could not read blocklist file %s: %v", blocklistFile(), err)
+			return err
+		}
+		if err = json.Unmarshal(data, b); err != nil {
+			log.Errorf("could not read JSON data from blocklist file %s: %v", blocklistFile(), err)
+			return err
+		}
+	}
+	b.filters = ma.NewFilters()
+	ipfs.SwarmAddrFilters = []string{}
+	for _, c := range b.CIDRs {
+		_, ipnet, err := net.ParseCIDR(c)
+		if err != nil {
+			log.Warnf("invalid CIDR range %s in blocklist: %v", c, err)
+			continue
+		}
+		b.filters.AddFilter(*ipnet, ma.ActionDeny)
+		if f, err := cidrToFilter(ipnet); err == nil {
+			ipfs.SwarmAddrFilters = append(ipfs.SwarmAddrFilters, f)
+		}
+	}
+	return nil
+}
+
+func (b *Blocklist) save() error {
+	data, _ := json.MarshalIndent(b, "", " ")
+	if err := util.WriteDataFile(blocklistFile(), data); err != nil {
+		log.Errorf("could not write blocklist file %s: %v", blocklistFile(), err)
+		return err
+	}
+	return nil
+}
+
+// cidrToFilter converts a CIDR range to the multiaddr format used by the IPFS swarm address filters.
+func cidrToFilter(ipnet *net.IPNet) (string, error) {
+	ones, _ := ipnet.Mask.Size()
+	if ip4 := ipnet.IP.To4(); ip4 != nil {
+		return fmt.Sprintf("/ip4/%s/ipcidr/%v", ip4, ones), nil
+	}
+	return fmt.Sprintf("/ip6/%s/ipcidr/%v", ipnet.IP, ones), nil
+}
+
+// Block adds a peer ID or a CIDR range to the blocklist.
+func (b *Blocklist) Block(s string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if _, ipnet, err := net.ParseCIDR(s); err == nil {
+		if util.Contains(b.CIDRs, ipnet.String()) {
+			return nil
+		}
+		b.CIDRs = append(b.CIDRs, ipnet.String())
+		b.filters.AddFilter(*ipnet, ma.ActionDeny)
+		log.Infof("blocked CIDR range %s", ipnet)
+		return b.save()
+	}
+	pid, err := peer.Decode(s)
+	if err != nil {
+		return fmt.Errorf("%s is not a valid peer ID or CIDR range", s)
+	}
+	if util.Contains(b.Peers, pid.String()) {
+		return nil
+	}
+	b.Peers = append(b.Peers, pid.String())
+	log.Infof("blocked peer %v", pid)
+	return b.save()
+}
+
+// Unblock removes a peer ID or a CIDR range from the blocklist.
+func (b *Blocklist) Unblock(s string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if _, ipnet, err := net.ParseCIDR(s); err == nil {
+		for i, c := range b.CIDRs {
+			if c == ipnet.String() {
+				b.CIDRs = append(b.CIDRs[:i], b.CIDRs[i+1:]...)
+				b.filters.RemoveLiteral(*ipnet)
+				return b.save()
+			}
+		}
+		return fmt.Errorf("CIDR range %s is not blocked", s)
+	}
+	for i, p := range b.Peers {
+		if p == s {
+			b.Peers = append(b.Peers[:i], b.Peers[i+1:]...)
+			return b.save()
+		}
+	}
+	return fmt.Errorf("peer %s is not blocked", s)
+}
+
+// Report records an abuse report for a peer.
+func (b *Blocklist) Report(pid string, reason string) error {
+	if _, err := peer.Decode(pid); err != nil {
+		return fmt.Errorf("%s is not a valid peer ID", pid)
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.Reports = append(b.Reports, AbuseReport{Peer: pid, Reason: reason, Time: util.Now()})
+	log.Warnf("abuse report for peer %s: %s", pid, reason)
+	return b.save()
+}
+
+// IsBlocked returns true if a peer or the address it is connecting from is blocked.
+func (b *Blocklist) IsBlocked(pid peer.ID, addr ma.Multiaddr) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if util.Contains(b.Peers, pid.String()) {
+		return true
+	}
+	return addr != nil && b.filters.AddrBlocked(addr)
+}
+
+// EnforceBlocklist disconnects blocked peers, both currently connected ones and those which connect later.
+// Disconnecting a peer also stops bitswap from serving blocks to it.
+func EnforceBlocklist(ipfscore ipfs.IPFSCore) {
+	n := ipfscore.Node.PeerHost.Network()
+	n.Notify(&network.NotifyBundle{
+		ConnectedF: func(_ network.Network, c network.Conn) {
+			if Blocked.IsBlocked(c.RemotePeer(), c.RemoteMultiaddr()) {
+				log.Infof("disconnecting blocked peer %v at %v", c.RemotePeer(), c.RemoteMultiaddr())
+				go c.Close()
+			}
+		},
+	})
+	disconnectBlocked(ipfscore)
+}
+
+func disconnectBlocked(ipfscore ipfs.IPFSCore) {
+	for _, c := range ipfscore.Node.PeerHost.Network().Conns() {
+		if Blocked.IsBlocked(c.RemotePeer(), c.RemoteMultiaddr()) {
+			log.Infof("disconnecting blocked peer %v at %v", c.RemotePeer(), c.RemoteMultiaddr())
+			c.Close()
+		}
+	}
+}
+
+// SetBlocklistHandlers registers the blocklist API on the relay HTTP router.
+func SetBlocklistHandlers(router *mux.Router, ipfscore ipfs.IPFSCore) {
+	router.Path("/peers/blocklist").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Blocked.lock.Lock()
+		defer Blocked.lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Blocked)
+	})
+	router.Path("/peers/blocklist/{entry:.+}").Methods("PUT", "DELETE").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !util.IsLocalRequest(r) {
+			http.Error(w, "the blocklist can only be changed from the local host", http.StatusForbidden)
+			return
+		}
+		var err error
+		if r.Method == "PUT" {
+			err = Blocked.Block(mux.Vars(r)["entry"])
+			disconnectBlocked(ipfscore)
+		} else {
+			err = Blocked.Unblock(mux.Vars(r)["entry"])
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	router.Path("/peers/{peer}/report").Methods("POST").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data := struct {
+			Reason string `json:"reason"`
+		}{}
+		json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&data)
+		if err := Blocked.Report(mux.Vars(r)["peer"], data.Reason); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
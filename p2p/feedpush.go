@@ -0,0 +1,184 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	"github.com/allisterb/patr/ipfs"
+)
+
+const FeedPushProtocol = protocol.ID("/patr/feedpush/0.1")
+
+const FeatureFeedPush = "feed-push"
+
+// MaxPushedFeedBlocks is the most post blocks pushed to a peer in one exchange.
+const MaxPushedFeedBlocks = 512
+
+// FeedPushCooldown is the time after an exchange with a peer before feeds are pushed to it again, since both nodes start
+// an exchange when they connect.
+var FeedPushCooldown = time.Minute
+
+// FeedHead is the head of a feed a node has and the time it was posted.
+type FeedHead struct {
+	Head   string
+	Posted int64
+}
+
+// PushedFeed is a run of posts of a feed from its head back, newest first.
+type PushedFeed struct {
+	PubKey string
+	Head   string
+	Blocks []PushedBlock
+}
+
+// FeedSource provides the feeds a node pushes to mutual follows and stores the feeds they push to it. It is implemented
+// by the feed package.
+type FeedSource interface {
+	// FeedHeads returns the heads of the node's feed and the feeds it follows keyed by Nostr public key. Followed feeds
+	// without a head have an empty head.
+	FeedHeads(ctx context.Context) map[string]FeedHead
+	// FeedPosts returns up to max posts of a feed from a head back to but not including a post.
+	FeedPosts(ctx context.Context, head string, until string, max int) []PushedBlock
+	// ReceiveFeed validates and stores posts pushed by a peer and returns the number stored.
+	ReceiveFeed(ctx context.Context, pid peer.ID, f PushedFeed) (int, error)
+}
+
+type feedHeadsMessage struct {
+	Heads map[string]FeedHead
+}
+
+type feedPushMessage struct {
+	Feeds []PushedFeed
+}
+
+var feedSource FeedSource
+var feedPushes = make(map[peer.ID]time.Time)
+var feedPushLock = sync.Mutex{}
+
+func init() {
+	Features = append(Features, FeatureFeedPush)
+}
+
+// mutualFollow returns true if a peer's node is operated by a followed user who follows the user back, which the peer
+// shows by supporting feed push and accepting the exchange.
+func mutualFollow(i Identity) bool {
+	return i.Trusted && i.Supports(FeatureFeedPush)
+}
+
+// SetFeedPushStreamHandler pushes the posts each side is missing when the node connects to the node of a mutual follow,
+// so feeds propagate even when pubsub and IPNS don't.
+func SetFeedPushStreamHandler(ipfscore ipfs.IPFSCore, source FeedSource) {
+	feedSource = source
+	ipfscore.Node.PeerHost.SetStreamHandler(FeedPushProtocol, func(s network.Stream) {
+		defer s.Close()
+		pid := s.Conn().RemotePeer()
+		if i, ok := GetPeerIdentity(pid); !ok || !mutualFollow(i) {
+			log.Debugf("refusing feed push from %v which is not operated by a followed user", pid)
+			s.Reset()
+			return
+		}
+		markFeedPush(pid)
+		if err := exchangeFeeds(ipfscore.Ctx, s, source); err != nil {
+			log.Errorf("error exchanging feeds with %v: %v", pid, err)
+		}
+	})
+	onIdentityExchanged(func(pid peer.ID, i Identity) {
+		if !mutualFollow(i) || !markFeedPush(pid) {
+			return
+		}
+		// The peer resets the stream if its user doesn't follow the user back.
+		if err := PushFeeds(ipfscore.Ctx, ipfscore, pid); err != nil {
+			log.Debugf("could not exchange feeds with %v: %v", pid, err)
+		}
+	})
+}
+
+// markFeedPush records an exchange with a peer and returns false if there was one within FeedPushCooldown.
+func markFeedPush(pid peer.ID) bool {
+	feedPushLock.Lock()
+	defer feedPushLock.Unlock()
+	if t, ok := feedPushes[pid]; ok && time.Since(t) < FeedPushCooldown {
+		return false
+	}
+	feedPushes[pid] = time.Now()
+	return true
+}
+
+// PushFeeds exchanges feed heads with the node of a mutual follow and pushes the posts each side is missing.
+func PushFeeds(ctx context.Context, ipfscore ipfs.IPFSCore, pid peer.ID) error {
+	if feedSource == nil {
+		return fmt.Errorf("feed push is not enabled")
+	}
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+	s, err := ipfscore.Node.PeerHost.NewStream(ctx, pid, FeedPushProtocol)
+	if err != nil {
+		return fmt.Errorf("could not open %s stream to peer %v: %v", FeedPushProtocol, pid, err)
+	}
+	defer s.Close()
+	return exchangeFeeds(ctx, s, feedSource)
+}
+
+// missingFeeds returns the posts of the feeds a peer has older heads of than the node, up to MaxPushedFeedBlocks.
+func missingFeeds(ctx context.Context, source FeedSource, local map[string]FeedHead, remote map[string]FeedHead) []PushedFeed {
+	feeds := []PushedFeed{}
+	n := 0
+	for pubkey, rh := range remote {
+		lh, ok := local[pubkey]
+		if !ok || lh.Head == "" || lh.Head == rh.Head || lh.Posted <= rh.Posted {
+			continue
+		}
+		if n >= MaxPushedFeedBlocks {
+			break
+		}
+		blocks := source.FeedPosts(ctx, lh.Head, rh.Head, MaxPushedFeedBlocks-n)
+		if len(blocks) == 0 {
+			continue
+		}
+		feeds = append(feeds, PushedFeed{PubKey: pubkey, Head: lh.Head, Blocks: blocks})
+		n += len(blocks)
+	}
+	return feeds
+}
+
+func exchangeFeeds(ctx context.Context, s network.Stream, source FeedSource) error {
+	pid := s.Conn().RemotePeer()
+	rw := bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))
+	local := source.FeedHeads(ctx)
+	if err := writeMessage(rw, feedHeadsMessage{Heads: local}); err != nil {
+		return err
+	}
+	hm := feedHeadsMessage{}
+	if err := readMessage(rw, &hm); err != nil {
+		return err
+	}
+	pm := feedPushMessage{Feeds: missingFeeds(ctx, source, local, hm.Heads)}
+	if err := writeMessage(rw, pm); err != nil {
+		return err
+	}
+	rm := feedPushMessage{}
+	if err := readMessage(rw, &rm); err != nil {
+		return err
+	}
+	received := 0
+	for _, f := range rm.Feeds {
+		if _, ok := local[f.PubKey]; !ok {
+			log.Warnf("peer %v pushed feed of %s which is not followed", pid, f.PubKey)
+			continue
+		}
+		n, err := source.ReceiveFeed(ctx, pid, f)
+		if err != nil {
+			log.Warnf("could not store feed of %s pushed by peer %v: %v", f.PubKey, pid, err)
+		}
+		received += n
+	}
+	log.Infof("pushed %v feeds to peer %v and received %v posts", len(pm.Feeds), pid, received)
+	return nil
+}
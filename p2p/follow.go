@@ -0,0 +1,123 @@
+package p2p
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip04"
+
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/util"
+)
+
+const (
+	// KindFollowRequest is the kind of the Nostr event a user sends to ask to follow a protected account.
+	KindFollowRequest = 30081
+	// KindFollowKey is the kind of the Nostr event a protected account sends to an approved follower with the keys of
+	// its non-public posts.
+	KindFollowKey = 30082
+)
+
+// Followers records the follow requests sent to the user's protected account and the post keys of the protected
+// accounts the user follows. It is implemented by the node package.
+type Followers interface {
+	// ReceiveFollowRequest records a follow request from the user of a DID with a Nostr public key.
+	ReceiveFollowRequest(did string, nostrPubKey string, evt nostr.Event) error
+	// ReceiveFollowKey records the post keys sent by the protected account of a DID with a Nostr public key.
+	ReceiveFollowKey(did string, nostrPubKey string, evt nostr.Event) error
+}
+
+var followers Followers
+
+// newFollowEvent signs an event of a follow kind with content encrypted to a Nostr public key with NIP-04.
+func newFollowEvent(privkey string, kind int, pubkey string, content string) (nostr.Event, error) {
+	secret, err := nip04.ComputeSharedSecret(pubkey, privkey)
+	if err != nil {
+		return nostr.Event{}, err
+	}
+	enc, err := nip04.Encrypt(content, secret)
+	if err != nil {
+		return nostr.Event{}, err
+	}
+	evt := nostr.Event{
+		CreatedAt: nostr.Timestamp(util.Now().Unix()),
+		Kind:      kind,
+		Tags:      nostr.Tags{nostr.Tag{"d", pubkey}, nostr.Tag{"p", pubkey}},
+		Content:   enc,
+	}
+	if err = evt.Sign(privkey); err != nil {
+		log.Errorf("could not sign follow event: %v", err)
+		return nostr.Event{}, err
+	}
+	return evt, nil
+}
+
+// NewFollowRequest signs a request to follow the protected account with a Nostr public key, with a message encrypted to
+// it.
+func NewFollowRequest(privkey string, pubkey string, message string) (nostr.Event, error) {
+	return newFollowEvent(privkey, KindFollowRequest, pubkey, message)
+}
+
+// NewFollowKey signs the keys of the non-public posts of a protected account, keyed by key ID, encrypted to the Nostr
+// public key of an approved follower.
+func NewFollowKey(privkey string, pubkey string, keys map[string][]byte) (nostr.Event, error) {
+	encoded := map[string]string{}
+	for id, k := range keys {
+		encoded[id] = base64.StdEncoding.EncodeToString(k)
+	}
+	data, _ := json.Marshal(encoded)
+	return newFollowEvent(privkey, KindFollowKey, pubkey, string(data))
+}
+
+// OpenFollowEvent checks a follow event of a kind was signed by the sender's Nostr public key for the receiver and
+// decrypts its content with the receiver's private key.
+func OpenFollowEvent(evt nostr.Event, kind int, sender string, privkey string) (string, error) {
+	if evt.Kind != kind || evt.PubKey != sender {
+		return "", fmt.Errorf("event %s is not a follow event of kind %v from %s", evt.ID, kind, sender)
+	}
+	if ok, err := evt.CheckSignature(); err != nil || !ok || evt.GetID() != evt.ID {
+		return "", fmt.Errorf("event %s has an invalid signature", evt.ID)
+	}
+	pubkey, err := nostr.GetPublicKey(privkey)
+	if err != nil {
+		return "", err
+	}
+	if p := evt.Tags.GetFirst([]string{"p", ""}); p == nil || p.Value() != pubkey {
+		return "", fmt.Errorf("event %s is not for this user", evt.ID)
+	}
+	secret, err := nip04.ComputeSharedSecret(sender, privkey)
+	if err != nil {
+		return "", err
+	}
+	return nip04.Decrypt(evt.Content, secret)
+}
+
+// ParseFollowKey returns the post keys in the decrypted content of a follow key event.
+func ParseFollowKey(content string) (map[string][]byte, error) {
+	encoded := map[string]string{}
+	if err := json.Unmarshal([]byte(content), &encoded); err != nil {
+		return nil, fmt.Errorf("invalid follow key: %v", err)
+	}
+	keys := map[string][]byte{}
+	for id, k := range encoded {
+		key, err := base64.StdEncoding.DecodeString(k)
+		if err != nil {
+			return nil, fmt.Errorf("invalid follow key %s: %v", id, err)
+		}
+		keys[id] = key
+	}
+	return keys, nil
+}
+
+// SendFollowRequest sends a follow request from the user of a DID to the node of the user of an ENS name.
+func SendFollowRequest(ctx context.Context, ipfscore ipfs.IPFSCore, apikey string, from string, did string, evt nostr.Event) error {
+	return sendDM(ctx, ipfscore, apikey, did, DM{Did: from, FollowRequest: &evt})
+}
+
+// SendFollowKey sends the post keys of the protected account of a DID to the node of an approved follower.
+func SendFollowKey(ctx context.Context, ipfscore ipfs.IPFSCore, apikey string, from string, did string, evt nostr.Event) error {
+	return sendDM(ctx, ipfscore, apikey, did, DM{Did: from, FollowKey: &evt})
+}
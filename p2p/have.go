@@ -0,0 +1,182 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ipfs/bbloom"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	"github.com/allisterb/patr/ipfs"
+)
+
+const HaveProtocol = protocol.ID("/patr/have/0.1")
+
+const FeatureHave = "have"
+
+const maxHaveEntries = 4096
+
+const maxPushedBlocks = 256
+
+// HaveList is a bounded list of recently-seen post CIDs that is advertised to peers as a bloom filter.
+type HaveList struct {
+	lock sync.Mutex
+	cids []cid.Cid
+	set  map[cid.Cid]struct{}
+}
+
+type haveMessage struct {
+	Bloom []byte
+}
+
+type pushMessage struct {
+	Blocks []PushedBlock
+}
+
+// PushedBlock is a block pushed to a peer.
+type PushedBlock struct {
+	Cid  string
+	Data []byte
+}
+
+var Haves = &HaveList{set: make(map[cid.Cid]struct{})}
+
+func init() {
+	Features = append(Features, FeatureHave)
+}
+
+func (h *HaveList) Add(c cid.Cid) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if _, ok := h.set[c]; ok {
+		return
+	}
+	h.cids = append(h.cids, c)
+	h.set[c] = struct{}{}
+	if len(h.cids) > maxHaveEntries {
+		delete(h.set, h.cids[0])
+		h.cids = h.cids[1:]
+	}
+}
+
+func (h *HaveList) CIDs() []cid.Cid {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return append([]cid.Cid{}, h.cids...)
+}
+
+func (h *HaveList) Bloom() *bbloom.Bloom {
+	cids := h.CIDs()
+	b, _ := bbloom.New(float64(len(cids)+1), 0.01)
+	for _, c := range cids {
+		b.Add(c.Bytes())
+	}
+	return b
+}
+
+// SetHaveStreamHandler exchanges have bloom filters with every connecting patr peer and pushes the posts they are missing.
+func SetHaveStreamHandler(ipfscore ipfs.IPFSCore) {
+	ipfscore.Node.PeerHost.SetStreamHandler(HaveProtocol, func(s network.Stream) {
+		defer s.Close()
+		if err := exchangeHaves(ipfscore.Ctx, ipfscore, s); err != nil {
+			log.Errorf("error exchanging haves with %v: %v", s.Conn().RemotePeer(), err)
+		}
+	})
+	onPeerIdentified(ipfscore, HaveProtocol, func(pid peer.ID) {
+		if err := SyncHaves(ipfscore.Ctx, ipfscore, pid); err != nil {
+			log.Errorf("error exchanging haves with %v: %v", pid, err)
+		}
+	})
+}
+
+func SyncHaves(ctx context.Context, ipfscore ipfs.IPFSCore, pid peer.ID) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+	s, err := ipfscore.Node.PeerHost.NewStream(ctx, pid, HaveProtocol)
+	if err != nil {
+		return fmt.Errorf("could not open %s stream to peer %v: %v", HaveProtocol, pid, err)
+	}
+	defer s.Close()
+	return exchangeHaves(ctx, ipfscore, s)
+}
+
+func exchangeHaves(ctx context.Context, ipfscore ipfs.IPFSCore, s network.Stream) error {
+	pid := s.Conn().RemotePeer()
+	rw := bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))
+	if err := writeMessage(rw, haveMessage{Bloom: Haves.Bloom().JSONMarshal()}); err != nil {
+		return err
+	}
+	hm := haveMessage{}
+	if err := readMessage(rw, &hm); err != nil {
+		return err
+	}
+	remote, err := bbloom.JSONUnmarshal(hm.Bloom)
+	if err != nil {
+		return fmt.Errorf("could not decode bloom filter from peer %v: %v", pid, err)
+	}
+	pm := pushMessage{}
+	for _, c := range Haves.CIDs() {
+		if len(pm.Blocks) >= maxPushedBlocks {
+			break
+		}
+		if remote.Has(c.Bytes()) {
+			continue
+		}
+		data, err := ipfs.GetBlock(ctx, ipfscore, c)
+		if err != nil {
+			continue
+		}
+		pm.Blocks = append(pm.Blocks, PushedBlock{Cid: c.String(), Data: data})
+	}
+	if err = writeMessage(rw, pm); err != nil {
+		return err
+	}
+	rm := pushMessage{}
+	if err = readMessage(rw, &rm); err != nil {
+		return err
+	}
+	tracker := ipfs.NewFetchTracker(pid.String())
+	for _, b := range rm.Blocks {
+		if !tracker.Allow(len(b.Data), 0) {
+			break
+		}
+		c, err := cid.Parse(b.Cid)
+		if err != nil {
+			log.Warnf("peer %v pushed an invalid CID %s", pid, b.Cid)
+			continue
+		}
+		if err = ipfs.PutBlock(ctx, ipfscore, c, b.Data); err != nil {
+			log.Warnf("could not store block %v pushed by peer %v: %v", c, pid, err)
+			continue
+		}
+		Haves.Add(c)
+	}
+	log.Infof("pushed %v blocks to peer %v and received %v blocks", len(pm.Blocks), pid, len(rm.Blocks))
+	return nil
+}
+
+func writeMessage(rw *bufio.ReadWriter, m any) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if _, err = rw.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return rw.Flush()
+}
+
+func readMessage(rw *bufio.ReadWriter, m any) error {
+	str, err := rw.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(str), m)
+}
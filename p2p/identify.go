@@ -0,0 +1,221 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/topics"
+	"github.com/allisterb/patr/util"
+)
+
+const IdentifyProtocol = protocol.ID("/patr/id/0.1")
+
+const (
+	FeatureDM    = "dm"
+	FeatureRelay = "relay"
+)
+
+type Identity struct {
+	UserAgent      string
+	Version        string
+	SchemaVersions []int
+	TopicVersions  []int `json:",omitempty"`
+	Features       []string
+	// Attestation is the signed attestation of the user operating the node.
+	Attestation *nostr.Event `json:",omitempty"`
+	// Did and Trusted are set locally once the attestation of a peer is verified.
+	Did     string `json:"-"`
+	Trusted bool   `json:"-"`
+}
+
+var SchemaVersions = []int{1}
+
+var Features = []string{FeatureDM, FeatureRelay}
+
+var peerIdentities = make(map[peer.ID]Identity)
+var peerIdentitiesLock = sync.RWMutex{}
+
+var identityHandlers = []func(peer.ID, Identity){}
+var identityHandlersLock = sync.RWMutex{}
+
+func LocalIdentity(userAgent string) Identity {
+	if userAgent == "" {
+		userAgent = "patr/" + util.Version
+	}
+	attestationLock.RLock()
+	defer attestationLock.RUnlock()
+	return Identity{
+		UserAgent:      userAgent,
+		Version:        util.Version,
+		SchemaVersions: SchemaVersions,
+		TopicVersions:  topics.Versions,
+		Features:       Features,
+		Attestation:    localAttestation,
+	}
+}
+
+func (i Identity) Supports(feature string) bool {
+	return util.Contains(i.Features, feature)
+}
+
+// CommonSchemaVersion returns the highest schema version supported by both identities.
+func CommonSchemaVersion(a Identity, b Identity) (int, bool) {
+	v := 0
+	for _, x := range a.SchemaVersions {
+		for _, y := range b.SchemaVersions {
+			if x == y && x > v {
+				v = x
+			}
+		}
+	}
+	return v, v > 0
+}
+
+// CommonTopicVersion returns the highest pubsub topic version supported by both identities.
+func CommonTopicVersion(a Identity, b Identity) (int, bool) {
+	return topics.Negotiate(a.TopicVersions, b.TopicVersions)
+}
+
+// TopicVersionsInUse returns the current topic version and the versions negotiated with the identified peers, so
+// announcements reach peers which don't support the current version yet.
+func TopicVersionsInUse() []int {
+	peerIdentitiesLock.RLock()
+	defer peerIdentitiesLock.RUnlock()
+	inUse := map[int]bool{topics.Current: true}
+	for _, i := range peerIdentities {
+		if v, ok := topics.Negotiate(topics.Versions, i.TopicVersions); ok {
+			inUse[v] = true
+		}
+	}
+	versions := []int{}
+	for _, v := range topics.Versions {
+		if inUse[v] {
+			versions = append(versions, v)
+		}
+	}
+	return versions
+}
+
+// GetPeerIdentity returns the cached patr identity of a peer if it has been exchanged already.
+func GetPeerIdentity(pid peer.ID) (Identity, bool) {
+	peerIdentitiesLock.RLock()
+	defer peerIdentitiesLock.RUnlock()
+	i, ok := peerIdentities[pid]
+	return i, ok
+}
+
+func setPeerIdentity(pid peer.ID, i Identity) {
+	peerIdentitiesLock.Lock()
+	peerIdentities[pid] = i
+	peerIdentitiesLock.Unlock()
+	identityHandlersLock.RLock()
+	defer identityHandlersLock.RUnlock()
+	for _, h := range identityHandlers {
+		go h(pid, i)
+	}
+}
+
+// onIdentityExchanged calls f in a new goroutine whenever the patr identity of a peer is exchanged and its attestation
+// checked.
+func onIdentityExchanged(f func(peer.ID, Identity)) {
+	identityHandlersLock.Lock()
+	defer identityHandlersLock.Unlock()
+	identityHandlers = append(identityHandlers, f)
+}
+
+// SetIdentifyStreamHandler answers /patr/id requests and exchanges identities with every connecting peer that speaks the protocol.
+func SetIdentifyStreamHandler(ipfscore ipfs.IPFSCore, userAgent string) {
+	local := LocalIdentity(userAgent)
+	ipfscore.Node.PeerHost.SetStreamHandler(IdentifyProtocol, func(s network.Stream) {
+		defer s.Close()
+		rw := bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))
+		remote, err := exchangeIdentity(rw, local)
+		if err != nil {
+			log.Errorf("error exchanging patr identity with %v: %v", s.Conn().RemotePeer(), err)
+			return
+		}
+		checkAttestation(ipfscore, s.Conn().RemotePeer(), &remote)
+		setPeerIdentity(s.Conn().RemotePeer(), remote)
+		log.Infof("peer %v is running %s with features %v", s.Conn().RemotePeer(), remote.UserAgent, remote.Features)
+	})
+	onPeerIdentified(ipfscore, IdentifyProtocol, func(pid peer.ID) {
+		Identify(ipfscore.Ctx, ipfscore, pid, userAgent)
+	})
+}
+
+// onPeerIdentified calls f in a new goroutine for every peer that completes libp2p identification and supports the given protocol.
+func onPeerIdentified(ipfscore ipfs.IPFSCore, proto protocol.ID, f func(peer.ID)) {
+	sub, err := ipfscore.Node.PeerHost.EventBus().Subscribe(new(event.EvtPeerIdentificationCompleted))
+	if err != nil {
+		log.Errorf("could not subscribe to peer identification events: %v", err)
+		return
+	}
+	go func() {
+		defer sub.Close()
+		for {
+			select {
+			case <-ipfscore.Ctx.Done():
+				return
+			case e, ok := <-sub.Out():
+				if !ok {
+					return
+				}
+				pid := e.(event.EvtPeerIdentificationCompleted).Peer
+				if p, err := ipfscore.Node.PeerHost.Peerstore().FirstSupportedProtocol(pid, proto); err != nil || p == "" {
+					continue
+				}
+				go f(pid)
+			}
+		}
+	}()
+}
+
+// Identify exchanges patr identities with a peer over /patr/id.
+func Identify(ctx context.Context, ipfscore ipfs.IPFSCore, pid peer.ID, userAgent string) (Identity, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	s, err := ipfscore.Node.PeerHost.NewStream(ctx, pid, IdentifyProtocol)
+	if err != nil {
+		return Identity{}, fmt.Errorf("could not open %s stream to peer %v: %v", IdentifyProtocol, pid, err)
+	}
+	defer s.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))
+	remote, err := exchangeIdentity(rw, LocalIdentity(userAgent))
+	if err != nil {
+		return Identity{}, fmt.Errorf("could not exchange patr identity with peer %v: %v", pid, err)
+	}
+	checkAttestation(ipfscore, pid, &remote)
+	setPeerIdentity(pid, remote)
+	log.Infof("peer %v is running %s with features %v", pid, remote.UserAgent, remote.Features)
+	return remote, nil
+}
+
+func exchangeIdentity(rw *bufio.ReadWriter, local Identity) (Identity, error) {
+	b, _ := json.Marshal(local)
+	if _, err := rw.Write(append(b, '\n')); err != nil {
+		return Identity{}, err
+	}
+	if err := rw.Flush(); err != nil {
+		return Identity{}, err
+	}
+	str, err := rw.ReadString('\n')
+	if err != nil {
+		return Identity{}, err
+	}
+	remote := Identity{}
+	if err = json.Unmarshal([]byte(str), &remote); err != nil {
+		return Identity{}, err
+	}
+	return remote, nil
+}
@@ -0,0 +1,112 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	"github.com/allisterb/patr/ipfs"
+)
+
+const IPNSProtocol = protocol.ID("/patr/ipns/0.1")
+
+const FeatureIPNS = "ipns"
+
+// MaxIPNSPeers is the number of connected peers asked for the record of an IPNS name.
+const MaxIPNSPeers = 8
+
+// IPNSPeerTimeout is the time peers have to answer a query for an IPNS record.
+var IPNSPeerTimeout = 3 * time.Second
+
+type ipnsRequest struct {
+	Name string
+}
+
+type ipnsResponse struct {
+	Record []byte `json:",omitempty"`
+}
+
+func init() {
+	Features = append(Features, FeatureIPNS)
+}
+
+// SetIPNSStreamHandler answers queries from peers for the IPNS records the node has validated recently and lets the node
+// ask its peers for records when it resolves a name.
+func SetIPNSStreamHandler(ipfscore ipfs.IPFSCore) {
+	ipfscore.Node.PeerHost.SetStreamHandler(IPNSProtocol, func(s network.Stream) {
+		defer s.Close()
+		s.SetDeadline(time.Now().Add(IPNSPeerTimeout))
+		rw := bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))
+		req := ipnsRequest{}
+		if err := readMessage(rw, &req); err != nil {
+			log.Debugf("could not read IPNS query from %v: %v", s.Conn().RemotePeer(), err)
+			return
+		}
+		resp := ipnsResponse{}
+		if pid, err := ipfs.IPNSNamePeerID(req.Name); err == nil {
+			resp.Record, _ = ipfs.CachedIPNSRecord(pid)
+		}
+		writeMessage(rw, resp)
+	})
+	ipfs.PeerIPNSResolver = func(ctx context.Context, pid peer.ID) [][]byte {
+		return QueryIPNSRecords(ctx, ipfscore, pid)
+	}
+}
+
+// ipnsPeers returns the connected peers which answer IPNS queries.
+func ipnsPeers(ipfscore ipfs.IPFSCore) []peer.ID {
+	peerIdentitiesLock.RLock()
+	defer peerIdentitiesLock.RUnlock()
+	pids := []peer.ID{}
+	for pid, i := range peerIdentities {
+		if len(pids) >= MaxIPNSPeers {
+			break
+		}
+		if i.Supports(FeatureIPNS) && ipfscore.Node.PeerHost.Network().Connectedness(pid) == network.Connected {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// QueryIPNSRecords asks connected peers for the record of an IPNS name and returns the records they sent. The records
+// are not validated.
+func QueryIPNSRecords(ctx context.Context, ipfscore ipfs.IPFSCore, name peer.ID) [][]byte {
+	ctx, cancel := context.WithTimeout(ctx, IPNSPeerTimeout)
+	defer cancel()
+	lock := sync.Mutex{}
+	records := [][]byte{}
+	wg := sync.WaitGroup{}
+	for _, pid := range ipnsPeers(ipfscore) {
+		wg.Add(1)
+		go func(pid peer.ID) {
+			defer wg.Done()
+			s, err := ipfscore.Node.PeerHost.NewStream(ctx, pid, IPNSProtocol)
+			if err != nil {
+				return
+			}
+			defer s.Close()
+			if d, ok := ctx.Deadline(); ok {
+				s.SetDeadline(d)
+			}
+			rw := bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))
+			resp := ipnsResponse{}
+			if err = writeMessage(rw, ipnsRequest{Name: name.String()}); err != nil {
+				return
+			}
+			if err = readMessage(rw, &resp); err != nil || len(resp.Record) == 0 {
+				return
+			}
+			lock.Lock()
+			records = append(records, resp.Record)
+			lock.Unlock()
+		}(pid)
+	}
+	wg.Wait()
+	return records
+}
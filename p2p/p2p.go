@@ -5,25 +5,46 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
 
 	"github.com/ipfs/boxo/coreiface/options"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/nbd-wtf/go-nostr"
 
 	"github.com/allisterb/patr/blockchain"
 	"github.com/allisterb/patr/did"
 	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/util"
 )
 
+// DM is a direct message from the user of a DID. Verification is set instead of Content when the DM confirms the short
+// authentication string of a contact verification, and is the commitment to both users' keys the string is derived from.
+// FollowRequest is set when the DM asks to follow a protected account and FollowKey when it carries the post keys of a
+// protected account to an approved follower.
 type DM struct {
-	Did     string
-	Content string
+	Did           string
+	Content       string
+	Verification  string       `json:",omitempty"`
+	FollowRequest *nostr.Event `json:",omitempty"`
+	FollowKey     *nostr.Event `json:",omitempty"`
+}
+
+// Contacts records the verification of the users who send DMs. It is implemented by the node package.
+type Contacts interface {
+	// Verified returns true if the user of a DID and the node's user have verified each other.
+	Verified(did string) bool
+	// ReceiveVerification records that the user of a DID with the given keys confirmed a verification commitment.
+	ReceiveVerification(did string, nostrPubKey string, ipfsPubKey string, commitment string) error
 }
 
 var log = logging.Logger("patr/p2p")
 
-func SetDMStreamHandler(ipfscore ipfs.IPFSCore, apikey string) {
+var contacts Contacts
+
+func SetDMStreamHandler(ipfscore ipfs.IPFSCore, apikey string, c Contacts, f Followers) {
+	contacts, followers = c, f
 	ipfscore.Node.PeerHost.SetStreamHandler(protocol.ID("patrchat/0.1"), func(s network.Stream) {
 		DMHandler(s, apikey)
 	})
@@ -39,15 +60,16 @@ func DMHandler(_s network.Stream, apiKey string) {
 			return
 		}
 		dm := DM{}
-		json.Unmarshal([]byte(str), &dm)
+		json.Unmarshal([]byte(strings.TrimSuffix(str, "\x00")), &dm)
 		if !did.IsValid(dm.Did) {
-			log.Errorf("The DID %s in the DM is not valid")
+			log.Errorf("The DID %s in the DM is not valid", dm.Did)
 			return
 		}
 		did, _ := did.Parse(dm.Did)
 		n, err := blockchain.ResolveENS(did.ID.ID, apiKey)
 		if err != nil {
 			log.Errorf("could not resolve ENS name %s: %v", did.ID.ID, err)
+			return
 		}
 		pid, err := ipfs.GetIPFSNodeIdentityFromPublicKeyName(n.IPFSPubKey)
 		if err != nil {
@@ -59,15 +81,60 @@ func DMHandler(_s network.Stream, apiKey string) {
 			return
 		}
 		log.Infof("the remote peer ID %v matches the DID peer ID %v for %s", s.Conn().RemotePeer(), pid, did.ID.ID)
-		rw.WriteString("delivered")
-		log.Infof("direct message from %v: %s", did.ID.ID, dm.Content)
+		if dm.Verification != "" {
+			if contacts == nil {
+				return
+			}
+			if err = contacts.ReceiveVerification(dm.Did, n.NostrPubKey, n.IPFSPubKey, dm.Verification); err != nil {
+				log.Warnf("could not record the verification confirmed by %s: %v", dm.Did, err)
+				return
+			}
+		}
+		if dm.FollowRequest != nil || dm.FollowKey != nil {
+			if followers == nil {
+				return
+			}
+			if dm.FollowRequest != nil {
+				err = followers.ReceiveFollowRequest(dm.Did, n.NostrPubKey, *dm.FollowRequest)
+			} else {
+				err = followers.ReceiveFollowKey(dm.Did, n.NostrPubKey, *dm.FollowKey)
+			}
+			if err != nil {
+				log.Warnf("could not record the follow DM from %s: %v", dm.Did, err)
+				return
+			}
+		}
+		rw.WriteString("delivered\x00")
+		rw.Flush()
+		if dm.Verification != "" {
+			log.Infof("%s confirmed your contact verification", did.ID.ID)
+			return
+		}
+		if dm.FollowRequest != nil || dm.FollowKey != nil {
+			return
+		}
+		status := "unverified"
+		if contacts != nil && contacts.Verified(dm.Did) {
+			status = "verified"
+		}
+		log.Infof("direct message from %v (%s): %s", did.ID.ID, status, util.Sensitive(dm.Content))
 	}(_s, _rw)
 }
 
-func SendDM(ctx context.Context, ipfscore ipfs.IPFSCore, apikey string, did string, text string) error {
+// SendDM sends a direct message from the user of a DID to the node of the user of an ENS name.
+func SendDM(ctx context.Context, ipfscore ipfs.IPFSCore, apikey string, from string, did string, text string) error {
+	return sendDM(ctx, ipfscore, apikey, did, DM{Did: from, Content: text})
+}
+
+// SendVerification sends the confirmation of a contact verification commitment to the node of the user of an ENS name.
+func SendVerification(ctx context.Context, ipfscore ipfs.IPFSCore, apikey string, from string, did string, commitment string) error {
+	return sendDM(ctx, ipfscore, apikey, did, DM{Did: from, Verification: commitment})
+}
+
+func sendDM(ctx context.Context, ipfscore ipfs.IPFSCore, apikey string, did string, dm DM) error {
 	n, err := blockchain.ResolveENS(did, apikey)
 	if err != nil {
-		return fmt.Errorf("could not resolve ENS name %s: %v", did)
+		return fmt.Errorf("could not resolve ENS name %s: %v", did, err)
 	}
 	log.Infof("sending DM to DID %s...", did)
 	pid, err := ipfs.GetIPFSNodeIdentityFromPublicKeyName(n.IPFSPubKey)
@@ -75,7 +142,9 @@ func SendDM(ctx context.Context, ipfscore ipfs.IPFSCore, apikey string, did stri
 		return fmt.Errorf("could not get IPFS node identity from string %s: %v", n.IPFSPubKey, err)
 	}
 	log.Infof("IPFS node identity for %s is %v", did, pid)
-	addr, err := ipfscore.Node.DHTClient.FindPeer(ctx, pid)
+	fctx, fcancel := util.WithTimeout(ctx, ipfs.DHTQueryTimeout)
+	addr, err := ipfscore.Node.DHTClient.FindPeer(fctx, pid)
+	fcancel()
 	if err != nil {
 		peers, _ := ipfscore.Api.PubSub().Peers(ctx, options.PubSub.Topic("patr"))
 		var found bool = false
@@ -92,25 +161,29 @@ func SendDM(ctx context.Context, ipfscore ipfs.IPFSCore, apikey string, did stri
 	} else {
 		log.Infof("the node %v for DID %s is online at address %v", pid, did, addr)
 	}
+	if id, err := Identify(ctx, ipfscore, pid, ""); err != nil {
+		log.Warnf("could not identify patr node %v for DID %s: %v", pid, did, err)
+	} else if !id.Supports(FeatureDM) {
+		return fmt.Errorf("the node %v for DID %s does not support DMs", pid, did)
+	} else if id.Did != "" && id.Did != did {
+		log.Warnf("the node %v for DID %s is attested by a different DID %s", pid, did, id.Did)
+	}
 	s, err := ipfscore.Node.PeerHost.NewStream(ctx, pid, protocol.ID("patrchat/0.1"))
 	if err != nil {
-		return fmt.Errorf("could not open new stream to peer", pid)
+		return fmt.Errorf("could not open new stream to peer %v: %v", pid, err)
 	}
+	defer s.Close()
 	rw := bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))
-	dm := DM{
-		Did:     did,
-		Content: text,
-	}
 	bdm, _ := json.Marshal(dm)
-	_, err = rw.Write(bdm)
-	if err != nil {
+	rw.Write(append(bdm, 0))
+	if err = rw.Flush(); err != nil {
 		return fmt.Errorf("could not write DM to stream to peer %v: %v", pid, err)
 	}
 	resp, err := rw.ReadString(byte(0))
 	if err != nil {
 		return fmt.Errorf("could not response to DM from stream to peer %v: %v", pid, err)
 	}
-	if resp == "delivered" {
+	if strings.TrimSuffix(resp, "\x00") == "delivered" {
 		log.Infof("delivered DM to DID %s", did)
 		return nil
 	} else {
@@ -0,0 +1,534 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	mrand "math/rand"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	gonostr "github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/blockchain"
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/util"
+)
+
+// PinProtocol negotiates paid pinning with a peer which offers it. The client asks for a quote to pin a set of DAGs of a
+// total size for a number of months, accepts it with a proof of payment, and then audits the provider by asking it for
+// the root blocks of the pinned DAGs.
+const PinProtocol = protocol.ID("/patr/pin/0.1")
+
+const FeaturePin = "pin"
+
+// QuoteValidFor is how long a pin quote can be accepted for.
+const QuoteValidFor = time.Hour
+
+const gib = 1 << 30
+
+const (
+	PinRoleClient   = "client"
+	PinRoleProvider = "provider"
+)
+
+// PinOffer is the price the node charges to pin the content of other users, per GiB per month.
+type PinOffer struct {
+	PriceMsatPerGiBMonth int64
+	PriceWeiPerGiBMonth  string
+	MaxGiB               float64
+}
+
+// PinPayee is how the node is paid for pinning, with zaps to its Nostr public key or Ethereum payments.
+type PinPayee struct {
+	NostrPubKey     string
+	ZapperPubKeys   []string
+	PaymentAddress  string
+	InfuraSecretKey string
+}
+
+// PinQuote is the price a provider asks to pin DAGs for a number of months. A zap paying a quote must have the quote ID
+// as the content of its zap request.
+type PinQuote struct {
+	ID             string
+	Provider       string
+	Cids           []string
+	Bytes          int64
+	Months         int
+	PriceMsat      int64
+	PriceWei       string
+	NostrPubKey    string
+	PaymentAddress string
+	Expires        time.Time
+}
+
+// PinAgreement is a pin quote accepted with a payment, kept by both the client and the provider with the results of
+// the audits of the provider. Clients also keep the quotes they haven't accepted yet.
+type PinAgreement struct {
+	Quote          PinQuote
+	Role           string
+	Peer           string
+	Payment        string
+	Accepted       time.Time
+	Until          time.Time
+	Audits         int
+	FailedAudits   int
+	LastAudit      time.Time
+	LastAuditError string
+}
+
+type pinRequest struct {
+	Op         string
+	Cids       []string       `json:",omitempty"`
+	Bytes      int64          `json:",omitempty"`
+	Months     int            `json:",omitempty"`
+	QuoteID    string         `json:",omitempty"`
+	TxHash     string         `json:",omitempty"`
+	ZapReceipt *gonostr.Event `json:",omitempty"`
+	Cid        string         `json:",omitempty"`
+}
+
+type pinResponse struct {
+	Error string    `json:",omitempty"`
+	Quote *PinQuote `json:",omitempty"`
+	Data  []byte    `json:",omitempty"`
+}
+
+var pinLock = sync.Mutex{}
+var pendingQuotes = make(map[string]PinQuote)
+
+func pinsFile() string {
+	return filepath.Join(util.AppData, "pins.json")
+}
+
+func readPins() ([]PinAgreement, error) {
+	pins := []PinAgreement{}
+	if !util.PathExists(pinsFile()) {
+		return pins, nil
+	}
+	data, err := util.ReadDataFile(pinsFile())
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &pins); err != nil {
+		log.Errorf("could not read JSON data from pins file %s: %v", pinsFile(), err)
+		return nil, err
+	}
+	return pins, nil
+}
+
+func writePins(pins []PinAgreement) error {
+	data, _ := json.MarshalIndent(pins, "", " ")
+	return util.WriteDataFile(pinsFile(), data)
+}
+
+// PinAgreements returns the pin agreements the node is a client or provider in.
+func PinAgreements() ([]PinAgreement, error) {
+	pinLock.Lock()
+	defer pinLock.Unlock()
+	return readPins()
+}
+
+// price returns the price of pinning a size for a number of months at a rate per GiB per month, rounded up.
+func price(rate *big.Int, bytes int64, months int) *big.Int {
+	p := new(big.Int).Mul(rate, big.NewInt(bytes*int64(months)))
+	return p.Add(p, big.NewInt(gib-1)).Div(p, big.NewInt(gib))
+}
+
+func (o PinOffer) quote(provider peer.ID, payee PinPayee, r pinRequest) (PinQuote, error) {
+	if len(r.Cids) == 0 || r.Bytes <= 0 || r.Months <= 0 {
+		return PinQuote{}, fmt.Errorf("a pin request must have CIDs, a size and a number of months")
+	}
+	if o.MaxGiB > 0 && float64(r.Bytes)/gib > o.MaxGiB {
+		return PinQuote{}, fmt.Errorf("this node pins at most %v GiB", o.MaxGiB)
+	}
+	for _, c := range r.Cids {
+		if _, err := cid.Parse(c); err != nil {
+			return PinQuote{}, fmt.Errorf("invalid CID %s", c)
+		}
+	}
+	wei, ok := new(big.Int).SetString(o.PriceWeiPerGiBMonth, 10)
+	if !ok {
+		wei = big.NewInt(0)
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	q := PinQuote{
+		ID:        hex.EncodeToString(id),
+		Provider:  provider.String(),
+		Cids:      r.Cids,
+		Bytes:     r.Bytes,
+		Months:    r.Months,
+		PriceMsat: price(big.NewInt(o.PriceMsatPerGiBMonth), r.Bytes, r.Months).Int64(),
+		PriceWei:  price(wei, r.Bytes, r.Months).String(),
+		Expires:   util.Now().Add(QuoteValidFor),
+	}
+	if o.PriceMsatPerGiBMonth > 0 {
+		q.NostrPubKey = payee.NostrPubKey
+	}
+	if wei.Sign() > 0 {
+		q.PaymentAddress = payee.PaymentAddress
+	}
+	return q, nil
+}
+
+// verifyPinZap checks a NIP-57 zap receipt from a trusted zapper paying the provider at least the price of a quote, with
+// the quote ID as the zap request content.
+func verifyPinZap(receipt *gonostr.Event, q PinQuote, payee PinPayee) error {
+	if receipt.Kind != 9735 || !validEvent(receipt) {
+		return fmt.Errorf("invalid zap receipt")
+	}
+	if !util.Contains(payee.ZapperPubKeys, receipt.PubKey) {
+		return fmt.Errorf("zap receipt is not from a trusted zapper")
+	}
+	if p := receipt.Tags.GetFirst([]string{"p", ""}); p == nil || p.Value() != payee.NostrPubKey {
+		return fmt.Errorf("zap receipt is not for this node")
+	}
+	req := gonostr.Event{}
+	if d := receipt.Tags.GetFirst([]string{"description", ""}); d == nil || json.Unmarshal([]byte(d.Value()), &req) != nil || req.Kind != 9734 || !validEvent(&req) {
+		return fmt.Errorf("zap receipt does not have a valid zap request")
+	}
+	if req.Content != q.ID {
+		return fmt.Errorf("zap is not for quote %s", q.ID)
+	}
+	amount := int64(0)
+	if a := req.Tags.GetFirst([]string{"amount", ""}); a != nil {
+		amount, _ = strconv.ParseInt(a.Value(), 10, 64)
+	}
+	if q.PriceMsat <= 0 || amount < q.PriceMsat {
+		return fmt.Errorf("zap of %v msat is less than the price of %v msat", amount, q.PriceMsat)
+	}
+	return nil
+}
+
+func validEvent(evt *gonostr.Event) bool {
+	ok, err := evt.CheckSignature()
+	return err == nil && ok && evt.GetID() == evt.ID
+}
+
+// accept checks the payment of a quote, records the agreement and pins the DAGs in the background.
+func (o PinOffer) accept(ctx context.Context, ipfscore ipfs.IPFSCore, client peer.ID, payee PinPayee, r pinRequest) error {
+	pinLock.Lock()
+	defer pinLock.Unlock()
+	q, ok := pendingQuotes[r.QuoteID]
+	if !ok || q.Expires.Before(util.Now()) {
+		return fmt.Errorf("unknown or expired quote %s", r.QuoteID)
+	}
+	payment := ""
+	switch {
+	case r.ZapReceipt != nil:
+		if err := verifyPinZap(r.ZapReceipt, q, payee); err != nil {
+			return err
+		}
+		payment = r.ZapReceipt.ID
+	case r.TxHash != "":
+		wei, _ := new(big.Int).SetString(q.PriceWei, 10)
+		if wei == nil || wei.Sign() <= 0 {
+			return fmt.Errorf("quote %s can't be paid on-chain", q.ID)
+		}
+		if err := blockchain.VerifyPayment(ctx, payee.InfuraSecretKey, r.TxHash, payee.PaymentAddress, wei); err != nil {
+			return err
+		}
+		payment = r.TxHash
+	default:
+		return fmt.Errorf("accepting a quote needs a zap receipt or a transaction hash")
+	}
+	pins, err := readPins()
+	if err != nil {
+		return err
+	}
+	for _, a := range pins {
+		if a.Payment == payment {
+			return fmt.Errorf("payment %s has already been used", payment)
+		}
+	}
+	now := util.Now()
+	pins = append(pins, PinAgreement{Quote: q, Role: PinRoleProvider, Peer: client.String(), Payment: payment, Accepted: now, Until: now.AddDate(0, q.Months, 0)})
+	if err = writePins(pins); err != nil {
+		return err
+	}
+	delete(pendingQuotes, q.ID)
+	go func() {
+		for _, s := range q.Cids {
+			c, _ := cid.Parse(s)
+			if err := ipfs.PinDAG(ipfscore.Ctx, ipfscore, c); err != nil {
+				log.Errorf("could not pin %v for peer %v: %v", c, client, err)
+			}
+		}
+		log.Infof("pinned %v DAGs for peer %v until %v", len(q.Cids), client, now.AddDate(0, q.Months, 0))
+	}()
+	return nil
+}
+
+// auditBlock returns the root block of a DAG the node pins for a client under an active agreement.
+func auditBlock(ctx context.Context, ipfscore ipfs.IPFSCore, client peer.ID, r pinRequest) ([]byte, error) {
+	pins, err := PinAgreements()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range pins {
+		if a.Role == PinRoleProvider && a.Peer == client.String() && a.Until.After(util.Now()) && util.Contains(a.Quote.Cids, r.Cid) {
+			c, err := cid.Parse(r.Cid)
+			if err != nil {
+				return nil, err
+			}
+			return ipfs.GetBlock(ctx, ipfscore, c)
+		}
+	}
+	return nil, fmt.Errorf("no active pin agreement for %s", r.Cid)
+}
+
+// SetPinStreamHandler answers pin quote, accept and audit requests if the node offers pinning, and expires the
+// agreements the node is a provider in.
+func SetPinStreamHandler(ipfscore ipfs.IPFSCore, offer *PinOffer, payee PinPayee) {
+	if offer == nil {
+		return
+	}
+	Features = append(Features, FeaturePin)
+	self := ipfscore.Node.Identity
+	ipfscore.Node.PeerHost.SetStreamHandler(PinProtocol, func(s network.Stream) {
+		defer s.Close()
+		pid := s.Conn().RemotePeer()
+		rw := bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))
+		r := pinRequest{}
+		if err := readMessage(rw, &r); err != nil {
+			log.Errorf("could not read pin request from %v: %v", pid, err)
+			return
+		}
+		resp := pinResponse{}
+		var err error
+		switch r.Op {
+		case "quote":
+			var q PinQuote
+			if q, err = offer.quote(self, payee, r); err == nil {
+				pinLock.Lock()
+				pendingQuotes[q.ID] = q
+				pinLock.Unlock()
+				resp.Quote = &q
+			}
+		case "accept":
+			err = offer.accept(ipfscore.Ctx, ipfscore, pid, payee, r)
+		case "audit":
+			resp.Data, err = auditBlock(ipfscore.Ctx, ipfscore, pid, r)
+		default:
+			err = fmt.Errorf("unknown pin request %s", r.Op)
+		}
+		if err != nil {
+			log.Warnf("pin %s request from %v failed: %v", r.Op, pid, err)
+			resp.Error = err.Error()
+		}
+		if err = writeMessage(rw, resp); err != nil {
+			log.Errorf("could not write pin response to %v: %v", pid, err)
+		}
+	})
+}
+
+func pinExchange(ctx context.Context, ipfscore ipfs.IPFSCore, pid peer.ID, r pinRequest) (pinResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+	s, err := ipfscore.Node.PeerHost.NewStream(ctx, pid, PinProtocol)
+	if err != nil {
+		return pinResponse{}, fmt.Errorf("could not open %s stream to peer %v: %v", PinProtocol, pid, err)
+	}
+	defer s.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))
+	if err = writeMessage(rw, r); err != nil {
+		return pinResponse{}, err
+	}
+	resp := pinResponse{}
+	if err = readMessage(rw, &resp); err != nil {
+		return pinResponse{}, err
+	}
+	if resp.Error != "" {
+		return resp, fmt.Errorf("peer %v: %s", pid, resp.Error)
+	}
+	return resp, nil
+}
+
+// RequestPinQuote asks a provider for the price of pinning DAGs with a total size for a number of months.
+func RequestPinQuote(ctx context.Context, ipfscore ipfs.IPFSCore, pid peer.ID, cids []cid.Cid, bytes int64, months int) (PinQuote, error) {
+	r := pinRequest{Op: "quote", Bytes: bytes, Months: months}
+	for _, c := range cids {
+		r.Cids = append(r.Cids, c.String())
+	}
+	resp, err := pinExchange(ctx, ipfscore, pid, r)
+	if err != nil {
+		return PinQuote{}, err
+	}
+	if resp.Quote == nil || resp.Quote.Provider != pid.String() {
+		return PinQuote{}, fmt.Errorf("peer %v did not send a valid quote", pid)
+	}
+	if util.DryRun {
+		return *resp.Quote, nil
+	}
+	pinLock.Lock()
+	defer pinLock.Unlock()
+	pins, err := readPins()
+	if err != nil {
+		return PinQuote{}, err
+	}
+	pins = append(pins, PinAgreement{Quote: *resp.Quote, Role: PinRoleClient, Peer: resp.Quote.Provider})
+	return *resp.Quote, writePins(pins)
+}
+
+// AcceptPinQuote accepts a quote received from a provider with a zap receipt or the hash of an on-chain payment.
+func AcceptPinQuote(ctx context.Context, ipfscore ipfs.IPFSCore, id string, zapReceipt *gonostr.Event, txhash string) error {
+	pins, err := PinAgreements()
+	if err != nil {
+		return err
+	}
+	var q *PinQuote
+	for _, a := range pins {
+		if a.Role == PinRoleClient && a.Quote.ID == id && a.Accepted.IsZero() {
+			q = &a.Quote
+		}
+	}
+	if q == nil {
+		return fmt.Errorf("unknown quote %s", id)
+	}
+	pid, err := peer.Decode(q.Provider)
+	if err != nil {
+		return fmt.Errorf("invalid provider peer ID %s: %v", q.Provider, err)
+	}
+	if util.DryRun {
+		log.Infof("dry run: would accept pin quote %s from %v", q.ID, pid)
+		return nil
+	}
+	if _, err = pinExchange(ctx, ipfscore, pid, pinRequest{Op: "accept", QuoteID: q.ID, ZapReceipt: zapReceipt, TxHash: txhash}); err != nil {
+		return err
+	}
+	payment := txhash
+	if zapReceipt != nil {
+		payment = zapReceipt.ID
+	}
+	now := util.Now()
+	pinLock.Lock()
+	defer pinLock.Unlock()
+	if pins, err = readPins(); err != nil {
+		return err
+	}
+	for i := range pins {
+		if pins[i].Role == PinRoleClient && pins[i].Quote.ID == id {
+			pins[i].Payment, pins[i].Accepted, pins[i].Until = payment, now, now.AddDate(0, q.Months, 0)
+		}
+	}
+	return writePins(pins)
+}
+
+// AuditPins asks each provider with an active agreement for the root block of a random DAG it pins for the node and
+// checks the block matches its CID. Failed audits are counted in the agreement.
+func AuditPins(ctx context.Context, ipfscore ipfs.IPFSCore) ([]PinAgreement, error) {
+	pins, err := PinAgreements()
+	if err != nil {
+		return nil, err
+	}
+	results := make(map[string]PinAgreement)
+	for _, a := range pins {
+		if a.Role != PinRoleClient || a.Accepted.IsZero() || a.Until.Before(util.Now()) || len(a.Quote.Cids) == 0 {
+			continue
+		}
+		c, _ := cid.Parse(a.Quote.Cids[mrand.Intn(len(a.Quote.Cids))])
+		err := auditPin(ctx, ipfscore, a.Peer, c)
+		a.Audits++
+		a.LastAudit, a.LastAuditError = util.Now(), ""
+		if err != nil {
+			a.FailedAudits++
+			a.LastAuditError = err.Error()
+			log.Warnf("pin provider %s failed audit of %v: %v", a.Peer, c, err)
+		}
+		results[a.Payment] = a
+	}
+	pinLock.Lock()
+	defer pinLock.Unlock()
+	if pins, err = readPins(); err != nil {
+		return nil, err
+	}
+	audited := []PinAgreement{}
+	for i := range pins {
+		if a, ok := results[pins[i].Payment]; ok && pins[i].Role == PinRoleClient {
+			pins[i] = a
+			audited = append(audited, a)
+		}
+	}
+	return audited, writePins(pins)
+}
+
+func auditPin(ctx context.Context, ipfscore ipfs.IPFSCore, provider string, c cid.Cid) error {
+	pid, err := peer.Decode(provider)
+	if err != nil {
+		return err
+	}
+	resp, err := pinExchange(ctx, ipfscore, pid, pinRequest{Op: "audit", Cid: c.String()})
+	if err != nil {
+		return err
+	}
+	vc, err := c.Prefix().Sum(resp.Data)
+	if err != nil || !vc.Equals(c) {
+		return fmt.Errorf("block sent for %v does not match its CID", c)
+	}
+	return nil
+}
+
+// ExpirePins unpins the DAGs of agreements the node is a provider in which have ended.
+func ExpirePins(ctx context.Context, ipfscore ipfs.IPFSCore) error {
+	pinLock.Lock()
+	defer pinLock.Unlock()
+	pins, err := readPins()
+	if err != nil {
+		return err
+	}
+	active := []PinAgreement{}
+	for _, a := range pins {
+		if a.Role == PinRoleProvider && a.Until.Before(util.Now()) {
+			for _, s := range a.Quote.Cids {
+				if c, err := cid.Parse(s); err == nil {
+					ipfs.UnpinDAG(ctx, ipfscore, c)
+				}
+			}
+			log.Infof("pin agreement with %s for %v DAGs ended", a.Peer, len(a.Quote.Cids))
+			continue
+		}
+		active = append(active, a)
+	}
+	if len(active) == len(pins) {
+		return nil
+	}
+	return writePins(active)
+}
+
+// SchedulePinAudits audits pin providers and expires ended agreements periodically until the context is cancelled.
+func SchedulePinAudits(ctx context.Context, ipfscore ipfs.IPFSCore, interval time.Duration) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				if _, err := AuditPins(ctx, ipfscore); err != nil {
+					log.Errorf("could not audit pin providers: %v", err)
+				}
+				if err := ExpirePins(ctx, ipfscore); err != nil {
+					log.Errorf("could not expire pin agreements: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// GiB converts a size in GiB to bytes.
+func GiB(size float64) int64 {
+	return int64(math.Ceil(size * gib))
+}
@@ -0,0 +1,186 @@
+// Package topics derives the names of the pubsub topics patr nodes announce feeds and events on. It has no dependencies
+// outside the standard library so other clients can use it to compute the same topics.
+//
+// Topic names are versioned. Version 0 is the original scheme:
+//
+//	global   patr
+//	hashtag  patr/tag/<normalized hashtag>
+//
+// Version 0 has no DID or key topics. Version 1 topics are
+//
+//	global   /patr/1/announce
+//	feed     /patr/1/feed/<id>  where id is derived from a DID
+//	key      /patr/1/key/<id>   where id is derived from a Nostr public key
+//	hashtag  /patr/1/tag/<id>   where id is derived from a hashtag
+//
+// and id is the SHA-256 hash of "/patr/1/<kind>:<normalized input>" encoded as lower case RFC 4648 base32 without
+// padding. DIDs are normalized by trimming spaces and converting them to lower case, Nostr public keys are 32 bytes of
+// hex in lower case, and hashtags are trimmed of spaces and a leading # and converted to lower case with the Unicode
+// default case mapping. The Vectors are the expected topics of some inputs.
+//
+// Nodes advertise the topic versions they support and use the highest version they have in common with a peer, so the
+// scheme can change without splitting the network. Peers which advertise no versions only support version 0.
+package topics
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Topic versions.
+const (
+	Legacy  = 0
+	Current = 1
+)
+
+// Versions are the topic versions this package derives, from oldest to newest.
+var Versions = []int{Legacy, Current}
+
+// Kinds of topics.
+const (
+	KindGlobal  = "global"
+	KindFeed    = "feed"
+	KindKey     = "key"
+	KindHashtag = "tag"
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NormalizeHashtag returns a hashtag in lower case without the leading #.
+func NormalizeHashtag(tag string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(tag), "#"))
+}
+
+func normalize(kind string, input string) (string, error) {
+	switch kind {
+	case KindFeed:
+		did := strings.ToLower(strings.TrimSpace(input))
+		if !strings.HasPrefix(did, "did:") {
+			return "", fmt.Errorf("%s is not a DID", input)
+		}
+		return did, nil
+	case KindKey:
+		key := strings.ToLower(strings.TrimSpace(input))
+		if b, err := hex.DecodeString(key); err != nil || len(b) != 32 {
+			return "", fmt.Errorf("%s is not a hex Nostr public key", input)
+		}
+		return key, nil
+	case KindHashtag:
+		tag := NormalizeHashtag(input)
+		if tag == "" {
+			return "", fmt.Errorf("empty hashtag")
+		}
+		return tag, nil
+	default:
+		return "", fmt.Errorf("unknown topic kind %s", kind)
+	}
+}
+
+// Derive returns the topic of a kind for an input in a topic version. The input of the global topic is ignored.
+func Derive(kind string, input string, version int) (string, error) {
+	switch version {
+	case Legacy:
+		switch kind {
+		case KindGlobal:
+			return "patr", nil
+		case KindHashtag:
+			tag, err := normalize(kind, input)
+			if err != nil {
+				return "", err
+			}
+			return "patr/tag/" + tag, nil
+		default:
+			return "", fmt.Errorf("topic version %v has no %s topics", version, kind)
+		}
+	case Current:
+		prefix := fmt.Sprintf("/patr/%v/", version)
+		if kind == KindGlobal {
+			return prefix + "announce", nil
+		}
+		n, err := normalize(kind, input)
+		if err != nil {
+			return "", err
+		}
+		h := sha256.Sum256([]byte(prefix + kind + ":" + n))
+		return prefix + kind + "/" + strings.ToLower(encoding.EncodeToString(h[:])), nil
+	default:
+		return "", fmt.Errorf("unknown topic version %v", version)
+	}
+}
+
+// Global returns the topic all nodes announce feed updates on.
+func Global(version int) string {
+	t, _ := Derive(KindGlobal, "", version)
+	return t
+}
+
+// Feed returns the topic the feed of a DID is announced on.
+func Feed(did string, version int) (string, error) {
+	return Derive(KindFeed, did, version)
+}
+
+// Key returns the topic of a Nostr public key.
+func Key(pubkey string, version int) (string, error) {
+	return Derive(KindKey, pubkey, version)
+}
+
+// Hashtag returns the topic events with a hashtag are announced on.
+func Hashtag(tag string, version int) (string, error) {
+	return Derive(KindHashtag, tag, version)
+}
+
+// Negotiate returns the highest topic version in both lists. An empty list means only the legacy version is supported.
+func Negotiate(local []int, remote []int) (int, bool) {
+	if len(local) == 0 {
+		local = []int{Legacy}
+	}
+	if len(remote) == 0 {
+		remote = []int{Legacy}
+	}
+	v, ok := -1, false
+	for _, x := range local {
+		for _, y := range remote {
+			if x == y && x > v {
+				v, ok = x, true
+			}
+		}
+	}
+	return v, ok
+}
+
+// Vector is the expected topic of an input.
+type Vector struct {
+	Kind    string
+	Input   string
+	Version int
+	Topic   string
+}
+
+// Vectors are test vectors for clients implementing the topic derivation.
+var Vectors = []Vector{
+	{KindGlobal, "", Legacy, "patr"},
+	{KindHashtag, "#Nostr", Legacy, "patr/tag/nostr"},
+	{KindGlobal, "", Current, "/patr/1/announce"},
+	{KindFeed, "did:ens:Alice.eth", Current, "/patr/1/feed/iinx5ktmzk23yshp6qlaqs6tdy4zrgpody6ja6mw5pdji4hryxba"},
+	{KindFeed, "did:ens:alice.eth", Current, "/patr/1/feed/iinx5ktmzk23yshp6qlaqs6tdy4zrgpody6ja6mw5pdji4hryxba"},
+	{KindKey, "3BF0C63FCB93463407AF97A5E5EE64FA883D107EF9E558472C4EB9AAAEFA459D", Current, "/patr/1/key/uykrlb2mdkbgafi4357y3tntxqhvclo2gkh5p3pc3erbyur7u6na"},
+	{KindHashtag, "#Nostr", Current, "/patr/1/tag/jmw5ole2yfnyvzt2o4xdse2vuamoz2rlyyyci7akdskkovfffzba"},
+	{KindHashtag, "Ελλάδα", Current, "/patr/1/tag/krmvnuofkv22ambecfbiclkqt6sgyoqsmttacubuurlisbtmj32q"},
+}
+
+// Verify derives the topics of the Vectors and returns an error for the first one which doesn't match.
+func Verify() error {
+	for _, v := range Vectors {
+		t, err := Derive(v.Kind, v.Input, v.Version)
+		if err != nil {
+			return fmt.Errorf("could not derive %s topic of %s in version %v: %v", v.Kind, v.Input, v.Version, err)
+		}
+		if t != v.Topic {
+			return fmt.Errorf("%s topic of %s in version %v is %s, expected %s", v.Kind, v.Input, v.Version, t, v.Topic)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package topics
+
+import "testing"
+
+func TestVectors(t *testing.T) {
+	for _, v := range Vectors {
+		topic, err := Derive(v.Kind, v.Input, v.Version)
+		if err != nil {
+			t.Errorf("could not derive %s topic of %q in version %v: %v", v.Kind, v.Input, v.Version, err)
+			continue
+		}
+		if topic != v.Topic {
+			t.Errorf("%s topic of %q in version %v is %s, expected %s", v.Kind, v.Input, v.Version, topic, v.Topic)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	if err := Verify(); err != nil {
+		t.Error(err)
+	}
+}
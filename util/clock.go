@@ -0,0 +1,31 @@
+package util
+
+import (
+	"fmt"
+	"time"
+)
+
+// Clock is a source of time for timestamps.
+type Clock interface {
+	Now() time.Time
+}
+
+// SetClock makes c the time source returned by Now.
+func SetClock(c Clock) {
+	Now = c.Now
+}
+
+// MaxFutureSkew is how far in the future a timestamp can be before it is rejected.
+var MaxFutureSkew = 15 * time.Minute
+
+// NormalizeTimestamp checks a timestamp for a new event or post and returns it in UTC truncated to whole seconds,
+// which is the precision of Nostr timestamps. Timestamps which are unset or too far in the future are rejected.
+func NormalizeTimestamp(t time.Time) (time.Time, error) {
+	if t.IsZero() || t.Unix() <= 0 {
+		return time.Time{}, fmt.Errorf("timestamp is not set")
+	}
+	if t.After(Now().Add(MaxFutureSkew)) {
+		return time.Time{}, fmt.Errorf("timestamp %v is more than %v in the future, check the system clock or the timestamp units", t.UTC(), MaxFutureSkew)
+	}
+	return t.UTC().Truncate(time.Second), nil
+}
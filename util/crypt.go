@@ -0,0 +1,289 @@
+package util
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// DataFiles are the files in the data directory which are encrypted when datastore encryption is enabled.
+var DataFiles = []string{"node.json", "outbox.json", "paidkeys.json", "quarantine.json", "blocklist.json", "sessions.json", "links.json", "pins.json", "heads.json", "media-pins.json", "contacts.json", "relay-index.json", "lock.json", "followers.json", "relay-moderation.json", "relay-terms.json"}
+
+// DataDirs are the directories in the data directory whose files are encrypted when datastore encryption is enabled.
+var DataDirs = []string{"remote-pins"}
+
+const encryptedMagic = "PATRENC1"
+
+// datastoreKey holds the salt of the key derived from the user passphrase and a value encrypted with it which is used
+// to check the passphrase.
+type datastoreKey struct {
+	Salt  []byte
+	Check []byte
+}
+
+var encryptionKey []byte
+var encryptionLock = sync.RWMutex{}
+
+func datastoreKeyFile() string {
+	return filepath.Join(AppData, "datastore.key")
+}
+
+// DatastoreEncrypted returns true if the data files are encrypted with a key derived from the user passphrase.
+func DatastoreEncrypted() bool {
+	return PathExists(datastoreKeyFile())
+}
+
+func deriveKey(passphrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+}
+
+func seal(key []byte, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(append([]byte(encryptedMagic), nonce...), nonce, data, []byte(encryptedMagic)), nil
+}
+
+func open(key []byte, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	data = data[len(encryptedMagic):]
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("encrypted data is truncated")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], []byte(encryptedMagic))
+}
+
+// checkDatastorePassphrase derives the datastore key from the user passphrase and checks it is the right key.
+func checkDatastorePassphrase(passphrase string) ([]byte, error) {
+	data, err := os.ReadFile(datastoreKeyFile())
+	if err != nil {
+		return nil, fmt.Errorf("could not read datastore key file: %v", err)
+	}
+	dk := datastoreKey{}
+	if err = json.Unmarshal(data, &dk); err != nil {
+		return nil, fmt.Errorf("could not read datastore key file: %v", err)
+	}
+	key, err := deriveKey(passphrase, dk.Salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = open(key, dk.Check); err != nil {
+		return nil, fmt.Errorf("the passphrase is incorrect")
+	}
+	return key, nil
+}
+
+// UnlockDatastore derives the datastore key from the user passphrase so encrypted data files can be read and written.
+func UnlockDatastore(passphrase string) error {
+	key, err := checkDatastorePassphrase(passphrase)
+	if err != nil {
+		return err
+	}
+	encryptionLock.Lock()
+	defer encryptionLock.Unlock()
+	encryptionKey = key
+	return nil
+}
+
+// EnableDatastoreEncryption creates a datastore key from a passphrase and encrypts the existing data files with it.
+func EnableDatastoreEncryption(passphrase string) error {
+	if DatastoreEncrypted() {
+		return fmt.Errorf("the datastore is already encrypted")
+	}
+	if passphrase == "" {
+		return fmt.Errorf("a passphrase is required to encrypt the datastore")
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	key, err := deriveKey(passphrase, salt)
+	if err != nil {
+		return err
+	}
+	check, err := seal(key, []byte("patr"))
+	if err != nil {
+		return err
+	}
+	files, err := readDataFiles()
+	if err != nil {
+		return err
+	}
+	data, _ := json.Marshal(datastoreKey{Salt: salt, Check: check})
+	if err = os.WriteFile(datastoreKeyFile(), data, 0600); err != nil {
+		return err
+	}
+	encryptionLock.Lock()
+	encryptionKey = key
+	encryptionLock.Unlock()
+	return writeDataFiles(files, key)
+}
+
+// DisableDatastoreEncryption decrypts the data files and removes the datastore key. The datastore must be unlocked.
+func DisableDatastoreEncryption() error {
+	if !DatastoreEncrypted() {
+		return fmt.Errorf("the datastore is not encrypted")
+	}
+	files, err := readDataFiles()
+	if err != nil {
+		return err
+	}
+	if err = writeDataFiles(files, nil); err != nil {
+		return err
+	}
+	encryptionLock.Lock()
+	encryptionKey = nil
+	encryptionLock.Unlock()
+	return os.Remove(datastoreKeyFile())
+}
+
+func readDataFiles() (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	for _, name := range DataFiles {
+		f := filepath.Join(AppData, name)
+		if !PathExists(f) {
+			continue
+		}
+		data, err := ReadDataFile(f)
+		if err != nil {
+			return nil, err
+		}
+		files[f] = data
+	}
+	for _, name := range DataDirs {
+		entries, err := os.ReadDir(filepath.Join(AppData, name))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.IsDir() || filepath.Ext(e.Name()) == ".tmp" {
+				continue
+			}
+			f := filepath.Join(AppData, name, e.Name())
+			data, err := ReadDataFile(f)
+			if err != nil {
+				return nil, err
+			}
+			files[f] = data
+		}
+	}
+	return files, nil
+}
+
+func writeDataFiles(files map[string][]byte, key []byte) error {
+	for f, data := range files {
+		if err := writeDataFile(f, data, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadDataFile reads a file in the data directory, decrypting it if it is encrypted. Files written before encryption
+// was enabled are read as is.
+func ReadDataFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(data, []byte(encryptedMagic)) {
+		return data, nil
+	}
+	encryptionLock.RLock()
+	key := encryptionKey
+	encryptionLock.RUnlock()
+	if key == nil {
+		return nil, fmt.Errorf("%s is encrypted and the datastore passphrase was not given", path)
+	}
+	plain, err := open(key, data)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt %s: %v", path, err)
+	}
+	return plain, nil
+}
+
+// WriteDataFile writes a file in the data directory, encrypting it if the datastore is encrypted. The file is written
+// to a temporary file and renamed so it is never left half-written.
+func WriteDataFile(path string, data []byte) error {
+	encryptionLock.RLock()
+	key := encryptionKey
+	encryptionLock.RUnlock()
+	if key == nil && DatastoreEncrypted() {
+		return fmt.Errorf("cannot write %s, the datastore is encrypted and the passphrase was not given", path)
+	}
+	return writeDataFile(path, data, key)
+}
+
+func writeDataFile(path string, data []byte, key []byte) error {
+	if key != nil {
+		var err error
+		if data, err = seal(key, data); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// WipeFile overwrites a file with random bytes, syncs it to disk and removes it. Journaling file systems and flash
+// storage may still keep copies of the old contents, which encrypting the data files protects against.
+func WipeFile(path string) error {
+	st, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	noise := make([]byte, st.Size())
+	rand.Read(noise)
+	_, err = f.WriteAt(noise, 0)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("could not overwrite %s: %v", path, err)
+	}
+	return os.Remove(path)
+}
+
+// WipeDatastoreKey wipes the salt of the datastore key and forgets the key, so the encrypted data files can't be
+// decrypted even with the passphrase.
+func WipeDatastoreKey() error {
+	encryptionLock.Lock()
+	encryptionKey = nil
+	encryptionLock.Unlock()
+	return WipeFile(datastoreKeyFile())
+}
@@ -0,0 +1,70 @@
+package util
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Experimental features which ship disabled and are enabled in the Features of the node configuration.
+const (
+	FeatureW3Up        = "experimental.w3up"
+	FeatureActivityPub = "experimental.activitypub"
+	FeatureLightNode   = "experimental.light-node"
+)
+
+// KnownFeatures are the feature flags and what they enable.
+var KnownFeatures = map[string]string{
+	FeatureW3Up:        "upload to Web3.Storage with the w3up protocol",
+	FeatureActivityPub: "federate the feed with ActivityPub servers",
+	FeatureLightNode:   "run without a full IPFS node",
+}
+
+var featureLock = sync.RWMutex{}
+var features = map[string]bool{}
+
+// SetFeatures replaces the enabled feature flags. Unknown flags are returned so they can be reported.
+func SetFeatures(flags map[string]bool) []string {
+	featureLock.Lock()
+	defer featureLock.Unlock()
+	features = map[string]bool{}
+	unknown := []string{}
+	for f, on := range flags {
+		if _, ok := KnownFeatures[f]; !ok {
+			unknown = append(unknown, f)
+			continue
+		}
+		features[f] = on
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// FeatureEnabled returns true if a feature flag is enabled.
+func FeatureEnabled(flag string) bool {
+	featureLock.RLock()
+	defer featureLock.RUnlock()
+	return features[flag]
+}
+
+// RequireFeature returns an error saying how to enable a feature flag if it is disabled.
+func RequireFeature(flag string) error {
+	if FeatureEnabled(flag) {
+		return nil
+	}
+	return fmt.Errorf("%s is experimental and disabled, set \"%s\": true in Features in the node configuration file to enable it", KnownFeatures[flag], flag)
+}
+
+// EnabledFeatures returns the enabled feature flags.
+func EnabledFeatures() []string {
+	featureLock.RLock()
+	defer featureLock.RUnlock()
+	enabled := []string{}
+	for f, on := range features {
+		if on {
+			enabled = append(enabled, f)
+		}
+	}
+	sort.Strings(enabled)
+	return enabled
+}
@@ -0,0 +1,79 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+)
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// EncodeGeohash returns the geohash of a location with precision characters.
+func EncodeGeohash(lat float64, lon float64, precision int) (string, error) {
+	if lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return "", fmt.Errorf("invalid location %v,%v", lat, lon)
+	}
+	if precision <= 0 || precision > 12 {
+		return "", fmt.Errorf("geohash precision must be between 1 and 12")
+	}
+	latRange := [2]float64{-90, 90}
+	lonRange := [2]float64{-180, 180}
+	var sb strings.Builder
+	even := true
+	bit, ch := 0, 0
+	for sb.Len() < precision {
+		r, v := &latRange, lat
+		if even {
+			r, v = &lonRange, lon
+		}
+		mid := (r[0] + r[1]) / 2
+		ch <<= 1
+		if v >= mid {
+			ch |= 1
+			r[0] = mid
+		} else {
+			r[1] = mid
+		}
+		even = !even
+		if bit++; bit == 5 {
+			sb.WriteByte(geohashAlphabet[ch])
+			bit, ch = 0, 0
+		}
+	}
+	return sb.String(), nil
+}
+
+// GeohashBounds returns the south-west and north-east corners of the area of a geohash.
+func GeohashBounds(hash string) (minLat, minLon, maxLat, maxLon float64, err error) {
+	latRange := [2]float64{-90, 90}
+	lonRange := [2]float64{-180, 180}
+	even := true
+	for _, c := range strings.ToLower(hash) {
+		i := strings.IndexRune(geohashAlphabet, c)
+		if i < 0 {
+			return 0, 0, 0, 0, fmt.Errorf("invalid geohash %s", hash)
+		}
+		for b := 4; b >= 0; b-- {
+			r := &latRange
+			if even {
+				r = &lonRange
+			}
+			mid := (r[0] + r[1]) / 2
+			if i&(1<<b) != 0 {
+				r[0] = mid
+			} else {
+				r[1] = mid
+			}
+			even = !even
+		}
+	}
+	return latRange[0], lonRange[0], latRange[1], lonRange[1], nil
+}
+
+// DecodeGeohash returns the center of the area of a geohash.
+func DecodeGeohash(hash string) (float64, float64, error) {
+	minLat, minLon, maxLat, maxLon, err := GeohashBounds(hash)
+	if err != nil {
+		return 0, 0, err
+	}
+	return (minLat + maxLat) / 2, (minLon + maxLon) / 2, nil
+}
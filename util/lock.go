@@ -0,0 +1,170 @@
+package util
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+// The publishing lock requires the user to re-authenticate with a passphrase before anything can be published as them,
+// so anyone with a shell on the machine can't post as the user. It is engaged manually or once nothing was published
+// for LockIdle. The lock state is kept in a data file so it holds for every patr process and is encrypted with the
+// other data files.
+
+// LockIdle is how long publishing stays unlocked without any publishing. Zero disables the idle lock.
+var LockIdle time.Duration
+
+// LockPassphraseHash is the hash of the lock passphrase created by HashLockPassphrase. If it is empty the datastore
+// passphrase unlocks publishing.
+var LockPassphraseHash string
+
+// LockStatus is the state of the publishing lock.
+type LockStatus struct {
+	Locked       bool      `json:"locked"`
+	LastActivity time.Time `json:"lastActivity,omitempty"`
+}
+
+var lockLog = logging.Logger("patr/lock")
+var publishLock = sync.Mutex{}
+
+func lockFile() string {
+	return filepath.Join(AppData, "lock.json")
+}
+
+// lockConfigured returns true if the publishing lock is configured, in which case publishing starts locked.
+func lockConfigured() bool {
+	return LockPassphraseHash != "" || LockIdle > 0
+}
+
+func readLockStatus() (LockStatus, error) {
+	s := LockStatus{}
+	data, err := ReadDataFile(lockFile())
+	if os.IsNotExist(err) {
+		s.Locked = lockConfigured()
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+	if err = json.Unmarshal(data, &s); err != nil {
+		return s, fmt.Errorf("could not read lock file: %v", err)
+	}
+	if !s.Locked && LockIdle > 0 && Now().Sub(s.LastActivity) > LockIdle {
+		s.Locked = true
+	}
+	return s, nil
+}
+
+func writeLockStatus(s LockStatus) error {
+	data, _ := json.Marshal(s)
+	return WriteDataFile(lockFile(), data)
+}
+
+// HashLockPassphrase returns the hash of a lock passphrase to store in the node configuration.
+func HashLockPassphrase(passphrase string) (string, error) {
+	if passphrase == "" {
+		return "", fmt.Errorf("the lock passphrase cannot be empty")
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := deriveKey(passphrase, salt)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(salt) + ":" + base64.StdEncoding.EncodeToString(key), nil
+}
+
+// checkLockPassphrase checks a passphrase against the lock passphrase or, if there is none, the datastore passphrase.
+func checkLockPassphrase(passphrase string) error {
+	if LockPassphraseHash == "" {
+		if !DatastoreEncrypted() {
+			return fmt.Errorf("no lock passphrase is set and the datastore is not encrypted")
+		}
+		_, err := checkDatastorePassphrase(passphrase)
+		return err
+	}
+	s, h, _ := strings.Cut(LockPassphraseHash, ":")
+	salt, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("invalid lock passphrase hash: %v", err)
+	}
+	hash, err := base64.StdEncoding.DecodeString(h)
+	if err != nil {
+		return fmt.Errorf("invalid lock passphrase hash: %v", err)
+	}
+	key, err := deriveKey(passphrase, salt)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(key, hash) != 1 {
+		return fmt.Errorf("the passphrase is incorrect")
+	}
+	return nil
+}
+
+// PublishLockStatus returns the state of the publishing lock.
+func PublishLockStatus() (LockStatus, error) {
+	publishLock.Lock()
+	defer publishLock.Unlock()
+	return readLockStatus()
+}
+
+// LockPublishing engages the publishing lock. A lock passphrase must be set or the datastore must be encrypted so
+// publishing can be unlocked again.
+func LockPublishing() error {
+	if LockPassphraseHash == "" && !DatastoreEncrypted() {
+		return fmt.Errorf("set a lock passphrase or encrypt the datastore before locking publishing")
+	}
+	publishLock.Lock()
+	defer publishLock.Unlock()
+	s, err := readLockStatus()
+	if err != nil {
+		return err
+	}
+	s.Locked = true
+	lockLog.Info("publishing locked")
+	return writeLockStatus(s)
+}
+
+// UnlockPublishing releases the publishing lock if the passphrase is the lock passphrase or, if there is none, the
+// datastore passphrase.
+func UnlockPublishing(passphrase string) error {
+	if err := checkLockPassphrase(passphrase); err != nil {
+		lockLog.Warnf("failed attempt to unlock publishing: %v", err)
+		return err
+	}
+	publishLock.Lock()
+	defer publishLock.Unlock()
+	lockLog.Info("publishing unlocked")
+	return writeLockStatus(LockStatus{LastActivity: Now()})
+}
+
+// CheckPublishLock returns an error if publishing is locked. Otherwise it records the publishing activity which keeps
+// publishing unlocked.
+func CheckPublishLock() error {
+	publishLock.Lock()
+	defer publishLock.Unlock()
+	if !lockConfigured() && !PathExists(lockFile()) {
+		return nil
+	}
+	s, err := readLockStatus()
+	if err != nil {
+		return err
+	}
+	if s.Locked {
+		lockLog.Warnf("refused to publish while publishing is locked")
+		return fmt.Errorf("publishing is locked, unlock it with patr lock unlock")
+	}
+	s.LastActivity = Now()
+	return writeLockStatus(s)
+}
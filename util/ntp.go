@@ -0,0 +1,120 @@
+package util
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var clockLog = logging.Logger("patr/clock")
+
+var DefaultNTPServers = []string{"pool.ntp.org", "time.google.com", "time.cloudflare.com"}
+
+// MaxClockSkew is the local clock offset above which a warning is logged.
+var MaxClockSkew = 30 * time.Second
+
+var skewLock = sync.Mutex{}
+var clockSkew time.Duration
+
+// ntpEpochOffset is the number of seconds between the NTP epoch (1900) and the Unix epoch.
+const ntpEpochOffset = 2208988800
+
+func ntpTime(b []byte) time.Time {
+	secs := binary.BigEndian.Uint32(b[0:4])
+	frac := binary.BigEndian.Uint32(b[4:8])
+	nsec := (int64(frac) * 1e9) >> 32
+	return time.Unix(int64(secs)-ntpEpochOffset, nsec)
+}
+
+// QueryNTP asks an SNTP server for the time and returns the offset of the local clock from it. A positive offset means the
+// local clock is behind.
+func QueryNTP(ctx context.Context, server string) (time.Duration, error) {
+	ctx, cancel := WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", net.JoinHostPort(server, "123"))
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
+	req := make([]byte, 48)
+	req[0] = 0x1b // version 3, client mode
+	sent := time.Now()
+	if _, err = conn.Write(req); err != nil {
+		return 0, err
+	}
+	resp := make([]byte, 48)
+	n, err := conn.Read(resp)
+	received := time.Now()
+	if err != nil {
+		return 0, err
+	}
+	if n < 48 {
+		return 0, fmt.Errorf("short NTP response from %s", server)
+	}
+	if resp[1] == 0 {
+		return 0, fmt.Errorf("NTP server %s sent a kiss-of-death response", server)
+	}
+	rx := ntpTime(resp[32:40])
+	tx := ntpTime(resp[40:48])
+	return (rx.Sub(sent) + tx.Sub(received)) / 2, nil
+}
+
+// CheckClockSkew measures the local clock offset against the first NTP server which responds and logs a warning if it is
+// more than MaxClockSkew, since event timestamps and IPNS record lifetimes depend on the local clock.
+func CheckClockSkew(ctx context.Context, servers []string) (time.Duration, error) {
+	if len(servers) == 0 {
+		servers = DefaultNTPServers
+	}
+	var err error
+	for _, s := range servers {
+		var offset time.Duration
+		if offset, err = QueryNTP(ctx, s); err != nil {
+			clockLog.Debugf("could not query NTP server %s: %v", s, err)
+			continue
+		}
+		skewLock.Lock()
+		clockSkew = offset
+		skewLock.Unlock()
+		if offset > MaxClockSkew || offset < -MaxClockSkew {
+			clockLog.Warnf("local clock is off by %v according to NTP server %s, event timestamps and IPNS records may be rejected", offset, s)
+		} else {
+			clockLog.Debugf("local clock offset is %v according to NTP server %s", offset, s)
+		}
+		return offset, nil
+	}
+	clockLog.Warnf("could not check the local clock against NTP servers %v: %v", servers, err)
+	return 0, err
+}
+
+// ClockSkew returns the last measured offset of the local clock.
+func ClockSkew() time.Duration {
+	skewLock.Lock()
+	defer skewLock.Unlock()
+	return clockSkew
+}
+
+// ScheduleClockSkewCheck checks the local clock periodically until the context is cancelled.
+func ScheduleClockSkewCheck(ctx context.Context, servers []string, interval time.Duration) {
+	go func() {
+		CheckClockSkew(ctx, servers)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				CheckClockSkew(ctx, servers)
+			}
+		}
+	}()
+}
@@ -0,0 +1,46 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+
+	"rsc.io/qr"
+)
+
+// qrQuietZone is the width in modules of the light border scanners need around a QR code.
+const qrQuietZone = 2
+
+// QRPNG returns a QR code encoding data as a PNG image with scale pixels per module.
+func QRPNG(data string, scale int) ([]byte, error) {
+	c, err := qr.Encode(data, qr.M)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode %s as a QR code: %v", data, err)
+	}
+	if scale > 0 {
+		c.Scale = scale
+	}
+	return c.PNG(), nil
+}
+
+// QRText returns a QR code encoding data drawn with Unicode half blocks, two rows of modules per line, so it can be
+// scanned from a terminal. Light modules are drawn as blocks, which suits terminals with dark backgrounds, unless
+// invert is true.
+func QRText(data string, invert bool) (string, error) {
+	c, err := qr.Encode(data, qr.M)
+	if err != nil {
+		return "", fmt.Errorf("could not encode %s as a QR code: %v", data, err)
+	}
+	light := func(x, y int) bool {
+		dark := x >= 0 && y >= 0 && x < c.Size && y < c.Size && c.Black(x, y)
+		return dark == invert
+	}
+	blocks := map[[2]bool]string{{true, true}: "█", {true, false}: "▀", {false, true}: "▄", {false, false}: " "}
+	var sb strings.Builder
+	for y := -qrQuietZone; y < c.Size+qrQuietZone; y += 2 {
+		for x := -qrQuietZone; x < c.Size+qrQuietZone; x++ {
+			sb.WriteString(blocks[[2]bool{light(x, y), light(x, y+1)}])
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String(), nil
+}
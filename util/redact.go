@@ -0,0 +1,165 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	logging "github.com/ipfs/go-log/v2"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// LogSensitive turns off the redaction of sensitive values in logs. It is only for debugging and must be enabled
+// explicitly.
+var LogSensitive = false
+
+// Redacted replaces keys and other secrets in logs.
+const Redacted = "[REDACTED]"
+
+var secrets = map[string]bool{}
+var secretsLock = sync.RWMutex{}
+
+// redactions mask values which look like secrets even if they were not registered: nsec private keys, bearer tokens,
+// JWTs like Web3.Storage tokens, Infura project keys in URLs and secrets in key=value pairs. Bearer tokens keep their
+// first characters so it can be seen which token was used.
+var redactions = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile(`nsec1[02-9ac-hj-np-z]{20,}`), "nsec1" + Redacted},
+	{regexp.MustCompile(`(?i)(bearer\s+)([A-Za-z0-9]{4})[A-Za-z0-9._~+/=-]*`), "${1}${2}…"},
+	{regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`), Redacted},
+	{regexp.MustCompile(`(infura\.io/v3/)[A-Za-z0-9]+`), "${1}" + Redacted},
+	{regexp.MustCompile(`(?i)((?:token|secret|passphrase|password|privkey|private_?key|api_?key)["']?\s*[:=]\s*["']?)[^\s"'&,}]+`), "${1}" + Redacted},
+}
+
+// AddSecrets registers values like private keys and API keys which are masked wherever they appear in logs. Values
+// shorter than 8 characters are ignored so common words aren't masked.
+func AddSecrets(values ...string) {
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+	for _, v := range values {
+		if len(v) >= 8 {
+			secrets[v] = true
+		}
+	}
+}
+
+// Sensitive is a value like the content of a DM which is redacted from logs unless LogSensitive is enabled. It is
+// passed to log calls in place of the string.
+type Sensitive string
+
+func (s Sensitive) String() string {
+	if LogSensitive {
+		return string(s)
+	}
+	return fmt.Sprintf("[%v characters redacted]", len(s))
+}
+
+// Redact masks the registered secrets and values which look like secrets in a log message unless LogSensitive is
+// enabled.
+func Redact(s string) string {
+	if LogSensitive {
+		return s
+	}
+	secretsLock.RLock()
+	values := make([]string, 0, len(secrets))
+	for v := range secrets {
+		if strings.Contains(s, v) {
+			values = append(values, v)
+		}
+	}
+	secretsLock.RUnlock()
+	// Longer secrets first so a secret containing another is masked whole.
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	for _, v := range values {
+		s = strings.ReplaceAll(s, v, Redacted)
+	}
+	for _, r := range redactions {
+		s = r.re.ReplaceAllString(s, r.repl)
+	}
+	return s
+}
+
+// redactingCore is a logging core which redacts the messages and string fields of log entries.
+type redactingCore struct {
+	zapcore.Core
+}
+
+func redactFields(fields []zapcore.Field) []zapcore.Field {
+	redacted := make([]zapcore.Field, len(fields))
+	for i, f := range fields {
+		if f.Type == zapcore.StringType {
+			f.String = Redact(f.String)
+		} else if f.Type == zapcore.ErrorType {
+			if err, ok := f.Interface.(error); ok {
+				f = zap.String(f.Key, Redact(err.Error()))
+			}
+		}
+		redacted[i] = f
+	}
+	return redacted
+}
+
+func (c redactingCore) With(fields []zapcore.Field) zapcore.Core {
+	return redactingCore{c.Core.With(redactFields(fields))}
+}
+
+func (c redactingCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c redactingCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	ent.Message = Redact(ent.Message)
+	return c.Core.Write(ent, redactFields(fields))
+}
+
+// RedactLogs replaces the primary logging core with one which writes to the same outputs in the same format and
+// redacts sensitive values from every log entry.
+func RedactLogs() error {
+	cfg := logging.GetConfig()
+	paths := []string{}
+	if cfg.Stderr {
+		paths = append(paths, "stderr")
+	}
+	if cfg.Stdout {
+		paths = append(paths, "stdout")
+	}
+	if cfg.File != "" {
+		paths = append(paths, cfg.File)
+	}
+	if cfg.URL != "" {
+		paths = append(paths, cfg.URL)
+	}
+	ws, _, err := zap.Open(paths...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not open log outputs %v: %v\n", paths, err)
+		return err
+	}
+	enc := zap.NewProductionEncoderConfig()
+	enc.EncodeTime = zapcore.ISO8601TimeEncoder
+	var encoder zapcore.Encoder
+	switch cfg.Format {
+	case logging.JSONOutput:
+		encoder = zapcore.NewJSONEncoder(enc)
+	case logging.PlaintextOutput:
+		enc.EncodeLevel = zapcore.CapitalLevelEncoder
+		encoder = zapcore.NewConsoleEncoder(enc)
+	default:
+		enc.EncodeLevel = zapcore.CapitalColorLevelEncoder
+		encoder = zapcore.NewConsoleEncoder(enc)
+	}
+	var core zapcore.Core = zapcore.NewCore(encoder, ws, zap.NewAtomicLevelAt(zapcore.DebugLevel))
+	for k, v := range cfg.Labels {
+		core = core.With([]zapcore.Field{zap.String(k, v)})
+	}
+	logging.SetPrimaryCore(redactingCore{core})
+	return nil
+}
@@ -0,0 +1,152 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+// RetryPolicy is how a network client retries failed calls.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	// Jitter is the fraction of each backoff which is randomized e.g. 0.2 means +/- 20%.
+	Jitter float64
+}
+
+// HTTPStatusError is returned by network clients for unsuccessful HTTP responses so the status can be used to decide
+// whether a call is retried.
+type HTTPStatusError struct {
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *HTTPStatusError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("HTTP response status: %s", e.Status)
+	}
+	return fmt.Sprintf("HTTP response status: %s %s", e.Status, e.Body)
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks an error as not retryable.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err}
+}
+
+// Retryable classifies errors from network calls. Cancelled calls, errors marked permanent and HTTP client errors
+// other than 408 and 429 are not retried; everything else is assumed to be transient.
+func Retryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var perr *permanentError
+	if errors.As(err, &perr) {
+		return false
+	}
+	var herr *HTTPStatusError
+	if errors.As(err, &herr) {
+		return herr.StatusCode >= 500 || herr.StatusCode == http.StatusTooManyRequests || herr.StatusCode == http.StatusRequestTimeout
+	}
+	return true
+}
+
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second, MaxBackoff: 30 * time.Second, Multiplier: 2, Jitter: 0.2}
+
+// RetryPolicies are the retry policies of each network client: w3s, pinning, blockchain, relay and gateway. The
+// remote-pins policy is how often failed remote pins are retried in the background. Clients without a policy use
+// DefaultRetryPolicy.
+var RetryPolicies = map[string]RetryPolicy{
+	"w3s":         {MaxAttempts: 5, InitialBackoff: 2 * time.Second, MaxBackoff: time.Minute, Multiplier: 2, Jitter: 0.2},
+	"pinning":     {MaxAttempts: 5, InitialBackoff: 2 * time.Second, MaxBackoff: time.Minute, Multiplier: 2, Jitter: 0.2},
+	"remote-pins": {MaxAttempts: 8, InitialBackoff: 10 * time.Minute, MaxBackoff: 24 * time.Hour, Multiplier: 3, Jitter: 0.2},
+	"blockchain":  {MaxAttempts: 3, InitialBackoff: time.Second, MaxBackoff: 10 * time.Second, Multiplier: 2, Jitter: 0.2},
+	"relay":       {MaxAttempts: 3, InitialBackoff: time.Second, MaxBackoff: 30 * time.Second, Multiplier: 2, Jitter: 0.2},
+	"gateway":     {MaxAttempts: 2, InitialBackoff: 5 * time.Second, MaxBackoff: 5 * time.Second, Multiplier: 1, Jitter: 0.5},
+}
+
+var retryLock = sync.RWMutex{}
+
+var retryLog = logging.Logger("patr/retry")
+
+// SetRetryPolicy replaces the retry policy of a network client.
+func SetRetryPolicy(client string, p RetryPolicy) {
+	retryLock.Lock()
+	defer retryLock.Unlock()
+	RetryPolicies[client] = p
+}
+
+func GetRetryPolicy(client string) RetryPolicy {
+	retryLock.RLock()
+	defer retryLock.RUnlock()
+	if p, ok := RetryPolicies[client]; ok {
+		return p
+	}
+	return DefaultRetryPolicy
+}
+
+// Backoff returns the delay before the given retry attempt, starting at 1.
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	d := float64(p.InitialBackoff)
+	for i := 1; i < attempt; i++ {
+		d *= p.Multiplier
+	}
+	if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+		d = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+// Do calls f until it succeeds, returns an error which is not retryable, the policy runs out of attempts or the
+// context is cancelled.
+func (p RetryPolicy) Do(ctx context.Context, op string, f func(ctx context.Context) error) error {
+	attempts := p.MaxAttempts
+	if attempts <= 0 {
+		attempts = 1
+	}
+	var err error
+	for i := 1; i <= attempts; i++ {
+		if err = f(ctx); err == nil || !Retryable(err) || i == attempts {
+			return err
+		}
+		d := p.Backoff(i)
+		retryLog.Warnf("%s failed (attempt %v of %v), retrying in %v: %v", op, i, attempts, d, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(d):
+		}
+	}
+	return err
+}
+
+// Retry calls f using the retry policy of a network client.
+func Retry(ctx context.Context, client string, op string, f func(ctx context.Context) error) error {
+	return GetRetryPolicy(client).Do(ctx, op, f)
+}
@@ -1,20 +1,52 @@
 package util
 
 import (
+	"context"
+	"net"
+	"net/http"
 	"os"
 	"path/filepath"
+	"time"
 )
 
+var Version = "0.1.0"
+
 var AppData = filepath.Join(GetUserHomeDir(), ".patr")
 
 var ServerConfigFile = filepath.Join(AppData, "node.json")
 
 var DbDir = filepath.Join(AppData, "db")
 
+var IPFSRepoDir = filepath.Join(AppData, "ipfs")
+
 var ClientConfigFile = filepath.Join(AppData, "client.json")
 
 var Shutdown = false
 
+// Now is the time source used for timestamps. It is replaced with a fake clock on the devnet.
+var Now = time.Now
+
+// DryRun is set when commands should only report the blocks, names and remote services they would touch.
+var DryRun = false
+
+// SetAppData changes the node data directory and the files in it.
+func SetAppData(dir string) {
+	AppData = dir
+	ServerConfigFile = filepath.Join(AppData, "node.json")
+	DbDir = filepath.Join(AppData, "db")
+	IPFSRepoDir = filepath.Join(AppData, "ipfs")
+	ClientConfigFile = filepath.Join(AppData, "client.json")
+}
+
+// WithTimeout returns a context which is cancelled after d or when the parent context is cancelled.
+// A zero or negative duration means the operation has no timeout of its own.
+func WithTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
 func GetUserHomeDir() string {
 	h, err := os.UserHomeDir()
 	if err != nil {
@@ -39,3 +71,13 @@ func PathExists(path string) bool {
 		return true
 	}
 }
+
+// IsLocalRequest returns true if an HTTP request comes from the local machine.
+func IsLocalRequest(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,67 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWithTimeoutExpires(t *testing.T) {
+	ctx, cancel := WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("context with a timeout was not cancelled when it expired")
+	}
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		t.Errorf("expired context error is %v, expected %v", ctx.Err(), context.DeadlineExceeded)
+	}
+}
+
+func TestWithTimeoutPropagatesCancel(t *testing.T) {
+	for _, d := range []time.Duration{0, time.Hour} {
+		parent, cancelParent := context.WithCancel(context.Background())
+		ctx, cancel := WithTimeout(parent, d)
+		cancelParent()
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("context with timeout %v was not cancelled with its parent", d)
+		}
+		if !errors.Is(ctx.Err(), context.Canceled) {
+			t.Errorf("context with timeout %v has error %v, expected %v", d, ctx.Err(), context.Canceled)
+		}
+		cancel()
+	}
+}
+
+func TestRetryStopsWhenCancelled(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Hour, MaxBackoff: time.Hour, Multiplier: 1}
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	done := make(chan error)
+	go func() {
+		done <- p.Do(ctx, "test", func(ctx context.Context) error {
+			attempts++
+			return errors.New("transient error")
+		})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("cancelled retry succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("retry did not stop when its context was cancelled")
+	}
+	if attempts != 1 {
+		t.Errorf("cancelled retry made %v attempts, expected 1", attempts)
+	}
+	if err := p.Do(ctx, "test", func(ctx context.Context) error { return ctx.Err() }); !errors.Is(err, context.Canceled) {
+		t.Errorf("retry with a cancelled context returned %v, expected %v", err, context.Canceled)
+	}
+}
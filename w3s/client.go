@@ -5,9 +5,12 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"time"
 
 	ipns_pb "github.com/ipfs/boxo/ipns/pb"
 	"github.com/ipfs/go-cid"
+
+	"github.com/allisterb/patr/devnet"
 )
 
 // Web3Response is a response to a call to the Get method.
@@ -17,6 +20,9 @@ type Web3Response struct {
 
 const clientName = "web3.storage/go"
 
+// RequestTimeout is the maximum time a request to the web3.storage API can take.
+var RequestTimeout = 5 * time.Minute
+
 // Client is a HTTP API client to the web3.storage service.
 type Client interface {
 	Get(context.Context, cid.Cid) (*Web3Response, error)
@@ -60,7 +66,8 @@ func (c *client) SetAuthToken(token string) {
 	c.cfg.token = token
 }
 
-// NewClient creates a new web3.storage API client.
+// NewClient creates a new web3.storage API client. The client uses the w3up API if it is configured with ConfigureUp, and
+// the token API otherwise.
 func NewClient(options ...Option) (Client, error) {
 	cfg := clientConfig{
 		endpoint: "https://api.web3.storage",
@@ -71,9 +78,15 @@ func NewClient(options ...Option) (Client, error) {
 			return nil, err
 		}
 	}
-	if cfg.token == "" {
+	if cfg.token == "" && !UpConfigured() {
 		return nil, fmt.Errorf("missing auth token")
 	}
+	if devnet.Enabled {
+		return newDevnetClient(cfg.token)
+	}
+	if UpConfigured() {
+		return newUpClient(upConfig, cfg.token, cfg.hc), nil
+	}
 	c := client{cfg: &cfg}
 	return &c, nil
 }
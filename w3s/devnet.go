@@ -0,0 +1,111 @@
+package w3s
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	ipns_pb "github.com/ipfs/boxo/ipns/pb"
+	"github.com/ipfs/go-cid"
+
+	"github.com/allisterb/patr/devnet"
+	"github.com/allisterb/patr/util"
+)
+
+// devnetClient is a mock web3.storage client used on the devnet which stores CARs and IPNS records in the
+// devnet directory shared by all devnet nodes.
+type devnetClient struct {
+	token string
+	dir   string
+}
+
+func newDevnetClient(token string) (*devnetClient, error) {
+	dir := filepath.Join(devnet.Dir, "w3s")
+	for _, d := range []string{filepath.Join(dir, "car"), filepath.Join(dir, "name")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &devnetClient{token: token, dir: dir}, nil
+}
+
+func (c *devnetClient) carFile(cid cid.Cid) string {
+	return filepath.Join(c.dir, "car", cid.String()+".car")
+}
+
+func (c *devnetClient) Get(ctx context.Context, cid cid.Cid) (*Web3Response, error) {
+	f, err := os.Open(c.carFile(cid))
+	if err != nil {
+		return &Web3Response{Response: &http.Response{StatusCode: 404, Status: "404 Not Found", Body: io.NopCloser(&bytes.Buffer{})}}, nil
+	}
+	return &Web3Response{Response: &http.Response{StatusCode: 200, Status: "200 OK", Body: f}}, nil
+}
+
+func (c *devnetClient) PutCar(ctx context.Context, r io.Reader) (cid.Cid, error) {
+	if err := devnet.Inject(ctx, devnet.FaultW3SUpload); err != nil {
+		return cid.Undef, err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return cid.Undef, err
+	}
+	cr, err := NewCarReader(bytes.NewReader(data))
+	if err != nil {
+		return cid.Undef, err
+	}
+	if len(cr.Header.Roots) == 0 {
+		return cid.Undef, fmt.Errorf("CAR data has no roots")
+	}
+	root := cr.Header.Roots[0]
+	if err = os.WriteFile(c.carFile(root), data, 0644); err != nil {
+		return cid.Undef, err
+	}
+	return root, nil
+}
+
+func (c *devnetClient) Status(ctx context.Context, cid cid.Cid) (*Status, error) {
+	fi, err := os.Stat(c.carFile(cid))
+	if err != nil {
+		return nil, fmt.Errorf("HTTP response status: 404 Not Found")
+	}
+	return &Status{Cid: cid, DagSize: uint64(fi.Size()), Created: fi.ModTime()}, nil
+}
+
+func (c *devnetClient) Pin(ctx context.Context, cid cid.Cid, options ...PinOption) (*PinResponse, error) {
+	return &PinResponse{RequestID: cid.String(), Status: "pinned", Created: util.Now()}, nil
+}
+
+func (c *devnetClient) GetName(ctx context.Context, name string) (*ipns_pb.IpnsEntry, error) {
+	b, err := os.ReadFile(filepath.Join(c.dir, "name", name))
+	if err != nil {
+		return nil, nil
+	}
+	n := ipns_pb.IpnsEntry{}
+	err = n.Unmarshal(b)
+	return &n, err
+}
+
+func (c *devnetClient) PutName(ctx context.Context, record *ipns_pb.IpnsEntry, name string) error {
+	if err := devnet.Inject(ctx, devnet.FaultW3SUpload); err != nil {
+		return err
+	}
+	b, err := record.Marshal()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(c.dir, "name", name), b, 0644)
+}
+
+func (c *devnetClient) GetAuthToken() string {
+	return c.token
+}
+
+func (c *devnetClient) SetAuthToken(token string) {
+	c.token = token
+}
+
+var _ Client = (*devnetClient)(nil)
@@ -10,16 +10,34 @@ import (
 	"strings"
 
 	ipns_pb "github.com/ipfs/boxo/ipns/pb"
+
+	"github.com/allisterb/patr/util"
 )
 
+// NameEndpoint is the URL of the w3name API IPNS records are published to and looked up from.
+const NameEndpoint = "https://name.web3.storage"
+
 func (c *client) GetName(ctx context.Context, name string) (*ipns_pb.IpnsEntry, error) {
-	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/name/%s", "https://name.web3.storage", name), nil)
+	return getName(ctx, c.cfg.hc, c.cfg.token, name)
+}
+
+func (c *client) PutName(ctx context.Context, record *ipns_pb.IpnsEntry, name string) error {
+	return putName(ctx, c.cfg.hc, c.cfg.token, record, name)
+}
+
+// getName looks up the IPNS record of a name with w3name, sending the token of the token API if it is set.
+func getName(ctx context.Context, hc *http.Client, token string, name string) (*ipns_pb.IpnsEntry, error) {
+	ctx, cancel := util.WithTimeout(ctx, RequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/name/%s", NameEndpoint, name), nil)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", c.cfg.token))
+	if token != "" && token != "none" {
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
 	req.Header.Add("X-Client", clientName)
-	res, err := c.cfg.hc.Do(req)
+	res, err := hc.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -27,7 +45,7 @@ func (c *client) GetName(ctx context.Context, name string) (*ipns_pb.IpnsEntry,
 	if res.StatusCode == 400 || res.StatusCode == 404 {
 		return nil, err
 	} else if res.StatusCode != 200 {
-		return nil, fmt.Errorf("HTTP response status: %s", res.Status)
+		return nil, &util.HTTPStatusError{StatusCode: res.StatusCode, Status: res.Status}
 	}
 
 	d := json.NewDecoder(res.Body)
@@ -51,7 +69,10 @@ func (c *client) GetName(ctx context.Context, name string) (*ipns_pb.IpnsEntry,
 	return &n, err
 }
 
-func (c *client) PutName(ctx context.Context, record *ipns_pb.IpnsEntry, name string) error {
+// putName publishes the IPNS record of a name with w3name, sending the token of the token API if it is set.
+func putName(ctx context.Context, hc *http.Client, token string, record *ipns_pb.IpnsEntry, name string) error {
+	ctx, cancel := util.WithTimeout(ctx, RequestTimeout)
+	defer cancel()
 	b, err := record.Marshal()
 	if err != nil {
 		return err
@@ -60,21 +81,23 @@ func (c *client) PutName(ctx context.Context, record *ipns_pb.IpnsEntry, name st
 
 	//w.Write(b)
 	//w.Close()
-	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/name/%s", "https://name.web3.storage", name), strings.NewReader(s))
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/name/%s", NameEndpoint, name), strings.NewReader(s))
 	if err != nil {
 		return err
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", c.cfg.token))
+	if token != "" && token != "none" {
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
 	req.Header.Add("X-Client", clientName)
 
-	res, err := c.cfg.hc.Do(req)
+	res, err := hc.Do(req)
 	if err != nil {
 		return err
 	}
 	if res.StatusCode != 200 {
 		//var b bytes.Buffer
 		b, _ := io.ReadAll(res.Body)
-		return fmt.Errorf("HTTP response status: %s %s", res.Status, string(b))
+		return &util.HTTPStatusError{StatusCode: res.StatusCode, Status: res.Status, Body: string(b)}
 	}
 	d := json.NewDecoder(res.Body)
 	var out struct {
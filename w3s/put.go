@@ -8,9 +8,13 @@ import (
 	"net/http"
 
 	"github.com/ipfs/go-cid"
+
+	"github.com/allisterb/patr/util"
 )
 
 func (c *client) PutCar(ctx context.Context, r io.Reader) (cid.Cid, error) {
+	ctx, cancel := util.WithTimeout(ctx, RequestTimeout)
+	defer cancel()
 	req, err := http.NewRequestWithContext(ctx, "POST", c.cfg.endpoint+"/car", r)
 	if err != nil {
 		return cid.Undef, err
@@ -24,7 +28,7 @@ func (c *client) PutCar(ctx context.Context, r io.Reader) (cid.Cid, error) {
 	}
 	if res.StatusCode != 200 {
 		b, _ := io.ReadAll(res.Body)
-		return cid.Undef, fmt.Errorf("error putting CAR data to Web3.Storage: %v %v", res.Status, string(b))
+		return cid.Undef, &util.HTTPStatusError{StatusCode: res.StatusCode, Status: res.Status, Body: string(b)}
 	}
 	d := json.NewDecoder(res.Body)
 	var out struct {
@@ -9,6 +9,8 @@ import (
 
 	"github.com/ipfs/go-cid"
 	"github.com/libp2p/go-libp2p/core/peer"
+
+	"github.com/allisterb/patr/util"
 )
 
 const iso8601 = "2006-01-02T15:04:05.999Z07:00"
@@ -253,6 +255,8 @@ func (s *Status) UnmarshalJSON(b []byte) error {
 }
 
 func (c *client) Status(ctx context.Context, cid cid.Cid) (*Status, error) {
+	ctx, cancel := util.WithTimeout(ctx, RequestTimeout)
+	defer cancel()
 	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/status/%s", c.cfg.endpoint, cid), nil)
 	if err != nil {
 		return nil, err
@@ -264,7 +268,7 @@ func (c *client) Status(ctx context.Context, cid cid.Cid) (*Status, error) {
 		return nil, err
 	}
 	if res.StatusCode != 200 {
-		return nil, fmt.Errorf("unexpected response status: %d", res.StatusCode)
+		return nil, &util.HTTPStatusError{StatusCode: res.StatusCode, Status: res.Status}
 	}
 	var s Status
 	d := json.NewDecoder(res.Body)
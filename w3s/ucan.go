@@ -0,0 +1,328 @@
+package w3s
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/codec/dagjson"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/multiformats/go-multibase"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// UCANVersion is the version of the UCANs the agent signs.
+const UCANVersion = "0.9.1"
+
+// Multicodec codes of keys, signatures and DIDs in UCANs.
+const (
+	ed25519PubCode  = 0xed
+	ed25519PrivCode = 0x1300
+	eddsaSigCode    = 0xd0ed
+	didCoreCode     = 0x0d1d
+)
+
+// ucanHeader is the JWT header of the payload the signatures of UCANs sign.
+var ucanHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"EdDSA","typ":"JWT","ucv":"` + UCANVersion + `"}`))
+
+// Agent is the Ed25519 key the node signs UCAN invocations to the w3up service with. Its did:key DID is the audience of
+// the delegation of the capabilities of the space uploads are stored in.
+type Agent struct {
+	key ed25519.PrivateKey
+}
+
+func uvarint(n uint64) []byte {
+	b := make([]byte, binary.MaxVarintLen64)
+	return b[:binary.PutUvarint(b, n)]
+}
+
+// GenerateAgentKey generates an agent key, formatted like the keys of the w3 CLI as multibase base64 with multicodec
+// prefixes.
+func GenerateAgentKey() (string, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	return formatAgentKey(priv)
+}
+
+func formatAgentKey(priv ed25519.PrivateKey) (string, error) {
+	b := append(uvarint(ed25519PrivCode), priv.Seed()...)
+	b = append(append(b, uvarint(ed25519PubCode)...), priv.Public().(ed25519.PublicKey)...)
+	return multibase.Encode(multibase.Base64pad, b)
+}
+
+// ParseAgent parses an agent key generated by GenerateAgentKey or the w3 CLI.
+func ParseAgent(key string) (*Agent, error) {
+	_, b, err := multibase.Decode(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid w3up agent key: %v", err)
+	}
+	code, n := binary.Uvarint(b)
+	if n <= 0 || code != ed25519PrivCode || len(b) < n+ed25519.SeedSize {
+		return nil, fmt.Errorf("the w3up agent key is not an Ed25519 private key")
+	}
+	return &Agent{key: ed25519.NewKeyFromSeed(b[n : n+ed25519.SeedSize])}, nil
+}
+
+// DID returns the did:key DID of the agent.
+func (a *Agent) DID() string {
+	b := append(uvarint(ed25519PubCode), a.key.Public().(ed25519.PublicKey)...)
+	s, _ := multibase.Encode(multibase.Base58BTC, b)
+	return "did:key:" + s
+}
+
+// sign returns the signature of data as a varsig, which has the multicodec code and length of the signature.
+func (a *Agent) sign(data []byte) []byte {
+	sig := ed25519.Sign(a.key, data)
+	return append(append(uvarint(eddsaSigCode), uvarint(uint64(len(sig)))...), sig...)
+}
+
+// encodeDID encodes a DID as it is stored in UCANs: did:key DIDs as their multicodec public key and other DIDs as the
+// DID without the did: prefix after a multicodec prefix.
+func encodeDID(did string) ([]byte, error) {
+	if strings.HasPrefix(did, "did:key:") {
+		_, b, err := multibase.Decode(strings.TrimPrefix(did, "did:key:"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid DID %s: %v", did, err)
+		}
+		return b, nil
+	}
+	if !strings.HasPrefix(did, "did:") {
+		return nil, fmt.Errorf("invalid DID %s", did)
+	}
+	return append(uvarint(didCoreCode), did[4:]...), nil
+}
+
+// decodeDID decodes a DID stored in a UCAN.
+func decodeDID(b []byte) string {
+	if prefix := uvarint(didCoreCode); bytes.HasPrefix(b, prefix) {
+		return "did:" + string(b[len(prefix):])
+	}
+	s, _ := multibase.Encode(multibase.Base58BTC, b)
+	return "did:key:" + s
+}
+
+// capability is a UCAN capability, the ability to invoke an operation on a resource with caveats which restrict it.
+// Caveats are assembled into the nb map in the order of their keys.
+type capability struct {
+	With string
+	Can  string
+	Nb   func(ma datamodel.MapAssembler)
+}
+
+func (c capability) assemble(na datamodel.NodeAssembler) {
+	qp.Map(3, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "can", qp.String(c.Can))
+		if c.Nb != nil {
+			qp.MapEntry(ma, "nb", qp.Map(4, c.Nb))
+		}
+		qp.MapEntry(ma, "with", qp.String(c.With))
+	})(na)
+}
+
+// invocation is a UCAN invoking capabilities of the issuer on a service, proved by delegations to the issuer.
+type invocation struct {
+	Audience     string
+	Capabilities []capability
+	Proofs       []cid.Cid
+	Expiration   time.Time
+}
+
+func linkList(cids []cid.Cid, asString bool) qp.Assemble {
+	return qp.List(int64(len(cids)), func(la datamodel.ListAssembler) {
+		for _, c := range cids {
+			if asString {
+				qp.ListEntry(la, qp.String(c.String()))
+			} else {
+				qp.ListEntry(la, qp.Link(cidlink.Link{Cid: c}))
+			}
+		}
+	})
+}
+
+func (inv invocation) att() qp.Assemble {
+	return qp.List(int64(len(inv.Capabilities)), func(la datamodel.ListAssembler) {
+		for _, c := range inv.Capabilities {
+			qp.ListEntry(la, c.assemble)
+		}
+	})
+}
+
+// sign signs the invocation with the agent and returns it as a dag-cbor block. The signature is over the JWT form of the
+// UCAN, so the service can verify it whatever the encoding of the UCAN.
+func (inv invocation) sign(a *Agent) (blocks.Block, error) {
+	iss, err := encodeDID(a.DID())
+	if err != nil {
+		return nil, err
+	}
+	aud, err := encodeDID(inv.Audience)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := qp.BuildMap(basicnode.Prototype.Any, 5, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "att", inv.att())
+		qp.MapEntry(ma, "aud", qp.String(inv.Audience))
+		qp.MapEntry(ma, "exp", qp.Int(inv.Expiration.Unix()))
+		qp.MapEntry(ma, "iss", qp.String(a.DID()))
+		qp.MapEntry(ma, "prf", linkList(inv.Proofs, true))
+	})
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err = dagjson.Encode(payload, &buf); err != nil {
+		return nil, err
+	}
+	sig := a.sign([]byte(ucanHeader + "." + base64.RawURLEncoding.EncodeToString(buf.Bytes())))
+	n, err := qp.BuildMap(basicnode.Prototype.Any, 7, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "v", qp.String(UCANVersion))
+		qp.MapEntry(ma, "iss", qp.Bytes(iss))
+		qp.MapEntry(ma, "aud", qp.Bytes(aud))
+		qp.MapEntry(ma, "att", inv.att())
+		qp.MapEntry(ma, "exp", qp.Int(inv.Expiration.Unix()))
+		qp.MapEntry(ma, "prf", linkList(inv.Proofs, false))
+		qp.MapEntry(ma, "s", qp.Bytes(sig))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return encodeBlock(n)
+}
+
+// encodeBlock encodes a node as a dag-cbor block.
+func encodeBlock(n datamodel.Node) (blocks.Block, error) {
+	var buf bytes.Buffer
+	if err := dagcbor.Encode(n, &buf); err != nil {
+		return nil, err
+	}
+	c, err := cid.NewPrefixV1(cid.DagCBOR, mh.SHA2_256).Sum(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return blocks.NewBlockWithCid(buf.Bytes(), c)
+}
+
+// decodeBlock decodes a dag-cbor block.
+func decodeBlock(data []byte) (datamodel.Node, error) {
+	nb := basicnode.Prototype.Any.NewBuilder()
+	if err := dagcbor.Decode(nb, bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	return nb.Build(), nil
+}
+
+// writeBlocksCar writes blocks as a CAR with a root.
+func writeBlocksCar(w io.Writer, root cid.Cid, blks []blocks.Block) error {
+	if err := WriteHeader(&CarHeader{Roots: []cid.Cid{root}, Version: 1}, w); err != nil {
+		return err
+	}
+	for _, b := range blks {
+		if err := LdWrite(w, b.Cid().Bytes(), b.RawData()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readBlocksCar reads the root and the blocks of a CAR.
+func readBlocksCar(r io.Reader) (cid.Cid, map[cid.Cid][]byte, error) {
+	cr, err := NewCarReader(bufio.NewReader(r))
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+	if len(cr.Header.Roots) == 0 {
+		return cid.Undef, nil, fmt.Errorf("CAR data has no roots")
+	}
+	blks := map[cid.Cid][]byte{}
+	for {
+		b, err := cr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return cid.Undef, nil, err
+		}
+		blks[b.Cid()] = b.RawData()
+	}
+	return cr.Header.Roots[0], blks, nil
+}
+
+// Delegation is a UCAN delegating capabilities on a space to the agent, with the delegations proving it.
+type Delegation struct {
+	Root   cid.Cid
+	Blocks []blocks.Block
+	// Audience is the DID the capabilities are delegated to and Resources the DIDs of the spaces they can be used on.
+	Audience  string
+	Resources []string
+}
+
+// ParseDelegation parses a delegation archived as a base64 CAR, like the output of w3 delegation create --base64.
+func ParseDelegation(proof string) (Delegation, error) {
+	data, err := base64.StdEncoding.DecodeString(proof)
+	if err != nil {
+		if _, data, err = multibase.Decode(proof); err != nil {
+			return Delegation{}, fmt.Errorf("the w3up delegation is not base64 encoded: %v", err)
+		}
+	}
+	root, blks, err := readBlocksCar(bytes.NewReader(data))
+	if err != nil {
+		return Delegation{}, fmt.Errorf("the w3up delegation is not a CAR: %v", err)
+	}
+	d := Delegation{Root: root}
+	n, err := decodeBlock(blks[root])
+	if err != nil {
+		return Delegation{}, fmt.Errorf("could not decode w3up delegation: %v", err)
+	}
+	// Delegations archived by newer clients have a root naming the UCAN version and linking to the delegation.
+	if l, err := n.LookupByString("ucan@" + UCANVersion); err == nil {
+		lnk, err := l.AsLink()
+		if err != nil {
+			return Delegation{}, fmt.Errorf("invalid w3up delegation archive: %v", err)
+		}
+		delete(blks, root)
+		d.Root = lnk.(cidlink.Link).Cid
+		if n, err = decodeBlock(blks[d.Root]); err != nil {
+			return Delegation{}, fmt.Errorf("could not decode w3up delegation: %v", err)
+		}
+	}
+	if aud, err := n.LookupByString("aud"); err == nil {
+		if b, err := aud.AsBytes(); err == nil {
+			d.Audience = decodeDID(b)
+		}
+	}
+	if att, err := n.LookupByString("att"); err == nil {
+		it := att.ListIterator()
+		for it != nil && !it.Done() {
+			_, c, err := it.Next()
+			if err != nil {
+				break
+			}
+			if w, err := c.LookupByString("with"); err == nil {
+				if s, err := w.AsString(); err == nil {
+					d.Resources = append(d.Resources, s)
+				}
+			}
+		}
+	}
+	for c, data := range blks {
+		b, err := blocks.NewBlockWithCid(data, c)
+		if err != nil {
+			return Delegation{}, err
+		}
+		d.Blocks = append(d.Blocks, b)
+	}
+	return d, nil
+}
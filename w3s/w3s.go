@@ -10,6 +10,8 @@ import (
 	"time"
 
 	"github.com/ipfs/go-cid"
+
+	"github.com/allisterb/patr/util"
 )
 
 type PinResponse struct {
@@ -146,6 +148,8 @@ type pinConfig struct {
 
 // Pin adds a new pin to Web3.Storage.
 func (c *client) Pin(ctx context.Context, cid cid.Cid, options ...PinOption) (*PinResponse, error) {
+	ctx, cancel := util.WithTimeout(ctx, RequestTimeout)
+	defer cancel()
 	var cfg pinConfig
 	for _, opt := range options {
 		if err := opt(&cfg); err != nil {
@@ -184,7 +188,7 @@ func (c *client) Pin(ctx context.Context, cid cid.Cid, options ...PinOption) (*P
 
 	if res.StatusCode != 200 {
 		b, _ := io.ReadAll(res.Body)
-		return nil, fmt.Errorf("HTTP response status: %s %s", res.Status, string(b))
+		return nil, &util.HTTPStatusError{StatusCode: res.StatusCode, Status: res.Status, Body: string(b)}
 	}
 	defer res.Body.Close()
 
@@ -0,0 +1,67 @@
+package w3s
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+
+	"github.com/allisterb/patr/internal/testutil"
+)
+
+// hangingClient returns a client of an API which never responds until the request is aborted.
+func hangingClient(t *testing.T) Client {
+	t.Helper()
+	c, err := NewClient(WithEndpoint(testutil.HangingServer(t)), WithToken("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func testCid(t *testing.T) cid.Cid {
+	t.Helper()
+	h, err := mh.Sum([]byte("patr"), mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cid.NewCidV1(cid.Raw, h)
+}
+
+func TestRequestsAbortWhenCancelled(t *testing.T) {
+	c, id := hangingClient(t), testCid(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	testutil.Aborts(t, "Status", func() error {
+		_, err := c.Status(ctx, id)
+		return err
+	})
+	testutil.Aborts(t, "PutCar", func() error {
+		_, err := c.PutCar(ctx, bytes.NewReader([]byte{}))
+		return err
+	})
+}
+
+func TestRequestsAbortWhenExpired(t *testing.T) {
+	c, id := hangingClient(t), testCid(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	testutil.Aborts(t, "Status", func() error {
+		_, err := c.Status(ctx, id)
+		return err
+	})
+	timeout := RequestTimeout
+	RequestTimeout = 20 * time.Millisecond
+	defer func() { RequestTimeout = timeout }()
+	testutil.Aborts(t, "Status with RequestTimeout", func() error {
+		_, err := c.Status(context.Background(), id)
+		return err
+	})
+	testutil.Aborts(t, "PutCar with RequestTimeout", func() error {
+		_, err := c.PutCar(context.Background(), bytes.NewReader([]byte{}))
+		return err
+	})
+}
@@ -0,0 +1,327 @@
+package w3s
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	ipns_pb "github.com/ipfs/boxo/ipns/pb"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	mh "github.com/multiformats/go-multihash"
+
+	"github.com/allisterb/patr/util"
+)
+
+// UpEndpoint and UpServiceDID are the URL and DID of the w3up service of web3.storage, which replaces the token API.
+const (
+	UpEndpoint   = "https://up.web3.storage"
+	UpServiceDID = "did:web:web3.storage"
+)
+
+// UpGateway is the gateway CARs stored with w3up are retrieved from.
+var UpGateway = "https://w3s.link"
+
+// carCode is the multicodec code of CAR files, the codec of the CIDs of the shards stored in a space.
+const carCode = 0x0202
+
+// messageVersion is the version of the ucanto agent messages invocations and receipts are sent in.
+const messageVersion = "ucanto/message@7.0.0"
+
+// UpConfig is the configuration of the w3up client: the agent invocations are signed with, the DID of the space uploads
+// are stored in and the delegation of the capabilities of the space to the agent.
+type UpConfig struct {
+	Agent      *Agent
+	Space      string
+	Delegation Delegation
+}
+
+var upConfig *UpConfig
+
+// ConfigureUp configures clients to use the w3up API with an agent key, the DID of a space and a base64 delegation of the
+// store/add and upload/add capabilities of the space to the agent. If the space is empty it is the space the delegation
+// is for. An empty agent key disables w3up.
+func ConfigureUp(agentkey string, space string, proof string) error {
+	if agentkey == "" {
+		upConfig = nil
+		return nil
+	}
+	a, err := ParseAgent(agentkey)
+	if err != nil {
+		return err
+	}
+	if proof == "" {
+		return fmt.Errorf("the w3up agent %s does not have a delegation from a space", a.DID())
+	}
+	d, err := ParseDelegation(proof)
+	if err != nil {
+		return err
+	}
+	if d.Audience != a.DID() {
+		return fmt.Errorf("the w3up delegation is to %s, not the agent %s", d.Audience, a.DID())
+	}
+	if space == "" && len(d.Resources) > 0 {
+		space = d.Resources[0]
+	}
+	if space == "" {
+		return fmt.Errorf("the w3up space is not set")
+	}
+	upConfig = &UpConfig{Agent: a, Space: space, Delegation: d}
+	return nil
+}
+
+// UpConfigured returns true if clients use the w3up API.
+func UpConfigured() bool {
+	return upConfig != nil
+}
+
+// Enabled returns true if a client can store data, because w3up is configured or it has a token for the token API.
+func Enabled(token string) bool {
+	return UpConfigured() || (token != "" && token != "none")
+}
+
+// upClient is a web3.storage client using the w3up API. CARs are stored in the space with store/add and registered as
+// uploads with upload/add. IPNS names are published with w3name, which doesn't need a token.
+type upClient struct {
+	cfg   *UpConfig
+	token string
+	hc    *http.Client
+}
+
+func newUpClient(cfg *UpConfig, token string, hc *http.Client) *upClient {
+	return &upClient{cfg: cfg, token: token, hc: hc}
+}
+
+// invoke sends an invocation of a capability on the space to the w3up service and returns the ok result of its receipt.
+func (c *upClient) invoke(ctx context.Context, can string, nb func(ma datamodel.MapAssembler)) (datamodel.Node, error) {
+	inv := invocation{
+		Audience:     UpServiceDID,
+		Capabilities: []capability{{With: c.cfg.Space, Can: can, Nb: nb}},
+		Proofs:       []cid.Cid{c.cfg.Delegation.Root},
+		Expiration:   util.Now().Add(RequestTimeout),
+	}
+	blk, err := inv.sign(c.cfg.Agent)
+	if err != nil {
+		return nil, fmt.Errorf("could not sign %s invocation: %v", can, err)
+	}
+	msg, err := qp.BuildMap(basicnode.Prototype.Any, 1, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, messageVersion, qp.Map(1, func(ma datamodel.MapAssembler) {
+			qp.MapEntry(ma, "execute", linkList([]cid.Cid{blk.Cid()}, false))
+		}))
+	})
+	if err != nil {
+		return nil, err
+	}
+	root, err := encodeBlock(msg)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err = writeBlocksCar(&buf, root.Cid(), append([]blocks.Block{root, blk}, c.cfg.Delegation.Blocks...)); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", UpEndpoint, &buf)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/vnd.ipld.car")
+	req.Header.Add("Accept", "application/vnd.ipld.car")
+	req.Header.Add("X-Client", clientName)
+	res, err := c.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		b, _ := io.ReadAll(res.Body)
+		return nil, &util.HTTPStatusError{StatusCode: res.StatusCode, Status: res.Status, Body: string(b)}
+	}
+	return receiptResult(res.Body, blk.Cid(), can)
+}
+
+// receiptResult reads the agent message the w3up service replies with and returns the ok result of the receipt of an
+// invocation, or its error.
+func receiptResult(r io.Reader, inv cid.Cid, can string) (datamodel.Node, error) {
+	root, blks, err := readBlocksCar(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid w3up response to %s: %v", can, err)
+	}
+	msg, err := decodeBlock(blks[root])
+	if err != nil {
+		return nil, fmt.Errorf("invalid w3up response to %s: %v", can, err)
+	}
+	n, err := msg.LookupByString(messageVersion)
+	if err == nil {
+		n, err = n.LookupByString("report")
+	}
+	if err == nil {
+		n, err = n.LookupByString(inv.String())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("the w3up response to %s does not have a receipt: %v", can, err)
+	}
+	lnk, err := n.AsLink()
+	if err != nil {
+		return nil, fmt.Errorf("invalid receipt of %s: %v", can, err)
+	}
+	receipt, err := decodeBlock(blks[lnk.(cidlink.Link).Cid])
+	if err != nil {
+		return nil, fmt.Errorf("invalid receipt of %s: %v", can, err)
+	}
+	out, err := receipt.LookupByString("ocm")
+	if err == nil {
+		out, err = out.LookupByString("out")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("the receipt of %s does not have a result: %v", can, err)
+	}
+	if e, err := out.LookupByString("error"); err == nil {
+		msg := "unknown error"
+		if m, err := e.LookupByString("message"); err == nil {
+			msg, _ = m.AsString()
+		}
+		return nil, fmt.Errorf("w3up %s failed: %s", can, msg)
+	}
+	return out.LookupByString("ok")
+}
+
+func lookupString(n datamodel.Node, key string) string {
+	v, err := n.LookupByString(key)
+	if err != nil {
+		return ""
+	}
+	s, _ := v.AsString()
+	return s
+}
+
+// PutCar stores a CAR in the space as a shard and registers it as an upload of its root, returning the root.
+func (c *upClient) PutCar(ctx context.Context, r io.Reader) (cid.Cid, error) {
+	ctx, cancel := util.WithTimeout(ctx, RequestTimeout)
+	defer cancel()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return cid.Undef, err
+	}
+	cr, err := NewCarReader(bytes.NewReader(data))
+	if err != nil {
+		return cid.Undef, err
+	}
+	if len(cr.Header.Roots) == 0 {
+		return cid.Undef, fmt.Errorf("CAR data has no roots")
+	}
+	root := cr.Header.Roots[0]
+	shard, err := cid.NewPrefixV1(carCode, mh.SHA2_256).Sum(data)
+	if err != nil {
+		return cid.Undef, err
+	}
+	ok, err := c.invoke(ctx, "store/add", func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "link", qp.Link(cidlink.Link{Cid: shard}))
+		qp.MapEntry(ma, "size", qp.Int(int64(len(data))))
+	})
+	if err != nil {
+		return cid.Undef, err
+	}
+	if lookupString(ok, "status") == "upload" {
+		if err = c.upload(ctx, ok, data); err != nil {
+			return cid.Undef, err
+		}
+	}
+	if _, err = c.invoke(ctx, "upload/add", func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "root", qp.Link(cidlink.Link{Cid: root}))
+		qp.MapEntry(ma, "shards", linkList([]cid.Cid{shard}, false))
+	}); err != nil {
+		return cid.Undef, err
+	}
+	return root, nil
+}
+
+// upload puts a CAR to the signed URL of the result of store/add with its headers.
+func (c *upClient) upload(ctx context.Context, ok datamodel.Node, data []byte) error {
+	url := lookupString(ok, "url")
+	if url == "" {
+		return fmt.Errorf("the result of store/add does not have an upload URL")
+	}
+	req, err := http.NewRequestWithContext(ctx, "PUT", url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if h, err := ok.LookupByString("headers"); err == nil {
+		it := h.MapIterator()
+		for it != nil && !it.Done() {
+			k, v, err := it.Next()
+			if err != nil {
+				break
+			}
+			ks, _ := k.AsString()
+			vs, _ := v.AsString()
+			req.Header.Set(ks, vs)
+		}
+	}
+	req.ContentLength = int64(len(data))
+	res, err := c.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		b, _ := io.ReadAll(res.Body)
+		return &util.HTTPStatusError{StatusCode: res.StatusCode, Status: res.Status, Body: string(b)}
+	}
+	return nil
+}
+
+func (c *upClient) Get(ctx context.Context, cid cid.Cid) (*Web3Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/ipfs/%s?format=car", UpGateway, cid), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", "application/vnd.ipld.car")
+	res, err := c.hc.Do(req)
+	return &Web3Response{Response: res}, err
+}
+
+// Status checks the gateway has a CID, since w3up has no status API. Only the CID of the status is known.
+func (c *upClient) Status(ctx context.Context, cid cid.Cid) (*Status, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", fmt.Sprintf("%s/ipfs/%s", UpGateway, cid), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, &util.HTTPStatusError{StatusCode: res.StatusCode, Status: res.Status}
+	}
+	return &Status{Cid: cid}, nil
+}
+
+// Pin is not supported by w3up, which only stores uploaded CARs.
+func (c *upClient) Pin(ctx context.Context, cid cid.Cid, options ...PinOption) (*PinResponse, error) {
+	return nil, fmt.Errorf("w3up does not support pinning CID %v by origin, upload it as a CAR", cid)
+}
+
+func (c *upClient) GetName(ctx context.Context, name string) (*ipns_pb.IpnsEntry, error) {
+	return getName(ctx, c.hc, "", name)
+}
+
+func (c *upClient) PutName(ctx context.Context, record *ipns_pb.IpnsEntry, name string) error {
+	return putName(ctx, c.hc, "", record, name)
+}
+
+func (c *upClient) GetAuthToken() string {
+	return c.token
+}
+
+func (c *upClient) SetAuthToken(token string) {
+	c.token = token
+}
+
+var _ Client = (*upClient)(nil)
@@ -0,0 +1,74 @@
+package wiki
+
+import "strconv"
+
+// Op is an operation of a document edit. An insert adds a line after the line with the ID After, or at the start of the
+// document if After is empty. A delete removes the line with the ID ID. Lines inserted by an edit have the ID
+// <edit CID>/<op index>, and ops refer to lines inserted earlier in the same edit as #<op index>.
+type Op struct {
+	Op    string `json:"op"`
+	ID    string `json:"id,omitempty"`
+	After string `json:"after,omitempty"`
+	Text  string `json:"text,omitempty"`
+}
+
+const (
+	OpInsert = "insert"
+	OpDelete = "delete"
+)
+
+// line is a line of a document with its ID.
+type line struct {
+	id      string
+	text    string
+	deleted bool
+}
+
+// diff returns the ops which change the visible lines of a document into the new lines, using the longest common
+// subsequence of the old and new lines.
+func diff(old []line, lines []string) []Op {
+	n, m := len(old), len(lines)
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if old[i].text == lines[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	ops := []Op{}
+	after := ""
+	insert := func(text string) {
+		ops = append(ops, Op{Op: OpInsert, After: after, Text: text})
+		after = "#" + strconv.Itoa(len(ops)-1)
+	}
+	i, j := 0, 0
+	for i < n && j < m {
+		switch {
+		case old[i].text == lines[j]:
+			after = old[i].id
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, Op{Op: OpDelete, ID: old[i].id})
+			i++
+		default:
+			insert(lines[j])
+			j++
+		}
+	}
+	for ; i < n; i++ {
+		ops = append(ops, Op{Op: OpDelete, ID: old[i].id})
+	}
+	for ; j < m; j++ {
+		insert(lines[j])
+	}
+	return ops
+}
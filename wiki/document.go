@@ -0,0 +1,442 @@
+package wiki
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ipfs/go-cid"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipld/go-ipld-prime/codec/dagjson"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/nbd-wtf/go-nostr"
+
+	"github.com/allisterb/patr/ipfs"
+	"github.com/allisterb/patr/node"
+	"github.com/allisterb/patr/util"
+)
+
+// KindDocumentEdit is the kind of the Nostr event a contributor signs a document edit with.
+const KindDocumentEdit = 3079
+
+var log = logging.Logger("patr/wiki")
+
+// Edit is a signed change to a collaborative document. Edits link the heads of the document they were made on, so the
+// edits of a document form a DAG which every node merges in the same order.
+type Edit struct {
+	Cid     cid.Cid
+	Doc     string
+	Parents []cid.Cid
+	Ops     []Op
+	Event   nostr.Event
+}
+
+// EditInfo is an entry of the history of a document.
+type EditInfo struct {
+	Cid     string    `json:"cid"`
+	Author  string    `json:"author"`
+	Created time.Time `json:"created"`
+	Parents []string  `json:"parents"`
+	Ops     int       `json:"ops"`
+}
+
+// Document is a collaborative document built by merging the edits reachable from its heads.
+type Document struct {
+	Name  string
+	Heads []cid.Cid
+	Edits []Edit
+	lines []line
+}
+
+func unsignedNode(doc string, parents []cid.Cid, ops []Op) (datamodel.Node, error) {
+	return qp.BuildMap(basicnode.Prototype.Any, 3, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "doc", qp.String(doc))
+		qp.MapEntry(ma, "parents", qp.List(int64(len(parents)), func(la datamodel.ListAssembler) {
+			for _, p := range parents {
+				qp.ListEntry(la, qp.Link(cidlink.Link{Cid: p}))
+			}
+		}))
+		qp.MapEntry(ma, "ops", qp.List(int64(len(ops)), func(la datamodel.ListAssembler) {
+			for _, o := range ops {
+				qp.ListEntry(la, qp.Map(4, func(ma datamodel.MapAssembler) {
+					qp.MapEntry(ma, "op", qp.String(o.Op))
+					qp.MapEntry(ma, "id", qp.String(o.ID))
+					qp.MapEntry(ma, "after", qp.String(o.After))
+					qp.MapEntry(ma, "text", qp.String(o.Text))
+				}))
+			}
+		}))
+	})
+}
+
+// digest returns the hash of the unsigned part of an edit which the edit event signs.
+func digest(doc string, parents []cid.Cid, ops []Op) (string, error) {
+	n, err := unsignedNode(doc, parents, ops)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err = dagjson.Encode(n, &buf); err != nil {
+		return "", err
+	}
+	h := sha256.Sum256(buf.Bytes())
+	return hex.EncodeToString(h[:]), nil
+}
+
+// writeEdit signs an edit and writes it to IPFS.
+func writeEdit(ctx context.Context, ipfscore ipfs.IPFSCore, privkey string, doc string, parents []cid.Cid, ops []Op) (cid.Cid, error) {
+	d, err := digest(doc, parents, ops)
+	if err != nil {
+		return cid.Undef, err
+	}
+	evt := nostr.Event{
+		CreatedAt: nostr.Timestamp(util.Now().Unix()),
+		Kind:      KindDocumentEdit,
+		Tags:      nostr.Tags{nostr.Tag{"d", doc}},
+		Content:   d,
+	}
+	if err := util.CheckPublishLock(); err != nil {
+		return cid.Undef, err
+	}
+	if err = evt.Sign(privkey); err != nil {
+		log.Errorf("could not sign edit of document %s: %v", doc, err)
+		return cid.Undef, err
+	}
+	evtnode, err := ipfs.NostrEventToIPLDNode(evt)
+	if err != nil {
+		return cid.Undef, err
+	}
+	unsigned, err := unsignedNode(doc, parents, ops)
+	if err != nil {
+		return cid.Undef, err
+	}
+	n, err := qp.BuildMap(basicnode.Prototype.Any, 5, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "type", qp.String("edit"))
+		it := unsigned.MapIterator()
+		for !it.Done() {
+			k, v, _ := it.Next()
+			ks, _ := k.AsString()
+			qp.MapEntry(ma, ks, qp.Node(v))
+		}
+		qp.MapEntry(ma, "event", qp.Node(evtnode))
+	})
+	if err != nil {
+		return cid.Undef, fmt.Errorf("could not create IPLD node for edit of document %s: %v", doc, err)
+	}
+	blk, err := ipfs.PutIPLDNode(ctx, ipfscore, n)
+	if err != nil {
+		log.Errorf("could not write edit of document %s to IPFS: %v", doc, err)
+		return cid.Undef, err
+	}
+	return blk.Cid(), nil
+}
+
+func str(n datamodel.Node, key string) string {
+	v, err := n.LookupByString(key)
+	if err != nil {
+		return ""
+	}
+	s, _ := v.AsString()
+	return s
+}
+
+// readEdit fetches an edit and verifies that it is signed by its author.
+func readEdit(ctx context.Context, ipfscore ipfs.IPFSCore, c cid.Cid) (Edit, error) {
+	ctx, cancel := util.WithTimeout(ctx, ipfs.DHTQueryTimeout)
+	defer cancel()
+	data, err := ipfs.RetrieveBlock(ctx, ipfscore, c)
+	if err != nil {
+		return Edit{}, fmt.Errorf("could not fetch edit %v: %v", c, err)
+	}
+	n, err := ipfs.DecodeIPLDNode(c, data)
+	if err != nil {
+		return Edit{}, fmt.Errorf("could not decode edit %v: %v", c, err)
+	}
+	if str(n, "type") != "edit" {
+		return Edit{}, fmt.Errorf("node %v is not a document edit", c)
+	}
+	e := Edit{Cid: c, Doc: str(n, "doc"), Parents: []cid.Cid{}, Ops: []Op{}}
+	if pn, err := n.LookupByString("parents"); err == nil {
+		it := pn.ListIterator()
+		for it != nil && !it.Done() {
+			_, v, _ := it.Next()
+			l, err := v.AsLink()
+			if err != nil {
+				return Edit{}, fmt.Errorf("edit %v has an invalid parent: %v", c, err)
+			}
+			e.Parents = append(e.Parents, l.(cidlink.Link).Cid)
+		}
+	}
+	if on, err := n.LookupByString("ops"); err == nil {
+		it := on.ListIterator()
+		for it != nil && !it.Done() {
+			_, v, _ := it.Next()
+			e.Ops = append(e.Ops, Op{Op: str(v, "op"), ID: str(v, "id"), After: str(v, "after"), Text: str(v, "text")})
+		}
+	}
+	en, err := n.LookupByString("event")
+	if err != nil {
+		return Edit{}, fmt.Errorf("edit %v is not signed", c)
+	}
+	if e.Event, err = ipfs.IPLDNodeToNostrEvent(en); err != nil {
+		return Edit{}, err
+	}
+	d, err := digest(e.Doc, e.Parents, e.Ops)
+	if err != nil {
+		return Edit{}, err
+	}
+	if e.Event.Kind != KindDocumentEdit || e.Event.Content != d {
+		return Edit{}, fmt.Errorf("the signature of edit %v does not match its content", c)
+	}
+	if ok, err := e.Event.CheckSignature(); err != nil || !ok || e.Event.GetID() != e.Event.ID {
+		return Edit{}, fmt.Errorf("edit %v has an invalid signature", c)
+	}
+	return e, nil
+}
+
+// Load fetches the edits of a document reachable from heads and merges them. Edits are applied in topological order,
+// ordering concurrent edits by time and CID, so every node builds the same document from the same edits.
+func Load(ctx context.Context, ipfscore ipfs.IPFSCore, name string, heads []cid.Cid) (*Document, error) {
+	edits := make(map[cid.Cid]Edit)
+	queue := append([]cid.Cid{}, heads...)
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+		if _, ok := edits[c]; ok {
+			continue
+		}
+		e, err := readEdit(ctx, ipfscore, c)
+		if err != nil {
+			return nil, err
+		}
+		if e.Doc != name {
+			return nil, fmt.Errorf("edit %v is an edit of document %s not %s", c, e.Doc, name)
+		}
+		edits[c] = e
+		queue = append(queue, e.Parents...)
+	}
+	children := make(map[cid.Cid][]cid.Cid)
+	pending := make(map[cid.Cid]int)
+	ready := []Edit{}
+	for c, e := range edits {
+		pending[c] = len(e.Parents)
+		for _, p := range e.Parents {
+			children[p] = append(children[p], c)
+		}
+		if len(e.Parents) == 0 {
+			ready = append(ready, e)
+		}
+	}
+	d := &Document{Name: name, Heads: heads, Edits: []Edit{}, lines: []line{}}
+	for len(ready) > 0 {
+		sort.Slice(ready, func(i, j int) bool {
+			if ready[i].Event.CreatedAt != ready[j].Event.CreatedAt {
+				return ready[i].Event.CreatedAt < ready[j].Event.CreatedAt
+			}
+			return ready[i].Cid.String() < ready[j].Cid.String()
+		})
+		e := ready[0]
+		ready = ready[1:]
+		d.apply(e)
+		for _, c := range children[e.Cid] {
+			if pending[c]--; pending[c] == 0 {
+				ready = append(ready, edits[c])
+			}
+		}
+	}
+	return d, nil
+}
+
+func (d *Document) index(id string) int {
+	for i, l := range d.lines {
+		if l.id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (d *Document) apply(e Edit) {
+	resolve := func(id string) string {
+		if strings.HasPrefix(id, "#") {
+			return e.Cid.String() + "/" + id[1:]
+		}
+		return id
+	}
+	for i, o := range e.Ops {
+		switch o.Op {
+		case OpInsert:
+			pos := 0
+			if o.After != "" {
+				if pos = d.index(resolve(o.After)) + 1; pos == 0 {
+					pos = len(d.lines)
+				}
+			}
+			d.lines = append(d.lines, line{})
+			copy(d.lines[pos+1:], d.lines[pos:])
+			d.lines[pos] = line{id: e.Cid.String() + "/" + strconv.Itoa(i), text: o.Text}
+		case OpDelete:
+			if j := d.index(resolve(o.ID)); j >= 0 {
+				d.lines[j].deleted = true
+			}
+		}
+	}
+	d.Edits = append(d.Edits, e)
+}
+
+func (d *Document) visible() []line {
+	lines := []line{}
+	for _, l := range d.lines {
+		if !l.deleted {
+			lines = append(lines, l)
+		}
+	}
+	return lines
+}
+
+// Text returns the merged text of the document.
+func (d *Document) Text() string {
+	text := []string{}
+	for _, l := range d.visible() {
+		text = append(text, l.text)
+	}
+	return strings.Join(text, "\n")
+}
+
+// History returns the edits of the document, newest first.
+func (d *Document) History() []EditInfo {
+	history := []EditInfo{}
+	for i := len(d.Edits) - 1; i >= 0; i-- {
+		e := d.Edits[i]
+		parents := []string{}
+		for _, p := range e.Parents {
+			parents = append(parents, p.String())
+		}
+		history = append(history, EditInfo{Cid: e.Cid.String(), Author: e.Event.PubKey, Created: e.Event.CreatedAt.Time(), Parents: parents, Ops: len(e.Ops)})
+	}
+	return history
+}
+
+// Heads returns the heads of a document in the node configuration.
+func Heads(name string) []cid.Cid {
+	heads := []cid.Cid{}
+	for _, h := range node.CurrentConfig.Documents[name] {
+		if c, err := cid.Parse(h); err == nil {
+			heads = append(heads, c)
+		}
+	}
+	return heads
+}
+
+func saveHeads(name string, heads []cid.Cid) error {
+	if util.DryRun {
+		return nil
+	}
+	config := node.CurrentConfig
+	docs := make(map[string][]string)
+	for k, v := range config.Documents {
+		docs[k] = v
+	}
+	docs[name] = []string{}
+	for _, h := range heads {
+		docs[name] = append(docs[name], h.String())
+	}
+	config.Documents = docs
+	return node.SaveConfig(config)
+}
+
+// Open loads a document from its heads in the node configuration.
+func Open(ctx context.Context, ipfscore ipfs.IPFSCore, name string) (*Document, error) {
+	if _, ok := node.CurrentConfig.Documents[name]; !ok {
+		return nil, fmt.Errorf("could not find document %s", name)
+	}
+	return Load(ctx, ipfscore, name, Heads(name))
+}
+
+// Write signs an edit changing a document to text, creating the document if it does not exist, and makes it the only
+// head of the document.
+func Write(ctx context.Context, ipfscore ipfs.IPFSCore, privkey string, name string, text string) (cid.Cid, error) {
+	d, err := Load(ctx, ipfscore, name, Heads(name))
+	if err != nil {
+		return cid.Undef, err
+	}
+	ops := diff(d.visible(), strings.Split(strings.TrimRight(text, "\n"), "\n"))
+	if len(ops) == 0 && len(d.Heads) > 0 {
+		return cid.Undef, fmt.Errorf("document %s is unchanged", name)
+	}
+	c, err := writeEdit(ctx, ipfscore, privkey, name, d.Heads, ops)
+	if err != nil {
+		return cid.Undef, err
+	}
+	log.Infof("wrote edit %v of document %s with %v ops", c, name, len(ops))
+	return c, saveHeads(name, []cid.Cid{c})
+}
+
+// Merge adds the edits reachable from a head, usually published by another contributor, to a document. Heads which
+// are ancestors of other heads are dropped.
+func Merge(ctx context.Context, ipfscore ipfs.IPFSCore, name string, head cid.Cid) error {
+	heads := Heads(name)
+	for _, h := range heads {
+		if h.Equals(head) {
+			return nil
+		}
+	}
+	heads = append(heads, head)
+	d, err := Load(ctx, ipfscore, name, heads)
+	if err != nil {
+		return err
+	}
+	ancestors := make(map[cid.Cid]bool)
+	for _, e := range d.Edits {
+		for _, p := range e.Parents {
+			ancestors[p] = true
+		}
+	}
+	merged := []cid.Cid{}
+	for _, h := range heads {
+		if !ancestors[h] {
+			merged = append(merged, h)
+		}
+	}
+	log.Infof("merged %v into document %s, which has %v heads", head, name, len(merged))
+	return saveHeads(name, merged)
+}
+
+// SetDocumentHandlers serves the rendered text of documents at GET /docs/{name} and their history at
+// GET /docs/{name}/history.
+func SetDocumentHandlers(ctx context.Context, ipfscore ipfs.IPFSCore, router *mux.Router) {
+	router.Path("/docs/{name}").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d, err := Open(r.Context(), ipfscore, mux.Vars(r)["name"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		w.Write([]byte(d.Text()))
+	})
+	router.Path("/docs/{name}/history").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d, err := Open(r.Context(), ipfscore, mux.Vars(r)["name"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		heads := []string{}
+		for _, h := range d.Heads {
+			heads = append(heads, h.String())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"name": d.Name, "heads": heads, "edits": d.History()})
+	})
+}